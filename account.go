@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Users register themselves with /register and are kept in the user store, the
+// passwords are only stored as argon2id hashes, see password.go. The users of the config are still
+// accepted, they are meant for operators and can't be changed through the API.
+
+var (
+	ErrInvalidUsername    = errors.New("usernames are 1 to 32 letters, digits, '.', '-' or '_'")
+	ErrWeakPassword       = errors.New("password too short")
+	ErrUserExists         = errors.New("user already exists")
+	ErrConfigUser         = errors.New("user is defined in the config")
+	ErrEmailNotVerified   = errors.New("email not verified")
+	ErrEmailRequired      = errors.New("an email is required to register")
+	ErrRegistrationClosed = errors.New("registration is disabled")
+)
+
+// maxUsernameLength is the longest username in bytes
+var maxUsernameLength = 32
+
+// verificationTimeout bounds the call to the email verifier
+var verificationTimeout = 10 * time.Second
+
+// dummyPasswordHash is compared against when the user doesn't exist, so a failed login
+// takes as long for unknown users as for wrong passwords
+var dummyPasswordHash, _ = hashArgon2id("dummy password", passwordHashParams)
+
+// EmailVerifier sends the link a new user has to open to verify their email
+type EmailVerifier interface {
+	SendVerification(ctx context.Context, user User, link string) error
+}
+
+// WebhookEmailVerifier POSTs the username, email and link as JSON to an URL, the
+// receiver is expected to send the email
+type WebhookEmailVerifier struct {
+	URL string
+}
+
+func (v WebhookEmailVerifier) SendVerification(ctx context.Context, user User, link string) error {
+	return postJSON(ctx, v.URL, nil, map[string]string{
+		"username": user.Username,
+		"email":    user.Email,
+		"link":     link,
+	})
+}
+
+// emailVerifier returns the configured verifier, or nil if emails are not verified
+func (m *Manager) emailVerifier() EmailVerifier {
+	if hook := m.config().Registration.VerificationWebhook; hook != "" {
+		return WebhookEmailVerifier{URL: hook}
+	}
+	return nil
+}
+
+// validateUsername returns an error if the username can't be used
+func validateUsername(username string) error {
+	if username == "" || len(username) > maxUsernameLength {
+		return ErrInvalidUsername
+	}
+	for _, r := range username {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+		default:
+			return ErrInvalidUsername
+		}
+	}
+	return nil
+}
+
+// hashPassword returns the hash of the password to store
+func (m *Manager) hashPassword(password string) (string, error) {
+	if len(password) < m.config().Registration.MinPasswordLength {
+		return "", fmt.Errorf("%w: at least %d characters", ErrWeakPassword, m.config().Registration.MinPasswordLength)
+	}
+	return hashArgon2id(password, passwordHashParams)
+}
+
+// authenticate checks the password of a user of the config or the user store
+// ErrUnauthorized is returned if the user doesn't exist or the password is wrong
+func (m *Manager) authenticate(username, password string) error {
+	if expected, ok := m.config().Users[username]; ok {
+		if !checkConfigPassword(expected, password) {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+
+	user, err := m.store.GetUser(username)
+	if errors.Is(err, ErrNotFound) {
+		checkPassword(dummyPasswordHash, password)
+		return ErrUnauthorized
+	}
+	if err != nil {
+		return err
+	}
+	if !checkPassword(user.PasswordHash, password) {
+		return ErrUnauthorized
+	}
+	// Older hashes are replaced now that the password is known
+	if needsRehash(user.PasswordHash) {
+		if hash, err := hashArgon2id(password, passwordHashParams); err == nil {
+			user.PasswordHash = hash
+			if err := m.store.SaveUser(user); err != nil {
+				log.Println("rehashing password: ", err)
+			}
+		}
+	}
+	if user.VerificationToken != "" {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// userExists returns true if the user is in the config or the user store
+func (m *Manager) userExists(username string) bool {
+	if _, ok := m.config().Users[username]; ok {
+		return true
+	}
+	_, err := m.store.GetUser(username)
+	return err == nil
+}
+
+// registerRequest is the body of /register
+type registerRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+}
+
+// accountResponse is an account as returned by the API, without its secrets
+type accountResponse struct {
+	Username string    `json:"username"`
+	Email    string    `json:"email,omitempty"`
+	Verified bool      `json:"verified"`
+	Created  time.Time `json:"created"`
+}
+
+func newAccountResponse(user User) accountResponse {
+	return accountResponse{
+		Username: user.Username,
+		Email:    user.Email,
+		Verified: user.VerificationToken == "",
+		Created:  user.Created,
+	}
+}
+
+// register creates a user, a verification link is sent if emails are verified
+// publicURL is the URL of the server the link points to
+func (m *Manager) register(ctx context.Context, req registerRequest, publicURL string) (User, error) {
+	if m.config().Registration.Disabled {
+		return User{}, ErrRegistrationClosed
+	}
+	if err := validateUsername(req.Username); err != nil {
+		return User{}, err
+	}
+	if isGuest(req.Username) {
+		return User{}, ErrReservedName
+	}
+	verifier := m.emailVerifier()
+	if verifier != nil && req.Email == "" {
+		return User{}, ErrEmailRequired
+	}
+	if m.userExists(req.Username) {
+		return User{}, ErrUserExists
+	}
+
+	hash, err := m.hashPassword(req.Password)
+	if err != nil {
+		return User{}, err
+	}
+	user := User{
+		Username:     req.Username,
+		PasswordHash: hash,
+		Email:        req.Email,
+		Created:      m.now(),
+	}
+	if verifier != nil {
+		user.VerificationToken = newVerificationToken()
+	}
+	if err := m.store.SaveUser(user); err != nil {
+		return User{}, err
+	}
+	m.audit(AuditEntry{Action: AuditRegister, Actor: user.Username})
+
+	if verifier != nil {
+		link := publicURL + "/verify?" + url.Values{"username": {user.Username}, "token": {user.VerificationToken}}.Encode()
+		ctx, cancel := context.WithTimeout(ctx, verificationTimeout)
+		defer cancel()
+		if err := verifier.SendVerification(ctx, user, link); err != nil {
+			// The user could never login without the link, the registration is undone so it can be retried
+			m.store.DeleteUser(user.Username)
+			return User{}, fmt.Errorf("sending verification email: %w", err)
+		}
+	}
+	return user, nil
+}
+
+// newVerificationToken returns a random token for the verification link
+func newVerificationToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// publicURL returns the configured public URL, or the URL the request was sent to
+func (m *Manager) publicURL(r *http.Request) string {
+	if u := m.config().Registration.PublicURL; u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// registerHandler creates an account, like {"username":"alice","password":"...","email":"..."}
+func (m *Manager) registerHandler(w http.ResponseWriter, r *http.Request) {
+	var req registerRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := m.register(r.Context(), req, m.publicURL(r))
+	switch {
+	case errors.Is(err, ErrRegistrationClosed):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrUserExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrInvalidUsername), errors.Is(err, ErrReservedName), errors.Is(err, ErrWeakPassword), errors.Is(err, ErrEmailRequired):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		log.Println("register: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusCreated, newAccountResponse(user))
+	}
+}
+
+// verifyHandler verifies the email of a user, it is the link sent by the EmailVerifier
+func (m *Manager) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	username, token := r.URL.Query().Get("username"), r.URL.Query().Get("token")
+
+	user, err := m.store.GetUser(username)
+	if err != nil || user.VerificationToken == "" ||
+		subtle.ConstantTimeCompare([]byte(user.VerificationToken), []byte(token)) != 1 {
+		http.Error(w, "invalid verification link", http.StatusNotFound)
+		return
+	}
+
+	user.VerificationToken = ""
+	if err := m.store.SaveUser(user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("email verified, you can login now\n"))
+}
+
+// changePasswordHandler changes the password of a stored user, the current password
+// is required, like {"username":"alice","password":"...","new_password":"..."}
+func (m *Manager) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+		NewPassword string `json:"new_password"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := m.accountOf(w, r, req.Username, req.Password)
+	if !ok {
+		return
+	}
+	hash, err := m.hashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user.PasswordHash = hash
+	if err := m.store.SaveUser(user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.audit(AuditEntry{Action: AuditPasswordChange, Actor: user.Username, RemoteAddr: r.RemoteAddr})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// accountHandler returns the account of the user authenticated with basic auth,
+// DELETE removes the account and disconnects its clients
+func (m *Manager) accountHandler(w http.ResponseWriter, r *http.Request) {
+	username, password, _ := r.BasicAuth()
+	user, ok := m.accountOf(w, r, username, password)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusOK, newAccountResponse(user))
+		return
+	}
+
+	if err := m.store.DeleteUser(user.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := m.store.DeleteProfile(user.Username); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Println("deleting profile: ", err)
+	}
+	m.audit(AuditEntry{Action: AuditAccountDeleted, Actor: user.Username, RemoteAddr: r.RemoteAddr})
+	m.kick(user.Username, user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// accountOf authenticates a stored user for the account endpoints, it writes the
+// error response and returns false if the user can't manage the account
+func (m *Manager) accountOf(w http.ResponseWriter, r *http.Request, username, password string) (User, bool) {
+	if _, ok := m.config().Users[username]; ok {
+		http.Error(w, ErrConfigUser.Error(), http.StatusForbidden)
+		return User{}, false
+	}
+
+	if m.rejectThrottledLogin(w, r, username) {
+		return User{}, false
+	}
+	err := m.authenticate(username, password)
+	if errors.Is(err, ErrUnauthorized) {
+		m.loginFailed(r, username)
+		m.audit(AuditEntry{Action: AuditLoginFailed, Actor: username, RemoteAddr: r.RemoteAddr})
+		w.Header().Set("WWW-Authenticate", `Basic realm="account"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return User{}, false
+	}
+	// Unverified users may still change their password or delete their account
+	if err != nil && !errors.Is(err, ErrEmailNotVerified) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return User{}, false
+	}
+
+	m.loginSucceeded(username)
+
+	user, err := m.store.GetUser(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return User{}, false
+	}
+	return user, true
+}
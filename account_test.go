@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAuthenticateConfigUsers(t *testing.T) {
+	hash, err := hashArgon2id("hashed secret", passwordHashParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.Users = map[string]string{"alice": hash, "bob": "clear secret"}
+	server, m, err := NewTestServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, test := range []struct {
+		username, password string
+		want               error
+	}{
+		{"alice", "hashed secret", nil},
+		{"alice", hash, ErrUnauthorized},
+		{"alice", "wrong", ErrUnauthorized},
+		{"bob", "clear secret", nil},
+		{"bob", "wrong", ErrUnauthorized},
+	} {
+		if err := m.authenticate(test.username, test.password); !errors.Is(err, test.want) {
+			t.Errorf("authenticate(%q, %q) = %v, want %v", test.username, test.password, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+)
+
+// Pinging every client at the same interval wastes a lot of frames on 50k idle
+// connections that are perfectly fine, while a flaky mobile connection could do
+// with more frequent pings. With adaptive pings every stable pong, one arriving
+// within StableRTT without the round trip times jumping around, makes the
+// interval of the client a quarter longer, up to MaxInterval. A slow pong halves
+// it, and a ping still unanswered when the next one is due drops it right to
+// MinInterval. The read deadline follows the interval, a client has PongWait to
+// answer a ping after it was sent.
+
+// currentPingInterval returns how often the client is pinged now
+func (c *Client) currentPingInterval() time.Duration {
+	config := c.manager.config()
+	if !config.AdaptivePing.Enabled {
+		return config.pingInterval()
+	}
+	interval := time.Duration(c.ping.interval.Load())
+	if interval == 0 {
+		interval = config.pingInterval()
+	}
+	// Clamped on every read, so changed bounds apply right away after a config reload
+	return c.clampPingInterval(interval)
+}
+
+// clampPingInterval keeps the interval within the configured bounds
+func (c *Client) clampPingInterval(interval time.Duration) time.Duration {
+	config := c.manager.config().AdaptivePing
+	if config.MaxInterval > 0 {
+		interval = min(interval, time.Duration(config.MaxInterval))
+	}
+	if config.MinInterval > 0 {
+		interval = max(interval, time.Duration(config.MinInterval))
+	}
+	return interval
+}
+
+// adaptPingInterval lengthens the interval after a stable pong and shortens it after a slow one
+// Only the read goroutine calls it
+func (c *Client) adaptPingInterval(rtt time.Duration) {
+	config := c.manager.config().AdaptivePing
+	if !config.Enabled {
+		return
+	}
+	interval := c.currentPingInterval()
+	stable := time.Duration(config.StableRTT)
+	if rtt <= stable && c.roundTripVariance() <= stable/2 {
+		interval += interval / 4
+	} else {
+		interval /= 2
+	}
+	c.ping.interval.Store(int64(c.clampPingInterval(interval)))
+}
+
+// missedPong drops the interval to the minimum, the last ping wasn't answered in time
+// Only the write goroutine calls it
+func (c *Client) missedPong() {
+	config := c.manager.config().AdaptivePing
+	if !config.Enabled {
+		return
+	}
+	debugLog("missed pong")
+	c.ping.interval.Store(int64(c.clampPingInterval(time.Duration(config.MinInterval))))
+}
+
+// readTimeout returns how long the read goroutine waits for a pong before the
+// connection counts as dead
+func (c *Client) readTimeout() time.Duration {
+	config := c.manager.config()
+	if !config.AdaptivePing.Enabled {
+		return config.pongWait()
+	}
+	// The writer may still wait for a longer interval than the current one
+	interval := max(c.currentPingInterval(), time.Duration(c.ping.scheduled.Load()))
+	return interval + config.pongWait()
+}
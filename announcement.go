@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Announcements are system messages sent by operators to every client or to a
+// room. High priority announcements use the priority queue of the clients, so
+// they are not dropped when a client is behind on its egress. In a cluster they
+// are fanned out to the other instances, which send them to their clients.
+
+// Priority levels of system events
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// EventSystem is a message from the server or an operator, not from a user
+const EventSystem = "system"
+
+// announcementHistorySize is how many announcements are kept for the admin API
+const announcementHistorySize = 100
+
+var (
+	ErrInvalidPriority     = errors.New("priority has to be low, normal or high")
+	ErrInvalidAnnouncement = errors.New("announcement needs a message or a code and a sender")
+	ErrAnnouncementRooms   = errors.New("announcement takes either room or rooms")
+)
+
+// SystemEvent is the payload sent in the
+// system event
+type SystemEvent struct {
+	Message string `json:"message"`
+	// Code and Params identify the message for translation, see localize.go
+	Code     string            `json:"code,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+	Priority string            `json:"priority"`
+	Sent     time.Time         `json:"sent"`
+}
+
+// Announcement is a system message sent through the admin API
+type Announcement struct {
+	Message string `json:"message"`
+	// Code is the message in the catalog of the config, translated for each client,
+	// Message is taken from the catalog if it is empty, see localize.go
+	Code     string            `json:"code,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+	Priority string            `json:"priority"`
+	// Room limits the announcement to a room, it goes to all clients if empty
+	Room string `json:"room,omitempty"`
+	// Rooms sends the announcement to several rooms at once, instead of Room
+	Rooms []string `json:"rooms,omitempty"`
+	// Sender is the operator that sent the announcement, the admin API sets it
+	// to the admin whatever the request says
+	Sender    string    `json:"sender"`
+	Sent      time.Time `json:"sent"`
+	Delivered int       `json:"delivered"`
+}
+
+// clusterAnnouncement is an announcement fanned out to the other instances
+type clusterAnnouncement struct {
+	// Rooms are the rooms to send it to, all clients get it if empty
+	Rooms    []string `json:"rooms,omitempty"`
+	Priority string   `json:"priority"`
+	Event    Event    `json:"event"`
+}
+
+// announcementLog keeps the latest announcements and who sent them
+type announcementLog struct {
+	sync.RWMutex
+	entries []Announcement
+}
+
+// add records an announcement, dropping the oldest ones once full
+func (l *announcementLog) add(a Announcement) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.entries = append(l.entries, a)
+	if len(l.entries) > announcementHistorySize {
+		l.entries = l.entries[len(l.entries)-announcementHistorySize:]
+	}
+}
+
+// list returns a copy of the recorded announcements
+func (l *announcementLog) list() []Announcement {
+	l.RLock()
+	defer l.RUnlock()
+
+	return append([]Announcement{}, l.entries...)
+}
+
+// announce sends the announcement as a system event and returns how many clients it was queued for
+func (m *Manager) announce(a Announcement) (int, error) {
+	if a.Priority == "" {
+		a.Priority = PriorityNormal
+	}
+	if a.Priority != PriorityLow && a.Priority != PriorityNormal && a.Priority != PriorityHigh {
+		return 0, ErrInvalidPriority
+	}
+	if (a.Message == "" && a.Code == "") || a.Sender == "" {
+		return 0, ErrInvalidAnnouncement
+	}
+	if a.Message == "" {
+		a.Message = m.localized(a.Code, a.Params)
+	}
+
+	a.Sent = m.now()
+	data, err := json.Marshal(SystemEvent{Message: a.Message, Code: a.Code, Params: a.Params, Priority: a.Priority, Sent: a.Sent})
+	if err != nil {
+		return 0, err
+	}
+	event := Event{Type: EventSystem, Payload: data}
+
+	if a.Room != "" && len(a.Rooms) > 0 {
+		return 0, ErrAnnouncementRooms
+	}
+	rooms := a.Rooms
+	if a.Room != "" {
+		rooms = []string{a.Room}
+	}
+
+	a.Delivered = m.deliverAnnouncement(rooms, a.Priority, event)
+	if m.cluster != nil {
+		a.Delivered += m.cluster.fanOut("/cluster/announcements", clusterAnnouncement{Rooms: rooms, Priority: a.Priority, Event: event})()
+	}
+
+	m.announcements.add(a)
+	m.audit(AuditEntry{
+		Action:  AuditAdminAnnounce,
+		Actor:   a.Sender,
+		Target:  strings.Join(rooms, ","),
+		Details: map[string]string{"priority": a.Priority, "message": a.Message},
+	})
+	return a.Delivered, nil
+}
+
+// deliverAnnouncement sends the system event to the clients in the rooms on this
+// instance, or to all of them if there are no rooms, and returns how many it was
+// queued for
+func (m *Manager) deliverAnnouncement(rooms []string, priority string, event Event) int {
+	event = prepare(event)
+
+	m.RLock()
+	defer m.RUnlock()
+
+	recipients := m.clients
+	if len(rooms) > 0 {
+		recipients = make(ClientList)
+		for _, room := range rooms {
+			for client := range m.members[room] {
+				recipients[client] = true
+			}
+		}
+	}
+	delivered := 0
+	for client := range recipients {
+		var ok bool
+		if priority == PriorityHigh {
+			ok = client.sendPriority(event)
+		} else {
+			ok = client.send(event)
+		}
+		if ok {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// announceHandler sends an announcement, the body is an Announcement
+func (m *Manager) announceHandler(w http.ResponseWriter, r *http.Request) {
+	var a Announcement
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The admin token is all the request is authenticated with, so that is who
+	// sent it, not whoever the body names
+	a.Sender = "admin"
+
+	delivered, err := m.announce(a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveryResponse{Delivered: delivered})
+}
+
+// listAnnouncementsHandler returns the latest announcements with who sent them
+func (m *Manager) listAnnouncementsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.announcements.list())
+}
+
+// clusterAnnouncementHandler sends an announcement fanned out by another instance to the clients here
+func (m *Manager) clusterAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	if m.cluster == nil {
+		http.Error(w, "not clustered", http.StatusNotFound)
+		return
+	}
+	var a clusterAnnouncement
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, clusterDelivered{Delivered: m.deliverAnnouncement(a.Rooms, a.Priority, a.Event)})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// This file holds the REST API used by backends to push events to users and
+// rooms without holding a websocket connection themselves.
+
+// deliveryResponse is returned by the REST API after an event is sent
+type deliveryResponse struct {
+	// Delivered is how many clients the event was queued for
+	Delivered int `json:"delivered"`
+}
+
+// requireAPIToken wraps a handler so it only accepts requests carrying the API token
+// as a bearer token, if no token is configured the API is disabled
+func (m *Manager) requireAPIToken(next http.HandlerFunc) http.HandlerFunc {
+	return requireBearerToken(func() string { return m.config().APIToken }, next)
+}
+
+// requireAdminToken wraps a handler so it only accepts requests carrying the admin token
+// as a bearer token, if no token is configured the admin API is disabled
+func (m *Manager) requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return requireBearerToken(func() string { return m.config().AdminToken }, next)
+}
+
+// requireBearerToken only lets requests through that carry the token returned by expected
+func requireBearerToken(expected func() string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		want := expected()
+		if want == "" {
+			http.Error(w, "api is disabled", http.StatusNotFound)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// roomMessageHandler sends a chat message to everyone in the room
+func (m *Manager) roomMessageHandler(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+	if err := validateRoomName(room); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var message SendMessageEvent
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Keys post in the name of their user and only to their rooms
+	if key, ok := requestAPIKey(r); ok {
+		if err := m.checkAPIKeyRoom(key, room); err != nil {
+			http.Error(w, err.Error(), postMessageStatus(err))
+			return
+		}
+		message.From = key.Username
+		if err := m.countMessage(key.Username); err != nil {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	delivered, err := m.postMessage(room, message)
+	if err != nil {
+		http.Error(w, err.Error(), postMessageStatus(err))
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveryResponse{Delivered: delivered})
+}
+
+// checkAPIKeyRoom returns an error unless the key may post to the room, its user
+// has to be let in by the settings of the room like a client joining it
+func (m *Manager) checkAPIKeyRoom(key APIKey, name string) error {
+	if !key.allowsRoom(name) {
+		return fmt.Errorf("%w: %s", ErrAPIKeyRoom, name)
+	}
+	room, err := m.roomSettings(name)
+	if err != nil {
+		return err
+	}
+	if !room.admits(key.Username) {
+		return fmt.Errorf("%w: %s", ErrNotInvited, name)
+	}
+	return nil
+}
+
+// postMessageStatus is the status of the response to a message that couldn't be posted
+func postMessageStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidRoom):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrAPIKeyRoom), errors.Is(err, ErrNotInvited), errors.Is(err, ErrE2EERoom):
+		return http.StatusForbidden
+	case errors.Is(err, ErrRoomNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrQuotaExceeded):
+		// The room stores all its quota allows, the message doesn't fit
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// userEventHandler sends an event to all clients of the user
+func (m *Manager) userEventHandler(w http.ResponseWriter, r *http.Request) {
+	var event Event
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if event.Type == "" {
+		http.Error(w, "type is required", http.StatusBadRequest)
+		return
+	}
+
+	delivered := m.sendToUser(r.PathValue("user"), event)
+	writeJSON(w, http.StatusOK, deliveryResponse{Delivered: delivered})
+}
+
+// writeJSON writes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
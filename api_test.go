@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postRoomMessage calls the room message handler like the API routes do, with the key if it is set
+func postRoomMessage(m *Manager, room string, key *APIKey) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/rooms/"+room+"/messages", strings.NewReader(`{"message":"hello"}`))
+	r.SetPathValue("room", room)
+	if key != nil {
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, *key))
+	}
+	w := httptest.NewRecorder()
+	m.roomMessageHandler(w, r)
+	return w
+}
+
+func TestRoomMessageErrors(t *testing.T) {
+	config := DefaultConfig()
+	config.Quotas.Default.StoragePerRoom = 1
+	_, m := newRoomTestServer(t, config)
+
+	for _, room := range []Room{
+		{Name: "vault", Owner: "alice", E2EE: true, Created: m.now()},
+		{Name: "full", Owner: "alice", Created: m.now()},
+	} {
+		if err := m.store.SaveRoom(room); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := StoredMessage{Room: "full", Seq: 1, Event: Event{Type: EventNewMessage, Payload: json.RawMessage(`{"message":"hi"}`)}, Sent: m.now()}
+	if err := m.store.AppendMessage(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		room string
+		want int
+	}{
+		{"too long room name", strings.Repeat("r", maxRoomNameLength+1), http.StatusBadRequest},
+		{"end-to-end encrypted room", "vault", http.StatusForbidden},
+		{"room out of storage", "full", http.StatusRequestEntityTooLarge},
+		{"public room", defaultRoom, http.StatusOK},
+	} {
+		if w := postRoomMessage(m, tc.room, nil); w.Code != tc.want {
+			t.Errorf("%s: %d %s, want %d", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+}
+
+func TestRoomMessageOfAPIKey(t *testing.T) {
+	_, m := newRoomTestServer(t, DefaultConfig())
+
+	for _, tc := range []struct {
+		name string
+		key  APIKey
+		room string
+		want int
+	}{
+		{"room of the key", APIKey{Username: "carol", Rooms: []string{"secret"}}, "secret", http.StatusOK},
+		{"room outside the key", APIKey{Username: "carol", Rooms: []string{"secret"}}, defaultRoom, http.StatusForbidden},
+		// The key names the room, the room still has to let its user in
+		{"private room of others", APIKey{Username: "bob", Rooms: []string{"secret"}}, "secret", http.StatusForbidden},
+		{"key for all rooms", APIKey{Username: "bob"}, "secret", http.StatusForbidden},
+		{"unknown room", APIKey{Username: "bob"}, "nowhere", http.StatusNotFound},
+	} {
+		if w := postRoomMessage(m, tc.room, &tc.key); w.Code != tc.want {
+			t.Errorf("%s: %d %s, want %d", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+}
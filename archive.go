@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Most rooms are busy for a while and then never used again, but every room used
+// since the start keeps its sequence number and history in memory. Rooms nobody
+// was in and nothing happened in for rooms.archive_after are archived: the stored
+// room gets archived_at set and everything kept of it in memory is dropped, its
+// history stays in the store. The next time the room is used, like when someone
+// joins it or a message is sent to it, it is loaded from the store like after a
+// restart and is active again, clients don't notice. The default room and
+// ephemeral rooms, which are closed instead, are never archived. The states of
+// state sync are kept, they are not stored anywhere else.
+
+// archiveInterval is how often the rooms are checked for inactivity
+var archiveInterval = time.Minute
+
+// runArchival archives the inactive rooms
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runArchival(ctx context.Context) {
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.archiveRooms(m.now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// archiveRooms archives the rooms in memory that are inactive at now
+func (m *Manager) archiveRooms(now time.Time) {
+	after := time.Duration(m.config().Rooms.ArchiveAfter)
+	if after <= 0 {
+		return
+	}
+
+	m.roomsLock.Lock()
+	names := slices.Collect(maps.Keys(m.rooms))
+	m.roomsLock.Unlock()
+
+	for _, name := range names {
+		if name == defaultRoom {
+			continue
+		}
+		if err := m.archiveRoom(name, now, after); err != nil {
+			log.Printf("archiving room %s: %v", name, err)
+		}
+	}
+}
+
+// archiveRoom archives the room if it has no members and was not active since the
+// duration before now
+func (m *Manager) archiveRoom(name string, now time.Time, after time.Duration) error {
+	// An update of the settings can't race with the room being archived
+	m.roomSettingsLock.Lock()
+	defer m.roomSettingsLock.Unlock()
+
+	m.roomsLock.Lock()
+	r, ok := m.rooms[name]
+	m.roomsLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// The room lock keeps events from being sent to the room while it is archived
+	r.Lock()
+	m.RLock()
+	members := len(m.members[name])
+	m.RUnlock()
+	if members > 0 || now.Sub(r.lastActive) < after {
+		r.Unlock()
+		return nil
+	}
+	room, err := m.roomSettings(name)
+	if err != nil || room.Ephemeral {
+		r.Unlock()
+		return err
+	}
+	idle := r.lastActive
+	room.ArchivedAt = &now
+	if err := m.store.SaveRoom(room); err != nil {
+		r.Unlock()
+		return err
+	}
+	m.roomsLock.Lock()
+	delete(m.rooms, name)
+	m.roomsLock.Unlock()
+	r.Unlock()
+
+	m.quotas.forgetStorage(name)
+	m.uncacheRoom(name)
+	m.dropRoomDocs(name)
+	log.Printf("archived room %s, inactive since %s", name, idle.Format(time.RFC3339))
+	return nil
+}
+
+// unarchiveRoom marks the archived room as active again, it is called when the room
+// is loaded
+func (m *Manager) unarchiveRoom(room Room) {
+	room.ArchivedAt = nil
+	if err := m.store.SaveRoom(room); err != nil {
+		log.Printf("reactivating room %s: %v", room.Name, err)
+		return
+	}
+	log.Printf("reactivated archived room %s", room.Name)
+}
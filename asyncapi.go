@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// REST APIs are described with OpenAPI, the events of the websocket with AsyncAPI.
+// GET /asyncapi.json returns an AsyncAPI 3.0 document of the server as it runs:
+// the events of the catalog, see catalog.go, with JSON Schemas of their payloads,
+// the event types with a handler but no entry in the catalog and the configured
+// ephemeral events. Standard tooling renders it as documentation, generates
+// clients from it or validates traffic against it.
+//
+// The websocket is the connection channel, each event is a message on it wrapped
+// in the envelope, as an operation the server receives or sends. The rooms
+// channel has the listed rooms as the values of its room parameter, since events
+// are sent to the room the client is in, private rooms are left out.
+
+// asyncAPIVersion is the version of the AsyncAPI specification of the document
+const asyncAPIVersion = "3.0.0"
+
+// jsonSchemas collects the schemas of the named structs used by the payloads
+type jsonSchemas struct {
+	schemas map[string]any
+}
+
+// schemaOf returns the JSON Schema of the Go type, adding the schemas it refers to
+func (g *jsonSchemas) schemaOf(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]any{"type": "string", "description": "a duration like 1m30s"}
+	case rawJSONType:
+		return map[string]any{}
+	}
+	if t.Kind() != reflect.Pointer && reflect.PointerTo(t).Implements(marshalerType) {
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schemaOf(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.objectSchema(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// Marks it before the fields, so types referring to themselves end
+			g.schemas[t.Name()] = nil
+			g.schemas[t.Name()] = g.objectSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// objectSchema returns the schema of the struct as encoding/json writes it, the
+// fields of embedded structs are part of the struct
+func (g *jsonSchemas) objectSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	g.addFields(t, properties, &required)
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds the fields of the struct to the properties
+func (g *jsonSchemas) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				g.addFields(embedded, properties, required)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schemaOf(field.Type)
+		if !slices.Contains(strings.Split(options, ","), "omitempty") && field.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// envelopeSchema returns the schema of the event of the type wrapped in the envelope
+func envelopeSchema(eventType string, payload map[string]any) map[string]any {
+	return map[string]any{
+		"type":     "object",
+		"required": []string{"type", "payload"},
+		"properties": map[string]any{
+			"id":      map[string]any{"type": "string", "description": "required with the strict envelope of chat.v2.json, a string or a number"},
+			"ts":      map[string]any{"description": "required with the strict envelope of chat.v2.json, an RFC 3339 string or milliseconds since the epoch"},
+			"type":    map[string]any{"const": eventType},
+			"room":    map[string]any{"type": "string"},
+			"payload": payload,
+		},
+	}
+}
+
+// asyncAPISpecs returns the events of the catalog and the ones of this Manager
+// that aren't in it, the payload of events the catalog doesn't describe can be anything
+func (m *Manager) asyncAPISpecs() []EventSpec {
+	specs := EventSpecs()
+	known := map[string]bool{}
+	for _, spec := range specs {
+		known[spec.Direction+"/"+spec.Type] = true
+	}
+	for _, eventType := range slices.Sorted(maps.Keys(m.handlers)) {
+		if !known[DirectionClient+"/"+eventType] {
+			specs = append(specs, EventSpec{Type: eventType, Direction: DirectionClient, Payload: json.RawMessage(nil)})
+		}
+	}
+	for _, eventType := range m.config().Ephemeral.Events {
+		if !m.isEphemeral(eventType) || known[DirectionClient+"/"+eventType] {
+			continue
+		}
+		specs = append(specs,
+			EventSpec{Type: eventType, Direction: DirectionClient, Payload: json.RawMessage(nil)},
+			EventSpec{Type: eventType, Direction: DirectionServer, Payload: EphemeralStateEvent{}},
+		)
+	}
+	return specs
+}
+
+// asyncAPIDocument returns the AsyncAPI document of the server, reached at host
+// over the scheme, ws or wss
+func (m *Manager) asyncAPIDocument(scheme, host string) (map[string]any, error) {
+	g := &jsonSchemas{schemas: map[string]any{}}
+	messages := map[string]any{}
+	refs := map[string]any{}
+	operations := map[string]any{}
+	for _, spec := range m.asyncAPISpecs() {
+		payload := map[string]any{"type": "object", "additionalProperties": false}
+		if spec.Payload != nil {
+			payload = g.schemaOf(reflect.TypeOf(spec.Payload))
+		}
+		id := spec.Direction + "." + spec.Type
+		messages[id] = map[string]any{
+			"name":        spec.Type,
+			"title":       spec.Type,
+			"contentType": "application/json",
+			"payload":     envelopeSchema(spec.Type, payload),
+		}
+		refs[id] = map[string]any{"$ref": "#/components/messages/" + id}
+
+		// The document describes the server, it receives the events of clients
+		action := "receive"
+		if spec.Direction == DirectionServer {
+			action = "send"
+		}
+		operations[action+"."+spec.Type] = map[string]any{
+			"action":   action,
+			"channel":  map[string]any{"$ref": "#/channels/connection"},
+			"messages": []any{map[string]any{"$ref": "#/channels/connection/messages/" + id}},
+		}
+	}
+
+	list, err := m.listRooms(ListRoomsEvent{Limit: maxRoomListLimit}, func(string) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	rooms := []string{}
+	for _, room := range list.Rooms {
+		rooms = append(rooms, room.Name)
+	}
+
+	latest := 0
+	for _, protocol := range protocols {
+		latest = max(latest, protocol.Version)
+	}
+
+	return map[string]any{
+		"asyncapi": asyncAPIVersion,
+		"info": map[string]any{
+			"title":       "Chat server",
+			"version":     strconv.Itoa(latest),
+			"description": "The events of the websocket. Clients pick the codec and the envelope with the subprotocol, one of " + strings.Join(supportedSubprotocols(), ", ") + ".",
+		},
+		"servers": map[string]any{
+			"default": map[string]any{
+				"host":     host,
+				"protocol": scheme,
+				"pathname": m.config().BasePath + "/ws",
+			},
+		},
+		"defaultContentType": "application/json",
+		"channels": map[string]any{
+			"connection": map[string]any{
+				"address":     "/ws",
+				"description": "The websocket of a client, connected with ?otp= or an API key",
+				"messages":    refs,
+			},
+			"rooms": map[string]any{
+				"address":     "rooms/{room}",
+				"description": "The rooms events are sent to, a client gets the events of the room it is in",
+				"parameters": map[string]any{
+					"room": map[string]any{"enum": rooms, "default": defaultRoom},
+				},
+			},
+		},
+		"operations": operations,
+		"components": map[string]any{
+			"messages": messages,
+			"schemas":  g.schemas,
+		},
+	}, nil
+}
+
+// asyncAPIHandler serves the AsyncAPI document of the websocket
+func (m *Manager) asyncAPIHandler(w http.ResponseWriter, r *http.Request) {
+	scheme := "ws"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "wss"
+	}
+	document, err := m.asyncAPIDocument(scheme, r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, document)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Audit actions recorded in the AuditLog
+const (
+	AuditLogin          = "login"
+	AuditLoginFailed    = "login_failed"
+	AuditOTPVerified    = "otp_verified"
+	AuditOTPRejected    = "otp_rejected"
+	AuditKick           = "kick"
+	AuditRegister       = "register"
+	AuditPasswordChange = "password_change"
+	AuditAccountDeleted = "account_deleted"
+	AuditAPIKeyIssued   = "api_key_issued"
+	AuditAPIKeyRevoked  = "api_key_revoked"
+	AuditBan            = "ban"
+	AuditUnban          = "unban"
+	AuditPurge          = "purge"
+	AuditDeviceRevoked  = "device_revoked"
+	AuditAdminAnnounce  = "admin_announcement"
+	AuditBulkAddMembers = "bulk_add_members"
+)
+
+// AuditEntry is a single record in the AuditLog
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Actor is who performed the action, a username, operator or backend
+	Actor string `json:"actor,omitempty"`
+	// Target is what the action was performed on, like a kicked client
+	Target     string            `json:"target,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+}
+
+// AuditQuery filters the entries returned by an AuditLog, zero values match everything
+type AuditQuery struct {
+	Action string
+	Actor  string
+	Since  time.Time
+	Until  time.Time
+	// Limit is the max number of entries returned, the newest ones are kept
+	Limit int
+}
+
+// matches returns true if the entry passes the filters of the query
+func (q AuditQuery) matches(e AuditEntry) bool {
+	return (q.Action == "" || e.Action == q.Action) &&
+		(q.Actor == "" || e.Actor == q.Actor) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// limit keeps the newest entries if there are more than the query limit
+func (q AuditQuery) limit(entries []AuditEntry) []AuditEntry {
+	if q.Limit > 0 && len(entries) > q.Limit {
+		return entries[len(entries)-q.Limit:]
+	}
+	return entries
+}
+
+// AuditLog is an append-only log of administrative and security events
+type AuditLog interface {
+	Record(entry AuditEntry) error
+	Query(q AuditQuery) ([]AuditEntry, error)
+	// Rewrite passes every entry to fn and keeps what it returns, entries it returns
+	// false for are removed. It is only used to erase users, see gdpr.go
+	Rewrite(fn func(AuditEntry) (AuditEntry, bool)) error
+}
+
+// newAuditLog returns an audit log appending to the file at path, or kept in memory
+// if path is empty, the memory log keeps up to maxEntries
+func newAuditLog(path string, maxEntries int) (AuditLog, error) {
+	if path == "" {
+		if maxEntries <= 0 {
+			return nil, errors.New("audit_log_max_entries has to be positive without an audit_log_path")
+		}
+		return &memoryAuditLog{max: maxEntries}, nil
+	}
+	return newFileAuditLog(path)
+}
+
+// memoryAuditLog keeps the latest entries in memory, used for development
+type memoryAuditLog struct {
+	sync.RWMutex
+	// entries is a ring of up to max entries, once it is full the oldest is at start
+	entries []AuditEntry
+	start   int
+	max     int
+}
+
+func (l *memoryAuditLog) Record(entry AuditEntry) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.entries) < l.max {
+		l.entries = append(l.entries, entry)
+		return nil
+	}
+	l.entries[l.start] = entry
+	l.start = (l.start + 1) % len(l.entries)
+	return nil
+}
+
+// all returns the entries oldest first
+func (l *memoryAuditLog) all() []AuditEntry {
+	return append(slices.Clone(l.entries[l.start:]), l.entries[:l.start]...)
+}
+
+func (l *memoryAuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	result := []AuditEntry{}
+	for _, e := range l.all() {
+		if q.matches(e) {
+			result = append(result, e)
+		}
+	}
+	return q.limit(result), nil
+}
+
+func (l *memoryAuditLog) Rewrite(fn func(AuditEntry) (AuditEntry, bool)) error {
+	l.Lock()
+	defer l.Unlock()
+
+	kept := []AuditEntry{}
+	for _, e := range l.all() {
+		if e, keep := fn(e); keep {
+			kept = append(kept, e)
+		}
+	}
+	l.entries = kept
+	l.start = 0
+	return nil
+}
+
+// fileAuditLog appends entries as JSON lines to a file
+type fileAuditLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+func newFileAuditLog(path string) (*fileAuditLog, error) {
+	// O_APPEND so entries are only ever added to the end
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditLog{file: file}, nil
+}
+
+func (l *fileAuditLog) Record(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+func (l *fileAuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	file, err := os.Open(l.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := []AuditEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		if q.matches(e) {
+			result = append(result, e)
+		}
+	}
+	return q.limit(result), scanner.Err()
+}
+
+// Rewrite writes the entries to a temporary file and renames it over the log, so
+// the log is never half written
+func (l *fileAuditLog) Rewrite(fn func(AuditEntry) (AuditEntry, bool)) error {
+	l.Lock()
+	defer l.Unlock()
+
+	path := l.file.Name()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		}
+		e, keep := fn(e)
+		if !keep {
+			continue
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		out.Write(append(line, '\n'))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// Appending continues in the new file
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	return nil
+}
+
+// audit records an entry in the audit log, failures are logged but don't stop the action
+func (m *Manager) audit(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = m.now()
+	}
+	if err := m.auditLog.Record(entry); err != nil {
+		log.Println("failed to record audit entry: ", err)
+	}
+}
+
+// auditQueryHandler returns audit entries filtered by the action, actor, since, until
+// and limit query params, since and until are RFC3339 timestamps
+func (m *Manager) auditQueryHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := AuditQuery{
+		Action: params.Get("action"),
+		Actor:  params.Get("actor"),
+		Limit:  100,
+	}
+
+	var err error
+	if v := params.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := m.auditLog.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryAuditLogIsCapped(t *testing.T) {
+	auditLog, err := newAuditLog("", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		auditLog.Record(AuditEntry{Time: start.Add(time.Duration(i) * time.Minute), Action: AuditLogin, Actor: strconv.Itoa(i)})
+	}
+
+	// Only the newest entries are kept, oldest first
+	entries, err := auditLog.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actors(entries); got != "234" {
+		t.Errorf("entries are of %s, want 234", got)
+	}
+	entries, _ = auditLog.Query(AuditQuery{Limit: 2})
+	if got := actors(entries); got != "34" {
+		t.Errorf("limited entries are of %s, want 34", got)
+	}
+
+	// Rewriting keeps the order and the ring keeps going after it
+	err = auditLog.Rewrite(func(e AuditEntry) (AuditEntry, bool) { return e, e.Actor != "3" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 5; i < 7; i++ {
+		auditLog.Record(AuditEntry{Time: start.Add(time.Duration(i) * time.Minute), Action: AuditLogin, Actor: strconv.Itoa(i)})
+	}
+	entries, _ = auditLog.Query(AuditQuery{})
+	if got := actors(entries); got != "456" {
+		t.Errorf("entries after the rewrite are of %s, want 456", got)
+	}
+}
+
+func TestMemoryAuditLogNeedsACap(t *testing.T) {
+	if _, err := newAuditLog("", 0); err == nil {
+		t.Error("an unbounded memory audit log was created")
+	}
+}
+
+// actors joins the actors of the entries
+func actors(entries []AuditEntry) string {
+	var s string
+	for _, e := range entries {
+		s += e.Actor
+	}
+	return s
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// The Autobahn test suite fuzzes WebSocket servers for compliance with RFC 6455:
+// fragmentation, control frames in between fragments, UTF-8 validation, close
+// codes and limits. Its fuzzing client needs an echo server, which is what
+// /autobahn is with autobahn.enabled in the config. Every message is sent back as
+// it came, permessage-deflate is offered and text that isn't UTF-8 fails the
+// connection with 1007. The frames are read and written by the same gorilla
+// connection the chat uses, the fixes the suite asked for are in the read and write
+// loops of client.go too. Run it with
+//
+//	docker run -it --rm --network host -v "$PWD/autobahn:/config" -v "$PWD/autobahn/reports:/reports" \
+//	    crossbario/autobahn-testsuite wstest -m fuzzingclient -s /config/fuzzingclient.json
+//
+// and a fuzzingclient.json like
+//
+//	{"outdir": "/reports", "servers": [{"agent": "chat", "url": "ws://127.0.0.1:8080/autobahn"}], "cases": ["*"]}
+//
+// The endpoint takes anyone without an OTP, it must never be enabled in production.
+
+// autobahnReadLimit is the largest message echoed, the largest cases send 16 MiB
+const autobahnReadLimit = 32 << 20
+
+// AutobahnConfig configures the echo endpoint of the Autobahn test suite
+type AutobahnConfig struct {
+	// Enabled serves /autobahn, without authentication
+	Enabled bool `json:"enabled"`
+}
+
+// serveAutobahn is the echo endpoint of the Autobahn test suite, it is not found
+// unless enabled in the config
+func (m *Manager) serveAutobahn(w http.ResponseWriter, r *http.Request) {
+	if !m.config().Autobahn.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	upgrader := websocketUpgrader
+	upgrader.CheckOrigin = func(*http.Request) bool { return true }
+	upgrader.EnableCompression = true
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadLimit(autobahnReadLimit)
+	for {
+		// Pings are answered and closes echoed by gorilla while reading, protocol
+		// errors are closed with 1002 and too large messages with 1009
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType == websocket.TextMessage && !utf8.Valid(data) {
+			closing := websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, "invalid UTF-8")
+			conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(closeWait))
+			return
+		}
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			return
+		}
+	}
+}
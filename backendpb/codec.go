@@ -0,0 +1,40 @@
+// Package backendpb is the gRPC API of grpc.proto, used by backend services to
+// reach connected users. backend_gen.go is generated by protogen, run go generate
+// in the root of the module after changing grpc.proto.
+//
+// The messages encode themselves with protowire instead of being protoc types, so
+// servers and clients have to use Codec:
+//
+//	server := grpc.NewServer(grpc.ForceServerCodec(backendpb.Codec{}))
+//	conn, err := grpc.NewClient(target, grpc.WithDefaultCallOptions(grpc.ForceCodec(backendpb.Codec{})))
+package backendpb
+
+import "fmt"
+
+// Message is implemented by all messages of the package
+type Message interface {
+	MarshalProto() []byte
+	UnmarshalProto(b []byte) error
+}
+
+// Codec encodes the messages of the package for gRPC, it replaces the default
+// proto codec which only handles protoc generated types
+type Codec struct{}
+
+func (Codec) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(Message)
+	if !ok {
+		return nil, fmt.Errorf("grpc: cannot marshal %T", v)
+	}
+	return msg.MarshalProto(), nil
+}
+
+func (Codec) Unmarshal(data []byte, v any) error {
+	msg, ok := v.(Message)
+	if !ok {
+		return fmt.Errorf("grpc: cannot unmarshal into %T", v)
+	}
+	return msg.UnmarshalProto(data)
+}
+
+func (Codec) Name() string { return "proto" }
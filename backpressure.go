@@ -0,0 +1,180 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// A single busy room can queue the same event for thousands of clients, and
+// clients that fall behind keep their events in memory. The bytes of every queued
+// event are counted against a global budget, and while it is exceeded the server
+// pushes back in three steps, each of them can be turned off in the config:
+//
+//   - reads are paused, so clients can't send events that fan out even more
+//   - the event types listed as shed events, like user_typing, are dropped
+//   - once over budget for a while, the clients with the most bytes queued are
+//     disconnected until the queues fit in the budget again
+//
+// Every action is counted, the counters are in the runtime debug endpoint.
+
+var (
+	// memoryBudgetInterval is how often the budget is checked for disconnects
+	memoryBudgetInterval = time.Second
+	// maxReadPause is the longest a read is paused, a longer pause could miss the
+	// pongs and disconnect the client
+	maxReadPause = time.Second
+	// readPauseInterval is how often a paused read checks the budget again
+	readPauseInterval = 10 * time.Millisecond
+)
+
+// memoryBudget tracks the bytes queued for all clients and what was done about it
+type memoryBudget struct {
+	// buffered is the bytes of all events waiting on the queues of clients
+	buffered atomic.Int64
+	// overSince is when the budget was exceeded in unix nanoseconds, zero while under it
+	overSince atomic.Int64
+
+	pausedReads atomic.Uint64
+	shedEvents  atomic.Uint64
+	disconnects atomic.Uint64
+}
+
+// memoryBudgetStats is a snapshot of the memory budget for the runtime endpoint
+type memoryBudgetStats struct {
+	BufferedBytes    int64 `json:"buffered_bytes"`
+	MaxBufferedBytes int64 `json:"max_buffered_bytes"`
+	OverBudget       bool  `json:"over_budget"`
+	// PausedReads counts the reads that were paused, ShedEvents the events dropped
+	// and Disconnects the clients disconnected for the budget
+	PausedReads uint64 `json:"paused_reads"`
+	ShedEvents  uint64 `json:"shed_events"`
+	Disconnects uint64 `json:"disconnects"`
+}
+
+// eventSize is the bytes an event takes in memory, roughly
+func eventSize(event Event) int64 {
+	return int64(len(event.Type) + len(event.Payload))
+}
+
+// reserve counts the event against the budget before it is queued
+func (c *Client) reserve(event Event) {
+	n := eventSize(event)
+	c.stats.queuedBytes.Add(n)
+	c.manager.budget.buffered.Add(n)
+}
+
+// release takes the event off the budget once it left the queue
+func (c *Client) release(event Event) {
+	n := eventSize(event)
+	// Below zero the bytes were already released all at once by releaseAll
+	if c.stats.queuedBytes.Add(-n) >= 0 {
+		c.manager.budget.buffered.Add(-n)
+	}
+}
+
+// releaseAll takes everything still queued for a removed client off the budget
+// Only call it while holding the manager lock, so nothing is queued meanwhile
+func (c *Client) releaseAll() {
+	c.manager.budget.buffered.Add(-c.stats.queuedBytes.Swap(0))
+}
+
+// overBudget returns true while the queued events take more than the budget
+func (m *Manager) overBudget() bool {
+	budget := m.config().MemoryBudget.MaxBufferedBytes
+	return budget > 0 && m.budget.buffered.Load() > budget
+}
+
+// shed returns true if the event should be dropped instead of queued
+func (m *Manager) shed(event Event) bool {
+	if !m.overBudget() || !slices.Contains(m.config().MemoryBudget.ShedEvents, event.Type) {
+		return false
+	}
+	m.budget.shedEvents.Add(1)
+	return true
+}
+
+// waitForBudget pauses the read of the next event while over budget, in netpoll
+// mode that pauses the reads of all clients as they share the poller
+func (c *Client) waitForBudget() {
+	m := c.manager
+	if !m.config().MemoryBudget.PauseReads || !m.overBudget() {
+		return
+	}
+
+	m.budget.pausedReads.Add(1)
+	deadline := time.Now().Add(maxReadPause)
+	for m.overBudget() && time.Now().Before(deadline) {
+		time.Sleep(readPauseInterval)
+	}
+}
+
+// runMemoryBudget disconnects the worst offenders once over budget for too long
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runMemoryBudget(ctx context.Context) {
+	ticker := time.NewTicker(memoryBudgetInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.enforceMemoryBudget(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// enforceMemoryBudget disconnects the clients with the most bytes queued until the
+// queues fit in the budget, if it is exceeded for longer than allowed at now
+func (m *Manager) enforceMemoryBudget(now time.Time) {
+	if !m.overBudget() {
+		m.budget.overSince.Store(0)
+		return
+	}
+	m.budget.overSince.CompareAndSwap(0, now.UnixNano())
+
+	config := m.config().MemoryBudget
+	overSince := time.Unix(0, m.budget.overSince.Load())
+	if config.DisconnectAfter <= 0 || now.Sub(overSince) < time.Duration(config.DisconnectAfter) {
+		return
+	}
+
+	m.RLock()
+	clients := make([]*Client, 0, len(m.clients))
+	for client := range m.clients {
+		clients = append(clients, client)
+	}
+	m.RUnlock()
+	slices.SortFunc(clients, func(a, b *Client) int {
+		return cmp.Compare(b.stats.queuedBytes.Load(), a.stats.queuedBytes.Load())
+	})
+
+	for _, client := range clients {
+		if !m.overBudget() || client.stats.queuedBytes.Load() <= 0 {
+			break
+		}
+		log.Printf("memory budget exceeded, disconnecting client %s of %s with %d bytes queued",
+			client.id, client.username, client.stats.queuedBytes.Load())
+		m.budget.disconnects.Add(1)
+		m.removeClient(client)
+	}
+	if !m.overBudget() {
+		m.budget.overSince.Store(0)
+	}
+}
+
+// memoryBudgetStats returns the current state of the memory budget
+func (m *Manager) memoryBudgetStats() memoryBudgetStats {
+	return memoryBudgetStats{
+		BufferedBytes:    m.budget.buffered.Load(),
+		MaxBufferedBytes: m.config().MemoryBudget.MaxBufferedBytes,
+		OverBudget:       m.overBudget(),
+		PausedReads:      m.budget.pausedReads.Load(),
+		ShedEvents:       m.budget.shedEvents.Load(),
+		Disconnects:      m.budget.disconnects.Load(),
+	}
+}
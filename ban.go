@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Bans are either listed in the config, or stored with the admin API so they
+// survive restarts and are shared by instances using the same store.
+
+var ErrInvalidBan = errors.New("a ban needs a username")
+
+// ban stores the ban and disconnects the clients of the user, it returns how many were kicked
+func (m *Manager) ban(ban Ban) (int, error) {
+	if ban.Username == "" {
+		return 0, ErrInvalidBan
+	}
+	ban.Created = m.now()
+	if err := m.store.SaveBan(ban); err != nil {
+		return 0, err
+	}
+
+	m.audit(AuditEntry{Action: AuditBan, Actor: ban.Actor, Target: ban.Username, Details: map[string]string{"reason": ban.Reason}})
+	return m.kick(ban.Username, ban.Actor), nil
+}
+
+// banHandler bans the user in the body, like {"username":"mallory","reason":"spam"}
+func (m *Manager) banHandler(w http.ResponseWriter, r *http.Request) {
+	var ban Ban
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&ban); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ban.Actor = "admin"
+
+	kicked, err := m.ban(ban)
+	if errors.Is(err, ErrInvalidBan) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Kicked int `json:"kicked"`
+	}{Kicked: kicked})
+}
+
+// unbanHandler lifts a stored ban, users banned in the config stay banned
+func (m *Manager) unbanHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	err := m.store.DeleteBan(username)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.audit(AuditEntry{Action: AuditUnban, Actor: "admin", Target: username})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listBansHandler returns the stored bans
+func (m *Manager) listBansHandler(w http.ResponseWriter, r *http.Request) {
+	bans, err := m.store.ListBans()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, bans)
+}
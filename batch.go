@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients using the JSON codec can ask for batching by connecting with batch=1.
+// The writer then sends the events waiting on egress together, as a single
+// frame holding a JSON array of events, saving frames and syscalls when a
+// client receives many events at once. A frame with a single event is sent
+// as a plain event object like without batching.
+
+// batchOf returns the events to send with first, taken from egress without
+// blocking longer than the configured window
+// open is false if egress was closed meanwhile
+func (c *Client) batchOf(first Event) (batch []Event, open bool) {
+	config := c.manager.config().Batching
+	batch = append(batch, first)
+
+	var window <-chan time.Time
+	if config.Window > 0 {
+		timer := time.NewTimer(time.Duration(config.Window))
+		defer timer.Stop()
+		window = timer.C
+	}
+
+	for len(batch) < config.MaxEvents {
+		var message Event
+		var ok bool
+		if window == nil {
+			select {
+			case message, ok = <-c.egress:
+			default:
+				// Nothing else pending
+				return batch, true
+			}
+		} else {
+			select {
+			case message, ok = <-c.egress:
+			case <-window:
+				return batch, true
+			}
+		}
+
+		if !ok {
+			return batch, false
+		}
+		batch = append(batch, c.uncoalesce(message))
+	}
+	return batch, true
+}
+
+// writeBatch writes the events as a single JSON array frame
+func (c *Client) writeBatch(batch []Event) {
+	if len(batch) == 1 {
+		c.writeEvent(batch[0])
+		return
+	}
+	for _, message := range batch {
+		c.release(message)
+	}
+	writes := c.chaosWrites()
+	if writes == 0 {
+		return
+	}
+	defer c.observeWrite(time.Now())
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	buf.WriteByte('[')
+	for _, message := range batch {
+		start := buf.Len()
+		if start > 1 {
+			buf.WriteByte(',')
+		}
+		if _, err := encodeTo(c.codec, buf, message); err != nil {
+			log.Println(err)
+			buf.Truncate(start)
+		}
+	}
+	buf.WriteByte(']')
+
+	// A batch larger than the client takes is sent as single events instead
+	if limit := c.maxFrameSize.Load(); limit > 0 && int64(buf.Len()) > limit {
+		for range writes {
+			for _, message := range batch {
+				c.writeFrame(message)
+			}
+		}
+		return
+	}
+	c.applyCompression()
+	for range writes {
+		for _, message := range batch {
+			c.record(RecordOutbound, message)
+		}
+		if err := c.connection.WriteMessage(websocket.TextMessage, buf.Bytes()); err != nil {
+			log.Println(err)
+		}
+		c.countOut(len(batch), buf.Len())
+	}
+	debugLog("sent batch of", len(batch))
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The fan-out benchmark measures how long a room broadcast takes to reach every
+// client and what it allocates. Clients are connected over benchTransport, which
+// throws the frames away, so only the server side is measured. Run it with
+//
+//	go test -run '^$' -bench BenchmarkFanout -fanout-clients 1000,10000,50000
+//
+// Sub-benchmarks are named registry/encoding/clients/payload. The map registry is
+// the one of the Manager, a single map behind the manager lock. The sharded
+// registry spreads the clients over shardCount maps with a lock each and fans out
+// to the shards in parallel. With encode-per-client every writer goroutine encodes
+// the event itself, with prepared the broadcast is encoded once into a
+// websocket.PreparedMessage like real connections do. On a single core the
+// sharded registry is no faster than the map, the writer goroutines dominate and
+// its goroutine per shard costs allocations, so the Manager keeps the map.
+//
+// BenchmarkCodec compares the codecs encoding and reading a single event, with
+// and without the pooled buffers. BenchmarkConnectionBuffers measures what the
+// buffers of a connection cost with and without the shared write pool, see buffers.go.
+
+var (
+	fanoutClients  = flag.String("fanout-clients", "100,1000,10000", "client counts of BenchmarkFanout")
+	fanoutPayloads = flag.String("fanout-payloads", "64,1024,16384", "payload sizes in bytes of BenchmarkFanout")
+	bufferConns    = flag.Int("buffer-conns", 1000, "connections of BenchmarkConnectionBuffers")
+	bufferSizes    = flag.String("buffer-sizes", "1024,4096,16384", "buffer sizes in bytes of BenchmarkConnectionBuffers")
+)
+
+// benchTransport discards written frames and counts the broadcast ones on a
+// WaitGroup, reads block until the transport is closed
+type benchTransport struct {
+	written *sync.WaitGroup
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (t *benchTransport) ReadMessage() (int, []byte, error) {
+	<-t.closed
+	return 0, nil, ErrTransportClosed
+}
+
+// benchEventType is the type of the broadcast event as the frames carry it, other
+// events like the welcome of a new client are not counted
+var benchEventType = []byte(`"type":"` + EventNewMessage + `"`)
+
+func (t *benchTransport) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.TextMessage && bytes.Contains(data, benchEventType) {
+		t.written.Done()
+	}
+	return nil
+}
+
+func (t *benchTransport) SetReadLimit(int64)                {}
+func (t *benchTransport) SetReadDeadline(time.Time) error   { return nil }
+func (t *benchTransport) SetPongHandler(func(string) error) {}
+func (t *benchTransport) Subprotocol() string               { return "" }
+
+func (t *benchTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+// benchPreparedTransport also takes prepared messages, like *websocket.Conn
+type benchPreparedTransport struct {
+	*benchTransport
+}
+
+func (t benchPreparedTransport) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	t.written.Done()
+	return nil
+}
+
+// benchEncodings create the transport of a client for each encoding compared
+var benchEncodings = []struct {
+	name      string
+	transport func(written *sync.WaitGroup) Transport
+}{
+	{"encode-per-client", func(written *sync.WaitGroup) Transport {
+		return &benchTransport{written: written, closed: make(chan struct{})}
+	}},
+	{"prepared", func(written *sync.WaitGroup) Transport {
+		return benchPreparedTransport{&benchTransport{written: written, closed: make(chan struct{})}}
+	}},
+}
+
+// shardCount is how many shards the sharded registry has
+var shardCount = 16
+
+// registryShard is one map of the sharded registry with its own lock
+type registryShard struct {
+	sync.RWMutex
+	clients map[*Client]struct{}
+}
+
+// shardedRegistry is the alternative to the single map of the Manager the
+// benchmark compares it to, clients are sharded by the hash of their id
+type shardedRegistry struct {
+	shards []*registryShard
+}
+
+func newShardedRegistry(clients []*Client) *shardedRegistry {
+	s := &shardedRegistry{shards: make([]*registryShard, shardCount)}
+	for i := range s.shards {
+		s.shards[i] = &registryShard{clients: make(map[*Client]struct{})}
+	}
+	for _, client := range clients {
+		h := fnv.New32a()
+		h.Write([]byte(client.id))
+		shard := s.shards[h.Sum32()%uint32(shardCount)]
+		shard.clients[client] = struct{}{}
+	}
+	return s
+}
+
+// broadcast numbers the event like numberRoomEvent and sends it to the clients of
+// all shards, every shard in a goroutine of its own
+func (s *shardedRegistry) broadcast(m *Manager, room string, event Event) {
+	r := m.room(room)
+	r.Lock()
+	defer r.Unlock()
+	r.seq++
+	event.Payload = withSeq(event.Payload, r.seq)
+	event.Room = room
+	prepared := prepare(event)
+
+	var wg sync.WaitGroup
+	for _, shard := range s.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shard.RLock()
+			for client := range shard.clients {
+				client.send(prepared)
+			}
+			shard.RUnlock()
+		}()
+	}
+	wg.Wait()
+}
+
+// benchRegistries are the registries compared, each returning how to broadcast to
+// the clients of the Manager
+var benchRegistries = []struct {
+	name      string
+	broadcast func(m *Manager, clients []*Client) func(event Event)
+}{
+	{"map", func(m *Manager, _ []*Client) func(Event) {
+		return func(event Event) { m.broadcastToRoom(defaultRoom, "", event) }
+	}},
+	{"sharded", func(m *Manager, clients []*Client) func(Event) {
+		registry := newShardedRegistry(clients)
+		return func(event Event) { registry.broadcast(m, defaultRoom, event) }
+	}},
+}
+
+// benchPayload returns a new_message payload with a message of roughly size bytes
+func benchPayload(size int) json.RawMessage {
+	data, _ := json.Marshal(NewMessageEvent{
+		SendMessageEvent: SendMessageEvent{Message: strings.Repeat("x", size), From: "bench"},
+		Sent:             time.Now(),
+	})
+	return data
+}
+
+// parseIntList parses a comma separated list of integers like 1000,10000
+func parseIntList(b *testing.B, s string) []int {
+	var list []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			b.Fatal(err)
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+func BenchmarkFanout(b *testing.B) {
+	// Every frame is logged at the debug level, servers run at info like this
+	level := logLevel()
+	setLogLevel(LogLevelInfo)
+	b.Cleanup(func() { setLogLevel(level) })
+
+	for _, registry := range benchRegistries {
+		for _, encoding := range benchEncodings {
+			for _, clients := range parseIntList(b, *fanoutClients) {
+				for _, size := range parseIntList(b, *fanoutPayloads) {
+					name := fmt.Sprintf("%s/%s/clients=%d/payload=%d", registry.name, encoding.name, clients, size)
+					b.Run(name, func(b *testing.B) {
+						benchmarkFanout(b, registry.broadcast, encoding.transport, clients, size)
+					})
+				}
+			}
+		}
+	}
+}
+
+// benchmarkFanout broadcasts to the given number of clients, an op is a broadcast
+// that reached all of them
+func benchmarkFanout(b *testing.B, registry func(*Manager, []*Client) func(Event), transport func(*sync.WaitGroup) Transport, clients, payloadSize int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := NewManager(ctx, DefaultConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var written sync.WaitGroup
+	all := make([]*Client, 0, clients)
+	for range clients {
+		client := NewClient(transport(&written), m, "bench")
+		m.startClient(client)
+		all = append(all, client)
+	}
+	defer func() {
+		for _, client := range all {
+			m.removeClient(client)
+		}
+	}()
+
+	broadcast := registry(m, all)
+	event := Event{Type: EventNewMessage, Payload: benchPayload(payloadSize)}
+
+	// One warm up round so lazily created state like the room is not measured
+	written.Add(clients)
+	broadcast(event)
+	written.Wait()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		written.Add(clients)
+		broadcast(event)
+		written.Wait()
+	}
+}
+
+func BenchmarkCodec(b *testing.B) {
+	event := Event{Type: EventNewMessage, Payload: benchPayload(512)}
+	named := map[string]Codec{"json": jsonCodec{}, "proto": protoCodec{}, "socket.io": socketIOCodec{}}
+
+	for _, name := range []string{"json", "proto", "socket.io"} {
+		codec := named[name]
+		messageType, data, err := codec.Encode(event)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		operations := []struct {
+			name string
+			fn   func()
+		}{
+			{"encode", func() { codec.Encode(event) }},
+			{"encode-pooled", func() {
+				buf := getBuffer()
+				encodeTo(codec, buf, event)
+				putBuffer(buf)
+			}},
+			// Reading like ReadMessage does, into a new slice, then decoding
+			{"read+decode", func() {
+				frame, _ := io.ReadAll(bytes.NewReader(data))
+				codec.Decode(messageType, frame)
+			}},
+			{"read+decode-pooled", func() {
+				buf := getBuffer()
+				buf.ReadFrom(bytes.NewReader(data))
+				codec.Decode(messageType, buf.Bytes())
+				putBuffer(buf)
+			}},
+		}
+		for _, op := range operations {
+			b.Run(name+"/"+op.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for range b.N {
+					op.fn()
+				}
+			})
+		}
+	}
+}
+
+// bufferBenchDialer dials the connections of the buffer benchmark, it is the same
+// in every run and its small pooled buffers keep the dialing side out of the numbers
+var bufferBenchDialer = websocket.Dialer{ReadBufferSize: 256, WriteBufferSize: 256, WriteBufferPool: &sync.Pool{}}
+
+func BenchmarkConnectionBuffers(b *testing.B) {
+	for _, size := range parseIntList(b, *bufferSizes) {
+		for _, shared := range []bool{false, true} {
+			pool := "dedicated"
+			if shared {
+				pool = "shared"
+			}
+			b.Run(fmt.Sprintf("size=%d/%s", size, pool), func(b *testing.B) {
+				var perConn int64
+				for range b.N {
+					perConn += connectionBufferHeap(b, *bufferConns, size, shared)
+				}
+				b.ReportMetric(float64(perConn)/float64(b.N), "heap-B/conn")
+			})
+		}
+	}
+}
+
+// connectionBufferHeap upgrades conns connections over loopback with buffers of
+// size bytes and returns the heap in use per connection once all are idle
+func connectionBufferHeap(b *testing.B, conns, size int, shared bool) int64 {
+	upgrader := newUpgrader(BuffersConfig{ReadBufferSize: size, WriteBufferSize: size, SharedWritePool: shared})
+	upgraded := make(chan *websocket.Conn, 1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		// Every connection writes a message, so it used a write buffer once
+		conn.WriteMessage(websocket.TextMessage, []byte("welcome"))
+		upgraded <- conn
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	var open []*websocket.Conn
+	defer func() {
+		for _, conn := range open {
+			conn.Close()
+		}
+	}()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for range conns {
+		conn, _, err := bufferBenchDialer.Dial("ws://"+listener.Addr().String(), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		open = append(open, conn, <-upgraded)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	return (int64(after.HeapInuse) - int64(before.HeapInuse)) / int64(conns)
+}
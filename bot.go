@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"arti.soft/websockets-go/wstest"
+)
+
+// Bots are chat participants running inside the server. A bot is a regular Client
+// connected over a wstest.Conn, so it goes through the same handlers, rate limits
+// and room fan-out as a browser, without a network connection. It lives in package
+// main like the rest of the server.
+//
+//	bot := manager.NewBot("helper")
+//	bot.OnMessage(func(b *Bot, msg NewMessageEvent) error {
+//		if msg.Message == "!ping" {
+//			return b.SendMessage("pong")
+//		}
+//		return nil
+//	})
+//	bot.Start(ctx)
+
+var ErrBotStarted = errors.New("bot already started")
+
+// BotHandler handles an event received by a bot, errors are logged
+type BotHandler func(bot *Bot, event Event) error
+
+// Bot is an in-process client driven by handlers
+type Bot struct {
+	// Username is the user the bot sends as
+	Username string
+
+	manager *Manager
+
+	// handlers are keyed by event type, like Manager.handlers
+	handlers map[string]BotHandler
+
+	lock      sync.Mutex
+	transport *wstest.Conn
+	room      string
+}
+
+// NewBot returns a bot for the username, register handlers before starting it
+func (m *Manager) NewBot(username string) *Bot {
+	return &Bot{
+		Username: username,
+		manager:  m,
+		handlers: make(map[string]BotHandler),
+		room:     defaultRoom,
+	}
+}
+
+// Handle registers the handler for events of the type, replacing any previous one
+func (b *Bot) Handle(eventType string, handler BotHandler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.handlers[eventType] = handler
+}
+
+// OnMessage registers a handler for the chat messages of the room the bot is in,
+// the messages sent by the bot itself are skipped
+func (b *Bot) OnMessage(handler func(bot *Bot, message NewMessageEvent) error) {
+	b.Handle(EventNewMessage, func(bot *Bot, event Event) error {
+		var message NewMessageEvent
+		if err := json.Unmarshal(event.Payload, &message); err != nil {
+			return fmt.Errorf("bad payload in event: %v", err)
+		}
+		if message.From == bot.Username {
+			return nil
+		}
+		return handler(bot, message)
+	})
+}
+
+// Start connects the bot to the Manager and runs its handlers until ctx is done
+// or the bot is disconnected
+func (b *Bot) Start(ctx context.Context) error {
+	b.lock.Lock()
+	if b.transport != nil {
+		b.lock.Unlock()
+		return ErrBotStarted
+	}
+	server, peer := wstest.Pipe("")
+	b.transport = peer
+	b.lock.Unlock()
+
+	client := NewClient(server, b.manager, b.Username)
+	client.bot = true
+	b.manager.startClient(client)
+
+	go func() {
+		<-ctx.Done()
+		b.Close()
+	}()
+	go b.run()
+	return nil
+}
+
+// run reads the events sent to the bot and calls the handlers
+// Is Blocking, so run as a Goroutine
+func (b *Bot) run() {
+	for {
+		messageType, data, err := b.transport.ReadMessage()
+		if err != nil {
+			return
+		}
+		event, err := (jsonCodec{}).Decode(messageType, data)
+		if err != nil {
+			log.Printf("bot %s: %v", b.Username, err)
+			continue
+		}
+		// Bots leave right away, so they don't hold up a drain
+		if event.Type == EventServerDraining {
+			b.Close()
+			return
+		}
+
+		b.lock.Lock()
+		handler, ok := b.handlers[event.Type]
+		b.lock.Unlock()
+		if !ok {
+			continue
+		}
+		if err := handler(b, event); err != nil {
+			log.Printf("bot %s: %s handler: %v", b.Username, event.Type, err)
+		}
+	}
+}
+
+// Send sends an event to the server as the bot, the payload is marshalled to JSON
+func (b *Bot) Send(eventType string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	messageType, frame, err := (jsonCodec{}).Encode(Event{Type: eventType, Payload: data})
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	transport := b.transport
+	b.lock.Unlock()
+	if transport == nil {
+		return ErrTransportClosed
+	}
+	return transport.WriteMessage(messageType, frame)
+}
+
+// SendMessage sends a chat message to the room the bot is in
+func (b *Bot) SendMessage(message string) error {
+	return b.Send(EventSendMessage, SendMessageEvent{Message: message})
+}
+
+// JoinRoom moves the bot to another room
+func (b *Bot) JoinRoom(room string) error {
+	if err := b.Send(EventJoinRoom, JoinRoomEvent{Room: room}); err != nil {
+		return err
+	}
+	b.lock.Lock()
+	b.room = room
+	b.lock.Unlock()
+	return nil
+}
+
+// Room returns the room the bot is in
+func (b *Bot) Room() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.room
+}
+
+// Close disconnects the bot, the server sees it like a closed websocket
+func (b *Bot) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.transport != nil {
+		b.transport.Close()
+	}
+}
+
+// newWelcomeBot returns a bot greeting every user the first time they write in a room
+func (m *Manager) newWelcomeBot(username, greeting string) *Bot {
+	greeted := make(map[string]bool)
+
+	bot := m.NewBot(username)
+	bot.OnMessage(func(b *Bot, message NewMessageEvent) error {
+		key := b.Room() + "/" + message.From
+		if greeted[key] {
+			return nil
+		}
+		greeted[key] = true
+		return b.SendMessage(strings.ReplaceAll(greeting, "{user}", message.From))
+	})
+	return bot
+}
+
+// startBots starts the bots enabled in the config
+func (m *Manager) startBots(ctx context.Context, config BotsConfig) error {
+	if config.Welcome.Username == "" {
+		return nil
+	}
+	greeting := config.Welcome.Greeting
+	if greeting == "" {
+		greeting = "Welcome @{user}!"
+	}
+
+	bot := m.newWelcomeBot(config.Welcome.Username, greeting)
+	if err := bot.Start(ctx); err != nil {
+		return err
+	}
+	if config.Welcome.Room != "" {
+		return bot.JoinRoom(config.Welcome.Room)
+	}
+	return nil
+}
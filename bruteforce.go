@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Failed logins are counted per IP and per username, so neither guessing many
+// passwords of one user from many IPs nor many users from one IP goes unnoticed.
+// After free_attempts failures every further attempt has to wait, twice as long
+// after each failure up to max_delay, and after lockout_after failures the IP or
+// username is locked out for lockout_duration. A failure after the lockout ended
+// starts the count over, and failures are forgotten window after the last one.
+// Attempts during the wait are answered 429 without checking the password, so
+// the argon2id hashing can't be run at line rate either.
+
+const (
+	AuditLoginThrottled = "login_throttled"
+	AuditLoginLockout   = "login_lockout"
+
+	// maxLoginFailureEntries bounds the memory of the counters, the oldest are forgotten first
+	maxLoginFailureEntries = 100000
+)
+
+// loginFailureKey is an IP or a username failed logins are counted for
+type loginFailureKey struct {
+	kind  string
+	value string
+}
+
+// loginFailures are the failed logins of an IP or username
+type loginFailures struct {
+	count int
+	// blockedUntil is when the next attempt is allowed
+	blockedUntil time.Time
+	locked       bool
+}
+
+// loginThrottleStats counts what the login throttling did since the start
+type loginThrottleStats struct {
+	Failures  uint64 `json:"failures"`
+	Throttled uint64 `json:"throttled"`
+	Lockouts  uint64 `json:"lockouts"`
+}
+
+// loginThrottleCounters are the counters of loginThrottleStats
+type loginThrottleCounters struct {
+	failures  atomic.Uint64
+	throttled atomic.Uint64
+	lockouts  atomic.Uint64
+}
+
+func (c *loginThrottleCounters) stats() loginThrottleStats {
+	return loginThrottleStats{
+		Failures:  c.failures.Load(),
+		Throttled: c.throttled.Load(),
+		Lockouts:  c.lockouts.Load(),
+	}
+}
+
+// loginKeys returns the keys a login of the user from the request counts for
+func loginKeys(r *http.Request, username string) []loginFailureKey {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return []loginFailureKey{{kind: "ip", value: ip}, {kind: "user", value: username}}
+}
+
+// loginDelay returns how long to wait after the failures, zero for the free attempts
+func loginDelay(config LoginThrottleConfig, failures int) time.Duration {
+	over := failures - config.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	delay := float64(config.BaseDelay) * math.Pow(2, float64(over-1))
+	if delay > float64(config.MaxDelay) {
+		return time.Duration(config.MaxDelay)
+	}
+	return time.Duration(delay)
+}
+
+// throttleLogin returns how long the login of the user has to wait, zero if it may go ahead.
+// Throttled attempts are audited and counted
+func (m *Manager) throttleLogin(r *http.Request, username string) time.Duration {
+	if !m.config().LoginThrottle.Enabled {
+		return 0
+	}
+	now := m.now()
+	var wait time.Duration
+	for _, key := range loginKeys(r, username) {
+		failures, ok := m.loginFailures.Get(key)
+		if ok && failures.blockedUntil.After(now) {
+			wait = max(wait, failures.blockedUntil.Sub(now))
+		}
+	}
+	if wait > 0 {
+		m.loginThrottle.throttled.Add(1)
+		m.audit(AuditEntry{Action: AuditLoginThrottled, Actor: username, RemoteAddr: r.RemoteAddr})
+	}
+	return wait
+}
+
+// loginFailed counts the failed login of the user, reaching lockout_after locks
+// the IP or username out
+func (m *Manager) loginFailed(r *http.Request, username string) {
+	config := m.config().LoginThrottle
+	m.loginThrottle.failures.Add(1)
+	if !config.Enabled {
+		return
+	}
+	now := m.now()
+	for _, key := range loginKeys(r, username) {
+		failures := m.loginFailures.Update(key, time.Duration(config.Window), func(failures loginFailures, _ bool) loginFailures {
+			// The lockout is over, so lockout_after more failures lock out again
+			if failures.locked && !failures.blockedUntil.After(now) {
+				failures = loginFailures{}
+			}
+			failures.count++
+			failures.blockedUntil = now.Add(loginDelay(config, failures.count))
+			if config.LockoutAfter > 0 && failures.count >= config.LockoutAfter && !failures.locked {
+				failures.locked = true
+				failures.blockedUntil = now.Add(time.Duration(config.LockoutDuration))
+			}
+			return failures
+		})
+		if failures.locked && failures.count == config.LockoutAfter {
+			m.loginThrottle.lockouts.Add(1)
+			m.audit(AuditEntry{Action: AuditLoginLockout, Actor: username, RemoteAddr: r.RemoteAddr, Details: map[string]string{key.kind: key.value, "failures": strconv.Itoa(failures.count)}})
+		}
+	}
+}
+
+// loginSucceeded forgets the failures of the user, the ones of the IP stay so a
+// single known password doesn't reset the count of an IP guessing others
+func (m *Manager) loginSucceeded(username string) {
+	m.loginFailures.Delete(loginFailureKey{kind: "user", value: username})
+}
+
+// rejectThrottledLogin answers 429 if the login has to wait, returning true if it did
+func (m *Manager) rejectThrottledLogin(w http.ResponseWriter, r *http.Request, username string) bool {
+	wait := m.throttleLogin(r, username)
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoginLockoutEnds(t *testing.T) {
+	config := DefaultConfig()
+	config.LoginThrottle = LoginThrottleConfig{
+		Enabled:         true,
+		FreeAttempts:    2,
+		BaseDelay:       Duration(time.Second),
+		MaxDelay:        Duration(10 * time.Second),
+		LockoutAfter:    3,
+		LockoutDuration: Duration(time.Minute),
+		Window:          Duration(time.Hour),
+	}
+	clock := NewManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	server, m, err := NewTestServer(config, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+
+	for round := 1; round <= 2; round++ {
+		for range config.LoginThrottle.LockoutAfter {
+			if wait := m.throttleLogin(r, "alice"); wait > 0 {
+				t.Fatalf("round %d: an attempt before the lockout waits %s", round, wait)
+			}
+			m.loginFailed(r, "alice")
+			clock.Advance(10 * time.Second)
+		}
+		if wait := m.throttleLogin(r, "alice"); wait != 50*time.Second {
+			t.Errorf("round %d: locked out attempt waits %s, want 50s", round, wait)
+		}
+		// The IP and the username are both locked out
+		if lockouts := m.loginThrottle.lockouts.Load(); lockouts != uint64(2*round) {
+			t.Errorf("round %d: %d lockouts counted, want %d", round, lockouts, 2*round)
+		}
+		// Within the window, the next failures after the lockout are counted from the start
+		clock.Advance(50 * time.Second)
+	}
+}
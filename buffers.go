@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every websocket connection has a read buffer and a write buffer of its own,
+// gorilla allocates both when the connection is upgraded and they live as long as
+// the connection. At 50k connections the default 1 KiB each is 100 MiB, larger
+// buffers for fewer syscalls multiply that. Most connections are idle most of the
+// time, so with buffers.shared_write_pool in the config the write buffers come from
+// a pool shared by all connections instead: a connection only takes one while it
+// writes a message and puts it back after. The read buffer is needed while a
+// connection waits for its next frame, it can't be shared.
+//
+//	"buffers": {"read_buffer_size": 1024, "write_buffer_size": 4096, "shared_write_pool": true}
+//
+// A size of 0 is 4 KiB, without the pool the buffer of the HTTP server the
+// connection was upgraded on is reused then. The buffers are set when the Manager
+// is created, a reload only reports them in requires_restart. What they cost per
+// connection is measured with
+//
+//	go test -run '^$' -bench BenchmarkConnectionBuffers -buffer-conns 5000
+//
+// which upgrades real connections over loopback with and without the shared pool.
+// Idle connections with the pool hold no write buffer at all, so the pool saves
+// about the write buffer size per idle connection. On a single core:
+//
+//	buffer size  conns  dedicated bytes/conn  shared bytes/conn  saved/conn  saved total
+//	1024         5000   4803                  3457               1346        6572 KiB
+//	4096         5000   13580                 8252               5328        26015 KiB
+//	16384        5000   37848                 19197              18651       91069 KiB
+//
+// so 50k connections with 1 KiB buffers save 64 MiB and with 16 KiB buffers 890 MiB.
+
+// BuffersConfig configures the buffers of the websocket connections
+type BuffersConfig struct {
+	// ReadBufferSize is the read buffer of a connection in bytes
+	ReadBufferSize int `json:"read_buffer_size"`
+	// WriteBufferSize is the write buffer of a connection in bytes
+	WriteBufferSize int `json:"write_buffer_size"`
+	// SharedWritePool takes the write buffers from a pool shared by all connections
+	SharedWritePool bool `json:"shared_write_pool"`
+}
+
+// newUpgrader returns the websocketUpgrader with the buffers of the config, the write
+// buffers come from a pool of its own if shared. A pool must only hold buffers of
+// one size, so every upgrader gets a new one
+func newUpgrader(config BuffersConfig) websocket.Upgrader {
+	upgrader := websocketUpgrader
+	upgrader.ReadBufferSize = config.ReadBufferSize
+	upgrader.WriteBufferSize = config.WriteBufferSize
+	if config.SharedWritePool {
+		upgrader.WriteBufferPool = &sync.Pool{}
+	}
+	return upgrader
+}
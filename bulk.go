@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Bulk operations change many clients at once, each under a single acquisition
+// of the locks instead of one round trip per user: adding users to a room,
+// announcing to several rooms and kicking everybody out of a room. Operators use
+// them with the bulk_* events, backends through the admin API.
+
+const (
+	// EventBulkAddMembers is sent by an operator to add users to a room
+	EventBulkAddMembers = "bulk_add_members"
+	// EventBulkAnnounce is sent by an operator to announce to several rooms
+	EventBulkAnnounce = "bulk_announce"
+	// EventBulkKick is sent by an operator to disconnect all members of a room
+	EventBulkKick = "bulk_kick"
+	// EventBulkResult is the response to the bulk events
+	EventBulkResult = "bulk_result"
+)
+
+var (
+	ErrBulkTooLarge = errors.New("too many users or rooms in a bulk operation")
+)
+
+// maxBulkSize is the most users or rooms in a single bulk operation
+var maxBulkSize = 1000
+
+// BulkAddMembersEvent is the payload sent in the
+// bulk_add_members event, and the body of POST /admin/rooms/{room}/members
+type BulkAddMembersEvent struct {
+	Room      string   `json:"room"`
+	Usernames []string `json:"usernames"`
+}
+
+// BulkAnnounceEvent is the payload sent in the
+// bulk_announce event
+type BulkAnnounceEvent struct {
+	Rooms    []string `json:"rooms"`
+	Message  string   `json:"message"`
+	Priority string   `json:"priority,omitempty"`
+}
+
+// BulkKickEvent is the payload sent in the
+// bulk_kick event
+type BulkKickEvent struct {
+	Room string `json:"room"`
+}
+
+// BulkResultEvent is the payload sent in the
+// bulk_result event, only the counts of the operation are set
+type BulkResultEvent struct {
+	Operation string `json:"operation"`
+	// Invited counts the users added to the invites of the room
+	Invited int `json:"invited,omitempty"`
+	// Moved counts the connected clients moved into the room
+	Moved     int `json:"moved,omitempty"`
+	Delivered int `json:"delivered,omitempty"`
+	Kicked    int `json:"kicked,omitempty"`
+}
+
+// addMembers lets the users into the room, inviting the ones its visibility keeps
+// out, and moves their connected clients into it. Limits on members don't apply
+func (m *Manager) addMembers(name string, usernames []string, actor string) (BulkResultEvent, error) {
+	result := BulkResultEvent{Operation: EventBulkAddMembers}
+	if len(usernames) > maxBulkSize {
+		return result, fmt.Errorf("%w: at most %d", ErrBulkTooLarge, maxBulkSize)
+	}
+	for _, username := range usernames {
+		if err := validateUsername(username); err != nil {
+			return result, err
+		}
+	}
+
+	m.roomSettingsLock.Lock()
+	room, err := m.roomSettings(name)
+	if err != nil {
+		m.roomSettingsLock.Unlock()
+		return result, err
+	}
+	for _, username := range usernames {
+		if !room.admits(username) {
+			room.Invited = append(room.Invited, username)
+			result.Invited++
+		}
+	}
+	if result.Invited > 0 {
+		err = m.store.SaveRoom(room)
+	}
+	m.roomSettingsLock.Unlock()
+	if err != nil {
+		return result, err
+	}
+
+	reactions := m.historyReactions(name, defaultSwitchHistory)
+
+	// Same as switchRoom, only for all the clients at once
+	r := m.room(name)
+	// Loading the room reactivated it if it was archived
+	room.ArchivedAt = nil
+	r.Lock()
+	m.Lock()
+	for client := range m.clients {
+		if client.room == name || !slices.Contains(usernames, client.username) {
+			continue
+		}
+		from := client.room
+		leaving := !m.userInRoom(from, client.username, client)
+		joining := !m.userInRoom(name, client.username, client)
+		m.moveClient(client, name)
+		result.Moved++
+
+		switched, err := m.roomSwitched(from, room, r, defaultSwitchHistory, reactions)
+		if err != nil {
+			m.Unlock()
+			r.Unlock()
+			return result, err
+		}
+		client.send(switched)
+		if leaving {
+			m.sendMemberEvent(EventMemberLeft, from, client.username, nil)
+		}
+		if joining {
+			m.sendMemberEvent(EventMemberJoined, name, client.username, client)
+		}
+	}
+	m.Unlock()
+	r.Unlock()
+
+	for _, username := range usernames {
+		m.addMembership(username, name)
+	}
+	m.audit(AuditEntry{
+		Action:  AuditBulkAddMembers,
+		Actor:   actor,
+		Target:  name,
+		Details: map[string]string{"usernames": strings.Join(usernames, ","), "moved": strconv.Itoa(result.Moved)},
+	})
+	return result, nil
+}
+
+// kickRoom disconnects all clients in the room and returns how many there were
+func (m *Manager) kickRoom(room, actor string) int {
+	m.Lock()
+	var kicked []*Client
+	for client := range m.members[room] {
+		kicked = append(kicked, client)
+	}
+	for _, client := range kicked {
+		m.dropClient(client)
+	}
+	m.Unlock()
+
+	m.audit(AuditEntry{
+		Action:  AuditKick,
+		Actor:   actor,
+		Target:  room,
+		Details: map[string]string{"room": room, "kicked": strconv.Itoa(len(kicked))},
+	})
+	return len(kicked)
+}
+
+// BulkAddMembersHandler adds users to a room for an operator
+func BulkAddMembersHandler(event Event, c *Client) error {
+	var req BulkAddMembersEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if !c.manager.allowed(c, PermissionOperator) {
+		return ErrPermissionDenied
+	}
+
+	result, err := c.manager.addMembers(req.Room, req.Usernames, c.username)
+	if err != nil {
+		return err
+	}
+	return c.manager.replyJSON(c, EventBulkResult, result)
+}
+
+// BulkAnnounceHandler announces to several rooms for an operator
+func BulkAnnounceHandler(event Event, c *Client) error {
+	var req BulkAnnounceEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if !c.manager.allowed(c, PermissionOperator) {
+		return ErrPermissionDenied
+	}
+	if len(req.Rooms) == 0 {
+		return ErrInvalidRoom
+	}
+	if len(req.Rooms) > maxBulkSize {
+		return fmt.Errorf("%w: at most %d", ErrBulkTooLarge, maxBulkSize)
+	}
+
+	delivered, err := c.manager.announce(Announcement{
+		Message:  req.Message,
+		Priority: req.Priority,
+		Rooms:    req.Rooms,
+		Sender:   c.username,
+	})
+	if err != nil {
+		return err
+	}
+	return c.manager.replyJSON(c, EventBulkResult, BulkResultEvent{Operation: EventBulkAnnounce, Delivered: delivered})
+}
+
+// BulkKickHandler disconnects everybody in a room for an operator
+func BulkKickHandler(event Event, c *Client) error {
+	var req BulkKickEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if !c.manager.allowed(c, PermissionOperator) {
+		return ErrPermissionDenied
+	}
+	if err := validateRoomName(req.Room); err != nil {
+		return err
+	}
+
+	// The operator may be in the room, the result is sent before it is kicked too
+	kicked := c.manager.kickRoom(req.Room, c.username)
+	return c.manager.replyJSON(c, EventBulkResult, BulkResultEvent{Operation: EventBulkKick, Kicked: kicked})
+}
+
+// addMembersHandler adds users to a room, like {"usernames":["alice","bob"]}
+func (m *Manager) addMembersHandler(w http.ResponseWriter, r *http.Request) {
+	var req BulkAddMembersEvent
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := m.addMembers(r.PathValue("room"), req.Usernames, "admin")
+	switch {
+	case errors.Is(err, ErrRoomNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrBulkTooLarge), errors.Is(err, ErrInvalidUsername):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// kickRoomHandler disconnects all clients in a room
+func (m *Manager) kickRoomHandler(w http.ResponseWriter, r *http.Request) {
+	kicked := m.kickRoom(r.PathValue("room"), "admin")
+	writeJSON(w, http.StatusOK, BulkResultEvent{Operation: EventBulkKick, Kicked: kicked})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// New optimizations only help clients that understand them, and clients stay in
+// the wild for years. Instead of the server guessing from the query string, a
+// client can send hello as its first event, declaring what it can take:
+//
+//	{"type":"hello","payload":{"capabilities":{"batch":true,"compression":true,"binary":false,"max_message_size":65536}}}
+//
+// The server records them on the client, applies them to everything it sends
+// afterwards and answers with a new welcome whose protocol.capabilities are the
+// ones in effect, which can be fewer than declared:
+//
+//   - batch sends several events per frame, for JSON clients granted batching, see batch.go
+//   - compression compresses frames, if permessage-deflate was negotiated and compression is granted
+//   - max_message_size is the largest frame the client takes, larger batches are sent
+//     as single events and larger events are dropped, at least minClientMessageSize
+//   - binary is whether frames are binary, the subprotocol picks the codec before
+//     the first frame, so it can't change on an open connection. A client that can
+//     decode them connects with a binary subprotocol, like chat.v1.proto, next time
+//
+// Clients that send no hello keep working as before: batching with batch=1,
+// compression if negotiated and granted, frames of any size.
+
+const (
+	// EventHello is sent by a client to declare its capabilities, it is answered with a welcome
+	EventHello = "hello"
+)
+
+// minClientMessageSize is the smallest max_message_size a client may declare,
+// smaller ones are raised to it so the events of the server still fit
+var minClientMessageSize = 4096
+
+// ClientCapabilities are what a client can take
+type ClientCapabilities struct {
+	// Batch accepts several events per frame as a JSON array
+	Batch bool `json:"batch"`
+	// Compression accepts compressed frames
+	Compression bool `json:"compression"`
+	// Binary accepts binary frames
+	Binary bool `json:"binary"`
+	// MaxMessageSize is the largest frame in bytes, 0 is unlimited
+	MaxMessageSize int `json:"max_message_size,omitempty"`
+	// Chunks accepts events larger than MaxMessageSize as chunk events, see stream.go
+	Chunks bool `json:"chunks,omitempty"`
+}
+
+// HelloEvent is the payload sent in the
+// hello event
+type HelloEvent struct {
+	Capabilities ClientCapabilities `json:"capabilities"`
+	// Locale is the locale the messages of the server are translated to, see localize.go
+	Locale string `json:"locale,omitempty"`
+}
+
+// declareCapabilities records the capabilities of the client and applies the ones
+// the connection and the feature flags allow
+func (c *Client) declareCapabilities(capabilities ClientCapabilities) {
+	m := c.manager
+	_, isJSON := c.codec.(jsonCodec)
+	c.batch.Store(capabilities.Batch && isJSON && m.featureGranted(FlagBatching, c.username))
+	c.compress.Store(capabilities.Compression && m.featureGranted(FlagCompression, c.username))
+	if capabilities.MaxMessageSize > 0 {
+		c.maxFrameSize.Store(int64(max(capabilities.MaxMessageSize, minClientMessageSize)))
+	} else {
+		c.maxFrameSize.Store(0)
+	}
+	c.chunks.Store(capabilities.Chunks && m.config().Streams.Enabled)
+	c.capabilities.Store(&capabilities)
+}
+
+// effectiveCapabilities returns the capabilities in effect for the client, nil if
+// it declared none
+func (c *Client) effectiveCapabilities() *ClientCapabilities {
+	if c.capabilities.Load() == nil {
+		return nil
+	}
+	_, binary := c.codec.(protoCodec)
+	return &ClientCapabilities{
+		Batch:          c.batch.Load(),
+		Compression:    c.compress.Load(),
+		Binary:         binary,
+		MaxMessageSize: int(c.maxFrameSize.Load()),
+		Chunks:         c.chunks.Load(),
+	}
+}
+
+// compressionWriter is implemented by transports that can turn compression of
+// their frames on and off, *websocket.Conn does
+type compressionWriter interface {
+	EnableWriteCompression(enable bool)
+}
+
+// applyCompression turns compression of the next frame on or off, call it from the writer
+func (c *Client) applyCompression() {
+	if w, ok := c.connection.(compressionWriter); ok {
+		w.EnableWriteCompression(c.compress.Load())
+	}
+}
+
+// oversized returns true if the encoded event is larger than the client takes,
+// the event is then sent in chunks if the client takes them or else dropped
+func (c *Client) oversized(message Event, size int) bool {
+	limit := c.maxFrameSize.Load()
+	if limit == 0 || int64(size) <= limit {
+		return false
+	}
+	if c.chunks.Load() && message.Type != EventChunk {
+		c.writeChunks(message, int(limit))
+		return true
+	}
+	c.stats.oversized.Add(1)
+	log.Printf("dropped %s of %d bytes for client %s, it takes at most %d", message.Type, size, c.id, limit)
+	return true
+}
+
+// HelloHandler records the capabilities of the client and answers with a welcome
+func HelloHandler(event Event, c *Client) error {
+	var hello HelloEvent
+	if err := json.Unmarshal(event.Payload, &hello); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	c.declareCapabilities(hello.Capabilities)
+	c.setLocale(hello.Locale)
+
+	m := c.manager
+	m.RLock()
+	defer m.RUnlock()
+	if _, ok := m.clients[c]; ok {
+		m.sendWelcome(c)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// The catalog lists the events of the protocol with the Go type of their payload
+// and the direction they go in. The client SDKs are generated from it, see
+// sdkgen.go, so the frontend and the server can't drift apart. Events without a
+// payload have a nil Payload. Types that go both ways, like stats, are listed once
+// per direction since the payloads differ.
+//
+// Handlers added outside this package describe their events with RegisterEventSpec,
+// from an init function, to have them in the generated code as well.
+
+const (
+	// DirectionClient is an event sent by clients to the server
+	DirectionClient = "client"
+	// DirectionServer is an event sent by the server to clients
+	DirectionServer = "server"
+)
+
+// EventSpec describes an event of the protocol
+type EventSpec struct {
+	// Type is the type of the event
+	Type string
+	// Direction is DirectionClient or DirectionServer
+	Direction string
+	// Payload is a value of the type of the payload, nil if it has none
+	Payload any
+}
+
+var (
+	eventSpecsLock sync.RWMutex
+	// eventSpecs are the built-in events, followed by the registered ones
+	eventSpecs = []EventSpec{
+		{EventHello, DirectionClient, HelloEvent{}},
+		{EventSendMessage, DirectionClient, SendMessageEvent{}},
+		{EventJoinRoom, DirectionClient, JoinRoomEvent{}},
+		{EventSwitchRoom, DirectionClient, SwitchRoomEvent{}},
+		{EventSendDirectMessage, DirectionClient, SendDirectMessageEvent{}},
+		{EventRegisterPushToken, DirectionClient, PushToken{}},
+		{EventScheduleMessage, DirectionClient, ScheduleMessageEvent{}},
+		{EventListScheduledMessages, DirectionClient, nil},
+		{EventCancelScheduledMessage, DirectionClient, CancelScheduledMessageEvent{}},
+		{EventGetHistory, DirectionClient, GetHistoryEvent{}},
+		{EventAck, DirectionClient, AckEvent{}},
+		{EventTyping, DirectionClient, TypingEvent{}},
+		{EventAddReaction, DirectionClient, ReactionEvent{}},
+		{EventRemoveReaction, DirectionClient, ReactionEvent{}},
+		{EventGetRoom, DirectionClient, GetRoomEvent{}},
+		{EventUpdateRoom, DirectionClient, UpdateRoomEvent{}},
+		{EventInviteToRoom, DirectionClient, InviteToRoomEvent{}},
+		{EventListRooms, DirectionClient, ListRoomsEvent{}},
+		{EventPublishKeys, DirectionClient, PublishKeysEvent{}},
+		{EventFetchKeys, DirectionClient, FetchKeysEvent{}},
+		{EventE2EESend, DirectionClient, E2EESendEvent{}},
+		{EventListDevices, DirectionClient, nil},
+		{EventRevokeDevice, DirectionClient, RevokeDeviceEvent{}},
+		{EventTimeSync, DirectionClient, TimeSyncEvent{}},
+		{EventBulkAddMembers, DirectionClient, BulkAddMembersEvent{}},
+		{EventBulkAnnounce, DirectionClient, BulkAnnounceEvent{}},
+		{EventBulkKick, DirectionClient, BulkKickEvent{}},
+		{EventStats, DirectionClient, nil},
+		{EventSetNickname, DirectionClient, SetNicknameEvent{}},
+		{EventGetProfile, DirectionClient, GetProfileEvent{}},
+		{EventUpdateProfile, DirectionClient, UpdateProfileEvent{}},
+		{EventSetStatus, DirectionClient, SetStatusEvent{}},
+		{EventSearchMessages, DirectionClient, SearchMessagesEvent{}},
+		{EventSubscribeState, DirectionClient, SubscribeStateEvent{}},
+		{EventUnsubscribeState, DirectionClient, UnsubscribeStateEvent{}},
+		{EventUpdateState, DirectionClient, UpdateStateEvent{}},
+		{EventRTCSignal, DirectionClient, RTCSignalEvent{}},
+		{EventGetICEServers, DirectionClient, nil},
+		{EventOpenDoc, DirectionClient, OpenDocEvent{}},
+		{EventCloseDoc, DirectionClient, OpenDocEvent{}},
+		{EventDocUpdate, DirectionClient, DocUpdateEvent{}},
+		{EventDocAwareness, DirectionClient, DocAwarenessEvent{}},
+		{EventDocSnapshot, DirectionClient, DocSnapshotEvent{}},
+		{EventChunk, DirectionClient, ChunkEvent{}},
+		{EventCreateLobby, DirectionClient, CreateLobbyEvent{}},
+		{EventJoinLobby, DirectionClient, JoinLobbyEvent{}},
+		{EventFindLobby, DirectionClient, CreateLobbyEvent{}},
+		{EventLeaveLobby, DirectionClient, nil},
+		{EventLobbyReady, DirectionClient, LobbyReadyEvent{}},
+		{EventListLobbies, DirectionClient, ListLobbiesEvent{}},
+
+		{EventWelcome, DirectionServer, WelcomeEvent{}},
+		{EventError, DirectionServer, ErrorEvent{}},
+		{EventSystem, DirectionServer, SystemEvent{}},
+		{EventEphemeral, DirectionServer, EphemeralEvent{}},
+		{EventServerDraining, DirectionServer, ServerDrainingEvent{}},
+		{EventSlowConsumer, DirectionServer, SlowConsumerEvent{}},
+		{EventSessionRecording, DirectionServer, SessionRecordingEvent{}},
+		{EventAccountErased, DirectionServer, AccountErasedEvent{}},
+		{EventNewMessage, DirectionServer, NewMessageEvent{}},
+		{EventDirectMessage, DirectionServer, DirectMessageEvent{}},
+		{EventMention, DirectionServer, MentionEvent{}},
+		{EventUserTyping, DirectionServer, UserTypingEvent{}},
+		{EventReactionUpdated, DirectionServer, ReactionUpdatedEvent{}},
+		{EventHistory, DirectionServer, HistoryEvent{}},
+		{EventMessageScheduled, DirectionServer, ScheduledMessage{}},
+		{EventScheduledMessages, DirectionServer, ScheduledMessagesEvent{}},
+		{EventScheduledMessageCancelled, DirectionServer, CancelScheduledMessageEvent{}},
+		{EventRoomSwitched, DirectionServer, RoomSwitchedEvent{}},
+		{EventMemberJoined, DirectionServer, MemberEvent{}},
+		{EventMemberLeft, DirectionServer, MemberEvent{}},
+		{EventRoomInfo, DirectionServer, RoomInfo{}},
+		{EventRoomUpdated, DirectionServer, RoomUpdatedEvent{}},
+		{EventRoomInvite, DirectionServer, RoomInviteEvent{}},
+		{EventRoomList, DirectionServer, RoomListEvent{}},
+		{EventRoomClosed, DirectionServer, RoomClosedEvent{}},
+		{EventPresence, DirectionServer, PresenceEvent{}},
+		{EventKeysPublished, DirectionServer, KeysPublishedEvent{}},
+		{EventKeyBundles, DirectionServer, KeyBundlesEvent{}},
+		{EventE2EEMessage, DirectionServer, E2EEMessageEvent{}},
+		{EventDeviceList, DirectionServer, DeviceListEvent{}},
+		{EventDeviceRevoked, DirectionServer, DeviceRevokedEvent{}},
+		{EventTimeSync, DirectionServer, TimeSyncEvent{}},
+		{EventBulkResult, DirectionServer, BulkResultEvent{}},
+		{EventStats, DirectionServer, ConnectionStatsEvent{}},
+		{EventNicknameChanged, DirectionServer, NicknameChangedEvent{}},
+		{EventProfile, DirectionServer, ProfileEvent{}},
+		{EventProfileUpdated, DirectionServer, ProfileEvent{}},
+		{EventSearchResults, DirectionServer, SearchResultsEvent{}},
+		{EventStateSnapshot, DirectionServer, StateSnapshotEvent{}},
+		{EventStateDelta, DirectionServer, StateDeltaEvent{}},
+		{EventRTCSignal, DirectionServer, RTCSignalEvent{}},
+		{EventICEServers, DirectionServer, ICEServersEvent{}},
+		{EventDocOpened, DirectionServer, DocOpenedEvent{}},
+		{EventDocUpdated, DirectionServer, DocUpdatedEvent{}},
+		{EventDocAwareness, DirectionServer, DocAwarenessEvent{}},
+		{EventCompactDoc, DirectionServer, CompactDocEvent{}},
+		{EventCountdownStarted, DirectionServer, CountdownEvent{}},
+		{EventCountdownCancelled, DirectionServer, CountdownEvent{}},
+		{EventLobbies, DirectionServer, LobbiesEvent{}},
+		{EventLobbyUpdated, DirectionServer, Lobby{}},
+		{EventLobbyLeft, DirectionServer, LobbyLeftEvent{}},
+		{EventLobbyStarted, DirectionServer, LobbyStartedEvent{}},
+		{EventChunk, DirectionServer, ChunkEvent{}},
+	}
+)
+
+// RegisterEventSpec adds an event to the catalog, an event of the same type and
+// direction is replaced
+func RegisterEventSpec(spec EventSpec) {
+	eventSpecsLock.Lock()
+	defer eventSpecsLock.Unlock()
+
+	eventSpecs = slices.DeleteFunc(eventSpecs, func(s EventSpec) bool {
+		return s.Type == spec.Type && s.Direction == spec.Direction
+	})
+	eventSpecs = append(eventSpecs, spec)
+}
+
+// EventSpecs returns the events in the catalog, the ones clients send first
+func EventSpecs() []EventSpec {
+	eventSpecsLock.RLock()
+	defer eventSpecsLock.RUnlock()
+
+	specs := slices.Clone(eventSpecs)
+	slices.SortStableFunc(specs, func(a, b EventSpec) int {
+		switch {
+		case a.Direction == b.Direction:
+			return 0
+		case a.Direction == DirectionClient:
+			return -1
+		}
+		return 1
+	})
+	return specs
+}
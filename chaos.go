@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Chaos mode lets frontend teams check how their clients cope with a bad
+// network: events held back, lost, delivered twice or the connection dropped.
+// It is a test mode, off unless chaos.enabled is set in the config, and the
+// faults are then set with the admin API:
+//
+//	PUT /admin/chaos {"faults":[{"users":["alice"],"latency":"500ms","jitter":"1s"},
+//	                            {"drop_rate":0.05,"duplicate_rate":0.05,"disconnect_rate":0.001}]}
+//	GET /admin/chaos
+//	DELETE /admin/chaos
+//
+// A fault applies to the clients of its users and client IDs, or to every client
+// if it names none. The rates are the share of the events written to those
+// clients that is dropped, written twice, or that disconnects the client instead
+// of being written, so 0.05 hits one event in twenty. Latency holds every event
+// back before it is written, plus a random part of Jitter, later events wait
+// behind it like on a slow connection. Faults are applied where events are
+// written, so pings, pongs and close frames are left alone.
+
+const (
+	AuditChaos = "chaos"
+)
+
+var (
+	ErrChaosDisabled = errors.New("chaos mode is not enabled")
+	ErrChaosFault    = errors.New("rates must be between 0 and 1 and latency and jitter can't be negative")
+)
+
+// ChaosFault is a fault injected into the events written to some clients
+type ChaosFault struct {
+	// Users and Clients pick the clients by username and client ID, all clients if
+	// both are empty
+	Users   []string `json:"users,omitempty"`
+	Clients []string `json:"clients,omitempty"`
+	// Latency holds every event back before it is written, plus up to Jitter
+	Latency Duration `json:"latency,omitempty"`
+	Jitter  Duration `json:"jitter,omitempty"`
+	// DropRate is the share of events, 0 to 1, that are never written
+	DropRate float64 `json:"drop_rate,omitempty"`
+	// DuplicateRate is the share of events that are written twice
+	DuplicateRate float64 `json:"duplicate_rate,omitempty"`
+	// DisconnectRate is the share of events that disconnect the client instead
+	DisconnectRate float64 `json:"disconnect_rate,omitempty"`
+}
+
+// ChaosState is the body of PUT /admin/chaos and the response of GET /admin/chaos
+type ChaosState struct {
+	Faults []ChaosFault `json:"faults"`
+}
+
+// validate returns ErrChaosFault if a rate or duration is out of range
+func (f ChaosFault) validate() error {
+	for _, rate := range []float64{f.DropRate, f.DuplicateRate, f.DisconnectRate} {
+		if rate < 0 || rate > 1 {
+			return ErrChaosFault
+		}
+	}
+	if f.Latency < 0 || f.Jitter < 0 {
+		return ErrChaosFault
+	}
+	return nil
+}
+
+// applies returns true if the fault applies to the client
+func (f ChaosFault) applies(c *Client) bool {
+	if len(f.Users) == 0 && len(f.Clients) == 0 {
+		return true
+	}
+	return slices.Contains(f.Users, c.username) || slices.Contains(f.Clients, c.id)
+}
+
+// chaosFaults returns the faults injected right now, none unless chaos mode is enabled
+func (m *Manager) chaosFaults() []ChaosFault {
+	if !m.config().Chaos.Enabled {
+		return nil
+	}
+	if faults := m.chaos.Load(); faults != nil {
+		return *faults
+	}
+	return nil
+}
+
+// setChaosFaults replaces the injected faults
+func (m *Manager) setChaosFaults(faults []ChaosFault) error {
+	if !m.config().Chaos.Enabled {
+		return ErrChaosDisabled
+	}
+	for _, fault := range faults {
+		if err := fault.validate(); err != nil {
+			return err
+		}
+	}
+	m.chaos.Store(&faults)
+	if len(faults) > 0 {
+		log.Printf("chaos mode injects %d faults", len(faults))
+	}
+	return nil
+}
+
+// chaosWrites applies the faults to an event about to be written to the client
+// and returns how often to write it: 1 normally, 0 if it was dropped or the client
+// disconnected instead, 2 if it is duplicated
+func (c *Client) chaosWrites() int {
+	faults := c.manager.chaosFaults()
+	if len(faults) == 0 {
+		return 1
+	}
+
+	writes := 1
+	for _, fault := range faults {
+		if !fault.applies(c) {
+			continue
+		}
+		if delay := time.Duration(fault.Latency); delay > 0 || fault.Jitter > 0 {
+			if fault.Jitter > 0 {
+				delay += rand.N(time.Duration(fault.Jitter))
+			}
+			time.Sleep(delay)
+		}
+		if rand.Float64() < fault.DisconnectRate {
+			log.Printf("chaos: disconnecting client %s", c.id)
+			// The writer stops once the queues are closed
+			go c.manager.removeClient(c)
+			return 0
+		}
+		if rand.Float64() < fault.DropRate {
+			writes = 0
+		} else if writes > 0 && rand.Float64() < fault.DuplicateRate {
+			writes = 2
+		}
+	}
+	return writes
+}
+
+// chaosHandler shows and changes the faults of chaos mode, GET shows them, PUT
+// replaces them and DELETE removes them all
+func (m *Manager) chaosHandler(w http.ResponseWriter, r *http.Request) {
+	if !m.config().Chaos.Enabled {
+		http.Error(w, ErrChaosDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	var state ChaosState
+	switch r.Method {
+	case http.MethodPut:
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+	default:
+		writeJSON(w, http.StatusOK, ChaosState{Faults: append([]ChaosFault{}, m.chaosFaults()...)})
+		return
+	}
+
+	if err := m.setChaosFaults(state.Faults); err != nil {
+		http.Error(w, fmt.Sprintf("bad fault: %v", err), http.StatusBadRequest)
+		return
+	}
+	m.audit(AuditEntry{
+		Action:     AuditChaos,
+		Actor:      "admin",
+		RemoteAddr: r.RemoteAddr,
+		Details:    map[string]string{"faults": strconv.Itoa(len(state.Faults))},
+	})
+	writeJSON(w, http.StatusOK, ChaosState{Faults: append([]ChaosFault{}, state.Faults...)})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// callChaos calls the chaos handler like the admin API does
+func callChaos(m *Manager, method, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	m.chaosHandler(w, httptest.NewRequest(method, "/admin/chaos", strings.NewReader(body)))
+	return w
+}
+
+func TestChaosIsOffByDefault(t *testing.T) {
+	_, m := newRoomTestServer(t, DefaultConfig())
+	if w := callChaos(m, http.MethodPut, `{"faults":[{"drop_rate":1}]}`); w.Code != http.StatusNotFound {
+		t.Errorf("PUT without chaos mode: %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if err := m.setChaosFaults([]ChaosFault{{DropRate: 1}}); !errors.Is(err, ErrChaosDisabled) {
+		t.Errorf("setting faults without chaos mode: %v, want %v", err, ErrChaosDisabled)
+	}
+}
+
+func TestChaosFaults(t *testing.T) {
+	config := DefaultConfig()
+	config.Chaos.Enabled = true
+	server, m := newRoomTestServer(t, config)
+	alice := server.Connect("alice")
+	bob := server.Connect("bob")
+	carol := server.Connect("carol")
+
+	for _, body := range []string{`{"faults":[{"drop_rate":1.5}]}`, `{"faults":[{"latency":"-1s"}]}`, `{"faults":`} {
+		if w := callChaos(m, http.MethodPut, body); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Every event to alice is lost, every event to bob is written twice and carol
+	// is held back
+	body := `{"faults":[{"users":["alice"],"drop_rate":1},{"users":["bob"],"duplicate_rate":1},{"clients":["` + carol.ID + `"],"latency":"100ms"}]}`
+	if w := callChaos(m, http.MethodPut, body); w.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	sent := time.Now()
+	m.sendToRoom(defaultRoom, Event{Type: "tick"})
+	if err := alice.ExpectNone("tick", 200*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+	for range 2 {
+		if _, err := bob.Expect("tick", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := carol.Expect("tick", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if held := time.Since(sent); held < 100*time.Millisecond {
+		t.Errorf("the event to carol was held back for %s, want at least 100ms", held)
+	}
+
+	if w := callChaos(m, http.MethodGet, ""); !strings.Contains(w.Body.String(), `"drop_rate":1`) {
+		t.Errorf("GET shows %s, want the faults", w.Body)
+	}
+	if w := callChaos(m, http.MethodDelete, ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	m.sendToRoom(defaultRoom, Event{Type: "tock"})
+	if _, err := alice.Expect("tock", time.Second); err != nil {
+		t.Errorf("events are still dropped after removing the faults: %v", err)
+	}
+	entries, _ := m.auditLog.Query(AuditQuery{Action: AuditChaos})
+	if len(entries) != 2 {
+		t.Errorf("%d chaos changes audited, want 2", len(entries))
+	}
+}
+
+func TestChaosDisconnects(t *testing.T) {
+	config := DefaultConfig()
+	config.Chaos.Enabled = true
+	server, m := newRoomTestServer(t, config)
+	alice := server.Connect("alice")
+
+	if err := m.setChaosFaults([]ChaosFault{{Users: []string{"alice"}, DisconnectRate: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	m.sendToRoom(defaultRoom, Event{Type: "tick"})
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := m.clientByID(alice.ID); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("alice is still connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
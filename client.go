@@ -1,29 +1,52 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
 var (
-	// pongWait is how long we will await a pong response from client
-	pongWait = 10 * time.Second
-	// pingInterval has to be less than pongWait, We cant multiply by 0.9 to get 90% of time
-	// Because that can make decimals, so instead *9 / 10 to get 90%
-	// The reason why it has to be less than PingRequency is becuase otherwise it will send a new Ping before getting response
-	pingInterval = (pongWait * 9) / 10
+	// egressBufferSize is how many events can be queued for a client before new ones are dropped
+	egressBufferSize = 256
+	// priorityBufferSize is how many high priority events can be queued for a client
+	priorityBufferSize = 16
+	// maxMessageSize is the largest message in bytes a client may send
+	maxMessageSize = 1024
+	// closeWait is how long writing the close frame may take before the connection is closed anyway
+	closeWait = time.Second
+	// maxRequestBodySize is the largest body accepted by the HTTP endpoints
+	maxRequestBodySize int64 = 64 * 1024
 )
 
+// defaultRoom is the room clients are in when connecting
+const defaultRoom = "general"
+
 // ClientList is a map to help manage a map of clients
 type ClientList map[*Client]bool
 
 // Client is a websocket client, basically a frontend visitor
 type Client struct {
-	// the websocket connection
-	connection *websocket.Conn
+	// id is a unique identifier of the connection
+	id string
+	// username is the authenticated user of the connection
+	username string
+	// guest is set for clients of guests, see guest.go
+	guest bool
+	// deviceID is the device the client connected from, empty for API keys, see device.go
+	deviceID string
+	// room is the chat room the client is in, only change it while holding the manager lock
+	room string
+
+	// the websocket connection, or an in-memory transport in tests
+	connection Transport
 
 	// manager is the used to manage the client
 	manager *Manager
@@ -31,14 +54,224 @@ type Client struct {
 	// egress is used to avoid concurrent writes on the WebSocket
 	// egress chan []byte
 	egress chan Event
+	// priority is a separate queue for high priority events, so they are not
+	// dropped when egress is full and are written before anything on egress
+	priority chan Event
+
+	// protocol is the negotiated subprotocol, see protocol.go
+	protocol Protocol
+	// codec is used to encode and decode events, based on the negotiated subprotocol
+	codec Codec
+
+	// limiter rate limits the events sent by the client, only used by the read goroutine
+	limiter tokenBucket
+	// ephemeralLimiter rate limits the ephemeral events instead, see ephemeral.go
+	ephemeralLimiter tokenBucket
+	// coalesced holds the latest ephemeral event of each key with a marker on egress
+	coalesced     map[string]Event
+	coalescedLock sync.Mutex
+
+	// lastActivity is when the client last sent an event in unix nanoseconds, see idle.go
+	lastActivity atomic.Int64
+	// bot is set for the clients of bots running in the server, they are never idle
+	bot bool
+
+	// panics counts the handler panics caused by events of this client
+	panics atomic.Int32
+
+	// netpoll is set when the client has no read and write goroutines, see netpoll.go
+	netpoll bool
+	// fd is the file descriptor of the connection in netpoll mode
+	fd int
+	// flushing is set while a flush goroutine writes the queued events in netpoll mode
+	flushing atomic.Bool
+
+	// batch is set when the client accepts batches of events as a JSON array
+	batch atomic.Bool
+	// compress is set when frames may be compressed, if permessage-deflate was negotiated
+	compress atomic.Bool
+	// maxFrameSize is the largest frame in bytes the client takes, 0 is unlimited
+	maxFrameSize atomic.Int64
+	// chunks is set when the client takes events larger than maxFrameSize as chunks, see stream.go
+	chunks atomic.Bool
+	// capabilities are what the client declared in hello, nil if it sent none, see capabilities.go
+	capabilities atomic.Pointer[ClientCapabilities]
+	// locale is the locale the client declared, nil if it declared none, see localize.go
+	locale atomic.Pointer[string]
+
+	// apiKey is the key the client connected with, nil for clients that logged in
+	apiKey *APIKey
+
+	// qos tracks unacked events when the client asked for at-least-once delivery, nil otherwise
+	qos *qosSession
+
+	// stats tracks how fast the client takes its events, see slowconsumer.go
+	stats egressStats
+	// traffic counts what went over the connection, see stats.go
+	traffic trafficStats
+	// ping measures the round trip time, see rtt.go
+	ping rttEstimator
+	// connectedAt is when the client connected
+	connectedAt time.Time
+
+	// recorder records the events of the session while an operator has it recorded, see recording.go
+	recorder atomic.Pointer[sessionRecorder]
+
+	// flags are the feature flags granted to the user when it connected, see flags.go
+	flags []string
+
+	// outboundFilters are applied to the events sent to this client, guarded by the manager lock, see outbound.go
+	outboundFilters []*outboundFilter
+
+	// closeFrame is the close frame sent when the connection is closed, a normal closure
+	// unless failConnection set another one
+	closeFrame atomic.Pointer[[]byte]
+	// closeSent is set once a close frame was sent, the close of the server or the echo
+	// of the close of the client
+	closeSent atomic.Bool
+	// peerClose is the close frame of the client, nil if it sent none, see close.go
+	peerClose atomic.Pointer[CloseStatus]
+	// connectionLost is set when reading failed without a close frame
+	connectionLost atomic.Bool
+
+	// streams are the streams of chunks the client is sending, see stream.go
+	streams clientStreams
+}
+
+// eventLimit is the largest event of the type in bytes a client may send, document
+// events, WebRTC signals and chunks may be larger than maxMessageSize if they are enabled
+func (m *Manager) eventLimit(eventType string) int {
+	config := m.config()
+	switch {
+	case docEvents[eventType] && config.Docs.Enabled:
+		return max(maxMessageSize, config.Docs.MaxMessageSize)
+	case eventType == EventRTCSignal && config.WebRTC.Enabled:
+		return max(maxMessageSize, config.WebRTC.MaxSignalSize)
+	case eventType == EventChunk && config.Streams.Enabled:
+		return max(maxMessageSize, config.Streams.chunkEventLimit())
+	}
+	return maxMessageSize
+}
+
+// readLimit is the largest message in bytes a client may send, the largest limit
+// of any event type
+func (m *Manager) readLimit() int {
+	return max(m.eventLimit(EventDocUpdate), m.eventLimit(EventRTCSignal), m.eventLimit(EventChunk))
 }
 
 // NewClient is used to initialize a new Client with all required values initialized
-func NewClient(conn *websocket.Conn, manager *Manager) *Client {
-	return &Client{
-		connection: conn,
-		manager:    manager,
-		egress:     make(chan Event),
+func NewClient(conn Transport, manager *Manager, username string) *Client {
+	client := &Client{
+		id:          manager.newID(),
+		connectedAt: manager.now(),
+		username:    username,
+		room:        defaultRoom,
+		connection:  conn,
+		manager:     manager,
+		egress:      make(chan Event, egressBufferSize),
+		priority:    make(chan Event, priorityBufferSize),
+		protocol:    negotiatedProtocol(conn.Subprotocol()),
+		guest:       isGuest(username),
+		flags:       manager.flagsOf(username),
+	}
+	client.codec = client.protocol.Codec
+	if client.protocol.Strict {
+		client.codec = strictCodec{m: manager}
+	}
+	// Guests start in the first of their rooms if they may not use the default one
+	if client.guest && !manager.guestAllowsRoom(client.room) {
+		if rooms := manager.config().Guests.Rooms; len(rooms) > 0 {
+			client.room = rooms[0]
+		}
+	}
+	// Connecting counts as activity
+	client.lastActivity.Store(manager.now().UnixNano())
+	return client
+}
+
+// sendPriority queues a high priority event for the client without blocking
+// Only call it while holding the manager lock, so the queue can't be closed meanwhile
+func (c *Client) sendPriority(event Event) bool {
+	if c.qos != nil {
+		// Filtered before it is tracked, so an event a filter drops isn't waited on
+		var ok bool
+		if event, ok = c.filterOutbound(event); !ok {
+			return false
+		}
+		event = c.qos.track(event)
+	}
+	return c.enqueuePriority(event)
+}
+
+// enqueuePriority puts the event on the priority queue without qos tracking
+// Only call it while holding the manager lock, so the queue can't be closed meanwhile
+func (c *Client) enqueuePriority(event Event) bool {
+	// Events with an id were tracked by qos, they went through the filters before
+	if event.ID == "" {
+		var ok bool
+		if event, ok = c.filterOutbound(event); !ok {
+			return false
+		}
+	}
+	c.reserve(event)
+	select {
+	case c.priority <- event:
+		if c.netpoll {
+			c.wake()
+		}
+		return true
+	default:
+		c.release(event)
+		c.stats.dropped.Add(1)
+		log.Printf("priority queue full, dropping %s event for client %s", event.Type, c.id)
+		return false
+	}
+}
+
+// send queues the event for the client without blocking
+// It returns false if the egress is full and the event was dropped, with qos
+// enabled the event is still sent again later
+// Only call it while holding the manager lock, so the egress can't be closed meanwhile
+func (c *Client) send(event Event) bool {
+	if c.qos != nil {
+		// Filtered before it is tracked, so an event a filter drops isn't waited on
+		var ok bool
+		if event, ok = c.filterOutbound(event); !ok {
+			return false
+		}
+		event = c.qos.track(event)
+	}
+	return c.enqueue(event)
+}
+
+// enqueue puts the event on egress without qos tracking
+// Only call it while holding the manager lock, so the egress can't be closed meanwhile
+func (c *Client) enqueue(event Event) bool {
+	// Events with an id were tracked by qos and markers of ephemeral events were
+	// coalesced, they went through the filters before
+	if event.ID == "" && event.coalesceKey == "" {
+		var ok bool
+		if event, ok = c.filterOutbound(event); !ok {
+			return false
+		}
+	}
+	if c.manager.shed(event) {
+		return false
+	}
+
+	c.reserve(event)
+	select {
+	case c.egress <- event:
+		if c.netpoll {
+			c.wake()
+		}
+		c.checkQueueDepth()
+		return true
+	default:
+		c.release(event)
+		c.stats.dropped.Add(1)
+		log.Printf("egress full, dropping %s event for client %s", event.Type, c.id)
+		return false
 	}
 }
 
@@ -52,65 +285,123 @@ func (c *Client) readMessages() {
 		c.manager.removeClient(c)
 	}()
 
-	// Set Max size of Messages in Bytes
-	c.connection.SetReadLimit(1024)
+	// Set Max size of Messages in Bytes, document events may be larger, see docs.go
+	c.connection.SetReadLimit(int64(c.manager.readLimit()))
 
 	// Configure Wait time for Pong response, use Current time + pongWait
 	// This has to be done here to set the first initial timer.
-	if err := c.connection.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+	if err := c.connection.SetReadDeadline(time.Now().Add(c.readTimeout())); err != nil {
 		log.Println(err)
 		return
 	}
 
 	c.connection.SetPongHandler(c.pongHandler)
+	c.handleClose()
 
 	// Infinite loop
-	for {
-		// ReadMessage is used to read the next message is queue
-		// in the connection
-		_, payload, err := c.connection.ReadMessage()
+	for c.readMessage() {
+	}
+}
 
-		if err != nil {
-			// If connection is closed, we will recive an error here
-			// We only want to log "strange" errors, but not simple disconnection
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error reading a message: %v", err)
-			}
-			break // Break the loop to close conn and Cleanup
+// readMessage reads a single message and handles it, it returns false when the
+// connection has to be closed
+func (c *Client) readMessage() bool {
+	// Hold off while the queues of all clients are over the memory budget
+	c.waitForBudget()
+
+	// The message after a binary chunk is its data, see stream.go
+	if c.awaitsChunkData() {
+		return c.readChunkData()
+	}
+
+	// ReadMessage is used to read the next message is queue
+	// in the connection
+	messageType, frame, err := readFrame(c.connection)
+
+	if err != nil {
+		c.readFailed(err)
+		return false // Close conn and Cleanup
+	}
+	size := frame.Len()
+	c.countIn(size)
+	// RFC 6455 fails the connection on text that isn't UTF-8, encoding/json would take it
+	if messageType == websocket.TextMessage && !utf8.Valid(frame.Bytes()) {
+		putBuffer(frame)
+		log.Printf("client %s sent text that isn't UTF-8", c.id)
+		c.failConnection(websocket.CloseInvalidFramePayloadData, "invalid UTF-8")
+		return false
+	}
+	// log.Println("MessageType; ", messageType)
+	// Decode incoming data into Event struct
+	request, err := c.codec.Decode(messageType, frame.Bytes())
+	putBuffer(frame)
+	if errors.Is(err, errPong) {
+		if err := c.pongHandler(""); err != nil {
+			log.Println(err)
+			return false
 		}
-		// log.Println("MessageType; ", messageType)
-		// log.Println("Payload: ", string(payload))
-		// Marshal incoming data into Event struct
-		var request Event
-		if err := json.Unmarshal(payload, &request); err != nil {
-			log.Printf("error marshaling message: %v", err)
-			break // Breaking connection here might be harsh
+		return true
+	}
+	if errors.Is(err, errSkip) {
+		return true
+	}
+	if c.rejectEnvelope(err) {
+		return true
+	}
+	if err != nil {
+		log.Printf("error marshaling message: %v", err)
+		// Breaking connection here might be harsh, the close code tells the client why
+		if errors.Is(err, ErrUnexpectedFrame) {
+			c.failConnection(websocket.CloseUnsupportedData, err.Error())
+		} else {
+			c.failConnection(websocket.CloseInvalidFramePayloadData, err.Error())
 		}
+		return false
+	}
 
-		if err := c.manager.reouteEvent(request, c); err != nil {
-			log.Println("Error handling Message: ", err)
-		}
+	c.record(RecordInbound, request)
+
+	// The read limit is that of the largest event type, the others have their own
+	if limit := c.manager.eventLimit(request.Type); size > limit {
+		c.manager.sendError(c, "too_large", map[string]string{"type": request.Type, "limit": strconv.Itoa(limit)})
+		return true
+	}
 
-		// Hack to test that WriteMessages works as intended
-		// Will be replaced soon
-		// for wsclient := range c.manager.clients {
-		// 	wsclient.egress <- payload
-		// }
+	// Rate limits are read on every event so a config reload applies right away
+	limiter, limit := c.limitOf(request.Type)
+	if !limiter.allow(c.manager.now(), limit.EventsPerSecond, limit.Burst) {
+		c.manager.sendError(c, "rate_limited", map[string]string{"type": request.Type})
+		return true
 	}
+
+	if !c.completeEnvelope(&request) {
+		return true
+	}
+
+	c.markActive(request.Type)
+	if request.Type == EventChunk && c.manager.config().Streams.Enabled {
+		c.receiveChunk(request)
+		return true
+	}
+	c.manager.dispatchEvent(request, c)
+	return true
 }
 
 // pongHandler is useed to handle PongMessages for the Client
 func (c *Client) pongHandler(pongMsg string) error {
 	// Current time + Pong Wait time
-	log.Println("pong")
-	return c.connection.SetReadDeadline(time.Now().Add(pongWait))
+	debugLog("pong")
+	c.pongReceived()
+	return c.connection.SetReadDeadline(time.Now().Add(c.readTimeout()))
 }
 
 // writeMessages is a process that listens for new messages to output to the Client
 func (c *Client) writeMessages() {
 
 	// Create ticker that triggers a ping at givent interval
-	ticker := time.NewTicker(pingInterval)
+	interval := c.currentPingInterval()
+	c.ping.scheduled.Store(int64(interval))
+	ticker := time.NewTicker(interval)
 
 	defer func() {
 		ticker.Stop()
@@ -120,44 +411,186 @@ func (c *Client) writeMessages() {
 	}()
 
 	for {
+		// High priority events skip ahead of everything queued on egress
+		select {
+		case message, ok := <-c.priority:
+			if !ok {
+				return
+			}
+			c.writeEvent(message)
+			continue
+		default:
+		}
+
 		// select is used for waiting on multiple channels (used in goroutines and concurrency).
 		// select waits for the first channel to send data.
 		// It allows handling multiple channels concurrently.
 		select {
+		case message, ok := <-c.priority:
+			if !ok {
+				return
+			}
+			c.writeEvent(message)
+
 		// The arrow operator <- in Go is used for sending and receiving values from channels in concurrent programming.
 		// The arrow (<-) points left, meaning we are receiving a value.
 		// This blocks execution until a value is available in c.egress.
 		case message, ok := <-c.egress:
 			// ok will be false incase the egress channel is close
+			// The close frame was sent by dropClient
 			if !ok {
-				// Manager has closed this connection channel, so communicate this to frontend
-				if err := c.connection.WriteMessage(websocket.CloseMessage, nil); err != nil {
-					// Log that the connection is closed and the reason
-					log.Println("connection closed: ", err)
-				}
 				// Return to close the goroutine
 				return
 			}
-
-			data, err := json.Marshal(message)
-			if err != nil {
-				log.Println(err)
-				return // closses the connection, should we really
+			message = c.uncoalesce(message)
+			if !c.batch.Load() {
+				c.writeEvent(message)
+				continue
 			}
 
-			// Write a regula text to the connection
-			if err := c.connection.WriteMessage(websocket.TextMessage, data); err != nil {
-				log.Println(err)
+			// Send whatever else is waiting in the same frame
+			batch, open := c.batchOf(message)
+			c.writeBatch(batch)
+			if !open {
+				return
 			}
-			log.Println("sent message")
 
 		case <-ticker.C:
-			log.Println("ping")
-			// Send the Ping
-			if err := c.connection.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			// The last ping is still unanswered
+			if c.ping.pingSent.Load() != 0 {
+				c.missedPong()
+			}
+			// Pick up a changed ping interval after a config reload or an adaptive change
+			if current := c.currentPingInterval(); current != interval {
+				interval = current
+				c.ping.scheduled.Store(int64(interval))
+				ticker.Reset(interval)
+			}
+
+			debugLog("ping")
+			// Send the Ping, some codecs send their pings as regular messages
+			messageType, data := websocket.PingMessage, []byte{}
+			if p, ok := c.codec.(pinger); ok {
+				messageType, data = p.Ping()
+			}
+			c.pingWritten()
+			if err := c.connection.WriteMessage(messageType, data); err != nil {
 				log.Println("writemsg: ", err)
 				return // return to break this goroutine triggering cleanup
 			}
 		}
 	}
 }
+
+// writeEvent encodes the event and writes it to the connection
+func (c *Client) writeEvent(message Event) {
+	c.release(message)
+
+	// Chaos mode may drop or repeat the event, see chaos.go
+	for range c.chaosWrites() {
+		c.writeFrame(message)
+	}
+}
+
+// writeFrame writes the event as a single frame
+func (c *Client) writeFrame(message Event) {
+	defer c.observeWrite(time.Now())
+	c.record(RecordOutbound, message)
+	c.applyCompression()
+
+	// Broadcasts are encoded once and shared by all clients using the same codec
+	if w, ok := c.connection.(preparedWriter); ok && message.prepared != nil {
+		pm, size, err := message.prepared.message(c.codec, message)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if c.oversized(message, size) {
+			return
+		}
+		if err := w.WritePreparedMessage(pm); err != nil {
+			log.Println(err)
+		}
+		c.countOut(1, size)
+		debugLog("sent message")
+		return
+	}
+
+	// Large events are encoded straight into the connection, see stream.go
+	if c.streamsEvent(message) {
+		c.writeStreamed(message)
+		return
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	messageType, err := encodeTo(c.codec, buf, message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if c.oversized(message, buf.Len()) {
+		return
+	}
+
+	// Write the encoded event to the connection, it copies the data into its own write buffer
+	if err := c.connection.WriteMessage(messageType, buf.Bytes()); err != nil {
+		log.Println(err)
+	}
+	c.countOut(1, buf.Len())
+	debugLog("sent message")
+}
+
+// maxCloseReasonLength is the longest reason in bytes that fits a close frame
+const maxCloseReasonLength = 123
+
+// failConnection sets the close code and reason the connection is closed with, the
+// first one set wins. The connection is closed once the reader stops
+func (c *Client) failConnection(code int, reason string) {
+	// Clients fail the connection on a reason that isn't UTF-8
+	reason = strings.ToValidUTF8(reason, "")
+	if len(reason) > maxCloseReasonLength {
+		reason = reason[:maxCloseReasonLength]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	frame := websocket.FormatCloseMessage(code, reason)
+	c.closeFrame.CompareAndSwap(nil, &frame)
+}
+
+// closeConnection tells the frontend the Manager has closed this connection and
+// closes it. dropClient runs it as a goroutine, so a stuck connection can't hold
+// the manager lock while the close frame is written
+func (c *Client) closeConnection() {
+	c.writeClose()
+	c.connection.Close()
+}
+
+// writeClose sends the close frame, unless the frontend closed the connection and
+// got its close echoed already, see close.go
+func (c *Client) writeClose() {
+	if !c.closeSent.CompareAndSwap(false, true) {
+		return
+	}
+	data := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if frame := c.closeFrame.Load(); frame != nil {
+		data = *frame
+	}
+
+	// gorilla sent the close itself for protocol errors and too large messages
+	if err := c.writeCloseFrame(data); err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		// Log that the connection is closed and the reason
+		log.Println("connection closed: ", err)
+	}
+}
+
+// writeCloseFrame writes a close frame with the data as its body
+func (c *Client) writeCloseFrame(data []byte) error {
+	// The writer may be in the middle of a frame, control frames can be written anyway
+	if w, ok := c.connection.(controlWriter); ok {
+		return w.WriteControl(websocket.CloseMessage, data, time.Now().Add(closeWait))
+	}
+	return c.connection.WriteMessage(websocket.CloseMessage, data)
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Admin calls the admin API of the server, it needs the admin token
+type Admin struct {
+	// Server is the base URL of the server like http://localhost:8080
+	Server string
+	Token  string
+}
+
+// Kick disconnects the client with the id, or all clients of the user, and
+// returns how many were kicked
+func (a *Admin) Kick(ctx context.Context, target string) (int, error) {
+	var result struct {
+		Kicked int `json:"kicked"`
+	}
+	err := a.do(ctx, http.MethodPost, "/admin/clients/"+url.PathEscape(target)+"/kick", &result)
+	return result.Kicked, err
+}
+
+// Stats returns the runtime stats of the server as JSON
+func (a *Admin) Stats(ctx context.Context) (json.RawMessage, error) {
+	var result json.RawMessage
+	err := a.do(ctx, http.MethodGet, "/admin/debug/runtime", &result)
+	return result, err
+}
+
+// do sends a request without body and decodes the JSON response into result
+func (a *Admin) do(ctx context.Context, method, path string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(a.Server, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
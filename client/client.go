@@ -0,0 +1,228 @@
+// Package client is a Go client for the chat server, used by wsctl and by
+// backends that would rather hold a socket than use the REST API.
+//
+// A session starts with Login, trading a username and password for an OTP,
+// followed by Dial to open the websocket with it.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// Event is the envelope of everything sent over the websocket
+type Event struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Subprotocol is the version of the protocol the SDK speaks
+const Subprotocol = "chat.v1.json"
+
+// Event types used by the helpers of Conn
+const (
+	EventSendMessage    = "send_message"
+	EventJoinRoom       = "join_room"
+	EventSwitchRoom     = "switch_room"
+	EventAddReaction    = "add_reaction"
+	EventRemoveReaction = "remove_reaction"
+	EventRevokeDevice   = "revoke_device"
+	EventStats          = "stats"
+)
+
+// Register creates an account on the server, email is only needed when the server
+// verifies emails, the account can't login until the link sent there is opened
+func Register(ctx context.Context, server, username, password, email string) error {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password, "email": email})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(server, "/")+"/register", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("register failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Login trades the username and password for an OTP, server is the base URL
+// of the server like http://localhost:8080
+func Login(ctx context.Context, server, username, password string) (string, error) {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(server, "/")+"/login", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", ErrUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("login failed: %s", resp.Status)
+	}
+
+	var result struct {
+		OTP string `json:"otp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.OTP, nil
+}
+
+// Conn is a websocket connection to the server
+type Conn struct {
+	conn *websocket.Conn
+	// writeLock serializes writes, the websocket allows only one writer at a time
+	writeLock sync.Mutex
+}
+
+// Dial opens the websocket using an OTP returned by Login
+func Dial(ctx context.Context, server, otp string) (*Conn, error) {
+	return dial(ctx, server, url.Values{"otp": {otp}}, nil)
+}
+
+// DialDevice is Dial for a device that connected before, deviceID is the device_id
+// of the welcome event the server sent then
+func DialDevice(ctx context.Context, server, otp, deviceID string) (*Conn, error) {
+	return dial(ctx, server, url.Values{"otp": {otp}, "device": {deviceID}}, nil)
+}
+
+// DialAPIKey opens the websocket with an API key issued by an operator, without logging in
+func DialAPIKey(ctx context.Context, server, key string) (*Conn, error) {
+	return dial(ctx, server, nil, http.Header{"Authorization": {"Bearer " + key}})
+}
+
+func dial(ctx context.Context, server string, query url.Values, header http.Header) (*Conn, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+	u.RawQuery = query.Encode()
+
+	// The SDK speaks JSON, it says so with the subprotocol
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{Subprotocol}
+	conn, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, ErrUnauthorized
+		}
+		return nil, err
+	}
+	return &Conn{conn: conn}, nil
+}
+
+// Connect logs in and opens the websocket
+func Connect(ctx context.Context, server, username, password string) (*Conn, error) {
+	otp, err := Login(ctx, server, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return Dial(ctx, server, otp)
+}
+
+// Send sends an event, the payload is marshalled to JSON
+func (c *Conn) Send(eventType string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.conn.WriteJSON(Event{Type: eventType, Payload: data})
+}
+
+// JoinRoom moves the connection to another room
+func (c *Conn) JoinRoom(room string) error {
+	return c.Send(EventJoinRoom, map[string]string{"room": room})
+}
+
+// SwitchRoom moves the connection to another room, the server answers with a
+// room_switched event holding the latest events of the room
+func (c *Conn) SwitchRoom(room string) error {
+	return c.Send(EventSwitchRoom, map[string]string{"room": room})
+}
+
+// SendMessage sends a chat message to the current room
+func (c *Conn) SendMessage(message string) error {
+	return c.Send(EventSendMessage, map[string]string{"message": message})
+}
+
+// React adds a reaction to a message of the current room, messageID is the id of its new_message event
+func (c *Conn) React(messageID, emoji string) error {
+	return c.Send(EventAddReaction, map[string]string{"message_id": messageID, "emoji": emoji})
+}
+
+// Unreact removes a reaction added with React
+func (c *Conn) Unreact(messageID, emoji string) error {
+	return c.Send(EventRemoveReaction, map[string]string{"message_id": messageID, "emoji": emoji})
+}
+
+// RevokeDevice logs out another device of the user, like a lost phone
+func (c *Conn) RevokeDevice(deviceID string) error {
+	return c.Send(EventRevokeDevice, map[string]string{"device_id": deviceID})
+}
+
+// RequestStats asks for the stats of the connection, the server answers with a
+// stats event holding the messages and bytes sent each way and the round trip time
+func (c *Conn) RequestStats() error {
+	return c.Send(EventStats, struct{}{})
+}
+
+// Receive blocks until the next event arrives, pings are answered while waiting
+func (c *Conn) Receive() (Event, error) {
+	var event Event
+	err := c.conn.ReadJSON(&event)
+	return event, err
+}
+
+// Close closes the connection, telling the server first
+func (c *Conn) Close() error {
+	c.writeLock.Lock()
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.writeLock.Unlock()
+	return c.conn.Close()
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Event types of state sync
+const (
+	EventSubscribeState   = "subscribe_state"
+	EventUnsubscribeState = "unsubscribe_state"
+	EventUpdateState      = "update_state"
+	EventStateSnapshot    = "state_snapshot"
+	EventStateDelta       = "state_delta"
+)
+
+// StateUpdate is a snapshot or a delta of a state, in the order of the versions
+type StateUpdate struct {
+	Room    string          `json:"room"`
+	Name    string          `json:"name"`
+	Version uint64          `json:"version"`
+	State   json.RawMessage `json:"state,omitempty"`
+	Delta   json.RawMessage `json:"delta,omitempty"`
+	From    string          `json:"from,omitempty"`
+}
+
+// Snapshot returns true if the update holds the whole state instead of a delta
+func (u StateUpdate) Snapshot() bool {
+	return u.Delta == nil
+}
+
+// StateSync follows the states of the room the connection is in. Pass every event
+// received to Handle, it returns the snapshots and deltas in order and asks the
+// server for what was missed when a version is skipped.
+type StateSync struct {
+	conn *Conn
+
+	lock     sync.Mutex
+	versions map[string]uint64
+	// resyncing are the states missing a delta, until the server caught them up
+	resyncing map[string]bool
+}
+
+// NewStateSync returns a StateSync sending on the connection
+func NewStateSync(conn *Conn) *StateSync {
+	return &StateSync{conn: conn, versions: make(map[string]uint64), resyncing: make(map[string]bool)}
+}
+
+// Subscribe asks for the state, the server answers with a snapshot
+func (s *StateSync) Subscribe(name string) error {
+	s.lock.Lock()
+	delete(s.versions, name)
+	s.lock.Unlock()
+	return s.conn.Send(EventSubscribeState, map[string]any{"name": name})
+}
+
+// Unsubscribe stops the changes of the state
+func (s *StateSync) Unsubscribe(name string) error {
+	s.lock.Lock()
+	delete(s.versions, name)
+	delete(s.resyncing, name)
+	s.lock.Unlock()
+	return s.conn.Send(EventUnsubscribeState, map[string]any{"name": name})
+}
+
+// Update sends a change of the state, a JSON merge patch unless the server says
+// otherwise. With a base version other than 0 the server rejects the change with
+// a state_conflict error if the state is at another version
+func (s *StateSync) Update(name string, change any, baseVersion uint64) error {
+	return s.conn.Send(EventUpdateState, map[string]any{"name": name, "change": change, "base_version": baseVersion})
+}
+
+// Version returns the version of the state the client has
+func (s *StateSync) Version(name string) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.versions[name]
+}
+
+// Handle returns the update in the event and true if it is the next one of its
+// state. Events of other types, deltas already seen and deltas after a gap return
+// false, a gap makes the server send the missing deltas or a snapshot
+func (s *StateSync) Handle(event Event) (StateUpdate, bool, error) {
+	if event.Type != EventStateSnapshot && event.Type != EventStateDelta {
+		return StateUpdate{}, false, nil
+	}
+	var update StateUpdate
+	if err := json.Unmarshal(event.Payload, &update); err != nil {
+		return update, false, fmt.Errorf("bad payload in %s: %w", event.Type, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if event.Type == EventStateSnapshot {
+		update.Delta = nil
+		s.versions[update.Name] = update.Version
+		delete(s.resyncing, update.Name)
+		return update, true, nil
+	}
+
+	version := s.versions[update.Name]
+	switch {
+	case update.Version <= version:
+		return update, false, nil
+	case update.Version == version+1:
+		s.versions[update.Name] = update.Version
+		delete(s.resyncing, update.Name)
+		return update, true, nil
+	case s.resyncing[update.Name]:
+		return update, false, nil
+	}
+	s.resyncing[update.Name] = true
+	payload := map[string]any{"name": update.Name, "version": version}
+	return update, false, s.conn.Send(EventSubscribeState, payload)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The Manager reads the time through a Clock instead of calling time.Now, so
+// tests can set the time retention, scheduled messages, room expiry, idle users
+// and rate limits are checked against, without sleeping. The tickers driving the
+// background work still run on real time, tests call the checks directly with
+// the time of their clock, like m.deliverScheduled(clock.Now()).
+
+// Clock tells the time
+type Clock interface {
+	Now() time.Time
+}
+
+// ManagerOption changes how NewManager sets up the Manager
+type ManagerOption func(*Manager)
+
+// WithClock makes the Manager read the time from the clock
+func WithClock(clock Clock) ManagerOption {
+	return func(m *Manager) {
+		m.clock = clock
+	}
+}
+
+// systemClock is the wall clock, used unless another Clock is given
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock that only moves when told to, for tests
+type ManualClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a ManualClock stopped at start
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now returns the time the clock was set to
+func (c *ManualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// Set moves the clock to t, which may be in the past
+func (c *ManualClock) Set(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = t
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// now returns the time of the Manager's clock
+func (m *Manager) now() time.Time {
+	return m.clock.Now()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManagerClockTimestamps(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	server, m, err := NewTestServer(DefaultConfig(), WithClock(NewManualClock(start)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var welcome WelcomeEvent
+	if err := server.Connect("alice").ExpectPayload(EventWelcome, &welcome, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !welcome.ServerTime.Equal(start) {
+		t.Errorf("welcome server time is %v, want %v", welcome.ServerTime, start)
+	}
+
+	if _, err := m.ban(Ban{Username: "mallory"}); err != nil {
+		t.Fatal(err)
+	}
+	bans, err := m.store.ListBans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || !bans[0].Created.Equal(start) {
+		t.Errorf("bans are %+v, want one created at %v", bans, start)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A client tells why it leaves with the code and reason of its close frame: 1000
+// when it is done, 1001 when the tab is closed or the app goes to the background,
+// 4000-4999 for reasons of its own. The close handler records them and echoes the
+// code like RFC 6455 asks. When the client is removed they are logged, counted by
+// code as disconnects_total in /admin/metrics and passed to the disconnect hooks
+// added with WithDisconnectHook, so the different ways clients leave can be told
+// apart:
+//
+//	client 3f2a... of alice disconnected, closed by client with 4001 "token expired"
+//
+// Connections the server closed have the code it sent, 1000 unless it failed the
+// connection, see failConnection. Connections that ended without a close frame,
+// like a dropped network or a missed pong, are lost with 1006.
+
+// Who closed the connection, see DisconnectInfo
+const (
+	ClosedByClient = "client"
+	ClosedByServer = "server"
+	ClosedByLost   = "lost"
+)
+
+// CloseStatus is the code and reason of a close frame
+type CloseStatus struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// DisconnectInfo tells the disconnect hooks about a client that was removed
+type DisconnectInfo struct {
+	ClientID string
+	Username string
+	Room     string
+	// ClosedBy is who closed the connection, one of client, server and lost
+	ClosedBy string
+	// Code and Reason are those of the close frame of whoever closed the connection,
+	// 1006 if it was lost
+	Code   int
+	Reason string
+	// ConnectedAt is when the client connected, Duration how long it was connected
+	ConnectedAt time.Time
+	Duration    time.Duration
+}
+
+// DisconnectHook is called after a client was removed
+type DisconnectHook func(info DisconnectInfo)
+
+// WithDisconnectHook makes the Manager call the hook for every client it removes,
+// hooks run in their own goroutine in the order they were added
+func WithDisconnectHook(hook DisconnectHook) ManagerOption {
+	return func(m *Manager) {
+		m.disconnectHooks = append(m.disconnectHooks, hook)
+	}
+}
+
+// closeHandlerSetter is implemented by transports that let the close frame of the
+// peer be handled, *websocket.Conn does
+type closeHandlerSetter interface {
+	SetCloseHandler(h func(code int, text string) error)
+}
+
+// closeCounts counts the removed clients by who closed the connection and its code
+type closeCounts struct {
+	sync.Mutex
+	counts map[closeCountKey]uint64
+}
+
+type closeCountKey struct {
+	closedBy string
+	code     int
+}
+
+// handleClose sets the close handler of the connection, call it before reading
+func (c *Client) handleClose() {
+	if s, ok := c.connection.(closeHandlerSetter); ok {
+		s.SetCloseHandler(c.closeHandler)
+	}
+}
+
+// closeHandler records the close frame of the client and echoes its code, the
+// read returns a *websocket.CloseError after it
+func (c *Client) closeHandler(code int, text string) error {
+	c.peerClose.CompareAndSwap(nil, &CloseStatus{Code: code, Reason: text})
+	// When the server closed first this is the answer to its close frame
+	if !c.closeSent.CompareAndSwap(false, true) {
+		return nil
+	}
+	// A close frame without a code reads as 1005 and is answered by one without a code
+	var data []byte
+	if code != websocket.CloseNoStatusReceived {
+		data = websocket.FormatCloseMessage(code, "")
+	}
+	if err := c.writeCloseFrame(data); err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		debugLog(fmt.Sprintf("echoing the close of client %s: %v", c.id, err))
+	}
+	return nil
+}
+
+// readFailed records why reading the connection failed, the close code is logged
+// once the client is removed
+func (c *Client) readFailed(err error) {
+	var closeErr *websocket.CloseError
+	switch {
+	case errors.As(err, &closeErr) && closeErr.Code == websocket.CloseAbnormalClosure:
+		// gorilla reads a connection closed without a close frame as 1006
+		c.connectionLost.Store(true)
+	case errors.As(err, &closeErr):
+		// Transports without a close handler answered the close themselves
+		c.peerClose.CompareAndSwap(nil, &CloseStatus{Code: closeErr.Code, Reason: closeErr.Text})
+		c.closeSent.Store(true)
+	case errors.Is(err, websocket.ErrReadLimit):
+		// gorilla sent the close frame already
+		c.failConnection(websocket.CloseMessageTooBig, "")
+	default:
+		c.connectionLost.Store(true)
+	}
+}
+
+// closeStatus returns who closed the connection of the client and with which close frame
+func (c *Client) closeStatus() (string, CloseStatus) {
+	if status := c.peerClose.Load(); status != nil {
+		return ClosedByClient, *status
+	}
+	if frame := c.closeFrame.Load(); frame != nil {
+		return ClosedByServer, parseCloseFrame(*frame)
+	}
+	if c.connectionLost.Load() {
+		return ClosedByLost, CloseStatus{Code: websocket.CloseAbnormalClosure}
+	}
+	return ClosedByServer, CloseStatus{Code: websocket.CloseNormalClosure}
+}
+
+// parseCloseFrame returns the code and reason of the body of a close frame
+func parseCloseFrame(frame []byte) CloseStatus {
+	if len(frame) < 2 {
+		return CloseStatus{Code: websocket.CloseNoStatusReceived}
+	}
+	return CloseStatus{Code: int(frame[0])<<8 | int(frame[1]), Reason: string(frame[2:])}
+}
+
+// recordDisconnect logs and counts how the client disconnected and runs the
+// disconnect hooks, called by dropClient
+func (m *Manager) recordDisconnect(c *Client) {
+	closedBy, status := c.closeStatus()
+	log.Printf("client %s of %s disconnected, closed by %s with %d %q", c.id, c.username, closedBy, status.Code, status.Reason)
+
+	m.disconnects.Lock()
+	if m.disconnects.counts == nil {
+		m.disconnects.counts = make(map[closeCountKey]uint64)
+	}
+	m.disconnects.counts[closeCountKey{closedBy: closedBy, code: status.Code}]++
+	m.disconnects.Unlock()
+
+	if len(m.disconnectHooks) == 0 {
+		return
+	}
+	now := m.now()
+	info := DisconnectInfo{
+		ClientID:    c.id,
+		Username:    c.username,
+		Room:        c.room,
+		ClosedBy:    closedBy,
+		Code:        status.Code,
+		Reason:      status.Reason,
+		ConnectedAt: c.connectedAt,
+		Duration:    now.Sub(c.connectedAt),
+	}
+	// The manager lock is held, hooks may call it
+	go func() {
+		for _, hook := range m.disconnectHooks {
+			hook(info)
+		}
+	}()
+}
+
+// writeDisconnectMetrics writes the disconnects by who closed and close code in the
+// Prometheus text format
+func (m *Manager) writeDisconnectMetrics(w io.Writer) {
+	m.disconnects.Lock()
+	counts := maps.Clone(m.disconnects.counts)
+	m.disconnects.Unlock()
+
+	keys := slices.SortedFunc(maps.Keys(counts), func(a, b closeCountKey) int {
+		return cmp.Or(strings.Compare(a.closedBy, b.closedBy), cmp.Compare(a.code, b.code))
+	})
+	fmt.Fprintf(w, "# HELP disconnects_total Disconnected clients by who closed the connection and close code.\n# TYPE disconnects_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "disconnects_total{closed_by=%q,code=\"%d\"} %d\n", key.closedBy, key.code, counts[key])
+	}
+}
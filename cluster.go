@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Several instances can serve the same rooms behind a load balancer, with the
+// clients of a room connected to any of them. The instances are a cluster, each
+// names itself in cluster.node_id and lists the others with the URL they serve
+// the routes on, base path included:
+//
+//	"cluster": {
+//	    "node_id": "ws-1",
+//	    "peers":   {"ws-2": "http://10.0.0.2:8080", "ws-3": "http://10.0.0.3:8080"},
+//	    "secret":  "..."
+//	}
+//
+// They share a Postgres store and talk to each other over HTTP on /cluster/...,
+// the backplane, authenticated by the shared secret.
+//
+// Every room is owned by one instance, picked by consistent hashing of the room
+// name over the instances that are up. The owner numbers the events of its
+// rooms: an instance broadcasting to a room it doesn't own forwards the event to
+// the owner, which numbers and stores it, sends it to its clients in the room and
+// fans it out to the other instances, which send it to theirs and keep it in
+// their history. So a room has the same sequence numbers on every instance.
+// Events that are not numbered, like typing, are fanned out by the instance
+// sending them, and so are announcements, see announcement.go. Every peer has a
+// queue the events fanned out to it wait in, sent one at a time, so a peer gets
+// the events of a room in order and a slow peer doesn't hold up the others.
+//
+// The instances check each other every cluster.heartbeat_interval, a peer that
+// didn't answer for cluster.failure_timeout, or failed a forwarded event, is down
+// and its rooms move to the instances that are up, the other rooms stay where
+// they are. An instance taking over a room continues the numbering after the last
+// event it got or the store has, whichever is higher. Instances seeing different
+// peers up, during a network partition, may both number the events of a room
+// until they see the same peers again.
+
+var (
+	ErrInvalidCluster = errors.New("invalid cluster config")
+)
+
+// clusterTimeout bounds a request to another instance
+var clusterTimeout = 5 * time.Second
+
+// clusterQueueSize is how many requests may wait to be sent to a peer, more are
+// dropped while the peer is slow to answer
+var clusterQueueSize = 1024
+
+// clusterVirtualNodes is how many points each instance has on the hash ring, more
+// points spread the rooms more evenly
+const clusterVirtualNodes = 64
+
+// hashRing assigns keys to nodes by consistent hashing, when a node is removed only
+// its keys move
+type hashRing struct {
+	hashes []uint64
+	// nodes holds the node of the hash at the same index
+	nodes []string
+}
+
+// ringHash returns the position of the key on the ring
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newHashRing(nodes []string) *hashRing {
+	type point struct {
+		hash uint64
+		node string
+	}
+	points := make([]point, 0, len(nodes)*clusterVirtualNodes)
+	for _, node := range nodes {
+		for i := range clusterVirtualNodes {
+			points = append(points, point{hash: ringHash(fmt.Sprintf("%s#%d", node, i)), node: node})
+		}
+	}
+	slices.SortFunc(points, func(a, b point) int {
+		if a.hash != b.hash {
+			return cmp.Compare(a.hash, b.hash)
+		}
+		return cmp.Compare(a.node, b.node)
+	})
+
+	ring := &hashRing{}
+	for _, p := range points {
+		ring.hashes = append(ring.hashes, p.hash)
+		ring.nodes = append(ring.nodes, p.node)
+	}
+	return ring
+}
+
+// owner returns the node of the key, the first one at or after its hash on the ring
+func (r *hashRing) owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[i]
+}
+
+// clusterEvent is an event of a room sent between instances
+type clusterEvent struct {
+	// ID is the id the event is stored with, for events forwarded to the owner
+	ID string `json:"id,omitempty"`
+	// Seq is the sequence number the owner gave the event, 0 for events that are not numbered
+	Seq   uint64 `json:"seq,omitempty"`
+	Event Event  `json:"event"`
+}
+
+// clusterDelivered is the response to a forwarded or fanned out event
+type clusterDelivered struct {
+	// Delivered is how many clients the event was queued for
+	Delivered int `json:"delivered"`
+}
+
+// ClusterNode is an instance as shown by GET /admin/cluster
+type ClusterNode struct {
+	ID       string    `json:"id"`
+	URL      string    `json:"url,omitempty"`
+	Up       bool      `json:"up"`
+	Self     bool      `json:"self,omitempty"`
+	LastSeen time.Time `json:"last_seen,omitzero"`
+}
+
+// ClusterStatus is returned by GET /admin/cluster
+type ClusterStatus struct {
+	NodeID string `json:"node_id"`
+	// Epoch changes every time the instances that are up change
+	Epoch uint64        `json:"epoch"`
+	Nodes []ClusterNode `json:"nodes"`
+	// Raft is the Raft group, if cluster.raft is on, see raft.go
+	Raft *RaftStatus `json:"raft,omitempty"`
+}
+
+// peerRequest is a request waiting in the queue of a peer
+type peerRequest struct {
+	path string
+	body json.RawMessage
+	// delivered gets how many clients of the peer it was queued for, 0 if it failed
+	delivered chan<- int
+}
+
+// cluster tracks the other instances and which rooms this one owns
+type cluster struct {
+	self string
+	// secret returns the secret of the current config, so a reload applies to the
+	// requests to the peers as it does to the requests from them
+	secret func() string
+
+	sync.RWMutex
+	// peers are the URLs of the other instances by node id, the ones of the config
+	// and the ones found by gossip, see gossip.go
+	peers map[string]string
+	// lastSeen is when each peer last answered
+	lastSeen map[string]time.Time
+	// up holds the peers that are up
+	up   map[string]bool
+	ring *hashRing
+	// epoch changes every time the ring does
+	epoch uint64
+	// queues hold the requests fanned out to each peer, sent one at a time so the
+	// peer gets them in the order they were queued
+	queues map[string]chan peerRequest
+	closed bool
+}
+
+// newCluster returns the cluster of the config, or nil if it isn't clustered
+// The peers are taken to be up until they fail to answer
+func newCluster(config ClusterConfig, secret func() string, now time.Time) (*cluster, error) {
+	if config.NodeID == "" && len(config.Peers) == 0 {
+		return nil, nil
+	}
+	if config.NodeID == "" {
+		return nil, fmt.Errorf("%w: node_id is required", ErrInvalidCluster)
+	}
+	if config.Secret == "" {
+		return nil, fmt.Errorf("%w: secret is required", ErrInvalidCluster)
+	}
+	if _, ok := config.Peers[config.NodeID]; ok {
+		return nil, fmt.Errorf("%w: %s is a peer of itself", ErrInvalidCluster, config.NodeID)
+	}
+	for id, peer := range config.Peers {
+		if u, err := url.Parse(peer); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("%w: peer %s has no valid url", ErrInvalidCluster, id)
+		}
+	}
+
+	c := &cluster{
+		self:     config.NodeID,
+		secret:   secret,
+		peers:    make(map[string]string),
+		lastSeen: make(map[string]time.Time),
+		up:       make(map[string]bool),
+		queues:   make(map[string]chan peerRequest),
+	}
+	for id, peer := range config.Peers {
+		c.peers[id] = peer
+		c.lastSeen[id] = now
+		c.up[id] = true
+		c.startQueue(id)
+	}
+	c.rebuild()
+	return c, nil
+}
+
+// rebuild puts this instance and the peers that are up on a new ring
+// Only call it while holding the write lock
+func (c *cluster) rebuild() {
+	nodes := []string{c.self}
+	for id, up := range c.up {
+		if up {
+			nodes = append(nodes, id)
+		}
+	}
+	c.ring = newHashRing(nodes)
+	c.epoch++
+}
+
+// owner returns the node owning the room
+func (c *cluster) owner(room string) string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.ring.owner(room)
+}
+
+// currentEpoch returns the epoch of the ring
+func (c *cluster) currentEpoch() uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.epoch
+}
+
+// upPeers returns the node ids of the peers that are up
+func (c *cluster) upPeers() []string {
+	c.RLock()
+	defer c.RUnlock()
+	var peers []string
+	for id, up := range c.up {
+		if up {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// peerURL returns the URL of the routes of the peer
+func (c *cluster) peerURL(node string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	url, ok := c.peers[node]
+	return url, ok
+}
+
+// peerIDs returns the node ids of the peers, up or not
+func (c *cluster) peerIDs() []string {
+	c.RLock()
+	defer c.RUnlock()
+	return slices.Collect(maps.Keys(c.peers))
+}
+
+// addPeer adds a peer found by gossip, or changes its URL, it is taken to be up
+// Returns false if the peer was known with the URL
+func (c *cluster) addPeer(node, url string, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	if node == c.self || c.peers[node] == url {
+		return false
+	}
+	if _, ok := c.peers[node]; !ok {
+		c.startQueue(node)
+	}
+	c.peers[node] = url
+	c.lastSeen[node] = now
+	if !c.up[node] {
+		c.up[node] = true
+		c.rebuild()
+	}
+	return true
+}
+
+// removePeer forgets a peer found by gossip
+func (c *cluster) removePeer(node string) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.peers[node]; !ok {
+		return
+	}
+	up := c.up[node]
+	delete(c.peers, node)
+	delete(c.lastSeen, node)
+	delete(c.up, node)
+	if queue, ok := c.queues[node]; ok {
+		close(queue)
+		delete(c.queues, node)
+	}
+	if up {
+		c.rebuild()
+	}
+}
+
+// seen records that the peer answered
+func (c *cluster) seen(node string, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.lastSeen[node] = now
+	if !c.up[node] {
+		c.up[node] = true
+		log.Printf("cluster: %s is up", node)
+		c.rebuild()
+	}
+}
+
+// markDown takes the peer off the ring until it answers again
+func (c *cluster) markDown(node string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.up[node] {
+		c.up[node] = false
+		log.Printf("cluster: %s is down, its rooms move", node)
+		c.rebuild()
+	}
+}
+
+// expire takes the peers that didn't answer for the timeout off the ring
+func (c *cluster) expire(now time.Time, timeout time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	changed := false
+	for id, up := range c.up {
+		if up && now.Sub(c.lastSeen[id]) > timeout {
+			c.up[id] = false
+			log.Printf("cluster: %s didn't answer for %s, its rooms move", id, timeout)
+			changed = true
+		}
+	}
+	if changed {
+		c.rebuild()
+	}
+}
+
+// request sends the body as JSON to the path of the peer and decodes the response into out
+func (c *cluster) request(ctx context.Context, node, method, path string, body, out any) error {
+	peer, ok := c.peerURL(node)
+	if !ok {
+		return fmt.Errorf("%s is not a peer", node)
+	}
+	return c.requestURL(ctx, peer+path, method, body, out)
+}
+
+// requestURL sends the body as JSON to the URL of an instance and decodes the response into out
+func (c *cluster) requestURL(ctx context.Context, target, method string, body, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, clusterTimeout)
+	defer cancel()
+
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.secret())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", target, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// roomDeliverPath is the backplane path events of the room are fanned out on
+func roomDeliverPath(room string) string {
+	return "/cluster/rooms/" + url.PathEscape(room) + "/deliver"
+}
+
+// startQueue starts sending the requests queued for the peer
+// Only call it while holding the write lock
+func (c *cluster) startQueue(node string) {
+	if c.closed {
+		return
+	}
+	queue := make(chan peerRequest, clusterQueueSize)
+	c.queues[node] = queue
+	go c.sendQueued(node, queue)
+}
+
+// sendQueued sends the requests of the queue to the peer one at a time, until the
+// queue is closed
+func (c *cluster) sendQueued(node string, queue <-chan peerRequest) {
+	for req := range queue {
+		var resp clusterDelivered
+		if err := c.request(context.Background(), node, http.MethodPost, req.path, req.body, &resp); err != nil {
+			log.Printf("cluster: sending %s to %s: %v", req.path, node, err)
+		}
+		req.delivered <- resp.Delivered
+	}
+}
+
+// close stops sending to the peers, what is queued is still sent
+func (c *cluster) close() {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	for node, queue := range c.queues {
+		close(queue)
+		delete(c.queues, node)
+	}
+}
+
+// fanOut queues the body for the path of the peers that are up, after what was
+// queued for them before, and returns a func waiting for the peers to answer
+// which returns how many of their clients it was queued for
+func (c *cluster) fanOut(path string, body any) func() int {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("cluster: encoding %s: %v", path, err)
+		return func() int { return 0 }
+	}
+
+	c.RLock()
+	var answers []chan int
+	for node, up := range c.up {
+		queue, ok := c.queues[node]
+		if !up || !ok {
+			continue
+		}
+		delivered := make(chan int, 1)
+		select {
+		case queue <- peerRequest{path: path, body: data, delivered: delivered}:
+			answers = append(answers, delivered)
+		default:
+			log.Printf("cluster: dropping %s, the queue of %s is full", path, node)
+		}
+	}
+	c.RUnlock()
+
+	return func() int {
+		total := 0
+		for _, delivered := range answers {
+			total += <-delivered
+		}
+		return total
+	}
+}
+
+// forwardRoomEvent sends the event to the instance owning the room to be numbered
+func (m *Manager) forwardRoomEvent(node, room, id string, event Event) (int, error) {
+	var resp clusterDelivered
+	err := m.cluster.request(context.Background(), node, http.MethodPost, "/cluster/rooms/"+url.PathEscape(room)+"/events",
+		clusterEvent{ID: id, Event: event}, &resp)
+	return resp.Delivered, err
+}
+
+// takeOverRoom continues the numbering of the room after the last event stored,
+// if the store has later events than this instance got, once per epoch of the ring
+// as the room may have moved from another instance
+// Only call it while holding the room lock
+func (m *Manager) takeOverRoom(name string, r *roomState) {
+	epoch := m.cluster.currentEpoch()
+	if r.epoch == epoch {
+		return
+	}
+	r.epoch = epoch
+
+	messages, err := m.store.ListMessages(name, roomHistorySize)
+	if err != nil {
+		log.Printf("cluster: loading history of room %s: %v", name, err)
+		return
+	}
+	if len(messages) > 0 && messages[len(messages)-1].Seq > r.seq {
+		log.Printf("cluster: room %s continues at %d", name, messages[len(messages)-1].Seq)
+		restoreHistory(r, messages)
+	}
+}
+
+// receiveRoomEvent keeps an event numbered by the owner of the room in the history
+// and sends it to the clients in the room on this instance
+func (m *Manager) receiveRoomEvent(room string, event clusterEvent) int {
+	r := m.room(room)
+	r.Lock()
+	defer r.Unlock()
+
+	switch {
+	case event.Seq == r.seq+1:
+		r.history = append(r.history, event.Event)
+		if len(r.history) > roomHistorySize {
+			r.history = r.history[len(r.history)-roomHistorySize:]
+		}
+		r.seq = event.Seq
+	case event.Seq > r.seq:
+		// Events were missed, the history has to be contiguous so it starts over
+		r.history = []Event{event.Event}
+		r.seq = event.Seq
+	}
+	r.lastActive = m.now()
+	return m.deliverToRoom(room, event.Event)
+}
+
+// runCluster checks the peers at the heartbeat interval
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runCluster(ctx context.Context) {
+	for {
+		// The intervals are read every time so a config reload applies to the next run
+		config := m.config().Cluster
+		interval := time.Duration(config.HeartbeatInterval)
+		if interval <= 0 {
+			interval = 2 * time.Second
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			m.cluster.close()
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, node := range m.cluster.peerIDs() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := m.cluster.request(ctx, node, http.MethodGet, "/cluster/health", nil, nil); err == nil {
+					m.cluster.seen(node, m.now())
+				}
+			}()
+		}
+		wg.Wait()
+		m.cluster.expire(m.now(), time.Duration(config.FailureTimeout))
+	}
+}
+
+// registerClusterHandlers registers the backplane and the cluster status
+func (m *Manager) registerClusterHandlers(mux routes) {
+	secret := func() string { return m.config().Cluster.Secret }
+	mux.HandleFunc("GET /cluster/health", requireBearerToken(secret, m.clusterHealthHandler))
+	mux.HandleFunc("POST /cluster/rooms/{room}/events", requireBearerToken(secret, m.clusterEventHandler))
+	mux.HandleFunc("POST /cluster/rooms/{room}/deliver", requireBearerToken(secret, m.clusterDeliverHandler))
+	mux.HandleFunc("GET /cluster/raft", requireBearerToken(secret, m.raftStatusHandler))
+	mux.HandleFunc("POST /cluster/raft/join", requireBearerToken(secret, m.raftJoinHandler))
+	mux.HandleFunc("POST /cluster/raft/apply", requireBearerToken(secret, m.raftApplyHandler))
+	mux.HandleFunc("POST /cluster/users/{username}/deliver", requireBearerToken(secret, m.clusterUserDeliverHandler))
+	mux.HandleFunc("POST /cluster/announcements", requireBearerToken(secret, m.clusterAnnouncementHandler))
+	mux.HandleFunc("GET /admin/cluster", m.requireAdminToken(m.clusterStatusHandler))
+	mux.HandleFunc("GET /admin/cluster/overview", m.requireAdminToken(m.clusterOverviewHandler))
+}
+
+// clusterHealthHandler answers the heartbeats of the peers
+func (m *Manager) clusterHealthHandler(w http.ResponseWriter, r *http.Request) {
+	if m.cluster == nil {
+		http.Error(w, "not clustered", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"node_id": m.cluster.self})
+}
+
+// decodeClusterEvent reads the event of the request, it writes the error response if it can't
+func (m *Manager) decodeClusterEvent(w http.ResponseWriter, r *http.Request) (clusterEvent, bool) {
+	var event clusterEvent
+	if m.cluster == nil {
+		http.Error(w, "not clustered", http.StatusNotFound)
+		return event, false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return event, false
+	}
+	return event, true
+}
+
+// clusterEventHandler numbers an event forwarded by another instance
+// It is numbered here even if this instance doesn't see itself as the owner, the
+// instances see different peers for a moment and forwarding it on could loop
+func (m *Manager) clusterEventHandler(w http.ResponseWriter, r *http.Request) {
+	event, ok := m.decodeClusterEvent(w, r)
+	if !ok {
+		return
+	}
+	room := r.PathValue("room")
+	if owner := m.cluster.owner(room); owner != m.cluster.self {
+		log.Printf("cluster: numbering an event of room %s owned by %s", room, owner)
+	}
+	writeJSON(w, http.StatusOK, clusterDelivered{Delivered: m.numberRoomEvent(room, event.ID, event.Event)})
+}
+
+// clusterDeliverHandler sends an event fanned out by another instance to the clients here
+func (m *Manager) clusterDeliverHandler(w http.ResponseWriter, r *http.Request) {
+	event, ok := m.decodeClusterEvent(w, r)
+	if !ok {
+		return
+	}
+	room := r.PathValue("room")
+	delivered := 0
+	if event.Seq == 0 {
+		delivered = m.deliverToRoom(room, event.Event)
+	} else {
+		delivered = m.receiveRoomEvent(room, event)
+	}
+	writeJSON(w, http.StatusOK, clusterDelivered{Delivered: delivered})
+}
+
+// clusterStatusHandler returns the instances and which are up
+func (m *Manager) clusterStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if m.cluster == nil {
+		http.Error(w, "not clustered", http.StatusNotFound)
+		return
+	}
+	c := m.cluster
+	c.RLock()
+	status := ClusterStatus{
+		NodeID: c.self,
+		Epoch:  c.epoch,
+		Nodes:  []ClusterNode{{ID: c.self, Up: true, Self: true}},
+	}
+	for _, id := range slices.Sorted(maps.Keys(c.peers)) {
+		status.Nodes = append(status.Nodes, ClusterNode{ID: id, URL: c.peers[id], Up: c.up[id], LastSeen: c.lastSeen[id]})
+	}
+	c.RUnlock()
+	if m.raft != nil {
+		raftStatus := m.raft.status(m.now(), m.raftPresenceTTL())
+		status.Raft = &raftStatus
+	}
+	writeJSON(w, http.StatusOK, status)
+}
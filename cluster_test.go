@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"arti.soft/websockets-go/wstest"
+)
+
+// newClusterTestServers starts two instances of a cluster, ws-1 and ws-2, each
+// serving the backplane on an HTTP server of its own
+func newClusterTestServers(t *testing.T, config Config) ([]*wstest.Server, []*Manager) {
+	t.Helper()
+	nodes := []string{"ws-1", "ws-2"}
+	muxes := make([]*http.ServeMux, len(nodes))
+	urls := make(map[string]string)
+	for i, node := range nodes {
+		muxes[i] = http.NewServeMux()
+		backplane := httptest.NewServer(muxes[i])
+		t.Cleanup(backplane.Close)
+		urls[node] = backplane.URL
+	}
+
+	var servers []*wstest.Server
+	var managers []*Manager
+	for i, node := range nodes {
+		config.Cluster.NodeID = node
+		config.Cluster.Secret = "backplane"
+		config.Cluster.Peers = make(map[string]string)
+		for _, peer := range nodes {
+			if peer != node {
+				config.Cluster.Peers[peer] = urls[peer]
+			}
+		}
+		server, m, err := NewTestServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(server.Close)
+		m.registerClusterHandlers(newRoutes(muxes[i], ""))
+		servers = append(servers, server)
+		managers = append(managers, m)
+	}
+	return servers, managers
+}
+
+func TestAnnouncementIsFannedOut(t *testing.T) {
+	servers, managers := newClusterTestServers(t, DefaultConfig())
+	alice := servers[0].Connect("alice")
+	bob := servers[1].Connect("bob")
+
+	// The body names another sender, the announcement is still recorded as the admin's
+	body := `{"message":"maintenance at noon","priority":"high","sender":"mallory"}`
+	w := httptest.NewRecorder()
+	managers[0].announceHandler(w, httptest.NewRequest(http.MethodPost, "/admin/announcements", strings.NewReader(body)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"delivered":2`) {
+		t.Fatalf("announcing: %d %s, want it delivered to 2 clients", w.Code, w.Body)
+	}
+	for name, client := range map[string]*wstest.Client{"alice": alice, "bob": bob} {
+		var system SystemEvent
+		if err := client.ExpectPayload(EventSystem, &system, time.Second); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if system.Message != "maintenance at noon" || system.Priority != PriorityHigh {
+			t.Errorf("%s got %+v", name, system)
+		}
+	}
+
+	if list := managers[0].announcements.list(); len(list) != 1 || list[0].Sender != "admin" {
+		t.Errorf("announcements are %+v, want one by admin", list)
+	}
+	entries, err := managers[0].auditLog.Query(AuditQuery{Action: AuditAdminAnnounce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Actor != "admin" {
+		t.Errorf("audit entries are %+v, want one by admin", entries)
+	}
+}
+
+func TestRoomAnnouncementIsFannedOut(t *testing.T) {
+	servers, managers := newClusterTestServers(t, DefaultConfig())
+	bob := servers[1].Connect("bob")
+	carol := servers[1].Connect("carol")
+	if err := routeAs(t, managers[1], carol, EventJoinRoom, JoinRoomEvent{Room: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+
+	delivered, err := managers[0].announce(Announcement{Message: "deploying", Room: "ops", Sender: "olivia"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 1 {
+		t.Errorf("delivered to %d clients, want 1", delivered)
+	}
+	if err := carol.ExpectPayload(EventSystem, &SystemEvent{}, time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := bob.ExpectNone(EventSystem, 50*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFanOutKeepsTheOrder(t *testing.T) {
+	servers, managers := newClusterTestServers(t, DefaultConfig())
+	bob := servers[1].Connect("bob")
+
+	for i := range 50 {
+		managers[0].sendToRoom(defaultRoom, Event{Type: "tick", Payload: json.RawMessage(strconv.Itoa(i))})
+	}
+	for i := range 50 {
+		var n int
+		if err := bob.ExpectPayload("tick", &n, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if n != i {
+			t.Fatalf("tick %d arrived as number %d", n, i)
+		}
+	}
+}
+
+func TestClusterSecretIsReloaded(t *testing.T) {
+	servers, managers := newClusterTestServers(t, DefaultConfig())
+	bob := servers[1].Connect("bob")
+
+	// Both instances move to a new secret, the requests between them use it right away
+	for _, m := range managers {
+		config := *m.config()
+		config.Cluster.Secret = "rotated"
+		m.currentConfig.Store(&config)
+	}
+	if delivered := managers[0].cluster.fanOut(roomDeliverPath(defaultRoom), clusterEvent{Event: Event{Type: "tick"}})(); delivered != 1 {
+		t.Errorf("delivered to %d clients with the reloaded secret, want 1", delivered)
+	}
+	if _, err := bob.Expect("tick", time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRoomMessagesAcrossTheCluster(t *testing.T) {
+	servers, managers := newClusterTestServers(t, DefaultConfig())
+	bob := servers[1].Connect("bob")
+
+	for i := range 20 {
+		delivered, err := managers[0].postMessage(defaultRoom, SendMessageEvent{Message: strconv.Itoa(i), From: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delivered != 1 {
+			t.Errorf("message %d was delivered to %d clients, want 1", i, delivered)
+		}
+	}
+	for i := range 20 {
+		var msg NewMessageEvent
+		if err := bob.ExpectPayload(EventNewMessage, &msg, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Message != strconv.Itoa(i) {
+			t.Fatalf("message %s arrived as number %d", msg.Message, i)
+		}
+	}
+}
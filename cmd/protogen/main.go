@@ -0,0 +1,51 @@
+// protogen generates Go code from the protobuf schemas, it is run by go
+// generate in the root of the module
+//
+//	protogen -in events.proto -out proto_gen.go
+//	protogen -in grpc.proto -out backendpb/backend_gen.go -package backendpb -grpc
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"arti.soft/websockets-go/protogen"
+)
+
+func main() {
+	in := flag.String("in", "events.proto", "the schema")
+	out := flag.String("out", "proto_gen.go", "the generated Go file")
+	pkg := flag.String("package", "main", "the package of the generated file")
+	grpc := flag.Bool("grpc", false, "generate the messages and services as a gRPC package")
+	flag.Parse()
+
+	if err := generate(*in, *out, *pkg, *grpc); err != nil {
+		fmt.Fprintln(os.Stderr, "protogen:", err)
+		os.Exit(1)
+	}
+}
+
+func generate(in, out, pkg string, grpc bool) error {
+	schema, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer schema.Close()
+
+	parsed, err := protogen.Parse(schema)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+	var source []byte
+	if grpc {
+		source, err = protogen.GenerateGRPC(pkg, filepath.Base(in), parsed)
+	} else {
+		source, err = protogen.Generate(pkg, filepath.Base(in), parsed.Messages)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+	return os.WriteFile(out, source, 0o644)
+}
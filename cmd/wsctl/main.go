@@ -0,0 +1,246 @@
+// wsctl talks to the chat server from the command line
+//
+//	wsctl login
+//	wsctl send --room general hello everyone
+//	wsctl tail --room general
+//	wsctl kick <client id|user>
+//	wsctl stats
+//	wsctl conformance
+//
+// Credentials are taken from flags or the WSCTL_USER, WSCTL_PASSWORD and
+// WSCTL_ADMIN_TOKEN environment variables, the server from WSCTL_SERVER.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"arti.soft/websockets-go/client"
+	"arti.soft/websockets-go/conformance"
+)
+
+const usage = `usage: wsctl <command> [flags]
+
+commands:
+  login                   print an OTP for the user
+  send --room R message   send a message to a room
+  tail --room R           print the events of a room as JSON lines
+  kick <client id|user>   disconnect a client, or all clients of a user
+  stats                   print runtime stats of the server
+  conformance             check that the server speaks the wire protocol
+
+run wsctl <command> -h for the flags of a command`
+
+// options are the flags shared by all commands
+type options struct {
+	server     string
+	user       string
+	password   string
+	adminToken string
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.server, "server", envOr("WSCTL_SERVER", "http://localhost:8080"), "base URL of the server")
+	fs.StringVar(&o.user, "user", os.Getenv("WSCTL_USER"), "username to log in with")
+	fs.StringVar(&o.password, "password", os.Getenv("WSCTL_PASSWORD"), "password to log in with")
+	fs.StringVar(&o.adminToken, "admin-token", os.Getenv("WSCTL_ADMIN_TOKEN"), "admin token for kick and stats")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var err error
+	command, args := os.Args[1], os.Args[2:]
+	switch command {
+	case "login":
+		err = login(ctx, args)
+	case "send":
+		err = send(ctx, args)
+	case "tail":
+		err = tail(ctx, args)
+	case "kick":
+		err = kick(ctx, args)
+	case "stats":
+		err = stats(ctx, args)
+	case "conformance":
+		err = runConformance(ctx, args)
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "wsctl:", err)
+		os.Exit(1)
+	}
+}
+
+func login(ctx context.Context, args []string) error {
+	var opts options
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	opts.register(fs)
+	fs.Parse(args)
+
+	otp, err := client.Login(ctx, opts.server, opts.user, opts.password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(otp)
+	return nil
+}
+
+func send(ctx context.Context, args []string) error {
+	var opts options
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	opts.register(fs)
+	room := fs.String("room", "general", "room to send the message to")
+	fs.Parse(args)
+
+	message := strings.Join(fs.Args(), " ")
+	if message == "" {
+		return errors.New("no message given")
+	}
+
+	conn, err := client.Connect(ctx, opts.server, opts.user, opts.password)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.JoinRoom(*room); err != nil {
+		return err
+	}
+	return conn.SendMessage(message)
+}
+
+func tail(ctx context.Context, args []string) error {
+	var opts options
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	opts.register(fs)
+	room := fs.String("room", "general", "room to follow")
+	fs.Parse(args)
+
+	conn, err := client.Connect(ctx, opts.server, opts.user, opts.password)
+	if err != nil {
+		return err
+	}
+	// Closing the connection unblocks Receive when interrupted
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err := conn.JoinRoom(*room); err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		event, err := conn.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+}
+
+func kick(ctx context.Context, args []string) error {
+	var opts options
+	fs := flag.NewFlagSet("kick", flag.ExitOnError)
+	opts.register(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("kick needs a client id or username")
+	}
+
+	admin := client.Admin{Server: opts.server, Token: opts.adminToken}
+	kicked, err := admin.Kick(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("kicked %d clients\n", kicked)
+	return nil
+}
+
+func stats(ctx context.Context, args []string) error {
+	var opts options
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	opts.register(fs)
+	fs.Parse(args)
+
+	admin := client.Admin{Server: opts.server, Token: opts.adminToken}
+	data, err := admin.Stats(ctx)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+func runConformance(ctx context.Context, args []string) error {
+	var opts options
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	opts.register(fs)
+	apiKey := fs.String("api-key", os.Getenv("WSCTL_API_KEY"), "API key to connect with instead of logging in")
+	room := fs.String("room", "", "room to send the messages of the checks to, a new one if empty")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for the server each time")
+	fs.Parse(args)
+
+	results := conformance.Run(ctx, conformance.Config{
+		Server:   opts.server,
+		Username: opts.user,
+		Password: opts.password,
+		APIKey:   *apiKey,
+		Room:     *room,
+		Timeout:  *timeout,
+	})
+
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.Skipped != "":
+			fmt.Printf("SKIP %s: %s\n", result.Name, result.Skipped)
+		case result.Err != nil:
+			failed++
+			fmt.Printf("FAIL %s (%s)\n     %v\n", result.Name, result.Duration.Round(time.Millisecond), result.Err)
+		default:
+			fmt.Printf("PASS %s (%s)\n", result.Name, result.Duration.Round(time.Millisecond))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	return nil
+}
+
+// envOr returns the environment variable or the fallback if it is not set
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
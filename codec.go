@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrUnexpectedFrame = errors.New("unexpected websocket frame type for codec")
+
+	// errPong is returned by codecs that carry heartbeats in regular messages
+	// when the message decoded was a pong, it is treated as a websocket pong
+	errPong = errors.New("pong message")
+	// errSkip is returned by codecs for protocol messages that are not events
+	errSkip = errors.New("no event in message")
+)
+
+// Codec is used to translate Events to and from websocket messages
+// The codec of a connection is selected by the negotiated subprotocol
+type Codec interface {
+	// Encode turns the event into the message type and data to write
+	Encode(event Event) (int, []byte, error)
+	// Decode turns a message read from the connection into an Event
+	Decode(messageType int, data []byte) (Event, error)
+}
+
+// pinger is implemented by codecs that send their own ping messages
+// instead of websocket ping frames
+type pinger interface {
+	Ping() (int, []byte)
+}
+
+// jsonCodec sends events as JSON text messages, this is the default protocol
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(event Event) (int, []byte, error) {
+	data, err := json.Marshal(event)
+	return websocket.TextMessage, data, err
+}
+
+// EncodeTo encodes the event into buf, see bufferEncoder
+func (jsonCodec) EncodeTo(buf *bytes.Buffer, event Event) (int, error) {
+	if err := json.NewEncoder(buf).Encode(event); err != nil {
+		return 0, err
+	}
+	// Encode ends with a newline, which Marshal does not
+	buf.Truncate(buf.Len() - 1)
+	return websocket.TextMessage, nil
+}
+
+// EncodeStream encodes the event into w, see streamEncoder
+func (jsonCodec) EncodeStream(w io.Writer, event Event) error {
+	return json.NewEncoder(w).Encode(event)
+}
+
+// MessageType is the type of the messages written by EncodeStream
+func (jsonCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Decode(_ int, data []byte) (Event, error) {
+	var event Event
+	err := json.Unmarshal(data, &event)
+	return event, err
+}
+
+// protoCodec sends events as protobuf binary messages, see events.proto
+type protoCodec struct{}
+
+func (protoCodec) Encode(event Event) (int, []byte, error) {
+	data, err := marshalProtoEvent(event)
+	return websocket.BinaryMessage, data, err
+}
+
+func (protoCodec) Decode(messageType int, data []byte) (Event, error) {
+	if messageType != websocket.BinaryMessage {
+		return Event{}, ErrUnexpectedFrame
+	}
+	return unmarshalProtoEvent(data)
+}
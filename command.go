@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Messages starting with a slash are commands, like "/me waves", they are run on
+// the server instead of being sent to the room. Commands answer with an ephemeral
+// event only the issuer sees. A message starting with two slashes is sent as a
+// regular message with the first slash removed.
+//
+// Commands are registered like event handlers:
+//
+//	m.RegisterCommand("/roll", SlashCommand{Help: "roll a dice", Run: rollCommand})
+
+const (
+	// EventEphemeral is the answer to a command, only sent to the client that issued it
+	EventEphemeral = "ephemeral"
+)
+
+var (
+	ErrUnknownCommand   = errors.New("unknown command, try /help")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrCommandUsage     = errors.New("usage")
+)
+
+// Permission is who may run a command
+type Permission int
+
+const (
+	// PermissionUser lets everyone run the command
+	PermissionUser Permission = iota
+	// PermissionOperator only lets the operators of the config run the command
+	PermissionOperator
+)
+
+// EphemeralEvent is the payload of the ephemeral event
+type EphemeralEvent struct {
+	Command string `json:"command"`
+	Message string `json:"message"`
+	// Error is set if the command failed
+	Error bool `json:"error,omitempty"`
+	// Code and Params identify the message of a failed command for translation, see localize.go
+	Code   string            `json:"code,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// CommandContext is a command being run
+type CommandContext struct {
+	// Name is the command, including the slash
+	Name string
+	// Args is everything after the name, with surrounding spaces removed
+	Args   string
+	Room   string
+	Client *Client
+}
+
+// SlashCommand is a registered command
+type SlashCommand struct {
+	// Usage shows the arguments, like "<user>"
+	Usage string
+	Help  string
+	// Permission is who may run the command
+	Permission Permission
+	// Run runs the command, the returned text is sent back as ephemeral event
+	Run func(ctx CommandContext) (string, error)
+}
+
+// RegisterCommand adds a command, replacing the command of the same name
+// The name includes the slash, like "/kick"
+func (m *Manager) RegisterCommand(name string, command SlashCommand) {
+	m.commandsLock.Lock()
+	defer m.commandsLock.Unlock()
+	m.commands[name] = command
+}
+
+// setupCommands adds the built-in commands
+func (m *Manager) setupCommands() {
+	m.RegisterCommand("/help", SlashCommand{Help: "list the commands", Run: m.helpCommand})
+	m.RegisterCommand("/me", SlashCommand{Usage: "<action>", Help: "send an action, like /me waves", Run: m.meCommand})
+	m.RegisterCommand("/nick", SlashCommand{Usage: "[nickname]", Help: "set the name shown on your messages, without one it is cleared", Run: m.nickCommand})
+	m.RegisterCommand("/list", SlashCommand{Help: "list the users in the room", Run: m.listCommand})
+	m.RegisterCommand("/kick", SlashCommand{Usage: "<user>", Help: "disconnect all clients of a user", Permission: PermissionOperator, Run: m.kickCommand})
+}
+
+// isCommand returns true if the message is a command, "//" escapes a leading slash
+func isCommand(message string) bool {
+	return strings.HasPrefix(message, "/") && !strings.HasPrefix(message, "//")
+}
+
+// runCommand runs the command in the message and answers the client
+func (m *Manager) runCommand(c *Client, message string) error {
+	name, args, _ := strings.Cut(message, " ")
+	ctx := CommandContext{Name: name, Args: strings.TrimSpace(args), Room: m.roomOf(c), Client: c}
+
+	m.commandsLock.RLock()
+	command, ok := m.commands[name]
+	m.commandsLock.RUnlock()
+
+	var reply string
+	var err error
+	switch {
+	case !ok:
+		err = ErrUnknownCommand
+	case !m.allowed(c, command.Permission):
+		err = ErrPermissionDenied
+	default:
+		reply, err = command.Run(ctx)
+	}
+
+	if err != nil {
+		code, params := commandErrorCode(name, command, err)
+		return m.replyJSON(c, EventEphemeral, EphemeralEvent{Command: name, Message: m.localized(code, params), Error: true, Code: code, Params: params})
+	}
+	if reply == "" {
+		return nil
+	}
+	return m.replyJSON(c, EventEphemeral, EphemeralEvent{Command: name, Message: reply})
+}
+
+// commandErrorCode returns the code and params of the message telling why the command failed
+func commandErrorCode(name string, command SlashCommand, err error) (string, map[string]string) {
+	params := map[string]string{"command": name}
+	switch {
+	case errors.Is(err, ErrUnknownCommand):
+		return "unknown_command", params
+	case errors.Is(err, ErrPermissionDenied):
+		return "permission_denied", params
+	case errors.Is(err, ErrCommandUsage):
+		params["usage"] = command.Usage
+		return "command_usage", params
+	}
+	params["reason"] = err.Error()
+	return "command_failed", params
+}
+
+// allowed returns true if the client has the permission
+func (m *Manager) allowed(c *Client, permission Permission) bool {
+	switch permission {
+	case PermissionUser:
+		return true
+	case PermissionOperator:
+		// Keys act for machines, they never get operator commands
+		return c.apiKey == nil && slices.Contains(m.config().Operators, c.username)
+	default:
+		return false
+	}
+}
+
+func (m *Manager) helpCommand(ctx CommandContext) (string, error) {
+	m.commandsLock.RLock()
+	defer m.commandsLock.RUnlock()
+
+	var lines []string
+	for name, command := range m.commands {
+		if !m.allowed(ctx.Client, command.Permission) {
+			continue
+		}
+		line := name
+		if command.Usage != "" {
+			line += " " + command.Usage
+		}
+		lines = append(lines, line+" - "+command.Help)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), nil
+}
+
+func (m *Manager) meCommand(ctx CommandContext) (string, error) {
+	if ctx.Args == "" {
+		return "", ErrCommandUsage
+	}
+	_, err := m.postMessage(ctx.Room, SendMessageEvent{
+		Message:  ctx.Args,
+		From:     ctx.Client.username,
+		Nickname: m.nickname(ctx.Client.username),
+		Action:   true,
+	})
+	return "", err
+}
+
+func (m *Manager) nickCommand(ctx CommandContext) (string, error) {
+	nickname, err := m.changeNickname(ctx.Client.username, ctx.Args)
+	if err != nil {
+		return "", err
+	}
+	if nickname == "" {
+		return "nickname cleared", nil
+	}
+	return "you are now known as " + nickname, nil
+}
+
+func (m *Manager) listCommand(ctx CommandContext) (string, error) {
+	m.RLock()
+	var users []string
+	for client := range m.members[ctx.Room] {
+		if !slices.Contains(users, client.username) {
+			users = append(users, client.username)
+		}
+	}
+	m.RUnlock()
+
+	sort.Strings(users)
+	return fmt.Sprintf("%d in %s: %s", len(users), ctx.Room, strings.Join(users, ", ")), nil
+}
+
+func (m *Manager) kickCommand(ctx CommandContext) (string, error) {
+	if ctx.Args == "" {
+		return "", ErrCommandUsage
+	}
+	kicked := m.kick(ctx.Args, ctx.Client.username)
+	return fmt.Sprintf("kicked %d clients of %s", kicked, ctx.Args), nil
+}
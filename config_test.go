@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigMigratesCSRFSecret(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `{"csrf": {"enabled": true, "secret": "shared"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.SigningKeys) != 1 || config.SigningKeys[0] != (SigningKey{ID: csrfSecretKeyID, Secret: "shared"}) {
+		t.Errorf("signing keys are %+v, want the csrf secret", config.SigningKeys)
+	}
+	if config.CSRF.Secret != "" {
+		t.Errorf("csrf secret %q is left", config.CSRF.Secret)
+	}
+
+	_, err = LoadConfig(writeConfig(t, `{"csrf": {"secret": "shared"}, "signing_keys": [{"id": "k1", "secret": "other"}]}`))
+	if !errors.Is(err, ErrCSRFSecret) {
+		t.Errorf("config with csrf.secret and signing_keys: %v, want %v", err, ErrCSRFSecret)
+	}
+}
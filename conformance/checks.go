@@ -0,0 +1,457 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"arti.soft/websockets-go/client"
+	"github.com/gorilla/websocket"
+)
+
+// Event types the checks send and expect, spelled out as they are on the wire
+const (
+	eventWelcome      = "welcome"
+	eventError        = "error"
+	eventAck          = "ack"
+	eventTimeSync     = "time_sync"
+	eventSwitchRoom   = "switch_room"
+	eventRoomSwitched = "room_switched"
+	eventSendMessage  = "send_message"
+	eventNewMessage   = "new_message"
+)
+
+// checks are run in this order, the handshake first since everything else needs it
+var checks = []check{
+	{"handshake/unauthorized", checkUnauthorized},
+	{"handshake/subprotocol", checkUnsupportedSubprotocol},
+	{"handshake/welcome", checkWelcome},
+	{"ping", checkPing},
+	{"close/normal", checkNormalClose},
+	{"close/too_large", checkTooLarge},
+	{"errors/invalid_envelope", checkInvalidEnvelope},
+	{"ack/redelivery", checkRedelivery},
+	{"ordering", checkOrdering},
+}
+
+// welcome is the part of the welcome event the checks look at
+type welcome struct {
+	ClientID string `json:"client_id"`
+	Room     string `json:"room"`
+	Protocol struct {
+		Subprotocol       string `json:"subprotocol"`
+		Version           int    `json:"version"`
+		QoS               bool   `json:"qos"`
+		MaxMessageSize    int    `json:"max_message_size"`
+		MaxDocMessageSize int    `json:"max_doc_message_size"`
+		MaxSignalSize     int    `json:"max_signal_size"`
+	} `json:"protocol"`
+	Heartbeat struct {
+		PingInterval string `json:"ping_interval"`
+		PongWait     string `json:"pong_wait"`
+		Keepalive    bool   `json:"keepalive"`
+	} `json:"heartbeat"`
+}
+
+// errorEvent is the payload of the error event
+type errorEvent struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Params  map[string]string `json:"params"`
+}
+
+// message is the part of new_message the checks look at
+type message struct {
+	Message string `json:"message"`
+	Seq     uint64 `json:"seq"`
+}
+
+// checkUnauthorized connects without an OTP, the upgrade has to be refused with 401
+func checkUnauthorized(ctx context.Context, s *suite) error {
+	c, resp, err := s.dial(ctx, dialOptions{anonymous: true})
+	if err == nil {
+		c.close()
+		return errors.New("connected without an OTP or API key")
+	}
+	if resp == nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("upgrade without an OTP was refused with %s, want 401", resp.Status)
+	}
+	return nil
+}
+
+// checkUnsupportedSubprotocol offers only a subprotocol the server can't speak, the
+// upgrade has to be refused with 400 naming the supported ones
+func checkUnsupportedSubprotocol(ctx context.Context, s *suite) error {
+	c, resp, err := s.dial(ctx, dialOptions{subprotocols: []string{"chat.v0.conformance"}, anonymous: true})
+	if err == nil {
+		c.close()
+		return errors.New("connected with an unsupported subprotocol")
+	}
+	if resp == nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("upgrade with an unsupported subprotocol was refused with %s, want 400", resp.Status)
+	}
+	if !strings.Contains(resp.Header.Get("Sec-WebSocket-Protocol"), subprotocolJSON) {
+		return fmt.Errorf("refused upgrade names the subprotocols %q, want %s among them", resp.Header.Get("Sec-WebSocket-Protocol"), subprotocolJSON)
+	}
+	return nil
+}
+
+// checkWelcome connects with chat.v1.json, the server has to select it and send the
+// welcome first
+func checkWelcome(ctx context.Context, s *suite) error {
+	c, _, err := s.dial(ctx, dialOptions{})
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	if c.ws.Subprotocol() != subprotocolJSON {
+		return fmt.Errorf("server selected the subprotocol %q, want %s", c.ws.Subprotocol(), subprotocolJSON)
+	}
+	event, err := c.next()
+	if err != nil {
+		return err
+	}
+	if event.Type != eventWelcome {
+		return fmt.Errorf("first event is %s, want %s", event.Type, eventWelcome)
+	}
+	var w welcome
+	if err := json.Unmarshal(event.Payload, &w); err != nil {
+		return fmt.Errorf("payload of welcome: %w", err)
+	}
+	switch {
+	case w.ClientID == "":
+		return errors.New("welcome has no client_id")
+	case w.Room == "":
+		return errors.New("welcome has no room")
+	case w.Protocol.Subprotocol != subprotocolJSON:
+		return fmt.Errorf("welcome names the subprotocol %q, want %s", w.Protocol.Subprotocol, subprotocolJSON)
+	case w.Protocol.MaxMessageSize <= 0:
+		return errors.New("welcome has no max_message_size")
+	}
+
+	if w.Heartbeat.Keepalive {
+		return nil
+	}
+	interval, err := time.ParseDuration(w.Heartbeat.PingInterval)
+	if err != nil {
+		return fmt.Errorf("heartbeat ping_interval: %w", err)
+	}
+	pongWait, err := time.ParseDuration(w.Heartbeat.PongWait)
+	if err != nil {
+		return fmt.Errorf("heartbeat pong_wait: %w", err)
+	}
+	if interval <= 0 || interval >= pongWait {
+		return fmt.Errorf("heartbeat ping_interval %s has to be positive and shorter than pong_wait %s", interval, pongWait)
+	}
+	return nil
+}
+
+// checkPing sends a ping, the server has to answer with a pong carrying the same data
+func checkPing(ctx context.Context, s *suite) error {
+	c, _, err := s.connect(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	const data = "conformance"
+	pongs := make(chan string, 1)
+	c.ws.SetPongHandler(func(appData string) error {
+		select {
+		case pongs <- appData:
+		default:
+		}
+		return nil
+	})
+	// Pongs are handled while reading, the events read meanwhile don't matter
+	go func() {
+		for {
+			if _, err := c.next(); err != nil && !errors.Is(err, ErrTimeout) {
+				return
+			}
+		}
+	}()
+
+	if err := c.ws.WriteControl(websocket.PingMessage, []byte(data), time.Now().Add(s.config.Timeout)); err != nil {
+		return err
+	}
+	select {
+	case appData := <-pongs:
+		if appData != data {
+			return fmt.Errorf("pong carries %q, want %q", appData, data)
+		}
+		return nil
+	case <-time.After(s.config.Timeout):
+		return fmt.Errorf("waiting for pong: %w", ErrTimeout)
+	}
+}
+
+// checkNormalClose closes with 1000, the server has to echo the close code
+func checkNormalClose(ctx context.Context, s *suite) error {
+	c, _, err := s.connect(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer c.ws.Close()
+
+	closing := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "conformance")
+	if err := c.ws.WriteControl(websocket.CloseMessage, closing, time.Now().Add(s.config.Timeout)); err != nil {
+		return err
+	}
+	return expectClose(c, websocket.CloseNormalClosure)
+}
+
+// checkTooLarge sends a message larger than the server reads, the server has to
+// close with 1009
+func checkTooLarge(ctx context.Context, s *suite) error {
+	c, w, err := s.connect(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer c.ws.Close()
+
+	limit := max(w.Protocol.MaxMessageSize, w.Protocol.MaxDocMessageSize, w.Protocol.MaxSignalSize)
+	if err := c.ws.WriteMessage(websocket.TextMessage, []byte(strings.Repeat(" ", limit+1))); err != nil {
+		return err
+	}
+	return expectClose(c, websocket.CloseMessageTooBig)
+}
+
+// expectClose reads until the server closes, it has to close with the code
+func expectClose(c *conn, code int) error {
+	for {
+		_, err := c.next()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			return fmt.Errorf("waiting for close %d: %w", code, err)
+		}
+		if closeErr.Code != code {
+			return fmt.Errorf("server closed with %d, want %d", closeErr.Code, code)
+		}
+		return nil
+	}
+}
+
+// checkInvalidEnvelope breaks the strict envelope of chat.v2.json, the server has
+// to answer with invalid_envelope errors naming the field and the id
+func checkInvalidEnvelope(ctx context.Context, s *suite) error {
+	c, resp, err := s.dial(ctx, dialOptions{subprotocols: []string{subprotocolStrict}})
+	if resp != nil && resp.StatusCode == http.StatusBadRequest {
+		return &skipError{reason: "the server doesn't speak " + subprotocolStrict}
+	}
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	if err := c.expect(eventWelcome, nil); err != nil {
+		return err
+	}
+
+	cases := []struct {
+		envelope string
+		id       string
+		field    string
+	}{
+		{envelope: `{"type":"time_sync","payload":{}}`, field: "id"},
+		{envelope: `{"id":"conformance-1","ts":"yesterday","type":"time_sync","payload":{}}`, id: "conformance-1", field: "ts"},
+	}
+	for _, tc := range cases {
+		if err := c.ws.WriteMessage(websocket.TextMessage, []byte(tc.envelope)); err != nil {
+			return err
+		}
+		var e errorEvent
+		if err := c.expect(eventError, &e); err != nil {
+			return fmt.Errorf("sent %s: %w", tc.envelope, err)
+		}
+		switch {
+		case e.Code != "invalid_envelope":
+			return fmt.Errorf("sent %s: error code is %q, want invalid_envelope", tc.envelope, e.Code)
+		case e.Message == "":
+			return fmt.Errorf("sent %s: error has no message", tc.envelope)
+		case e.Params["field"] != tc.field:
+			return fmt.Errorf("sent %s: error names the field %q, want %q", tc.envelope, e.Params["field"], tc.field)
+		case e.Params["id"] != tc.id:
+			return fmt.Errorf("sent %s: error names the id %q, want %q", tc.envelope, e.Params["id"], tc.id)
+		}
+	}
+	return nil
+}
+
+// checkRedelivery asks for at-least-once delivery, an event that isn't acked has to
+// be sent again on reconnect with the same id, and not after it was acked
+func checkRedelivery(ctx context.Context, s *suite) error {
+	query := url.Values{"qos": {"1"}, "session": {"conformance-" + randomID()}}
+	text := "conformance ack " + randomID()
+
+	// The message is received but not acked
+	c, w, err := s.connect(ctx, query)
+	if err != nil {
+		return err
+	}
+	if !w.Protocol.QoS {
+		c.close()
+		return errors.New("welcome doesn't confirm qos")
+	}
+	if err := switchRoom(c, s.config.Room); err != nil {
+		c.close()
+		return err
+	}
+	if err := c.send(eventSendMessage, map[string]string{"message": text}); err != nil {
+		c.close()
+		return err
+	}
+	first, err := expectMessage(c, text)
+	c.close()
+	if err != nil {
+		return err
+	}
+	if first.ID == "" {
+		return errors.New("new_message sent with qos has no id")
+	}
+
+	// It is sent again, and acked this time
+	c, _, err = s.connect(ctx, query)
+	if err != nil {
+		return err
+	}
+	again, err := expectMessage(c, text)
+	if err != nil {
+		c.close()
+		return fmt.Errorf("unacked event was not sent again: %w", err)
+	}
+	if again.ID != first.ID {
+		c.close()
+		return fmt.Errorf("unacked event was sent again with the id %q, want %q", again.ID, first.ID)
+	}
+	if err := c.send(eventAck, map[string]string{"id": first.ID}); err != nil {
+		c.close()
+		return err
+	}
+	// The answer to time_sync comes after the ack was read
+	err = timeSync(c)
+	c.close()
+	if err != nil {
+		return err
+	}
+
+	// Pending events are sent right after the welcome, before the answer to time_sync
+	c, _, err = s.connect(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	if err := c.send(eventTimeSync, map[string]any{}); err != nil {
+		return err
+	}
+	for {
+		event, err := c.next()
+		if err != nil {
+			return fmt.Errorf("waiting for %s: %w", eventTimeSync, err)
+		}
+		switch {
+		case event.ID == first.ID:
+			return errors.New("acked event was sent again")
+		case event.Type == eventTimeSync:
+			return nil
+		}
+	}
+}
+
+// checkOrdering sends messages to a room from one connection, another connection
+// in the room has to get them in the order they were sent with increasing seqs
+func checkOrdering(ctx context.Context, s *suite) error {
+	receiver, _, err := s.connect(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer receiver.close()
+	sender, _, err := s.connect(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer sender.close()
+	for _, c := range []*conn{receiver, sender} {
+		if err := switchRoom(c, s.config.Room); err != nil {
+			return err
+		}
+	}
+
+	prefix := "conformance order " + randomID() + " "
+	for i := range s.config.Messages {
+		if err := sender.send(eventSendMessage, map[string]string{"message": fmt.Sprint(prefix, i)}); err != nil {
+			return err
+		}
+	}
+
+	for _, peer := range []struct {
+		name string
+		c    *conn
+	}{{"receiver", receiver}, {"sender", sender}} {
+		name, c := peer.name, peer.c
+		var last uint64
+		for i := range s.config.Messages {
+			var m message
+			for {
+				if err := c.expect(eventNewMessage, &m); err != nil {
+					return fmt.Errorf("%s got %d of %d messages: %w", name, i, s.config.Messages, err)
+				}
+				if strings.HasPrefix(m.Message, prefix) {
+					break
+				}
+			}
+			if want := fmt.Sprint(prefix, i); m.Message != want {
+				return fmt.Errorf("%s got %q as message %d, want %q", name, m.Message, i, want)
+			}
+			if m.Seq <= last {
+				return fmt.Errorf("%s got seq %d after %d", name, m.Seq, last)
+			}
+			last = m.Seq
+		}
+	}
+	return nil
+}
+
+// switchRoom moves the connection to the room and waits until it is there
+func switchRoom(c *conn, room string) error {
+	if err := c.send(eventSwitchRoom, map[string]any{"room": room, "history": -1}); err != nil {
+		return err
+	}
+	return c.expect(eventRoomSwitched, nil)
+}
+
+// timeSync sends a time_sync and waits for the answer
+func timeSync(c *conn) error {
+	if err := c.send(eventTimeSync, map[string]any{}); err != nil {
+		return err
+	}
+	return c.expect(eventTimeSync, nil)
+}
+
+// expectMessage reads until the new_message with the text arrives
+func expectMessage(c *conn, text string) (client.Event, error) {
+	for {
+		var m message
+		event, err := c.expectEvent(eventNewMessage, &m)
+		if err != nil {
+			return client.Event{}, err
+		}
+		if m.Message == text {
+			return event, nil
+		}
+	}
+}
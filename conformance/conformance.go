@@ -0,0 +1,295 @@
+// Package conformance checks that a running chat server speaks the wire protocol,
+// so alternate client implementations and forks of the server can tell whether
+// they are compatible. It connects to the server like any client and checks the
+// handshake, ping and pong, the close codes, error events, the ack semantics of
+// at-least-once delivery and the order events of a room arrive in.
+//
+// From the command line it runs with wsctl:
+//
+//	wsctl conformance --server http://localhost:8080 --user alice --password secret
+//
+// and from a Go test with Test, every check is a subtest:
+//
+//	func TestConformance(t *testing.T) {
+//	    conformance.Test(t, conformance.Config{Server: "http://localhost:8080", APIKey: os.Getenv("CHAT_API_KEY")})
+//	}
+//
+// The tests of the server run it as TestConformance, against a server they start
+// or the one CONFORMANCE_SERVER points to:
+//
+//	CONFORMANCE_SERVER=https://chat.example.com CONFORMANCE_API_KEY=... go test -run TestConformance
+//
+// The checks speak chat.v1.json, and chat.v2.json for the strict envelope, they
+// log in again for every connection as OTPs can be used once. Messages are sent
+// to a room of their own, so the users of the server don't see them.
+package conformance
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"arti.soft/websockets-go/client"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrTimeout = errors.New("timed out waiting for the server")
+)
+
+// Subprotocols of the protocol the checks speak
+const (
+	subprotocolJSON   = "chat.v1.json"
+	subprotocolStrict = "chat.v2.json"
+)
+
+// Config tells the checks where the server is and how to log in
+type Config struct {
+	// Server is the base URL of the server like http://localhost:8080
+	Server string
+	// Username and Password log in for every connection, unless APIKey is set
+	Username string
+	Password string
+	// APIKey connects without logging in, it needs the connect scope
+	APIKey string
+	// Room is the room messages are sent to, a new one if empty
+	Room string
+	// Timeout is how long to wait for the server each time, 5s if zero
+	Timeout time.Duration
+	// Messages is how many messages the ordering check sends, 20 if zero
+	Messages int
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Name string
+	// Err is nil if the server passed the check
+	Err error
+	// Skipped is why the check didn't run, like a server without the strict envelope
+	Skipped  string
+	Duration time.Duration
+}
+
+// Passed returns true if the check ran and the server passed it
+func (r Result) Passed() bool {
+	return r.Err == nil && r.Skipped == ""
+}
+
+// skipError is returned by checks that can't run against the server
+type skipError struct {
+	reason string
+}
+
+func (e *skipError) Error() string {
+	return "skipped: " + e.reason
+}
+
+// check is a single check of the suite
+type check struct {
+	name string
+	run  func(ctx context.Context, s *suite) error
+}
+
+// Run runs all checks against the server, in order, and returns their results
+func Run(ctx context.Context, config Config) []Result {
+	s := newSuite(config)
+	results := make([]Result, 0, len(checks))
+	for _, c := range checks {
+		results = append(results, s.run(ctx, c))
+	}
+	return results
+}
+
+// Test runs all checks against the server as subtests of t
+func Test(t *testing.T, config Config) {
+	s := newSuite(config)
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			result := s.run(t.Context(), c)
+			switch {
+			case result.Skipped != "":
+				t.Skip(result.Skipped)
+			case result.Err != nil:
+				t.Error(result.Err)
+			}
+		})
+	}
+}
+
+// suite holds what the checks share
+type suite struct {
+	config Config
+}
+
+func newSuite(config Config) *suite {
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.Messages <= 0 {
+		config.Messages = 20
+	}
+	if config.Room == "" {
+		config.Room = "conformance-" + randomID()
+	}
+	return &suite{config: config}
+}
+
+// run runs the check and times it
+func (s *suite) run(ctx context.Context, c check) Result {
+	start := time.Now()
+	err := c.run(ctx, s)
+	result := Result{Name: c.name, Err: err, Duration: time.Since(start)}
+	var skip *skipError
+	if errors.As(err, &skip) {
+		result.Err, result.Skipped = nil, skip.reason
+	}
+	return result
+}
+
+// conn is a websocket to the server read by a single check
+type conn struct {
+	ws      *websocket.Conn
+	timeout time.Duration
+}
+
+// dialOptions change how dial connects
+type dialOptions struct {
+	// subprotocols are offered to the server, chat.v1.json if empty
+	subprotocols []string
+	// anonymous connects without an OTP or API key
+	anonymous bool
+	// query is added to the URL, like qos=1
+	query url.Values
+}
+
+// dial opens a websocket to the server, logging in first unless an API key is used.
+// The response is returned along with the error when the upgrade was refused
+func (s *suite) dial(ctx context.Context, options dialOptions) (*conn, *http.Response, error) {
+	u, err := url.Parse(s.config.Server)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+
+	query := url.Values{}
+	for key, values := range options.query {
+		query[key] = values
+	}
+	header := http.Header{}
+	switch {
+	case options.anonymous:
+	case s.config.APIKey != "":
+		header.Set("Authorization", "Bearer "+s.config.APIKey)
+	default:
+		otp, err := client.Login(ctx, s.config.Server, s.config.Username, s.config.Password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("login: %w", err)
+		}
+		query.Set("otp", otp)
+	}
+	u.RawQuery = query.Encode()
+
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = s.config.Timeout
+	dialer.Subprotocols = options.subprotocols
+	if len(dialer.Subprotocols) == 0 {
+		dialer.Subprotocols = []string{subprotocolJSON}
+	}
+	ws, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		return nil, resp, err
+	}
+	return &conn{ws: ws, timeout: s.config.Timeout}, resp, nil
+}
+
+// connect opens a websocket with chat.v1.json and reads the welcome
+func (s *suite) connect(ctx context.Context, query url.Values) (*conn, welcome, error) {
+	c, _, err := s.dial(ctx, dialOptions{query: query})
+	if err != nil {
+		return nil, welcome{}, err
+	}
+	var w welcome
+	if err := c.expect(eventWelcome, &w); err != nil {
+		c.close()
+		return nil, welcome{}, err
+	}
+	return c, w, nil
+}
+
+// send sends an event with the loose envelope
+func (c *conn) send(eventType string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteJSON(client.Event{Type: eventType, Payload: data})
+}
+
+// next reads the next event, waiting at most the timeout
+func (c *conn) next() (client.Event, error) {
+	c.ws.SetReadDeadline(time.Now().Add(c.timeout))
+	var event client.Event
+	if err := c.ws.ReadJSON(&event); err != nil {
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return client.Event{}, ErrTimeout
+		}
+		return client.Event{}, err
+	}
+	return event, nil
+}
+
+// expect reads events until one of the type arrives and decodes its payload into v,
+// v may be nil. Events of other types are skipped
+func (c *conn) expect(eventType string, v any) error {
+	_, err := c.expectEvent(eventType, v)
+	return err
+}
+
+// expectEvent is expect returning the event
+func (c *conn) expectEvent(eventType string, v any) (client.Event, error) {
+	deadline := time.Now().Add(c.timeout)
+	for time.Now().Before(deadline) {
+		event, err := c.next()
+		if err != nil {
+			return client.Event{}, fmt.Errorf("waiting for %s: %w", eventType, err)
+		}
+		if event.Type != eventType {
+			continue
+		}
+		if v != nil {
+			if err := json.Unmarshal(event.Payload, v); err != nil {
+				return client.Event{}, fmt.Errorf("payload of %s: %w", eventType, err)
+			}
+		}
+		return event, nil
+	}
+	return client.Event{}, fmt.Errorf("waiting for %s: %w", eventType, ErrTimeout)
+}
+
+// close closes the websocket, telling the server first
+func (c *conn) close() {
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(c.timeout))
+	c.ws.Close()
+}
+
+// randomID returns a random hex string for rooms and sessions
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"arti.soft/websockets-go/conformance"
+)
+
+// TestConformance runs the conformance suite against a server started by the
+// test, or against the one at CONFORMANCE_SERVER, logging in with
+// CONFORMANCE_USER and CONFORMANCE_PASSWORD or connecting with CONFORMANCE_API_KEY
+func TestConformance(t *testing.T) {
+	config := conformance.Config{
+		Server:   os.Getenv("CONFORMANCE_SERVER"),
+		Username: os.Getenv("CONFORMANCE_USER"),
+		Password: os.Getenv("CONFORMANCE_PASSWORD"),
+		APIKey:   os.Getenv("CONFORMANCE_API_KEY"),
+	}
+	if config.Server == "" {
+		s := startE2EServer(t, 1)
+		config.Server, config.Username, config.Password = s.URL, e2eUser(0), e2ePassword
+	}
+	conformance.Test(t, config)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The console lets operators manage the server by typing commands, either on
+// stdin or on a unix socket, e.g. with `nc -U /run/websockets.sock`.
+// The socket has no authentication, access is controlled by its file permissions.
+
+// consoleHelp lists the console commands
+const consoleHelp = `commands:
+  clients                 list connected clients
+  kick <client id|user>   disconnect a client, or all clients of a user
+  broadcast <message>     send a system message to everyone
+  stats                   show runtime stats
+  loglevel [debug|info]   show or set the log level
+  help                    show this help
+  quit                    close the console`
+
+// AuditConsole is recorded for every command that changes something
+const AuditConsole = "console"
+
+var (
+	ErrConsoleUsage  = errors.New("wrong usage, type help for the commands")
+	ErrConsoleSocket = errors.New("the console socket path is taken by a file that is not a socket")
+)
+
+// errConsoleQuit ends the console session
+var errConsoleQuit = errors.New("quit")
+
+// serveConsole reads commands from r and writes the results to w until r is closed
+func (m *Manager) serveConsole(r io.Reader, w io.Writer, actor string) {
+	scanner := bufio.NewScanner(r)
+	fmt.Fprint(w, "> ")
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			err := m.runConsoleCommand(w, line, actor)
+			if errors.Is(err, errConsoleQuit) {
+				return
+			}
+			if err != nil {
+				fmt.Fprintln(w, "error:", err)
+			}
+		}
+		fmt.Fprint(w, "> ")
+	}
+}
+
+// runConsoleCommand executes a single console command
+func (m *Manager) runConsoleCommand(w io.Writer, line string, actor string) error {
+	command, args, _ := strings.Cut(line, " ")
+	args = strings.TrimSpace(args)
+
+	switch command {
+	case "help":
+		fmt.Fprintln(w, consoleHelp)
+
+	case "quit", "exit":
+		return errConsoleQuit
+
+	case "clients":
+		m.RLock()
+		for client := range m.clients {
+			fmt.Fprintf(w, "%s\t%s\t%s\tegress=%d\n", client.id, client.username, client.room, len(client.egress))
+		}
+		fmt.Fprintf(w, "%d clients\n", len(m.clients))
+		m.RUnlock()
+
+	case "kick":
+		if args == "" {
+			return ErrConsoleUsage
+		}
+		kicked := m.kick(args, actor)
+		fmt.Fprintf(w, "kicked %d clients\n", kicked)
+
+	case "broadcast":
+		if args == "" {
+			return ErrConsoleUsage
+		}
+		delivered, err := m.announce(Announcement{Message: args, Sender: actor})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "delivered to %d clients\n", delivered)
+
+	case "stats":
+		data, err := json.MarshalIndent(m.runtimeDebugInfo(), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+
+	case "loglevel":
+		if args != "" {
+			if err := setLogLevel(args); err != nil {
+				return err
+			}
+			m.audit(AuditEntry{Action: AuditConsole, Actor: actor, Details: map[string]string{"command": line}})
+		}
+		fmt.Fprintln(w, "log level:", logLevel())
+
+	default:
+		return ErrConsoleUsage
+	}
+	return nil
+}
+
+// kick disconnects the client with the id, or all clients of the user, and returns how many it kicked
+func (m *Manager) kick(target string, actor string) int {
+	var kicked []*Client
+	m.RLock()
+	for client := range m.clients {
+		if client.id == target || client.username == target {
+			kicked = append(kicked, client)
+		}
+	}
+	m.RUnlock()
+
+	for _, client := range kicked {
+		m.removeClient(client)
+		m.audit(AuditEntry{
+			Action:  AuditKick,
+			Actor:   actor,
+			Target:  client.username,
+			Details: map[string]string{"client_id": client.id, "via": "console"},
+		})
+	}
+	return len(kicked)
+}
+
+// runStdinConsole serves the console on stdin and stdout
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runStdinConsole() {
+	m.serveConsole(os.Stdin, os.Stdout, "console")
+}
+
+// runConsoleSocket serves the console on a unix socket, one session per connection
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runConsoleSocket(ctx context.Context, path string) error {
+	lis, err := listenConsoleSocket(path)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := removeStaleSocket(path); err != nil {
+			log.Println("removing the console socket: ", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			log.Println("console session opened")
+			m.serveConsole(conn, conn, "console")
+		}()
+	}
+}
+
+// listenConsoleSocket listens on the unix socket at path. The socket is created in a
+// new 0700 directory next to path and only moved into place once it is 0600, so
+// nobody but the user running the server can ever connect to it
+func listenConsoleSocket(path string) (*net.UnixListener, error) {
+	// Remove a socket left over from an earlier run
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".console-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	lis, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The listener would unlink the temporary path on Close, the socket is removed
+	// by runConsoleSocket instead
+	lis.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
+
+// removeStaleSocket removes the unix socket at path, anything else found there is
+// left alone and reported as ErrConsoleSocket
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%w: %s", ErrConsoleSocket, path)
+	}
+	return os.Remove(path)
+}
+
+// kickHandler disconnects the client with the id, or all clients of the user
+func (m *Manager) kickHandler(w http.ResponseWriter, r *http.Request) {
+	kicked := m.kick(r.PathValue("target"), "admin")
+	writeJSON(w, http.StatusOK, struct {
+		Kicked int `json:"kicked"`
+	}{Kicked: kicked})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsoleSocketKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.sock")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := listenConsoleSocket(path); !errors.Is(err, ErrConsoleSocket) {
+		t.Fatalf("listen on a regular file: %v, want %v", err, ErrConsoleSocket)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("the file was changed: %q, %v", data, err)
+	}
+}
+
+func TestConsoleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "console.sock")
+	// A socket left over from an earlier run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server, m, err := NewTestServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- m.runConsoleSocket(ctx, path) }()
+
+	var conn net.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer conn.Close()
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Type() != fs.ModeSocket || info.Mode().Perm() != 0600 {
+		t.Errorf("console socket has mode %v, want a socket with 0600", info.Mode())
+	}
+	// The temporary directory the socket was created in is gone
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d entries next to the socket, want only the socket", len(entries))
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("loglevel\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	// The answer follows the prompt on the same line
+	if line, err := reader.ReadString('\n'); err != nil || !strings.Contains(line, logLevel()) {
+		t.Errorf("loglevel answered %q, %v", line, err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the socket is left after the shutdown: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Browsers on another origin than the server, like a frontend on app.example.com
+// talking to chat.example.com, may only read the responses of /login and the REST
+// and admin APIs if the server allows it with CORS headers. Before requests with
+// a JSON body or an Authorization header they send a preflight OPTIONS request,
+// which is answered without reaching the handler. CORS is off unless origins are
+// configured, WebSocket connections are checked against allowed_origins instead.
+
+// defaultCORSHeaders are the request headers allowed unless others are configured
+var defaultCORSHeaders = []string{"Authorization", "Content-Type", csrfHeader}
+
+// corsMethods are the methods the routes take
+const corsMethods = "GET, POST, PUT, PATCH, DELETE"
+
+// corsOrigin returns the value of Access-Control-Allow-Origin for the origin,
+// ok is false if the origin is not allowed
+func corsOrigin(config CORSConfig, origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	if slices.Contains(config.AllowedOrigins, origin) {
+		return origin, true
+	}
+	if slices.Contains(config.AllowedOrigins, "*") {
+		// Browsers refuse a wildcard with credentials, so the origin is echoed instead
+		if config.AllowCredentials {
+			return origin, true
+		}
+		return "*", true
+	}
+	return "", false
+}
+
+// cors adds the CORS headers for allowed origins and answers their preflight requests
+func (m *Manager) cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := m.config().CORS
+		allowOrigin, ok := corsOrigin(config, r.Header.Get("Origin"))
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		header.Set("Access-Control-Allow-Origin", allowOrigin)
+		if config.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			if len(config.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(config.ExposedHeaders, ", "))
+			}
+			next(w, r)
+			return
+		}
+
+		// Preflight, the handler is not asked
+		allowedHeaders := config.AllowedHeaders
+		if len(allowedHeaders) == 0 {
+			allowedHeaders = defaultCORSHeaders
+		}
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		header.Set("Access-Control-Allow-Methods", corsMethods)
+		header.Set("Access-Control-Allow-Headers", strings.Join(allowedHeaders, ", "))
+		if config.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(config.MaxAge).Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Browsers send cookies and cached basic auth credentials along with requests
+// made by any page, so a page on another site could log users in to its own
+// account, change their password or delete their account without them noticing.
+// With csrf enabled, these requests also need a token only pages of an allowed
+// origin can read: GET /csrf sets it as a cookie and returns it, and it has to be
+// sent back in the X-CSRF-Token header, or the csrf query param of the upgrade,
+// since browsers can't set headers on WebSocket connections. Tokens are signed
+// with the signing keys, see signing.go, so a cookie planted from a sibling
+// subdomain is not accepted either.
+//
+// Requests with bearer tokens, like the REST and admin APIs, are left alone since
+// browsers never add those on their own. WebSocket connections are only checked
+// when they come from a browser, which always sends an Origin header.
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+	// csrfParam is the query param of the token on the upgrade request
+	csrfParam = "csrf"
+	// csrfCookieTTL is how long browsers keep the token
+	csrfCookieTTL = 12 * time.Hour
+)
+
+var (
+	ErrCSRFToken  = errors.New("csrf token missing or invalid")
+	ErrCSRFSecret = errors.New("csrf.secret is replaced by signing_keys")
+)
+
+// csrfSecretKeyID is the ID of the signing key a csrf.secret is moved to
+const csrfSecretKeyID = "csrf"
+
+// migrateCSRFSecret moves the csrf.secret of older configs to signing_keys, so
+// instances sharing it keep accepting each others tokens. With signing keys
+// configured as well it is unclear which was meant, the config is rejected
+func migrateCSRFSecret(config *Config) error {
+	secret := config.CSRF.Secret
+	if secret == "" {
+		return nil
+	}
+	if len(config.SigningKeys) > 0 {
+		return fmt.Errorf("%w: remove it, signing_keys are configured", ErrCSRFSecret)
+	}
+	log.Printf("%v: using it as signing key %q, move it to signing_keys", ErrCSRFSecret, csrfSecretKeyID)
+	config.SigningKeys = []SigningKey{{ID: csrfSecretKeyID, Secret: secret}}
+	config.CSRF.Secret = ""
+	return nil
+}
+
+// CSRFTokenResponse is the answer to GET /csrf
+type CSRFTokenResponse struct {
+	Token string `json:"token"`
+}
+
+// newCSRFToken returns a random value, the ID of the key it was signed with and the signature
+func (m *Manager) newCSRFToken() string {
+	value := make([]byte, 16)
+	rand.Read(value)
+	nonce := hex.EncodeToString(value)
+	keyID, signature := m.sign(csrfCookieName + ":" + nonce)
+	return nonce + "." + keyID + "." + signature
+}
+
+// validCSRF returns true if the token matches the cookie and was signed by the server
+func (m *Manager) validCSRF(r *http.Request, token string) bool {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || token == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+		return false
+	}
+	parts := strings.Split(token, ".")
+	return len(parts) == 3 && m.verifySignature(csrfCookieName+":"+parts[0], parts[1], parts[2])
+}
+
+// csrfHandler sets the token cookie and returns the token for the header
+func (m *Manager) csrfHandler(w http.ResponseWriter, r *http.Request) {
+	config := m.config().CSRF
+	if !config.Enabled {
+		http.Error(w, "csrf is disabled", http.StatusNotFound)
+		return
+	}
+
+	token := m.newCSRFToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     m.basePath() + "/",
+		MaxAge:   int(csrfCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   config.Secure || r.TLS != nil,
+		SameSite: csrfSameSite(config.SameSite),
+	})
+	writeJSON(w, http.StatusOK, CSRFTokenResponse{Token: token})
+}
+
+// csrfSameSite returns the SameSite mode of the cookie, strict unless lax or none is configured.
+// Frontends on another site need none, which browsers only accept along with secure
+func csrfSameSite(mode string) http.SameSite {
+	switch strings.ToLower(mode) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteStrictMode
+	}
+}
+
+// requireCSRF only lets state changing requests through that carry the token, if csrf is enabled
+func (m *Manager) requireCSRF(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next(w, r)
+			return
+		}
+		if m.config().CSRF.Enabled && !m.validCSRF(r, r.Header.Get(csrfHeader)) {
+			log.Printf("rejected %s %s: %v", r.Method, r.URL.Path, ErrCSRFToken)
+			http.Error(w, ErrCSRFToken.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// checkUpgradeCSRF returns false if the upgrade comes from a browser without the token
+func (m *Manager) checkUpgradeCSRF(r *http.Request) bool {
+	if !m.config().CSRF.Enabled || r.Header.Get("Origin") == "" {
+		return true
+	}
+	return m.validCSRF(r, r.URL.Query().Get(csrfParam))
+}
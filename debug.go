@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+)
+
+// clientDebugInfo describes the state of a single client for the runtime endpoint
+type clientDebugInfo struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Room     string `json:"room"`
+	// EgressDepth is how many events are waiting to be written, a full egress drops events
+	EgressDepth   int `json:"egress_depth"`
+	PriorityDepth int `json:"priority_depth"`
+	// QueuedBytes is the size of the events waiting on both queues
+	QueuedBytes int64 `json:"queued_bytes"`
+	// Dropped counts the events dropped because a queue was full
+	Dropped uint64 `json:"dropped"`
+	// Coalesced counts the ephemeral events replaced by a newer one while queued
+	Coalesced uint64 `json:"coalesced"`
+	// Oversized counts the events dropped for being larger than the client takes, see capabilities.go
+	Oversized uint64 `json:"oversized"`
+	// Slow is set while the client is over a slow consumer threshold
+	Slow     bool   `json:"slow"`
+	Warnings uint64 `json:"slow_consumer_warnings"`
+	// LastWrite and AvgWrite are how long writing a frame to the client took
+	LastWrite Duration `json:"last_write"`
+	AvgWrite  Duration `json:"avg_write"`
+	// IdleFor is how long ago the client last sent an event
+	IdleFor Duration `json:"idle_for"`
+	// RTT is the rolling estimate of the round trip time, RTTVariance how much it varies
+	RTT         Duration `json:"rtt"`
+	RTTVariance Duration `json:"rtt_variance"`
+}
+
+// runtimeDebugInfo is returned by the runtime endpoint
+type runtimeDebugInfo struct {
+	Goroutines     int                          `json:"goroutines"`
+	Clients        []clientDebugInfo            `json:"clients"`
+	HandlerLatency map[string]HistogramSnapshot `json:"handler_latency_seconds"`
+	// HandlerSLO is how each event type does against the handler latency objective, see slo.go
+	HandlerSLO map[string]handlerSLOStats `json:"handler_slo"`
+	// WriteLatency is how long writing a frame to a client took, for all clients
+	WriteLatency HistogramSnapshot `json:"write_latency_seconds"`
+	// RTT is the round trip time of the pings, for all clients
+	RTT HistogramSnapshot `json:"rtt_seconds"`
+	// SlowConsumerWarnings counts the slow_consumer events sent since the start
+	SlowConsumerWarnings uint64 `json:"slow_consumer_warnings"`
+	// LoginThrottle counts the failed, throttled and locked out logins, see bruteforce.go
+	LoginThrottle loginThrottleStats `json:"login_throttle"`
+	// MemoryBudget is how many bytes are queued for clients and the actions taken to stay in budget
+	MemoryBudget memoryBudgetStats `json:"memory_budget"`
+	// HistoryCache is how many rooms are cached and how often the cache had a room, see historycache.go
+	HistoryCache historyCacheStats `json:"history_cache"`
+	// WorkerPools are the handler worker pools keyed by event type, empty if handlers run inline
+	WorkerPools map[string]workerPoolStats `json:"worker_pools,omitempty"`
+}
+
+// registerDebugHandlers adds pprof and the runtime introspection endpoint to the mux,
+// all of them behind the admin token
+func (m *Manager) registerDebugHandlers(mux routes) {
+	mux.HandleFunc("/admin/debug/pprof/", m.requireAdminToken(pprofIndex))
+	mux.HandleFunc("/admin/debug/pprof/cmdline", m.requireAdminToken(pprof.Cmdline))
+	mux.HandleFunc("/admin/debug/pprof/profile", m.requireAdminToken(pprof.Profile))
+	mux.HandleFunc("/admin/debug/pprof/symbol", m.requireAdminToken(pprof.Symbol))
+	mux.HandleFunc("/admin/debug/pprof/trace", m.requireAdminToken(pprof.Trace))
+	mux.HandleFunc("GET /admin/debug/runtime", m.requireAdminToken(m.runtimeDebugHandler))
+	mux.HandleFunc("GET /admin/metrics", m.requireAdminToken(m.metricsHandler))
+}
+
+// pprofIndex serves the pprof index and named profiles, pprof.Index expects them
+// under /debug/pprof/ so the prefix, and the base path before it, is rewritten
+func pprofIndex(w http.ResponseWriter, r *http.Request) {
+	r2 := r.Clone(r.Context())
+	_, name, _ := strings.Cut(r.URL.Path, "/admin/debug/pprof/")
+	r2.URL.Path = "/debug/pprof/" + name
+	pprof.Index(w, r2)
+}
+
+// runtimeDebugHandler dumps goroutine counts, queue depths and handler latencies
+func (m *Manager) runtimeDebugHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.runtimeDebugInfo())
+}
+
+// runtimeDebugInfo collects the runtime state of the server
+func (m *Manager) runtimeDebugInfo() runtimeDebugInfo {
+	info := runtimeDebugInfo{
+		Goroutines:     runtime.NumGoroutine(),
+		Clients:        []clientDebugInfo{},
+		HandlerLatency: m.handlerLatency.Snapshot(),
+		HandlerSLO:     m.handlerSLOStats(),
+		WriteLatency:   m.writeLatency.Snapshot(),
+		RTT:            m.rttLatency.Snapshot(),
+
+		SlowConsumerWarnings: m.slowConsumers.Load(),
+		LoginThrottle:        m.loginThrottle.stats(),
+		MemoryBudget:         m.memoryBudgetStats(),
+		HistoryCache:         m.historyCacheStats(),
+	}
+	if m.handlerPools != nil {
+		info.WorkerPools = m.handlerPools.stats()
+	}
+
+	m.RLock()
+	for client := range m.clients {
+		info.Clients = append(info.Clients, client.debugInfo())
+	}
+	m.RUnlock()
+
+	return info
+}
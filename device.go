@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Every browser or app a user connects from is a device with an ID that stays the
+// same across connections. The server assigns it on the first connect and sends
+// it in the welcome event, the client keeps it and connects with ?device=<id> from
+// then on. Users can list their devices and revoke one, which disconnects it and
+// drops its push tokens and resumable session, like logging out a lost phone.
+
+const (
+	// EventListDevices is sent by a client to list the devices of its user
+	EventListDevices = "list_devices"
+	// EventDeviceList is the response to list_devices
+	EventDeviceList = "device_list"
+	// EventRevokeDevice is sent by a client to log out a device of its user
+	EventRevokeDevice = "revoke_device"
+	// EventDeviceRevoked is sent to all clients of the user once a device is revoked
+	EventDeviceRevoked = "device_revoked"
+)
+
+var (
+	ErrNoDevice = errors.New("client has no device")
+)
+
+var (
+	// maxDevicesPerUser is how many devices are kept per user, the least recently
+	// seen one is forgotten beyond it
+	maxDevicesPerUser = 50
+	// maxDeviceNameLength is the longest device name in bytes
+	maxDeviceNameLength = 64
+)
+
+// DeviceInfo is a device of the user as listed to its clients
+type DeviceInfo struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name,omitempty"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen"`
+	// Connected is how many clients are connected from the device
+	Connected int `json:"connected"`
+	// Current is set for the device of the client asking
+	Current bool `json:"current,omitempty"`
+}
+
+// DeviceListEvent is the payload sent in the
+// device_list event
+type DeviceListEvent struct {
+	Devices []DeviceInfo `json:"devices"`
+}
+
+// RevokeDeviceEvent is the payload sent in the
+// revoke_device event
+type RevokeDeviceEvent struct {
+	DeviceID string `json:"device_id"`
+}
+
+// DeviceRevokedEvent is the payload sent in the
+// device_revoked event
+type DeviceRevokedEvent struct {
+	DeviceID string `json:"device_id"`
+}
+
+// registerDevice returns the device of the user with the id, updating when it was
+// last seen. Unknown ids get a new device, so a client can't pick its own id
+func (m *Manager) registerDevice(username, id, name string) (Device, error) {
+	if len(name) > maxDeviceNameLength {
+		name = name[:maxDeviceNameLength]
+	}
+
+	devices, err := m.store.ListDevices(username)
+	if err != nil {
+		return Device{}, err
+	}
+
+	now := m.now()
+	for _, device := range devices {
+		if id == "" || device.ID != id {
+			continue
+		}
+		device.LastSeen = now
+		if name != "" {
+			device.Name = name
+		}
+		return device, m.store.SaveDevice(device)
+	}
+
+	// Make room for the new device by forgetting the least recently seen ones
+	for len(devices) >= maxDevicesPerUser {
+		oldest := 0
+		for i, device := range devices {
+			if device.LastSeen.Before(devices[oldest].LastSeen) {
+				oldest = i
+			}
+		}
+		if err := m.store.DeleteDevice(username, devices[oldest].ID); err != nil && !errors.Is(err, ErrNotFound) {
+			return Device{}, err
+		}
+		devices = append(devices[:oldest], devices[oldest+1:]...)
+	}
+
+	device := Device{Username: username, ID: m.newID(), Name: name, Created: now, LastSeen: now}
+	return device, m.store.SaveDevice(device)
+}
+
+// ListDevicesHandler answers with the devices of the user
+func ListDevicesHandler(event Event, c *Client) error {
+	m := c.manager
+	devices, err := m.store.ListDevices(c.username)
+	if err != nil {
+		return err
+	}
+
+	connected := make(map[string]int)
+	m.RLock()
+	for client := range m.clients {
+		if client.username == c.username && client.deviceID != "" {
+			connected[client.deviceID]++
+		}
+	}
+	m.RUnlock()
+
+	list := DeviceListEvent{Devices: []DeviceInfo{}}
+	for _, device := range devices {
+		list.Devices = append(list.Devices, DeviceInfo{
+			ID:        device.ID,
+			Name:      device.Name,
+			Created:   device.Created,
+			LastSeen:  device.LastSeen,
+			Connected: connected[device.ID],
+			Current:   device.ID == c.deviceID,
+		})
+	}
+	return m.replyJSON(c, EventDeviceList, list)
+}
+
+// RevokeDeviceHandler logs out a device of the user
+func RevokeDeviceHandler(event Event, c *Client) error {
+	var revoke RevokeDeviceEvent
+	if err := json.Unmarshal(event.Payload, &revoke); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	// Clients of API keys act for a service, not a person with devices
+	if c.apiKey != nil {
+		return ErrNoDevice
+	}
+	return c.manager.revokeDevice(c.username, revoke.DeviceID, c.username)
+}
+
+// revokeDevice forgets the device of the user and disconnects its clients, its push
+// tokens and resumable session are dropped as well
+func (m *Manager) revokeDevice(username, id, actor string) error {
+	// The push tokens go first, so a failure leaves the device to be revoked again
+	if err := m.store.DeletePushTokens(username, id); err != nil {
+		return err
+	}
+	if err := m.store.DeleteDevice(username, id); err != nil {
+		return err
+	}
+	m.dropQoSSession(username, id)
+
+	var revoked []*Client
+	m.RLock()
+	for client := range m.clients {
+		if client.username == username && client.deviceID == id {
+			revoked = append(revoked, client)
+		}
+	}
+	m.RUnlock()
+	for _, client := range revoked {
+		m.removeClient(client)
+	}
+
+	m.audit(AuditEntry{
+		Action:  AuditDeviceRevoked,
+		Actor:   actor,
+		Target:  username,
+		Details: map[string]string{"device_id": id, "disconnected": fmt.Sprint(len(revoked))},
+	})
+
+	data, err := json.Marshal(DeviceRevokedEvent{DeviceID: id})
+	if err != nil {
+		return fmt.Errorf("failed to marshal device_revoked: %v", err)
+	}
+	m.sendToUser(username, Event{Type: EventDeviceRevoked, Payload: data})
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// In a cluster the recipient of a direct message or a mention may be connected
+// to another instance than the sender. The instances the user has clients on are
+// looked up in the presence the instances share, the clients replicated by Raft,
+// see raft.go, and the users in the gossip digests, see gossip.go. The event is
+// sent to each of them over the backplane on POST /cluster/users/{username}/deliver,
+// which answers with how many clients it was queued for and whether the user is
+// still connected there. Only when the user is connected nowhere, here or on an
+// instance that was asked, the offline notification is sent. So a user who
+// disconnected since the presence was last shared still gets it, and one
+// reachable on some instance doesn't get a push on top.
+
+// userDelivered is the response to an event sent to the clients of a user
+type userDelivered struct {
+	// Delivered is how many clients the event was queued for
+	Delivered int `json:"delivered"`
+	// Connected is false if the user has no clients on the instance anymore
+	Connected bool `json:"connected"`
+}
+
+// remoteUserNodes returns the URLs of the routes of the other instances the user
+// has clients on, by node id
+func (m *Manager) remoteUserNodes(username string) map[string]string {
+	nodes := make(map[string]string)
+	if m.cluster == nil {
+		return nodes
+	}
+
+	if m.raft != nil {
+		m.raft.remoteMembers(m.cluster.self, m.now(), m.raftPresenceTTL(), func(state raftNodeState, member raftMember) {
+			if member.Username != username {
+				return
+			}
+			if _, ok := nodes[state.Node]; ok {
+				return
+			}
+			if peer, ok := m.cluster.peerURL(state.Node); ok {
+				nodes[state.Node] = peer
+			} else if peer, err := m.raftPeerURL(state.Address); err == nil {
+				nodes[state.Node] = peer
+			}
+		})
+	}
+
+	if m.gossip != nil {
+		timeout := time.Duration(m.config().Cluster.FailureTimeout)
+		now := m.now()
+		for _, member := range m.gossip.list() {
+			if member.ID == m.cluster.self || now.Sub(member.updated) > timeout {
+				continue
+			}
+			if _, found := slices.BinarySearch(member.Digest.Users, username); found {
+				nodes[member.ID] = member.URL
+			}
+		}
+	}
+	return nodes
+}
+
+// remoteUserConnected returns true if the user has clients on other instances, as
+// far as the shared presence knows
+func (m *Manager) remoteUserConnected(username string) bool {
+	return len(m.remoteUserNodes(username)) > 0
+}
+
+// sendToLocalUser sends the event to the clients of the user on this instance, it
+// returns how many it was queued for and false if the user has none
+func (m *Manager) sendToLocalUser(username string, event Event) (int, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	delivered, connected := 0, false
+	for client := range m.clients {
+		if client.username != username {
+			continue
+		}
+		connected = true
+		if client.send(event) {
+			delivered++
+		}
+	}
+	return delivered, connected
+}
+
+// deliverToUser sends the event to all clients of the user, on this instance and
+// the others the user has clients on, it returns how many it was queued for and
+// false if the user is connected nowhere
+func (m *Manager) deliverToUser(username string, event Event) (int, bool) {
+	delivered, connected := m.sendToLocalUser(username, event)
+
+	nodes := m.remoteUserNodes(username)
+	if len(nodes) == 0 {
+		return delivered, connected
+	}
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for node, peer := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var resp userDelivered
+			target := peer + "/cluster/users/" + url.PathEscape(username) + "/deliver"
+			if err := m.cluster.requestURL(context.Background(), target, http.MethodPost, event, &resp); err != nil {
+				log.Printf("cluster: sending %s to %s on %s: %v", event.Type, username, node, err)
+				return
+			}
+			mu.Lock()
+			delivered += resp.Delivered
+			connected = connected || resp.Connected
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return delivered, connected
+}
+
+// clusterUserDeliverHandler sends an event routed by another instance to the
+// clients of the user here
+func (m *Manager) clusterUserDeliverHandler(w http.ResponseWriter, r *http.Request) {
+	if m.cluster == nil {
+		http.Error(w, "not clustered", http.StatusNotFound)
+		return
+	}
+	var event Event
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	delivered, connected := m.sendToLocalUser(r.PathValue("username"), event)
+	writeJSON(w, http.StatusOK, userDelivered{Delivered: delivered, Connected: connected})
+}
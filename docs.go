@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Collaborative editors keep their documents as CRDTs, like Yjs or Automerge, which
+// merge the changes of everyone without a server deciding the order. The server
+// only relays and keeps the binary updates, it never looks into them. It is off
+// unless docs.enabled is set in the config.
+//
+// A client in a room sends open_doc with the name of a document of the room and
+// gets doc_opened with the snapshot of the document and the updates since, which
+// it applies to an empty document. Its doc_update events are numbered, stored and
+// sent as doc_updated to everyone who opened the document, the sender included so
+// it learns the number. Binary data is base64 in JSON. Updates are larger than
+// the 1KB other events are limited to, so document events may be up to
+// docs.max_message_size.
+//
+// Awareness, the cursors and selections of the other editors, is relayed with
+// doc_awareness but not stored. The server keeps the latest state of each client
+// for those opening the document later, until the client doesn't renew it for
+// docs.awareness_timeout, then the others get a null state for it.
+//
+// Updates pile up, so once a document collected docs.compact_after updates since
+// its snapshot the client whose update went over it is sent compact_doc with the
+// number of the latest update. It answers with doc_snapshot, the state merging
+// everything up to that number, like Y.encodeStateAsUpdate, which replaces the
+// snapshot and the updates it merged in the store.
+//
+// Documents are deleted with their room. Like the state of state sync, the
+// numbering is done by the instance, so in a cluster the editors of a document
+// have to be on the same instance.
+
+const (
+	// EventOpenDoc is sent by a client to get a document and its updates
+	EventOpenDoc = "open_doc"
+	// EventDocOpened is the response to open_doc
+	EventDocOpened = "doc_opened"
+	// EventCloseDoc stops the updates of a document
+	EventCloseDoc = "close_doc"
+	// EventDocUpdate is sent by a client with an update of a document
+	EventDocUpdate = "doc_update"
+	// EventDocUpdated is sent to the clients that opened the document
+	EventDocUpdated = "doc_updated"
+	// EventDocAwareness carries the awareness state of a client both ways
+	EventDocAwareness = "doc_awareness"
+	// EventCompactDoc asks a client for a snapshot of a document
+	EventCompactDoc = "compact_doc"
+	// EventDocSnapshot is the answer to compact_doc
+	EventDocSnapshot = "doc_snapshot"
+)
+
+var (
+	ErrDocsDisabled   = errors.New("documents are not enabled")
+	ErrInvalidDoc     = errors.New("invalid document name")
+	ErrDocNotOpen     = errors.New("document is not open")
+	ErrInvalidDocSeq  = errors.New("invalid sequence number for the document")
+	ErrEmptyDocUpdate = errors.New("empty document update")
+)
+
+// maxDocNameLength is the longest name of a document in bytes
+const maxDocNameLength = 128
+
+// docEvents are the events that may be larger than maxMessageSize
+var docEvents = map[string]bool{
+	EventOpenDoc:      true,
+	EventCloseDoc:     true,
+	EventDocUpdate:    true,
+	EventDocAwareness: true,
+	EventDocSnapshot:  true,
+}
+
+// docKey is a document of a room
+type docKey struct {
+	room string
+	doc  string
+}
+
+// docAwarenessKey is the awareness of a client in a document
+type docAwarenessKey struct {
+	docKey
+	client string
+}
+
+// docSession is a document opened since the start, sessions are kept until their
+// room is closed so the numbering is never started over
+type docSession struct {
+	sync.Mutex
+	// seq is the number of the latest update, snapshotSeq the one merged into the snapshot
+	seq         uint64
+	snapshotSeq uint64
+	loaded      bool
+	// compactSeq is the number a snapshot was asked for, 0 if none is pending
+	compactSeq  uint64
+	subscribers map[*Client]bool
+	// awareness is the latest awareness state of each client
+	awareness map[*Client]json.RawMessage
+}
+
+// OpenDocEvent is the payload of the open_doc and close_doc events
+type OpenDocEvent struct {
+	Doc string `json:"doc"`
+}
+
+// DocUpdateEvent is the payload of the doc_update event
+type DocUpdateEvent struct {
+	Doc    string `json:"doc"`
+	Update []byte `json:"update"`
+}
+
+// DocUpdatedEvent is the payload of the doc_updated event and the updates in doc_opened
+type DocUpdatedEvent struct {
+	Room   string    `json:"room,omitempty"`
+	Doc    string    `json:"doc,omitempty"`
+	Seq    uint64    `json:"seq"`
+	Update []byte    `json:"update"`
+	From   string    `json:"from"`
+	Sent   time.Time `json:"sent"`
+}
+
+// DocAwarenessEvent is the payload of the doc_awareness event, a null state
+// removes the awareness of the client
+type DocAwarenessEvent struct {
+	Room string `json:"room,omitempty"`
+	Doc  string `json:"doc"`
+	// Client is the id of the client, set by the server
+	Client string          `json:"client,omitempty"`
+	From   string          `json:"from,omitempty"`
+	State  json.RawMessage `json:"state"`
+}
+
+// DocOpenedEvent is the payload of the doc_opened event
+type DocOpenedEvent struct {
+	Room string `json:"room"`
+	Doc  string `json:"doc"`
+	// Snapshot merges the updates up to SnapshotSeq, empty for a document without one
+	Snapshot    []byte            `json:"snapshot,omitempty"`
+	SnapshotSeq uint64            `json:"snapshot_seq"`
+	Updates     []DocUpdatedEvent `json:"updates"`
+	// Seq is the number of the latest update
+	Seq       uint64              `json:"seq"`
+	Awareness []DocAwarenessEvent `json:"awareness"`
+}
+
+// CompactDocEvent is the payload of the compact_doc event
+type CompactDocEvent struct {
+	Room string `json:"room"`
+	Doc  string `json:"doc"`
+	// Seq is the number of the latest update the snapshot has to merge
+	Seq uint64 `json:"seq"`
+}
+
+// DocSnapshotEvent is the payload of the doc_snapshot event
+type DocSnapshotEvent struct {
+	Doc   string `json:"doc"`
+	Seq   uint64 `json:"seq"`
+	State []byte `json:"state"`
+}
+
+// validateDocName checks the name of a document
+func validateDocName(doc string) error {
+	if doc == "" {
+		return ErrInvalidDoc
+	}
+	if len(doc) > maxDocNameLength {
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidDoc, maxDocNameLength)
+	}
+	return nil
+}
+
+// docSession returns the session of the document, created if it isn't open
+func (m *Manager) docSession(key docKey) *docSession {
+	m.docsLock.Lock()
+	defer m.docsLock.Unlock()
+	s, ok := m.docs[key]
+	if !ok {
+		s = &docSession{subscribers: make(map[*Client]bool), awareness: make(map[*Client]json.RawMessage)}
+		m.docs[key] = s
+	}
+	return s
+}
+
+// openDoc subscribes the client to the document and sends it the document
+func (m *Manager) openDoc(c *Client, key docKey) error {
+	s := m.docSession(key)
+	s.Lock()
+	defer s.Unlock()
+
+	// Loading under the lock of the document keeps updates from being numbered meanwhile
+	snapshot, updates, err := m.store.LoadDoc(key.room, key.doc)
+	if err != nil {
+		return fmt.Errorf("loading document %s: %w", key.doc, err)
+	}
+
+	opened := DocOpenedEvent{Room: key.room, Doc: key.doc, Snapshot: snapshot.State, SnapshotSeq: snapshot.Seq, Awareness: []DocAwarenessEvent{}}
+	for _, update := range updates {
+		opened.Updates = append(opened.Updates, DocUpdatedEvent{Seq: update.Seq, Update: update.Update, From: update.From, Sent: update.Sent})
+	}
+	if opened.Updates == nil {
+		opened.Updates = []DocUpdatedEvent{}
+	}
+	opened.Seq = snapshot.Seq
+	if len(updates) > 0 {
+		opened.Seq = updates[len(updates)-1].Seq
+	}
+	if !s.loaded {
+		s.seq, s.snapshotSeq, s.loaded = opened.Seq, snapshot.Seq, true
+	}
+	for client, state := range s.awareness {
+		opened.Awareness = append(opened.Awareness, DocAwarenessEvent{Client: client.id, From: client.username, State: state})
+	}
+	s.subscribers[c] = true
+	return m.replyJSON(c, EventDocOpened, opened)
+}
+
+// closeDoc unsubscribes the client from the document and removes its awareness
+func (m *Manager) closeDoc(c *Client, key docKey) {
+	s := m.docSession(key)
+	s.Lock()
+	delete(s.subscribers, c)
+	_, aware := s.awareness[c]
+	s.Unlock()
+	if aware {
+		m.docAwareness.Delete(docAwarenessKey{docKey: key, client: c.id})
+		m.setDocAwareness(key, c, nil)
+	}
+}
+
+// sendToDoc sends the event to the clients that opened the document, except one
+// Only call it while holding the lock of the session
+func (m *Manager) sendToDoc(s *docSession, key docKey, event Event, except *Client) {
+	m.RLock()
+	defer m.RUnlock()
+	for client := range s.subscribers {
+		// Clients that left the room or disconnected closed the document
+		if _, ok := m.clients[client]; !ok || client.room != key.room {
+			delete(s.subscribers, client)
+			continue
+		}
+		if client != except {
+			client.send(event)
+		}
+	}
+}
+
+// updateDoc numbers and stores the update and sends it to the clients that opened
+// the document, the sender is asked for a snapshot if the document needs one
+func (m *Manager) updateDoc(c *Client, key docKey, data []byte) error {
+	if len(data) == 0 {
+		return ErrEmptyDocUpdate
+	}
+	s := m.docSession(key)
+	s.Lock()
+	defer s.Unlock()
+	if !s.subscribers[c] {
+		return fmt.Errorf("%w: %s", ErrDocNotOpen, key.doc)
+	}
+
+	update := DocUpdate{Room: key.room, Doc: key.doc, Seq: s.seq + 1, Update: data, From: c.username, Sent: m.now()}
+	// The store is written under the lock of the document so the updates are stored in order
+	if err := m.store.AppendDocUpdate(update); err != nil {
+		return fmt.Errorf("storing update %d of document %s: %w", update.Seq, key.doc, err)
+	}
+	s.seq = update.Seq
+
+	payload, err := json.Marshal(DocUpdatedEvent{Room: key.room, Doc: key.doc, Seq: update.Seq, Update: data, From: c.username, Sent: update.Sent})
+	if err != nil {
+		return err
+	}
+	m.sendToDoc(s, key, Event{Type: EventDocUpdated, Payload: payload}, nil)
+
+	// A pending request is asked again of someone else once as many updates came in
+	compactAfter := uint64(max(m.config().Docs.CompactAfter, 1))
+	if s.seq-s.snapshotSeq < compactAfter || (s.compactSeq != 0 && s.seq-s.compactSeq < compactAfter) {
+		return nil
+	}
+	s.compactSeq = s.seq
+	data, err = json.Marshal(CompactDocEvent{Room: key.room, Doc: key.doc, Seq: s.seq})
+	if err != nil {
+		return err
+	}
+	m.sendToClient(c, Event{Type: EventCompactDoc, Payload: data})
+	return nil
+}
+
+// compactDoc replaces the snapshot of the document with the one sent by the client
+func (m *Manager) compactDoc(c *Client, key docKey, snapshot DocSnapshotEvent) error {
+	s := m.docSession(key)
+	s.Lock()
+	defer s.Unlock()
+	if !s.subscribers[c] {
+		return fmt.Errorf("%w: %s", ErrDocNotOpen, key.doc)
+	}
+	if snapshot.Seq <= s.snapshotSeq || snapshot.Seq > s.seq {
+		return fmt.Errorf("%w: %d is not between %d and %d", ErrInvalidDocSeq, snapshot.Seq, s.snapshotSeq+1, s.seq)
+	}
+
+	err := m.store.CompactDoc(DocSnapshot{Room: key.room, Doc: key.doc, Seq: snapshot.Seq, State: snapshot.State, From: c.username, Saved: m.now()})
+	if err != nil {
+		return fmt.Errorf("storing snapshot %d of document %s: %w", snapshot.Seq, key.doc, err)
+	}
+	s.snapshotSeq = snapshot.Seq
+	if s.compactSeq <= snapshot.Seq {
+		s.compactSeq = 0
+	}
+	log.Printf("compacted document %s of room %s up to update %d", key.doc, key.room, snapshot.Seq)
+	return nil
+}
+
+// setDocAwareness keeps the awareness state of the client and sends it to the
+// others, a nil state removes it
+func (m *Manager) setDocAwareness(key docKey, c *Client, state json.RawMessage) {
+	s := m.docSession(key)
+	s.Lock()
+	defer s.Unlock()
+	if state == nil {
+		if _, ok := s.awareness[c]; !ok {
+			return
+		}
+		delete(s.awareness, c)
+	} else {
+		s.awareness[c] = state
+	}
+
+	if state == nil {
+		state = json.RawMessage("null")
+	}
+	data, err := json.Marshal(DocAwarenessEvent{Room: key.room, Doc: key.doc, Client: c.id, From: c.username, State: state})
+	if err != nil {
+		log.Println("failed to marshal doc_awareness: ", err)
+		return
+	}
+	m.sendToDoc(s, key, Event{Type: EventDocAwareness, Payload: data}, c)
+}
+
+// docAwarenessExpired removes the awareness of a client that didn't renew it
+func (m *Manager) docAwarenessExpired(key docAwarenessKey, c *Client) {
+	m.setDocAwareness(key.docKey, c, nil)
+}
+
+// dropRoomDocs forgets the open documents of a room that was closed, the store
+// deletes them with the room
+func (m *Manager) dropRoomDocs(room string) {
+	m.docsLock.Lock()
+	defer m.docsLock.Unlock()
+	for key := range m.docs {
+		if key.room == room {
+			delete(m.docs, key)
+		}
+	}
+}
+
+// docKeyOf returns the document of the room of the client, checking that documents are enabled
+func (m *Manager) docKeyOf(c *Client, doc string) (docKey, error) {
+	if !m.config().Docs.Enabled {
+		return docKey{}, ErrDocsDisabled
+	}
+	if err := validateDocName(doc); err != nil {
+		return docKey{}, err
+	}
+	return docKey{room: m.roomOf(c), doc: doc}, nil
+}
+
+// OpenDocHandler sends a document to the client and subscribes it to the updates
+func OpenDocHandler(event Event, c *Client) error {
+	var open OpenDocEvent
+	if err := json.Unmarshal(event.Payload, &open); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	key, err := c.manager.docKeyOf(c, open.Doc)
+	if err != nil {
+		return err
+	}
+	return c.manager.openDoc(c, key)
+}
+
+// CloseDocHandler stops sending the updates of a document to the client
+func CloseDocHandler(event Event, c *Client) error {
+	var closing OpenDocEvent
+	if err := json.Unmarshal(event.Payload, &closing); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	key, err := c.manager.docKeyOf(c, closing.Doc)
+	if err != nil {
+		return err
+	}
+	c.manager.closeDoc(c, key)
+	return nil
+}
+
+// DocUpdateHandler stores an update of a document and relays it
+func DocUpdateHandler(event Event, c *Client) error {
+	var update DocUpdateEvent
+	if err := json.Unmarshal(event.Payload, &update); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	key, err := c.manager.docKeyOf(c, update.Doc)
+	if err != nil {
+		return err
+	}
+	return c.manager.updateDoc(c, key, update.Update)
+}
+
+// DocAwarenessHandler relays the awareness state of the client to the others
+// editing the document
+func DocAwarenessHandler(event Event, c *Client) error {
+	var awareness DocAwarenessEvent
+	if err := json.Unmarshal(event.Payload, &awareness); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	m := c.manager
+	key, err := m.docKeyOf(c, awareness.Doc)
+	if err != nil {
+		return err
+	}
+
+	s := m.docSession(key)
+	s.Lock()
+	open := s.subscribers[c]
+	s.Unlock()
+	if !open {
+		return fmt.Errorf("%w: %s", ErrDocNotOpen, key.doc)
+	}
+
+	awarenessKey := docAwarenessKey{docKey: key, client: c.id}
+	if len(awareness.State) == 0 || string(awareness.State) == "null" {
+		m.docAwareness.Delete(awarenessKey)
+		m.setDocAwareness(key, c, nil)
+		return nil
+	}
+	m.docAwareness.SetTTL(awarenessKey, c, time.Duration(m.config().Docs.AwarenessTimeout))
+	m.setDocAwareness(key, c, slices.Clone(awareness.State))
+	return nil
+}
+
+// DocSnapshotHandler stores the snapshot a client was asked for with compact_doc
+func DocSnapshotHandler(event Event, c *Client) error {
+	var snapshot DocSnapshotEvent
+	if err := json.Unmarshal(event.Payload, &snapshot); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	key, err := c.manager.docKeyOf(c, snapshot.Doc)
+	if err != nil {
+		return err
+	}
+	return c.manager.compactDoc(c, key, snapshot)
+}
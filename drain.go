@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Draining is used for rolling deploys. A draining server refuses new
+// connections, tells the connected clients to reconnect elsewhere and
+// reports once the last client is gone, so it can be stopped without
+// cutting anybody off.
+
+// EventServerDraining is sent to all clients when the server starts draining
+const EventServerDraining = "server_draining"
+
+// AuditDrain is recorded when an operator puts the server in drain mode
+const AuditDrain = "drain"
+
+// drainRetryAfter is how long clients are told to wait before connecting again
+var drainRetryAfter = 30 * time.Second
+
+// ServerDrainingEvent asks clients to reconnect, ideally to another instance
+type ServerDrainingEvent struct {
+	// RetryAfter is the number of seconds before this server takes connections again
+	RetryAfter int    `json:"retry_after"`
+	Message    string `json:"message"`
+	// Code identifies the message for translation, see localize.go
+	Code string `json:"code"`
+}
+
+// drainStatus is returned by the drain admin endpoints
+type drainStatus struct {
+	Draining bool `json:"draining"`
+	Clients  int  `json:"clients"`
+	// Drained is true once draining and the last client disconnected
+	Drained bool `json:"drained"`
+}
+
+// drain stops the server from accepting new connections and asks the connected
+// clients to leave, it is safe to call more than once
+// The returned channel is closed when no clients are connected anymore
+func (m *Manager) drain() <-chan struct{} {
+	if !m.draining.CompareAndSwap(false, true) {
+		return m.drained
+	}
+	log.Println("draining connections")
+
+	data, _ := json.Marshal(ServerDrainingEvent{
+		RetryAfter: int(drainRetryAfter.Seconds()),
+		Message:    m.localized("server_draining", nil),
+		Code:       "server_draining",
+	})
+	event := prepare(Event{Type: EventServerDraining, Payload: data})
+
+	m.RLock()
+	for client := range m.clients {
+		client.sendPriority(event)
+	}
+	empty := len(m.clients) == 0
+	m.RUnlock()
+
+	if empty {
+		m.markDrained()
+	}
+	return m.drained
+}
+
+// markDrained closes the drained channel once
+func (m *Manager) markDrained() {
+	m.drainedOnce.Do(func() {
+		log.Println("all clients drained")
+		close(m.drained)
+	})
+}
+
+// isDrained returns true when draining has finished
+func (m *Manager) isDrained() bool {
+	select {
+	case <-m.drained:
+		return true
+	default:
+		return false
+	}
+}
+
+// rejectDraining answers with 503 and returns true if the server is draining
+// Use it before upgrading a connection
+func (m *Manager) rejectDraining(w http.ResponseWriter) bool {
+	if !m.draining.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(drainRetryAfter.Seconds())))
+	http.Error(w, ErrDraining.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+// drainStatus returns the current drain state
+func (m *Manager) drainStatus() drainStatus {
+	m.RLock()
+	defer m.RUnlock()
+	return drainStatus{Draining: m.draining.Load(), Clients: len(m.clients), Drained: m.isDrained()}
+}
+
+// drainHandler puts the server in drain mode
+func (m *Manager) drainHandler(w http.ResponseWriter, r *http.Request) {
+	m.drain()
+	m.audit(AuditEntry{Action: AuditDrain, RemoteAddr: r.RemoteAddr})
+	writeJSON(w, http.StatusAccepted, m.drainStatus())
+}
+
+// drainStatusHandler reports the drain progress
+func (m *Manager) drainStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.drainStatus())
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"arti.soft/websockets-go/client"
+	"github.com/gorilla/websocket"
+)
+
+// The end to end tests run the server as main does, with all routes on a real HTTP
+// listener, and connect like a browser: login for an OTP, then the upgrade with it.
+// Run them with -race, the clients read and write concurrently like real ones.
+
+// e2eClients is how many clients the broadcast tests connect
+const e2eClients = 300
+
+// e2ePassword is the password of every user of the tests
+const e2ePassword = "correct horse battery staple"
+
+// e2eServer is a running server with its Manager
+type e2eServer struct {
+	*httptest.Server
+	manager *Manager
+}
+
+// startE2EServer starts the server with users user000 to user(n-1)
+func startE2EServer(t *testing.T, users int) *e2eServer {
+	t.Helper()
+	config := DefaultConfig()
+	config.Users = make(map[string]string, users)
+	for i := range users {
+		config.Users[e2eUser(i)] = e2ePassword
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mux := http.NewServeMux()
+	manager, err := setupAPI(ctx, config, mux)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+		cancel()
+		manager.store.Close()
+	})
+	return &e2eServer{Server: server, manager: manager}
+}
+
+func e2eUser(i int) string {
+	return fmt.Sprintf("user%03d", i)
+}
+
+// e2eConn is a websocket of a client that logged in
+type e2eConn struct {
+	ws *websocket.Conn
+}
+
+// connect logs the user in, upgrades with the OTP and reads the welcome
+func (s *e2eServer) connect(t *testing.T, username string) *e2eConn {
+	t.Helper()
+	otp, err := client.Login(t.Context(), s.URL, username, e2ePassword)
+	if err != nil {
+		t.Fatalf("login of %s: %v", username, err)
+	}
+	ws, _, err := websocket.DefaultDialer.DialContext(t.Context(), s.wsURL(otp), nil)
+	if err != nil {
+		t.Fatalf("upgrade of %s: %v", username, err)
+	}
+	c := &e2eConn{ws: ws}
+	t.Cleanup(func() { ws.Close() })
+	if _, err := c.expect(EventWelcome, nil); err != nil {
+		t.Fatalf("welcome of %s: %v", username, err)
+	}
+	return c
+}
+
+// wsURL is the URL of the websocket with the OTP
+func (s *e2eServer) wsURL(otp string) string {
+	return "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?otp=" + url.QueryEscape(otp)
+}
+
+// clients returns how many clients the server has, as /debug reports it
+func (s *e2eServer) clients(t *testing.T) int {
+	t.Helper()
+	resp, err := http.Get(s.URL + "/debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.Atoi(string(body))
+	if err != nil {
+		t.Fatalf("/debug answered %q", body)
+	}
+	return n
+}
+
+// waitForClients waits until the server has n clients
+func (s *e2eServer) waitForClients(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.clients(t) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("server has %d clients, want %d", s.clients(t), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// send sends an event
+func (c *e2eConn) send(eventType string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteJSON(Event{Type: eventType, Payload: data})
+}
+
+// expect reads events until one of the type arrives, others are skipped. The
+// payload is decoded into v unless it is nil
+func (c *e2eConn) expect(eventType string, v any) (Event, error) {
+	c.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var event Event
+		if err := c.ws.ReadJSON(&event); err != nil {
+			return Event{}, err
+		}
+		if event.Type != eventType {
+			continue
+		}
+		if v != nil {
+			if err := json.Unmarshal(event.Payload, v); err != nil {
+				return Event{}, err
+			}
+		}
+		return event, nil
+	}
+}
+
+// expectMessage reads until the message arrives
+func (c *e2eConn) expectMessage(message string) error {
+	for {
+		var received NewMessageEvent
+		if _, err := c.expect(EventNewMessage, &received); err != nil {
+			return err
+		}
+		if received.Message == message {
+			return nil
+		}
+	}
+}
+
+// connectAll connects the users concurrently, like clients arriving at once
+func (s *e2eServer) connectAll(t *testing.T, n int) []*e2eConn {
+	t.Helper()
+	conns := make([]*e2eConn, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conns[i] = s.connect(t, e2eUser(i))
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	return conns
+}
+
+// broadcast sends the message from the first client and checks that every client
+// gets it
+func broadcast(t *testing.T, conns []*e2eConn, message string) {
+	t.Helper()
+	if err := conns[0].send(EventSendMessage, SendMessageEvent{Message: message}); err != nil {
+		t.Fatal(err)
+	}
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.expectMessage(message)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatalf("broadcast of %q: %v", message, err)
+	}
+}
+
+func TestE2ELoginOTPUpgrade(t *testing.T) {
+	s := startE2EServer(t, 1)
+	c := s.connect(t, e2eUser(0))
+
+	var welcome WelcomeEvent
+	if err := c.send(EventHello, HelloEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.expect(EventWelcome, &welcome); err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Username != e2eUser(0) {
+		t.Errorf("welcome is for %q, want %q", welcome.Username, e2eUser(0))
+	}
+
+	if _, err := client.Login(t.Context(), s.URL, e2eUser(0), "wrong"); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("login with a wrong password: %v, want %v", err, client.ErrUnauthorized)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(s.wsURL("not-an-otp"), nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("upgrade without a valid OTP: %v", err)
+	}
+}
+
+func TestE2EOTPIsUsedOnce(t *testing.T) {
+	s := startE2EServer(t, 1)
+	otp, err := client.Login(t.Context(), s.URL, e2eUser(0), e2ePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(s.wsURL(otp), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if _, resp, err := websocket.DefaultDialer.Dial(s.wsURL(otp), nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("second upgrade with the same OTP: %v", err)
+	}
+}
+
+func TestE2EBroadcast(t *testing.T) {
+	s := startE2EServer(t, e2eClients)
+	conns := s.connectAll(t, e2eClients)
+	s.waitForClients(t, e2eClients)
+
+	for i := range 3 {
+		broadcast(t, conns, fmt.Sprintf("hello %d", i))
+	}
+}
+
+func TestE2EAbruptDisconnects(t *testing.T) {
+	s := startE2EServer(t, e2eClients)
+	conns := s.connectAll(t, e2eClients)
+
+	// Half of the clients vanish without a close frame, like a dropped network
+	var gone, staying []*e2eConn
+	for i, c := range conns {
+		if i%2 == 1 {
+			gone = append(gone, c)
+		} else {
+			staying = append(staying, c)
+		}
+	}
+	for _, c := range gone {
+		c.ws.NetConn().Close()
+	}
+	s.waitForClients(t, len(staying))
+
+	// The others don't notice
+	broadcast(t, staying, "still here")
+}
+
+func TestE2EShutdown(t *testing.T) {
+	s := startE2EServer(t, e2eClients)
+	conns := s.connectAll(t, e2eClients)
+
+	drained := s.manager.drain()
+	for _, c := range conns {
+		if _, err := c.expect(EventServerDraining, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A draining server takes no new connections
+	otp, err := client.Login(t.Context(), s.URL, e2eUser(0), e2ePassword)
+	if err == nil {
+		if _, resp, err := websocket.DefaultDialer.Dial(s.wsURL(otp), nil); err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("upgrade while draining: %v", err)
+		}
+	}
+
+	// The clients leave as asked, with a normal close
+	for _, c := range conns {
+		c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not drained, %d clients left", s.clients(t))
+	}
+
+	// The clients got their close echoed and the server stops with nobody connected
+	for _, c := range conns {
+		if _, _, err := c.ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Fatalf("closing: %v", err)
+		}
+	}
+	// The logins at once dialed more connections than they used, the spare ones sent
+	// no request and Shutdown would wait for them as new
+	http.DefaultClient.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Config.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// End-to-end encrypted clients encrypt on the device, the server never sees the
+// plaintext. It only does what it can't avoid doing: every device publishes its
+// public keys in a bundle, other clients fetch the bundles of a user to set up a
+// session with each device, and the ciphertext is relayed without looking into it.
+//
+// The key format is up to the clients, a bundle matches the X3DH scheme: an
+// identity key, a signed prekey with its signature and one-time prekeys that are
+// handed out once each. Rooms flagged as E2EE refuse plaintext messages, so a
+// client can't leak a message in the clear by mistake, and as the server can't
+// read e2ee.message events no mentions, commands or notification previews apply.
+
+const (
+	// EventPublishKeys is sent by a device to publish or refresh its key bundle
+	EventPublishKeys = "e2ee.publish_keys"
+	// EventKeysPublished is the response to e2ee.publish_keys
+	EventKeysPublished = "e2ee.keys_published"
+	// EventFetchKeys is sent by a client to get the bundles of all devices of a user
+	EventFetchKeys = "e2ee.fetch_keys"
+	// EventKeyBundles is the response to e2ee.fetch_keys
+	EventKeyBundles = "e2ee.key_bundles"
+	// EventE2EESend is sent by a client with ciphertext for a room or user
+	EventE2EESend = "e2ee.send"
+	// EventE2EEMessage relays the ciphertext to the room or user
+	EventE2EEMessage = "e2ee.message"
+)
+
+var (
+	ErrInvalidKeyBundle = errors.New("invalid key bundle")
+	ErrTooManyDevices   = errors.New("too many devices with keys")
+	ErrE2EERoom         = errors.New("room is end-to-end encrypted, send e2ee.send events")
+	ErrInvalidE2EESend  = errors.New("e2ee.send needs ciphertext and either a room or a recipient")
+	ErrNotInRoom        = errors.New("not in the room")
+)
+
+var (
+	// maxKeyLength is the longest key in bytes, long enough for post-quantum keys in base64
+	maxKeyLength = 4096
+	// maxOneTimePrekeys is how many one-time prekeys are kept per device
+	maxOneTimePrekeys = 100
+	// maxKeyDevices is how many devices of a user can publish keys
+	maxKeyDevices = 16
+)
+
+// PublishKeysEvent is the payload sent in the
+// e2ee.publish_keys event
+type PublishKeysEvent struct {
+	DeviceID        string `json:"device_id"`
+	IdentityKey     string `json:"identity_key"`
+	SignedPrekey    string `json:"signed_prekey"`
+	PrekeySignature string `json:"prekey_signature"`
+	// OneTimePrekeys are added to the ones not handed out yet, unless the identity key changed
+	OneTimePrekeys []string `json:"one_time_prekeys,omitempty"`
+}
+
+// KeysPublishedEvent is the payload sent in the
+// e2ee.keys_published event
+type KeysPublishedEvent struct {
+	DeviceID string `json:"device_id"`
+	// OneTimePrekeys is how many one-time prekeys are left to hand out
+	OneTimePrekeys int `json:"one_time_prekeys"`
+}
+
+// FetchKeysEvent is the payload sent in the
+// e2ee.fetch_keys event
+type FetchKeysEvent struct {
+	Username string `json:"username"`
+}
+
+// DeviceKeys are the keys of one device as handed out to another client
+type DeviceKeys struct {
+	DeviceID        string `json:"device_id"`
+	IdentityKey     string `json:"identity_key"`
+	SignedPrekey    string `json:"signed_prekey"`
+	PrekeySignature string `json:"prekey_signature"`
+	// OneTimePrekey is empty once the device ran out of them
+	OneTimePrekey string `json:"one_time_prekey,omitempty"`
+}
+
+// KeyBundlesEvent is the payload sent in the
+// e2ee.key_bundles event
+type KeyBundlesEvent struct {
+	Username string       `json:"username"`
+	Devices  []DeviceKeys `json:"devices"`
+}
+
+// E2EESendEvent is the payload sent in the
+// e2ee.send event, either Room or To is set
+type E2EESendEvent struct {
+	Room string `json:"room,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Ciphertext is relayed as is, usually an object with a ciphertext per device
+	Ciphertext json.RawMessage `json:"ciphertext"`
+}
+
+// E2EEMessageEvent is the payload sent in the
+// e2ee.message event
+type E2EEMessageEvent struct {
+	// ID is set on room messages, so they can be reacted to like chat messages
+	ID         string          `json:"id,omitempty"`
+	From       string          `json:"from"`
+	Room       string          `json:"room,omitempty"`
+	To         string          `json:"to,omitempty"`
+	Ciphertext json.RawMessage `json:"ciphertext"`
+	Sent       time.Time       `json:"sent"`
+}
+
+// validateKeys returns an error if one of the keys is empty or too long
+func validateKeys(publish PublishKeysEvent) error {
+	if publish.DeviceID == "" || len(publish.DeviceID) > maxKeyLength {
+		return fmt.Errorf("%w: device_id is required", ErrInvalidKeyBundle)
+	}
+	for name, key := range map[string]string{
+		"identity_key":     publish.IdentityKey,
+		"signed_prekey":    publish.SignedPrekey,
+		"prekey_signature": publish.PrekeySignature,
+	} {
+		if key == "" || len(key) > maxKeyLength {
+			return fmt.Errorf("%w: %s must be 1 to %d bytes", ErrInvalidKeyBundle, name, maxKeyLength)
+		}
+	}
+	for _, key := range publish.OneTimePrekeys {
+		if key == "" || len(key) > maxKeyLength {
+			return fmt.Errorf("%w: one-time prekeys must be 1 to %d bytes", ErrInvalidKeyBundle, maxKeyLength)
+		}
+	}
+	return nil
+}
+
+// PublishKeysHandler stores the key bundle of a device of the user
+func PublishKeysHandler(event Event, c *Client) error {
+	var publish PublishKeysEvent
+	if err := json.Unmarshal(event.Payload, &publish); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if err := validateKeys(publish); err != nil {
+		return err
+	}
+
+	m := c.manager
+	// Publishing and fetching both rewrite the one-time prekeys of a bundle
+	m.keysLock.Lock()
+	bundles, err := m.store.ListKeyBundles(c.username)
+	if err != nil {
+		m.keysLock.Unlock()
+		return err
+	}
+
+	bundle := KeyBundle{Username: c.username, DeviceID: publish.DeviceID}
+	known := false
+	for _, existing := range bundles {
+		if existing.DeviceID == publish.DeviceID {
+			bundle, known = existing, true
+		}
+	}
+	if !known && len(bundles) >= maxKeyDevices {
+		m.keysLock.Unlock()
+		return fmt.Errorf("%w: at most %d", ErrTooManyDevices, maxKeyDevices)
+	}
+
+	// A new identity means a reinstalled device, the prekeys of the old one are useless
+	if bundle.IdentityKey != publish.IdentityKey {
+		bundle.OneTimePrekeys = nil
+	}
+	bundle.IdentityKey = publish.IdentityKey
+	bundle.SignedPrekey = publish.SignedPrekey
+	bundle.PrekeySignature = publish.PrekeySignature
+	bundle.OneTimePrekeys = append(bundle.OneTimePrekeys, publish.OneTimePrekeys...)
+	if len(bundle.OneTimePrekeys) > maxOneTimePrekeys {
+		bundle.OneTimePrekeys = bundle.OneTimePrekeys[len(bundle.OneTimePrekeys)-maxOneTimePrekeys:]
+	}
+	bundle.Updated = m.now()
+
+	err = m.store.SaveKeyBundle(bundle)
+	m.keysLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return m.replyJSON(c, EventKeysPublished, KeysPublishedEvent{DeviceID: bundle.DeviceID, OneTimePrekeys: len(bundle.OneTimePrekeys)})
+}
+
+// FetchKeysHandler answers with the keys of all devices of a user, handing out one
+// one-time prekey of each device
+func FetchKeysHandler(event Event, c *Client) error {
+	var fetch FetchKeysEvent
+	if err := json.Unmarshal(event.Payload, &fetch); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if err := validateUsername(fetch.Username); err != nil {
+		return err
+	}
+
+	m := c.manager
+	m.keysLock.Lock()
+	bundles, err := m.store.ListKeyBundles(fetch.Username)
+	if err != nil {
+		m.keysLock.Unlock()
+		return err
+	}
+
+	reply := KeyBundlesEvent{Username: fetch.Username, Devices: []DeviceKeys{}}
+	for _, bundle := range bundles {
+		keys := DeviceKeys{
+			DeviceID:        bundle.DeviceID,
+			IdentityKey:     bundle.IdentityKey,
+			SignedPrekey:    bundle.SignedPrekey,
+			PrekeySignature: bundle.PrekeySignature,
+		}
+		if len(bundle.OneTimePrekeys) > 0 {
+			keys.OneTimePrekey = bundle.OneTimePrekeys[0]
+			bundle.OneTimePrekeys = bundle.OneTimePrekeys[1:]
+			if err := m.store.SaveKeyBundle(bundle); err != nil {
+				m.keysLock.Unlock()
+				return err
+			}
+		}
+		reply.Devices = append(reply.Devices, keys)
+	}
+	m.keysLock.Unlock()
+
+	return m.replyJSON(c, EventKeyBundles, reply)
+}
+
+// E2EESendHandler relays ciphertext to a room or a user without looking into it
+func E2EESendHandler(event Event, c *Client) error {
+	var send E2EESendEvent
+	if err := json.Unmarshal(event.Payload, &send); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if len(send.Ciphertext) == 0 || string(send.Ciphertext) == "null" || (send.Room != "" && send.To != "") {
+		return ErrInvalidE2EESend
+	}
+
+	m := c.manager
+	if err := m.countMessage(c.username); err != nil {
+		return err
+	}
+	message := E2EEMessageEvent{
+		From:       c.username,
+		To:         send.To,
+		Ciphertext: send.Ciphertext,
+		Sent:       m.now(),
+	}
+
+	if send.To != "" {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return fmt.Errorf("failed to marshal e2ee message: %v", err)
+		}
+		m.sendToUser(send.To, Event{Type: EventE2EEMessage, Payload: data})
+		return nil
+	}
+
+	message.Room = send.Room
+	if message.Room == "" {
+		message.Room = m.roomOf(c)
+	}
+	// Only members can write to a room, like with send_message
+	if message.Room != m.roomOf(c) {
+		return fmt.Errorf("%w: %s", ErrNotInRoom, message.Room)
+	}
+	if err := m.checkStorageQuota(message.Room); err != nil {
+		return err
+	}
+	message.ID = m.newID()
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal e2ee message: %v", err)
+	}
+	m.broadcastToRoom(message.Room, message.ID, Event{Type: EventE2EEMessage, Payload: data})
+	return nil
+}
+
+// roomIsE2EE returns true if the room only accepts encrypted messages
+func (m *Manager) roomIsE2EE(name string) bool {
+	r := m.room(name)
+	r.Lock()
+	defer r.Unlock()
+	return r.e2ee
+}
+
+// setRoomE2EE updates the flag kept with the state of the room
+func (m *Manager) setRoomE2EE(name string, e2ee bool) {
+	r := m.room(name)
+	r.Lock()
+	r.e2ee = e2ee
+	r.Unlock()
+}
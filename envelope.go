@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The envelope of chat.v1.json is loose: clients send a type and a payload and
+// the server fills in the rest. Client SDKs need a firmer contract, so clients
+// can negotiate chat.v2.json, whose envelope is strict. Every event, in both
+// directions, has an id, a timestamp and a type, and can name its room:
+//
+//	{"id":"01J9Z...","ts":"2026-10-16T12:00:00.123Z","type":"send_message","room":"general","payload":{"message":"hi"}}
+//
+// An event sent without id, ts or type, with fields the envelope doesn't have or
+// for a room that isn't the room of the client, is not handled. The client gets
+// an error event with the code invalid_envelope instead, naming the field, the
+// problem and the id of the event if it had one:
+//
+//	{"code":"invalid_envelope","message":"invalid envelope, ts is missing","params":{"id":"01J9Z...","field":"ts","reason":"is missing"}}
+//
+// Events the server sends get an id from the IDGenerator of the Manager, see
+// ids.go, unless they have one already, and the time they were encoded. How ts
+// is written is pluggable: envelope.timestamps in the config picks rfc3339, an
+// RFC 3339 string with up to nanoseconds, or unix_ms, the milliseconds since the
+// epoch as a number, and WithTimestampFormat sets any other TimestampFormat.
+//
+// Clients move over by sending ids and timestamps, then negotiating chat.v2.json.
+// Until they do, the envelopes of the loose protocols are completed by the server
+// when they are read: events without an id get a new one and all get the time they
+// were read, so handlers see the same envelope whatever the protocol. Once all
+// clients moved, envelope.loose set to reject turns away connections that don't
+// negotiate a strict protocol.
+
+const (
+	TimestampRFC3339    = "rfc3339"
+	TimestampUnixMillis = "unix_ms"
+
+	// LooseAccept accepts clients speaking a protocol with the loose envelope
+	LooseAccept = "accept"
+	// LooseReject turns away clients that don't negotiate a strict protocol
+	LooseReject = "reject"
+)
+
+// maxEnvelopeIDLength is the longest id in bytes a client may give its events
+const maxEnvelopeIDLength = 128
+
+var (
+	ErrInvalidEnvelope        = errors.New("invalid envelope")
+	ErrInvalidTimestampFormat = errors.New("timestamp format has to be rfc3339 or unix_ms")
+	ErrInvalidLooseEnvelopes  = errors.New("envelope loose has to be accept or reject")
+	ErrLooseEnvelope          = errors.New("the loose envelope is not accepted, connect with a strict subprotocol like chat.v2.json")
+)
+
+// EnvelopeConfig configures the envelope of the events
+type EnvelopeConfig struct {
+	// Timestamps is how ts is written in strict envelopes, rfc3339 or unix_ms, rfc3339 if empty
+	Timestamps string `json:"timestamps"`
+	// Loose is accept or reject, whether clients may speak a protocol with the loose envelope
+	Loose string `json:"loose"`
+}
+
+// EnvelopeError is returned when decoding a strict envelope that breaks the contract
+type EnvelopeError struct {
+	// ID is the id of the event, if it could be read
+	ID string
+	// Field is the field of the envelope that is wrong
+	Field string
+	// Reason tells what is wrong with the field
+	Reason string
+}
+
+func (e *EnvelopeError) Error() string {
+	return fmt.Sprintf("%v: %s %s", ErrInvalidEnvelope, e.Field, e.Reason)
+}
+
+func (e *EnvelopeError) Unwrap() error {
+	return ErrInvalidEnvelope
+}
+
+// params returns the params of the invalid_envelope error event
+func (e *EnvelopeError) params() map[string]string {
+	params := map[string]string{"field": e.Field, "reason": e.Reason}
+	if e.ID != "" {
+		params["id"] = e.ID
+	}
+	return params
+}
+
+// TimestampFormat writes and reads the ts of strict envelopes
+type TimestampFormat interface {
+	// MarshalTimestamp returns the JSON value of the time
+	MarshalTimestamp(t time.Time) ([]byte, error)
+	// UnmarshalTimestamp reads the time from the JSON value
+	UnmarshalTimestamp(data []byte) (time.Time, error)
+}
+
+// WithTimestampFormat makes the Manager write the timestamps of strict envelopes
+// in the format instead of the one in the config
+func WithTimestampFormat(format TimestampFormat) ManagerOption {
+	return func(m *Manager) {
+		m.timestamps = format
+	}
+}
+
+// newTimestampFormat returns the format of the name
+func newTimestampFormat(name string) (TimestampFormat, error) {
+	switch name {
+	case "", TimestampRFC3339:
+		return rfc3339Timestamps{}, nil
+	case TimestampUnixMillis:
+		return unixMillisTimestamps{}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrInvalidTimestampFormat, name)
+}
+
+// validateEnvelope returns an error if the envelope config can't be used
+func validateEnvelope(config EnvelopeConfig) error {
+	if _, err := newTimestampFormat(config.Timestamps); err != nil {
+		return err
+	}
+	if config.Loose != "" && config.Loose != LooseAccept && config.Loose != LooseReject {
+		return fmt.Errorf("%w: %q", ErrInvalidLooseEnvelopes, config.Loose)
+	}
+	return nil
+}
+
+// timestampFormat returns the format timestamps are written in
+func (m *Manager) timestampFormat() TimestampFormat {
+	if m.timestamps != nil {
+		return m.timestamps
+	}
+	format, err := newTimestampFormat(m.config().Envelope.Timestamps)
+	if err != nil {
+		// LoadConfig and NewManager reject it, the default is the safe choice
+		return rfc3339Timestamps{}
+	}
+	return format
+}
+
+// rfc3339Timestamps writes timestamps as RFC 3339 strings
+type rfc3339Timestamps struct{}
+
+func (rfc3339Timestamps) MarshalTimestamp(t time.Time) ([]byte, error) {
+	return json.Marshal(t.UTC().Format(time.RFC3339Nano))
+}
+
+func (rfc3339Timestamps) UnmarshalTimestamp(data []byte) (time.Time, error) {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return time.Time{}, errors.New("is not an RFC 3339 string")
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, errors.New("is not an RFC 3339 string")
+	}
+	return t, nil
+}
+
+// unixMillisTimestamps writes timestamps as the milliseconds since the epoch
+type unixMillisTimestamps struct{}
+
+func (unixMillisTimestamps) MarshalTimestamp(t time.Time) ([]byte, error) {
+	return strconv.AppendInt(nil, t.UnixMilli(), 10), nil
+}
+
+func (unixMillisTimestamps) UnmarshalTimestamp(data []byte) (time.Time, error) {
+	millis, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("is not a number of milliseconds")
+	}
+	return time.UnixMilli(millis), nil
+}
+
+// strictEnvelope is an event on the wire of a strict protocol
+type strictEnvelope struct {
+	ID      json.RawMessage `json:"id"`
+	TS      json.RawMessage `json:"ts"`
+	Type    string          `json:"type"`
+	Room    string          `json:"room,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// strictCodec sends events as JSON text messages with the strict envelope, it
+// takes the ids, the time and the timestamp format from the Manager
+type strictCodec struct {
+	m *Manager
+}
+
+func (c strictCodec) Encode(event Event) (int, []byte, error) {
+	if event.ID == "" {
+		event.ID = c.m.newID()
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = c.m.now()
+	}
+	id, err := json.Marshal(event.ID)
+	if err != nil {
+		return 0, nil, err
+	}
+	ts, err := c.m.timestampFormat().MarshalTimestamp(event.Timestamp)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := json.Marshal(strictEnvelope{ID: id, TS: ts, Type: event.Type, Room: event.Room, Payload: event.Payload})
+	return websocket.TextMessage, data, err
+}
+
+func (c strictCodec) Decode(messageType int, data []byte) (Event, error) {
+	if messageType != websocket.TextMessage {
+		return Event{}, ErrUnexpectedFrame
+	}
+	var envelope strictEnvelope
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&envelope); err != nil {
+		return Event{}, &EnvelopeError{Field: "envelope", Reason: strings.TrimPrefix(err.Error(), "json: ")}
+	}
+
+	var event Event
+	id, err := envelopeID(envelope.ID)
+	if err != nil {
+		return Event{}, &EnvelopeError{Field: "id", Reason: err.Error()}
+	}
+	event.ID = id
+	if len(envelope.TS) == 0 || string(envelope.TS) == "null" {
+		return Event{}, &EnvelopeError{ID: id, Field: "ts", Reason: "is missing"}
+	}
+	if event.Timestamp, err = c.m.timestampFormat().UnmarshalTimestamp(envelope.TS); err != nil {
+		return Event{}, &EnvelopeError{ID: id, Field: "ts", Reason: err.Error()}
+	}
+	if envelope.Type == "" {
+		return Event{}, &EnvelopeError{ID: id, Field: "type", Reason: "is missing"}
+	}
+	event.Type = envelope.Type
+	event.Room = envelope.Room
+	event.Payload = envelope.Payload
+	return event, nil
+}
+
+// envelopeID reads the id of a strict envelope, a string or, for clients using
+// numeric ids like snowflakes, a number
+func envelopeID(data json.RawMessage) (string, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return "", errors.New("is missing")
+	}
+	var id string
+	if err := json.Unmarshal(data, &id); err != nil {
+		var number json.Number
+		if json.Unmarshal(data, &number) != nil {
+			return "", errors.New("has to be a string or a number")
+		}
+		id = number.String()
+	}
+	if id == "" {
+		return "", errors.New("is missing")
+	}
+	if len(id) > maxEnvelopeIDLength {
+		return "", fmt.Errorf("is longer than %d bytes", maxEnvelopeIDLength)
+	}
+	return id, nil
+}
+
+// rejectLoose returns true if the protocol has the loose envelope and the config
+// doesn't accept those anymore
+func (m *Manager) rejectLoose(protocol Protocol) bool {
+	return !protocol.Strict && m.config().Envelope.Loose == LooseReject
+}
+
+// completeEnvelope checks the envelope of an event read from the client, and fills
+// in what the loose envelope lacks. It returns false if the client was sent an
+// error instead
+func (c *Client) completeEnvelope(event *Event) bool {
+	m := c.manager
+	if !c.protocol.Strict {
+		if event.ID == "" {
+			event.ID = m.newID()
+		}
+		event.Timestamp = m.now()
+		return true
+	}
+	if event.Room != "" && event.Room != m.roomOf(c) {
+		err := &EnvelopeError{ID: event.ID, Field: "room", Reason: "is not the room of the client"}
+		m.sendError(c, "invalid_envelope", err.params())
+		return false
+	}
+	return true
+}
+
+// rejectEnvelope tells the client the event it sent was not handled, it returns
+// false if err isn't about the envelope
+func (c *Client) rejectEnvelope(err error) bool {
+	var envelopeErr *EnvelopeError
+	if !errors.As(err, &envelopeErr) {
+		return false
+	}
+	log.Printf("client %s sent an invalid envelope: %v", c.id, err)
+	c.manager.sendError(c, "invalid_envelope", envelopeErr.params())
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// Cursor positions, live pointers and voice activity change many times a second
+// and only the latest value matters. Event types listed in ephemeral.events are
+// relayed to the others in the room of the sender as they are, with the sender
+// added:
+//
+//	{"type":"cursor","payload":{"x":10,"y":20}}
+//	{"type":"cursor","payload":{"room":"general","from":"alice","client":"...","data":{"x":10,"y":20}}}
+//
+// They are not numbered, stored, replayed or acked, even for clients with
+// at-least-once delivery. While an event of a sender waits on the egress of a
+// client, a newer one of the same type and sender replaces it instead of queueing
+// behind it, so a slow client gets the latest cursor instead of all of them. They
+// are limited by ephemeral.rate_limit instead of rate_limit, so a moving cursor
+// doesn't use up the events of the chat. Built-in event types can't be made
+// ephemeral.
+
+// EphemeralStateEvent is the payload of an ephemeral event relayed to the room
+type EphemeralStateEvent struct {
+	Room string `json:"room"`
+	From string `json:"from"`
+	// Client is the id of the client that sent it, the latest of each client is kept
+	Client string          `json:"client"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// isEphemeral returns true if the event type is relayed as ephemeral event
+func (m *Manager) isEphemeral(eventType string) bool {
+	if _, builtin := m.handlers[eventType]; builtin {
+		return false
+	}
+	return slices.Contains(m.config().Ephemeral.Events, eventType)
+}
+
+// ephemeralKey returns the key an ephemeral event is coalesced by, false if the
+// event isn't one relayed by EphemeralHandler
+func (m *Manager) ephemeralKey(event Event) (string, string, bool) {
+	if !m.isEphemeral(event.Type) {
+		return "", "", false
+	}
+	var state EphemeralStateEvent
+	if err := json.Unmarshal(event.Payload, &state); err != nil || state.Client == "" {
+		return "", "", false
+	}
+	return event.Type + "/" + state.Client, state.Client, true
+}
+
+// limitOf returns the rate limit of the event type for the client
+func (c *Client) limitOf(eventType string) (*tokenBucket, RateLimitConfig) {
+	if c.manager.isEphemeral(eventType) {
+		return &c.ephemeralLimiter, c.manager.config().Ephemeral.RateLimit
+	}
+	return &c.limiter, c.rateLimit()
+}
+
+// EphemeralHandler relays an ephemeral event to the others in the room
+func EphemeralHandler(event Event, c *Client) error {
+	if !json.Valid(event.Payload) {
+		return fmt.Errorf("bad payload in request: not JSON")
+	}
+	m := c.manager
+	room := m.roomOf(c)
+	data, err := json.Marshal(EphemeralStateEvent{Room: room, From: c.username, Client: c.id, Data: event.Payload})
+	if err != nil {
+		return err
+	}
+	m.sendToRoom(room, Event{Type: event.Type, Payload: data})
+	return nil
+}
+
+// deliverEphemeral sends the ephemeral event to the clients in the room on this
+// instance but its sender, replacing an older one of the sender still queued
+func (m *Manager) deliverEphemeral(room string, event Event, key, sender string) int {
+	m.RLock()
+	defer m.RUnlock()
+	prepared := prepare(event)
+	delivered := 0
+	for client := range m.members[room] {
+		if client.id != sender && client.enqueueCoalesced(key, prepared) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// enqueueCoalesced queues the event, or replaces the event of the key that is
+// still queued. A marker holding the key goes on egress, the writer takes the
+// latest event of the key when it gets to the marker
+// Only call it while holding the manager lock, so the egress can't be closed meanwhile
+func (c *Client) enqueueCoalesced(key string, event Event) bool {
+	event, ok := c.filterOutbound(event)
+	if !ok {
+		return false
+	}
+
+	c.coalescedLock.Lock()
+	defer c.coalescedLock.Unlock()
+
+	if old, pending := c.coalesced[key]; pending {
+		c.release(old)
+		c.reserve(event)
+		c.coalesced[key] = event
+		c.stats.coalesced.Add(1)
+		return true
+	}
+	if !c.enqueue(Event{Type: event.Type, coalesceKey: key}) {
+		return false
+	}
+	if c.coalesced == nil {
+		c.coalesced = make(map[string]Event)
+	}
+	c.reserve(event)
+	c.coalesced[key] = event
+	return true
+}
+
+// uncoalesce returns the event to write for one taken off egress, the latest
+// event of the key for a marker
+func (c *Client) uncoalesce(message Event) Event {
+	if message.coalesceKey == "" {
+		return message
+	}
+	c.release(message)
+
+	c.coalescedLock.Lock()
+	defer c.coalescedLock.Unlock()
+	latest := c.coalesced[message.coalesceKey]
+	delete(c.coalesced, message.coalesceKey)
+	return latest
+}
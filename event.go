@@ -1,14 +1,28 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Event is the messages sent over the websocket
 // Used to differ between different actions
 type Event struct {
+	// ID identifies the event, it is set on events sent to clients with at-least-once delivery
+	ID string `json:"id,omitempty"`
 	// Type is the message type sent
 	Type string `json:"type"`
 	// Payload is the data based on the type
 	Payload json.RawMessage `json:"payload"`
+	// Timestamp is when the event was sent, it is only on the wire in the strict envelope, see envelope.go
+	Timestamp time.Time `json:"-"`
+	// Room is the room the event belongs to, if known, it is only on the wire in the strict envelope
+	Room string `json:"-"`
+
+	// prepared caches the encoded frames of events sent to many clients, nil otherwise
+	prepared *preparedEvent
+	// coalesceKey is set on the markers of ephemeral events on egress, see ephemeral.go
+	coalesceKey string
 }
 
 // EventHandler is a function signature that is used to affect messages on the socket and triggered
@@ -17,6 +31,22 @@ type EventHandler func(event Event, c *Client) error
 const (
 	// EventSendMessage is the event name for new chaat messages sent
 	EventSendMessage = "send_message"
+	// EventNewMessage is a response to send_message, delivered to everyone in the room
+	EventNewMessage = "new_message"
+	// EventJoinRoom is sent by a client that wants to change room
+	EventJoinRoom = "join_room"
+	// EventError is sent to a client when something went wrong handling its event
+	EventError = "error"
+	// EventAck is used to acknowledge an event by its id
+	EventAck = "ack"
+	// EventSendDirectMessage is sent by a client to message a single user
+	EventSendDirectMessage = "send_direct_message"
+	// EventDirectMessage is delivered to all clients of the recipient of a direct message
+	EventDirectMessage = "direct_message"
+	// EventMention is delivered to all clients of a user mentioned in a message
+	EventMention = "mention"
+	// EventRegisterPushToken is sent by a client to receive push notifications while offline
+	EventRegisterPushToken = "register_push_token"
 )
 
 // SendMessageEvent is the payload sent in the
@@ -24,4 +54,68 @@ const (
 type SendMessageEvent struct {
 	Message string `json:"message"`
 	From    string `json:"from"`
+	// Nickname is the name the sender chose with /nick, shown instead of From if set
+	Nickname string `json:"nickname,omitempty"`
+	// Action is set for messages sent with /me, they read like "* alice waves"
+	Action bool `json:"action,omitempty"`
+	// Mentions are the users mentioned, if empty they are parsed from @username in the message
+	Mentions []string `json:"mentions,omitempty"`
+}
+
+// NewMessageEvent is returned when responding to send_message
+type NewMessageEvent struct {
+	// ID identifies the message, used to react to it
+	ID string `json:"id"`
+	SendMessageEvent
+	Sent time.Time `json:"sent"`
+}
+
+// JoinRoomEvent is the payload sent in the
+// join_room event
+type JoinRoomEvent struct {
+	Room string `json:"room"`
+}
+
+// ErrorEvent is the payload sent in the
+// error event
+type ErrorEvent struct {
+	// Code is a short machine readable identifier of the error
+	Code string `json:"code"`
+	// Message is a human readable description, in the locale of the client
+	Message string `json:"message"`
+	// Params are the values filled into the message of the code, see localize.go
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// AckEvent is the payload sent in the
+// ack event
+type AckEvent struct {
+	// ID is the id of the event being acknowledged
+	ID string `json:"id"`
+}
+
+// SendDirectMessageEvent is the payload sent in the
+// send_direct_message event
+type SendDirectMessageEvent struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+// DirectMessageEvent is returned when responding to send_direct_message
+type DirectMessageEvent struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Nickname is the nickname of the sender, if set
+	Nickname string    `json:"nickname,omitempty"`
+	Message  string    `json:"message"`
+	Sent     time.Time `json:"sent"`
+}
+
+// MentionEvent is the payload sent in the
+// mention event
+type MentionEvent struct {
+	From    string    `json:"from"`
+	Room    string    `json:"room"`
+	Message string    `json:"message"`
+	Sent    time.Time `json:"sent"`
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The history of a room can be exported for compliance or to take it elsewhere,
+// as JSON Lines with one stored event per line or as CSV with one row per event.
+// Operators export any room with GET /admin/rooms/{room}/export, backends with
+// the API token or an API key with the export scope use GET
+// /api/rooms/{room}/export, a key only for the rooms its user may join. The
+// export is written while it is read from the store, so large rooms don't have to
+// fit in memory, ?from= and ?to= limit it to the events sent in that time.
+//
+//	GET /admin/rooms/general/export?format=csv&from=2024-01-01T00:00:00Z&to=2024-02-01T00:00:00Z
+
+const (
+	AuditExport = "export"
+
+	ExportJSONLines = "jsonl"
+	ExportCSV       = "csv"
+)
+
+var (
+	ErrExportFormat = errors.New("format must be jsonl or csv")
+)
+
+var (
+	// exportBatchSize is how many events the Postgres store reads at once while exporting
+	exportBatchSize = 1000
+	// exportFlushEvery is after how many events the response is flushed to the client
+	exportFlushEvery = 500
+)
+
+// exportCSVHeader are the columns of a CSV export, payload holds the event as JSON
+// and from and message are filled for chat messages
+var exportCSVHeader = []string{"room", "seq", "id", "sent", "type", "from", "message", "payload"}
+
+// exportRequest is an export as asked for in the query
+type exportRequest struct {
+	Room   string
+	Format string
+	From   time.Time
+	To     time.Time
+}
+
+// parseExportRequest reads the export from the path and query of the request
+func parseExportRequest(r *http.Request) (exportRequest, error) {
+	query := r.URL.Query()
+	req := exportRequest{Room: r.PathValue("room"), Format: query.Get("format")}
+	if req.Format == "" {
+		req.Format = ExportJSONLines
+	}
+	if req.Format != ExportJSONLines && req.Format != ExportCSV {
+		return exportRequest{}, ErrExportFormat
+	}
+	for name, dest := range map[string]*time.Time{"from": &req.From, "to": &req.To} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return exportRequest{}, fmt.Errorf("%s must be an RFC 3339 time: %v", name, err)
+			}
+			*dest = t
+		}
+	}
+	return req, nil
+}
+
+// exportWriter writes the events of an export in its format
+type exportWriter struct {
+	w      http.ResponseWriter
+	csv    *csv.Writer
+	json   *json.Encoder
+	events int
+}
+
+func newExportWriter(w http.ResponseWriter, format string) *exportWriter {
+	e := &exportWriter{w: w}
+	if format == ExportCSV {
+		e.csv = csv.NewWriter(w)
+	} else {
+		e.json = json.NewEncoder(w)
+	}
+	return e
+}
+
+// header writes the CSV header, JSON Lines have none
+func (e *exportWriter) header() error {
+	if e.csv == nil {
+		return nil
+	}
+	return e.csv.Write(exportCSVHeader)
+}
+
+// write writes one event and flushes the response every exportFlushEvery events
+func (e *exportWriter) write(msg StoredMessage) error {
+	var err error
+	if e.csv != nil {
+		err = e.csv.Write(exportCSVRecord(msg))
+	} else {
+		err = e.json.Encode(msg)
+	}
+	if err != nil {
+		return err
+	}
+	e.events++
+	if e.events%exportFlushEvery == 0 {
+		return e.flush()
+	}
+	return nil
+}
+
+// flush sends what was written so far to the client
+func (e *exportWriter) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	err := http.NewResponseController(e.w).Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// exportCSVRecord returns the CSV row of the event
+func exportCSVRecord(msg StoredMessage) []string {
+	var chat SendMessageEvent
+	if msg.Event.Type == EventNewMessage {
+		json.Unmarshal(msg.Event.Payload, &chat)
+	}
+	return []string{
+		msg.Room,
+		strconv.FormatUint(msg.Seq, 10),
+		msg.ID,
+		msg.Sent.UTC().Format(time.RFC3339Nano),
+		msg.Event.Type,
+		chat.From,
+		chat.Message,
+		string(msg.Event.Payload),
+	}
+}
+
+// exportRoom writes the history of the room to the response, the status is sent
+// before the first event so later errors can only end the export early
+func (m *Manager) exportRoom(w http.ResponseWriter, req exportRequest) (int, error) {
+	contentType, extension := "application/x-ndjson", "jsonl"
+	if req.Format == ExportCSV {
+		contentType, extension = "text/csv; charset=utf-8", "csv"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", req.Room+"."+extension))
+	w.WriteHeader(http.StatusOK)
+
+	e := newExportWriter(w, req.Format)
+	if err := e.header(); err != nil {
+		return 0, err
+	}
+	if err := m.store.ExportMessages(req.Room, req.From, req.To, e.write); err != nil {
+		return e.events, err
+	}
+	return e.events, e.flush()
+}
+
+// exportHandler streams the history of a room, API keys may only export the rooms
+// their user may join. actor is who is audited as exporting without a key
+func (m *Manager) exportHandler(actor string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := parseExportRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		room, err := m.roomSettings(req.Room)
+		if errors.Is(err, ErrRoomNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		exporter := actor
+		if key, ok := requestAPIKey(r); ok {
+			if !key.allowsRoom(room.Name) || !room.admits(key.Username) {
+				http.Error(w, ErrAPIKeyRoom.Error(), http.StatusForbidden)
+				return
+			}
+			exporter = key.Username
+		}
+
+		events, err := m.exportRoom(w, req)
+		if err != nil {
+			log.Printf("export of %s ended after %d events: %v", room.Name, events, err)
+		}
+		m.audit(AuditEntry{
+			Action:     AuditExport,
+			Actor:      exporter,
+			Target:     room.Name,
+			RemoteAddr: r.RemoteAddr,
+			Details:    map[string]string{"format": req.Format, "events": strconv.Itoa(events)},
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportRoomHistory calls the export handler like the routes do, with the key if it is set
+func exportRoomHistory(m *Manager, room, query string, key *APIKey) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/admin/rooms/"+room+"/export?"+query, nil)
+	r.SetPathValue("room", room)
+	if key != nil {
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, *key))
+	}
+	w := httptest.NewRecorder()
+	m.exportHandler("admin")(w, r)
+	return w
+}
+
+// newExportTestServer returns a test server with three messages in the default room, an hour apart
+func newExportTestServer(t *testing.T) (*Manager, time.Time) {
+	t.Helper()
+	_, m := newRoomTestServer(t, DefaultConfig())
+	start := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i, text := range []string{"first", "second", "third"} {
+		payload, _ := json.Marshal(NewMessageEvent{ID: text, SendMessageEvent: SendMessageEvent{Message: text, From: "alice"}})
+		msg := StoredMessage{
+			ID:    text,
+			Room:  defaultRoom,
+			Seq:   uint64(i + 1),
+			Event: Event{Type: EventNewMessage, Payload: payload},
+			Sent:  start.Add(time.Duration(i) * time.Hour),
+		}
+		if err := m.store.AppendMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m, start
+}
+
+func TestExportJSONLines(t *testing.T) {
+	m, _ := newExportTestServer(t)
+
+	w := exportRoomHistory(m, defaultRoom, "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var ids []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var msg StoredMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	if strings.Join(ids, ",") != "first,second,third" {
+		t.Errorf("exported %v, want first, second and third", ids)
+	}
+
+	entries, err := m.auditLog.Query(AuditQuery{Action: AuditExport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Actor != "admin" || entries[0].Details["events"] != "3" {
+		t.Errorf("audit entries are %+v, want the export of 3 events by admin", entries)
+	}
+}
+
+func TestExportCSVOfATimeRange(t *testing.T) {
+	m, start := newExportTestServer(t)
+
+	// from is inclusive and to exclusive, so only the second message is in the range
+	query := "format=csv&from=" + start.Add(time.Hour).Format(time.RFC3339) + "&to=" + start.Add(2*time.Hour).Format(time.RFC3339)
+	w := exportRoomHistory(m, defaultRoom, query, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", w.Code, w.Body)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || strings.Join(records[0], ",") != strings.Join(exportCSVHeader, ",") {
+		t.Fatalf("exported %v, want the header and one row", records)
+	}
+	if row := records[1]; row[1] != "2" || row[2] != "second" || row[5] != "alice" || row[6] != "second" {
+		t.Errorf("row is %v, want the second message of alice", row)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	m, _ := newExportTestServer(t)
+
+	for _, tc := range []struct {
+		name  string
+		room  string
+		query string
+		key   *APIKey
+		want  int
+	}{
+		{"unknown format", defaultRoom, "format=xml", nil, http.StatusBadRequest},
+		{"invalid time", defaultRoom, "from=yesterday", nil, http.StatusBadRequest},
+		{"unknown room", "nowhere", "", nil, http.StatusNotFound},
+		{"room outside the key", defaultRoom, "", &APIKey{Username: "carol", Rooms: []string{"secret"}}, http.StatusForbidden},
+		{"private room of others", "secret", "", &APIKey{Username: "bob"}, http.StatusForbidden},
+		{"room of the key", "secret", "", &APIKey{Username: "carol", Rooms: []string{"secret"}}, http.StatusOK},
+	} {
+		if w := exportRoomHistory(m, tc.room, tc.query, tc.key); w.Code != tc.want {
+			t.Errorf("%s: %d %s, want %d", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+}
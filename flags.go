@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Feature flags roll protocol features out to some tenants and users before
+// everyone gets them. A flag is granted to a client when it is enabled, or lists
+// the user or its tenant, see quota.go, or the user falls into its percent, which
+// is picked by a hash of the flag and the username so a user keeps the flag:
+//
+//	"feature_flags": {"flags": {
+//	    "batching":    {"percent": 25},
+//	    "compression": {"tenants": ["acme"]},
+//	    "search":      {"users": ["alice"], "events": ["search_messages"]}
+//	}}
+//
+// batching and compression gate batch=1 and permessage-deflate, features without
+// a flag are not gated. The events of a flag can only be sent by clients that
+// were granted it, the others get an error event with the code feature_disabled.
+// The flags are evaluated when a client connects and the granted ones are in the
+// flags of its welcome event, so the client knows what it may use.
+//
+// The flags of the config can be overridden by a remote provider, GET
+// feature_flags.remote_url returns {"flags": {...}} like the config and is read
+// every feature_flags.refresh_interval. Its flags replace the ones of the config
+// with the same name, the last flags read are kept while it can't be reached.
+
+const (
+	// FlagBatching gates the batching of events, see batch.go
+	FlagBatching = "batching"
+	// FlagCompression gates permessage-deflate
+	FlagCompression = "compression"
+)
+
+var (
+	ErrFeatureDisabled = errors.New("feature is not enabled")
+)
+
+// flagsTimeout bounds a request to the remote provider
+var flagsTimeout = 10 * time.Second
+
+// FeatureFlag says who is granted a feature
+type FeatureFlag struct {
+	// Enabled grants the flag to everyone
+	Enabled bool     `json:"enabled,omitempty"`
+	Tenants []string `json:"tenants,omitempty"`
+	Users   []string `json:"users,omitempty"`
+	// Percent grants the flag to this share of the users, 0 to 100
+	Percent float64 `json:"percent,omitempty"`
+	// Events are the event types only clients granted the flag may send
+	Events []string `json:"events,omitempty"`
+}
+
+// FlagProvider returns the flags that override the ones of the config
+type FlagProvider interface {
+	Flags(ctx context.Context) (map[string]FeatureFlag, error)
+}
+
+// HTTPFlagProvider reads the flags from an URL returning {"flags": {...}}
+type HTTPFlagProvider struct {
+	URL string
+}
+
+func (p HTTPFlagProvider) Flags(ctx context.Context) (map[string]FeatureFlag, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with %s", p.URL, resp.Status)
+	}
+
+	var body struct {
+		Flags map[string]FeatureFlag `json:"flags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Flags, nil
+}
+
+// grants returns true if the flag is granted to the user of the tenant
+func (f FeatureFlag) grants(name, username, tenant string) bool {
+	if f.Enabled || slices.Contains(f.Users, username) || slices.Contains(f.Tenants, tenant) {
+		return true
+	}
+	if f.Percent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "/" + username))
+	return float64(h.Sum32()%10000) < f.Percent*100
+}
+
+// featureFlag returns the flag with the name, the one of the remote provider if it has it
+func (m *Manager) featureFlag(name string) (FeatureFlag, bool) {
+	if remote := m.remoteFlags.Load(); remote != nil {
+		if flag, ok := (*remote)[name]; ok {
+			return flag, true
+		}
+	}
+	flag, ok := m.config().FeatureFlags.Flags[name]
+	return flag, ok
+}
+
+// flagsOf returns the names of the flags granted to the user, sorted
+func (m *Manager) flagsOf(username string) []string {
+	names := slices.Collect(maps.Keys(m.config().FeatureFlags.Flags))
+	if remote := m.remoteFlags.Load(); remote != nil {
+		names = append(names, slices.Collect(maps.Keys(*remote))...)
+	}
+	slices.Sort(names)
+
+	tenant := m.tenantOf(username)
+	var granted []string
+	for _, name := range slices.Compact(names) {
+		if flag, _ := m.featureFlag(name); flag.grants(name, username, tenant) {
+			granted = append(granted, name)
+		}
+	}
+	return granted
+}
+
+// featureGranted returns true if the feature is granted to the user, or is not gated by a flag
+func (m *Manager) featureGranted(name, username string) bool {
+	flag, ok := m.featureFlag(name)
+	return !ok || flag.grants(name, username, m.tenantOf(username))
+}
+
+// eventFlag returns the flag gating the event type, if any
+func (m *Manager) eventFlag(eventType string) (string, bool) {
+	var remote map[string]FeatureFlag
+	if flags := m.remoteFlags.Load(); flags != nil {
+		remote = *flags
+	}
+	for name, flag := range remote {
+		if slices.Contains(flag.Events, eventType) {
+			return name, true
+		}
+	}
+	for name, flag := range m.config().FeatureFlags.Flags {
+		if _, replaced := remote[name]; !replaced && slices.Contains(flag.Events, eventType) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// checkEventFlag returns ErrFeatureDisabled if the event is gated by a flag the
+// client wasn't granted, the client is sent an error event then
+func (m *Manager) checkEventFlag(event Event, c *Client) error {
+	name, ok := m.eventFlag(event.Type)
+	if !ok || slices.Contains(c.flags, name) {
+		return nil
+	}
+	m.sendError(c, "feature_disabled", map[string]string{"type": event.Type, "feature": name})
+	return fmt.Errorf("%w: %s", ErrFeatureDisabled, name)
+}
+
+// refreshFlags reads the flags of the remote provider
+func (m *Manager) refreshFlags(ctx context.Context, provider FlagProvider) {
+	ctx, cancel := context.WithTimeout(ctx, flagsTimeout)
+	defer cancel()
+	flags, err := provider.Flags(ctx)
+	if err != nil {
+		log.Println("reading feature flags: ", err)
+		return
+	}
+	m.remoteFlags.Store(&flags)
+}
+
+// runFlagProvider reads the flags of the remote provider at the refresh interval
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runFlagProvider(ctx context.Context, provider FlagProvider) {
+	for {
+		m.refreshFlags(ctx, provider)
+
+		// The interval is read every time so a config reload applies to the next run
+		interval := time.Duration(m.config().FeatureFlags.RefreshInterval)
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
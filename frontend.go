@@ -0,0 +1,23 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// frontendFiles holds the demo chat frontend, it is compiled into the binary
+// so the server can be tried out without setting anything else up
+//
+//go:embed frontend
+var frontendFiles embed.FS
+
+// frontendHandler serves the demo frontend
+func frontendHandler() http.Handler {
+	files, err := fs.Sub(frontendFiles, "frontend")
+	if err != nil {
+		// Can only happen if the embed directive is wrong
+		panic(err)
+	}
+	return http.FileServerFS(files)
+}
@@ -0,0 +1,341 @@
+// Demo frontend for the chat server, it logs in, trades the OTP for a
+// websocket and shows the messages of the current room
+
+// typingTimeout is how long after the last key press the user stops typing
+const typingTimeout = 2000;
+
+let conn = null;
+let room = "general";
+let typingTimer = null;
+let typing = false;
+// csrfToken is sent along with the login and the connection if the server asks for it
+let csrfToken = "";
+
+// typingUsers holds the users currently typing in the room
+const typingUsers = new Set();
+
+// reactionSpans holds the element showing the reactions of each message by id
+const reactionSpans = new Map();
+
+// Event is the envelope of everything sent over the websocket
+class Event {
+    constructor(type, payload) {
+        this.type = type;
+        this.payload = payload;
+    }
+}
+
+function sendEvent(type, payload) {
+    if (conn === null || conn.readyState !== WebSocket.OPEN) {
+        return;
+    }
+    conn.send(JSON.stringify(new Event(type, payload)));
+}
+
+function appendLine(text, className) {
+    const messages = document.getElementById("chatmessages");
+    const line = document.createElement("div");
+    line.textContent = text;
+    if (className) {
+        line.className = className;
+    }
+    messages.appendChild(line);
+    messages.scrollTop = messages.scrollHeight;
+    return line;
+}
+
+// addReactionButton lets the user react to the message with a thumbs up, clicking again removes it
+function addReactionButton(line, id) {
+    const reactions = document.createElement("span");
+    reactions.className = "reactions";
+    const button = document.createElement("button");
+    button.textContent = "+\u{1F44D}";
+    let reacted = false;
+    button.onclick = () => {
+        reacted = !reacted;
+        sendEvent(reacted ? "add_reaction" : "remove_reaction", { message_id: id, emoji: "\u{1F44D}" });
+    };
+    line.append(" ", reactions, button);
+    reactionSpans.set(id, reactions);
+}
+
+function renderTopic(info) {
+    if (info.name === room) {
+        document.getElementById("room-topic").textContent = info.topic || "";
+    }
+}
+
+function renderReactions(payload) {
+    const reactions = reactionSpans.get(payload.message_id);
+    if (reactions) {
+        reactions.textContent = Object.entries(payload.reactions).map(([emoji, n]) => `${emoji} ${n}`).join(" ");
+    }
+}
+
+function renderTyping() {
+    const el = document.getElementById("typing");
+    if (typingUsers.size === 0) {
+        el.textContent = "";
+        return;
+    }
+    el.textContent = [...typingUsers].join(", ") + (typingUsers.size === 1 ? " is typing..." : " are typing...");
+}
+
+// routeEvent handles the events sent by the server
+function routeEvent(event) {
+    switch (event.type) {
+    case "welcome":
+        // Reconnects of this browser count as the same device
+        if (event.payload.device_id) {
+            localStorage.setItem("device_id", event.payload.device_id);
+        }
+        break;
+    case "account_erased":
+        appendLine(`[system] ${event.payload.message}`, "system");
+        break;
+    case "session_recording":
+        appendLine(event.payload.recording ? "[system] this session is being recorded" : "[system] this session is no longer recorded", "system");
+        break;
+    case "device_revoked":
+        appendLine(`[system] a device was logged out`, "system");
+        break;
+    case "new_message": {
+        const sent = new Date(event.payload.sent).toLocaleTimeString();
+        typingUsers.delete(event.payload.from);
+        renderTyping();
+        const name = event.payload.nickname || event.payload.from;
+        let line;
+        if (event.payload.action) {
+            line = appendLine(`${sent} * ${name} ${event.payload.message}`);
+        } else {
+            line = appendLine(`${sent} ${name}: ${event.payload.message}`);
+        }
+        if (event.payload.id) {
+            addReactionButton(line, event.payload.id);
+        }
+        break;
+    }
+    case "reaction_updated":
+        renderReactions(event.payload);
+        break;
+    case "room_switched":
+        room = event.payload.room.name;
+        document.getElementById("chat-header").textContent = "Currently in chat: " + room;
+        document.getElementById("chatmessages").replaceChildren();
+        reactionSpans.clear();
+        typingUsers.clear();
+        renderTyping();
+        renderTopic(event.payload.room);
+        event.payload.history.forEach(routeEvent);
+        for (const [id, reactions] of Object.entries(event.payload.reactions || {})) {
+            renderReactions({ message_id: id, reactions: reactions });
+        }
+        break;
+    case "member_joined":
+        appendLine(`[system] ${event.payload.nickname || event.payload.username} joined`, "system");
+        break;
+    case "member_left":
+        appendLine(`[system] ${event.payload.nickname || event.payload.username} left`, "system");
+        break;
+    case "nickname_changed":
+        if (event.payload.nickname) {
+            appendLine(`[system] ${event.payload.previous || event.payload.username} is now known as ${event.payload.nickname}`, "system");
+        } else {
+            appendLine(`[system] ${event.payload.previous} is ${event.payload.username} again`, "system");
+        }
+        break;
+    case "room_info":
+        renderTopic(event.payload);
+        break;
+    case "room_updated":
+        renderTopic(event.payload.room);
+        appendLine(`[system] ${event.payload.by} changed the room settings`, "system");
+        break;
+    case "room_closed":
+        appendLine(`[system] ${event.payload.room} was closed, you are back in ${event.payload.moved_to}`, "system");
+        room = event.payload.moved_to;
+        document.getElementById("chat-header").textContent = "Currently in chat: " + room;
+        sendEvent("get_room", { room: room });
+        break;
+    case "room_invite":
+        appendLine(`[system] ${event.payload.from} invited you to ${event.payload.room}`, "system");
+        break;
+    case "ephemeral":
+        appendLine(event.payload.message, event.payload.error ? "error" : "system");
+        break;
+    case "direct_message":
+        appendLine(`(direct) ${event.payload.nickname || event.payload.from}: ${event.payload.message}`);
+        break;
+    case "user_typing":
+        if (event.payload.typing) {
+            typingUsers.add(event.payload.from);
+        } else {
+            typingUsers.delete(event.payload.from);
+        }
+        renderTyping();
+        break;
+    case "presence":
+        appendLine(`[system] ${event.payload.nickname || event.payload.username} is ${event.payload.status}${event.payload.text ? ": " + event.payload.text : ""}`, "system");
+        break;
+    case "system":
+        appendLine(`[system] ${event.payload.message}`, "system");
+        break;
+    case "server_draining":
+        appendLine(`[system] ${event.payload.message}`, "system");
+        break;
+    case "error":
+        appendLine(`[error] ${event.payload.message}`, "error");
+        break;
+    default:
+        console.log("unsupported event type", event.type);
+    }
+}
+
+// setTyping tells the room when the user starts or stops typing, without
+// sending an event on every key press
+function setTyping(now) {
+    clearTimeout(typingTimer);
+    if (now) {
+        typingTimer = setTimeout(() => setTyping(false), typingTimeout);
+    }
+    if (now !== typing) {
+        typing = now;
+        sendEvent("typing", { typing: typing });
+    }
+}
+
+function changeChatRoom(e) {
+    e.preventDefault();
+    const selected = document.getElementById("chatroom").value.trim();
+    if (selected === "" || selected === room) {
+        return;
+    }
+    // The server answers with room_switched, holding the history of the room
+    sendEvent("switch_room", { room: selected });
+}
+
+function sendMessage(e) {
+    e.preventDefault();
+    const input = document.getElementById("message");
+    if (input.value === "") {
+        return;
+    }
+    sendEvent("send_message", { message: input.value });
+    setTyping(false);
+    input.value = "";
+}
+
+function connectWebsocket(otp) {
+    // Relative to the page, so it works under the base path of the server
+    const url = new URL("ws", location.href);
+    url.protocol = location.protocol === "https:" ? "wss:" : "ws:";
+    url.searchParams.set("otp", otp);
+    if (csrfToken) {
+        url.searchParams.set("csrf", csrfToken);
+    }
+    const device = localStorage.getItem("device_id");
+    if (device) {
+        url.searchParams.set("device", device);
+    }
+    conn = new WebSocket(url, "chat.v1.json");
+
+    conn.onopen = () => {
+        document.getElementById("connection-header").textContent = "Connected to websocket: true";
+        sendEvent("get_room", { room: room });
+    };
+    conn.onclose = () => {
+        document.getElementById("connection-header").textContent = "Connected to websocket: false";
+    };
+    conn.onmessage = (msg) => {
+        routeEvent(JSON.parse(msg.data));
+    };
+}
+
+async function login(e) {
+    e.preventDefault();
+    const form = document.getElementById("login-form");
+
+    const resp = await fetch("login", {
+        method: "POST",
+        headers: { "X-CSRF-Token": csrfToken },
+        body: JSON.stringify({
+            username: form.username.value,
+            password: form.password.value,
+        }),
+    });
+    if (!resp.ok) {
+        alert("unauthorized");
+        return;
+    }
+
+    const data = await resp.json();
+    form.hidden = true;
+    document.getElementById("chat").hidden = false;
+    connectWebsocket(data.otp);
+}
+
+// joinAsGuest gets an OTP for a new guest, the server answers 404 without guest access
+async function joinAsGuest() {
+    const resp = await fetch("guest", {
+        method: "POST",
+        headers: { "X-CSRF-Token": csrfToken },
+    });
+    if (!resp.ok) {
+        alert(await resp.text());
+        return;
+    }
+
+    const data = await resp.json();
+    room = data.rooms[0];
+    document.getElementById("chatroom").value = room;
+    document.getElementById("chat-header").textContent = `Currently in chat: ${room} as ${data.nickname}`;
+    document.getElementById("login-form").hidden = true;
+    document.getElementById("chat").hidden = false;
+    connectWebsocket(data.otp);
+}
+
+// fetchCSRFToken gets the csrf token, the server answers 404 if it doesn't use them
+async function fetchCSRFToken() {
+    const resp = await fetch("csrf");
+    if (resp.ok) {
+        csrfToken = (await resp.json()).token;
+    }
+}
+
+// register creates the account with the username and password of the login form
+async function register() {
+    const form = document.getElementById("login-form");
+
+    const resp = await fetch("register", {
+        method: "POST",
+        headers: { "X-CSRF-Token": csrfToken },
+        body: JSON.stringify({
+            username: form.username.value,
+            password: form.password.value,
+        }),
+    });
+    if (!resp.ok) {
+        alert(await resp.text());
+        return;
+    }
+    alert("registered, you can login now");
+}
+
+window.onload = async () => {
+    document.getElementById("login-form").onsubmit = login;
+    document.getElementById("register").onclick = register;
+    document.getElementById("guest").onclick = joinAsGuest;
+    document.getElementById("chatroom-selection").onsubmit = changeChatRoom;
+    document.getElementById("chatroom-message").onsubmit = sendMessage;
+    document.getElementById("message").oninput = () => setTyping(true);
+    await fetchCSRFToken();
+
+    // Single sign-on redirects back here with the OTP in the fragment
+    const params = new URLSearchParams(location.hash.slice(1));
+    if (params.has("otp")) {
+        history.replaceState(null, "", location.pathname);
+        document.getElementById("login-form").hidden = true;
+        document.getElementById("chat").hidden = false;
+        connectWebsocket(params.get("otp"));
+    }
+};
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"arti.soft/websockets-go/wstest"
+	"github.com/gorilla/websocket"
+)
+
+// The fuzz targets feed what a client controls into the server: the frames its
+// codec decodes, the events the decoded frames are routed as and the query of the
+// upgrade. The seed corpora are in testdata/fuzz, run a target for longer with
+//
+//	go test -run '^$' -fuzz FuzzRouteEvent -fuzztime 1m
+
+// fuzzManager returns a Manager for the fuzz target, stopped when it ends
+func fuzzManager(f *testing.F) *Manager {
+	f.Helper()
+	server, m, err := NewTestServer(DefaultConfig())
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(server.Close)
+	return m
+}
+
+// samePayload compares payloads as JSON values, a missing payload is null
+func samePayload(a, b json.RawMessage) bool {
+	decode := func(raw json.RawMessage) any {
+		var v any
+		if len(raw) > 0 {
+			json.Unmarshal(raw, &v)
+		}
+		return v
+	}
+	return reflect.DeepEqual(decode(a), decode(b))
+}
+
+// fuzzCodec checks that whatever the codec decodes it can encode again, and that
+// decoding that gives the same event
+func fuzzCodec(t *testing.T, codec Codec, messageType int, data []byte) {
+	event, err := codec.Decode(messageType, data)
+	if err != nil {
+		return
+	}
+	encodedType, encoded, err := codec.Encode(event)
+	if err != nil {
+		t.Fatalf("encoding the decoded %q: %v", data, err)
+	}
+	again, err := codec.Decode(encodedType, encoded)
+	if err != nil {
+		t.Fatalf("decoding the encoded %q: %v", encoded, err)
+	}
+	if again.Type != event.Type || again.ID != event.ID || again.Room != event.Room || !samePayload(again.Payload, event.Payload) {
+		t.Fatalf("round trip of %q changed the event\nbefore: %+v\nafter:  %+v", data, event, again)
+	}
+}
+
+func FuzzJSONCodec(f *testing.F) {
+	f.Add([]byte(`{"type":"send_message","payload":{"message":"hi"}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzCodec(t, jsonCodec{}, websocket.TextMessage, data)
+	})
+}
+
+func FuzzProtoCodec(f *testing.F) {
+	for _, event := range []Event{
+		{Type: EventSendMessage, Payload: json.RawMessage(`{"message":"hi"}`)},
+		{Type: EventJoinRoom, Payload: json.RawMessage(`{"room":"general"}`), ID: "1"},
+	} {
+		data, err := marshalProtoEvent(event)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzCodec(t, protoCodec{}, websocket.BinaryMessage, data)
+	})
+}
+
+func FuzzStrictCodec(f *testing.F) {
+	codec := strictCodec{m: fuzzManager(f)}
+	f.Add([]byte(`{"id":"1","ts":"2024-01-01T00:00:00Z","type":"send_message","payload":{"message":"hi"}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzCodec(t, codec, websocket.TextMessage, data)
+	})
+}
+
+// FuzzRouteEvent routes events of any type with any payload, a handler must
+// answer garbage with an error and never panic
+func FuzzRouteEvent(f *testing.F) {
+	m := fuzzManager(f)
+	for eventType := range m.handlers {
+		f.Add(eventType, []byte(`{}`))
+		f.Add(eventType, []byte(`null`))
+	}
+	f.Fuzz(func(t *testing.T, eventType string, payload []byte) {
+		transport, peer := wstest.Pipe("")
+		defer peer.Close()
+		c := NewClient(transport, m, "fuzzer")
+		m.startClient(c)
+		defer m.removeClient(c)
+
+		m.reouteEvent(Event{Type: eventType, Payload: payload}, c)
+		// runHandler recovers, the fuzzer would not see the panic
+		if panics := c.panics.Load(); panics > 0 {
+			t.Fatalf("handler of %q panicked on %q", eventType, payload)
+		}
+	})
+}
+
+// FuzzOTPQuery upgrades with any query, without a valid OTP nobody gets in
+func FuzzOTPQuery(f *testing.F) {
+	m := fuzzManager(f)
+	f.Add("otp=")
+	f.Add("otp=" + m.newOTP("alice").Key + "x")
+	f.Fuzz(func(t *testing.T, query string) {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.URL.RawQuery = query
+		w := httptest.NewRecorder()
+		m.serveWS(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("upgrade with %q answered %d, want %d", query, w.Code, http.StatusUnauthorized)
+		}
+	})
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Operators erase everything the server keeps about a user on request, like for
+// a GDPR erasure, with POST /admin/users/{username}/erase:
+//
+//	{"mode":"delete"}                  // the messages of the user are deleted
+//	{"mode":"anonymize"}               // the messages stay, sent by [deleted]
+//	{"mode":"delete","dry_run":true}   // only reports what would be erased
+//
+// Either way the account, profile, devices, E2EE keys, scheduled messages, ban,
+// nickname, status and the other presence traces of the user are removed, the
+// reactions of the user are removed or given to [deleted], and the API keys issued
+// for the user are revoked. Audit entries about the user are deleted or have the
+// user replaced with [deleted]. Connected clients of the user get an
+// account_erased event and are disconnected. Users of the config can't be removed
+// from it, everything else about them is erased. Mentions of the user in messages
+// of others are left as they are.
+
+const (
+	// EventAccountErased is sent to the clients of a user right before they are
+	// disconnected because the user was erased
+	EventAccountErased = "account_erased"
+
+	AuditErase = "erase"
+
+	EraseDelete    = "delete"
+	EraseAnonymize = "anonymize"
+)
+
+// anonymousUser is who the messages and audit entries of anonymized users are
+// attributed to, it can't be registered as username
+const anonymousUser = "[deleted]"
+
+var (
+	ErrEraseMode = errors.New("mode must be delete or anonymize")
+)
+
+// erasedCloseDelay is how long the clients of an erased user have to receive
+// account_erased before they are disconnected
+var erasedCloseDelay = 200 * time.Millisecond
+
+// MessageErasure is what EraseMessagesFrom changed or would change
+type MessageErasure struct {
+	// Messages is how many chat messages of the user were deleted or anonymized
+	Messages int `json:"messages"`
+	// Reactions is how many messages the user had reacted to
+	Reactions int `json:"reactions"`
+}
+
+// EraseRequest is the body of POST /admin/users/{username}/erase
+type EraseRequest struct {
+	Mode   string `json:"mode"`
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+// EraseReport is the response of POST /admin/users/{username}/erase, with a dry
+// run it is what would be erased
+type EraseReport struct {
+	Mode   string `json:"mode"`
+	DryRun bool   `json:"dry_run,omitempty"`
+	MessageErasure
+	Account bool `json:"account"`
+	// ConfigUser is set if the user is defined in the config, it stays there
+	ConfigUser        bool `json:"config_user,omitempty"`
+	Profile           bool `json:"profile"`
+	Devices           int  `json:"devices"`
+	KeyBundles        int  `json:"key_bundles"`
+	PushTokens        int  `json:"push_tokens"`
+	Memberships       int  `json:"memberships"`
+	ScheduledMessages int  `json:"scheduled_messages"`
+	Ban               bool `json:"ban"`
+	APIKeys           int  `json:"api_keys"`
+	AuditEntries      int  `json:"audit_entries"`
+	// Disconnected is how many clients of the user were connected
+	Disconnected int `json:"disconnected"`
+}
+
+// AccountErasedEvent is the payload sent in the
+// account_erased event
+type AccountErasedEvent struct {
+	Message string `json:"message"`
+	// Code identifies the message for translation, see localize.go
+	Code string `json:"code"`
+}
+
+// messageAuthor returns who sent the chat message of the payload
+func messageAuthor(payload json.RawMessage) string {
+	var message struct {
+		From string `json:"from"`
+	}
+	json.Unmarshal(payload, &message)
+	return message.From
+}
+
+// anonymizeMessage returns the chat message of the payload sent by replacement,
+// without the nickname of the user
+func anonymizeMessage(payload json.RawMessage, replacement string) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+	from, _ := json.Marshal(replacement)
+	fields["from"] = from
+	delete(fields, "nickname")
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return data
+}
+
+// eraseReactions returns the reactions without the user, or with replacement instead
+// if it is set. Emojis nobody reacted with anymore are dropped. It returns false if
+// the user had not reacted
+func eraseReactions(reactions map[string][]string, username, replacement string) (map[string][]string, bool) {
+	found := false
+	for _, users := range reactions {
+		if slices.Contains(users, username) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return reactions, false
+	}
+
+	erased := make(map[string][]string, len(reactions))
+	for emoji, users := range reactions {
+		if !slices.Contains(users, username) {
+			erased[emoji] = users
+			continue
+		}
+		users = slices.DeleteFunc(slices.Clone(users), func(u string) bool { return u == username })
+		if replacement != "" {
+			users = append(users, replacement)
+		}
+		if len(users) > 0 {
+			erased[emoji] = users
+		}
+	}
+	return erased, true
+}
+
+// eraseAuditEntry returns the entry without the user, false if it is about the user
+// and has to be deleted. changed is set if the entry mentions the user
+func eraseAuditEntry(e AuditEntry, username, replacement string) (entry AuditEntry, keep bool, changed bool) {
+	if e.Actor == username {
+		e.Actor, changed = replacement, true
+	}
+	if e.Target == username {
+		e.Target, changed = replacement, true
+	}
+	if slices.Contains(slices.Collect(maps.Values(e.Details)), username) {
+		details := make(map[string]string, len(e.Details))
+		for key, value := range e.Details {
+			if value == username {
+				value = replacement
+			}
+			details[key] = value
+		}
+		e.Details, changed = details, true
+	}
+	return e, !changed || replacement != "", changed
+}
+
+// eraseUser erases the user as described at the top, with dryRun it only reports
+// what it would erase
+func (m *Manager) eraseUser(username string, req EraseRequest) (EraseReport, error) {
+	report := EraseReport{Mode: req.Mode, DryRun: req.DryRun}
+	replacement := ""
+	switch req.Mode {
+	case EraseDelete:
+	case EraseAnonymize:
+		replacement = anonymousUser
+	default:
+		return report, ErrEraseMode
+	}
+	dryRun := req.DryRun
+
+	// The clients go first, so nothing new is sent in the name of the user meanwhile
+	if !dryRun {
+		report.Disconnected = m.disconnectErased(username)
+	} else {
+		report.Disconnected = m.userClientCount(username)
+	}
+
+	var err error
+	if report.MessageErasure, err = m.store.EraseMessagesFrom(username, replacement, dryRun); err != nil {
+		return report, fmt.Errorf("erasing messages: %w", err)
+	}
+	if !dryRun {
+		m.uncacheAllRooms()
+		m.eraseFromHistories(username, replacement)
+	}
+
+	_, report.ConfigUser = m.config().Users[username]
+	if _, err := m.store.GetUser(username); err == nil {
+		report.Account = true
+		if !dryRun {
+			if err := m.store.DeleteUser(username); err != nil {
+				return report, fmt.Errorf("deleting account: %w", err)
+			}
+		}
+	}
+	if _, err := m.store.GetProfile(username); err == nil {
+		report.Profile = true
+		if !dryRun {
+			if err := m.store.DeleteProfile(username); err != nil {
+				return report, fmt.Errorf("deleting profile: %w", err)
+			}
+		}
+	}
+
+	devices, err := m.store.ListDevices(username)
+	if err != nil {
+		return report, fmt.Errorf("listing devices: %w", err)
+	}
+	report.Devices = len(devices)
+	bundles, err := m.store.ListKeyBundles(username)
+	if err != nil {
+		return report, fmt.Errorf("listing key bundles: %w", err)
+	}
+	report.KeyBundles = len(bundles)
+	tokens, err := m.store.ListPushTokens(username)
+	if err != nil {
+		return report, fmt.Errorf("listing push tokens: %w", err)
+	}
+	report.PushTokens = len(tokens)
+	memberships, err := m.store.ListMemberships(username)
+	if err != nil {
+		return report, fmt.Errorf("listing memberships: %w", err)
+	}
+	report.Memberships = len(memberships)
+	if !dryRun {
+		for _, device := range devices {
+			m.dropQoSSession(username, device.ID)
+			if err := m.store.DeleteDevice(username, device.ID); err != nil && !errors.Is(err, ErrNotFound) {
+				return report, fmt.Errorf("deleting devices: %w", err)
+			}
+		}
+		if err := m.store.DeleteKeyBundles(username); err != nil {
+			return report, fmt.Errorf("deleting key bundles: %w", err)
+		}
+		if err := m.store.DeletePushTokens(username, ""); err != nil {
+			return report, fmt.Errorf("deleting push tokens: %w", err)
+		}
+		if err := m.store.DeleteMemberships(username); err != nil {
+			return report, fmt.Errorf("deleting memberships: %w", err)
+		}
+	}
+
+	scheduled, err := m.store.ListScheduled()
+	if err != nil {
+		return report, fmt.Errorf("listing scheduled messages: %w", err)
+	}
+	for _, msg := range scheduled {
+		if msg.Author != username && msg.To != username {
+			continue
+		}
+		report.ScheduledMessages++
+		if !dryRun {
+			if err := m.store.DeleteScheduled(msg.ID); err != nil && !errors.Is(err, ErrNotFound) {
+				return report, fmt.Errorf("deleting scheduled messages: %w", err)
+			}
+		}
+	}
+
+	if banned, err := m.store.IsBanned(username); err == nil && banned {
+		report.Ban = true
+		if !dryRun {
+			if err := m.store.DeleteBan(username); err != nil && !errors.Is(err, ErrNotFound) {
+				return report, fmt.Errorf("deleting ban: %w", err)
+			}
+		}
+	}
+
+	keys, err := m.store.ListAPIKeys()
+	if err != nil {
+		return report, fmt.Errorf("listing api keys: %w", err)
+	}
+	for _, key := range keys {
+		if key.Username != username || key.Revoked != nil {
+			continue
+		}
+		report.APIKeys++
+		if !dryRun {
+			if _, err := m.revokeAPIKey(key.ID, "admin"); err != nil {
+				return report, fmt.Errorf("revoking api keys: %w", err)
+			}
+		}
+	}
+
+	if !dryRun {
+		m.erasePresence(username)
+	}
+
+	// The audit log goes last, so the entries of the steps above are erased as well
+	err = m.auditLog.Rewrite(func(e AuditEntry) (AuditEntry, bool) {
+		erased, keep, changed := eraseAuditEntry(e, username, replacement)
+		if changed {
+			report.AuditEntries++
+		}
+		if dryRun {
+			return e, true
+		}
+		return erased, keep
+	})
+	if err != nil {
+		return report, fmt.Errorf("erasing audit entries: %w", err)
+	}
+	return report, nil
+}
+
+// userClientCount returns how many clients of the user are connected
+func (m *Manager) userClientCount(username string) int {
+	m.RLock()
+	defer m.RUnlock()
+	count := 0
+	for client := range m.clients {
+		if client.username == username {
+			count++
+		}
+	}
+	return count
+}
+
+// disconnectErased tells the clients of the user that the user was erased and
+// disconnects them, it returns how many there were
+func (m *Manager) disconnectErased(username string) int {
+	data, _ := json.Marshal(AccountErasedEvent{Message: m.localized("account_erased", nil), Code: "account_erased"})
+	event := Event{Type: EventAccountErased, Payload: data}
+
+	var erased []*Client
+	m.RLock()
+	for client := range m.clients {
+		if client.username == username {
+			client.sendPriority(event)
+			erased = append(erased, client)
+		}
+	}
+	m.RUnlock()
+	if len(erased) == 0 {
+		return 0
+	}
+
+	// Closing the connection right away would drop the event
+	time.Sleep(erasedCloseDelay)
+	for _, client := range erased {
+		m.removeClient(client)
+	}
+	return len(erased)
+}
+
+// eraseFromHistories applies the erasure to the history of the rooms kept in
+// memory. Anonymized messages are rewritten in place, deleted ones can't leave a
+// gap, so the history is cut after the last deleted message
+func (m *Manager) eraseFromHistories(username, replacement string) {
+	m.roomsLock.Lock()
+	rooms := make([]*roomState, 0, len(m.rooms))
+	for _, r := range m.rooms {
+		rooms = append(rooms, r)
+	}
+	m.roomsLock.Unlock()
+
+	for _, r := range rooms {
+		r.Lock()
+		last := -1
+		for i, event := range r.history {
+			if event.Type != EventNewMessage || messageAuthor(event.Payload) != username {
+				continue
+			}
+			if replacement == "" {
+				last = i
+				continue
+			}
+			r.history[i].Payload = anonymizeMessage(event.Payload, replacement)
+		}
+		if last >= 0 {
+			r.history = append([]Event{}, r.history[last+1:]...)
+		}
+		r.Unlock()
+	}
+}
+
+// erasePresence forgets what the manager keeps in memory about the user
+func (m *Manager) erasePresence(username string) {
+	m.setNickname(username, "")
+	m.presenceLock.Lock()
+	delete(m.away, username)
+	delete(m.statuses, username)
+	m.presenceLock.Unlock()
+	m.loginFailures.Delete(loginFailureKey{kind: "user", value: username})
+}
+
+// eraseHandler erases a user, like {"mode":"anonymize","dry_run":true}
+func (m *Manager) eraseHandler(w http.ResponseWriter, r *http.Request) {
+	var req EraseRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := m.eraseUser(r.PathValue("username"), req)
+	if errors.Is(err, ErrEraseMode) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The erased user is left out of the entry, it would undo the erasure
+	if !req.DryRun {
+		m.audit(AuditEntry{
+			Action:     AuditErase,
+			Actor:      "admin",
+			RemoteAddr: r.RemoteAddr,
+			Details:    map[string]string{"mode": req.Mode, "messages": strconv.Itoa(report.Messages)},
+		})
+	}
+	writeJSON(w, http.StatusOK, report)
+}
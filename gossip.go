@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Listing every instance in cluster.peers doesn't work when instances come and go
+// with autoscaling. With cluster.gossip an instance only needs the address of a
+// few others, the seeds, and finds the rest through them:
+//
+//	"cluster": {
+//	    "node_id": "ws-4",
+//	    "secret":  "...",
+//	    "gossip":  {"advertise_url": "http://10.0.0.4:8080", "bind": ":7946", "seeds": ["ws-1:7946"]}
+//	}
+//
+// The members are found and checked by hashicorp/memberlist, which gossips over
+// UDP and TCP on gossip.bind, encrypted with a key derived from cluster.secret. A
+// member carries the URL of its HTTP and its health, ready and draining, in its
+// metadata, so a new instance is a peer of the others right away. Every
+// cluster.gossip.interval memberlist exchanges the full state with a random
+// member, where each instance adds a digest of its clients: how many it has, in
+// which rooms, and the users connected. Both keep the newest digest of every
+// member. GET /admin/cluster/overview adds those up into the view of the whole
+// cluster.
+//
+// The members found are peers of the cluster, owning rooms, see cluster.go. A
+// member memberlist finds dead, or that left, is down and its rooms move, it is
+// forgotten after gossipForgetAfter. The digests are versioned by a heartbeat
+// that starts from the time the instance started, so it goes on rising when an
+// instance restarts.
+
+// gossipForgetAfter is how long a member that is down stays in the list
+var gossipForgetAfter = 5 * time.Minute
+
+// gossipDefaultPort is the port memberlist binds to without one in gossip.bind
+const gossipDefaultPort = 7946
+
+// GossipHealth is the health of a member
+type GossipHealth struct {
+	// Ready is false if a readiness check failed, see health.go
+	Ready    bool   `json:"ready"`
+	Draining bool   `json:"draining"`
+	Region   string `json:"region,omitempty"`
+}
+
+// GossipDigest sums up the clients of a member
+type GossipDigest struct {
+	Clients int `json:"clients"`
+	// Rooms holds how many clients are in each room
+	Rooms map[string]int `json:"rooms"`
+	// Users are the usernames with connected clients, sorted
+	Users []string `json:"users"`
+}
+
+// GossipMember is an instance as known by gossip
+type GossipMember struct {
+	ID        string       `json:"id"`
+	URL       string       `json:"url"`
+	Heartbeat uint64       `json:"heartbeat"`
+	Health    GossipHealth `json:"health"`
+	Digest    GossipDigest `json:"digest"`
+
+	// up is set while memberlist has the member alive
+	up bool
+	// updated is when the member last changed here
+	updated time.Time
+}
+
+// gossipMeta is the metadata of a member in memberlist, it has to fit memberlist.MetaMaxSize
+type gossipMeta struct {
+	URL    string       `json:"url"`
+	Health GossipHealth `json:"health"`
+}
+
+// gossip is the list of the members as known to this instance
+type gossip struct {
+	memberlist *memberlist.Memberlist
+
+	sync.Mutex
+	members map[string]*GossipMember
+}
+
+// newGossip starts memberlist for the config, or returns nil if gossip is off.
+// Joining the seeds is left to runGossip, they may not be up yet
+func (m *Manager) newGossip(config ClusterConfig) (*gossip, error) {
+	if config.Gossip.AdvertiseURL == "" {
+		return nil, nil
+	}
+	for _, seed := range config.Gossip.Seeds {
+		if strings.Contains(seed, "://") {
+			return nil, fmt.Errorf("%w: gossip seed %s has to be the host:port of its gossip.bind, not a URL", ErrInvalidCluster, seed)
+		}
+	}
+
+	now := m.now()
+	g := &gossip{members: map[string]*GossipMember{
+		config.NodeID: {ID: config.NodeID, URL: config.Gossip.AdvertiseURL, Heartbeat: uint64(now.UnixMilli()), up: true, updated: now},
+	}}
+	// memberlist calls back while it is created, the gossip has to be in place
+	m.gossip = g
+
+	conf := memberlist.DefaultLANConfig()
+	conf.Name = config.NodeID
+	if err := splitGossipAddress(config.Gossip.Bind, &conf.BindAddr, &conf.BindPort); err != nil {
+		return nil, err
+	}
+	conf.AdvertisePort = conf.BindPort
+	if config.Gossip.Advertise != "" {
+		if err := splitGossipAddress(config.Gossip.Advertise, &conf.AdvertiseAddr, &conf.AdvertisePort); err != nil {
+			return nil, err
+		}
+	}
+	if interval := time.Duration(config.Gossip.Interval); interval > 0 {
+		conf.PushPullInterval = interval
+	}
+	if config.Gossip.Fanout > 0 {
+		conf.GossipNodes = config.Gossip.Fanout
+	}
+	// Instances of other clusters, or without the secret, can't take part
+	key := sha256.Sum256([]byte("gossip:" + config.Secret))
+	conf.SecretKey = key[:]
+	conf.Delegate = gossipDelegate{m}
+	conf.Events = gossipDelegate{m}
+	conf.LogOutput = memberlistLog{}
+
+	list, err := memberlist.Create(conf)
+	if err != nil {
+		return nil, fmt.Errorf("gossip: %w", err)
+	}
+	g.memberlist = list
+	return g, nil
+}
+
+// splitGossipAddress parses a host:port, the port defaults to gossipDefaultPort
+func splitGossipAddress(address string, host *string, port *int) error {
+	if address == "" {
+		*port = gossipDefaultPort
+		return nil
+	}
+	h, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: gossip address %s: %v", ErrInvalidCluster, address, err)
+	}
+	if h != "" {
+		*host = h
+	}
+	if *port, err = strconv.Atoi(p); err != nil {
+		return fmt.Errorf("%w: gossip address %s: %v", ErrInvalidCluster, address, err)
+	}
+	return nil
+}
+
+// memberlistLog writes the logs of memberlist to the log, without its debug lines
+type memberlistLog struct{}
+
+func (memberlistLog) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("[DEBUG]")) {
+		return len(p), nil
+	}
+	return log.Writer().Write(p)
+}
+
+// list returns copies of the members
+func (g *gossip) list() []GossipMember {
+	g.Lock()
+	defer g.Unlock()
+	members := make([]GossipMember, 0, len(g.members))
+	for _, member := range g.members {
+		members = append(members, *member)
+	}
+	return members
+}
+
+// gossipDelegate hooks the Manager into memberlist, as its Delegate and EventDelegate
+type gossipDelegate struct {
+	m *Manager
+}
+
+// NodeMeta is the URL and health of this instance
+func (d gossipDelegate) NodeMeta(limit int) []byte {
+	m := d.m
+	m.gossip.Lock()
+	self := m.gossip.members[m.cluster.self]
+	data, err := json.Marshal(gossipMeta{URL: self.URL, Health: self.Health})
+	m.gossip.Unlock()
+	if err != nil || len(data) > limit {
+		log.Printf("gossip: metadata of %d bytes doesn't fit %d", len(data), limit)
+		return nil
+	}
+	return data
+}
+
+// NotifyMsg is not used, the digests go with the state
+func (gossipDelegate) NotifyMsg([]byte) {}
+
+// GetBroadcasts is not used, the digests go with the state
+func (gossipDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+
+// LocalState is the digests known to this instance, exchanged with a random member
+// every interval
+func (d gossipDelegate) LocalState(join bool) []byte {
+	data, err := json.Marshal(d.m.gossip.list())
+	if err != nil {
+		log.Printf("gossip: %v", err)
+		return nil
+	}
+	return data
+}
+
+// MergeRemoteState keeps the newest digest of every member
+func (d gossipDelegate) MergeRemoteState(buf []byte, join bool) {
+	var members []GossipMember
+	if err := json.Unmarshal(buf, &members); err != nil {
+		log.Printf("gossip: bad state: %v", err)
+		return
+	}
+	d.m.mergeGossip(members)
+}
+
+// NotifyJoin makes a member that is alive a peer of the cluster
+func (d gossipDelegate) NotifyJoin(node *memberlist.Node) {
+	d.m.memberAlive(node)
+}
+
+// NotifyUpdate takes the new URL and health of a member
+func (d gossipDelegate) NotifyUpdate(node *memberlist.Node) {
+	d.m.memberAlive(node)
+}
+
+// NotifyLeave takes a member that is dead or left off the ring
+func (d gossipDelegate) NotifyLeave(node *memberlist.Node) {
+	m := d.m
+	if node.Name == m.cluster.self {
+		return
+	}
+	m.gossip.Lock()
+	if member, ok := m.gossip.members[node.Name]; ok {
+		member.up = false
+		member.updated = m.now()
+	}
+	m.gossip.Unlock()
+	m.cluster.markDown(node.Name)
+}
+
+// memberAlive records the metadata of the member and makes it a peer
+func (m *Manager) memberAlive(node *memberlist.Node) {
+	if node.Name == m.cluster.self {
+		return
+	}
+	var meta gossipMeta
+	if err := json.Unmarshal(node.Meta, &meta); err != nil || meta.URL == "" {
+		log.Printf("gossip: %s has no URL in its metadata", node.Name)
+		return
+	}
+	now := m.now()
+	m.gossip.Lock()
+	member, ok := m.gossip.members[node.Name]
+	if !ok {
+		member = &GossipMember{ID: node.Name}
+		m.gossip.members[node.Name] = member
+	}
+	member.URL, member.Health, member.up, member.updated = meta.URL, meta.Health, true, now
+	m.gossip.Unlock()
+
+	if m.cluster.addPeer(node.Name, meta.URL, now) {
+		log.Printf("gossip: found %s at %s", node.Name, meta.URL)
+	}
+	m.cluster.seen(node.Name, now)
+}
+
+// refreshSelf increments the heartbeat of this instance and updates its health and
+// digest, memberlist is told when the health changed
+func (m *Manager) refreshSelf(ctx context.Context) {
+	_, ready := m.checkReadiness(ctx)
+	health := GossipHealth{Ready: ready, Draining: m.draining.Load(), Region: m.config().Region}
+
+	digest := GossipDigest{Rooms: make(map[string]int)}
+	users := make(map[string]bool)
+	m.RLock()
+	digest.Clients = len(m.clients)
+	for client := range m.clients {
+		digest.Rooms[client.room]++
+		users[client.username] = true
+	}
+	m.RUnlock()
+	digest.Users = slices.Sorted(maps.Keys(users))
+
+	now := m.now()
+	m.gossip.Lock()
+	self := m.gossip.members[m.cluster.self]
+	changed := self.Health != health
+	self.Heartbeat++
+	self.Health = health
+	self.Digest = digest
+	self.updated = now
+	m.gossip.Unlock()
+
+	if changed && m.gossip.memberlist != nil {
+		if err := m.gossip.memberlist.UpdateNode(time.Second); err != nil {
+			log.Printf("gossip: %v", err)
+		}
+	}
+}
+
+// mergeGossip keeps the newest digest of every member, whether a member is up is
+// up to memberlist
+func (m *Manager) mergeGossip(members []GossipMember) {
+	now := m.now()
+	m.gossip.Lock()
+	defer m.gossip.Unlock()
+	for _, member := range members {
+		if member.ID == "" || member.ID == m.cluster.self {
+			continue
+		}
+		known, ok := m.gossip.members[member.ID]
+		if !ok || member.Heartbeat <= known.Heartbeat {
+			// Members come from memberlist, a digest of one it doesn't know yet waits for the next exchange
+			continue
+		}
+		known.Heartbeat = member.Heartbeat
+		known.Digest = member.Digest
+		known.updated = now
+	}
+}
+
+// expireGossip forgets the members down for gossipForgetAfter
+func (m *Manager) expireGossip() {
+	now := m.now()
+	var forgotten []string
+
+	m.gossip.Lock()
+	for id, member := range m.gossip.members {
+		if !member.up && now.Sub(member.updated) > gossipForgetAfter {
+			delete(m.gossip.members, id)
+			forgotten = append(forgotten, id)
+		}
+	}
+	m.gossip.Unlock()
+
+	for _, id := range forgotten {
+		// Peers of the config stay, they are expected to come back
+		if _, static := m.config().Cluster.Peers[id]; !static {
+			m.cluster.removePeer(id)
+			log.Printf("gossip: forgot %s", id)
+		}
+	}
+}
+
+// runGossip refreshes the digest of this instance at the gossip interval and joins
+// the seeds while it knows no other member
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runGossip(ctx context.Context) {
+	defer func() {
+		// Tell the others, so they don't wait for the failure detection
+		if err := m.gossip.memberlist.Leave(time.Second); err != nil {
+			log.Printf("gossip: leaving: %v", err)
+		}
+		m.gossip.memberlist.Shutdown()
+	}()
+	for {
+		m.refreshSelf(ctx)
+		if seeds := m.config().Cluster.Gossip.Seeds; len(seeds) > 0 && m.gossip.memberlist.NumMembers() < 2 {
+			if _, err := m.gossip.memberlist.Join(seeds); err != nil {
+				log.Printf("gossip: joining %v: %v", seeds, err)
+			}
+		}
+		m.expireGossip()
+
+		// The interval is read every time so a config reload applies to the next run
+		interval := time.Duration(m.config().Cluster.Gossip.Interval)
+		if interval <= 0 {
+			interval = time.Second
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ClusterOverview is the whole cluster as returned by GET /admin/cluster/overview
+type ClusterOverview struct {
+	Members []ClusterMemberOverview `json:"members"`
+	// Clients are the clients of the members that are up
+	Clients int `json:"clients"`
+	// Rooms holds how many clients are in each room on the members that are up
+	Rooms map[string]int `json:"rooms"`
+	// Users holds the members each connected user has clients on
+	Users map[string][]string `json:"users"`
+}
+
+// ClusterMemberOverview is a member in the overview
+type ClusterMemberOverview struct {
+	ID       string       `json:"id"`
+	URL      string       `json:"url"`
+	Up       bool         `json:"up"`
+	Health   GossipHealth `json:"health"`
+	Clients  int          `json:"clients"`
+	LastSeen time.Time    `json:"last_seen"`
+}
+
+// clusterOverviewHandler adds up the digests of the members that are up
+func (m *Manager) clusterOverviewHandler(w http.ResponseWriter, r *http.Request) {
+	if m.gossip == nil {
+		http.Error(w, "gossip is off", http.StatusNotFound)
+		return
+	}
+	m.refreshSelf(r.Context())
+
+	members := m.gossip.list()
+	slices.SortFunc(members, func(a, b GossipMember) int { return strings.Compare(a.ID, b.ID) })
+	overview := ClusterOverview{Members: []ClusterMemberOverview{}, Rooms: make(map[string]int), Users: make(map[string][]string)}
+	for _, member := range members {
+		up := member.ID == m.cluster.self || member.up
+		overview.Members = append(overview.Members, ClusterMemberOverview{
+			ID:       member.ID,
+			URL:      member.URL,
+			Up:       up,
+			Health:   member.Health,
+			Clients:  member.Digest.Clients,
+			LastSeen: member.updated,
+		})
+		if !up {
+			continue
+		}
+		overview.Clients += member.Digest.Clients
+		for room, clients := range member.Digest.Rooms {
+			overview.Rooms[room] += clients
+		}
+		for _, username := range member.Digest.Users {
+			overview.Users[username] = append(overview.Users[username], member.ID)
+		}
+	}
+	writeJSON(w, http.StatusOK, overview)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestGossipFindsTheMembers(t *testing.T) {
+	nodes := []string{"ws-1", "ws-2"}
+	gossipAddresses := map[string]string{"ws-1": freeRaftAddress(t), "ws-2": freeRaftAddress(t)}
+
+	var managers []*Manager
+	for _, node := range nodes {
+		mux := http.NewServeMux()
+		backplane := httptest.NewServer(mux)
+		t.Cleanup(backplane.Close)
+
+		config := DefaultConfig()
+		config.Cluster.NodeID = node
+		config.Cluster.Secret = "backplane"
+		config.Cluster.Gossip.AdvertiseURL = backplane.URL
+		config.Cluster.Gossip.Bind = gossipAddresses[node]
+		config.Cluster.Gossip.Interval = Duration(100 * time.Millisecond)
+		// ws-2 only knows ws-1, ws-1 waits to be found
+		if node == "ws-2" {
+			config.Cluster.Gossip.Seeds = []string{gossipAddresses["ws-1"]}
+		}
+		server, m, err := NewTestServer(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(server.Close)
+		m.registerClusterHandlers(newRoutes(mux, ""))
+		if node == "ws-2" {
+			server.Connect("bob")
+		}
+		managers = append(managers, m)
+	}
+
+	// ws-1 learns of ws-2 and, with the next exchange, of the clients on it
+	deadline := time.Now().Add(10 * time.Second)
+	for len(managers[0].remoteUserNodes("bob")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ws-1 didn't find bob on ws-2, members %+v", managers[0].gossip.list())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	url, ok := managers[0].cluster.peerURL("ws-2")
+	if !ok || url != managers[0].remoteUserNodes("bob")["ws-2"] {
+		t.Errorf("ws-2 is peer %q of ws-1, want its advertise url", url)
+	}
+	if _, ok := managers[1].cluster.peerURL("ws-1"); !ok {
+		t.Error("ws-1 is not a peer of ws-2")
+	}
+
+	w := httptest.NewRecorder()
+	managers[0].clusterOverviewHandler(w, httptest.NewRequest(http.MethodGet, "/admin/cluster/overview", nil))
+	var overview ClusterOverview
+	if err := json.Unmarshal(w.Body.Bytes(), &overview); err != nil {
+		t.Fatalf("overview: %d %s", w.Code, w.Body)
+	}
+	if len(overview.Members) != 2 || overview.Clients != 1 || len(overview.Users["bob"]) != 1 || overview.Users["bob"][0] != "ws-2" {
+		t.Errorf("overview is %+v, want 2 members and bob on ws-2", overview)
+	}
+}
+
+func TestGossipKeepsTheNewestDigest(t *testing.T) {
+	config := DefaultConfig()
+	config.Cluster.NodeID = "ws-1"
+	config.Cluster.Secret = "backplane"
+	clock := NewManualClock(time.Now())
+	server, m, err := NewTestServer(config, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// The members are handed in like memberlist does, without gossiping
+	m.gossip = &gossip{members: map[string]*GossipMember{
+		"ws-1": {ID: "ws-1", URL: "http://ws-1.test", up: true, updated: clock.Now()},
+	}}
+
+	meta, _ := json.Marshal(gossipMeta{URL: "http://ws-2.test", Health: GossipHealth{Ready: true}})
+	gossipDelegate{m}.NotifyJoin(&memberlist.Node{Name: "ws-2", Meta: meta})
+	if url, ok := m.cluster.peerURL("ws-2"); !ok || url != "http://ws-2.test" {
+		t.Fatalf("ws-2 is peer %q, want the url of its metadata", url)
+	}
+
+	m.mergeGossip([]GossipMember{
+		{ID: "ws-2", Heartbeat: 5, Digest: GossipDigest{Clients: 1, Users: []string{"bob"}}},
+		// A member memberlist doesn't know yet waits for it
+		{ID: "ws-3", Heartbeat: 1, Digest: GossipDigest{Clients: 1, Users: []string{"carol"}}},
+	})
+	// An older digest is late, it doesn't replace the newer one
+	m.mergeGossip([]GossipMember{{ID: "ws-2", Heartbeat: 3, Digest: GossipDigest{}}})
+	if nodes := m.remoteUserNodes("bob"); nodes["ws-2"] != "http://ws-2.test" {
+		t.Errorf("bob is on %v, want ws-2", nodes)
+	}
+	if nodes := m.remoteUserNodes("carol"); len(nodes) != 0 {
+		t.Errorf("carol is on %v of a member that isn't known", nodes)
+	}
+
+	// A member that left stays listed as down, then is forgotten
+	gossipDelegate{m}.NotifyLeave(&memberlist.Node{Name: "ws-2"})
+	for _, member := range m.gossip.list() {
+		if member.ID == "ws-2" && member.up {
+			t.Error("ws-2 is up after it left")
+		}
+	}
+	clock.Advance(gossipForgetAfter + time.Second)
+	m.expireGossip()
+	if len(m.gossip.list()) != 1 {
+		t.Errorf("members are %+v after %s, want ws-1 only", m.gossip.list(), gossipForgetAfter)
+	}
+	if _, ok := m.cluster.peerURL("ws-2"); ok {
+		t.Error("ws-2 is still a peer after it was forgotten")
+	}
+}
+
+func TestGossipSeedIsNotAURL(t *testing.T) {
+	config := DefaultConfig()
+	config.Cluster.NodeID = "ws-1"
+	config.Cluster.Secret = "backplane"
+	config.Cluster.Gossip.AdvertiseURL = "http://ws-1.test"
+	config.Cluster.Gossip.Bind = freeRaftAddress(t)
+	config.Cluster.Gossip.Seeds = []string{"http://ws-2:7946"}
+	if _, _, err := NewTestServer(config); !errors.Is(err, ErrInvalidCluster) {
+		t.Errorf("a URL as seed: %v, want %v", err, ErrInvalidCluster)
+	}
+}
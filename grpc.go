@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"arti.soft/websockets-go/backendpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// This file holds the gRPC API described in grpc.proto, used by backend services
+// to push events to connected users and observe what the clients are doing.
+// The messages, the service descriptor and a client are generated into package
+// backendpb, see protogen.
+
+//go:generate go run ./cmd/protogen -in grpc.proto -out backendpb/backend_gen.go -package backendpb -grpc
+
+// backendServer implements the Backend gRPC service on top of the Manager
+type backendServer struct {
+	manager *Manager
+}
+
+// PublishEvent sends the event to the user, or all clients if no user is set
+func (s *backendServer) PublishEvent(_ context.Context, req *backendpb.PublishEventRequest) (*backendpb.PublishEventResponse, error) {
+	if req.Type == "" {
+		return nil, status.Error(codes.InvalidArgument, "type is required")
+	}
+	// A payload that isn't JSON can't be encoded for any client
+	if len(req.Payload) > 0 && !json.Valid(req.Payload) {
+		return nil, status.Error(codes.InvalidArgument, "payload is not JSON")
+	}
+
+	event := Event{Type: req.Type, Payload: req.Payload}
+
+	var delivered int
+	if req.User != "" {
+		delivered = s.manager.sendToUser(req.User, event)
+	} else {
+		delivered = s.manager.broadcast(event)
+	}
+	return &backendpb.PublishEventResponse{Delivered: int64(delivered)}, nil
+}
+
+// SubscribeEvents streams client events until the backend disconnects
+func (s *backendServer) SubscribeEvents(req *backendpb.SubscribeEventsRequest, stream backendpb.BackendSubscribeEventsServer) error {
+	events, stop := s.manager.observe()
+	defer stop()
+
+	for {
+		select {
+		case observed := <-events:
+			if len(req.Types) > 0 && !slices.Contains(req.Types, observed.Event.Type) {
+				continue
+			}
+			err := stream.Send(&backendpb.ObservedEvent{
+				ClientID: observed.ClientID,
+				Username: observed.Username,
+				Type:     observed.Event.Type,
+				Payload:  observed.Event.Payload,
+			})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// ListClients returns all connected clients
+func (s *backendServer) ListClients(_ context.Context, _ *backendpb.ListClientsRequest) (*backendpb.ListClientsResponse, error) {
+	s.manager.RLock()
+	defer s.manager.RUnlock()
+
+	resp := &backendpb.ListClientsResponse{}
+	for client := range s.manager.clients {
+		resp.Clients = append(resp.Clients, &backendpb.ClientInfo{ID: client.id, Username: client.username})
+	}
+	return resp, nil
+}
+
+// KickClient disconnects the client with the given id
+func (s *backendServer) KickClient(ctx context.Context, req *backendpb.KickClientRequest) (*backendpb.KickClientResponse, error) {
+	client, ok := s.manager.findClient(req.ID)
+	if !ok {
+		return &backendpb.KickClientResponse{Kicked: false}, nil
+	}
+	s.manager.removeClient(client)
+
+	s.manager.audit(AuditEntry{
+		Action:  AuditKick,
+		Actor:   grpcPeerName(ctx),
+		Target:  client.username,
+		Details: map[string]string{"client_id": client.id, "via": "grpc"},
+	})
+	return &backendpb.KickClientResponse{Kicked: true}, nil
+}
+
+// grpcPeerName returns the common name of the client certificate of the backend calling
+func grpcPeerName(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return p.Addr.String()
+	}
+	return info.State.PeerCertificates[0].Subject.CommonName
+}
+
+// newGRPCServer creates the gRPC server for backend services
+// Backends have to present a client certificate signed by the CA, so the
+// server is secured by mTLS
+func newGRPCServer(m *Manager, certFile, keyFile, caFile string) (*grpc.Server, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("grpc requires a certificate, key and client CA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	creds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	return newBackendGRPCServer(m, grpc.Creds(creds)), nil
+}
+
+// newBackendGRPCServer creates the gRPC server with the Backend service
+func newBackendGRPCServer(m *Manager, options ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(append(options, grpc.ForceServerCodec(backendpb.Codec{}))...)
+	backendpb.RegisterBackendServer(server, &backendServer{manager: m})
+	return server
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"arti.soft/websockets-go/backendpb"
+	"arti.soft/websockets-go/wstest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCTestServer serves the Backend service of a test server over an in-memory listener
+func newGRPCTestServer(t *testing.T) (*wstest.Server, *Manager, backendpb.BackendClient) {
+	t.Helper()
+	server, m, err := NewTestServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := newBackendGRPCServer(m)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(backendpb.Codec{})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return server, m, backendpb.NewBackendClient(conn)
+}
+
+func TestGRPCPublishEvent(t *testing.T) {
+	server, _, backend := newGRPCTestServer(t)
+	alice := server.Connect("alice")
+	bob := server.Connect("bob")
+
+	resp, err := backend.PublishEvent(context.Background(), &backendpb.PublishEventRequest{
+		User:    "alice",
+		Type:    "order_shipped",
+		Payload: []byte(`{"order":"42"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Delivered != 1 {
+		t.Errorf("delivered to %d clients, want 1", resp.Delivered)
+	}
+	var shipped struct {
+		Order string `json:"order"`
+	}
+	if err := alice.ExpectPayload("order_shipped", &shipped, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if shipped.Order != "42" {
+		t.Errorf("order is %q, want 42", shipped.Order)
+	}
+	if err := bob.ExpectNone("order_shipped", 50*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGRPCPublishEventInvalid(t *testing.T) {
+	server, _, backend := newGRPCTestServer(t)
+	alice := server.Connect("alice")
+
+	for name, req := range map[string]*backendpb.PublishEventRequest{
+		"no type":      {User: "alice", Payload: []byte(`{}`)},
+		"invalid JSON": {User: "alice", Type: "order_shipped", Payload: []byte(`{"order":`)},
+		"not JSON":     {User: "alice", Type: "order_shipped", Payload: []byte("order 42")},
+	} {
+		_, err := backend.PublishEvent(context.Background(), req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: %v, want %v", name, err, codes.InvalidArgument)
+		}
+	}
+	if err := alice.ExpectNone("order_shipped", 50*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGRPCSubscribeEvents(t *testing.T) {
+	server, m, backend := newGRPCTestServer(t)
+	alice := server.Connect("alice")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := backend.SubscribeEvents(ctx, &backendpb.SubscribeEventsRequest{Types: []string{EventSendMessage}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stream is open once the server observes the clients
+	for {
+		m.RLock()
+		observing := len(m.observers) > 0
+		m.RUnlock()
+		if observing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := alice.Send(EventGetHistory, GetHistoryEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Send(EventSendMessage, SendMessageEvent{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	observed, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if observed.Type != EventSendMessage || observed.Username != "alice" || observed.ClientID != alice.ID {
+		t.Errorf("observed %+v, want the send_message of alice", observed)
+	}
+}
+
+func TestGRPCListAndKickClients(t *testing.T) {
+	server, m, backend := newGRPCTestServer(t)
+	alice := server.Connect("alice")
+
+	list, err := backend.ListClients(context.Background(), &backendpb.ListClientsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Clients) != 1 || list.Clients[0].ID != alice.ID || list.Clients[0].Username != "alice" {
+		t.Fatalf("clients are %+v, want alice", list.Clients)
+	}
+
+	kicked, err := backend.KickClient(context.Background(), &backendpb.KickClientRequest{ID: alice.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kicked.Kicked {
+		t.Error("alice was not kicked")
+	}
+	if _, ok := m.clientByID(alice.ID); ok {
+		t.Error("alice is still connected")
+	}
+
+	kicked, err = backend.KickClient(context.Background(), &backendpb.KickClientRequest{ID: alice.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kicked.Kicked {
+		t.Error("a client that isn't connected was kicked")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// With guests enabled, POST /guest hands out an OTP for a made up user, so demos
+// and public drop-in rooms work without an account. Guests get a username like
+// guest-3f9a1c2e and a nickname like "Quiet Otter 42" others see instead, can
+// only use the rooms listed in guests.rooms and have their own, usually lower,
+// rate limit. Every call makes a new guest, a guest that reconnects is someone
+// new. The guest- prefix can't be registered, so guests can't pass as users.
+
+const (
+	// guestPrefix starts the usernames of guests
+	guestPrefix = "guest-"
+)
+
+var (
+	ErrGuestsDisabled = errors.New("guest access is disabled")
+	ErrReservedName   = errors.New("usernames starting with guest- are reserved for guests")
+	ErrGuestRoom      = errors.New("guests are not allowed in the room")
+)
+
+var (
+	guestAdjectives = []string{"Quiet", "Brave", "Curious", "Gentle", "Happy", "Lucky", "Clever", "Sunny", "Swift", "Witty", "Calm", "Bold"}
+	guestAnimals    = []string{"Otter", "Fox", "Panda", "Owl", "Koala", "Lynx", "Heron", "Badger", "Dolphin", "Falcon", "Hedgehog", "Tiger"}
+)
+
+// GuestResponse is the answer to POST /guest
+type GuestResponse struct {
+	OTP      string `json:"otp"`
+	Username string `json:"username"`
+	Nickname string `json:"nickname"`
+	// Rooms are the rooms the guest may use, the first is where it starts
+	Rooms []string `json:"rooms"`
+}
+
+// isGuest returns true if the username belongs to a guest
+func isGuest(username string) bool {
+	return strings.HasPrefix(username, guestPrefix)
+}
+
+// newGuestName returns a random guest username
+func newGuestName() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return guestPrefix + hex.EncodeToString(id)
+}
+
+// guestNickname returns the nickname of the guest, it is made from the username so
+// it doesn't have to be kept anywhere
+func guestNickname(username string) string {
+	id, err := hex.DecodeString(strings.TrimPrefix(username, guestPrefix))
+	if err != nil || len(id) < 4 {
+		return ""
+	}
+	number := binary.BigEndian.Uint16(id[2:4]) % 100
+	return fmt.Sprintf("%s %s %d", guestAdjectives[int(id[0])%len(guestAdjectives)], guestAnimals[int(id[1])%len(guestAnimals)], number)
+}
+
+// guestHandler issues an OTP for a new guest
+func (m *Manager) guestHandler(w http.ResponseWriter, r *http.Request) {
+	config := m.config().Guests
+	if !config.Enabled || len(config.Rooms) == 0 {
+		http.Error(w, ErrGuestsDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	username := newGuestName()
+	nickname := m.nickname(username)
+	otp := m.newOTP(username)
+	m.audit(AuditEntry{Action: AuditLogin, Actor: username, RemoteAddr: r.RemoteAddr, Details: map[string]string{"method": "guest"}})
+
+	writeJSON(w, http.StatusOK, GuestResponse{OTP: otp.Key, Username: username, Nickname: nickname, Rooms: config.Rooms})
+}
+
+// guestAllowsRoom returns true if guests may use the room
+func (m *Manager) guestAllowsRoom(room string) bool {
+	return slices.Contains(m.config().Guests.Rooms, room)
+}
+
+// rateLimit returns the rate limit of the client, guests have their own if it is set
+func (c *Client) rateLimit() RateLimitConfig {
+	config := c.manager.config()
+	if c.guest && config.Guests.RateLimit.EventsPerSecond > 0 {
+		return config.Guests.RateLimit
+	}
+	return config.RateLimit
+}
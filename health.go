@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrDraining = errors.New("server is draining")
+)
+
+// readinessTimeout is how long all readiness checks together may take
+var readinessTimeout = 2 * time.Second
+
+// ReadinessCheck reports if a dependency of the server is usable
+type ReadinessCheck func(ctx context.Context) error
+
+// healthStatus is the JSON body returned by the health endpoints
+type healthStatus struct {
+	Status string `json:"status"`
+	// Checks holds the result of every readiness check, "ok" or the error
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// addReadinessCheck registers a check that has to pass for the server to be ready
+// Only call it during setup, the checks are not protected by a lock
+func (m *Manager) addReadinessCheck(name string, check ReadinessCheck) {
+	m.readinessChecks[name] = check
+}
+
+// healthzHandler reports that the process is alive, it does no checks
+func (m *Manager) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// readyzHandler reports if the server can take traffic, which requires all
+// readiness checks to pass and the server not to be draining
+func (m *Manager) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status, ready := m.checkReadiness(r.Context())
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+// checkReadiness runs the readiness checks, it returns false if one failed or the
+// server is draining
+func (m *Manager) checkReadiness(ctx context.Context) (healthStatus, bool) {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	status := healthStatus{Status: "ok", Checks: make(map[string]string)}
+	ready := true
+
+	if m.draining.Load() {
+		status.Checks["drain"] = ErrDraining.Error()
+		ready = false
+	} else {
+		status.Checks["drain"] = "ok"
+	}
+
+	for name, check := range m.readinessChecks {
+		if err := check(ctx); err != nil {
+			status.Checks[name] = err.Error()
+			ready = false
+			continue
+		}
+		status.Checks[name] = "ok"
+	}
+
+	if !ready {
+		status.Status = "unavailable"
+	}
+	return status, ready
+}
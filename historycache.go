@@ -0,0 +1,158 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// After a deploy or a network blip every client reconnects at once, and each
+// join and get_history asks the store for the latest messages of its room, for
+// their reactions. The latest history_cache.messages messages of up to
+// history_cache.rooms rooms are kept in memory instead. A room nobody asked for
+// or sent to in history_cache.idle_ttl is dropped, and when the cache is full the
+// room used least recently goes first. Asking for more messages than are cached goes
+// to the store.
+//
+// Messages broadcast to a cached room are added to it. Changes to stored messages,
+// reactions, retention purges and closed rooms, drop the room from the cache, and
+// erasing the messages of a user drops all rooms, so they are loaded again. A
+// load racing with a change is not cached.
+
+// cachedRoom holds the latest messages of a room, oldest first
+type cachedRoom struct {
+	messages []StoredMessage
+	// epoch is the epoch of the cache when the messages were loaded
+	epoch uint64
+}
+
+// historyCache keeps the latest messages of the active rooms
+type historyCache struct {
+	rooms *TTLCache[string, cachedRoom]
+	// size is how many messages are kept per room
+	size int
+	ttl  time.Duration
+
+	// The lock is held while rooms are stored, so a load doesn't overwrite a change
+	sync.Mutex
+	// changes counts the appends to and invalidations of each room, a load is only
+	// cached if its room didn't change while loading
+	changes map[string]uint64
+	// epoch goes up when all rooms are dropped
+	epoch atomic.Uint64
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// historyCacheStats is how well the cache does, in /admin/debug/runtime
+type historyCacheStats struct {
+	Rooms  int    `json:"rooms"`
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// newHistoryCache returns the cache of the config, or nil if it is off
+func newHistoryCache(ctx context.Context, config HistoryCacheConfig, clock Clock) *historyCache {
+	if config.Rooms <= 0 || config.Messages <= 0 {
+		return nil
+	}
+	return &historyCache{
+		rooms:   NewTTLCache(ctx, TTLCacheOptions[string, cachedRoom]{MaxEntries: config.Rooms, Clock: clock}),
+		size:    config.Messages,
+		ttl:     time.Duration(config.IdleTTL),
+		changes: make(map[string]uint64),
+	}
+}
+
+// changeCount returns how often the room changed
+func (h *historyCache) changeCount(room string) uint64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.changes[room]
+}
+
+// latestMessages returns up to limit of the latest messages of the room, oldest
+// first, from the cache if it has them
+func (m *Manager) latestMessages(room string, limit int) ([]StoredMessage, error) {
+	h := m.historyCache
+	if h == nil || limit > h.size {
+		return m.store.ListMessages(room, limit)
+	}
+
+	if cached, ok := h.rooms.Get(room); ok && cached.epoch == h.epoch.Load() {
+		h.rooms.Touch(room, h.ttl)
+		h.hits.Add(1)
+		return tail(cached.messages, limit), nil
+	}
+	h.misses.Add(1)
+
+	changes, epoch := h.changeCount(room), h.epoch.Load()
+	messages, err := m.store.ListMessages(room, h.size)
+	if err != nil {
+		return nil, err
+	}
+	h.Lock()
+	if h.changes[room] == changes && h.epoch.Load() == epoch {
+		h.rooms.SetTTL(room, cachedRoom{messages: messages, epoch: epoch}, h.ttl)
+	}
+	h.Unlock()
+	return tail(messages, limit), nil
+}
+
+// tail returns a copy of the last n messages
+func tail(messages []StoredMessage, n int) []StoredMessage {
+	return append([]StoredMessage{}, messages[max(len(messages)-n, 0):]...)
+}
+
+// cacheMessage adds a message just stored to its room, if the room is cached
+func (m *Manager) cacheMessage(msg StoredMessage) {
+	h := m.historyCache
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.changes[msg.Room]++
+	cached, ok := h.rooms.Get(msg.Room)
+	if !ok {
+		return
+	}
+
+	// The slice is shared with readers, so it is copied instead of appended to.
+	// Messages are stored outside the room lock, so they may come out of order
+	messages := append(tail(cached.messages, h.size-1), msg)
+	slices.SortFunc(messages, func(a, b StoredMessage) int { return cmp.Compare(a.Seq, b.Seq) })
+	h.rooms.SetTTL(msg.Room, cachedRoom{messages: messages, epoch: cached.epoch}, h.ttl)
+}
+
+// uncacheRoom drops the room from the cache after its stored messages changed
+func (m *Manager) uncacheRoom(room string) {
+	h := m.historyCache
+	if h == nil {
+		return
+	}
+	h.Lock()
+	h.changes[room]++
+	h.rooms.Delete(room)
+	h.Unlock()
+}
+
+// uncacheAllRooms drops all rooms from the cache
+func (m *Manager) uncacheAllRooms() {
+	if m.historyCache != nil {
+		m.historyCache.epoch.Add(1)
+	}
+}
+
+// historyCacheStats returns how well the cache does
+func (m *Manager) historyCacheStats() historyCacheStats {
+	h := m.historyCache
+	if h == nil {
+		return historyCacheStats{}
+	}
+	return historyCacheStats{Rooms: h.rooms.Len(), Hits: h.hits.Load(), Misses: h.misses.Load()}
+}
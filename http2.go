@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HTTP/2 has no Upgrade, a WebSocket over HTTP/2 (RFC 8441) is a stream opened
+// with an extended CONNECT request carrying :protocol websocket. The frames then
+// go over the request and response bodies of that stream. Go only announces
+// extended CONNECT support to clients when the process is started with
+// GODEBUG=http2xconnect=1, it can't be turned on from the code. Clients that
+// don't see it fall back to the HTTP/1.1 upgrade on their own. TLS listeners
+// always offer HTTP/2, with http2.enabled the others take HTTP/2 without TLS (h2c)
+// next to HTTP/1.1, which is what HTTP/2-only ingresses speak to their backends.
+//
+// gorilla only knows the HTTP/1.1 handshake, so the stream is handed to it as a
+// hijacked connection of a made up HTTP/1.1 upgrade request, and the 101 response
+// it writes is turned into the 200 the stream is answered with. Streams can't be
+// polled, clients on them always run their own read and write goroutines.
+
+var (
+	ErrNotExtendedConnect = errors.New("not a websocket extended connect request")
+)
+
+// isExtendedConnect returns true for requests opening a WebSocket over HTTP/2
+func isExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && r.Header.Get(":protocol") == "websocket"
+}
+
+// upgradeHTTP2 accepts a WebSocket over the HTTP/2 stream of the extended CONNECT
+// request. The handler has to wait for the returned stream to be done, the stream
+// is closed once the handler returns
+func (m *Manager) upgradeHTTP2(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, *http2Stream, error) {
+	if !isExtendedConnect(r) {
+		return nil, nil, ErrNotExtendedConnect
+	}
+
+	// The made up HTTP/1.1 request gorilla checks, RFC 8441 has no key, any will do
+	key := make([]byte, 16)
+	rand.Read(key)
+	upgrade := r.Clone(r.Context())
+	upgrade.Method = http.MethodGet
+	upgrade.Proto, upgrade.ProtoMajor, upgrade.ProtoMinor = "HTTP/1.1", 1, 1
+	upgrade.Header.Del(":protocol")
+	upgrade.Header.Set("Connection", "Upgrade")
+	upgrade.Header.Set("Upgrade", "websocket")
+	upgrade.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+
+	stream := &http2Stream{body: r.Body, w: w, rc: http.NewResponseController(w), remote: http2Addr(r.RemoteAddr), done: make(chan struct{})}
+	conn, err := m.upgrader.Upgrade(&http2Hijacker{ResponseWriter: w, stream: stream}, upgrade, responseHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, stream, nil
+}
+
+// serverProtocols returns the protocols the HTTP server accepts
+func serverProtocols(config HTTP2Config) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(config.Enabled)
+	return protocols
+}
+
+// http2Hijacker hands the stream to gorilla as if it hijacked an HTTP/1.1 connection
+type http2Hijacker struct {
+	http.ResponseWriter
+	stream *http2Stream
+}
+
+func (h *http2Hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.stream, bufio.NewReadWriter(bufio.NewReader(h.stream), bufio.NewWriter(h.stream)), nil
+}
+
+// http2Stream is the stream of an extended CONNECT request as a net.Conn
+type http2Stream struct {
+	body io.ReadCloser
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	// remote is the address of the connection the stream is on
+	remote http2Addr
+
+	// answered is set once the handshake response was sent
+	writeLock sync.Mutex
+	answered  bool
+	handshake bytes.Buffer
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *http2Stream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+// Write sends the frames over the stream, the 101 response gorilla writes first
+// becomes the 200 response of the stream
+func (s *http2Stream) Write(p []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if !s.answered {
+		s.handshake.Write(p)
+		if !bytes.HasSuffix(s.handshake.Bytes(), []byte("\r\n\r\n")) {
+			return len(p), nil
+		}
+		s.answered = true
+		return len(p), s.answer()
+	}
+
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, s.rc.Flush()
+}
+
+// answer sends the headers of the 101 response with a 200 instead
+func (s *http2Stream) answer() error {
+	resp, err := http.ReadResponse(bufio.NewReader(&s.handshake), nil)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"Sec-WebSocket-Protocol", "Sec-WebSocket-Extensions"} {
+		if value := resp.Header.Get(name); value != "" {
+			s.w.Header().Set(name, value)
+		}
+	}
+	s.w.WriteHeader(http.StatusOK)
+	return s.rc.Flush()
+}
+
+// Close ends the stream, the handler waiting on done returns
+func (s *http2Stream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return s.body.Close()
+}
+
+// wait blocks until the stream is closed or the client went away
+func (s *http2Stream) wait(r *http.Request) {
+	select {
+	case <-s.done:
+	case <-r.Context().Done():
+	}
+}
+
+func (s *http2Stream) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+func (s *http2Stream) SetReadDeadline(t time.Time) error {
+	return s.rc.SetReadDeadline(t)
+}
+
+func (s *http2Stream) SetWriteDeadline(t time.Time) error {
+	return s.rc.SetWriteDeadline(t)
+}
+
+func (s *http2Stream) LocalAddr() net.Addr {
+	return http2Addr("")
+}
+
+func (s *http2Stream) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+// http2Addr is the address of the connection a stream is on
+type http2Addr string
+
+func (a http2Addr) Network() string { return "tcp" }
+func (a http2Addr) String() string  { return string(a) }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// The pings only tell whether a connection is alive, not whether anybody is
+// using it. Every client remembers when it last sent an event, and a user whose
+// clients all sat idle for a while is shown as away with a presence event to the
+// rooms the user is in. The first event sent after that, or a new connection,
+// shows the user as online again. Clients idle for much longer can be
+// disconnected, so forgotten tabs don't hold on to server resources.
+
+const (
+	// EventPresence is sent to the rooms of a user when the user goes away or comes back
+	EventPresence = "presence"
+)
+
+const (
+	PresenceOnline = "online"
+	PresenceAway   = "away"
+)
+
+// idleCheckInterval is how often the clients are checked for being idle
+var idleCheckInterval = 5 * time.Second
+
+// passiveEvents don't count as activity, clients send them without the user doing anything
+var passiveEvents = map[string]bool{
+	EventAck:      true,
+	EventTimeSync: true,
+	EventStats:    true,
+}
+
+// PresenceEvent is the payload sent in the
+// presence event
+type PresenceEvent struct {
+	Username string `json:"username"`
+	Nickname string `json:"nickname,omitempty"`
+	// Status is online, away or dnd, see status.go
+	Status string `json:"status"`
+	// Text is the status text the user picked
+	Text string `json:"text,omitempty"`
+	// LastActive is when a client of the user last sent an event
+	LastActive time.Time `json:"last_active"`
+}
+
+// markActive records that the client sent the event, bringing its user back if away
+func (c *Client) markActive(eventType string) {
+	if passiveEvents[eventType] {
+		return
+	}
+	now := c.manager.now()
+	c.lastActivity.Store(now.UnixNano())
+
+	m := c.manager
+	m.presenceLock.Lock()
+	wasAway := m.away[c.username]
+	delete(m.away, c.username)
+	picked := m.statusPicked(c.username)
+	m.presenceLock.Unlock()
+
+	// A status the user picked stays until changed
+	if wasAway && !picked {
+		m.broadcastPresence(c.username, now)
+	}
+}
+
+// runIdle marks users as away and disconnects idle clients
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runIdle(ctx context.Context) {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.checkIdle(m.now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkIdle updates the presence of all users and disconnects the clients that are idle at now
+func (m *Manager) checkIdle(now time.Time) {
+	config := m.config().Idle
+
+	// The latest activity of any client counts for the user
+	lastActive := make(map[string]time.Time)
+	var idle []*Client
+	m.RLock()
+	for client := range m.clients {
+		if client.bot {
+			continue
+		}
+		last := time.Unix(0, client.lastActivity.Load())
+		if last.After(lastActive[client.username]) {
+			lastActive[client.username] = last
+		}
+		if config.DisconnectAfter > 0 && now.Sub(last) >= time.Duration(config.DisconnectAfter) {
+			idle = append(idle, client)
+		}
+	}
+	m.RUnlock()
+
+	for _, client := range idle {
+		log.Printf("disconnecting client %s of %s, idle for %v", client.id, client.username, time.Duration(config.DisconnectAfter))
+		m.removeClient(client)
+	}
+
+	var changed []string
+	m.presenceLock.Lock()
+	// Users without clients are gone, there is nobody to tell they are back
+	for username := range m.away {
+		if _, ok := lastActive[username]; !ok {
+			delete(m.away, username)
+		}
+	}
+	for username, last := range lastActive {
+		away := config.AwayAfter > 0 && now.Sub(last) >= time.Duration(config.AwayAfter)
+		if away == m.away[username] {
+			continue
+		}
+		if away {
+			m.away[username] = true
+		} else {
+			delete(m.away, username)
+		}
+		if !m.statusPicked(username) {
+			changed = append(changed, username)
+		}
+	}
+	m.presenceLock.Unlock()
+
+	for _, username := range changed {
+		m.broadcastPresence(username, lastActive[username])
+	}
+}
+
+// broadcastPresence tells the rooms the user is in about the status of the user
+func (m *Manager) broadcastPresence(username string, lastActive time.Time) {
+	status, text := m.presence(username)
+	data, err := json.Marshal(PresenceEvent{Username: username, Nickname: m.nickname(username), Status: status, Text: text, LastActive: lastActive})
+	if err != nil {
+		log.Println("failed to marshal presence: ", err)
+		return
+	}
+
+	for _, room := range m.roomsOfUser(username) {
+		m.sendToRoom(room, Event{Type: EventPresence, Payload: data})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IDs of messages, clients, devices and scheduled messages come from the
+// IDGenerator of the Manager. Random UUIDs are the default, ULIDs and snowflakes
+// sort by the time they were made, which helps stores that keep messages in the
+// order of their ID. Secrets like OTPs are always random UUIDs, whatever the
+// format, since the time based IDs are partly predictable.
+
+const (
+	IDFormatUUID      = "uuid"
+	IDFormatULID      = "ulid"
+	IDFormatSnowflake = "snowflake"
+)
+
+var (
+	ErrInvalidIDFormat = errors.New("id format has to be uuid, ulid or snowflake")
+	ErrInvalidIDNode   = errors.New("snowflake node has to be between 0 and 1023")
+)
+
+// snowflakeEpoch is the time snowflake IDs count their milliseconds from
+var snowflakeEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// crockford is the alphabet of ULIDs, base32 without I, L, O and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// IDGenerator makes unique IDs
+type IDGenerator interface {
+	NewID() string
+}
+
+// WithIDGenerator makes the Manager use the generator instead of the one in the config
+func WithIDGenerator(ids IDGenerator) ManagerOption {
+	return func(m *Manager) {
+		m.ids = ids
+	}
+}
+
+// newIDGenerator returns the generator for the configured format, time based ones use the clock
+func newIDGenerator(config IDConfig, clock Clock) (IDGenerator, error) {
+	switch config.Format {
+	case "", IDFormatUUID:
+		return uuidGenerator{}, nil
+	case IDFormatULID:
+		return &ulidGenerator{clock: clock}, nil
+	case IDFormatSnowflake:
+		if config.Node < 0 || config.Node > 1023 {
+			return nil, ErrInvalidIDNode
+		}
+		return &snowflakeGenerator{clock: clock, node: int64(config.Node)}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidIDFormat, config.Format)
+	}
+}
+
+// newID returns a new ID from the Manager's generator
+func (m *Manager) newID() string {
+	return m.ids.NewID()
+}
+
+// uuidGenerator makes random version 4 UUIDs
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() string {
+	return uuid.NewString()
+}
+
+// ulidGenerator makes ULIDs, 48 bits of milliseconds followed by 80 random bits.
+// IDs made within the same millisecond increment the random part, so they still sort
+type ulidGenerator struct {
+	clock Clock
+
+	sync.Mutex
+	lastMs uint64
+	last   [16]byte
+}
+
+func (g *ulidGenerator) NewID() string {
+	ms := uint64(g.clock.Now().UnixMilli())
+
+	g.Lock()
+	defer g.Unlock()
+
+	if ms <= g.lastMs && g.lastMs != 0 {
+		// Same millisecond or the clock went back, count up from the last ID
+		for i := 15; i >= 6; i-- {
+			g.last[i]++
+			if g.last[i] != 0 {
+				break
+			}
+		}
+	} else {
+		g.lastMs = ms
+		binary.BigEndian.PutUint16(g.last[0:2], uint16(ms>>32))
+		binary.BigEndian.PutUint32(g.last[2:6], uint32(ms))
+		rand.Read(g.last[6:])
+	}
+	return encodeULID(g.last)
+}
+
+// encodeULID writes the 128 bits as 26 characters of 5 bits, the first one only holds 3
+func encodeULID(id [16]byte) string {
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := range out {
+		shift := uint(125 - 5*i)
+		var v uint64
+		switch {
+		case shift >= 64:
+			v = hi >> (shift - 64)
+		case shift > 59:
+			v = lo>>shift | hi<<(64-shift)
+		default:
+			v = lo >> shift
+		}
+		out[i] = crockford[v&31]
+	}
+	return string(out[:])
+}
+
+// snowflakeGenerator makes snowflake IDs, 41 bits of milliseconds since the
+// snowflakeEpoch, 10 bits of node and a 12 bit sequence within the millisecond.
+// Every instance needs its own node, or they can make the same IDs
+type snowflakeGenerator struct {
+	clock Clock
+	node  int64
+
+	sync.Mutex
+	lastMs int64
+	seq    int64
+}
+
+func (g *snowflakeGenerator) NewID() string {
+	ms := g.clock.Now().Sub(snowflakeEpoch).Milliseconds()
+
+	g.Lock()
+	defer g.Unlock()
+
+	if ms <= g.lastMs {
+		// Instead of waiting for the next millisecond, borrow it, the clock catches up
+		ms = g.lastMs
+		g.seq++
+		if g.seq > 4095 {
+			ms++
+			g.seq = 0
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMs = ms
+	return strconv.FormatInt(ms<<22|g.node<<12|g.seq, 10)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Clients send what they were built to send, which isn't always what the handlers
+// expect: old app versions use old payloads, some compress large payloads and
+// some send more text than a message may hold. Before an event is routed to its
+// handler it goes through the ingress pipeline, the transformers configured for
+// its type and those for all types ("*"), which return the event as the handlers
+// should see it, or an error rejecting it. The sender of a rejected event gets an
+// error event with the code "rejected".
+//
+// The config sets up the built-in transformers per event type, in order:
+//
+//	"ingress": {
+//	    "*":            [{"transform": "gunzip"}],
+//	    "send_message": [{"transform": "rename", "field": "text", "to": "message"},
+//	                     {"transform": "trim", "field": "message", "max_length": 2000}]
+//	}
+//
+//   - gunzip replaces a payload like {"gzip":"<base64>"} with the JSON it holds
+//   - rename moves a top-level field of the payload to another name, like a field
+//     renamed in a newer version of the protocol, unless the new one is set
+//   - trim cuts a top-level string field to max_length characters
+//
+// The server adds its own with AddIngressTransformer, they run after the
+// configured ones. How many events each transformer changed and rejected is
+// exported on /metrics.
+
+const (
+	IngressGunzip = "gunzip"
+	IngressRename = "rename"
+	IngressTrim   = "trim"
+)
+
+// ingressAllTypes is the event type of the transformers applied to every event
+const ingressAllTypes = "*"
+
+var (
+	ErrInvalidIngress = errors.New("invalid ingress config")
+	ErrEventRejected  = errors.New("event rejected")
+)
+
+// maxGunzipSize is the largest payload in bytes gunzip unpacks, so a small
+// compressed payload can't blow up to fill the memory
+var maxGunzipSize = 1024 * 1024
+
+// IngressTransformer returns the event as the handlers should see it, an error rejects it
+type IngressTransformer func(*Client, Event) (Event, error)
+
+// IngressStep is a built-in transformer in the config
+type IngressStep struct {
+	// Transform is gunzip, rename or trim
+	Transform string `json:"transform"`
+	// Field is the top-level field of the payload renamed or trimmed
+	Field string `json:"field,omitempty"`
+	// To is the new name of the field for rename
+	To string `json:"to,omitempty"`
+	// MaxLength is the most characters trim keeps
+	MaxLength int `json:"max_length,omitempty"`
+}
+
+// namedTransformer is a transformer with the name its metrics are labeled with
+type namedTransformer struct {
+	name      string
+	transform IngressTransformer
+}
+
+// ingressCounts counts what a transformer did to the events of one type
+type ingressCounts struct {
+	modified atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// ingressKey is a transformer applied to an event type
+type ingressKey struct {
+	eventType string
+	name      string
+}
+
+// ingressPipeline holds the transformers added by the server and the metrics of all
+type ingressPipeline struct {
+	sync.RWMutex
+	transformers map[string][]namedTransformer
+	counts       map[ingressKey]*ingressCounts
+}
+
+func newIngressPipeline() *ingressPipeline {
+	return &ingressPipeline{transformers: make(map[string][]namedTransformer), counts: make(map[ingressKey]*ingressCounts)}
+}
+
+// with returns the counts of the transformer for the event type, creating them if needed
+func (p *ingressPipeline) with(key ingressKey) *ingressCounts {
+	p.RLock()
+	counts, ok := p.counts[key]
+	p.RUnlock()
+	if ok {
+		return counts
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if counts, ok = p.counts[key]; !ok {
+		counts = &ingressCounts{}
+		p.counts[key] = counts
+	}
+	return counts
+}
+
+// AddIngressTransformer runs the transformer on the events of the type, or of all
+// types for "*", before they are routed. The name labels its metrics
+func (m *Manager) AddIngressTransformer(eventType, name string, transform IngressTransformer) {
+	m.ingress.Lock()
+	defer m.ingress.Unlock()
+	m.ingress.transformers[eventType] = append(m.ingress.transformers[eventType], namedTransformer{name: name, transform: transform})
+}
+
+// validateIngress returns an error if a configured transformer can't be built
+func validateIngress(ingress map[string][]IngressStep) error {
+	for eventType, steps := range ingress {
+		for _, step := range steps {
+			if _, err := step.transformer(); err != nil {
+				return fmt.Errorf("%s: %w", eventType, err)
+			}
+		}
+	}
+	return nil
+}
+
+// transformer returns the built-in transformer of the step
+func (s IngressStep) transformer() (IngressTransformer, error) {
+	switch s.Transform {
+	case IngressGunzip:
+		return gunzipPayload, nil
+	case IngressRename:
+		if s.Field == "" || s.To == "" {
+			return nil, fmt.Errorf("%w: rename needs field and to", ErrInvalidIngress)
+		}
+		return func(_ *Client, event Event) (Event, error) {
+			return renameField(event, s.Field, s.To)
+		}, nil
+	case IngressTrim:
+		if s.Field == "" || s.MaxLength <= 0 {
+			return nil, fmt.Errorf("%w: trim needs field and max_length", ErrInvalidIngress)
+		}
+		return func(_ *Client, event Event) (Event, error) {
+			return trimField(event, s.Field, s.MaxLength)
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown transform %q", ErrInvalidIngress, s.Transform)
+}
+
+// ingressTransformers returns the transformers of the event type in the order they run
+func (m *Manager) ingressTransformers(eventType string) []namedTransformer {
+	var transformers []namedTransformer
+	config := m.config().Ingress
+	for _, key := range []string{ingressAllTypes, eventType} {
+		for _, step := range config[key] {
+			transform, err := step.transformer()
+			if err != nil {
+				// LoadConfig rejects them, only a Manager created with a bad config gets here
+				log.Println("ingress: ", err)
+				continue
+			}
+			transformers = append(transformers, namedTransformer{name: step.Transform, transform: transform})
+		}
+	}
+	m.ingress.RLock()
+	defer m.ingress.RUnlock()
+	transformers = append(transformers, m.ingress.transformers[ingressAllTypes]...)
+	return append(transformers, m.ingress.transformers[eventType]...)
+}
+
+// transformIngress runs the event through the pipeline, false if it was rejected
+// and the client was told so
+func (m *Manager) transformIngress(event Event, c *Client) (Event, bool) {
+	eventType := event.Type
+	for _, t := range m.ingressTransformers(eventType) {
+		transformed, err := t.transform(c, event)
+		if err != nil {
+			m.ingress.with(ingressKey{eventType: eventType, name: t.name}).rejected.Add(1)
+			m.sendError(c, "rejected", map[string]string{"type": eventType, "reason": err.Error()})
+			return event, false
+		}
+		if transformed.Type != event.Type || !bytes.Equal(transformed.Payload, event.Payload) {
+			m.ingress.with(ingressKey{eventType: eventType, name: t.name}).modified.Add(1)
+		}
+		event = transformed
+	}
+	return event, true
+}
+
+// gunzipPayload unpacks a payload of the form {"gzip":"<base64>"}, other payloads
+// are left as they are
+func gunzipPayload(_ *Client, event Event) (Event, error) {
+	var packed struct {
+		Gzip *string `json:"gzip"`
+	}
+	if json.Unmarshal(event.Payload, &packed) != nil || packed.Gzip == nil {
+		return event, nil
+	}
+	compressed, err := base64.StdEncoding.DecodeString(*packed.Gzip)
+	if err != nil {
+		return event, fmt.Errorf("%w: gzip is not base64", ErrEventRejected)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return event, fmt.Errorf("%w: %v", ErrEventRejected, err)
+	}
+	defer reader.Close()
+	payload, err := io.ReadAll(io.LimitReader(reader, int64(maxGunzipSize)+1))
+	if err != nil {
+		return event, fmt.Errorf("%w: %v", ErrEventRejected, err)
+	}
+	if len(payload) > maxGunzipSize {
+		return event, fmt.Errorf("%w: unpacks to more than %d bytes", ErrEventRejected, maxGunzipSize)
+	}
+	if !json.Valid(payload) {
+		return event, fmt.Errorf("%w: unpacked payload is not JSON", ErrEventRejected)
+	}
+	event.Payload = payload
+	return event, nil
+}
+
+// payloadFields decodes the payload as an object, false if it is none
+func payloadFields(payload json.RawMessage) (map[string]json.RawMessage, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil || fields == nil {
+		return nil, false
+	}
+	return fields, true
+}
+
+// renameField moves the field of the payload to the new name, unless that is set already
+func renameField(event Event, from, to string) (Event, error) {
+	fields, ok := payloadFields(event.Payload)
+	if !ok {
+		return event, nil
+	}
+	value, ok := fields[from]
+	if !ok {
+		return event, nil
+	}
+	if _, set := fields[to]; !set {
+		fields[to] = value
+	}
+	delete(fields, from)
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return event, err
+	}
+	event.Payload = payload
+	return event, nil
+}
+
+// trimField cuts the string field of the payload to at most maxLength characters
+func trimField(event Event, field string, maxLength int) (Event, error) {
+	fields, ok := payloadFields(event.Payload)
+	if !ok {
+		return event, nil
+	}
+	var value string
+	if json.Unmarshal(fields[field], &value) != nil || utf8.RuneCountInString(value) <= maxLength {
+		return event, nil
+	}
+	trimmed, err := json.Marshal(string([]rune(value)[:maxLength]))
+	if err != nil {
+		return event, err
+	}
+	fields[field] = trimmed
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return event, err
+	}
+	event.Payload = payload
+	return event, nil
+}
+
+// writeIngressMetrics writes the counts of the transformers in the Prometheus text format
+func (m *Manager) writeIngressMetrics(w io.Writer) {
+	m.ingress.RLock()
+	counts := maps.Clone(m.ingress.counts)
+	m.ingress.RUnlock()
+
+	keys := slices.SortedFunc(maps.Keys(counts), func(a, b ingressKey) int {
+		if a.eventType != b.eventType {
+			return cmp.Compare(a.eventType, b.eventType)
+		}
+		return cmp.Compare(a.name, b.name)
+	})
+	fmt.Fprintf(w, "# HELP ingress_modified_total Events changed by an ingress transformer by event type.\n# TYPE ingress_modified_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "ingress_modified_total{event_type=%q,transformer=%q} %d\n", key.eventType, key.name, counts[key].modified.Load())
+	}
+	fmt.Fprintf(w, "# HELP ingress_rejected_total Events rejected by an ingress transformer by event type.\n# TYPE ingress_rejected_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "ingress_rejected_total{event_type=%q,transformer=%q} %d\n", key.eventType, key.name, counts[key].rejected.Load())
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// The HTTP server can listen on several addresses at once, all serving the same
+// routes, like a unix socket for a reverse proxy on the same host next to a TLS
+// port for everyone else. Without listeners in the config it listens on addr over
+// plain TCP, as it always has. TLS listeners also offer HTTP/2, see http2.go.
+
+const (
+	ListenerTCP  = "tcp"
+	ListenerTLS  = "tls"
+	ListenerUnix = "unix"
+)
+
+// defaultSocketMode lets the owner and its group, like the one of the reverse proxy, connect
+const defaultSocketMode = 0660
+
+var (
+	ErrInvalidListener = errors.New("listener network has to be tcp, tls or unix")
+	ErrListenerAddr    = errors.New("listener needs an addr")
+	ErrListenerCert    = errors.New("tls listener needs a cert and a key")
+	ErrSocketMode      = errors.New("socket mode has to be octal, like 0660")
+)
+
+// listenerConfigs returns the configured listeners, or one on Addr over plain TCP
+func listenerConfigs(config Config) []ListenerConfig {
+	if len(config.Listeners) > 0 {
+		return config.Listeners
+	}
+	return []ListenerConfig{{Network: ListenerTCP, Addr: config.Addr}}
+}
+
+// listen opens the listener, a unix socket left over from an earlier run is removed first
+func listen(config ListenerConfig) (net.Listener, error) {
+	if config.Addr == "" {
+		return nil, ErrListenerAddr
+	}
+	switch config.Network {
+	case "", ListenerTCP:
+		return net.Listen("tcp", config.Addr)
+	case ListenerTLS:
+		if config.Cert == "" || config.Key == "" {
+			return nil, ErrListenerCert
+		}
+		return net.Listen("tcp", config.Addr)
+	case ListenerUnix:
+		mode := os.FileMode(defaultSocketMode)
+		if config.Mode != "" {
+			parsed, err := strconv.ParseUint(config.Mode, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q", ErrSocketMode, config.Mode)
+			}
+			mode = os.FileMode(parsed)
+		}
+		os.Remove(config.Addr)
+		lis, err := net.Listen("unix", config.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(config.Addr, mode); err != nil {
+			lis.Close()
+			return nil, err
+		}
+		return lis, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidListener, config.Network)
+	}
+}
+
+// serveListeners opens all listeners before serving any, so a bad one stops the
+// start instead of leaving the server half up. server.Shutdown closes them all
+func serveListeners(server *http.Server, configs []ListenerConfig) error {
+	listeners := make([]net.Listener, 0, len(configs))
+	for _, config := range configs {
+		lis, err := listen(config)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return fmt.Errorf("listening on %s %s: %w", config.Network, config.Addr, err)
+		}
+		listeners = append(listeners, lis)
+	}
+
+	for i, lis := range listeners {
+		config := configs[i]
+		if config.Network == "" {
+			config.Network = ListenerTCP
+		}
+		log.Printf("listening on %s %s", config.Network, lis.Addr())
+		go func() {
+			var err error
+			if config.Network == ListenerTLS {
+				err = server.ServeTLS(lis, config.Cert, config.Key)
+			} else {
+				err = server.Serve(lis)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	return nil
+}
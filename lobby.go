@@ -0,0 +1,547 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// Multiplayer games use lobbies to gather their players before a game starts. A
+// lobby has a capacity, create_lobby opens one and join_lobby joins it, or
+// find_lobby joins the oldest open lobby of a game with places left and opens a
+// new one if there is none. A user is in one lobby at a time.
+//
+// The server moves a lobby through its states, clients can only ask:
+//
+//	open ──full──▶ ready_check ──all ready──▶ countdown ──deadline──▶ started
+//	  ▲                 │                          │
+//	  └─left, timeout───┴──────────left────────────┘
+//
+// Once the lobby is full it goes to ready_check and every player has
+// lobbies.ready_timeout to send lobby_ready. Players not ready by then are removed
+// and the lobby is open again. Once all are ready the countdown starts, a player
+// sending lobby_ready with ready false goes back to the ready check. At the end of
+// the countdown the server creates a private ephemeral room for the game, invites
+// the players, sends lobby_started and moves their clients into the room.
+//
+// Every change is sent to the players as lobby_updated with the whole lobby, the
+// deadline tells clients what to count down to. A player that leaves, or has no
+// connected client anymore, is removed with lobby_left. Lobbies are kept in memory
+// of the instance the players are connected to.
+
+const (
+	// EventCreateLobby is sent by a client to open a lobby
+	EventCreateLobby = "create_lobby"
+	// EventJoinLobby is sent by a client to join a lobby by its id
+	EventJoinLobby = "join_lobby"
+	// EventFindLobby is sent by a client to join any open lobby of a game
+	EventFindLobby = "find_lobby"
+	// EventLeaveLobby is sent by a client to leave its lobby
+	EventLeaveLobby = "leave_lobby"
+	// EventLobbyReady is sent by a client to answer the ready check
+	EventLobbyReady = "lobby_ready"
+	// EventListLobbies is sent by a client for the open lobbies
+	EventListLobbies = "list_lobbies"
+	// EventLobbies is the response to list_lobbies
+	EventLobbies = "lobbies"
+	// EventLobbyUpdated is sent to the players of a lobby when it changed
+	EventLobbyUpdated = "lobby_updated"
+	// EventLobbyLeft is sent to a player removed from a lobby
+	EventLobbyLeft = "lobby_left"
+	// EventLobbyStarted is sent to the players when the game starts
+	EventLobbyStarted = "lobby_started"
+)
+
+// States of a lobby
+const (
+	LobbyOpen       = "open"
+	LobbyReadyCheck = "ready_check"
+	LobbyCountdown  = "countdown"
+	LobbyStarted    = "started"
+)
+
+// Reasons a player left a lobby
+const (
+	LobbyLeftLeft         = "left"
+	LobbyLeftNotReady     = "not_ready"
+	LobbyLeftDisconnected = "disconnected"
+)
+
+var (
+	ErrLobbyNotFound   = errors.New("lobby not found")
+	ErrLobbyFull       = errors.New("lobby is full")
+	ErrInLobby         = errors.New("already in a lobby")
+	ErrNotInLobby      = errors.New("not in a lobby")
+	ErrInvalidLobby    = errors.New("invalid lobby")
+	ErrLobbyTransition = errors.New("lobby can't do that in its state")
+)
+
+// lobbyInterval is how often the deadlines of the lobbies are checked
+var lobbyInterval = 250 * time.Millisecond
+
+// lobbyTransitions are the states each state may move to
+var lobbyTransitions = map[string][]string{
+	LobbyOpen:       {LobbyReadyCheck},
+	LobbyReadyCheck: {LobbyOpen, LobbyCountdown},
+	LobbyCountdown:  {LobbyOpen, LobbyReadyCheck, LobbyStarted},
+}
+
+// Lobby is a lobby as sent to the clients
+type Lobby struct {
+	ID       string        `json:"id"`
+	Game     string        `json:"game,omitempty"`
+	Owner    string        `json:"owner"`
+	Capacity int           `json:"capacity"`
+	State    string        `json:"state"`
+	Members  []LobbyMember `json:"members"`
+	// Deadline is when the ready check or the countdown ends
+	Deadline time.Time `json:"deadline,omitzero"`
+	Created  time.Time `json:"created"`
+}
+
+// LobbyMember is a player in a lobby
+type LobbyMember struct {
+	Username string `json:"username"`
+	Ready    bool   `json:"ready"`
+}
+
+// CreateLobbyEvent is the payload of the create_lobby and find_lobby events
+type CreateLobbyEvent struct {
+	// Game is what the lobby is for, find_lobby only joins lobbies of the same game
+	Game     string `json:"game,omitempty"`
+	Capacity int    `json:"capacity"`
+}
+
+// JoinLobbyEvent is the payload of the join_lobby event
+type JoinLobbyEvent struct {
+	Lobby string `json:"lobby"`
+}
+
+// LobbyReadyEvent is the payload of the lobby_ready event
+type LobbyReadyEvent struct {
+	Ready bool `json:"ready"`
+}
+
+// ListLobbiesEvent is the payload of the list_lobbies event
+type ListLobbiesEvent struct {
+	// Game limits the lobbies to the ones of the game, if set
+	Game string `json:"game,omitempty"`
+}
+
+// LobbiesEvent is returned when responding to list_lobbies
+type LobbiesEvent struct {
+	Lobbies []Lobby `json:"lobbies"`
+}
+
+// LobbyLeftEvent is the payload of the lobby_left event
+type LobbyLeftEvent struct {
+	Lobby string `json:"lobby"`
+	// Reason is left, not_ready or disconnected
+	Reason string `json:"reason"`
+}
+
+// LobbyStartedEvent is the payload of the lobby_started event
+type LobbyStartedEvent struct {
+	Lobby Lobby `json:"lobby"`
+	// Room is the room of the game, the clients of the players are moved into it
+	Room string `json:"room"`
+}
+
+// transition moves the lobby to the state, if the state machine allows it
+func (l *Lobby) transition(to string, deadline time.Time) error {
+	if !slices.Contains(lobbyTransitions[l.State], to) {
+		return fmt.Errorf("%w: %s to %s", ErrLobbyTransition, l.State, to)
+	}
+	l.State = to
+	l.Deadline = deadline
+	for i := range l.Members {
+		// Everyone answers the ready check again, the countdown keeps who is ready
+		if to != LobbyCountdown && to != LobbyStarted {
+			l.Members[i].Ready = false
+		}
+	}
+	return nil
+}
+
+// member returns the index of the player in the lobby, -1 if not in it
+func (l *Lobby) member(username string) int {
+	return slices.IndexFunc(l.Members, func(member LobbyMember) bool { return member.Username == username })
+}
+
+// allReady returns true if every player is ready
+func (l *Lobby) allReady() bool {
+	return !slices.ContainsFunc(l.Members, func(member LobbyMember) bool { return !member.Ready })
+}
+
+// copy returns a copy of the lobby that doesn't change with it
+func (l *Lobby) copy() Lobby {
+	c := *l
+	c.Members = slices.Clone(l.Members)
+	return c
+}
+
+// validateLobby returns an error if a lobby can't be opened like this
+func (m *Manager) validateLobby(create CreateLobbyEvent) error {
+	maxCapacity := m.config().Lobbies.MaxCapacity
+	if create.Capacity < 2 || create.Capacity > maxCapacity {
+		return fmt.Errorf("%w: capacity has to be between 2 and %d", ErrInvalidLobby, maxCapacity)
+	}
+	if len(create.Game) > maxRoomNameLength {
+		return fmt.Errorf("%w: game longer than %d bytes", ErrInvalidLobby, maxRoomNameLength)
+	}
+	return nil
+}
+
+// createLobby opens a lobby with the user as its first player
+// Only call it while holding the lobbies lock
+func (m *Manager) createLobby(username string, create CreateLobbyEvent) *Lobby {
+	l := &Lobby{
+		ID:       m.newID(),
+		Game:     create.Game,
+		Owner:    username,
+		Capacity: create.Capacity,
+		State:    LobbyOpen,
+		Members:  []LobbyMember{{Username: username}},
+		Created:  m.now(),
+	}
+	m.lobbies[l.ID] = l
+	m.lobbyOf[username] = l.ID
+	m.sendLobbyUpdated(l)
+	return l
+}
+
+// joinLobby adds the user to the open lobby, a full lobby starts its ready check
+// Only call it while holding the lobbies lock
+func (m *Manager) joinLobby(username string, l *Lobby) error {
+	if l.State != LobbyOpen {
+		return fmt.Errorf("%w: can't join while %s", ErrLobbyTransition, l.State)
+	}
+	if len(l.Members) >= l.Capacity {
+		return ErrLobbyFull
+	}
+	l.Members = append(l.Members, LobbyMember{Username: username})
+	m.lobbyOf[username] = l.ID
+	if len(l.Members) == l.Capacity {
+		if err := l.transition(LobbyReadyCheck, m.now().Add(time.Duration(m.config().Lobbies.ReadyTimeout))); err != nil {
+			return err
+		}
+	}
+	m.sendLobbyUpdated(l)
+	return nil
+}
+
+// leaveLobby removes the user from its lobby, a lobby that is no longer full is
+// open again and an empty one is closed
+// Only call it while holding the lobbies lock
+func (m *Manager) leaveLobby(username, reason string) error {
+	l, ok := m.lobbies[m.lobbyOf[username]]
+	if !ok {
+		return ErrNotInLobby
+	}
+	m.removeFromLobby(l, username, reason)
+	if len(l.Members) == 0 {
+		delete(m.lobbies, l.ID)
+		return nil
+	}
+	if l.State != LobbyOpen {
+		if err := l.transition(LobbyOpen, time.Time{}); err != nil {
+			return err
+		}
+	}
+	m.sendLobbyUpdated(l)
+	return nil
+}
+
+// removeFromLobby takes the player out of the lobby and tells it why, without
+// changing the state of the lobby
+// Only call it while holding the lobbies lock
+func (m *Manager) removeFromLobby(l *Lobby, username, reason string) {
+	l.Members = slices.DeleteFunc(l.Members, func(member LobbyMember) bool { return member.Username == username })
+	delete(m.lobbyOf, username)
+	if l.Owner == username && len(l.Members) > 0 {
+		l.Owner = l.Members[0].Username
+	}
+	data, err := json.Marshal(LobbyLeftEvent{Lobby: l.ID, Reason: reason})
+	if err != nil {
+		log.Println("marshalling lobby_left: ", err)
+		return
+	}
+	m.sendToLocalUser(username, Event{Type: EventLobbyLeft, Payload: data})
+}
+
+// setLobbyReady answers the ready check of the user, all players being ready starts
+// the countdown and a player no longer ready stops it
+// Only call it while holding the lobbies lock
+func (m *Manager) setLobbyReady(username string, ready bool) error {
+	l, ok := m.lobbies[m.lobbyOf[username]]
+	if !ok {
+		return ErrNotInLobby
+	}
+	if l.State != LobbyReadyCheck && l.State != LobbyCountdown {
+		return fmt.Errorf("%w: no ready check while %s", ErrLobbyTransition, l.State)
+	}
+	config := m.config().Lobbies
+	member := &l.Members[l.member(username)]
+	if member.Ready == ready {
+		return nil
+	}
+	member.Ready = ready
+
+	var err error
+	switch {
+	case l.State == LobbyReadyCheck && l.allReady():
+		err = l.transition(LobbyCountdown, m.now().Add(time.Duration(config.Countdown)))
+	case l.State == LobbyCountdown && !ready:
+		// The others stay ready, only the player that backed out has to answer again
+		err = l.transition(LobbyReadyCheck, m.now().Add(time.Duration(config.ReadyTimeout)))
+		for i := range l.Members {
+			l.Members[i].Ready = l.Members[i].Username != username
+		}
+	}
+	if err != nil {
+		return err
+	}
+	m.sendLobbyUpdated(l)
+	return nil
+}
+
+// sendLobbyUpdated sends the lobby to its players
+// Only call it while holding the lobbies lock
+func (m *Manager) sendLobbyUpdated(l *Lobby) {
+	data, err := json.Marshal(l)
+	if err != nil {
+		log.Println("marshalling lobby_updated: ", err)
+		return
+	}
+	for _, member := range l.Members {
+		m.sendToLocalUser(member.Username, Event{Type: EventLobbyUpdated, Payload: data})
+	}
+}
+
+// runLobbies ends the ready checks and countdowns that are due
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runLobbies(ctx context.Context) {
+	ticker := time.NewTicker(lobbyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.advanceLobbies(m.now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// advanceLobbies removes the players without clients, ends the ready checks and
+// countdowns that are due at now and starts the games
+func (m *Manager) advanceLobbies(now time.Time) {
+	var started []Lobby
+
+	m.lobbiesLock.Lock()
+	for _, l := range m.lobbies {
+		for _, member := range slices.Clone(l.Members) {
+			if m.userClientCount(member.Username) == 0 {
+				if err := m.leaveLobby(member.Username, LobbyLeftDisconnected); err != nil {
+					log.Printf("removing %s from lobby %s: %v", member.Username, l.ID, err)
+				}
+			}
+		}
+		if l.Deadline.IsZero() || now.Before(l.Deadline) || len(l.Members) == 0 {
+			continue
+		}
+
+		switch l.State {
+		case LobbyReadyCheck:
+			for _, member := range slices.Clone(l.Members) {
+				if !member.Ready {
+					m.removeFromLobby(l, member.Username, LobbyLeftNotReady)
+				}
+			}
+			if len(l.Members) == 0 {
+				delete(m.lobbies, l.ID)
+				continue
+			}
+			if err := l.transition(LobbyOpen, time.Time{}); err != nil {
+				log.Printf("ending ready check of lobby %s: %v", l.ID, err)
+				continue
+			}
+			m.sendLobbyUpdated(l)
+		case LobbyCountdown:
+			if err := l.transition(LobbyStarted, time.Time{}); err != nil {
+				log.Printf("starting lobby %s: %v", l.ID, err)
+				continue
+			}
+			delete(m.lobbies, l.ID)
+			for _, member := range l.Members {
+				delete(m.lobbyOf, member.Username)
+			}
+			started = append(started, l.copy())
+		}
+	}
+	m.lobbiesLock.Unlock()
+
+	// The room is created without the lobbies lock, moving the clients takes the room and manager locks
+	for _, l := range started {
+		if err := m.startLobby(l); err != nil {
+			log.Printf("starting the game of lobby %s: %v", l.ID, err)
+		}
+	}
+}
+
+// startLobby creates the room of the game and moves the players into it
+func (m *Manager) startLobby(l Lobby) error {
+	players := make([]string, 0, len(l.Members))
+	for _, member := range l.Members {
+		players = append(players, member.Username)
+	}
+	name := "lobby-" + l.ID
+	room := Room{
+		Name:        name,
+		Created:     m.now(),
+		MaxMembers:  l.Capacity,
+		Visibility:  VisibilityPrivate,
+		Invited:     players,
+		Ephemeral:   true,
+		IdleTimeout: m.config().Lobbies.RoomIdleTimeout,
+	}
+	if err := m.store.SaveRoom(room); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(LobbyStartedEvent{Lobby: l, Room: name})
+	if err != nil {
+		return err
+	}
+	for _, player := range players {
+		m.sendToLocalUser(player, Event{Type: EventLobbyStarted, Payload: data})
+	}
+	_, err = m.addMembers(name, players, "lobby")
+	return err
+}
+
+// openLobbies returns the open lobbies of the game, or of all games, oldest first
+func (m *Manager) openLobbies(game string) []Lobby {
+	m.lobbiesLock.Lock()
+	defer m.lobbiesLock.Unlock()
+	lobbies := []Lobby{}
+	for _, l := range m.lobbies {
+		if l.State == LobbyOpen && (game == "" || l.Game == game) {
+			lobbies = append(lobbies, l.copy())
+		}
+	}
+	slices.SortFunc(lobbies, func(a, b Lobby) int {
+		return cmp.Or(a.Created.Compare(b.Created), cmp.Compare(a.ID, b.ID))
+	})
+	return lobbies
+}
+
+// CreateLobbyHandler opens a lobby with the client as its first player
+func CreateLobbyHandler(event Event, c *Client) error {
+	var create CreateLobbyEvent
+	if err := json.Unmarshal(event.Payload, &create); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	m := c.manager
+	if err := m.validateLobby(create); err != nil {
+		return err
+	}
+
+	m.lobbiesLock.Lock()
+	defer m.lobbiesLock.Unlock()
+	if _, ok := m.lobbyOf[c.username]; ok {
+		return ErrInLobby
+	}
+	m.createLobby(c.username, create)
+	return nil
+}
+
+// JoinLobbyHandler adds the client to an open lobby
+func JoinLobbyHandler(event Event, c *Client) error {
+	var join JoinLobbyEvent
+	if err := json.Unmarshal(event.Payload, &join); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	m := c.manager
+
+	m.lobbiesLock.Lock()
+	defer m.lobbiesLock.Unlock()
+	if _, ok := m.lobbyOf[c.username]; ok {
+		return ErrInLobby
+	}
+	l, ok := m.lobbies[join.Lobby]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrLobbyNotFound, join.Lobby)
+	}
+	return m.joinLobby(c.username, l)
+}
+
+// FindLobbyHandler adds the client to the oldest open lobby of the game with the
+// capacity, or opens one if there is none
+func FindLobbyHandler(event Event, c *Client) error {
+	var find CreateLobbyEvent
+	if err := json.Unmarshal(event.Payload, &find); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	m := c.manager
+	if err := m.validateLobby(find); err != nil {
+		return err
+	}
+
+	m.lobbiesLock.Lock()
+	defer m.lobbiesLock.Unlock()
+	if _, ok := m.lobbyOf[c.username]; ok {
+		return ErrInLobby
+	}
+	var found *Lobby
+	for _, l := range m.lobbies {
+		if l.State != LobbyOpen || l.Game != find.Game || l.Capacity != find.Capacity || len(l.Members) >= l.Capacity {
+			continue
+		}
+		if found == nil || l.Created.Before(found.Created) {
+			found = l
+		}
+	}
+	if found == nil {
+		m.createLobby(c.username, find)
+		return nil
+	}
+	return m.joinLobby(c.username, found)
+}
+
+// LeaveLobbyHandler removes the client from its lobby
+func LeaveLobbyHandler(event Event, c *Client) error {
+	m := c.manager
+	m.lobbiesLock.Lock()
+	defer m.lobbiesLock.Unlock()
+	return m.leaveLobby(c.username, LobbyLeftLeft)
+}
+
+// LobbyReadyHandler answers the ready check of the lobby of the client
+func LobbyReadyHandler(event Event, c *Client) error {
+	var ready LobbyReadyEvent
+	if err := json.Unmarshal(event.Payload, &ready); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	m := c.manager
+	m.lobbiesLock.Lock()
+	defer m.lobbiesLock.Unlock()
+	return m.setLobbyReady(c.username, ready.Ready)
+}
+
+// ListLobbiesHandler returns the open lobbies to the client
+func ListLobbiesHandler(event Event, c *Client) error {
+	var list ListLobbiesEvent
+	if len(event.Payload) > 0 {
+		if err := json.Unmarshal(event.Payload, &list); err != nil {
+			return fmt.Errorf("bad payload in request: %v", err)
+		}
+	}
+	return c.manager.replyJSON(c, EventLobbies, LobbiesEvent{Lobbies: c.manager.openLobbies(list.Game)})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// The server tells clients about errors, announcements and the like in messages
+// it writes itself, and a frontend in German shouldn't show them in English.
+// These events carry a code and the parameters of the message next to the text:
+//
+//	{"type":"error","payload":{"code":"rate_limited","message":"too many events, send_message was dropped","params":{"type":"send_message"}}}
+//
+// Frontends can render the code in their own words, or let the server translate
+// it. A client declares its locale as ?locale= when connecting, in the locale of
+// hello, or else the Accept-Language of the upgrade request is used. The message
+// is then looked up in the catalog of the config for that locale, then for its
+// language ("de" for "de-AT"), then for the default locale and last in the built-in
+// English messages. Parameters are filled in where the message names them:
+//
+//	"localization": {
+//	    "default_locale": "en",
+//	    "catalog": {
+//	        "de": {"rate_limited": "Zu viele Ereignisse, {type} wurde verworfen"}
+//	    }
+//	}
+//
+// Messages are translated right before they are queued for a client, by an
+// outbound filter, so a broadcast announcement reaches every client in its locale.
+
+// localizedEvents are the events whose message is translated for the client
+var localizedEvents = map[string]bool{
+	EventError:          true,
+	EventSystem:         true,
+	EventEphemeral:      true,
+	EventServerDraining: true,
+	EventAccountErased:  true,
+}
+
+// defaultMessages are the messages of the codes in English, used when the catalog
+// has no translation
+var defaultMessages = map[string]string{
+	"too_large":         "{type} is larger than {limit} bytes",
+	"stream_failed":     "stream {stream} failed: {reason}",
+	"rate_limited":      "too many events, {type} was dropped",
+	"overloaded":        "server is busy, event {type} was dropped",
+	"internal_error":    "failed to handle {type}",
+	"feature_disabled":  "{type} needs the {feature} feature",
+	"rejected":          "{type} was rejected: {reason}",
+	"quota_exceeded":    "{reason}",
+	"state_conflict":    "{reason}",
+	"server_draining":   "server is going away, please reconnect",
+	"account_erased":    "your account and data were erased",
+	"unknown_command":   "unknown command, try /help",
+	"permission_denied": "permission denied",
+	"command_usage":     "usage: {command} {usage}",
+	"command_failed":    "{reason}",
+	"invalid_envelope":  "invalid envelope, {field} {reason}",
+}
+
+// LocalizationConfig configures the translation of the messages of the server
+type LocalizationConfig struct {
+	// DefaultLocale is used for clients that declared no locale or one without a catalog
+	DefaultLocale string `json:"default_locale"`
+	// Catalog holds the messages by locale and code
+	Catalog map[string]map[string]string `json:"catalog,omitempty"`
+}
+
+// localizedPayload is the part of a payload that is translated
+type localizedPayload struct {
+	Code   string            `json:"code"`
+	Params map[string]string `json:"params"`
+}
+
+// requestLocale returns the locale the client asked for when connecting, the
+// locale query param or the first language of the Accept-Language header
+func requestLocale(r *http.Request) string {
+	if locale := r.URL.Query().Get("locale"); locale != "" {
+		return locale
+	}
+	first, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+	tag, _, _ := strings.Cut(first, ";")
+	if tag = strings.TrimSpace(tag); tag == "*" {
+		return ""
+	}
+	return tag
+}
+
+// setLocale records the locale the client declared, an empty one is ignored
+func (c *Client) setLocale(locale string) {
+	if locale = strings.TrimSpace(locale); locale != "" {
+		c.locale.Store(&locale)
+	}
+}
+
+// effectiveLocale returns the locale of the catalog the messages of the client are
+// taken from, the default locale if it has none
+func (m *Manager) effectiveLocale(c *Client) string {
+	config := m.config().Localization
+	if locale := c.locale.Load(); locale != nil {
+		if found, ok := catalogLocale(config.Catalog, *locale); ok {
+			return found
+		}
+	}
+	return config.DefaultLocale
+}
+
+// catalogLocale returns the locale of the catalog for the locale, or for its language
+func catalogLocale(catalog map[string]map[string]string, locale string) (string, bool) {
+	locale = strings.ReplaceAll(locale, "_", "-")
+	language, _, _ := strings.Cut(locale, "-")
+	for _, candidate := range []string{locale, language} {
+		for name := range catalog {
+			if strings.EqualFold(name, candidate) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// translate returns the message of the code in the locale with the params filled in
+func (m *Manager) translate(locale, code string, params map[string]string) string {
+	config := m.config().Localization
+	message, ok := "", false
+	for _, candidate := range []string{locale, config.DefaultLocale} {
+		if name, found := catalogLocale(config.Catalog, candidate); found {
+			if message, ok = config.Catalog[name][code]; ok {
+				break
+			}
+		}
+	}
+	if !ok {
+		if message, ok = defaultMessages[code]; !ok {
+			return code
+		}
+	}
+
+	replacements := make([]string, 0, 2*len(params))
+	for key, value := range params {
+		replacements = append(replacements, "{"+key+"}", value)
+	}
+	return strings.NewReplacer(replacements...).Replace(message)
+}
+
+// localized returns the message of the code in the default locale, clients with
+// another locale get it translated when it is sent
+func (m *Manager) localized(code string, params map[string]string) string {
+	return m.translate(m.config().Localization.DefaultLocale, code, params)
+}
+
+// sendError sends the client an error event with the message of the code
+func (m *Manager) sendError(c *Client, code string, params map[string]string) {
+	data, _ := json.Marshal(ErrorEvent{Code: code, Message: m.localized(code, params), Params: params})
+	m.sendToClient(c, Event{Type: EventError, Payload: data})
+}
+
+// localizeOutbound is the outbound filter translating the messages of the server
+// for clients whose locale isn't the default one
+func (m *Manager) localizeOutbound(c *Client, event Event) (Event, bool) {
+	if !localizedEvents[event.Type] || c.locale.Load() == nil {
+		return event, true
+	}
+	locale := m.effectiveLocale(c)
+	if locale == m.config().Localization.DefaultLocale {
+		return event, true
+	}
+
+	var localized localizedPayload
+	if json.Unmarshal(event.Payload, &localized) != nil || localized.Code == "" {
+		return event, true
+	}
+	fields, ok := payloadFields(event.Payload)
+	if !ok {
+		return event, true
+	}
+	message, err := json.Marshal(m.translate(locale, localized.Code, localized.Params))
+	if err != nil {
+		return event, true
+	}
+	fields["message"] = message
+	payload, err := json.Marshal(fields)
+	if err != nil {
+		return event, true
+	}
+	event.Payload = payload
+	return event, true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+// Log levels, everything is logged at info except the chatty per message logs
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+)
+
+var (
+	ErrInvalidLogLevel = errors.New("log level has to be debug or info")
+)
+
+// debugEnabled turns on the debug logs, like every ping and pong
+var debugEnabled atomic.Bool
+
+func init() {
+	// The debug logs were always on before levels existed, keep it that way
+	debugEnabled.Store(true)
+}
+
+// setLogLevel changes the log level at runtime
+func setLogLevel(level string) error {
+	switch level {
+	case LogLevelDebug:
+		debugEnabled.Store(true)
+	case LogLevelInfo:
+		debugEnabled.Store(false)
+	default:
+		return ErrInvalidLogLevel
+	}
+	return nil
+}
+
+// logLevel returns the current log level
+func logLevel() string {
+	if debugEnabled.Load() {
+		return LogLevelDebug
+	}
+	return LogLevelInfo
+}
+
+// debugLog logs only when the level is debug
+func debugLog(v ...any) {
+	if debugEnabled.Load() {
+		log.Println(v...)
+	}
+}
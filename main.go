@@ -2,36 +2,237 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	// shutdownDelay is how long readiness fails before the server stops, so load
+	// balancers have time to notice
+	shutdownDelay = 5 * time.Second
+	// shutdownTimeout is how long in flight HTTP requests get to finish
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
 
+	configPath := flag.String("config", "", "path to the JSON config file")
+	console := flag.Bool("console", false, "read operator console commands from stdin")
+	replayPath := flag.String("replay", "", "replay the archived events of the JSON Lines file into a Manager made from the config and exit")
+	replaySpeed := flag.Float64("replay-speed", 1, "speed of -replay, 0 replays as fast as possible")
+	replayRoom := flag.String("replay-room", "", "room -replay sends all messages to instead of the archived rooms")
+	playbackPath := flag.String("playback", "", "play the session recording back against a test server made from the config and exit")
+	playbackUser := flag.String("playback-user", "", "user -playback connects as")
+	playbackSpeed := flag.Float64("playback-speed", 1, "speed of -playback, 0 sends the events right away")
+	generateSDKDir := flag.String("generate-sdk", "", "write the TypeScript definitions and the JavaScript client of the events into the directory and exit")
+	hashPassword := flag.Bool("hash-password", false, "print the hash of the password read from stdin, for the users of the config, and exit")
+	flag.Parse()
+
+	if *hashPassword {
+		if err := printPasswordHash(os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *generateSDKDir != "" {
+		if err := generateSDK(*generateSDKDir); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var err error
+	config := DefaultConfig()
+	if *configPath != "" {
+		if config, err = LoadConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *replayPath != "" {
+		if err := runReplay(os.Stdout, config, *replayPath, ReplayOptions{Speed: *replaySpeed, Room: *replayRoom}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *playbackPath != "" {
+		if err := runPlayback(os.Stdout, config, *playbackPath, *playbackUser, *playbackSpeed); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Create a root ctx and a CancelFunc which can be used to cancel retentionMap goroutine
 	rootCtx := context.Background()
 	ctx, cancel := context.WithCancel(rootCtx)
 
 	defer cancel()
 
-	setupAPI(ctx)
+	mux := http.NewServeMux()
+	manager, err := setupAPI(ctx, config, mux)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Apply changes to the config file without restarting
+	newRoutes(mux, config.BasePath).with(manager.cors).HandleFunc("POST /admin/config/reload", manager.requireAdminToken(manager.reloadConfigHandler(*configPath)))
+	if *configPath != "" {
+		go manager.watchConfig(ctx, *configPath)
+	}
 
-	// Serve on port :8080
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Operator console, on stdin and or a unix socket
+	if *console {
+		go manager.runStdinConsole()
+	}
+	if config.ConsoleSocket != "" {
+		go func() {
+			if err := manager.runConsoleSocket(ctx, config.ConsoleSocket); err != nil {
+				log.Println("console socket: ", err)
+			}
+		}()
+	}
+
+	// gRPC API for backend services, disabled unless an address is given
+	if config.GRPC.Addr != "" {
+		server, err := newGRPCServer(manager, config.GRPC.Cert, config.GRPC.Key, config.GRPC.ClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lis, err := net.Listen("tcp", config.GRPC.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(server.Serve(lis))
+		}()
+	}
+
+	// Serve on the configured listeners, :8080 by default
+	server := &http.Server{Handler: mux, Protocols: serverProtocols(config.HTTP2)}
+	if err := serveListeners(server, listenerConfigs(config)); err != nil {
+		log.Fatal(err)
+	}
+
+	// Wait for the orchestrator to tell us to stop, then fail readiness so no new
+	// traffic is sent here before shutting down the HTTP server
+	signalCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-signalCtx.Done()
+
+	log.Println("shutting down")
+	// Ask clients to move on, they get the shutdown delay to do so
+	manager.drain()
+	time.Sleep(shutdownDelay)
+	if status := manager.drainStatus(); !status.Drained {
+		log.Printf("%d clients still connected", status.Clients)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println(err)
+	}
+	if err := manager.store.Close(); err != nil {
+		log.Println(err)
+	}
 }
 
-func setupAPI(ctx context.Context) {
+// setupAPI creates the Manager and registers its routes on the router under the
+// base path of the config, see routes.go
+func setupAPI(ctx context.Context, config Config, router Router, options ...ManagerOption) (*Manager, error) {
 
 	// Create a Manager instance used to handle WebSocket Connections
-	manager := NewManager(ctx)
+	manager, err := NewManager(ctx, config, options...)
+	if err != nil {
+		return nil, err
+	}
+	mux := newRoutes(router, config.BasePath)
+	// Browsers on other origins use the login and the REST and admin APIs, see cors.go
+	api := mux.with(manager.cors)
 
-	http.HandleFunc("/login", manager.loginHandler)
-	http.HandleFunc("/ws", manager.serveWS)
+	api.HandleFunc("GET /csrf", manager.csrfHandler)
+	api.HandleFunc("/login", manager.requireCSRF(manager.loginHandler))
+	api.HandleFunc("POST /register", manager.requireCSRF(manager.registerHandler))
+	api.HandleFunc("POST /guest", manager.requireCSRF(manager.guestHandler))
+	mux.HandleFunc("GET /oidc/login", manager.oidcLoginHandler)
+	mux.HandleFunc("GET /oidc/callback", manager.oidcCallbackHandler)
+	api.HandleFunc("GET /verify", manager.verifyHandler)
+	api.HandleFunc("POST /password/change", manager.requireCSRF(manager.changePasswordHandler))
+	api.HandleFunc("GET /account", manager.accountHandler)
+	api.HandleFunc("DELETE /account", manager.requireCSRF(manager.accountHandler))
+	mux.HandleFunc("/ws", manager.serveWS)
+	// AsyncAPI document of the events of the websocket
+	api.HandleFunc("GET /asyncapi.json", manager.asyncAPIHandler)
+	// socket.io compatible endpoint, for frontends using the socket.io client
+	mux.HandleFunc("/socket.io/", manager.serveSocketIO)
+	// echo endpoint of the Autobahn test suite, only with autobahn.enabled
+	mux.HandleFunc("/autobahn", manager.serveAutobahn)
 
-	http.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+	// REST API for backends pushing events without holding a socket
+	api.HandleFunc("GET /api/rooms", manager.requirePublishAuth(manager.listRoomsHandler))
+	api.HandleFunc("GET /api/search", manager.requirePublishAuth(manager.searchHandler))
+	api.HandleFunc("GET /api/rooms/{room}/export", manager.requireScopeAuth(ScopeExport, manager.exportHandler("api")))
+	api.HandleFunc("POST /api/rooms/{room}/messages", manager.requirePublishAuth(manager.roomMessageHandler))
+	api.HandleFunc("POST /api/users/{user}/events", manager.requireAPIToken(manager.userEventHandler))
+	api.HandleFunc("GET /api/users/{user}/profile", manager.requireAPIToken(manager.getProfileHandler))
+	api.HandleFunc("PUT /api/users/{user}/profile", manager.requireAPIToken(manager.updateProfileHandler))
+
+	// Admin API for operators
+	api.HandleFunc("POST /admin/announcements", manager.requireAdminToken(manager.announceHandler))
+	api.HandleFunc("GET /admin/announcements", manager.requireAdminToken(manager.listAnnouncementsHandler))
+	api.HandleFunc("GET /admin/audit", manager.requireAdminToken(manager.auditQueryHandler))
+	api.HandleFunc("GET /admin/clients", manager.requireAdminToken(manager.listClientsHandler))
+	api.HandleFunc("POST /admin/clients/{target}/kick", manager.requireAdminToken(manager.kickHandler))
+	api.HandleFunc("POST /admin/clients/{target}/recording", manager.requireAdminToken(manager.startRecordingHandler))
+	api.HandleFunc("DELETE /admin/clients/{target}/recording", manager.requireAdminToken(manager.stopRecordingHandler))
+	api.HandleFunc("POST /admin/drain", manager.requireAdminToken(manager.drainHandler))
+	api.HandleFunc("POST /admin/apikeys", manager.requireAdminToken(manager.issueAPIKeyHandler))
+	api.HandleFunc("GET /admin/apikeys", manager.requireAdminToken(manager.listAPIKeysHandler))
+	api.HandleFunc("DELETE /admin/apikeys/{id}", manager.requireAdminToken(manager.revokeAPIKeyHandler))
+	api.HandleFunc("GET /admin/bans", manager.requireAdminToken(manager.listBansHandler))
+	api.HandleFunc("POST /admin/bans", manager.requireAdminToken(manager.banHandler))
+	api.HandleFunc("DELETE /admin/bans/{username}", manager.requireAdminToken(manager.unbanHandler))
+	api.HandleFunc("GET /admin/drain", manager.requireAdminToken(manager.drainStatusHandler))
+	api.HandleFunc("POST /admin/rooms/{room}/purge", manager.requireAdminToken(manager.purgeHandler))
+	api.HandleFunc("GET /admin/rooms/{room}/export", manager.requireAdminToken(manager.exportHandler("admin")))
+	api.HandleFunc("POST /admin/rooms/{room}/members", manager.requireAdminToken(manager.addMembersHandler))
+	api.HandleFunc("POST /admin/rooms/{room}/kick", manager.requireAdminToken(manager.kickRoomHandler))
+	api.HandleFunc("GET /admin/chaos", manager.requireAdminToken(manager.chaosHandler))
+	api.HandleFunc("PUT /admin/chaos", manager.requireAdminToken(manager.chaosHandler))
+	api.HandleFunc("DELETE /admin/chaos", manager.requireAdminToken(manager.chaosHandler))
+	api.HandleFunc("POST /admin/replay", manager.requireAdminToken(manager.replayHandler))
+	api.HandleFunc("POST /admin/users/{username}/erase", manager.requireAdminToken(manager.eraseHandler))
+	api.HandleFunc("GET /admin/quotas", manager.requireAdminToken(manager.quotasHandler))
+	api.HandleFunc("GET /admin/quotas/tenants/{tenant}", manager.requireAdminToken(manager.tenantUsageHandler))
+	api.HandleFunc("PUT /admin/quotas/tenants/{tenant}", manager.requireAdminToken(manager.setTenantQuotaHandler))
+	api.HandleFunc("DELETE /admin/quotas/tenants/{tenant}", manager.requireAdminToken(manager.setTenantQuotaHandler))
+	api.HandleFunc("DELETE /admin/quotas/users/{username}/messages", manager.requireAdminToken(manager.resetMessagesHandler))
+	manager.registerDebugHandlers(mux)
+	manager.registerClusterHandlers(mux)
+
+	// Health endpoints for orchestrators like Kubernetes
+	mux.HandleFunc("GET /healthz", manager.healthzHandler)
+	mux.HandleFunc("GET /readyz", manager.readyzHandler)
+
+	mux.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+		manager.RLock()
+		defer manager.RUnlock()
 		fmt.Fprint(w, len(manager.clients))
 	})
 
-	// Here could be front end handler but I am not gonna use it
+	// Demo frontend, turn it off in production with disable_frontend
+	if !config.DisableFrontend {
+		mux.Handle("/", http.StripPrefix(mux.base, frontendHandler()))
+	}
+
+	return manager, nil
 }
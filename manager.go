@@ -11,7 +11,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -24,20 +28,27 @@ var (
 	websocketUpgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		// remove for production
-		// CheckOrigin: func(r *http.Request) bool {
-		// 	return true
-		// },
-		CheckOrigin: checkOrigin,
+		// CheckOrigin is set by the Manager, which knows the allowed origins
+		// The subprotocol is negotiated by serveWS, see protocol.go
 	}
 
 	ErrEventNotSupported = errors.New("this event type is not supported")
+	ErrInvalidRoom       = errors.New("room name is required")
+	ErrInvalidRecipient  = errors.New("recipient is required")
+	ErrInvalidPushToken  = errors.New("push token needs a token and a platform of fcm or apns")
+	ErrHandlerPanic      = errors.New("handler panicked")
 )
 
 // Manager is used to hold references to all Client Registered, Broadcasting etc
 type Manager struct {
 	clients ClientList
 
+	// currentConfig is the server configuration, swapped when the config is reloaded
+	currentConfig atomic.Pointer[Config]
+
+	// upgrader is the websocketUpgrader checking origins against the config, with the buffers of the config
+	upgrader websocket.Upgrader
+
 	// Usinga a syncMutex here to be able to lock state before editing clients
 	// Could also use Channels to block
 	// A read-write mutex that allows multiple readers but only one writer.
@@ -46,102 +57,682 @@ type Manager struct {
 	// handlers are functions that are used to hande Events
 	handlers map[string]EventHandler
 
-	// otps is a map of allowed OTP to accept connections from
-	otps RetentionMap
+	// disconnectHooks are called for every client removed, disconnects counts them by close code, see close.go
+	disconnectHooks []DisconnectHook
+	disconnects     closeCounts
+	// streamHandlers read the payload of their events as a stream, see stream.go
+	streamHandlersLock sync.RWMutex
+	streamHandlers     map[string]StreamHandler
+
+	// otps are the OTPs allowed to connect, keyed by OTP
+	otps *TTLCache[string, OTP]
+
+	// oidc holds the OpenID Connect provider and the logins waiting for their callback
+	oidc *oidcAuth
+
+	// outboundFilters are applied to the events sent to every client, guarded by the manager lock, see outbound.go
+	outboundFilters []*outboundFilter
+
+	// commands are the slash commands by name, see command.go
+	commands     map[string]SlashCommand
+	commandsLock sync.RWMutex
+
+	// stateObjects are the kinds of state by name and states the state of each room, see statesync.go
+	stateObjects map[string]StateObject
+	states       map[stateKey]*syncedState
+	statesLock   sync.Mutex
+
+	// docs are the documents opened since the start, see docs.go
+	docs     map[docKey]*docSession
+	docsLock sync.Mutex
+	// docAwareness expires the awareness states that were not renewed
+	docAwareness *TTLCache[docAwarenessKey, *Client]
+
+	// lobbies are the lobbies waiting for their game by id and lobbyOf the lobby of each user, see lobby.go
+	lobbies     map[string]*Lobby
+	lobbyOf     map[string]string
+	lobbiesLock sync.Mutex
+
+	// nicknames are the names set with /nick, keyed by username
+	nicknames     map[string]string
+	nicknamesLock sync.Mutex
+
+	// reactionsLock serializes reaction updates, they read and rewrite the reactions of a message
+	reactionsLock sync.Mutex
+
+	// keysLock serializes changes to the E2EE key bundles, handing out a one-time prekey rewrites the bundle
+	keysLock sync.Mutex
+
+	// roomSettingsLock serializes room setting changes, they read and rewrite the stored room
+	roomSettingsLock sync.Mutex
+
+	// observers receive a copy of every event sent by the clients
+	observers map[chan ObservedEvent]struct{}
+
+	// notifications sends notifications to offline users, nil if no notifier is configured
+	notifications *notificationDispatcher
+
+	// store persists users, rooms, messages and bans
+	store Store
+
+	// announcements records the system messages sent by operators
+	announcements announcementLog
+
+	// auditLog records administrative and security events
+	auditLog AuditLog
+
+	// readinessChecks have to pass for the server to be ready for traffic
+	readinessChecks map[string]ReadinessCheck
+	// draining is set while the server is shutting down or drained by an operator
+	draining atomic.Bool
+	// drained is closed once draining and the last client disconnected
+	drained     chan struct{}
+	drainedOnce sync.Once
+
+	// handlerLatency holds how long handlers took, keyed by event type
+	handlerLatency *HistogramVec
+	// handlerSLO counts the slow handler runs, see slo.go
+	handlerSLO *handlerSLO
+	// ingress holds the transformers applied to received events and their metrics, see ingress.go
+	ingress *ingressPipeline
+	// writeLatency holds how long writing frames to clients took
+	writeLatency *Histogram
+	// rttLatency holds the round trip times of the pings of all clients
+	rttLatency *Histogram
+	// slowConsumers counts the slow_consumer warnings sent
+	slowConsumers atomic.Uint64
+	// away holds the users shown as away, see idle.go
+	away map[string]bool
+	// statuses holds the statuses users picked, see status.go
+	statuses     map[string]UserStatus
+	presenceLock sync.Mutex
+
+	// budget counts the bytes queued for clients against the memory budget
+	budget memoryBudget
+	// handlerPools runs handlers off the read goroutines, nil if handlers run inline
+	handlerPools *handlerPools
+
+	// poller waits for data on the connections in netpoll mode, nil otherwise
+	poller *netpoller
+
+	// members indexes the clients by room, guarded by the manager lock like clients
+	members map[string]ClientList
+
+	// rooms holds the sequence numbers and history of each room
+	rooms     map[string]*roomState
+	roomsLock sync.Mutex
+
+	// typing holds the users typing, their indicator is stopped once it expires
+	typing *TTLCache[typingKey, struct{}]
+
+	// qosSessions holds the unacked events of clients with at-least-once delivery
+	qosSessions *TTLCache[qosSessionKey, *qosSession]
+
+	// historyCache holds the latest messages of active rooms, nil if it is off
+	historyCache *historyCache
+
+	// clock tells the time, see clock.go
+	clock Clock
+	// ids makes the IDs of messages, clients and devices, see ids.go
+	ids IDGenerator
+	// timestamps writes the timestamps of strict envelopes, nil for the format of the config, see envelope.go
+	timestamps TimestampFormat
+
+	// loginFailures counts the failed logins per IP and username, see bruteforce.go
+	loginFailures *TTLCache[loginFailureKey, loginFailures]
+	loginThrottle loginThrottleCounters
+
+	// localSigningKey signs tokens unless signing keys are configured, see signing.go
+	localSigningKey []byte
+
+	// chaos holds the faults injected in chaos mode, see chaos.go
+	chaos atomic.Pointer[[]ChaosFault]
+
+	// quotas counts what the tenants use against their quotas, see quota.go
+	quotas *quotaUsage
+	// meter adds up the usage of the tenants, nil unless metering is on, see metering.go
+	meter *meter
+	// remoteFlags are the feature flags of the remote provider, see flags.go
+	remoteFlags atomic.Pointer[map[string]FeatureFlag]
+	// cluster tracks the other instances, nil unless clustered, see cluster.go
+	cluster *cluster
+	// raft is this instance in the Raft group, nil unless cluster.raft is on, see raft.go
+	raft *raftNode
+	// gossip is the list of the members of the cluster, nil unless cluster.gossip is on, see gossip.go
+	gossip *gossip
+}
+
+// ObservedEvent is an event sent by a client, as seen by observers
+type ObservedEvent struct {
+	ClientID string
+	Username string
+	Event    Event
 }
 
 // NewManager is used to initalize all the values inside the manager
-func NewManager(ctx context.Context) *Manager {
+// The options replace parts of the Manager, like the clock in tests
+func NewManager(ctx context.Context, config Config, options ...ManagerOption) (*Manager, error) {
+	store, err := newStore(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := newAuditLog(config.AuditLogPath, config.AuditLogMaxEntries)
+	if err != nil {
+		return nil, err
+	}
+
 	m := &Manager{
-		clients:  make(ClientList),
-		handlers: make(map[string]EventHandler),
+		clients:         make(ClientList),
+		handlers:        make(map[string]EventHandler),
+		streamHandlers:  make(map[string]StreamHandler),
+		observers:       make(map[chan ObservedEvent]struct{}),
+		store:           store,
+		auditLog:        auditLog,
+		readinessChecks: make(map[string]ReadinessCheck),
+		handlerLatency:  NewHistogramVec(latencyBuckets),
+		handlerSLO:      newHandlerSLO(),
+		ingress:         newIngressPipeline(),
+		writeLatency:    NewHistogram(latencyBuckets),
+		rttLatency:      NewHistogram(latencyBuckets),
+		members:         make(map[string]ClientList),
+		rooms:           make(map[string]*roomState),
+		drained:         make(chan struct{}),
+		oidc:            newOIDCAuth(),
+		commands:        make(map[string]SlashCommand),
+		stateObjects:    make(map[string]StateObject),
+		states:          make(map[stateKey]*syncedState),
+		docs:            make(map[docKey]*docSession),
+		lobbies:         make(map[string]*Lobby),
+		lobbyOf:         make(map[string]string),
+		nicknames:       make(map[string]string),
+		away:            make(map[string]bool),
+		statuses:        make(map[string]UserStatus),
+		clock:           systemClock{},
+		localSigningKey: newLocalSigningKey(),
+		quotas:          newQuotaUsage(),
+	}
+	for _, option := range options {
+		option(m)
+	}
+	m.qosSessions = NewTTLCache(ctx, TTLCacheOptions[qosSessionKey, *qosSession]{Clock: m.clock})
+	m.historyCache = newHistoryCache(ctx, config.HistoryCache, m.clock)
+	m.docAwareness = NewTTLCache(ctx, TTLCacheOptions[docAwarenessKey, *Client]{OnExpire: m.docAwarenessExpired, Clock: m.clock})
+	m.typing = NewTTLCache(ctx, TTLCacheOptions[typingKey, struct{}]{TTL: typingTimeout, OnExpire: m.typingExpired, Clock: m.clock})
+	m.otps = NewTTLCache(ctx, TTLCacheOptions[string, OTP]{TTL: otpTTL, SweepInterval: 400 * time.Millisecond, MaxEntries: maxOTPs, Clock: m.clock})
+	m.loginFailures = NewTTLCache(ctx, TTLCacheOptions[loginFailureKey, loginFailures]{MaxEntries: maxLoginFailureEntries, Clock: m.clock})
+	if m.ids == nil {
+		if m.ids, err = newIDGenerator(config.IDs, m.clock); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateEnvelope(config.Envelope); err != nil {
+		return nil, err
+	}
+
+	notifier, err := newOfflineNotifier(ctx, config.Notifications, m.store, m.clock)
+	if err != nil {
+		return nil, fmt.Errorf("notifications: %w", err)
+	}
+	if notifier != nil {
+		m.notifications = newNotificationDispatcher(ctx, notifier, config.Notifications, m.clock)
+	}
+
+	m.currentConfig.Store(&config)
+	m.upgrader = newUpgrader(config.Buffers)
+	m.upgrader.CheckOrigin = m.checkOrigin
+	m.upgrader.EnableCompression = config.EnableCompression
+
+	if config.Chaos.Enabled {
+		log.Println("chaos mode is enabled, faults can be injected into the traffic")
+		if err := m.setChaosFaults(config.Chaos.Faults); err != nil {
+			return nil, fmt.Errorf("chaos: %w", err)
+		}
+	}
+
+	sink, err := newUsageSink(config.Metering)
+	if err != nil {
+		return nil, fmt.Errorf("metering: %w", err)
+	}
+	if sink != nil {
+		m.meter = newMeter(sink)
+	}
+
+	if m.cluster, err = newCluster(config.Cluster, func() string { return m.config().Cluster.Secret }, m.now()); err != nil {
+		return nil, err
+	}
+	if config.Cluster.Raft.Bind != "" {
+		if m.cluster == nil {
+			return nil, fmt.Errorf("%w: raft needs node_id and secret", ErrInvalidCluster)
+		}
+		if m.raft, err = newRaftNode(config.Cluster.Raft); err != nil {
+			return nil, err
+		}
+	}
+	if config.Cluster.Gossip.AdvertiseURL != "" {
+		if m.cluster == nil {
+			return nil, fmt.Errorf("%w: gossip needs node_id and secret", ErrInvalidCluster)
+		}
+		if m.gossip, err = m.newGossip(config.Cluster); err != nil {
+			return nil, err
+		}
+	}
 
-		// Create a new retentionMap that remove OTPS older than 5 senconds
-		otps: NewRetentionMap(ctx, 20*time.Second),
+	if config.Netpoll {
+		if m.poller, err = newNetpoller(); err != nil {
+			return nil, err
+		}
+		go m.poller.run(ctx)
+	}
+
+	if config.Workers.Size > 0 {
+		m.handlerPools = newHandlerPools(ctx, config.Workers)
 	}
+
+	m.addReadinessCheck("message_store", store.Ping)
+
 	m.setupEventHandlers()
-	return m
+	m.setupCommands()
+	m.AddOutboundFilter(m.localizeOutbound)
+
+	// Every client starts in the default room, it is stored before anyone can ask for its settings
+	m.room(defaultRoom)
+
+	if err := m.startBots(ctx, config.Bots); err != nil {
+		return nil, err
+	}
+
+	// Deliver scheduled messages, including the ones stored before a restart
+	go m.runScheduler(ctx)
+	go m.runQoS(ctx)
+	go m.runRoomExpiry(ctx)
+	go m.runArchival(ctx)
+	go m.runLobbies(ctx)
+	go m.runTimers(ctx)
+	go m.runRetention(ctx)
+	go m.runMemoryBudget(ctx)
+	go m.runIdle(ctx)
+	if m.meter != nil {
+		go m.runMetering(ctx)
+	}
+	if url := config.FeatureFlags.RemoteURL; url != "" {
+		go m.runFlagProvider(ctx, HTTPFlagProvider{URL: url})
+	}
+	if m.cluster != nil {
+		go m.runCluster(ctx)
+	}
+	if m.raft != nil {
+		go m.runRaft(ctx)
+	}
+	if m.gossip != nil {
+		go m.runGossip(ctx)
+	}
+
+	return m, nil
+}
+
+// config returns the current configuration, don't hold on to it as it may be replaced
+func (m *Manager) config() *Config {
+	return m.currentConfig.Load()
 }
 
 // checkOrigin will check origin and return true if its allowed
-func checkOrigin(r *http.Request) bool {
+// All origins are allowed unless allowed origins are configured
+func (m *Manager) checkOrigin(r *http.Request) bool {
 
 	// Grab the request origin
 	origin := r.Header.Get("Origin")
 
-	switch origin {
-	case "http://localhost:8080":
-		return true
-	default:
-		return true
-	}
+	allowed := m.config().AllowedOrigins
+	return len(allowed) == 0 || slices.Contains(allowed, origin)
 }
 
 // setupEventHandlers configures and adds all handlers
 func (m *Manager) setupEventHandlers() {
-	m.handlers[EventSendMessage] = func(e Event, c *Client) error {
-		fmt.Println(e)
-		return nil
+	m.handlers[EventSendMessage] = SendMessageHandler
+	m.handlers[EventJoinRoom] = JoinRoomHandler
+	m.handlers[EventSendDirectMessage] = SendDirectMessageHandler
+	m.handlers[EventRegisterPushToken] = RegisterPushTokenHandler
+	m.handlers[EventScheduleMessage] = ScheduleMessageHandler
+	m.handlers[EventListScheduledMessages] = ListScheduledMessagesHandler
+	m.handlers[EventCancelScheduledMessage] = CancelScheduledMessageHandler
+	m.handlers[EventGetHistory] = GetHistoryHandler
+	m.handlers[EventAck] = AckHandler
+	m.handlers[EventTyping] = TypingHandler
+	m.handlers[EventAddReaction] = AddReactionHandler
+	m.handlers[EventRemoveReaction] = RemoveReactionHandler
+	m.handlers[EventGetRoom] = GetRoomHandler
+	m.handlers[EventUpdateRoom] = UpdateRoomHandler
+	m.handlers[EventInviteToRoom] = InviteToRoomHandler
+	m.handlers[EventListRooms] = ListRoomsHandler
+	m.handlers[EventPublishKeys] = PublishKeysHandler
+	m.handlers[EventFetchKeys] = FetchKeysHandler
+	m.handlers[EventE2EESend] = E2EESendHandler
+	m.handlers[EventListDevices] = ListDevicesHandler
+	m.handlers[EventRevokeDevice] = RevokeDeviceHandler
+	m.handlers[EventTimeSync] = TimeSyncHandler
+	m.handlers[EventHello] = HelloHandler
+	m.handlers[EventSwitchRoom] = SwitchRoomHandler
+	m.handlers[EventBulkAddMembers] = BulkAddMembersHandler
+	m.handlers[EventBulkAnnounce] = BulkAnnounceHandler
+	m.handlers[EventBulkKick] = BulkKickHandler
+	m.handlers[EventStats] = StatsHandler
+	m.handlers[EventSetNickname] = SetNicknameHandler
+	m.handlers[EventGetProfile] = GetProfileHandler
+	m.handlers[EventUpdateProfile] = UpdateProfileHandler
+	m.handlers[EventSetStatus] = SetStatusHandler
+	m.handlers[EventSearchMessages] = SearchMessagesHandler
+	m.handlers[EventSubscribeState] = SubscribeStateHandler
+	m.handlers[EventUnsubscribeState] = UnsubscribeStateHandler
+	m.handlers[EventUpdateState] = UpdateStateHandler
+	m.handlers[EventRTCSignal] = RTCSignalHandler
+	m.handlers[EventGetICEServers] = GetICEServersHandler
+	m.handlers[EventOpenDoc] = OpenDocHandler
+	m.handlers[EventCloseDoc] = CloseDocHandler
+	m.handlers[EventDocUpdate] = DocUpdateHandler
+	m.handlers[EventDocAwareness] = DocAwarenessHandler
+	m.handlers[EventDocSnapshot] = DocSnapshotHandler
+	m.handlers[EventCreateLobby] = CreateLobbyHandler
+	m.handlers[EventJoinLobby] = JoinLobbyHandler
+	m.handlers[EventFindLobby] = FindLobbyHandler
+	m.handlers[EventLeaveLobby] = LeaveLobbyHandler
+	m.handlers[EventLobbyReady] = LobbyReadyHandler
+	m.handlers[EventListLobbies] = ListLobbiesHandler
+}
+
+// SendMessageHandler will send out a message to all other participants in the chat room
+func SendMessageHandler(event Event, c *Client) error {
+	var chatevent SendMessageEvent
+	if err := json.Unmarshal(event.Payload, &chatevent); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
 	}
+
+	// Messages starting with a slash are commands, see command.go
+	if isCommand(chatevent.Message) {
+		return c.manager.runCommand(c, chatevent.Message)
+	}
+	chatevent.Message = strings.TrimPrefix(chatevent.Message, "/")
+	if err := c.manager.countMessage(c.username); err != nil {
+		return err
+	}
+
+	// Don't trust the client with who sent it
+	chatevent.From = c.username
+	chatevent.Nickname = c.manager.nickname(c.username)
+	chatevent.Action = false
+
+	_, err := c.manager.postMessage(c.manager.roomOf(c), chatevent)
+	return err
+}
+
+// JoinRoomHandler will move the client into another room
+func JoinRoomHandler(event Event, c *Client) error {
+	var joinevent JoinRoomEvent
+	if err := json.Unmarshal(event.Payload, &joinevent); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if err := validateRoomName(joinevent.Room); err != nil {
+		return err
+	}
+	if !c.allowedRoom(joinevent.Room) {
+		return c.roomError(joinevent.Room)
+	}
+
+	return c.manager.joinRoom(c, joinevent.Room)
 }
 
 // routeEvent is used to make sure the correct event goes into the correct handler
 func (m *Manager) reouteEvent(event Event, c *Client) error {
-	// Check is handler is present in Map
-	if handler, ok := m.handlers[event.Type]; ok {
-		// Execute the handler and return any err
-		if err := handler(event, c); err != nil {
+	m.notifyObservers(ObservedEvent{ClientID: c.id, Username: c.username, Event: event})
+
+	// Check is handler is present in Map, ephemeral event types share one
+	handler, ok := m.handlers[event.Type]
+	if !ok && m.isEphemeral(event.Type) {
+		handler, ok = EphemeralHandler, true
+	}
+	if !ok {
+		if streamHandler, found := m.streamHandler(event.Type); found {
+			handler, ok = streamHandler.asEventHandler(), true
+		}
+	}
+	if ok {
+		if err := m.checkEventFlag(event, c); err != nil {
 			return err
 		}
-		return nil
+		// Execute the handler and return any err
+		start := time.Now()
+		err := m.runHandler(handler, event, c)
+		m.observeHandler(event, c, time.Since(start))
+		if errors.Is(err, ErrQuotaExceeded) {
+			m.sendQuotaExceeded(c, err)
+		}
+		return err
 	} else {
 		return ErrEventNotSupported
 	}
 }
 
+// runHandler executes the handler, recovering from panics so a buggy handler can't
+// crash the server. The sender gets an error event, and is disconnected once it
+// caused more panics than allowed
+func (m *Manager) runHandler(handler EventHandler, event Event, c *Client) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		panics := c.panics.Add(1)
+		log.Printf("handler panic: event=%s client=%s user=%s panics=%d panic=%v\n%s",
+			event.Type, c.id, c.username, panics, r, debug.Stack())
+		err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+
+		m.sendError(c, "internal_error", map[string]string{"type": event.Type})
+
+		if limit := m.config().MaxHandlerPanics; limit > 0 && int(panics) >= limit {
+			log.Printf("disconnecting client %s after %d handler panics", c.id, panics)
+			c.failConnection(websocket.CloseInternalServerErr, "too many handler panics")
+			m.removeClient(c)
+		}
+	}()
+
+	return handler(event, c)
+}
+
+// observe registers a new observer of client events
+// The returned func has to be called to stop observing
+func (m *Manager) observe() (<-chan ObservedEvent, func()) {
+	m.Lock()
+	defer m.Unlock()
+
+	ch := make(chan ObservedEvent, egressBufferSize)
+	m.observers[ch] = struct{}{}
+
+	return ch, func() {
+		m.Lock()
+		defer m.Unlock()
+		delete(m.observers, ch)
+	}
+}
+
+// notifyObservers hands the event to all observers, slow observers miss events
+// instead of blocking the client
+func (m *Manager) notifyObservers(observed ObservedEvent) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for ch := range m.observers {
+		select {
+		case ch <- observed:
+		default:
+		}
+	}
+}
+
+// authenticateUpgrade checks the API key or the OTP of an upgrade request and that
+// the user isn't banned, before the connection is upgraded. The request is answered
+// and ok is false if it is rejected
+func (m *Manager) authenticateUpgrade(w http.ResponseWriter, r *http.Request) (verified OTP, apiKey *APIKey, ok bool) {
+	// Machine clients connect with an API key instead of an OTP
+	if raw, found := bearerAPIKey(r); found {
+		key, err := m.verifyAPIKey(raw, ScopeConnect)
+		if err != nil {
+			m.audit(AuditEntry{Action: AuditOTPRejected, RemoteAddr: r.RemoteAddr, Details: map[string]string{"api_key": err.Error()}})
+			w.WriteHeader(http.StatusUnauthorized)
+			return OTP{}, nil, false
+		}
+		apiKey = &key
+		verified = OTP{Username: key.Username}
+	} else {
+		// Grab the OTP int the Get param
+		otp := r.URL.Query().Get("otp")
+		if otp == "" {
+			// Tell the user its not authorized
+			w.WriteHeader(http.StatusUnauthorized)
+			return OTP{}, nil, false
+		}
+
+		// Verify OTP is existing
+		if verified, ok = m.verifyOTP(otp); !ok {
+			m.audit(AuditEntry{Action: AuditOTPRejected, RemoteAddr: r.RemoteAddr})
+			w.WriteHeader(http.StatusUnauthorized)
+			return OTP{}, nil, false
+		}
+		m.audit(AuditEntry{Action: AuditOTPVerified, Actor: verified.Username, RemoteAddr: r.RemoteAddr})
+	}
+
+	// The user could have been banned after getting the OTP
+	if m.isBanned(verified.Username) {
+		w.WriteHeader(http.StatusForbidden)
+		return OTP{}, nil, false
+	}
+	return verified, apiKey, true
+}
+
 // serveWS is a HTTP Handler that has the Manager that allows connections
 func (m *Manager) serveWS(w http.ResponseWriter, r *http.Request) {
+	// A draining server takes no new connections
+	if m.rejectDraining(w) {
+		return
+	}
+
+	// Before the OTP is used up, a client that can't speak any of the subprotocols can't connect
+	protocol, err := negotiateProtocol(r)
+	if err != nil {
+		w.Header().Set("Sec-WebSocket-Protocol", strings.Join(supportedSubprotocols(), ", "))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if m.rejectLoose(protocol) {
+		http.Error(w, ErrLooseEnvelope.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Grab the OTP int the Get param
-	otp := r.URL.Query().Get("otp")
-	fmt.Println(otp)
-	if otp == "" {
-		// Tell the user its not authorized
-		w.WriteHeader(http.StatusUnauthorized)
+	// Browsers have to show they got the page from an allowed origin, see csrf.go
+	if !m.checkUpgradeCSRF(r) {
+		http.Error(w, ErrCSRFToken.Error(), http.StatusForbidden)
 		return
 	}
 
-	// Verify OTP is existing
-	if !m.otps.VerifyOTP(otp) {
-		w.WriteHeader(http.StatusUnauthorized)
+	verified, apiKey, ok := m.authenticateUpgrade(w, r)
+	if !ok {
 		return
 	}
 
 	log.Println("New connections")
-	// Begin by upgrading the HTTP request
-	conn, err := websocketUpgrader.Upgrade(w, r, nil)
+
+	// In netpoll mode gorilla has to read through a frameConn, streams of HTTP/2
+	// connections can't be polled
+	var netpollWriter *netpollResponseWriter
+	if m.poller != nil && !isExtendedConnect(r) {
+		netpollWriter = &netpollResponseWriter{ResponseWriter: w}
+		w = netpollWriter
+	}
+
+	// Begin by upgrading the HTTP request, or the HTTP/2 stream, see http2.go
+	var conn *websocket.Conn
+	var stream *http2Stream
+	if isExtendedConnect(r) {
+		conn, stream, err = m.upgradeHTTP2(w, r, protocolHeader(r, protocol))
+	} else {
+		conn, err = m.upgrader.Upgrade(w, r, protocolHeader(r, protocol))
+	}
 	if err != nil {
 		log.Println(err)
 		return
 	}
-
 	// Create New Client
-	client := NewClient(conn, m)
+	client := NewClient(conn, m, verified.Username)
+	// Compression is negotiated before the user is known, it is only used if granted
+	client.compress.Store(m.featureGranted(FlagCompression, verified.Username))
+	client.setLocale(requestLocale(r))
+	if apiKey != nil {
+		client.apiKey = apiKey
+		// Keys limited to other rooms start in their first room
+		if !client.allowedRoom(client.room) {
+			client.room = apiKey.Rooms[0]
+		}
+	}
+
+	// Users keep their device across connections, see device.go, guests have none
+	if apiKey == nil && !client.guest {
+		device, err := m.registerDevice(verified.Username, r.URL.Query().Get("device"), r.URL.Query().Get("device_name"))
+		if err != nil {
+			log.Println("registering device: ", err)
+		}
+		client.deviceID = device.ID
+	}
+
+	// Clients can ask for at-least-once delivery, the session lets them resume after a reconnect.
+	// Without a session the device is used, so the same device resumes where it left off
+	if r.URL.Query().Get("qos") == "1" {
+		session := r.URL.Query().Get("session")
+		if session == "" {
+			session = client.deviceID
+		}
+		client.qos = m.qosSession(verified.Username, session)
+	}
+
+	// JSON clients can take several events per frame, see batch.go
+	if r.URL.Query().Get("batch") == "1" {
+		_, isJSON := client.codec.(jsonCodec)
+		client.batch.Store(isJSON && m.featureGranted(FlagBatching, verified.Username))
+	}
+
+	if netpollWriter != nil && m.startNetpollClient(client, netpollWriter.conn) {
+		return
+	}
+	m.startClient(client)
+
+	// The HTTP/2 stream ends with the handler, so it has to wait for the client to leave
+	if stream != nil {
+		stream.wait(r)
+	}
 
+	// We won't do anything yet so close connection again
+	// conn.Close()
+}
+
+// startClient adds the client and starts its read / write processes
+func (m *Manager) startClient(client *Client) {
 	// Add a newly created client to the manager
 	m.addClient(client)
 
+	if client.qos != nil {
+		m.redeliverPending(client)
+	}
+
 	// start the read / write processes
 	// we are going to have two goroutines
 	go client.readMessages()
 	go client.writeMessages()
-
-	// We won't do anything yet so close connection again
-	// conn.Close()
 }
 
 // addClient will add clients to our clientList
 func (m *Manager) addClient(client *Client) {
+	// The store is used before locking
+	m.loadNickname(client.username)
+	m.addMembership(client.username, client.room)
+
 	// Lock so we can manilpulate
 	m.Lock()
 	// defer will execute a function at the very end
@@ -149,21 +740,219 @@ func (m *Manager) addClient(client *Client) {
 
 	// Add Client
 	m.clients[client] = true
+	m.indexClient(client)
+	m.sendWelcome(client)
 }
 
 func (m *Manager) removeClient(client *Client) {
 	m.Lock()
 	defer m.Unlock()
+	m.dropClient(client)
+}
 
+// dropClient closes the client and removes it from the manager
+// Only call it while holding the manager write lock
+func (m *Manager) dropClient(client *Client) {
 	// Check is client exists, then delete it
 	if _, ok := m.clients[client]; ok {
-		// close connection
-		client.connection.Close()
+		if client.netpoll {
+			m.poller.remove(client)
+		}
+		// close connection, after telling the client with a close frame
+		go client.closeConnection()
+		// end the handlers still reading streams of the client
+		client.abortStreams()
+		// close egress so the writer stops, sends only happen under the lock so this is safe
+		close(client.egress)
+		close(client.priority)
+		client.releaseAll()
+		client.stopRecording()
+		m.meterDisconnect(client)
+		m.recordDisconnect(client)
 		// remove
 		delete(m.clients, client)
+		m.unindexClient(client)
+		// Guests are gone for good, so is a nickname or status they set
+		if client.guest {
+			m.setNickname(client.username, "")
+			m.presenceLock.Lock()
+			delete(m.statuses, client.username)
+			m.presenceLock.Unlock()
+		}
+
+		if m.draining.Load() && len(m.clients) == 0 {
+			m.markDrained()
+		}
 	}
 }
 
+// sendToClient sends the event to a single client, if it is still connected
+func (m *Manager) sendToClient(client *Client, event Event) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	if _, ok := m.clients[client]; !ok {
+		return false
+	}
+	return client.send(event)
+}
+
+// replyJSON marshals the payload and sends it as an event to the client
+func (m *Manager) replyJSON(client *Client, eventType string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", eventType, err)
+	}
+	m.sendToClient(client, Event{Type: eventType, Payload: data})
+	return nil
+}
+
+// findClient returns the client with the given id
+func (m *Manager) findClient(id string) (*Client, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for client := range m.clients {
+		if client.id == id {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
+// broadcast sends the event to all clients and returns how many it was queued for
+func (m *Manager) broadcast(event Event) int {
+	m.RLock()
+	defer m.RUnlock()
+
+	event = prepare(event)
+
+	delivered := 0
+	for client := range m.clients {
+		if client.send(event) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// SendDirectMessageHandler delivers a message to all clients of a single user,
+// if the user has no connected clients the offline notifier is used instead
+func SendDirectMessageHandler(event Event, c *Client) error {
+	var dmevent SendDirectMessageEvent
+	if err := json.Unmarshal(event.Payload, &dmevent); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if dmevent.To == "" {
+		return ErrInvalidRecipient
+	}
+	if err := c.manager.countMessage(c.username); err != nil {
+		return err
+	}
+
+	return c.manager.sendDirectMessage(c.username, dmevent.To, dmevent.Message)
+}
+
+// RegisterPushTokenHandler stores a device token of the user for push notifications
+func RegisterPushTokenHandler(event Event, c *Client) error {
+	var token PushToken
+	if err := json.Unmarshal(event.Payload, &token); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if token.Token == "" || (token.Platform != "fcm" && token.Platform != "apns") {
+		return ErrInvalidPushToken
+	}
+
+	return c.manager.store.SavePushToken(StoredPushToken{
+		Username:   c.username,
+		DeviceID:   c.deviceID,
+		Platform:   token.Platform,
+		Token:      token.Token,
+		Registered: c.manager.now(),
+	})
+}
+
+// sendDirectMessage delivers a message to all clients of a single user, on any
+// instance of the cluster, if the user has no connected clients the offline
+// notifier is used instead
+func (m *Manager) sendDirectMessage(from, to, text string) error {
+	message := DirectMessageEvent{
+		From:     from,
+		To:       to,
+		Nickname: m.nickname(from),
+		Message:  text,
+		Sent:     m.now(),
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal direct message: %v", err)
+	}
+
+	// The user may have clients on other instances, see dmroute.go
+	if _, connected := m.deliverToUser(message.To, Event{Type: EventDirectMessage, Payload: data}); !connected {
+		m.notifyOffline(OfflineNotification{
+			Username: message.To,
+			Type:     EventDirectMessage,
+			From:     message.From,
+			Summary:  message.Message,
+			Sent:     message.Sent,
+		})
+	}
+	return nil
+}
+
+// userConnected returns true if the user has at least one connected client, on
+// other instances of the cluster too, see dmroute.go
+func (m *Manager) userConnected(username string) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	for client := range m.clients {
+		if client.username == username {
+			return true
+		}
+	}
+	return m.remoteUserConnected(username)
+}
+
+// notifyOffline sends a notification to an offline user if a notifier is configured
+// and the user didn't mute notifications
+func (m *Manager) notifyOffline(n OfflineNotification) {
+	if m.notifications == nil || m.notificationsMuted(n.Username) {
+		return
+	}
+	m.notifications.notify(n)
+}
+
+// sendMessageToRoom wraps the chat message in a new_message event and sends it to the room
+func (m *Manager) sendMessageToRoom(room string, message SendMessageEvent) (int, error) {
+	id := m.newID()
+	data, err := json.Marshal(NewMessageEvent{
+		ID:               id,
+		SendMessageEvent: message,
+		Sent:             m.now(),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	return m.broadcastToRoom(room, id, Event{Type: EventNewMessage, Payload: data}), nil
+}
+
+// sendToUser sends the event to all clients of the user and returns how many it was queued for
+func (m *Manager) sendToUser(username string, event Event) int {
+	m.RLock()
+	defer m.RUnlock()
+
+	delivered := 0
+	for client := range m.clients {
+		if client.username == username && client.send(event) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
 // loginHandler is used to verify user authentication and return one time password
 func (m *Manager) loginHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -173,6 +962,7 @@ func (m *Manager) loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req userLoginRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -180,15 +970,35 @@ func (m *Manager) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Too many failed logins have to wait before trying again, see bruteforce.go
+	if m.rejectThrottledLogin(w, r, req.Username) {
+		return
+	}
+
 	// Authenticate user / Verify Access token, what ever auth method you use
-	if req.Username == "arti" && req.Password == "123" {
+	err = m.authenticate(req.Username, req.Password)
+	if errors.Is(err, ErrUnauthorized) {
+		m.loginFailed(r, req.Username)
+	}
+	if errors.Is(err, ErrEmailNotVerified) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil && !errors.Is(err, ErrUnauthorized) {
+		log.Println("login: ", err)
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+	if err == nil && !m.isBanned(req.Username) {
 		// format to return otp into the frontend
 		type response struct {
 			OTP string `json:"otp"`
 		}
 
 		// add a new OTP
-		otp := m.otps.NewOTP()
+		m.loginSucceeded(req.Username)
+		otp := m.newOTP(req.Username)
+		m.audit(AuditEntry{Action: AuditLogin, Actor: req.Username, RemoteAddr: r.RemoteAddr})
 
 		resp := response{
 			OTP: otp.Key,
@@ -208,5 +1018,6 @@ func (m *Manager) loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Failer to auth
+	m.audit(AuditEntry{Action: AuditLoginFailed, Actor: req.Username, RemoteAddr: r.RemoteAddr})
 	w.WriteHeader(http.StatusUnauthorized)
 }
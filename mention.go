@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// mentionPattern matches @username in a chat message
+var mentionPattern = regexp.MustCompile(`@([A-Za-z0-9_.-]+)`)
+
+// parseMentions returns the unique usernames mentioned in the message
+func parseMentions(message string) []string {
+	var mentions []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(message, -1) {
+		if !slices.Contains(mentions, match[1]) {
+			mentions = append(mentions, match[1])
+		}
+	}
+	return mentions
+}
+
+// postMessage sends the chat message to the room and notifies the users mentioned in it
+func (m *Manager) postMessage(room string, message SendMessageEvent) (int, error) {
+	if m.roomIsE2EE(room) {
+		return 0, fmt.Errorf("%w: %s", ErrE2EERoom, room)
+	}
+	if err := m.checkStorageQuota(room); err != nil {
+		return 0, err
+	}
+	if len(message.Mentions) == 0 {
+		message.Mentions = parseMentions(message.Message)
+	}
+	message.Mentions = m.existingUsers(message.Mentions)
+
+	delivered, err := m.sendMessageToRoom(room, message)
+	if err != nil {
+		return delivered, err
+	}
+	return delivered, m.deliverMentions(room, message)
+}
+
+// existingUsers filters the usernames down to the users that exist
+func (m *Manager) existingUsers(usernames []string) []string {
+	var existing []string
+	for _, username := range usernames {
+		if !slices.Contains(existing, username) && m.userExists(username) {
+			existing = append(existing, username)
+		}
+	}
+	return existing
+}
+
+// deliverMentions sends a mention event to every client of the mentioned users,
+// users without connected clients get an offline notification instead
+func (m *Manager) deliverMentions(room string, message SendMessageEvent) error {
+	mention := MentionEvent{
+		From:    message.From,
+		Room:    room,
+		Message: message.Message,
+		Sent:    m.now(),
+	}
+	data, err := json.Marshal(mention)
+	if err != nil {
+		return fmt.Errorf("failed to marshal mention: %v", err)
+	}
+
+	for _, username := range message.Mentions {
+		// Don't notify users about mentioning themselves, or while they muted notifications
+		if username == message.From || m.notificationsMuted(username) {
+			continue
+		}
+
+		if _, connected := m.deliverToUser(username, Event{Type: EventMention, Payload: data}); !connected {
+			m.notifyOffline(OfflineNotification{
+				Username: username,
+				Type:     EventMention,
+				From:     mention.From,
+				Summary:  mention.Message,
+				Sent:     mention.Sent,
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// A hosted deployment bills its customers by what they used. Metering adds up
+// what each tenant used, see quota.go for tenants, and emits it as usage records
+// to a sink every metering.interval:
+//
+//	connection_minutes   how long the clients of the users of the tenant were connected
+//	messages             messages the users sent, like messages_per_day counts them
+//	bytes_in, bytes_out  the size of the frames read from and written to the clients
+//	storage              bytes stored in the rooms of the tenant when the record was made
+//
+// The sink is file, appending the records as JSON Lines to metering.path, http,
+// POSTing them as a JSON array to metering.url, or kafka, producing one message
+// per record keyed by tenant to metering.topic through the Kafka REST proxy at
+// metering.url. Metering is off if no sink is set.
+//
+// The counts are added to the store every metering.save_interval and on shutdown,
+// and are only taken from it to be emitted, so they survive restarts and are
+// shared by the instances of a Postgres store. Records the sink refused are added
+// back and emitted with the next ones.
+
+const (
+	UsageSinkFile  = "file"
+	UsageSinkHTTP  = "http"
+	UsageSinkKafka = "kafka"
+)
+
+// UsageRecord is what a tenant used from Start to End
+type UsageRecord struct {
+	// ID is unique per record, so the billing side can drop records it got twice
+	ID                string    `json:"id"`
+	Tenant            string    `json:"tenant"`
+	Start             time.Time `json:"start"`
+	End               time.Time `json:"end"`
+	ConnectionMinutes float64   `json:"connection_minutes"`
+	Messages          int64     `json:"messages"`
+	BytesIn           int64     `json:"bytes_in"`
+	BytesOut          int64     `json:"bytes_out"`
+	// Storage is the bytes stored in the rooms of the tenant at End
+	Storage int64 `json:"storage"`
+}
+
+// UsageSink receives the usage records
+type UsageSink interface {
+	EmitUsage(ctx context.Context, records []UsageRecord) error
+}
+
+// FileUsageSink appends the records as JSON Lines to a file
+type FileUsageSink struct {
+	Path string
+}
+
+func (s FileUsageSink) EmitUsage(_ context.Context, records []UsageRecord) error {
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// HTTPUsageSink POSTs the records as a JSON array to an URL
+type HTTPUsageSink struct {
+	URL string
+}
+
+func (s HTTPUsageSink) EmitUsage(ctx context.Context, records []UsageRecord) error {
+	return postJSON(ctx, s.URL, nil, records)
+}
+
+// KafkaUsageSink produces the records to a topic through a Kafka REST proxy, there
+// is no Kafka client in the server
+type KafkaUsageSink struct {
+	// URL is the REST proxy, like http://kafka-rest:8082
+	URL   string
+	Topic string
+}
+
+// kafkaRecord is a record as the REST proxy takes it
+type kafkaRecord struct {
+	Key   string      `json:"key"`
+	Value UsageRecord `json:"value"`
+}
+
+func (s KafkaUsageSink) EmitUsage(ctx context.Context, records []UsageRecord) error {
+	body := struct {
+		Records []kafkaRecord `json:"records"`
+	}{}
+	for _, record := range records {
+		body.Records = append(body.Records, kafkaRecord{Key: record.Tenant, Value: record})
+	}
+	return postJSON(ctx, s.URL+"/topics/"+url.PathEscape(s.Topic),
+		map[string]string{"Content-Type": "application/vnd.kafka.json.v2+json"}, body)
+}
+
+// newUsageSink returns the configured sink, or nil if metering is off
+func newUsageSink(config MeteringConfig) (UsageSink, error) {
+	switch config.Sink {
+	case "":
+		return nil, nil
+	case UsageSinkFile:
+		if config.Path == "" {
+			return nil, fmt.Errorf("the %s sink needs a path", config.Sink)
+		}
+		return FileUsageSink{Path: config.Path}, nil
+	case UsageSinkHTTP:
+		if config.URL == "" {
+			return nil, fmt.Errorf("the %s sink needs an url", config.Sink)
+		}
+		return HTTPUsageSink{URL: config.URL}, nil
+	case UsageSinkKafka:
+		if config.URL == "" || config.Topic == "" {
+			return nil, fmt.Errorf("the %s sink needs an url and a topic", config.Sink)
+		}
+		return KafkaUsageSink{URL: config.URL, Topic: config.Topic}, nil
+	}
+	return nil, fmt.Errorf("unknown sink %q, use file, http or kafka", config.Sink)
+}
+
+// clientMeter is how much of a client was metered already
+type clientMeter struct {
+	at       time.Time
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// meter adds up the usage of the tenants until it is saved to the store
+type meter struct {
+	sync.Mutex
+	sink UsageSink
+	// usage is what the tenants used since it was last saved, keyed by tenant
+	usage map[string]*Usage
+	// clients holds how much of each connected client was metered
+	clients map[*Client]clientMeter
+}
+
+func newMeter(sink UsageSink) *meter {
+	return &meter{sink: sink, usage: make(map[string]*Usage), clients: make(map[*Client]clientMeter)}
+}
+
+// tenant returns the usage of the tenant, creating it if needed
+// Only call it while holding the lock
+func (mt *meter) tenant(tenant string, now time.Time) *Usage {
+	usage, ok := mt.usage[tenant]
+	if !ok {
+		usage = &Usage{Tenant: tenant, Since: now}
+		mt.usage[tenant] = usage
+	}
+	return usage
+}
+
+// client adds what the client used since it was last metered
+// Only call it while holding the lock
+func (mt *meter) client(c *Client, tenant string, now time.Time) {
+	mark, ok := mt.clients[c]
+	if !ok {
+		mark.at = c.connectedAt
+	}
+	in, out := c.traffic.bytesIn.Load(), c.traffic.bytesOut.Load()
+
+	mt.tenant(tenant, mark.at).add(Usage{
+		Since:             mark.at,
+		ConnectionSeconds: max(now.Sub(mark.at), 0).Seconds(),
+		BytesIn:           int64(in - mark.bytesIn),
+		BytesOut:          int64(out - mark.bytesOut),
+	})
+	mt.clients[c] = clientMeter{at: now, bytesIn: in, bytesOut: out}
+}
+
+// meterMessage counts a message sent by a user of the tenant
+func (m *Manager) meterMessage(tenant string) {
+	if m.meter == nil {
+		return
+	}
+	m.meter.Lock()
+	m.meter.tenant(tenant, m.now()).Messages++
+	m.meter.Unlock()
+}
+
+// meterDisconnect adds the rest of what the client used, it is not metered anymore
+// Only call it while holding the manager lock
+func (m *Manager) meterDisconnect(c *Client) {
+	if m.meter == nil {
+		return
+	}
+	m.meter.Lock()
+	m.meter.client(c, m.tenantOf(c.username), m.now())
+	delete(m.meter.clients, c)
+	m.meter.Unlock()
+}
+
+// saveUsage adds what the tenants used since the last save to the store
+func (m *Manager) saveUsage() {
+	now := m.now()
+	m.RLock()
+	m.meter.Lock()
+	for client := range m.clients {
+		m.meter.client(client, m.tenantOf(client.username), now)
+	}
+	usage := m.meter.usage
+	m.meter.usage = make(map[string]*Usage)
+	m.meter.Unlock()
+	m.RUnlock()
+
+	for tenant, u := range usage {
+		if err := m.store.AddUsage(*u); err != nil {
+			log.Printf("saving the usage of %s: %v", tenant, err)
+		}
+	}
+}
+
+// emitUsage takes the usage from the store and emits it with the storage of the
+// tenants, the usage is added back if the sink fails
+func (m *Manager) emitUsage(ctx context.Context, since time.Time) error {
+	usage, err := m.store.TakeUsage()
+	if err != nil {
+		return err
+	}
+	rooms, err := m.store.ListRooms()
+	if err != nil {
+		m.restoreUsage(usage)
+		return err
+	}
+
+	now := m.now()
+	records := make(map[string]*UsageRecord)
+	record := func(tenant string) *UsageRecord {
+		r, ok := records[tenant]
+		if !ok {
+			r = &UsageRecord{ID: m.newID(), Tenant: tenant, Start: since, End: now}
+			records[tenant] = r
+		}
+		return r
+	}
+	for _, u := range usage {
+		r := record(u.Tenant)
+		r.Start = u.Since
+		r.ConnectionMinutes = u.ConnectionSeconds / 60
+		r.Messages = u.Messages
+		r.BytesIn = u.BytesIn
+		r.BytesOut = u.BytesOut
+	}
+	for _, room := range rooms {
+		if room.Owner == "" {
+			continue
+		}
+		storage, err := m.roomStorage(room.Name)
+		if err != nil {
+			log.Printf("counting the storage of room %s: %v", room.Name, err)
+			continue
+		}
+		record(m.tenantOf(room.Owner)).Storage += storage
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	list := make([]UsageRecord, 0, len(records))
+	for _, r := range records {
+		list = append(list, *r)
+	}
+	if err := m.meter.sink.EmitUsage(ctx, list); err != nil {
+		m.restoreUsage(usage)
+		return err
+	}
+	log.Printf("emitted usage records of %d tenants", len(list))
+	return nil
+}
+
+// restoreUsage adds the taken usage back to the store
+func (m *Manager) restoreUsage(usage []Usage) {
+	for _, u := range usage {
+		if err := m.store.AddUsage(u); err != nil {
+			log.Printf("restoring the usage of %s: %v", u.Tenant, err)
+		}
+	}
+}
+
+// runMetering saves the usage and emits the records at their intervals, the usage
+// is saved a last time on shutdown
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runMetering(ctx context.Context) {
+	emitted := m.now()
+	for {
+		// The intervals are read every time so a config reload applies to the next run
+		config := m.config().Metering
+		save := time.Duration(config.SaveInterval)
+		if save <= 0 {
+			save = time.Minute
+		}
+
+		select {
+		case <-time.After(save):
+		case <-ctx.Done():
+			m.saveUsage()
+			return
+		}
+
+		m.saveUsage()
+		if m.now().Sub(emitted) < time.Duration(config.Interval) {
+			continue
+		}
+		if err := m.emitUsage(ctx, emitted); err != nil {
+			log.Println("emitting usage: ", err)
+			continue
+		}
+		emitted = m.now()
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the buckets used for latency histograms
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Histogram counts observations into buckets, like a Prometheus histogram
+type Histogram struct {
+	sync.Mutex
+	bounds []float64
+	// counts holds the number of observations per bucket, the last one is +Inf
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramSnapshot is a copy of a Histogram at one point in time
+type HistogramSnapshot struct {
+	// Buckets are cumulative, each holds the observations less or equal to its bound
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+}
+
+// HistogramBucket is a single bucket of a HistogramSnapshot
+type HistogramBucket struct {
+	// Le is the upper bound, +Inf is written as a float64 max so it survives JSON
+	Le    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+// NewHistogram creates a histogram with the given bucket bounds, which have to be sorted
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe adds a value to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// ObserveDuration adds a duration in seconds to the histogram
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Snapshot returns the current state of the histogram
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.Lock()
+	defer h.Unlock()
+
+	snapshot := HistogramSnapshot{Count: h.count, Sum: h.sum}
+	var cumulative uint64
+	for i, c := range h.counts {
+		cumulative += c
+		le := math.MaxFloat64
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		snapshot.Buckets = append(snapshot.Buckets, HistogramBucket{Le: le, Count: cumulative})
+	}
+	return snapshot
+}
+
+// HistogramVec is a set of histograms keyed by a label, like the event type
+type HistogramVec struct {
+	sync.RWMutex
+	bounds     []float64
+	histograms map[string]*Histogram
+}
+
+// NewHistogramVec creates an empty set of histograms sharing the bucket bounds
+func NewHistogramVec(bounds []float64) *HistogramVec {
+	return &HistogramVec{bounds: bounds, histograms: make(map[string]*Histogram)}
+}
+
+// With returns the histogram for the label, creating it if needed
+func (v *HistogramVec) With(label string) *Histogram {
+	v.RLock()
+	h, ok := v.histograms[label]
+	v.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if h, ok = v.histograms[label]; !ok {
+		h = NewHistogram(v.bounds)
+		v.histograms[label] = h
+	}
+	return h
+}
+
+// Snapshot returns the state of all histograms keyed by label
+func (v *HistogramVec) Snapshot() map[string]HistogramSnapshot {
+	v.RLock()
+	defer v.RUnlock()
+
+	snapshots := make(map[string]HistogramSnapshot, len(v.histograms))
+	for label, h := range v.histograms {
+		snapshots[label] = h.Snapshot()
+	}
+	return snapshots
+}
@@ -0,0 +1,39 @@
+-- Initial schema: users, rooms, room messages, scheduled messages and bans
+
+CREATE TABLE users (
+    username      TEXT PRIMARY KEY,
+    password_hash TEXT NOT NULL,
+    created       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE rooms (
+    name    TEXT PRIMARY KEY,
+    created TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE messages (
+    room    TEXT NOT NULL,
+    seq     BIGINT NOT NULL,
+    type    TEXT NOT NULL,
+    payload JSONB,
+    sent    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (room, seq)
+);
+
+CREATE TABLE scheduled_messages (
+    id         TEXT PRIMARY KEY,
+    author     TEXT NOT NULL,
+    room       TEXT NOT NULL DEFAULT '',
+    recipient  TEXT NOT NULL DEFAULT '',
+    message    TEXT NOT NULL,
+    deliver_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX scheduled_messages_deliver_at ON scheduled_messages (deliver_at);
+
+CREATE TABLE bans (
+    username TEXT PRIMARY KEY,
+    reason   TEXT NOT NULL DEFAULT '',
+    actor    TEXT NOT NULL DEFAULT '',
+    created  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
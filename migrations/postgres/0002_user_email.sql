@@ -0,0 +1,5 @@
+-- Email verification of registered users, verification_token is cleared once verified
+
+ALTER TABLE users
+    ADD COLUMN email              TEXT NOT NULL DEFAULT '',
+    ADD COLUMN verification_token TEXT NOT NULL DEFAULT '';
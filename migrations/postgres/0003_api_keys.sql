@@ -0,0 +1,12 @@
+-- API keys of machine clients, revoked keys are kept with their revocation time
+
+CREATE TABLE api_keys (
+    id          TEXT PRIMARY KEY,
+    name        TEXT NOT NULL DEFAULT '',
+    username    TEXT NOT NULL,
+    secret_hash TEXT NOT NULL,
+    scopes      TEXT[] NOT NULL,
+    rooms       TEXT[] NOT NULL DEFAULT '{}',
+    created     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked     TIMESTAMPTZ
+);
@@ -0,0 +1,7 @@
+-- Chat messages get an id so they can be reacted to, reactions are stored with the
+-- message as {"emoji": ["username", ...]}
+
+ALTER TABLE messages ADD COLUMN id TEXT;
+ALTER TABLE messages ADD COLUMN reactions JSONB;
+
+CREATE UNIQUE INDEX messages_id ON messages (id);
@@ -0,0 +1,11 @@
+-- Room settings: owner, topic, member limit, retention and visibility with the
+-- invited users of private rooms
+
+ALTER TABLE rooms
+    ADD COLUMN owner             TEXT NOT NULL DEFAULT '',
+    ADD COLUMN topic             TEXT NOT NULL DEFAULT '',
+    ADD COLUMN description       TEXT NOT NULL DEFAULT '',
+    ADD COLUMN max_members       INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN retention_seconds BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN visibility        TEXT NOT NULL DEFAULT '',
+    ADD COLUMN invited           TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,6 @@
+-- Ephemeral rooms are closed after being idle or at a fixed time
+
+ALTER TABLE rooms
+    ADD COLUMN ephemeral            BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN idle_timeout_seconds BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN expires_at           TIMESTAMPTZ;
@@ -0,0 +1,5 @@
+-- Rooms can cap how many of their messages are kept, 0 uses the server default
+
+ALTER TABLE rooms ADD COLUMN max_messages INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX messages_room_sent ON messages (room, sent);
@@ -0,0 +1,14 @@
+-- End-to-end encryption: rooms flagged as E2EE and the public keys of client devices
+
+ALTER TABLE rooms ADD COLUMN e2ee BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE key_bundles (
+    username         TEXT NOT NULL,
+    device_id        TEXT NOT NULL,
+    identity_key     TEXT NOT NULL,
+    signed_prekey    TEXT NOT NULL,
+    prekey_signature TEXT NOT NULL,
+    one_time_prekeys TEXT[] NOT NULL DEFAULT '{}',
+    updated          TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (username, device_id)
+);
@@ -0,0 +1,10 @@
+-- Devices users connected from, so they can be listed and revoked
+
+CREATE TABLE devices (
+    username  TEXT NOT NULL,
+    id        TEXT NOT NULL,
+    name      TEXT NOT NULL DEFAULT '',
+    created   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (username, id)
+);
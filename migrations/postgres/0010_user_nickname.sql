@@ -0,0 +1,3 @@
+-- Nicknames users picked with set_nickname or /nick
+
+ALTER TABLE users ADD COLUMN nickname TEXT NOT NULL DEFAULT '';
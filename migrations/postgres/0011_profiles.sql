@@ -0,0 +1,8 @@
+-- Profiles users show others, the display name is the nickname of the users table
+
+CREATE TABLE profiles (
+    username    TEXT PRIMARY KEY,
+    avatar_url  TEXT NOT NULL DEFAULT '',
+    status_text TEXT NOT NULL DEFAULT '',
+    updated     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,6 @@
+-- Full text index of the chat messages for search_messages, see search.go
+
+ALTER TABLE messages ADD COLUMN search tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', coalesce(payload->>'message', ''))) STORED;
+
+CREATE INDEX messages_search ON messages USING GIN (search);
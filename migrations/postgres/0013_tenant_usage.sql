@@ -0,0 +1,10 @@
+-- Usage of the tenants that was not reported to the metering sink yet, see metering.go
+
+CREATE TABLE tenant_usage (
+    tenant             TEXT PRIMARY KEY,
+    since              TIMESTAMPTZ NOT NULL,
+    connection_seconds DOUBLE PRECISION NOT NULL DEFAULT 0,
+    messages           BIGINT NOT NULL DEFAULT 0,
+    bytes_in           BIGINT NOT NULL DEFAULT 0,
+    bytes_out          BIGINT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,22 @@
+-- Collaborative documents of the rooms, see docs.go. The updates after the
+-- snapshot of a document are kept until a client merges them into a new one
+
+CREATE TABLE doc_updates (
+    room   TEXT NOT NULL,
+    doc    TEXT NOT NULL,
+    seq    BIGINT NOT NULL,
+    data   BYTEA NOT NULL,
+    sender TEXT NOT NULL,
+    sent   TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (room, doc, seq)
+);
+
+CREATE TABLE doc_snapshots (
+    room   TEXT NOT NULL,
+    doc    TEXT NOT NULL,
+    seq    BIGINT NOT NULL,
+    state  BYTEA NOT NULL,
+    sender TEXT NOT NULL,
+    saved  TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (room, doc)
+);
@@ -0,0 +1,12 @@
+-- Timers of the rooms, see timers.go. The instance owning the room when a timer
+-- is due deletes it and broadcasts its event
+
+CREATE TABLE room_timers (
+    id        TEXT PRIMARY KEY,
+    room      TEXT NOT NULL,
+    fires_at  TIMESTAMPTZ NOT NULL,
+    event     JSONB NOT NULL,
+    countdown BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX room_timers_fires_at ON room_timers (fires_at);
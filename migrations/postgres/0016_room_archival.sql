@@ -0,0 +1,3 @@
+-- Rooms archived for being inactive, see archive.go
+
+ALTER TABLE rooms ADD COLUMN archived_at TIMESTAMPTZ;
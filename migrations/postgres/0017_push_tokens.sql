@@ -0,0 +1,11 @@
+-- Push tokens of devices, so offline users are still notified after a restart and
+-- by every instance, see notify.go
+
+CREATE TABLE push_tokens (
+    username   TEXT NOT NULL,
+    platform   TEXT NOT NULL,
+    token      TEXT NOT NULL,
+    device_id  TEXT NOT NULL DEFAULT '',
+    registered TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (username, platform, token)
+);
@@ -0,0 +1,10 @@
+-- The rooms users are members of, so searching doesn't go through every room, see search.go
+
+CREATE TABLE memberships (
+    username TEXT NOT NULL,
+    room     TEXT NOT NULL,
+    joined   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (username, room)
+);
+
+CREATE INDEX memberships_room ON memberships (room);
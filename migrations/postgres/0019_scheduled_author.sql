@@ -0,0 +1,3 @@
+-- Scheduled messages are listed and counted by their author, see schedule.go
+
+CREATE INDEX scheduled_messages_author ON scheduled_messages (author, deliver_at);
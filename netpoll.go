@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// In netpoll mode idle connections don't hold any goroutine. The connections
+// are registered with an epoll instance and a read goroutine is only started
+// when data arrives, writes are done by a goroutine started when events are
+// queued, see flush. Only Linux supports it, see netpoll_linux.go.
+//
+// A read goroutine must not block waiting for the next frame, so in this mode
+// the server sends no websocket pings, whose pongs would be followed by such
+// a wait. Dead peers are found with TCP keepalives instead. Clients that send
+// pings themselves still work, but hold a goroutine until their next message.
+// Socket.IO clients expect Engine.IO pings and always use the goroutine mode.
+
+var (
+	ErrNetpollUnsupported = errors.New("netpoll mode is only supported on linux")
+)
+
+// netpollKeepAliveCount is how many TCP keepalive probes may go unanswered
+// before the connection is considered dead
+var netpollKeepAliveCount = 3
+
+// frameConn wraps the connection given to gorilla, so its buffered reader never
+// reads past the end of the current websocket frame. Data left in that buffer
+// would not wake up epoll, and the message would not be read until the next one.
+type frameConn struct {
+	net.Conn
+
+	// headerBuf holds the header of the current frame, header is the part not yet returned
+	headerBuf [14]byte
+	header    []byte
+	// remaining is the number of payload bytes of the current frame not yet returned
+	remaining int64
+	inFrame   bool
+}
+
+func (c *frameConn) Read(p []byte) (int, error) {
+	if !c.inFrame {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+		c.inFrame = true
+	}
+
+	if len(c.header) > 0 {
+		n := copy(p, c.header)
+		c.header = c.header[n:]
+		c.endFrame()
+		return n, nil
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.Conn.Read(p)
+	c.remaining -= int64(n)
+	c.endFrame()
+	return n, err
+}
+
+// endFrame starts looking for the next header once the frame has been returned
+func (c *frameConn) endFrame() {
+	if len(c.header) == 0 && c.remaining == 0 {
+		c.inFrame = false
+	}
+}
+
+// readHeader reads the header of the next frame, see RFC 6455 section 5.2
+func (c *frameConn) readHeader() error {
+	head := c.headerBuf[:2]
+	if _, err := io.ReadFull(c.Conn, head); err != nil {
+		return err
+	}
+
+	size := 2
+	switch head[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	// Frames sent by clients are masked
+	if head[1]&0x80 != 0 {
+		size += 4
+	}
+
+	head = c.headerBuf[:size]
+	if _, err := io.ReadFull(c.Conn, head[2:]); err != nil {
+		return err
+	}
+
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(head[2:4]))
+	case 127:
+		length = int64(binary.BigEndian.Uint64(head[2:10]))
+	}
+
+	c.header = head
+	c.remaining = length
+	return nil
+}
+
+// netpollResponseWriter hands gorilla a frameConn when it hijacks the connection
+type netpollResponseWriter struct {
+	http.ResponseWriter
+	conn *frameConn
+}
+
+func (w *netpollResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &frameConn{Conn: conn}
+	return w.conn, brw, nil
+}
+
+// startNetpollClient registers the client with the poller instead of starting
+// its read and write goroutines, false is returned if the connection can't be
+// polled and the goroutines have to be used
+func (m *Manager) startNetpollClient(client *Client, conn *frameConn) bool {
+	tcp, ok := conn.Conn.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+
+	// Keepalives replace the websocket pings
+	config := m.config()
+	err := tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     config.pongWait(),
+		Interval: config.pingInterval(),
+		Count:    netpollKeepAliveCount,
+	})
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	client.netpoll = true
+	client.connection.SetReadLimit(int64(m.readLimit()))
+	// A pong only arrives if the client pinged, it must not set a read deadline
+	client.connection.SetPongHandler(func(string) error { return nil })
+	client.handleClose()
+
+	m.addClient(client)
+	if client.qos != nil {
+		m.redeliverPending(client)
+	}
+
+	if err := m.poller.add(tcp, client); err != nil {
+		log.Println(err)
+		m.removeClient(client)
+	}
+	return true
+}
+
+// readReady is called by the poller when data arrived for the client
+// It reads one message and asks the poller for the next notification
+func (c *Client) readReady() {
+	if !c.readMessage() {
+		c.manager.removeClient(c)
+		return
+	}
+	if err := c.manager.poller.rearm(c); err != nil {
+		c.manager.removeClient(c)
+	}
+}
+
+// wake starts a flush of the queued events if none is running
+func (c *Client) wake() {
+	if c.flushing.CompareAndSwap(false, true) {
+		go c.flush()
+	}
+}
+
+// flush writes the queued events and exits once the queues are empty, it
+// replaces writeMessages in netpoll mode
+func (c *Client) flush() {
+	for {
+		if !c.flushQueues() {
+			// The client was removed, nothing will be written anymore
+			return
+		}
+		c.flushing.Store(false)
+
+		// An event queued after the queues were found empty but before the flag
+		// was cleared did not start a flush, so check once more
+		if len(c.priority) == 0 && len(c.egress) == 0 {
+			return
+		}
+		if !c.flushing.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+// flushQueues writes events until both queues are empty, false is returned
+// once they are closed
+func (c *Client) flushQueues() bool {
+	for {
+		// High priority events skip ahead of everything queued on egress
+		select {
+		case message, ok := <-c.priority:
+			if !ok {
+				return false
+			}
+			c.writeEvent(message)
+			continue
+		default:
+		}
+
+		select {
+		case message, ok := <-c.egress:
+			if !ok {
+				return false
+			}
+			message = c.uncoalesce(message)
+			if !c.batch.Load() {
+				c.writeEvent(message)
+				continue
+			}
+			batch, open := c.batchOf(message)
+			c.writeBatch(batch)
+			if !open {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
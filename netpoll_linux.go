@@ -0,0 +1,115 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// netpoller waits for data on the connections of netpoll clients with epoll
+// Connections are registered one shot, so a connection is handled by at most
+// one read goroutine and is armed again once it is done
+type netpoller struct {
+	epfd int
+
+	sync.Mutex
+	clients map[int]*Client
+}
+
+// netpollEvents are the epoll events a connection is armed for
+const netpollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+func newNetpoller() (*netpoller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &netpoller{epfd: epfd, clients: make(map[int]*Client)}, nil
+}
+
+// fdOf returns the file descriptor of the connection
+func fdOf(conn *net.TCPConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd int
+	err = raw.Control(func(f uintptr) { fd = int(f) })
+	return fd, err
+}
+
+// add registers the connection of the client
+func (p *netpoller) add(conn *net.TCPConn, client *Client) error {
+	fd, err := fdOf(conn)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.clients[fd] = client
+	p.Unlock()
+	client.fd = fd
+
+	event := syscall.EpollEvent{Events: netpollEvents, Fd: int32(fd)}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		p.remove(client)
+		return err
+	}
+	return nil
+}
+
+// rearm asks for the next notification of the client after one was handled
+// The lock orders the finished read before the next one started by run
+func (p *netpoller) rearm(client *Client) error {
+	p.Lock()
+	defer p.Unlock()
+
+	event := syscall.EpollEvent{Events: netpollEvents, Fd: int32(client.fd)}
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, client.fd, &event)
+}
+
+// remove forgets the client, call it before its connection is closed so the
+// file descriptor is not reused meanwhile
+func (p *netpoller) remove(client *Client) {
+	p.Lock()
+	defer p.Unlock()
+	if p.clients[client.fd] == client {
+		delete(p.clients, client.fd)
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, client.fd, nil)
+	}
+}
+
+// run waits for connections with data and starts a read goroutine for each
+// Is Blocking, so run as a Goroutine
+func (p *netpoller) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		syscall.Close(p.epfd)
+	}()
+
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("netpoll: ", err)
+			}
+			return
+		}
+
+		p.Lock()
+		for _, event := range events[:n] {
+			if client, ok := p.clients[int(event.Fd)]; ok {
+				go client.readReady()
+			}
+		}
+		p.Unlock()
+	}
+}
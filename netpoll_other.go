@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// netpoller is not available outside of Linux, newNetpoller always fails
+type netpoller struct{}
+
+func newNetpoller() (*netpoller, error) {
+	return nil, ErrNetpollUnsupported
+}
+
+func (p *netpoller) add(conn *net.TCPConn, client *Client) error { return ErrNetpollUnsupported }
+func (p *netpoller) rearm(client *Client) error                  { return ErrNetpollUnsupported }
+func (p *netpoller) remove(client *Client)                       {}
+func (p *netpoller) run(ctx context.Context)                     {}
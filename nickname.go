@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Users pick a display name with the set_nickname event or /nick, it is shown
+// instead of the username in messages, direct messages, presence and member
+// events. Nicknames of registered users are kept in the user store and loaded
+// when they connect, the ones of other users only last until the server restarts.
+// Nobody else in the rooms of the user may already go by the nickname, as nickname
+// or as username, so users can't pass as each other. Changes are sent to the rooms of
+// the user as nickname_changed events.
+
+const (
+	// EventSetNickname is sent by a client to change the nickname of its user, an empty one clears it
+	EventSetNickname = "set_nickname"
+	// EventNicknameChanged is sent to the rooms of a user that changed nickname
+	EventNicknameChanged = "nickname_changed"
+)
+
+var (
+	ErrInvalidNickname = errors.New("nicknames are letters, digits, spaces and . - _ '")
+	ErrNicknameTaken   = errors.New("somebody in the room already goes by that name")
+)
+
+// maxNicknameLength is the longest nickname in characters
+var maxNicknameLength = 32
+
+// SetNicknameEvent is the payload sent in the
+// set_nickname event
+type SetNicknameEvent struct {
+	Nickname string `json:"nickname"`
+}
+
+// NicknameChangedEvent is the payload sent in the
+// nickname_changed event
+type NicknameChangedEvent struct {
+	Username string `json:"username"`
+	// Nickname is empty if the user cleared it
+	Nickname string `json:"nickname"`
+	Previous string `json:"previous,omitempty"`
+}
+
+// validateNickname returns the nickname without surrounding spaces, or an error if it can't be used
+func validateNickname(nickname string) (string, error) {
+	nickname = strings.TrimSpace(nickname)
+	if utf8.RuneCountInString(nickname) > maxNicknameLength {
+		return "", fmt.Errorf("%w, at most %d characters", ErrInvalidNickname, maxNicknameLength)
+	}
+	for _, r := range nickname {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == ' ', r == '.', r == '-', r == '_', r == '\'':
+		default:
+			return "", ErrInvalidNickname
+		}
+	}
+	return nickname, nil
+}
+
+// nickname returns the nickname of the user, empty if none is set. Guests have
+// one from the start, see guest.go
+func (m *Manager) nickname(username string) string {
+	m.nicknamesLock.Lock()
+	defer m.nicknamesLock.Unlock()
+	if nickname, ok := m.nicknames[username]; ok || !isGuest(username) {
+		return nickname
+	}
+	return guestNickname(username)
+}
+
+// setNickname sets the nickname of the user, an empty nickname clears it
+func (m *Manager) setNickname(username, nickname string) {
+	m.nicknamesLock.Lock()
+	defer m.nicknamesLock.Unlock()
+	if nickname == "" {
+		delete(m.nicknames, username)
+		return
+	}
+	m.nicknames[username] = nickname
+}
+
+// loadNickname reads the nickname of a registered user from the store, unless it is known already
+func (m *Manager) loadNickname(username string) {
+	m.nicknamesLock.Lock()
+	_, known := m.nicknames[username]
+	m.nicknamesLock.Unlock()
+	if known {
+		return
+	}
+	user, err := m.store.GetUser(username)
+	if err == nil && user.Nickname != "" {
+		m.setNickname(username, user.Nickname)
+	}
+}
+
+// nicknameTaken returns true if someone else in one of the rooms goes by the nickname
+func (m *Manager) nicknameTaken(rooms []string, username, nickname string) bool {
+	m.RLock()
+	defer m.RUnlock()
+	for _, room := range rooms {
+		for client := range m.members[room] {
+			if client.username == username {
+				continue
+			}
+			if strings.EqualFold(nickname, client.username) || strings.EqualFold(nickname, m.nickname(client.username)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// changeNickname sets the nickname of the user, keeps it for registered users and
+// tells the rooms of the user. It returns the nickname as it was set
+func (m *Manager) changeNickname(username, nickname string) (string, error) {
+	nickname, err := validateNickname(nickname)
+	if err != nil {
+		return "", err
+	}
+	rooms := m.roomsOfUser(username)
+	if nickname != "" && m.nicknameTaken(rooms, username, nickname) {
+		return "", ErrNicknameTaken
+	}
+
+	previous := m.nickname(username)
+	if previous == nickname {
+		return nickname, nil
+	}
+	m.setNickname(username, nickname)
+
+	user, err := m.store.GetUser(username)
+	if err == nil {
+		user.Nickname = nickname
+		if err := m.store.SaveUser(user); err != nil {
+			log.Println("saving nickname: ", err)
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		log.Println("saving nickname: ", err)
+	}
+
+	data, err := json.Marshal(NicknameChangedEvent{Username: username, Nickname: nickname, Previous: previous})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal nickname_changed: %v", err)
+	}
+	for _, room := range rooms {
+		m.sendToRoom(room, Event{Type: EventNicknameChanged, Payload: data})
+	}
+	return nickname, nil
+}
+
+// roomsOfUser returns the rooms the clients of the user are in
+func (m *Manager) roomsOfUser(username string) []string {
+	m.RLock()
+	defer m.RUnlock()
+	var rooms []string
+	for client := range m.clients {
+		if client.username == username && !slices.Contains(rooms, client.room) {
+			rooms = append(rooms, client.room)
+		}
+	}
+	return rooms
+}
+
+// nicknamesOf returns the nicknames of the users that have one, keyed by username
+func (m *Manager) nicknamesOf(usernames []string) map[string]string {
+	var nicknames map[string]string
+	for _, username := range usernames {
+		if nickname := m.nickname(username); nickname != "" {
+			if nicknames == nil {
+				nicknames = make(map[string]string)
+			}
+			nicknames[username] = nickname
+		}
+	}
+	return nicknames
+}
+
+// SetNicknameHandler changes the nickname of the client's user
+func SetNicknameHandler(event Event, c *Client) error {
+	var req SetNicknameEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	_, err := c.manager.changeNickname(c.username, req.Nickname)
+	return err
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+// OfflineNotification is what a user gets notified about while having no connected clients
+type OfflineNotification struct {
+	// Username is the user to notify
+	Username string `json:"username"`
+	// Type is the event type that caused the notification
+	Type string `json:"type"`
+	// From is the user that sent the event
+	From string `json:"from"`
+	// Summary is a short text to show in the notification
+	Summary string    `json:"summary"`
+	Sent    time.Time `json:"sent"`
+}
+
+// OfflineNotifier is used to reach users that are not connected, e.g. by mobile push
+type OfflineNotifier interface {
+	NotifyOffline(ctx context.Context, n OfflineNotification) error
+}
+
+// PushToken is a device token registered by a client to receive push notifications
+type PushToken struct {
+	// Platform is either fcm or apns
+	Platform string `json:"platform"`
+	Token    string `json:"token"`
+}
+
+// pushTokens returns the tokens the user registered on the platform
+func pushTokens(store PushTokenStore, username, platform string) ([]string, error) {
+	stored, err := store.ListPushTokens(username)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	for _, token := range stored {
+		if token.Platform == platform {
+			tokens = append(tokens, token.Token)
+		}
+	}
+	return tokens, nil
+}
+
+// notificationsMuted returns true if the user doesn't want to be notified right now,
+// like while in do not disturb. Mention events and offline notifications are held
+// back then, the messages themselves are still delivered
+func (m *Manager) notificationsMuted(username string) bool {
+	status, _ := m.presence(username)
+	return status == PresenceDND
+}
+
+// postJSON sends v as JSON and fails on non 2xx responses
+func postJSON(ctx context.Context, url string, headers map[string]string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return nil
+}
+
+// WebhookNotifier POSTs every notification as JSON to an URL
+type WebhookNotifier struct {
+	URL string
+}
+
+func (n WebhookNotifier) NotifyOffline(ctx context.Context, notification OfflineNotification) error {
+	return postJSON(ctx, n.URL, nil, notification)
+}
+
+// fcmScope is the OAuth2 scope of the access tokens FCM messages are sent with
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// googleTokenURL is where access tokens are minted if the service account key doesn't say
+const googleTokenURL = "https://oauth2.googleapis.com/token"
+
+// serviceAccountKey is what minting access tokens needs of the JSON key of a Google service account
+type serviceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// newFCMTokenSource returns the access tokens of the service account of the key,
+// they are minted with the key when needed and reused until shortly before they expire
+func newFCMTokenSource(ctx context.Context, key string) (oauth2.TokenSource, error) {
+	var account serviceAccountKey
+	if err := json.Unmarshal([]byte(key), &account); err != nil {
+		return nil, fmt.Errorf("service account key: %w", err)
+	}
+	if account.ClientEmail == "" {
+		return nil, errors.New("service account key has no client_email")
+	}
+	if block, _ := pem.Decode([]byte(account.PrivateKey)); block == nil {
+		return nil, errors.New("service account key has no PEM private_key")
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = googleTokenURL
+	}
+
+	config := &jwt.Config{
+		Email:        account.ClientEmail,
+		PrivateKey:   []byte(account.PrivateKey),
+		PrivateKeyID: account.PrivateKeyID,
+		Scopes:       []string{fcmScope},
+		TokenURL:     account.TokenURI,
+	}
+	return config.TokenSource(ctx), nil
+}
+
+// FCMNotifier sends notifications to the android/web devices of a user with Firebase Cloud Messaging
+type FCMNotifier struct {
+	ProjectID string
+	// AccessTokens are the OAuth2 tokens of a service account allowed to send messages
+	AccessTokens oauth2.TokenSource
+	tokens       PushTokenStore
+}
+
+func (n FCMNotifier) NotifyOffline(ctx context.Context, notification OfflineNotification) error {
+	tokens, err := pushTokens(n.tokens, notification.Username, "fcm")
+	if err != nil || len(tokens) == 0 {
+		return err
+	}
+	access, err := n.AccessTokens.Token()
+	if err != nil {
+		return fmt.Errorf("fcm access token: %w", err)
+	}
+
+	url := fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", n.ProjectID)
+	headers := map[string]string{"Authorization": "Bearer " + access.AccessToken}
+
+	var errs []error
+	for _, token := range tokens {
+		message := map[string]any{
+			"message": map[string]any{
+				"token": token,
+				"notification": map[string]string{
+					"title": notification.From,
+					"body":  notification.Summary,
+				},
+				"data": map[string]string{"type": notification.Type},
+			},
+		}
+		errs = append(errs, postJSON(ctx, url, headers, message))
+	}
+	return errors.Join(errs...)
+}
+
+// apnsTokenLifetime is how long a provider token is used, APNs rejects tokens older
+// than an hour and ones that are refreshed more often than every 20 minutes
+const apnsTokenLifetime = 50 * time.Minute
+
+// apnsTokens signs the provider tokens of APNs with the .p8 key of the team, a token
+// is reused for apnsTokenLifetime
+type apnsTokens struct {
+	keyID  string
+	teamID string
+	key    *ecdsa.PrivateKey
+	clock  Clock
+
+	sync.Mutex
+	token  string
+	issued time.Time
+}
+
+// newAPNsTokens parses the .p8 key, it is the PEM of a PKCS #8 P-256 key
+func newAPNsTokens(keyID, teamID, p8 string, clock Clock) (*apnsTokens, error) {
+	if keyID == "" || teamID == "" {
+		return nil, errors.New("the key id and team id of the key are required")
+	}
+	block, _ := pem.Decode([]byte(p8))
+	if block == nil {
+		return nil, errors.New("private key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("private key: %w", err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, errors.New("private key is not a P-256 key")
+	}
+	return &apnsTokens{keyID: keyID, teamID: teamID, key: key, clock: clock}, nil
+}
+
+// Token returns the provider token, a new one is signed once the last one is too old
+func (t *apnsTokens) Token() (string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.clock.Now()
+	if t.token != "" && now.Sub(t.issued) < apnsTokenLifetime {
+		return t.token, nil
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": t.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{"iss": t.teamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, t.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS signatures are r and s as 32 bytes each, not ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	t.token = signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	t.issued = now
+	return t.token, nil
+}
+
+// APNsNotifier sends notifications to the apple devices of a user
+type APNsNotifier struct {
+	// Topic is the bundle id of the app
+	Topic string
+	// AuthTokens signs the provider tokens used to authenticate with APNs
+	AuthTokens *apnsTokens
+	Sandbox    bool
+	tokens     PushTokenStore
+}
+
+func (n APNsNotifier) NotifyOffline(ctx context.Context, notification OfflineNotification) error {
+	tokens, err := pushTokens(n.tokens, notification.Username, "apns")
+	if err != nil || len(tokens) == 0 {
+		return err
+	}
+	auth, err := n.AuthTokens.Token()
+	if err != nil {
+		return fmt.Errorf("apns provider token: %w", err)
+	}
+
+	host := "https://api.push.apple.com"
+	if n.Sandbox {
+		host = "https://api.sandbox.push.apple.com"
+	}
+	headers := map[string]string{
+		"Authorization": "bearer " + auth,
+		"apns-topic":    n.Topic,
+	}
+
+	var errs []error
+	for _, token := range tokens {
+		message := map[string]any{
+			"aps": map[string]any{
+				"alert": map[string]string{
+					"title": notification.From,
+					"body":  notification.Summary,
+				},
+			},
+			"type": notification.Type,
+		}
+		errs = append(errs, postJSON(ctx, host+"/3/device/"+token, headers, message))
+	}
+	return errors.Join(errs...)
+}
+
+// multiNotifier sends the notification with all of its notifiers
+type multiNotifier []OfflineNotifier
+
+func (notifiers multiNotifier) NotifyOffline(ctx context.Context, notification OfflineNotification) error {
+	var errs []error
+	for _, n := range notifiers {
+		errs = append(errs, n.NotifyOffline(ctx, notification))
+	}
+	return errors.Join(errs...)
+}
+
+// newOfflineNotifier builds the notifiers enabled in the config, nil is returned if none are
+// The push tokens of the users are read from the store, the access tokens of FCM are
+// minted with ctx, so it has to live as long as the notifiers
+func newOfflineNotifier(ctx context.Context, config NotificationConfig, tokens PushTokenStore, clock Clock) (OfflineNotifier, error) {
+	var notifiers multiNotifier
+	if config.Webhook != "" {
+		notifiers = append(notifiers, WebhookNotifier{URL: config.Webhook})
+	}
+	if config.FCM.ProjectID != "" {
+		access, err := newFCMTokenSource(ctx, config.FCM.ServiceAccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("fcm: %w", err)
+		}
+		notifiers = append(notifiers, FCMNotifier{ProjectID: config.FCM.ProjectID, AccessTokens: access, tokens: tokens})
+	}
+	if config.APNs.Topic != "" {
+		auth, err := newAPNsTokens(config.APNs.KeyID, config.APNs.TeamID, config.APNs.PrivateKey, clock)
+		if err != nil {
+			return nil, fmt.Errorf("apns: %w", err)
+		}
+		notifiers = append(notifiers, APNsNotifier{Topic: config.APNs.Topic, AuthTokens: auth, Sandbox: config.APNs.Sandbox, tokens: tokens})
+	}
+	if len(notifiers) == 0 {
+		return nil, nil
+	}
+	return notifiers, nil
+}
+
+// notificationDispatcher sends offline notifications in the background, dropping
+// duplicates and capping how many each user gets per minute
+type notificationDispatcher struct {
+	notifier     OfflineNotifier
+	queue        chan OfflineNotification
+	dedupeWindow time.Duration
+	maxPerMinute int
+
+	// recent holds the notifications sent within the dedupe window, keyed by user, sender and summary
+	recent *TTLCache[string, struct{}]
+	// sent holds when each of the notifications of the last minute was sent, keyed by user
+	sent *TTLCache[string, []time.Time]
+	// clock is the clock of the Manager, the window and cap are checked against it
+	clock Clock
+}
+
+// newNotificationDispatcher creates the dispatcher and starts sending until the ctx is done
+func newNotificationDispatcher(ctx context.Context, notifier OfflineNotifier, config NotificationConfig, clock Clock) *notificationDispatcher {
+	d := &notificationDispatcher{
+		notifier:     notifier,
+		queue:        make(chan OfflineNotification, egressBufferSize),
+		dedupeWindow: time.Duration(config.DedupeWindow),
+		maxPerMinute: config.MaxPerMinute,
+		recent:       NewTTLCache(ctx, TTLCacheOptions[string, struct{}]{TTL: time.Duration(config.DedupeWindow), SweepInterval: time.Minute, Clock: clock}),
+		sent:         NewTTLCache(ctx, TTLCacheOptions[string, []time.Time]{TTL: time.Minute, SweepInterval: time.Minute, Clock: clock}),
+		clock:        clock,
+	}
+	go d.run(ctx)
+	return d
+}
+
+// notify queues the notification unless it's a duplicate or the user reached the cap
+func (d *notificationDispatcher) notify(n OfflineNotification) {
+	if !d.allow(n) {
+		return
+	}
+
+	select {
+	case d.queue <- n:
+	default:
+		log.Println("notification queue full, dropping notification for", n.Username)
+	}
+}
+
+// allow checks the dedupe window and rate cap and records the notification if allowed
+func (d *notificationDispatcher) allow(n OfflineNotification) bool {
+	key := n.Username + "\x00" + n.From + "\x00" + n.Summary
+	now := d.clock.Now()
+	allowed := false
+
+	// Notifications of the user are checked one at a time while sent is updated
+	d.sent.Update(n.Username, time.Minute, func(sent []time.Time, _ bool) []time.Time {
+		if _, ok := d.recent.Get(key); ok {
+			return sent
+		}
+		// Only keep what was sent within the last minute
+		for len(sent) > 0 && now.Sub(sent[0]) > time.Minute {
+			sent = sent[1:]
+		}
+		if d.maxPerMinute > 0 && len(sent) >= d.maxPerMinute {
+			return sent
+		}
+		if d.dedupeWindow > 0 {
+			d.recent.Set(key, struct{}{})
+		}
+		allowed = true
+		return append(sent, now)
+	})
+	return allowed
+}
+
+// run sends the queued notifications, it is blocking so run it as a goroutine
+func (d *notificationDispatcher) run(ctx context.Context) {
+	for {
+		select {
+		case n := <-d.queue:
+			sendCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if err := d.notifier.NotifyOffline(sendCtx, n); err != nil {
+				log.Println("failed to notify offline user: ", err)
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPushTokensArePersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	config := DefaultConfig()
+	config.StorePath = path
+	server, m, err := NewTestServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	alice := server.Connect("alice")
+	for _, token := range []PushToken{{Platform: "fcm", Token: "android"}, {Platform: "apns", Token: "iphone"}} {
+		if err := routeAs(t, m, alice, EventRegisterPushToken, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := routeAs(t, m, alice, EventRegisterPushToken, PushToken{Platform: "sms", Token: "555"}); !errors.Is(err, ErrInvalidPushToken) {
+		t.Errorf("token of an unknown platform: %v, want %v", err, ErrInvalidPushToken)
+	}
+
+	// The tokens outlive the instance
+	m.store.Close()
+	store, err := newFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for platform, want := range map[string]string{"fcm": "android", "apns": "iphone"} {
+		tokens, err := pushTokens(store, "alice", platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != 1 || tokens[0] != want {
+			t.Errorf("%s tokens of alice are %v, want %s", platform, tokens, want)
+		}
+	}
+}
+
+func TestDeletePushTokens(t *testing.T) {
+	store := newMemoryStore()
+	for _, token := range []StoredPushToken{
+		{Username: "alice", DeviceID: "phone", Platform: "fcm", Token: "a"},
+		{Username: "alice", DeviceID: "tablet", Platform: "fcm", Token: "b"},
+		{Username: "bob", DeviceID: "phone", Platform: "apns", Token: "c"},
+	} {
+		if err := store.SavePushToken(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.DeletePushTokens("alice", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if tokens, _ := pushTokens(store, "alice", "fcm"); len(tokens) != 1 || tokens[0] != "b" {
+		t.Errorf("tokens of alice after revoking the phone are %v, want b", tokens)
+	}
+	if err := store.DeletePushTokens("alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	if tokens, _ := store.ListPushTokens("alice"); len(tokens) != 0 {
+		t.Errorf("tokens of alice after deleting all are %v", tokens)
+	}
+	if tokens, _ := store.ListPushTokens("bob"); len(tokens) != 1 {
+		t.Errorf("the tokens of bob were deleted too: %v", tokens)
+	}
+}
+
+// newP8Key returns a .p8 signing key like the ones of Apple developer accounts
+func newP8Key(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// jwtPart decodes the part of the JWT into v
+func jwtPart(t *testing.T, part string, v any) {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPNsTokens(t *testing.T) {
+	key, p8 := newP8Key(t)
+	clock := NewManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	tokens, err := newAPNsTokens("KEY123", "TEAM456", p8, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := tokens.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q is not a JWT", token)
+	}
+	var header struct{ Alg, Kid string }
+	jwtPart(t, parts[0], &header)
+	var claims struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+	}
+	jwtPart(t, parts[1], &claims)
+	if header.Alg != "ES256" || header.Kid != "KEY123" || claims.Iss != "TEAM456" || claims.Iat != clock.Now().Unix() {
+		t.Errorf("token has header %+v and claims %+v", header, claims)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		t.Fatalf("signature %q: %v", parts[2], err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("the signature doesn't verify with the key")
+	}
+
+	// The token is reused until it gets too old
+	clock.Advance(apnsTokenLifetime - time.Second)
+	if again, _ := tokens.Token(); again != token {
+		t.Error("a new token was signed before the last one got old")
+	}
+	clock.Advance(time.Second)
+	if refreshed, _ := tokens.Token(); refreshed == token {
+		t.Error("the token was not refreshed")
+	}
+}
+
+func TestFCMTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var minted atomic.Int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, "bad grant", http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "bad assertion", http.StatusBadRequest)
+			return
+		}
+		var claims struct {
+			Iss   string `json:"iss"`
+			Scope string `json:"scope"`
+		}
+		// t.Fatal can't be called from the handler, so the claims are decoded here
+		data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(data, &claims)
+		if claims.Iss != "push@project.iam.gserviceaccount.com" || claims.Scope != fcmScope {
+			http.Error(w, "bad claims", http.StatusForbidden)
+			return
+		}
+		minted.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "ya29.minted", "token_type": "Bearer", "expires_in": 3600})
+	}))
+	defer tokenServer.Close()
+
+	account, err := json.Marshal(serviceAccountKey{
+		ClientEmail:  "push@project.iam.gserviceaccount.com",
+		PrivateKeyID: "key-1",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:     tokenServer.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := newFCMTokenSource(context.Background(), string(account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		token, err := tokens.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != "ya29.minted" {
+			t.Errorf("access token is %q, want ya29.minted", token.AccessToken)
+		}
+	}
+	if minted.Load() != 1 {
+		t.Errorf("%d access tokens were minted, the first one should be reused", minted.Load())
+	}
+}
+
+func TestOfflineNotifierKeys(t *testing.T) {
+	_, p8 := newP8Key(t)
+	for name, setup := range map[string]func(*NotificationConfig){
+		"fcm without a key": func(c *NotificationConfig) { c.FCM.ProjectID = "chat" },
+		"fcm key without PEM": func(c *NotificationConfig) {
+			c.FCM.ProjectID, c.FCM.ServiceAccountKey = "chat", `{"client_email":"a@b","private_key":"x"}`
+		},
+		"apns without a key":       func(c *NotificationConfig) { c.APNs.Topic, c.APNs.KeyID, c.APNs.TeamID = "app", "KEY", "TEAM" },
+		"apns without the team id": func(c *NotificationConfig) { c.APNs.Topic, c.APNs.KeyID, c.APNs.PrivateKey = "app", "KEY", p8 },
+	} {
+		var config NotificationConfig
+		setup(&config)
+		if _, err := newOfflineNotifier(context.Background(), config, newMemoryStore(), systemClock{}); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	var config NotificationConfig
+	config.APNs.Topic, config.APNs.KeyID, config.APNs.TeamID, config.APNs.PrivateKey = "app", "KEY", "TEAM", p8
+	if notifier, err := newOfflineNotifier(context.Background(), config, newMemoryStore(), systemClock{}); err != nil || notifier == nil {
+		t.Errorf("apns with a key: %v, %v", notifier, err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Login can be delegated to an OpenID Connect provider like Google or Keycloak:
+//
+//  1. /oidc/login redirects the browser to the provider, the state of the login is
+//     also set in a cookie
+//  2. the provider redirects back to /oidc/callback with a code and the state, which
+//     has to match the cookie, so a login started in another browser can't be
+//     completed in this one
+//  3. the code is exchanged for an ID token, which is verified and mapped to a username
+//  4. an OTP is minted for that username, exactly like /login does, and the browser
+//     is redirected to the frontend with the OTP in the fragment so it can open /ws
+
+var (
+	ErrOIDCDisabled      = errors.New("oidc login is not configured")
+	ErrOIDCState         = errors.New("unknown or expired oidc login")
+	ErrOIDCStateCookie   = errors.New("the oidc login was started in another browser")
+	ErrOIDCNoUsername    = errors.New("the id token has no usable username claim")
+	ErrOIDCTooManyLogins = errors.New("too many pending oidc logins")
+)
+
+// oidcStateCookie holds the state of the login the browser started
+const oidcStateCookie = "oidc_state"
+
+var (
+	// oidcLoginTTL is how long a user has to complete the login at the provider
+	oidcLoginTTL = 10 * time.Minute
+	// maxPendingOIDCLogins caps the logins waiting for their callback
+	maxPendingOIDCLogins = 10000
+)
+
+// oidcLogin is a login waiting for the callback of the provider
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	created  time.Time
+}
+
+// oidcAuth holds the provider, it is discovered on the first login so the server
+// starts even if the provider is unreachable
+type oidcAuth struct {
+	sync.Mutex
+	provider *oidc.Provider
+
+	pending map[string]oidcLogin
+}
+
+func newOIDCAuth() *oidcAuth {
+	return &oidcAuth{pending: make(map[string]oidcLogin)}
+}
+
+// setup returns the oauth2 config and the ID token verifier, discovering the provider if needed
+func (a *oidcAuth) setup(ctx context.Context, config OIDCConfig) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	if config.Issuer == "" {
+		return nil, nil, ErrOIDCDisabled
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if a.provider == nil {
+		provider, err := oidc.NewProvider(ctx, config.Issuer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("discovering oidc provider: %w", err)
+		}
+		a.provider = provider
+	}
+
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	oauth := &oauth2.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		RedirectURL:  config.RedirectURL,
+		Endpoint:     a.provider.Endpoint(),
+		Scopes:       scopes,
+	}
+	return oauth, a.provider.Verifier(&oidc.Config{ClientID: config.ClientID}), nil
+}
+
+// begin records a new pending login and returns its state
+func (a *oidcAuth) begin() (string, oidcLogin, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	for state, login := range a.pending {
+		if time.Since(login.created) > oidcLoginTTL {
+			delete(a.pending, state)
+		}
+	}
+	if len(a.pending) >= maxPendingOIDCLogins {
+		return "", oidcLogin{}, ErrOIDCTooManyLogins
+	}
+
+	state := newVerificationToken()
+	login := oidcLogin{nonce: newVerificationToken(), verifier: oauth2.GenerateVerifier(), created: time.Now()}
+	a.pending[state] = login
+	return state, login, nil
+}
+
+// finish removes the pending login of the state so it can't be used twice
+func (a *oidcAuth) finish(state string) (oidcLogin, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	login, ok := a.pending[state]
+	if !ok || time.Since(login.created) > oidcLoginTTL {
+		return oidcLogin{}, ErrOIDCState
+	}
+	delete(a.pending, state)
+	return login, nil
+}
+
+// oidcUsername maps the claims of an ID token to a chat username
+func oidcUsername(token *oidc.IDToken, config OIDCConfig) (string, error) {
+	var claims map[string]any
+	if err := token.Claims(&claims); err != nil {
+		return "", err
+	}
+
+	if len(config.AllowedDomains) > 0 {
+		email, _ := claims["email"].(string)
+		verified, _ := claims["email_verified"].(bool)
+		_, domain, _ := strings.Cut(email, "@")
+		if !verified || !containsFold(config.AllowedDomains, domain) {
+			return "", fmt.Errorf("%w: email %q is not allowed", ErrUnauthorized, email)
+		}
+	}
+
+	claim := config.UsernameClaim
+	if claim == "" {
+		claim = "preferred_username"
+	}
+	username, _ := claims[claim].(string)
+	if claim == "email" {
+		// Only the local part, the @ is not allowed in usernames
+		username, _, _ = strings.Cut(username, "@")
+	}
+	username = config.UsernamePrefix + username
+	if err := validateUsername(username); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrOIDCNoUsername, err)
+	}
+	if isGuest(username) {
+		return "", fmt.Errorf("%w: %v", ErrOIDCNoUsername, ErrReservedName)
+	}
+	return username, nil
+}
+
+// oidcIdentity maps the ID token to a username that doesn't belong to a local account,
+// otherwise anyone at the provider could take over the local user of the same name
+func (m *Manager) oidcIdentity(token *oidc.IDToken, config OIDCConfig) (string, error) {
+	username, err := oidcUsername(token, config)
+	if err != nil {
+		return "", err
+	}
+	if m.userExists(username) {
+		return "", fmt.Errorf("%w: %s is a local account, set a username prefix", ErrUnauthorized, username)
+	}
+	return username, nil
+}
+
+// containsFold returns true if the list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcLoginHandler redirects the browser to the provider
+func (m *Manager) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	oauth, _, err := m.oidc.setup(r.Context(), m.config().OIDC)
+	if errors.Is(err, ErrOIDCDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "oidc provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, login, err := m.oidc.begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	// Lax, the cookie has to come along when the provider redirects back
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     m.basePath() + "/oidc/",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   m.config().CSRF.Secure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, oauth.AuthCodeURL(state, oidc.Nonce(login.nonce), oauth2.S256ChallengeOption(login.verifier)), http.StatusFound)
+}
+
+// checkOIDCState returns an error unless the state is the one of the cookie, the
+// cookie is removed either way
+func (m *Manager) checkOIDCState(w http.ResponseWriter, r *http.Request, state string) error {
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: m.basePath() + "/oidc/", MaxAge: -1, HttpOnly: true})
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return ErrOIDCStateCookie
+	}
+	return nil
+}
+
+// oidcCallbackHandler verifies the login at the provider and hands an OTP to the frontend
+func (m *Manager) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	config := m.config().OIDC
+	oauth, verifier, err := m.oidc.setup(r.Context(), config)
+	if errors.Is(err, ErrOIDCDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "oidc provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		http.Error(w, "login failed at the provider: "+e, http.StatusUnauthorized)
+		return
+	}
+	if err := m.checkOIDCState(w, r, query.Get("state")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	login, err := m.oidc.finish(query.Get("state"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	username, err := m.verifyOIDCCode(r.Context(), oauth, verifier, login, query.Get("code"), config)
+	if err == nil && m.isBanned(username) {
+		err = fmt.Errorf("%s is banned", username)
+	}
+	if err != nil {
+		log.Println("oidc login: ", err)
+		m.audit(AuditEntry{Action: AuditLoginFailed, Actor: username, RemoteAddr: r.RemoteAddr, Details: map[string]string{"method": "oidc"}})
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	otp := m.newOTP(username)
+	m.audit(AuditEntry{Action: AuditLogin, Actor: username, RemoteAddr: r.RemoteAddr, Details: map[string]string{"method": "oidc"}})
+
+	// The OTP is put in the fragment, it is not sent to servers or written to access logs
+	redirect := config.PostLoginRedirect
+	if redirect == "" {
+		redirect = m.basePath() + "/"
+	}
+	http.Redirect(w, r, redirect+"#"+url.Values{"otp": {otp.Key}, "username": {username}}.Encode(), http.StatusFound)
+}
+
+// verifyOIDCCode exchanges the code for the ID token, verifies it and returns the username
+func (m *Manager) verifyOIDCCode(ctx context.Context, oauth *oauth2.Config, verifier *oidc.IDTokenVerifier, login oidcLogin, code string, config OIDCConfig) (string, error) {
+	token, err := oauth.Exchange(ctx, code, oauth2.VerifierOption(login.verifier))
+	if err != nil {
+		return "", fmt.Errorf("exchanging code: %w", err)
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", errors.New("no id_token in the token response")
+	}
+
+	idToken, err := verifier.Verify(ctx, raw)
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(login.nonce)) != 1 {
+		return "", errors.New("id token nonce mismatch")
+	}
+	return m.oidcIdentity(idToken, config)
+}
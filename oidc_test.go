@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOIDCState(t *testing.T) {
+	server, m, err := NewTestServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, test := range []struct {
+		name   string
+		cookie string
+		state  string
+		want   error
+	}{
+		{"same browser", "state-1", "state-1", nil},
+		{"other browser", "state-2", "state-1", ErrOIDCStateCookie},
+		{"no cookie", "", "state-1", ErrOIDCStateCookie},
+		{"no state", "state-1", "", ErrOIDCStateCookie},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/oidc/callback?state="+test.state, nil)
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: test.cookie})
+			}
+			w := httptest.NewRecorder()
+			if err := m.checkOIDCState(w, r, test.state); !errors.Is(err, test.want) {
+				t.Errorf("checkOIDCState = %v, want %v", err, test.want)
+			}
+			// The cookie is used once
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || cookies[0].MaxAge >= 0 {
+				t.Errorf("cookie isn't removed: %v", cookies)
+			}
+		})
+	}
+}
@@ -1,64 +1,38 @@
 package main
 
 import (
-	"context"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// otpTTL is how long an OTP can be used to connect after login
+var otpTTL = 20 * time.Second
+
+// maxOTPs caps the OTPs waiting to be used, logins beyond it push out the oldest
+var maxOTPs = 100000
+
 type OTP struct {
 	Key     string
 	Created time.Time
+	// Username is the user the OTP was issued to
+	Username string
 }
 
-type RetentionMap map[string]OTP
-
-// NewRetentionMap will create a new retetion map and start the retention given the set period
-func NewRetentionMap(ctx context.Context, retentionPeriod time.Duration) RetentionMap {
-	rm := make(RetentionMap)
-
-	go rm.Retention(ctx, retentionPeriod)
-
-	return rm
-}
-
-// NewOTP creates and adds a new otp to the map
-func (rm RetentionMap) NewOTP() OTP {
+// newOTP creates and adds a new otp for the user, it expires after otpTTL
+func (m *Manager) newOTP(username string) OTP {
 	o := OTP{
-		Key:     uuid.NewString(),
-		Created: time.Now(),
+		Key:      uuid.NewString(),
+		Created:  m.now(),
+		Username: username,
 	}
-
-	rm[o.Key] = o
+	m.otps.Set(o.Key, o)
 	return o
 }
 
-// VerifyOTP will make sure an OTP exists
-// and return true if so
+// verifyOTP will make sure an OTP exists
+// and return it and true if so
 // It will delete the key so it can't be reused
-func (rm RetentionMap) VerifyOTP(otp string) bool {
-	if _, ok := rm[otp]; !ok {
-		return false
-	}
-	delete(rm, otp)
-	return true
-}
-
-// Retetion will make sure old OTPs are removed
-// Is Blocking, so run as a Goroutine
-func (rm RetentionMap) Retention(ctx context.Context, retentionPeriod time.Duration) {
-	ticker := time.NewTicker(400 * time.Millisecond)
-	for {
-		select {
-		case <-ticker.C:
-			for _, otp := range rm {
-				if otp.Created.Add(retentionPeriod).Before(time.Now()) {
-					delete(rm, otp.Key)
-				}
-			}
-		case <-ctx.Done():
-			return
-		}
-	}
+func (m *Manager) verifyOTP(otp string) (OTP, bool) {
+	return m.otps.Take(otp)
 }
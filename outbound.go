@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+)
+
+// Some features decide per recipient what it gets, like hiding the messages of
+// users someone blocked, redacting fields a client may not see or shaping a
+// payload for the locale of the client. Instead of checking in every place that
+// sends events, an OutboundFilter sees every event right before it is queued for
+// a client and returns it as it is, changed, or false to drop it:
+//
+//	m.AddOutboundFilter(func(c *Client, event Event) (Event, bool) {
+//		return event, !blocked(c.username, senderOf(event))
+//	})
+//
+// Filters added to the Manager apply to all clients, the ones added to a Client,
+// like from a handler, only to that client, after the ones of the Manager. A
+// changed event is encoded for the client alone instead of sharing the frame of a
+// broadcast. Events for clients with at-least-once delivery are filtered once,
+// before they are tracked, so an event that was dropped is not sent again.
+//
+// Filters run while the manager lock is held, they must be fast and must not send
+// events or call anything that takes the manager lock.
+
+// OutboundFilter returns the event to send to the client, false drops it
+type OutboundFilter func(*Client, Event) (Event, bool)
+
+// outboundFilter is a registered filter, the pointer identifies it for removal
+type outboundFilter struct {
+	filter OutboundFilter
+}
+
+// AddOutboundFilter applies the filter to the events sent to all clients, it
+// returns a function removing it again
+func (m *Manager) AddOutboundFilter(filter OutboundFilter) func() {
+	entry := &outboundFilter{filter: filter}
+	m.Lock()
+	m.outboundFilters = append(m.outboundFilters, entry)
+	m.Unlock()
+	return func() {
+		m.Lock()
+		defer m.Unlock()
+		m.outboundFilters = slices.DeleteFunc(slices.Clone(m.outboundFilters), func(f *outboundFilter) bool { return f == entry })
+	}
+}
+
+// AddOutboundFilter applies the filter to the events sent to the client, it
+// returns a function removing it again
+func (c *Client) AddOutboundFilter(filter OutboundFilter) func() {
+	m := c.manager
+	entry := &outboundFilter{filter: filter}
+	m.Lock()
+	c.outboundFilters = append(c.outboundFilters, entry)
+	m.Unlock()
+	return func() {
+		m.Lock()
+		defer m.Unlock()
+		c.outboundFilters = slices.DeleteFunc(slices.Clone(c.outboundFilters), func(f *outboundFilter) bool { return f == entry })
+	}
+}
+
+// filterOutbound runs the event through the filters of the manager and the client,
+// false if one of them dropped it
+// Only call it while holding the manager lock, like enqueue
+func (c *Client) filterOutbound(event Event) (Event, bool) {
+	if len(c.manager.outboundFilters) == 0 && len(c.outboundFilters) == 0 {
+		return event, true
+	}
+
+	original := event
+	for _, filters := range [][]*outboundFilter{c.manager.outboundFilters, c.outboundFilters} {
+		for _, f := range filters {
+			var ok bool
+			if event, ok = f.filter(c, event); !ok {
+				return event, false
+			}
+		}
+	}
+	// The prepared frames hold the event as it was, a changed event is encoded on its own
+	if event.Type != original.Type || !bytes.Equal(event.Payload, original.Payload) {
+		event.prepared = nil
+	}
+	return event, true
+}
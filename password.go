@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are stored as argon2id hashes in the PHC string format, like
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>, with the parameters OWASP
+// recommends. Users registered before keep their bcrypt hash until they log in,
+// then it is replaced with an argon2id one, as is any hash made with parameters
+// weaker than the current ones.
+//
+// The users of the config are given with such a hash too, made with
+//
+//	echo -n 'secret' | websockets-go -hash-password
+//
+// Passwords in the clear are still accepted there, with a warning at the start.
+
+var (
+	ErrUnknownHash = errors.New("unknown password hash format")
+)
+
+// argon2Params are the cost parameters of an argon2id hash
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	keyLen  uint32
+}
+
+// passwordHashParams are used for new hashes
+var passwordHashParams = argon2Params{memory: 19 * 1024, time: 2, threads: 1, keyLen: 32}
+
+// argon2SaltLen is the length of the random salt in bytes
+const argon2SaltLen = 16
+
+// hashArgon2id returns the PHC string of the argon2id hash of the password
+func hashArgon2id(password string, params argon2Params) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// parseArgon2id returns the parameters, salt and key of the PHC string
+func parseArgon2id(hash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+	params.keyLen = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// checkPassword returns true if the password matches the argon2id or bcrypt hash
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false
+		}
+		other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+		return subtle.ConstantTimeCompare(key, other) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// isPasswordHash returns true if the value is a hash checkPassword understands,
+// rather than a password in the clear
+func isPasswordHash(value string) bool {
+	for _, prefix := range []string{"$argon2id$", "$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfigPassword returns true if the password matches the one of a user of
+// the config, a hash or a password in the clear
+func checkConfigPassword(expected, password string) bool {
+	if isPasswordHash(expected) {
+		return checkPassword(expected, password)
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// warnPlaintextUsers logs the users of the config whose password is in the clear
+func warnPlaintextUsers(users map[string]string) {
+	for _, username := range slices.Sorted(maps.Keys(users)) {
+		if !isPasswordHash(users[username]) {
+			log.Printf("the password of user %s of the config is in the clear, replace it with the hash from -hash-password", username)
+		}
+	}
+}
+
+// printPasswordHash reads a password from the first line of r and writes its hash,
+// for the -hash-password flag
+func printPasswordHash(r io.Reader, w io.Writer) error {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return errors.New("no password on stdin")
+	}
+	hash, err := hashArgon2id(password, passwordHashParams)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, hash)
+	return err
+}
+
+// needsRehash returns true for hashes not made with argon2id and the current parameters
+func needsRehash(hash string) bool {
+	params, _, _, err := parseArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.memory < passwordHashParams.memory || params.time < passwordHashParams.time ||
+		params.threads < passwordHashParams.threads || params.keyLen < passwordHashParams.keyLen
+}
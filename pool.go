@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Buffers used to encode and read events are pooled, so a busy server does
+// not allocate a new buffer for every message it writes or reads.
+
+// maxPooledBufferSize is the largest buffer put back into the pool, the rare
+// huge message should not keep its memory around forever
+var maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns the buffer to the pool, don't use it afterwards
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// bufferEncoder is implemented by codecs that can encode into a buffer, which
+// saves allocating the encoded message
+type bufferEncoder interface {
+	// EncodeTo appends the encoded event to buf and returns the message type
+	EncodeTo(buf *bytes.Buffer, event Event) (int, error)
+}
+
+// streamReader is implemented by transports that can read a message as a
+// stream, *websocket.Conn does
+type streamReader interface {
+	NextReader() (messageType int, r io.Reader, err error)
+}
+
+// encodeTo encodes the event with the codec into buf
+func encodeTo(codec Codec, buf *bytes.Buffer, event Event) (int, error) {
+	if e, ok := codec.(bufferEncoder); ok {
+		return e.EncodeTo(buf, event)
+	}
+	messageType, data, err := codec.Encode(event)
+	if err != nil {
+		return 0, err
+	}
+	buf.Write(data)
+	return messageType, nil
+}
+
+// readFrame reads the next message of the transport into a pooled buffer
+// Codecs copy what they keep, so the buffer can be put back after decoding
+func readFrame(t Transport) (int, *bytes.Buffer, error) {
+	r, ok := t.(streamReader)
+	if !ok {
+		messageType, data, err := t.ReadMessage()
+		return messageType, bytes.NewBuffer(data), err
+	}
+
+	messageType, reader, err := r.NextReader()
+	if err != nil {
+		return 0, nil, err
+	}
+	buf := getBuffer()
+	if _, err := buf.ReadFrom(reader); err != nil {
+		putBuffer(buf)
+		return 0, nil, err
+	}
+	return messageType, buf, nil
+}
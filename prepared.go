@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Events broadcast to many clients are encoded once per codec instead of once
+// per client. The encoded frame is kept as a websocket.PreparedMessage, which
+// also caches the compressed variant for connections using permessage-deflate.
+
+// preparedWriter is implemented by transports that can write prepared messages,
+// *websocket.Conn does
+type preparedWriter interface {
+	WritePreparedMessage(pm *websocket.PreparedMessage) error
+}
+
+// preparedEvent holds the prepared frames of an event, keyed by codec
+type preparedEvent struct {
+	sync.Mutex
+	messages map[Codec]preparedFrame
+}
+
+// preparedFrame is the frame of an event encoded by a codec
+type preparedFrame struct {
+	message *websocket.PreparedMessage
+	// size is the length of the encoded event in bytes
+	size int
+}
+
+// prepare marks the event to be encoded only once per codec
+// Use it for events sent to many clients, the payload must not change afterwards
+func prepare(event Event) Event {
+	event.prepared = &preparedEvent{messages: make(map[Codec]preparedFrame)}
+	return event
+}
+
+// message returns the prepared frame for the codec and its size, encoding it on first use
+func (p *preparedEvent) message(codec Codec, event Event) (*websocket.PreparedMessage, int, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if frame, ok := p.messages[codec]; ok {
+		return frame.message, frame.size, nil
+	}
+
+	messageType, data, err := codec.Encode(event)
+	if err != nil {
+		return nil, 0, err
+	}
+	pm, err := websocket.NewPreparedMessage(messageType, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	p.messages[codec] = preparedFrame{message: pm, size: len(data)}
+	return pm, len(data), nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Users have a profile with a display name, an avatar and a status text, so
+// frontends can show who is talking without a backend of their own. The display
+// name is the nickname of the user, see nickname.go, the rest is kept in the
+// profile store. Users change their profile with update_profile, backends with
+// PUT /api/users/{user}/profile, either way the rooms of the user get a
+// profile_updated event. get_profile and GET /api/users/{user}/profile read the
+// profile of any user, users without one get an empty profile.
+
+const (
+	// EventGetProfile is sent by a client to read the profile of a user
+	EventGetProfile = "get_profile"
+	// EventProfile is the response to get_profile
+	EventProfile = "profile"
+	// EventUpdateProfile is sent by a client to change the profile of its user
+	EventUpdateProfile = "update_profile"
+	// EventProfileUpdated is sent to the rooms of a user when its profile changed
+	EventProfileUpdated = "profile_updated"
+)
+
+var (
+	ErrInvalidProfile = errors.New("invalid profile")
+	ErrGuestProfile   = errors.New("guests can't change their profile")
+)
+
+var (
+	// maxAvatarURLLength is the longest avatar URL in bytes
+	maxAvatarURLLength = 2048
+	// maxStatusTextLength is the longest status text in characters
+	maxStatusTextLength = 140
+)
+
+// ProfileEvent is the payload sent in the
+// profile and profile_updated events, and the response of the profile API
+type ProfileEvent struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	StatusText  string `json:"status_text,omitempty"`
+}
+
+// GetProfileEvent is the payload sent in the
+// get_profile event
+type GetProfileEvent struct {
+	// Username is the user to read the profile of, the own one if empty
+	Username string `json:"username"`
+}
+
+// UpdateProfileEvent is the payload sent in the
+// update_profile event, and the body of PUT /api/users/{user}/profile
+// Only the fields that are set are changed, an empty string clears a field
+type UpdateProfileEvent struct {
+	DisplayName *string `json:"display_name,omitempty"`
+	AvatarURL   *string `json:"avatar_url,omitempty"`
+	StatusText  *string `json:"status_text,omitempty"`
+}
+
+// validateProfileUpdate returns an error if the update has a value that can't be used,
+// the display name is checked as nickname
+func validateProfileUpdate(update UpdateProfileEvent) error {
+	if update.AvatarURL != nil && *update.AvatarURL != "" {
+		if len(*update.AvatarURL) > maxAvatarURLLength {
+			return fmt.Errorf("%w: avatar_url is longer than %d bytes", ErrInvalidProfile, maxAvatarURLLength)
+		}
+		u, err := url.Parse(*update.AvatarURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%w: avatar_url must be an http or https URL", ErrInvalidProfile)
+		}
+	}
+	if update.StatusText != nil {
+		if utf8.RuneCountInString(*update.StatusText) > maxStatusTextLength {
+			return fmt.Errorf("%w: status_text is longer than %d characters", ErrInvalidProfile, maxStatusTextLength)
+		}
+		if strings.ContainsFunc(*update.StatusText, unicode.IsControl) {
+			return fmt.Errorf("%w: status_text can't contain control characters", ErrInvalidProfile)
+		}
+	}
+	return nil
+}
+
+// profile returns the profile of the user, empty if the user has none
+func (m *Manager) profile(username string) (ProfileEvent, error) {
+	profile := ProfileEvent{Username: username, DisplayName: m.nickname(username)}
+	stored, err := m.store.GetProfile(username)
+	if errors.Is(err, ErrNotFound) {
+		return profile, nil
+	}
+	if err != nil {
+		return ProfileEvent{}, err
+	}
+	profile.AvatarURL = stored.AvatarURL
+	profile.StatusText = stored.StatusText
+	return profile, nil
+}
+
+// updateProfile changes the profile of the user and tells the rooms of the user
+func (m *Manager) updateProfile(username string, update UpdateProfileEvent) (ProfileEvent, error) {
+	if err := validateProfileUpdate(update); err != nil {
+		return ProfileEvent{}, err
+	}
+	// The nickname is checked and changed first, so an invalid one changes nothing
+	if update.DisplayName != nil {
+		if _, err := m.changeNickname(username, *update.DisplayName); err != nil {
+			return ProfileEvent{}, err
+		}
+	}
+
+	if update.AvatarURL != nil || update.StatusText != nil {
+		stored, err := m.store.GetProfile(username)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return ProfileEvent{}, err
+		}
+		stored.Username = username
+		if update.AvatarURL != nil {
+			stored.AvatarURL = *update.AvatarURL
+		}
+		if update.StatusText != nil {
+			stored.StatusText = strings.TrimSpace(*update.StatusText)
+		}
+		stored.Updated = m.now()
+		if err := m.store.SaveProfile(stored); err != nil {
+			return ProfileEvent{}, err
+		}
+	}
+
+	profile, err := m.profile(username)
+	if err != nil {
+		return ProfileEvent{}, err
+	}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return ProfileEvent{}, fmt.Errorf("failed to marshal profile_updated: %v", err)
+	}
+	for _, room := range m.roomsOfUser(username) {
+		m.sendToRoom(room, Event{Type: EventProfileUpdated, Payload: data})
+	}
+	return profile, nil
+}
+
+// GetProfileHandler answers with the profile of a user
+func GetProfileHandler(event Event, c *Client) error {
+	var req GetProfileEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if req.Username == "" {
+		req.Username = c.username
+	}
+
+	profile, err := c.manager.profile(req.Username)
+	if err != nil {
+		return err
+	}
+	return c.manager.replyJSON(c, EventProfile, profile)
+}
+
+// UpdateProfileHandler changes the profile of the client's user
+func UpdateProfileHandler(event Event, c *Client) error {
+	var update UpdateProfileEvent
+	if err := json.Unmarshal(event.Payload, &update); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	// Guests are gone once they disconnect, their profile would stay behind
+	if c.guest {
+		return ErrGuestProfile
+	}
+	_, err := c.manager.updateProfile(c.username, update)
+	return err
+}
+
+// getProfileHandler returns the profile of the user of the path
+func (m *Manager) getProfileHandler(w http.ResponseWriter, r *http.Request) {
+	profile, err := m.profile(r.PathValue("user"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+// updateProfileHandler changes the profile of the user of the path, like
+// {"display_name":"Alice","avatar_url":"https://...","status_text":"in a meeting"}
+func (m *Manager) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	var update UpdateProfileEvent
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	username := r.PathValue("user")
+	if isGuest(username) {
+		http.Error(w, ErrGuestProfile.Error(), http.StatusBadRequest)
+		return
+	}
+
+	profile, err := m.updateProfile(username, update)
+	switch {
+	case errors.Is(err, ErrInvalidProfile), errors.Is(err, ErrInvalidNickname):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNicknameTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, profile)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The protobuf wire format described in events.proto is written with protowire
+// here instead of using protoc generated types, the messages are small and only
+// hold strings. The field numbers come from the schema: go generate writes the
+// protoFields of the payloads and the envelope numbers into proto_gen.go, and
+// proto_test.go checks every message against the protobuf implementation.
+
+//go:generate go run ./cmd/protogen -in events.proto -out proto_gen.go
+
+var (
+	ErrInvalidProto = errors.New("invalid protobuf message")
+)
+
+// protoMessage is implemented by all payloads that have a protobuf schema
+type protoMessage interface {
+	// protoFields returns pointers to the fields of the message: *string,
+	// *[]string for repeated strings, *bool or *map[string]string
+	// The field with number n is found at index n-1
+	protoFields() []any
+}
+
+// protoPayloads maps event types to a constructor of their protobuf payload
+var protoPayloads = map[string]func() protoMessage{
+	EventSendMessage: func() protoMessage { return &SendMessageEvent{} },
+	EventJoinRoom:    func() protoMessage { return &JoinRoomEvent{} },
+	EventError:       func() protoMessage { return &ErrorEvent{} },
+	EventAck:         func() protoMessage { return &AckEvent{} },
+}
+
+// marshalProto encodes a message into the protobuf wire format
+func marshalProto(m protoMessage) []byte {
+	var b []byte
+	for i, field := range m.protoFields() {
+		num := protowire.Number(i + 1)
+		switch field := field.(type) {
+		case *string:
+			b = appendProtoString(b, num, *field)
+		case *[]string:
+			for _, v := range *field {
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendString(b, v)
+			}
+		case *bool:
+			b = appendProtoVarint(b, num, protowire.EncodeBool(*field))
+		case *map[string]string:
+			// A map is a repeated message of key 1 and value 2, sorted so the
+			// encoding of a message is always the same
+			for _, key := range slices.Sorted(maps.Keys(*field)) {
+				var entry []byte
+				entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+				entry = protowire.AppendString(entry, key)
+				entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+				entry = protowire.AppendString(entry, (*field)[key])
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendBytes(b, entry)
+			}
+		}
+	}
+	return b
+}
+
+// unmarshalProto decodes the protobuf wire format into a message
+// Unknown fields are skipped so older servers can read newer clients
+func unmarshalProto(b []byte, m protoMessage) error {
+	fields := m.protoFields()
+	return consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if int(num) < 1 || int(num) > len(fields) {
+			return 0
+		}
+
+		if field, ok := fields[num-1].(*bool); ok {
+			if typ != protowire.VarintType {
+				return 0
+			}
+			v, n := protowire.ConsumeVarint(b)
+			*field = protowire.DecodeBool(v)
+			return n
+		}
+		if typ != protowire.BytesType {
+			return 0
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n
+		}
+		switch field := fields[num-1].(type) {
+		case *string:
+			*field = string(v)
+		case *[]string:
+			*field = append(*field, string(v))
+		case *map[string]string:
+			key, value, err := unmarshalProtoMapEntry(v)
+			if err != nil {
+				return -1
+			}
+			if *field == nil {
+				*field = make(map[string]string)
+			}
+			(*field)[key] = value
+		}
+		return n
+	})
+}
+
+// unmarshalProtoMapEntry decodes an entry of a map<string, string>, missing keys
+// and values are empty
+func unmarshalProtoMapEntry(b []byte) (key, value string, err error) {
+	err = consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if typ != protowire.BytesType || (num != 1 && num != 2) {
+			return 0
+		}
+		v, n := protowire.ConsumeString(b)
+		if num == 1 {
+			key = v
+		} else {
+			value = v
+		}
+		return n
+	})
+	return key, value, err
+}
+
+// consumeProtoFields calls fn for every field found in b
+// fn returns the number of bytes of the value it consumed, or 0 to skip the field
+func consumeProtoFields(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrInvalidProto, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		n = fn(num, typ, b)
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: %v", ErrInvalidProto, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// appendProtoString appends a string field, skipping empty values like proto3 does
+func appendProtoString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendProtoBytes appends a bytes field, skipping empty values like proto3 does
+func appendProtoBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendProtoVarint appends an integer or bool field, skipping zero like proto3 does
+func appendProtoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// marshalProtoEvent encodes the Event envelope, converting the JSON payload
+// into its protobuf form if the event type has a schema
+func marshalProtoEvent(event Event) ([]byte, error) {
+	payload := []byte(event.Payload)
+
+	if newPayload, ok := protoPayloads[event.Type]; ok && len(payload) > 0 {
+		msg := newPayload()
+		if err := json.Unmarshal(payload, msg); err != nil {
+			return nil, err
+		}
+		payload = marshalProto(msg)
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, protoEventType, protowire.BytesType)
+	b = protowire.AppendString(b, event.Type)
+	b = appendProtoBytes(b, protoEventPayload, payload)
+	b = appendProtoString(b, protoEventID, event.ID)
+	return b, nil
+}
+
+// unmarshalProtoEvent decodes the Event envelope, converting the payload
+// back into JSON so handlers don't need to care about the codec in use
+func unmarshalProtoEvent(b []byte) (Event, error) {
+	var event Event
+	var payload []byte
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return event, fmt.Errorf("%w: %v", ErrInvalidProto, protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch {
+		case num == protoEventType && typ == protowire.BytesType:
+			event.Type, n = protowire.ConsumeString(b)
+		case num == protoEventPayload && typ == protowire.BytesType:
+			payload, n = protowire.ConsumeBytes(b)
+		case num == protoEventID && typ == protowire.BytesType:
+			event.ID, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return event, fmt.Errorf("%w: %v", ErrInvalidProto, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+
+	newPayload, ok := protoPayloads[event.Type]
+	if !ok {
+		// Event types without a schema carry their JSON as is, it is checked
+		// here as a broken RawMessage fails every later json.Marshal
+		if len(payload) > 0 {
+			if !json.Valid(payload) {
+				return event, fmt.Errorf("%w: payload of %s is not JSON", ErrInvalidProto, event.Type)
+			}
+			// Copy, the message may be in a buffer that is reused
+			event.Payload = json.RawMessage(bytes.Clone(payload))
+		}
+		return event, nil
+	}
+
+	msg := newPayload()
+	if err := unmarshalProto(payload, msg); err != nil {
+		return event, err
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return event, err
+	}
+	event.Payload = data
+	return event, nil
+}
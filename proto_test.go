@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"arti.soft/websockets-go/backendpb"
+	"arti.soft/websockets-go/protogen"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// The codec is checked against the protobuf implementation: every message of
+// events.proto is built with dynamicpb from the schema, encoded by proto.Marshal,
+// decoded by proto.go into the Go payload, whose JSON has to match protojson, and
+// encoded again and compared with proto.Equal. The JSON fields of the payloads
+// have to be in the schema too, or protobuf clients would silently lose them.
+
+// schemaMessages parses events.proto
+func schemaMessages(t *testing.T) []protogen.Message {
+	t.Helper()
+	return parseSchema(t, "events.proto").Messages
+}
+
+// parseSchema parses a .proto file of the module
+func parseSchema(t *testing.T, path string) protogen.Schema {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	schema, err := protogen.Parse(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+// schemaDescriptors builds the descriptors of the messages like protoc would
+func schemaDescriptors(t *testing.T, schema protogen.Schema) protoreflect.FileDescriptor {
+	t.Helper()
+	types := map[string]descriptorpb.FieldDescriptorProto_Type{
+		"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+		"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+		"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+		"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String(schema.Package + ".proto"),
+		Package: proto.String(schema.Package),
+		Syntax:  proto.String("proto3"),
+	}
+	for _, message := range schema.Messages {
+		descriptor := &descriptorpb.DescriptorProto{Name: proto.String(message.Name)}
+		for _, field := range message.Fields {
+			label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+			if field.Repeated {
+				label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+			}
+			fieldDescriptor := &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String(field.Name),
+				Number:   proto.Int32(int32(field.Number)),
+				Type:     types[field.Type].Enum(),
+				Label:    label.Enum(),
+				JsonName: proto.String(field.Name),
+			}
+			if field.Type == "map" {
+				// protoc turns a map into a repeated entry message nested in the message
+				entry := protogen.GoName(field.Name) + "Entry"
+				descriptor.NestedType = append(descriptor.NestedType, &descriptorpb.DescriptorProto{
+					Name: proto.String(entry),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						{Name: proto.String("key"), Number: proto.Int32(1), Type: types[field.Key].Enum(), Label: optional, JsonName: proto.String("key")},
+						{Name: proto.String("value"), Number: proto.Int32(2), Type: types[field.Value].Enum(), Label: optional, JsonName: proto.String("value")},
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				})
+				fieldDescriptor.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				fieldDescriptor.TypeName = proto.String("." + schema.Package + "." + message.Name + "." + entry)
+				fieldDescriptor.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			} else if _, ok := schema.Message(field.Type); ok {
+				fieldDescriptor.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				fieldDescriptor.TypeName = proto.String("." + schema.Package + "." + field.Type)
+			}
+			descriptor.Field = append(descriptor.Field, fieldDescriptor)
+		}
+		file.MessageType = append(file.MessageType, descriptor)
+	}
+	descriptors, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return descriptors
+}
+
+// fillMessage sets every field of the message, repeated ones and maps to two values
+func fillMessage(message *dynamicpb.Message) {
+	fields := message.Descriptor().Fields()
+	for i := range fields.Len() {
+		field := fields.Get(i)
+		value := fmt.Sprintf("%s-%d", field.Name(), field.Number())
+		if field.IsMap() {
+			entries := message.Mutable(field).Map()
+			entries.Set(protoreflect.ValueOfString("b").MapKey(), protoreflect.ValueOfString(value+"b"))
+			entries.Set(protoreflect.ValueOfString("a").MapKey(), protoreflect.ValueOfString(value+"a"))
+			continue
+		}
+		if field.Kind() == protoreflect.MessageKind {
+			// Nested messages are filled too
+			nested := func() protoreflect.Value {
+				nested := dynamicpb.NewMessage(field.Message())
+				fillMessage(nested)
+				return protoreflect.ValueOfMessage(nested)
+			}
+			if field.IsList() {
+				list := message.Mutable(field).List()
+				list.Append(nested())
+				list.Append(nested())
+			} else {
+				message.Set(field, nested())
+			}
+			continue
+		}
+		switch field.Kind() {
+		case protoreflect.BoolKind:
+			message.Set(field, protoreflect.ValueOfBool(true))
+			continue
+		case protoreflect.Int64Kind:
+			message.Set(field, protoreflect.ValueOfInt64(int64(field.Number())*-1000))
+			continue
+		}
+		if field.IsList() {
+			list := message.Mutable(field).List()
+			list.Append(protoreflect.ValueOfString(value + "a"))
+			list.Append(protoreflect.ValueOfString(value + "b"))
+			continue
+		}
+		if field.Kind() == protoreflect.BytesKind {
+			message.Set(field, protoreflect.ValueOfBytes([]byte(value)))
+			continue
+		}
+		message.Set(field, protoreflect.ValueOfString(value))
+	}
+}
+
+// assertSameFields checks the JSON of the payload has every field of the message with its value
+func assertSameFields(t *testing.T, payload protoMessage, message *dynamicpb.Message) {
+	t.Helper()
+	var got, want map[string]any
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	data, err = protojson.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range want {
+		if !reflect.DeepEqual(got[name], value) {
+			t.Errorf("%s of %T is %v, want %v", name, payload, got[name], value)
+		}
+	}
+}
+
+// assertInSchema checks every JSON field of the payload is a field of the message,
+// protobuf clients would lose the fields the schema doesn't have
+func assertInSchema(t *testing.T, payload protoMessage, message protogen.Message) {
+	t.Helper()
+	payloadType := reflect.TypeOf(payload).Elem()
+	for i := range payloadType.NumField() {
+		name, _, _ := strings.Cut(payloadType.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if !slices.ContainsFunc(message.Fields, func(field protogen.Field) bool { return field.Name == name }) {
+			t.Errorf("%s of %s is missing in events.proto", name, payloadType.Name())
+		}
+	}
+}
+
+func TestProtoGenerated(t *testing.T) {
+	source, err := protogen.Generate("main", "events.proto", schemaMessages(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := os.ReadFile("proto_gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(source, generated) {
+		t.Error("proto_gen.go is not up to date with events.proto, run go generate")
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	schema := parseSchema(t, "events.proto")
+	messages := schema.Messages
+	descriptors := schemaDescriptors(t, schema)
+
+	payloads := make(map[string]func() protoMessage, len(protoPayloads))
+	for _, newPayload := range protoPayloads {
+		payloads[reflect.TypeOf(newPayload()).Elem().Name()] = newPayload
+	}
+
+	for _, message := range messages {
+		if message.Name == protogen.Envelope {
+			continue
+		}
+		t.Run(message.Name, func(t *testing.T) {
+			newPayload, ok := payloads[message.Name]
+			if !ok {
+				t.Fatalf("%s is not the payload of any event in protoPayloads", message.Name)
+			}
+			assertInSchema(t, newPayload(), message)
+
+			want := dynamicpb.NewMessage(descriptors.Messages().ByName(protoreflect.Name(message.Name)))
+			fillMessage(want)
+			data, err := proto.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			payload := newPayload()
+			if err := unmarshalProto(data, payload); err != nil {
+				t.Fatal(err)
+			}
+			// Each field has to land in the Go field of the same name, not just come back
+			assertSameFields(t, payload, want)
+
+			got := dynamicpb.NewMessage(want.Descriptor())
+			if err := proto.Unmarshal(marshalProto(payload), got); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("round trip of %s gave %v, want %v", message.Name, got, want)
+			}
+		})
+	}
+}
+
+func TestProtoEventRoundTrip(t *testing.T) {
+	descriptors := schemaDescriptors(t, parseSchema(t, "events.proto"))
+	envelope := descriptors.Messages().ByName(protogen.Envelope)
+	joinRoom := descriptors.Messages().ByName("JoinRoomEvent")
+
+	room := dynamicpb.NewMessage(joinRoom)
+	fillMessage(room)
+	payload, err := proto.Marshal(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dynamicpb.NewMessage(envelope)
+	fillMessage(want)
+	want.Set(envelope.Fields().ByName("type"), protoreflect.ValueOfString(EventJoinRoom))
+	want.Set(envelope.Fields().ByName("payload"), protoreflect.ValueOfBytes(payload))
+	data, err := proto.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := unmarshalProtoEvent(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var join JoinRoomEvent
+	if err := json.Unmarshal(event.Payload, &join); err != nil || join.Room != "room-1" {
+		t.Errorf("payload of the event is %s, %v", event.Payload, err)
+	}
+
+	data, err = marshalProtoEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := dynamicpb.NewMessage(envelope)
+	if err := proto.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("round trip of the envelope gave %v, want %v", got, want)
+	}
+}
+
+func TestGRPCGenerated(t *testing.T) {
+	source, err := protogen.GenerateGRPC("backendpb", "grpc.proto", parseSchema(t, "grpc.proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := os.ReadFile("backendpb/backend_gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(source, generated) {
+		t.Error("backendpb/backend_gen.go is not up to date with grpc.proto, run go generate")
+	}
+}
+
+func TestGRPCRoundTrip(t *testing.T) {
+	schema := parseSchema(t, "grpc.proto")
+	descriptors := schemaDescriptors(t, schema)
+	messages := map[string]func() backendpb.Message{
+		"PublishEventRequest":    func() backendpb.Message { return &backendpb.PublishEventRequest{} },
+		"PublishEventResponse":   func() backendpb.Message { return &backendpb.PublishEventResponse{} },
+		"SubscribeEventsRequest": func() backendpb.Message { return &backendpb.SubscribeEventsRequest{} },
+		"ObservedEvent":          func() backendpb.Message { return &backendpb.ObservedEvent{} },
+		"ListClientsRequest":     func() backendpb.Message { return &backendpb.ListClientsRequest{} },
+		"ClientInfo":             func() backendpb.Message { return &backendpb.ClientInfo{} },
+		"ListClientsResponse":    func() backendpb.Message { return &backendpb.ListClientsResponse{} },
+		"KickClientRequest":      func() backendpb.Message { return &backendpb.KickClientRequest{} },
+		"KickClientResponse":     func() backendpb.Message { return &backendpb.KickClientResponse{} },
+	}
+
+	for _, message := range schema.Messages {
+		t.Run(message.Name, func(t *testing.T) {
+			newMessage, ok := messages[message.Name]
+			if !ok {
+				t.Fatalf("%s is not in the round trip test", message.Name)
+			}
+			want := dynamicpb.NewMessage(descriptors.Messages().ByName(protoreflect.Name(message.Name)))
+			fillMessage(want)
+			data, err := proto.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded := newMessage()
+			if err := decoded.UnmarshalProto(data); err != nil {
+				t.Fatal(err)
+			}
+			got := dynamicpb.NewMessage(want.Descriptor())
+			if err := proto.Unmarshal(decoded.MarshalProto(), got); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(got, want) {
+				t.Errorf("round trip of %s gave %v, want %v", message.Name, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients pick the codec and version of the protocol with the Sec-WebSocket-Protocol
+// header, offering the subprotocols they speak in the order they prefer them, like
+// chat.v1.json or chat.v1.proto. The server takes the first one it knows and sends
+// it back, clients that offer none of them are turned away, since they would
+// not understand what the server sends. Clients offering no subprotocol at all
+// get chat.v1.json, like before subprotocols were negotiated. The old name
+// proto still selects protobuf for the clients built against it.
+
+var (
+	ErrUnsupportedSubprotocol = errors.New("none of the offered subprotocols is supported")
+)
+
+// Protocol is a subprotocol clients can negotiate
+type Protocol struct {
+	// Name is the subprotocol sent in Sec-WebSocket-Protocol
+	Name string
+	// Version is the version of the events spoken, breaking changes get a new version
+	Version int
+	// Codec encodes and decodes the events, strict protocols use the strictCodec of the Manager
+	Codec Codec
+	// Strict is set for protocols with the strict envelope, see envelope.go
+	Strict bool
+}
+
+// protocols are the subprotocols that can be negotiated, the first one is the default
+var protocols = []Protocol{
+	{Name: "chat.v1.json", Version: 1, Codec: jsonCodec{}},
+	{Name: "chat.v1.proto", Version: 1, Codec: protoCodec{}},
+	{Name: "proto", Version: 1, Codec: protoCodec{}},
+	{Name: "chat.v2.json", Version: 2, Strict: true},
+}
+
+// protocolFor returns the protocol of the subprotocol, the default one for an empty name
+func protocolFor(subprotocol string) (Protocol, bool) {
+	if subprotocol == "" {
+		return protocols[0], true
+	}
+	for _, protocol := range protocols {
+		if protocol.Name == subprotocol {
+			return protocol, true
+		}
+	}
+	return Protocol{}, false
+}
+
+// negotiatedProtocol returns the protocol of the subprotocol the connection settled on
+func negotiatedProtocol(subprotocol string) Protocol {
+	if protocol, ok := protocolFor(subprotocol); ok {
+		return protocol
+	}
+	return protocols[0]
+}
+
+// negotiateProtocol returns the first protocol the client offered that is supported
+func negotiateProtocol(r *http.Request) (Protocol, error) {
+	offered := websocket.Subprotocols(r)
+	if len(offered) == 0 {
+		return protocols[0], nil
+	}
+	for _, name := range offered {
+		if protocol, ok := protocolFor(name); ok && name != "" {
+			return protocol, nil
+		}
+	}
+	return Protocol{}, fmt.Errorf("%w, offered %s", ErrUnsupportedSubprotocol, strings.Join(offered, ", "))
+}
+
+// protocolHeader returns the response header selecting the protocol, empty if the client offered none
+func protocolHeader(r *http.Request, protocol Protocol) http.Header {
+	if len(websocket.Subprotocols(r)) == 0 {
+		return nil
+	}
+	return http.Header{"Sec-Websocket-Protocol": {protocol.Name}}
+}
+
+// supportedSubprotocols returns the names of all subprotocols, in the order of preference
+func supportedSubprotocols() []string {
+	names := make([]string, 0, len(protocols))
+	for _, protocol := range protocols {
+		names = append(names, protocol.Name)
+	}
+	return names
+}
@@ -0,0 +1,258 @@
+package protogen
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"go/format"
+	"slices"
+	"strings"
+)
+
+// GenerateGRPC writes the Go source of a gRPC package for the schema into package
+// pkg, source names the schema in the header and the descriptor. Messages get a
+// struct with MarshalProto and UnmarshalProto, each service a server interface,
+// a Register function, a client and its grpc.ServiceDesc. The messages are not
+// protoc types, servers and clients have to use the Codec of the package
+func GenerateGRPC(pkg, source string, schema Schema) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by protogen from %s. DO NOT EDIT.\n\n", source)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	b.WriteString("import (\n\t\"context\"\n\n\t\"google.golang.org/grpc\"\n\t\"google.golang.org/protobuf/encoding/protowire\"\n)\n\n")
+
+	for _, message := range schema.Messages {
+		if err := generateMessage(&b, schema, message); err != nil {
+			return nil, err
+		}
+	}
+	for _, service := range schema.Services {
+		if err := generateService(&b, schema, source, service); err != nil {
+			return nil, err
+		}
+	}
+	return format.Source(b.Bytes())
+}
+
+// goType returns the Go type of a field of a gRPC message
+func goType(schema Schema, message Message, field Field) (string, error) {
+	var t string
+	switch field.Type {
+	case "string":
+		t = field.Type
+	case "bool", "int64":
+		// Repeated scalars are packed in proto3, which the generated code doesn't decode
+		if field.Repeated {
+			return "", fmt.Errorf("%w: %s.%s is repeated %s", ErrSyntax, message.Name, field.Name, field.Type)
+		}
+		t = field.Type
+	case "bytes":
+		if field.Repeated {
+			return "", fmt.Errorf("%w: %s.%s is repeated bytes", ErrSyntax, message.Name, field.Name)
+		}
+		t = "[]byte"
+	default:
+		if _, ok := schema.Message(field.Type); !ok {
+			return "", fmt.Errorf("%w: %s.%s has the unknown type %s", ErrSyntax, message.Name, field.Name, field.Type)
+		}
+		t = "*" + field.Type
+	}
+	if field.Repeated {
+		return "[]" + t, nil
+	}
+	return t, nil
+}
+
+func generateMessage(b *bytes.Buffer, schema Schema, message Message) error {
+	fmt.Fprintf(b, "type %s struct {\n", message.Name)
+	for _, field := range message.Fields {
+		t, err := goType(schema, message, field)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(b, "\t%s %s\n", GoName(field.Name), t)
+	}
+	b.WriteString("}\n\n")
+
+	// Fields are written in the order of their numbers like protoc does, zero
+	// values of singular fields are skipped
+	fmt.Fprintf(b, "// MarshalProto encodes the message into the protobuf wire format\n")
+	fmt.Fprintf(b, "func (m *%s) MarshalProto() []byte {\n\tvar b []byte\n", message.Name)
+	for _, field := range byNumber(message.Fields) {
+		name, num := "m."+GoName(field.Name), field.Number
+		switch {
+		case field.Repeated && field.Type == "string":
+			fmt.Fprintf(b, "\tfor _, v := range %s {\n\t\tb = protowire.AppendTag(b, %d, protowire.BytesType)\n\t\tb = protowire.AppendString(b, v)\n\t}\n", name, num)
+		case field.Repeated:
+			fmt.Fprintf(b, "\tfor _, v := range %s {\n\t\tb = protowire.AppendTag(b, %d, protowire.BytesType)\n\t\tb = protowire.AppendBytes(b, v.MarshalProto())\n\t}\n", name, num)
+		case field.Type == "string":
+			fmt.Fprintf(b, "\tif %s != \"\" {\n\t\tb = protowire.AppendTag(b, %d, protowire.BytesType)\n\t\tb = protowire.AppendString(b, %s)\n\t}\n", name, num, name)
+		case field.Type == "bytes":
+			fmt.Fprintf(b, "\tif len(%s) > 0 {\n\t\tb = protowire.AppendTag(b, %d, protowire.BytesType)\n\t\tb = protowire.AppendBytes(b, %s)\n\t}\n", name, num, name)
+		case field.Type == "bool":
+			fmt.Fprintf(b, "\tif %s {\n\t\tb = protowire.AppendTag(b, %d, protowire.VarintType)\n\t\tb = protowire.AppendVarint(b, 1)\n\t}\n", name, num)
+		case field.Type == "int64":
+			fmt.Fprintf(b, "\tif %s != 0 {\n\t\tb = protowire.AppendTag(b, %d, protowire.VarintType)\n\t\tb = protowire.AppendVarint(b, uint64(%s))\n\t}\n", name, num, name)
+		default:
+			fmt.Fprintf(b, "\tif %s != nil {\n\t\tb = protowire.AppendTag(b, %d, protowire.BytesType)\n\t\tb = protowire.AppendBytes(b, %s.MarshalProto())\n\t}\n", name, num, name)
+		}
+	}
+	b.WriteString("\treturn b\n}\n\n")
+
+	// Unknown fields and fields of an unexpected wire type are skipped
+	fmt.Fprintf(b, "// UnmarshalProto decodes the protobuf wire format into the message\n")
+	fmt.Fprintf(b, "func (m *%s) UnmarshalProto(b []byte) error {\n", message.Name)
+	b.WriteString("\tfor len(b) > 0 {\n\t\tnum, typ, n := protowire.ConsumeTag(b)\n\t\tif n < 0 {\n\t\t\treturn protowire.ParseError(n)\n\t\t}\n\t\tb = b[n:]\n\n\t\tswitch {\n")
+	for _, field := range message.Fields {
+		name, num := "m."+GoName(field.Name), field.Number
+		assign := "="
+		if field.Repeated {
+			assign = "append"
+		}
+		switch field.Type {
+		case "string":
+			fmt.Fprintf(b, "\t\tcase num == %d && typ == protowire.BytesType:\n\t\t\tvar v string\n\t\t\tv, n = protowire.ConsumeString(b)\n", num)
+			b.WriteString(store(name, assign, "v"))
+		case "bytes":
+			fmt.Fprintf(b, "\t\tcase num == %d && typ == protowire.BytesType:\n\t\t\tvar v []byte\n\t\t\tv, n = protowire.ConsumeBytes(b)\n", num)
+			// b may be a buffer that is reused
+			b.WriteString(store(name, assign, "append([]byte(nil), v...)"))
+		case "bool", "int64":
+			fmt.Fprintf(b, "\t\tcase num == %d && typ == protowire.VarintType:\n\t\t\tvar v uint64\n\t\t\tv, n = protowire.ConsumeVarint(b)\n", num)
+			if field.Type == "bool" {
+				b.WriteString(store(name, assign, "protowire.DecodeBool(v)"))
+			} else {
+				b.WriteString(store(name, assign, "int64(v)"))
+			}
+		default:
+			fmt.Fprintf(b, "\t\tcase num == %d && typ == protowire.BytesType:\n\t\t\tvar v []byte\n\t\t\tif v, n = protowire.ConsumeBytes(b); n >= 0 {\n", num)
+			fmt.Fprintf(b, "\t\t\t\tvalue := &%s{}\n\t\t\t\tif err := value.UnmarshalProto(v); err != nil {\n\t\t\t\t\treturn err\n\t\t\t\t}\n", field.Type)
+			b.WriteString("\t" + store(name, assign, "value"))
+			b.WriteString("\t\t\t}\n")
+		}
+	}
+	b.WriteString("\t\tdefault:\n\t\t\tn = protowire.ConsumeFieldValue(num, typ, b)\n\t\t}\n")
+	b.WriteString("\t\tif n < 0 {\n\t\t\treturn protowire.ParseError(n)\n\t\t}\n\t\tb = b[n:]\n\t}\n\treturn nil\n}\n\n")
+	return nil
+}
+
+// store returns the statement setting or appending the value to the field
+func store(field, assign, value string) string {
+	if assign == "append" {
+		return fmt.Sprintf("\t\t\t%s = append(%s, %s)\n", field, field, value)
+	}
+	return fmt.Sprintf("\t\t\t%s = %s\n", field, value)
+}
+
+// byNumber returns the fields ordered by their number
+func byNumber(fields []Field) []Field {
+	return slices.SortedFunc(slices.Values(fields), func(a, b Field) int {
+		return cmp.Compare(a.Number, b.Number)
+	})
+}
+
+func generateService(b *bytes.Buffer, schema Schema, source string, service Service) error {
+	for _, method := range service.Methods {
+		for _, name := range []string{method.Request, method.Response} {
+			if _, ok := schema.Message(name); !ok {
+				return fmt.Errorf("%w: rpc %s of %s uses the unknown message %s", ErrSyntax, method.Name, service.Name, name)
+			}
+		}
+	}
+
+	name := service.Name
+	lower := strings.ToLower(name[:1]) + name[1:]
+	fullName := name
+	if schema.Package != "" {
+		fullName = schema.Package + "." + name
+	}
+
+	// The server interface and the streams it sends on
+	fmt.Fprintf(b, "// %sServer is the server API of the %s service\n", name, fullName)
+	fmt.Fprintf(b, "type %sServer interface {\n", name)
+	for _, method := range service.Methods {
+		if method.ServerStreams {
+			fmt.Fprintf(b, "\t%s(*%s, %s%sServer) error\n", method.Name, method.Request, name, method.Name)
+		} else {
+			fmt.Fprintf(b, "\t%s(context.Context, *%s) (*%s, error)\n", method.Name, method.Request, method.Response)
+		}
+	}
+	b.WriteString("}\n\n")
+	for _, method := range service.Methods {
+		if !method.ServerStreams {
+			continue
+		}
+		fmt.Fprintf(b, "// %s%sServer is the stream %s sends its responses on\n", name, method.Name, method.Name)
+		fmt.Fprintf(b, "type %s%sServer interface {\n\tSend(*%s) error\n\tgrpc.ServerStream\n}\n\n", name, method.Name, method.Response)
+		fmt.Fprintf(b, "type %s%sServer struct {\n\tgrpc.ServerStream\n}\n\n", lower, method.Name)
+		fmt.Fprintf(b, "func (s *%s%sServer) Send(m *%s) error {\n\treturn s.ServerStream.SendMsg(m)\n}\n\n", lower, method.Name, method.Response)
+	}
+
+	fmt.Fprintf(b, "// Register%sServer registers the implementation of the %s service\n", name, fullName)
+	fmt.Fprintf(b, "func Register%sServer(s grpc.ServiceRegistrar, srv %sServer) {\n\ts.RegisterService(&%sServiceDesc, srv)\n}\n\n", name, name, name)
+
+	// The client and the streams it receives from
+	fmt.Fprintf(b, "// %sClient is the client API of the %s service\n", name, fullName)
+	fmt.Fprintf(b, "type %sClient interface {\n", name)
+	for _, method := range service.Methods {
+		if method.ServerStreams {
+			fmt.Fprintf(b, "\t%s(ctx context.Context, in *%s, opts ...grpc.CallOption) (%s%sClient, error)\n", method.Name, method.Request, name, method.Name)
+		} else {
+			fmt.Fprintf(b, "\t%s(ctx context.Context, in *%s, opts ...grpc.CallOption) (*%s, error)\n", method.Name, method.Request, method.Response)
+		}
+	}
+	b.WriteString("}\n\n")
+	fmt.Fprintf(b, "type %sClient struct {\n\tcc grpc.ClientConnInterface\n}\n\n", lower)
+	fmt.Fprintf(b, "// New%sClient returns a client of the %s service on the connection\n", name, fullName)
+	fmt.Fprintf(b, "func New%sClient(cc grpc.ClientConnInterface) %sClient {\n\treturn &%sClient{cc: cc}\n}\n\n", name, name, lower)
+
+	stream := 0
+	for _, method := range service.Methods {
+		path := "/" + fullName + "/" + method.Name
+		if !method.ServerStreams {
+			fmt.Fprintf(b, "func (c *%sClient) %s(ctx context.Context, in *%s, opts ...grpc.CallOption) (*%s, error) {\n", lower, method.Name, method.Request, method.Response)
+			fmt.Fprintf(b, "\tout := &%s{}\n\tif err := c.cc.Invoke(ctx, %q, in, out, opts...); err != nil {\n\t\treturn nil, err\n\t}\n\treturn out, nil\n}\n\n", method.Response, path)
+			continue
+		}
+		fmt.Fprintf(b, "func (c *%sClient) %s(ctx context.Context, in *%s, opts ...grpc.CallOption) (%s%sClient, error) {\n", lower, method.Name, method.Request, name, method.Name)
+		fmt.Fprintf(b, "\tstream, err := c.cc.NewStream(ctx, &%sServiceDesc.Streams[%d], %q, opts...)\n\tif err != nil {\n\t\treturn nil, err\n\t}\n", name, stream, path)
+		b.WriteString("\tif err := stream.SendMsg(in); err != nil {\n\t\treturn nil, err\n\t}\n\tif err := stream.CloseSend(); err != nil {\n\t\treturn nil, err\n\t}\n")
+		fmt.Fprintf(b, "\treturn &%s%sClient{ClientStream: stream}, nil\n}\n\n", lower, method.Name)
+		fmt.Fprintf(b, "// %s%sClient is the stream of responses of %s\n", name, method.Name, method.Name)
+		fmt.Fprintf(b, "type %s%sClient interface {\n\tRecv() (*%s, error)\n\tgrpc.ClientStream\n}\n\n", name, method.Name, method.Response)
+		fmt.Fprintf(b, "type %s%sClient struct {\n\tgrpc.ClientStream\n}\n\n", lower, method.Name)
+		fmt.Fprintf(b, "func (s *%s%sClient) Recv() (*%s, error) {\n\tm := &%s{}\n\tif err := s.ClientStream.RecvMsg(m); err != nil {\n\t\treturn nil, err\n\t}\n\treturn m, nil\n}\n\n", lower, method.Name, method.Response, method.Response)
+		stream++
+	}
+
+	// The handlers and the descriptor
+	for _, method := range service.Methods {
+		path := "/" + fullName + "/" + method.Name
+		if method.ServerStreams {
+			fmt.Fprintf(b, "func %s%sHandler(srv any, stream grpc.ServerStream) error {\n", lower, method.Name)
+			fmt.Fprintf(b, "\treq := &%s{}\n\tif err := stream.RecvMsg(req); err != nil {\n\t\treturn err\n\t}\n", method.Request)
+			fmt.Fprintf(b, "\treturn srv.(%sServer).%s(req, &%s%sServer{ServerStream: stream})\n}\n\n", name, method.Name, lower, method.Name)
+			continue
+		}
+		fmt.Fprintf(b, "func %s%sHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {\n", lower, method.Name)
+		fmt.Fprintf(b, "\treq := &%s{}\n\tif err := dec(req); err != nil {\n\t\treturn nil, err\n\t}\n", method.Request)
+		fmt.Fprintf(b, "\tif interceptor == nil {\n\t\treturn srv.(%sServer).%s(ctx, req)\n\t}\n", name, method.Name)
+		fmt.Fprintf(b, "\thandler := func(ctx context.Context, req any) (any, error) {\n\t\treturn srv.(%sServer).%s(ctx, req.(*%s))\n\t}\n", name, method.Name, method.Request)
+		fmt.Fprintf(b, "\treturn interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: %q}, handler)\n}\n\n", path)
+	}
+
+	fmt.Fprintf(b, "// %sServiceDesc is the descriptor of the %s service\n", name, fullName)
+	fmt.Fprintf(b, "var %sServiceDesc = grpc.ServiceDesc{\n\tServiceName: %q,\n\tHandlerType: (*%sServer)(nil),\n\tMethods: []grpc.MethodDesc{\n", name, fullName, name)
+	for _, method := range service.Methods {
+		if !method.ServerStreams {
+			fmt.Fprintf(b, "\t\t{MethodName: %q, Handler: %s%sHandler},\n", method.Name, lower, method.Name)
+		}
+	}
+	b.WriteString("\t},\n\tStreams: []grpc.StreamDesc{\n")
+	for _, method := range service.Methods {
+		if method.ServerStreams {
+			fmt.Fprintf(b, "\t\t{StreamName: %q, Handler: %s%sHandler, ServerStreams: true},\n", method.Name, lower, method.Name)
+		}
+	}
+	fmt.Fprintf(b, "\t},\n\tMetadata: %q,\n}\n\n", source)
+	return nil
+}
@@ -0,0 +1,309 @@
+// Package protogen generates the Go side of the protobuf schemas of the server,
+// in place of protoc which would need generated types and a toolchain outside Go.
+//
+// For events.proto, Generate writes what the codec of proto.go needs: the
+// protoFields method of every payload and the field numbers of the Event envelope.
+// For grpc.proto, GenerateGRPC writes a package like protoc-gen-go and
+// protoc-gen-go-grpc would: the messages with their encoding, the server
+// interface, the client and the service descriptor.
+//
+// Only the subset of proto3 the schemas use is understood: top level messages
+// with scalar, repeated, map<string, string> and message fields, and services of
+// unary and server streaming methods.
+package protogen
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Envelope is the message every event is wrapped in, its fields are generated as
+// constants as the codec encodes it itself
+const Envelope = "Event"
+
+var (
+	ErrSyntax      = errors.New("unsupported proto syntax")
+	ErrFieldNumber = errors.New("field numbers have to start at 1 without gaps")
+)
+
+// Field is a field of a message
+type Field struct {
+	Name     string
+	Type     string
+	Number   int
+	Repeated bool
+	// Key and Value are the types of a map field, whose Type is map
+	Key, Value string
+}
+
+// Message is a message of the schema with its fields in the order they are declared
+type Message struct {
+	Name   string
+	Fields []Field
+}
+
+// Method is an rpc of a service
+type Method struct {
+	Name     string
+	Request  string
+	Response string
+	// ServerStreams is set for methods returning a stream of responses
+	ServerStreams bool
+}
+
+// Service is a service of the schema
+type Service struct {
+	Name    string
+	Methods []Method
+}
+
+// Schema is a parsed .proto file
+type Schema struct {
+	Package  string
+	Messages []Message
+	Services []Service
+}
+
+// Parse reads a schema
+func Parse(r io.Reader) (Schema, error) {
+	tokens, err := tokenize(r)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	var schema Schema
+	for len(tokens) > 0 {
+		switch tokens[0] {
+		case "syntax", "package":
+			end := indexOf(tokens, ";")
+			if end < 0 {
+				return Schema{}, fmt.Errorf("%w: %s without ;", ErrSyntax, tokens[0])
+			}
+			// syntax = "proto3"; carries nothing the generated code needs
+			if tokens[0] == "package" && end == 2 {
+				schema.Package = tokens[1]
+			}
+			tokens = tokens[end+1:]
+		case "message":
+			var message Message
+			message, tokens, err = parseMessage(tokens[1:])
+			if err != nil {
+				return Schema{}, err
+			}
+			schema.Messages = append(schema.Messages, message)
+		case "service":
+			var service Service
+			service, tokens, err = parseService(tokens[1:])
+			if err != nil {
+				return Schema{}, err
+			}
+			schema.Services = append(schema.Services, service)
+		default:
+			return Schema{}, fmt.Errorf("%w: %q", ErrSyntax, tokens[0])
+		}
+	}
+	return schema, nil
+}
+
+// Message returns the message with the name
+func (s Schema) Message(name string) (Message, bool) {
+	for _, message := range s.Messages {
+		if message.Name == name {
+			return message, true
+		}
+	}
+	return Message{}, false
+}
+
+// parseMessage parses the name and body of a message, returning the tokens after it
+func parseMessage(tokens []string) (Message, []string, error) {
+	if len(tokens) < 2 || tokens[1] != "{" {
+		return Message{}, nil, fmt.Errorf("%w: message without body", ErrSyntax)
+	}
+	message := Message{Name: tokens[0]}
+	tokens = tokens[2:]
+
+	for len(tokens) > 0 && tokens[0] != "}" {
+		var field Field
+		if tokens[0] == "repeated" {
+			field.Repeated = true
+			tokens = tokens[1:]
+		}
+		// map<key, value> name = number ;
+		if tokens[0] == "map" {
+			if len(tokens) < 6 || tokens[1] != "<" || tokens[3] != "," || tokens[5] != ">" {
+				return Message{}, nil, fmt.Errorf("%w: map field of %s", ErrSyntax, message.Name)
+			}
+			field.Key, field.Value = tokens[2], tokens[4]
+			tokens = append([]string{"map"}, tokens[6:]...)
+		}
+		// type name = number ;
+		if len(tokens) < 5 || tokens[2] != "=" || tokens[4] != ";" {
+			return Message{}, nil, fmt.Errorf("%w: field of %s", ErrSyntax, message.Name)
+		}
+		field.Type, field.Name = tokens[0], tokens[1]
+		number, err := strconv.Atoi(tokens[3])
+		if err != nil {
+			return Message{}, nil, fmt.Errorf("%w: field number of %s.%s", ErrSyntax, message.Name, field.Name)
+		}
+		field.Number = number
+		message.Fields = append(message.Fields, field)
+		tokens = tokens[5:]
+	}
+	if len(tokens) == 0 {
+		return Message{}, nil, fmt.Errorf("%w: %s is not closed", ErrSyntax, message.Name)
+	}
+	return message, tokens[1:], nil
+}
+
+// parseService parses the name and methods of a service, returning the tokens after it
+func parseService(tokens []string) (Service, []string, error) {
+	if len(tokens) < 2 || tokens[1] != "{" {
+		return Service{}, nil, fmt.Errorf("%w: service without body", ErrSyntax)
+	}
+	service := Service{Name: tokens[0]}
+	tokens = tokens[2:]
+
+	for len(tokens) > 0 && tokens[0] != "}" {
+		// rpc Name ( Request ) returns ( [stream] Response ) ;
+		if len(tokens) < 9 || tokens[0] != "rpc" || tokens[2] != "(" || tokens[4] != ")" || tokens[5] != "returns" || tokens[6] != "(" {
+			return Service{}, nil, fmt.Errorf("%w: rpc of %s, client streams and options are not supported", ErrSyntax, service.Name)
+		}
+		method := Method{Name: tokens[1], Request: tokens[3]}
+		tokens = tokens[7:]
+		if tokens[0] == "stream" {
+			method.ServerStreams = true
+			tokens = tokens[1:]
+		}
+		if len(tokens) < 3 || tokens[1] != ")" || tokens[2] != ";" {
+			return Service{}, nil, fmt.Errorf("%w: rpc %s of %s", ErrSyntax, method.Name, service.Name)
+		}
+		method.Response = tokens[0]
+		service.Methods = append(service.Methods, method)
+		tokens = tokens[3:]
+	}
+	if len(tokens) == 0 {
+		return Service{}, nil, fmt.Errorf("%w: %s is not closed", ErrSyntax, service.Name)
+	}
+	return service, tokens[1:], nil
+}
+
+// tokenize splits the schema into words and punctuation, dropping comments
+func tokenize(r io.Reader) ([]string, error) {
+	var tokens []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "//")
+		for _, word := range strings.Fields(line) {
+			for word != "" {
+				i := strings.IndexAny(word, "{}=;<>,()")
+				switch {
+				case i < 0:
+					tokens = append(tokens, word)
+					word = ""
+				case i == 0:
+					tokens = append(tokens, word[:1])
+					word = word[1:]
+				default:
+					tokens = append(tokens, word[:i])
+					word = word[i:]
+				}
+			}
+		}
+	}
+	return tokens, scanner.Err()
+}
+
+func indexOf(tokens []string, token string) int {
+	for i, t := range tokens {
+		if t == token {
+			return i
+		}
+	}
+	return -1
+}
+
+// Generate writes the Go source for the messages into package pkg, source names
+// the schema in the header of the file
+func Generate(pkg, source string, messages []Message) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by protogen from %s. DO NOT EDIT.\n\n", source)
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	b.WriteString("import \"google.golang.org/protobuf/encoding/protowire\"\n\n")
+
+	for _, message := range messages {
+		if err := checkNumbers(message); err != nil {
+			return nil, err
+		}
+		if message.Name == Envelope {
+			fmt.Fprintf(&b, "// Field numbers of the %s envelope\n", Envelope)
+			b.WriteString("const (\n")
+			for _, field := range message.Fields {
+				fmt.Fprintf(&b, "\tproto%s%s protowire.Number = %d\n", Envelope, GoName(field.Name), field.Number)
+			}
+			b.WriteString(")\n\n")
+			continue
+		}
+
+		fields := make([]string, len(message.Fields))
+		for _, field := range message.Fields {
+			if err := checkPayloadField(message, field); err != nil {
+				return nil, err
+			}
+			fields[field.Number-1] = "&e." + GoName(field.Name)
+		}
+		fmt.Fprintf(&b, "func (e *%s) protoFields() []any { return []any{%s} }\n\n", message.Name, strings.Join(fields, ", "))
+	}
+	return format.Source(b.Bytes())
+}
+
+// checkPayloadField returns an error for fields the codec can't encode, see proto.go
+func checkPayloadField(message Message, field Field) error {
+	switch {
+	case field.Type == "string":
+		return nil
+	case field.Type == "bool" && !field.Repeated:
+		return nil
+	case field.Type == "map" && !field.Repeated && field.Key == "string" && field.Value == "string":
+		return nil
+	}
+	return fmt.Errorf("%w: %s.%s can't be encoded, payloads have strings, repeated strings, bools and map<string, string>", ErrSyntax, message.Name, field.Name)
+}
+
+// checkNumbers makes sure the field numbers are 1 to n, protoFields finds a field by its number
+func checkNumbers(message Message) error {
+	seen := make([]bool, len(message.Fields))
+	for _, field := range message.Fields {
+		if field.Number < 1 || field.Number > len(seen) || seen[field.Number-1] {
+			return fmt.Errorf("%w: %s.%s = %d", ErrFieldNumber, message.Name, field.Name, field.Number)
+		}
+		seen[field.Number-1] = true
+	}
+	return nil
+}
+
+// GoName is the name of the Go struct field of a proto field, like ID for id
+// and RoomName for room_name
+func GoName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part == "id" {
+			b.WriteString("ID")
+			continue
+		}
+		for i, r := range part {
+			if i == 0 {
+				r = unicode.ToUpper(r)
+			}
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,154 @@
+package protogen
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	schema := `
+syntax = "proto3";
+package chat;
+
+// Note is a message
+message Note {
+  string room_name = 1; // trailing comment
+  repeated string tags=2;
+  map<string,string> labels = 3;
+  bool pinned = 4;
+}
+`
+	parsed, err := Parse(strings.NewReader(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := parsed.Messages
+	if parsed.Package != "chat" {
+		t.Errorf("package is %q, want chat", parsed.Package)
+	}
+	if len(messages) != 1 || messages[0].Name != "Note" || len(messages[0].Fields) != 4 {
+		t.Fatalf("parsed %+v", messages)
+	}
+	want := []Field{
+		{Name: "room_name", Type: "string", Number: 1},
+		{Name: "tags", Type: "string", Number: 2, Repeated: true},
+		{Name: "labels", Type: "map", Number: 3, Key: "string", Value: "string"},
+		{Name: "pinned", Type: "bool", Number: 4},
+	}
+	for i, field := range messages[0].Fields {
+		if field != want[i] {
+			t.Errorf("field %d is %+v, want %+v", i, field, want[i])
+		}
+	}
+
+	source, err := Generate("main", "note.proto", messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(source), "return []any{&e.RoomName, &e.Tags, &e.Labels, &e.Pinned}") {
+		t.Errorf("generated\n%s", source)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, schema := range []string{
+		"enum Kind { A = 0; }",
+		"message Note { string text = 1;",
+		"message Note { string text; }",
+		"message Note { map<string> labels = 1; }",
+		"message Note { oneof body { string text = 1; } }",
+	} {
+		if _, err := Parse(strings.NewReader(schema)); !errors.Is(err, ErrSyntax) {
+			t.Errorf("Parse(%q): %v, want %v", schema, err, ErrSyntax)
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	gap := []Message{{Name: "Note", Fields: []Field{{Name: "text", Type: "string", Number: 2}}}}
+	if _, err := Generate("main", "note.proto", gap); !errors.Is(err, ErrFieldNumber) {
+		t.Errorf("gap in the field numbers: %v, want %v", err, ErrFieldNumber)
+	}
+	for _, field := range []Field{
+		{Name: "count", Type: "int32", Number: 1},
+		{Name: "flags", Type: "bool", Number: 1, Repeated: true},
+		{Name: "counts", Type: "map", Number: 1, Key: "string", Value: "int32"},
+	} {
+		message := []Message{{Name: "Note", Fields: []Field{field}}}
+		if _, err := Generate("main", "note.proto", message); !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s field: %v, want %v", field.Name, err, ErrSyntax)
+		}
+	}
+}
+
+func TestParseService(t *testing.T) {
+	schema := `
+syntax = "proto3";
+package chat.backend;
+
+service Backend {
+  rpc Publish(PublishRequest) returns (PublishResponse);
+  rpc Watch(WatchRequest) returns (stream Change);
+}
+
+message PublishRequest { bytes payload = 1; }
+message PublishResponse { int64 delivered = 1; }
+message WatchRequest { repeated string types = 1; }
+message Change { string type = 1; repeated PublishRequest requests = 2; }
+`
+	parsed, err := Parse(strings.NewReader(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Service{Name: "Backend", Methods: []Method{
+		{Name: "Publish", Request: "PublishRequest", Response: "PublishResponse"},
+		{Name: "Watch", Request: "WatchRequest", Response: "Change", ServerStreams: true},
+	}}
+	if len(parsed.Services) != 1 || !reflect.DeepEqual(parsed.Services[0], want) {
+		t.Fatalf("parsed %+v, want %+v", parsed.Services, want)
+	}
+
+	source, err := GenerateGRPC("backendpb", "backend.proto", parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"type BackendServer interface",
+		"Watch(*WatchRequest, BackendWatchServer) error",
+		"func NewBackendClient(cc grpc.ClientConnInterface) BackendClient",
+		"Requests []*PublishRequest",
+		`ServiceName: "chat.backend.Backend"`,
+	} {
+		if !strings.Contains(string(source), want) {
+			t.Errorf("generated code has no %q:\n%s", want, source)
+		}
+	}
+}
+
+func TestParseServiceErrors(t *testing.T) {
+	for _, schema := range []string{
+		"service Backend { rpc Publish(stream PublishRequest) returns (PublishResponse); }",
+		"service Backend { rpc Publish(PublishRequest) returns (PublishResponse) {} }",
+		"service Backend { rpc Publish(PublishRequest); }",
+		"service Backend { rpc Publish(PublishRequest) returns (PublishResponse);",
+	} {
+		if _, err := Parse(strings.NewReader(schema)); !errors.Is(err, ErrSyntax) {
+			t.Errorf("Parse(%q): %v, want %v", schema, err, ErrSyntax)
+		}
+	}
+}
+
+func TestGenerateGRPCErrors(t *testing.T) {
+	for name, schema := range map[string]Schema{
+		"repeated bool": {Messages: []Message{{Name: "Note", Fields: []Field{{Name: "flags", Type: "bool", Number: 1, Repeated: true}}}}},
+		"unknown request": {Services: []Service{{Name: "Backend", Methods: []Method{
+			{Name: "Publish", Request: "Missing", Response: "Missing"},
+		}}}},
+	} {
+		if _, err := GenerateGRPC("backendpb", "backend.proto", schema); !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s: %v, want %v", name, err, ErrSyntax)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Clients connecting with qos=1 get at-least-once delivery. Every event sent to
+// them gets an id and is kept until the client sends an ack with that id. Events
+// not acked within the ack timeout are sent again, and all unacked events are
+// sent again when the client reconnects with the same session.
+
+// qosSessionKey identifies a session across reconnects
+type qosSessionKey struct {
+	username string
+	session  string
+}
+
+// pendingEvent is an event waiting for its ack
+type pendingEvent struct {
+	event  Event
+	sentAt time.Time
+}
+
+// qosSession holds the unacked events of a session
+type qosSession struct {
+	sync.Mutex
+	// pending is ordered by when the events were first sent
+	pending []pendingEvent
+	limit   int
+	// key is the key of the session in the qosSessions of the Manager
+	key qosSessionKey
+	// ids and clock are the ones of the Manager
+	ids   IDGenerator
+	clock Clock
+}
+
+// track gives the event an id and keeps it until it is acked
+// If the session is at its limit the oldest pending event is dropped
+func (s *qosSession) track(event Event) Event {
+	// The id makes the event differ per client, so it can't share a prepared frame
+	event.prepared = nil
+	if event.ID == "" {
+		event.ID = s.ids.NewID()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.pending = append(s.pending, pendingEvent{event: event, sentAt: s.clock.Now()})
+	if len(s.pending) > s.limit {
+		log.Printf("qos buffer full, dropping unacked %s event %s", s.pending[0].event.Type, s.pending[0].event.ID)
+		s.pending = s.pending[1:]
+	}
+	return event
+}
+
+// unacked returns how many events wait for their ack
+func (s *qosSession) unacked() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.pending)
+}
+
+// ack removes the event with the id, false is returned if it was not pending
+func (s *qosSession) ack(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for i, p := range s.pending {
+		if p.event.ID == id {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// due returns the pending events sent before the deadline and marks them as sent now
+func (s *qosSession) due(deadline time.Time) []Event {
+	s.Lock()
+	defer s.Unlock()
+
+	var events []Event
+	now := s.clock.Now()
+	for i := range s.pending {
+		if s.pending[i].sentAt.Before(deadline) {
+			events = append(events, s.pending[i].event)
+			s.pending[i].sentAt = now
+		}
+	}
+	return events
+}
+
+// qosSession returns the session of the user, creating it if needed
+func (m *Manager) qosSession(username, session string) *qosSession {
+	key := qosSessionKey{username: username, session: session}
+	return m.qosSessions.Update(key, m.qosSessionTTL(), func(s *qosSession, ok bool) *qosSession {
+		if !ok {
+			s = &qosSession{limit: m.config().QoS.BufferSize, key: key, ids: m.ids, clock: m.clock}
+		}
+		return s
+	})
+}
+
+// qosSessionTTL is how long a session is kept without a client, with a session TTL
+// of zero it is gone right away, a TTL of zero would keep it forever in the cache
+func (m *Manager) qosSessionTTL() time.Duration {
+	return max(time.Duration(m.config().QoS.SessionTTL), time.Nanosecond)
+}
+
+// dropQoSSession forgets the session, its unacked events are not sent again
+func (m *Manager) dropQoSSession(username, session string) {
+	m.qosSessions.Delete(qosSessionKey{username: username, session: session})
+}
+
+// redeliverPending sends all unacked events of the client's session again, used on reconnect
+func (m *Manager) redeliverPending(client *Client) {
+	m.RLock()
+	defer m.RUnlock()
+
+	if _, ok := m.clients[client]; !ok {
+		return
+	}
+	for _, event := range client.qos.due(m.now().Add(time.Nanosecond)) {
+		client.enqueue(event)
+	}
+}
+
+// runQoS redelivers events that were not acked in time and forgets sessions that
+// have been disconnected for longer than the session TTL
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runQoS(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.redeliverExpired()
+			m.touchQoSSessions()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// redeliverExpired sends events again that were not acked within the ack timeout
+func (m *Manager) redeliverExpired() {
+	deadline := m.now().Add(-time.Duration(m.config().QoS.AckTimeout))
+
+	m.RLock()
+	defer m.RUnlock()
+
+	for client := range m.clients {
+		if client.qos == nil {
+			continue
+		}
+		for _, event := range client.qos.due(deadline) {
+			client.enqueue(event)
+		}
+	}
+}
+
+// touchQoSSessions keeps the sessions of connected clients, the sessions expire
+// once the session TTL passed without a client
+func (m *Manager) touchQoSSessions() {
+	ttl := m.qosSessionTTL()
+
+	m.RLock()
+	defer m.RUnlock()
+	for client := range m.clients {
+		if client.qos != nil {
+			m.qosSessions.Touch(client.qos.key, ttl)
+		}
+	}
+}
+
+// AckHandler removes an event from the pending events of the client's session
+func AckHandler(event Event, c *Client) error {
+	var ack AckEvent
+	if err := json.Unmarshal(event.Payload, &ack); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if c.qos == nil {
+		// Acks are harmless without qos, the client might just always send them
+		return nil
+	}
+	c.qos.ack(ack.ID)
+	return nil
+}
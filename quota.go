@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quotas cap what a tenant can use of a hosted server, so free plans can be
+// offered next to paid ones. A tenant is a customer, its users are set in
+// quotas.tenants of the config, every other user is a tenant of its own. The
+// rooms a user created belong to the tenant of the user, rooms without an owner
+// are made by the server or operators and have no quotas. The limits are:
+//
+//	rooms_per_tenant   rooms the users of the tenant may create
+//	members_per_room   users in each room of the tenant, below max_members of the room
+//	messages_per_day   messages each user of the tenant may send per day, UTC
+//	storage_per_room   bytes of the stored events of each room of the tenant
+//
+// 0 is unlimited. quotas.default applies to the tenants without limits in
+// quotas.limits, the admin API changes the limits of a tenant until a restart:
+//
+//	GET /admin/quotas
+//	GET /admin/quotas/tenants/{tenant}      the limits and what the tenant uses
+//	PUT /admin/quotas/tenants/{tenant}      {"rooms_per_tenant":3,"messages_per_day":500}
+//	DELETE /admin/quotas/tenants/{tenant}   back to the limits of the config
+//	DELETE /admin/quotas/users/{username}/messages   lets the user send again today
+//
+// An event refused by a quota gets the client an error event with the code
+// quota_exceeded, and the REST API answers 429. The messages sent today are
+// counted in memory and start over after a restart.
+
+const (
+	QuotaRoomsPerTenant = "rooms_per_tenant"
+	QuotaMembersPerRoom = "members_per_room"
+	QuotaMessagesPerDay = "messages_per_day"
+	QuotaStoragePerRoom = "storage_per_room"
+
+	AuditQuota = "quota"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrInvalidQuota  = errors.New("quotas can't be negative")
+)
+
+// QuotaLimits are the quotas of a tenant, 0 is unlimited
+type QuotaLimits struct {
+	RoomsPerTenant int `json:"rooms_per_tenant"`
+	MembersPerRoom int `json:"members_per_room"`
+	MessagesPerDay int `json:"messages_per_day"`
+	// StoragePerRoom is in bytes of stored event payloads
+	StoragePerRoom int64 `json:"storage_per_room"`
+}
+
+// QuotasResponse is the response of GET /admin/quotas
+type QuotasResponse struct {
+	Default QuotaLimits `json:"default"`
+	// Tenants are the limits of the tenants that don't use the default
+	Tenants map[string]QuotaLimits `json:"tenants"`
+}
+
+// RoomUsage is what a room of a tenant uses
+type RoomUsage struct {
+	Room    string `json:"room"`
+	Members int    `json:"members"`
+	Storage int64  `json:"storage"`
+}
+
+// TenantUsage is the response of GET /admin/quotas/tenants/{tenant}
+type TenantUsage struct {
+	Tenant string      `json:"tenant"`
+	Limits QuotaLimits `json:"limits"`
+	Rooms  []RoomUsage `json:"rooms"`
+	// MessagesToday are the messages sent today by the users of the tenant that sent any
+	MessagesToday map[string]int `json:"messages_today"`
+}
+
+// validate returns ErrInvalidQuota if a limit is negative
+func (l QuotaLimits) validate() error {
+	if l.RoomsPerTenant < 0 || l.MembersPerRoom < 0 || l.MessagesPerDay < 0 || l.StoragePerRoom < 0 {
+		return ErrInvalidQuota
+	}
+	return nil
+}
+
+// quotaUsage holds the limits set through the admin API and the usage that is
+// counted as it happens
+type quotaUsage struct {
+	sync.Mutex
+	// limits replace the limits of the config for some tenants
+	limits map[string]QuotaLimits
+	// messages counts the messages each user sent on day
+	day      string
+	messages map[string]int
+	// storage holds the bytes stored per room, for the rooms counted since the start
+	storage map[string]int64
+}
+
+func newQuotaUsage() *quotaUsage {
+	return &quotaUsage{
+		limits:   make(map[string]QuotaLimits),
+		messages: make(map[string]int),
+		storage:  make(map[string]int64),
+	}
+}
+
+// today returns the message counts of the day, they are reset when the day changed
+// Only call it while holding the lock
+func (q *quotaUsage) today(now time.Time) map[string]int {
+	if day := now.UTC().Format(time.DateOnly); day != q.day {
+		q.day = day
+		clear(q.messages)
+	}
+	return q.messages
+}
+
+// stored adds the bytes to the storage of the room, if it was counted before
+func (q *quotaUsage) stored(room string, bytes int) {
+	q.Lock()
+	defer q.Unlock()
+	if used, ok := q.storage[room]; ok {
+		q.storage[room] = used + int64(bytes)
+	}
+}
+
+// forgetStorage makes the storage of the room be counted again the next time it is needed
+func (q *quotaUsage) forgetStorage(room string) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.storage, room)
+}
+
+// tenantOf returns the tenant of the user
+func (m *Manager) tenantOf(username string) string {
+	if tenant, ok := m.config().Quotas.Tenants[username]; ok {
+		return tenant
+	}
+	return username
+}
+
+// quotaLimits returns the limits of the tenant
+func (m *Manager) quotaLimits(tenant string) QuotaLimits {
+	m.quotas.Lock()
+	limits, ok := m.quotas.limits[tenant]
+	m.quotas.Unlock()
+	if ok {
+		return limits
+	}
+
+	config := m.config().Quotas
+	if limits, ok := config.Limits[tenant]; ok {
+		return limits
+	}
+	return config.Default
+}
+
+// roomQuotaLimits returns the limits of the tenant owning the room, none if it has no owner
+func (m *Manager) roomQuotaLimits(owner string) QuotaLimits {
+	if owner == "" {
+		return QuotaLimits{}
+	}
+	return m.quotaLimits(m.tenantOf(owner))
+}
+
+// roomOwner returns the user that created the room, empty for rooms the server created
+func (m *Manager) roomOwner(name string) string {
+	r := m.room(name)
+	r.Lock()
+	defer r.Unlock()
+	return r.owner
+}
+
+// quotaError returns an error wrapping ErrQuotaExceeded
+func quotaError(quota, format string, args ...any) error {
+	return fmt.Errorf("%w: %s, %s", ErrQuotaExceeded, quota, fmt.Sprintf(format, args...))
+}
+
+// sendQuotaExceeded tells the client that its event was refused by a quota
+func (m *Manager) sendQuotaExceeded(c *Client, err error) {
+	m.sendError(c, "quota_exceeded", map[string]string{"reason": err.Error()})
+}
+
+// tenantRooms returns the rooms created by the users of the tenant
+func (m *Manager) tenantRooms(tenant string) ([]Room, error) {
+	rooms, err := m.store.ListRooms()
+	if err != nil {
+		return nil, err
+	}
+	var owned []Room
+	for _, room := range rooms {
+		if room.Owner != "" && m.tenantOf(room.Owner) == tenant {
+			owned = append(owned, room)
+		}
+	}
+	return owned, nil
+}
+
+// checkRoomQuota returns ErrQuotaExceeded if the tenant of the user can't create another room
+func (m *Manager) checkRoomQuota(username string) error {
+	tenant := m.tenantOf(username)
+	limit := m.quotaLimits(tenant).RoomsPerTenant
+	if limit == 0 {
+		return nil
+	}
+	rooms, err := m.tenantRooms(tenant)
+	if err != nil {
+		return err
+	}
+	if len(rooms) >= limit {
+		return quotaError(QuotaRoomsPerTenant, "%s may create %d rooms", tenant, limit)
+	}
+	return nil
+}
+
+// checkMembersQuota returns ErrQuotaExceeded if the client would take a place the
+// tenant owning the room doesn't have
+// Only call it while holding the manager lock
+func (m *Manager) checkMembersQuota(c *Client, room Room, limits QuotaLimits) error {
+	limit := limits.MembersPerRoom
+	if limit == 0 || m.hasPlace(c, room.Name, limit) {
+		return nil
+	}
+	return quotaError(QuotaMembersPerRoom, "%s allows %d members", room.Name, limit)
+}
+
+// countMessage counts a message of the user against its daily quota, it returns
+// ErrQuotaExceeded without counting it once the user sent all messages of the day
+func (m *Manager) countMessage(username string) error {
+	tenant := m.tenantOf(username)
+	limit := m.quotaLimits(tenant).MessagesPerDay
+
+	m.quotas.Lock()
+	messages := m.quotas.today(m.now())
+	if limit > 0 && messages[username] >= limit {
+		sent := messages[username]
+		m.quotas.Unlock()
+		return quotaError(QuotaMessagesPerDay, "%s sent %d of %d messages today", username, sent, limit)
+	}
+	messages[username]++
+	m.quotas.Unlock()
+
+	m.meterMessage(tenant)
+	return nil
+}
+
+// roomStorage returns the bytes of the stored events of the room, they are counted
+// from the store the first time and kept up to date as events are stored
+func (m *Manager) roomStorage(room string) (int64, error) {
+	m.quotas.Lock()
+	used, ok := m.quotas.storage[room]
+	m.quotas.Unlock()
+	if ok {
+		return used, nil
+	}
+
+	err := m.store.ExportMessages(room, time.Time{}, time.Time{}, func(msg StoredMessage) error {
+		used += int64(len(msg.Event.Payload))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	m.quotas.Lock()
+	m.quotas.storage[room] = used
+	m.quotas.Unlock()
+	return used, nil
+}
+
+// checkStorageQuota returns ErrQuotaExceeded if the room stores all the bytes its
+// tenant may store
+func (m *Manager) checkStorageQuota(room string) error {
+	limit := m.roomQuotaLimits(m.roomOwner(room)).StoragePerRoom
+	if limit == 0 {
+		return nil
+	}
+	used, err := m.roomStorage(room)
+	if err != nil || used < limit {
+		return err
+	}
+
+	// Stores drop old messages on their own, the room is counted again before refusing
+	m.quotas.forgetStorage(room)
+	if used, err = m.roomStorage(room); err != nil || used < limit {
+		return err
+	}
+	return quotaError(QuotaStoragePerRoom, "%s stores %d of %d bytes", room, used, limit)
+}
+
+// tenantUsage returns the limits of the tenant and what it uses
+func (m *Manager) tenantUsage(tenant string) (TenantUsage, error) {
+	usage := TenantUsage{
+		Tenant:        tenant,
+		Limits:        m.quotaLimits(tenant),
+		Rooms:         []RoomUsage{},
+		MessagesToday: make(map[string]int),
+	}
+	rooms, err := m.tenantRooms(tenant)
+	if err != nil {
+		return usage, err
+	}
+	for _, room := range rooms {
+		storage, err := m.roomStorage(room.Name)
+		if err != nil {
+			return usage, err
+		}
+		usage.Rooms = append(usage.Rooms, RoomUsage{Room: room.Name, Members: m.roomMembers(room.Name), Storage: storage})
+	}
+	slices.SortFunc(usage.Rooms, func(a, b RoomUsage) int { return strings.Compare(a.Room, b.Room) })
+
+	m.quotas.Lock()
+	defer m.quotas.Unlock()
+	for username, sent := range m.quotas.today(m.now()) {
+		if m.tenantOf(username) == tenant {
+			usage.MessagesToday[username] = sent
+		}
+	}
+	return usage, nil
+}
+
+// quotasHandler returns the default limits and the limits of the tenants
+func (m *Manager) quotasHandler(w http.ResponseWriter, r *http.Request) {
+	config := m.config().Quotas
+	response := QuotasResponse{Default: config.Default, Tenants: maps.Clone(config.Limits)}
+	if response.Tenants == nil {
+		response.Tenants = make(map[string]QuotaLimits)
+	}
+	m.quotas.Lock()
+	maps.Copy(response.Tenants, m.quotas.limits)
+	m.quotas.Unlock()
+	writeJSON(w, http.StatusOK, response)
+}
+
+// tenantUsageHandler returns the limits of the tenant and what it uses
+func (m *Manager) tenantUsageHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := m.tenantUsage(r.PathValue("tenant"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// setTenantQuotaHandler replaces the limits of the tenant with the body, DELETE
+// returns the tenant to the limits of the config
+func (m *Manager) setTenantQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	var limits QuotaLimits
+	if r.Method == http.MethodPut {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := limits.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	m.quotas.Lock()
+	if r.Method == http.MethodPut {
+		m.quotas.limits[tenant] = limits
+	} else {
+		delete(m.quotas.limits, tenant)
+	}
+	m.quotas.Unlock()
+
+	m.audit(AuditEntry{
+		Action:     AuditQuota,
+		Actor:      "admin",
+		Target:     tenant,
+		RemoteAddr: r.RemoteAddr,
+		Details: map[string]string{
+			QuotaRoomsPerTenant: strconv.Itoa(limits.RoomsPerTenant),
+			QuotaMembersPerRoom: strconv.Itoa(limits.MembersPerRoom),
+			QuotaMessagesPerDay: strconv.Itoa(limits.MessagesPerDay),
+			QuotaStoragePerRoom: strconv.FormatInt(limits.StoragePerRoom, 10),
+		},
+	})
+	writeJSON(w, http.StatusOK, m.quotaLimits(tenant))
+}
+
+// resetMessagesHandler forgets the messages the user sent today
+func (m *Manager) resetMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	m.quotas.Lock()
+	delete(m.quotas.today(m.now()), username)
+	m.quotas.Unlock()
+
+	m.audit(AuditEntry{
+		Action:     AuditQuota,
+		Actor:      "admin",
+		Target:     username,
+		RemoteAddr: r.RemoteAddr,
+		Details:    map[string]string{QuotaMessagesPerDay: "reset"},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
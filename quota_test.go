@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// callQuotas calls a quota handler of the admin API with the path values
+func callQuotas(handler http.HandlerFunc, method, body string, values map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/admin/quotas", strings.NewReader(body))
+	for name, value := range values {
+		r.SetPathValue(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestRoomsPerTenant(t *testing.T) {
+	config := DefaultConfig()
+	config.Quotas.Tenants = map[string]string{"alice": "acme", "bob": "acme"}
+	config.Quotas.Default.RoomsPerTenant = 1
+	server, m, err := NewTestServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	alice := server.Connect("alice")
+	bob := server.Connect("bob")
+
+	if err := routeAs(t, m, alice, EventJoinRoom, JoinRoomEvent{Room: "launch"}); err != nil {
+		t.Fatal(err)
+	}
+	// bob is of the same tenant, so the room of alice used up the quota of both
+	err = routeAs(t, m, bob, EventJoinRoom, JoinRoomEvent{Room: "planning"})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("creating a second room of the tenant: %v, want %v", err, ErrQuotaExceeded)
+	}
+	var refused ErrorEvent
+	if err := bob.ExpectPayload(EventError, &refused, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if refused.Code != "quota_exceeded" {
+		t.Errorf("bob got the error %+v, want quota_exceeded", refused)
+	}
+	// Joining a room that exists doesn't create one
+	if err := routeAs(t, m, bob, EventJoinRoom, JoinRoomEvent{Room: "launch"}); err != nil {
+		t.Errorf("joining the room of alice: %v", err)
+	}
+}
+
+func TestMembersPerRoom(t *testing.T) {
+	config := DefaultConfig()
+	config.Quotas.Limits = map[string]QuotaLimits{"alice": {MembersPerRoom: 2}}
+	server, m := newRoomTestServer(t, config)
+	alice := server.Connect("alice")
+	bob := server.Connect("bob")
+	carol := server.Connect("carol")
+
+	if err := routeAs(t, m, alice, EventJoinRoom, JoinRoomEvent{Room: "launch"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := routeAs(t, m, bob, EventJoinRoom, JoinRoomEvent{Room: "launch"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := routeAs(t, m, carol, EventJoinRoom, JoinRoomEvent{Room: "launch"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("joining a full room of the tenant: %v, want %v", err, ErrQuotaExceeded)
+	}
+	// Another client of a member doesn't take another place
+	if err := routeAs(t, m, server.Connect("bob"), EventJoinRoom, JoinRoomEvent{Room: "launch"}); err != nil {
+		t.Errorf("joining with a second client of bob: %v", err)
+	}
+}
+
+func TestMessagesPerDay(t *testing.T) {
+	config := DefaultConfig()
+	config.Quotas.Default.MessagesPerDay = 2
+	clock := NewManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	server, m, err := NewTestServer(config, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	alice := server.Connect("alice")
+
+	send := func() error {
+		return routeAs(t, m, alice, EventSendMessage, SendMessageEvent{Message: "hello"})
+	}
+	for range 2 {
+		if err := send(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := send(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("third message of the day: %v, want %v", err, ErrQuotaExceeded)
+	}
+
+	// The count starts over the next day, UTC, or when an operator resets it
+	clock.Advance(12 * time.Hour)
+	if err := send(); err != nil {
+		t.Errorf("first message of the next day: %v", err)
+	}
+	send()
+	if err := send(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("third message of the next day: %v, want %v", err, ErrQuotaExceeded)
+	}
+	if w := callQuotas(m.resetMessagesHandler, http.MethodDelete, "", map[string]string{"username": "alice"}); w.Code != http.StatusNoContent {
+		t.Fatalf("resetting the messages: %d %s", w.Code, w.Body)
+	}
+	if err := send(); err != nil {
+		t.Errorf("message after the reset: %v", err)
+	}
+}
+
+func TestTenantQuotaAPI(t *testing.T) {
+	config := DefaultConfig()
+	config.Quotas.Tenants = map[string]string{"alice": "acme"}
+	config.Quotas.Default.RoomsPerTenant = 5
+	server, m := newRoomTestServer(t, config)
+	alice := server.Connect("alice")
+	tenant := map[string]string{"tenant": "acme"}
+
+	if w := callQuotas(m.setTenantQuotaHandler, http.MethodPut, `{"messages_per_day":-1}`, tenant); w.Code != http.StatusBadRequest {
+		t.Errorf("negative limit: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := callQuotas(m.setTenantQuotaHandler, http.MethodPut, `{"messages_per_day":10}`, tenant); w.Code != http.StatusOK {
+		t.Fatalf("setting the limits: %d %s", w.Code, w.Body)
+	}
+	if err := routeAs(t, m, alice, EventSendMessage, SendMessageEvent{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var usage TenantUsage
+	w := callQuotas(m.tenantUsageHandler, http.MethodGet, "", tenant)
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+		t.Fatalf("usage %s: %v", w.Body, err)
+	}
+	// The owner of the private room of the test server is alice, so it is a room of acme
+	if usage.Limits.MessagesPerDay != 10 || usage.Limits.RoomsPerTenant != 0 || len(usage.Rooms) != 1 || usage.Rooms[0].Room != "secret" || usage.MessagesToday["alice"] != 1 {
+		t.Errorf("usage is %+v", usage)
+	}
+
+	var quotas QuotasResponse
+	w = callQuotas(m.quotasHandler, http.MethodGet, "", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &quotas); err != nil || quotas.Tenants["acme"].MessagesPerDay != 10 {
+		t.Errorf("quotas are %s, %v", w.Body, err)
+	}
+
+	if w := callQuotas(m.setTenantQuotaHandler, http.MethodDelete, "", tenant); w.Code != http.StatusOK {
+		t.Fatalf("removing the limits: %d %s", w.Code, w.Body)
+	}
+	if limits := m.quotaLimits("acme"); limits != config.Quotas.Default {
+		t.Errorf("limits after DELETE are %+v, want the default %+v", limits, config.Quotas.Default)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Deployments without a message broker can still have every instance know who
+// is in which room on the others. With cluster.raft the instances form a Raft
+// group replicating the clients connected to each of them and their rooms, so
+// room member counts and lists, max_members and members_per_room, and whether
+// a user is connected count the clients of all instances:
+//
+//	"cluster": {
+//	    "node_id": "ws-1",
+//	    "secret":  "...",
+//	    "raft": {"bind": ":7000", "advertise": "10.0.0.1:7000", "dns": "ws-raft.chat.svc.cluster.local"}
+//	}
+//
+// The other instances are found through raft.peers, a static list of their Raft
+// addresses, and the addresses raft.dns resolves to with the port of
+// raft.advertise, both are looked up every raft.discovery_interval. An instance
+// that is not in the group yet asks the instances it found for the leader and
+// has the leader add it, if none of them knows a leader the one with the lowest
+// address starts the group alone. Leader election is left to Raft, a group of
+// three instances keeps working with one of them down.
+//
+// Only the leader can change the state, the others forward their changes to it
+// over HTTP on /cluster/raft/..., at the Raft host of the leader and raft.http_port,
+// so the instances have to serve HTTP on the same port. A change replaces all
+// the clients of the instance sending it, changes made while one is applied are
+// sent together with the next one. Every instance sends its clients again every
+// third of raft.presence_ttl and the clients of an instance that didn't for
+// raft.presence_ttl are not counted anymore, so the clients of an instance that
+// went down go away. The state is about connected clients, it is kept in memory
+// and an instance restarting gets it from the leader again.
+
+var (
+	ErrNotInRaftGroup = errors.New("not in a raft group")
+)
+
+// raftTimeout bounds applying a change and adding an instance to the group
+var raftTimeout = 10 * time.Second
+
+// raftMaxStateSize bounds the clients of an instance forwarded to the leader
+var raftMaxStateSize int64 = 16 << 20
+
+// raftMember is a client in a room, as replicated to the other instances
+type raftMember struct {
+	Client   string `json:"client"`
+	Username string `json:"username"`
+	Room     string `json:"room"`
+}
+
+// raftNodeState holds the clients of an instance, it is what a change replaces
+type raftNodeState struct {
+	Node string `json:"node"`
+	// Address is the Raft address of the instance, its routes are at its host, see raftPeerURL
+	Address string `json:"address,omitempty"`
+	// At is when the instance sent it, the clients are dropped after the presence ttl
+	At      time.Time    `json:"at"`
+	Members []raftMember `json:"members"`
+}
+
+// raftFSM is the state replicated by Raft, the clients of every instance
+type raftFSM struct {
+	sync.RWMutex
+	nodes map[string]raftNodeState
+}
+
+func (f *raftFSM) Apply(entry *raft.Log) any {
+	var state raftNodeState
+	if err := json.Unmarshal(entry.Data, &state); err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.nodes[state.Node] = state
+	return nil
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.RLock()
+	defer f.RUnlock()
+	return raftSnapshot(maps.Clone(f.nodes)), nil
+}
+
+func (f *raftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	nodes := make(map[string]raftNodeState)
+	if err := json.NewDecoder(snapshot).Decode(&nodes); err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.nodes = nodes
+	return nil
+}
+
+// raftSnapshot is the state as of a snapshot
+type raftSnapshot map[string]raftNodeState
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s raftSnapshot) Release() {}
+
+// raftJoin is sent to the leader to be added to the group
+type raftJoin struct {
+	Address string `json:"address"`
+}
+
+// RaftStatus is the Raft group as seen by an instance
+type RaftStatus struct {
+	Address string `json:"address"`
+	// State is Leader, Follower, Candidate or Shutdown
+	State   string   `json:"state"`
+	Leader  string   `json:"leader,omitempty"`
+	Servers []string `json:"servers"`
+	// Clients is how many clients each instance has, counting only the ones within the presence ttl
+	Clients map[string]int `json:"clients"`
+}
+
+// raftNode is this instance in the Raft group
+type raftNode struct {
+	raft      *raft.Raft
+	transport *raft.NetworkTransport
+	fsm       *raftFSM
+	// address is the Raft address of this instance, also its server id
+	address string
+	// changed is signalled when the clients of this instance change
+	changed chan struct{}
+}
+
+// newRaftNode starts the Raft transport and the node, it joins a group in runRaft
+func newRaftNode(config RaftConfig) (*raftNode, error) {
+	advertise := config.Advertise
+	if advertise == "" {
+		advertise = config.Bind
+	}
+	addr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return nil, fmt.Errorf("raft: advertise address: %w", err)
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		return nil, fmt.Errorf("raft: advertise %s is not an address the other instances can reach", advertise)
+	}
+	transport, err := raft.NewTCPTransport(config.Bind, addr, 3, raftTimeout, log.Writer())
+	if err != nil {
+		return nil, fmt.Errorf("raft: %w", err)
+	}
+
+	n := &raftNode{
+		transport: transport,
+		fsm:       &raftFSM{nodes: make(map[string]raftNodeState)},
+		address:   addr.String(),
+		changed:   make(chan struct{}, 1),
+	}
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(n.address)
+	conf.LogOutput = log.Writer()
+	conf.LogLevel = "WARN"
+	store := raft.NewInmemStore()
+	if n.raft, err = raft.NewRaft(conf, n.fsm, store, store, raft.NewInmemSnapshotStore(), transport); err != nil {
+		transport.Close()
+		return nil, fmt.Errorf("raft: %w", err)
+	}
+	return n, nil
+}
+
+// markChanged has the clients of this instance sent to the group
+// It doesn't block, so it can be called while holding the manager lock
+func (n *raftNode) markChanged() {
+	select {
+	case n.changed <- struct{}{}:
+	default:
+	}
+}
+
+// inGroup returns true if this instance is a server of a Raft group
+func (n *raftNode) inGroup() bool {
+	future := n.raft.GetConfiguration()
+	if future.Error() != nil {
+		return false
+	}
+	for _, server := range future.Configuration().Servers {
+		if string(server.ID) == n.address {
+			return true
+		}
+	}
+	return false
+}
+
+// status returns the group as seen by this instance
+func (n *raftNode) status(now time.Time, ttl time.Duration) RaftStatus {
+	leader, _ := n.raft.LeaderWithID()
+	status := RaftStatus{
+		Address: n.address,
+		State:   n.raft.State().String(),
+		Leader:  string(leader),
+		Servers: []string{},
+		Clients: make(map[string]int),
+	}
+	if future := n.raft.GetConfiguration(); future.Error() == nil {
+		for _, server := range future.Configuration().Servers {
+			status.Servers = append(status.Servers, string(server.Address))
+		}
+	}
+	n.fsm.RLock()
+	for node, state := range n.fsm.nodes {
+		if now.Sub(state.At) <= ttl {
+			status.Clients[node] = len(state.Members)
+		}
+	}
+	n.fsm.RUnlock()
+	return status
+}
+
+// remoteMembers calls fn for the clients of the other instances, leaving out the
+// instances that didn't send theirs for the ttl
+func (n *raftNode) remoteMembers(self string, now time.Time, ttl time.Duration, fn func(raftNodeState, raftMember)) {
+	n.fsm.RLock()
+	defer n.fsm.RUnlock()
+	for node, state := range n.fsm.nodes {
+		if node == self || now.Sub(state.At) > ttl {
+			continue
+		}
+		for _, member := range state.Members {
+			fn(state, member)
+		}
+	}
+}
+
+// raftPresenceTTL returns how long the clients an instance sent are counted
+func (m *Manager) raftPresenceTTL() time.Duration {
+	if ttl := time.Duration(m.config().Cluster.Raft.PresenceTTL); ttl > 0 {
+		return ttl
+	}
+	return 30 * time.Second
+}
+
+// remoteRoomUsernames adds the users in the room on other instances to users
+// Only call it while holding the manager lock
+func (m *Manager) remoteRoomUsernames(room string, users map[string]bool) {
+	if m.raft == nil {
+		return
+	}
+	m.raft.remoteMembers(m.cluster.self, m.now(), m.raftPresenceTTL(), func(_ raftNodeState, member raftMember) {
+		if member.Room == room {
+			users[member.Username] = true
+		}
+	})
+}
+
+// localRaftState returns the clients of this instance
+func (m *Manager) localRaftState() raftNodeState {
+	m.RLock()
+	defer m.RUnlock()
+	state := raftNodeState{Node: m.cluster.self, Address: m.raft.address, At: m.now(), Members: make([]raftMember, 0, len(m.clients))}
+	for client := range m.clients {
+		state.Members = append(state.Members, raftMember{Client: client.id, Username: client.username, Room: client.room})
+	}
+	return state
+}
+
+// raftPeerURL returns the URL of the HTTP routes of the instance with the Raft address
+func (m *Manager) raftPeerURL(address string) (string, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	config := m.config()
+	port := config.Cluster.Raft.HTTPPort
+	if port == 0 {
+		_, p, err := net.SplitHostPort(config.Addr)
+		if err != nil {
+			return "", fmt.Errorf("raft.http_port is needed, addr has no port: %w", err)
+		}
+		if port, err = strconv.Atoi(p); err != nil {
+			return "", err
+		}
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + cleanBasePath(config.BasePath), nil
+}
+
+// raftRequest sends the body as JSON to the instance with the Raft address and
+// decodes the response into out
+func (m *Manager) raftRequest(ctx context.Context, address, method, path string, body, out any) error {
+	base, err := m.raftPeerURL(address)
+	if err != nil {
+		return err
+	}
+	return m.cluster.requestURL(ctx, base+path, method, body, out)
+}
+
+// applyRaftState has the leader apply the clients of this instance, forwarding
+// them if this instance is not the leader
+func (m *Manager) applyRaftState(ctx context.Context, state raftNodeState) error {
+	if m.raft.raft.State() == raft.Leader {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		future := m.raft.raft.Apply(data, raftTimeout)
+		if err := future.Error(); err != nil {
+			return err
+		}
+		if err, ok := future.Response().(error); ok {
+			return err
+		}
+		return nil
+	}
+	leader, _ := m.raft.raft.LeaderWithID()
+	if leader == "" {
+		return ErrNotInRaftGroup
+	}
+	return m.raftRequest(ctx, string(leader), http.MethodPost, "/cluster/raft/apply", state, nil)
+}
+
+// discoverRaftPeers returns the Raft addresses of the other instances found
+// through the static list and DNS
+func (m *Manager) discoverRaftPeers(ctx context.Context) []string {
+	config := m.config().Cluster.Raft
+	found := make(map[string]bool)
+	for _, peer := range config.Peers {
+		found[peer] = true
+	}
+	if config.DNS != "" {
+		_, port, _ := net.SplitHostPort(m.raft.address)
+		hosts, err := net.DefaultResolver.LookupHost(ctx, config.DNS)
+		if err != nil {
+			log.Printf("raft: looking up %s: %v", config.DNS, err)
+		}
+		for _, host := range hosts {
+			found[net.JoinHostPort(host, port)] = true
+		}
+	}
+	delete(found, m.raft.address)
+	return slices.Sorted(maps.Keys(found))
+}
+
+// joinRaftGroup has the leader known to the peers add this instance, or starts
+// the group if none of them knows a leader and this instance has the lowest address
+func (m *Manager) joinRaftGroup(ctx context.Context) {
+	peers := m.discoverRaftPeers(ctx)
+	reachable := []string{m.raft.address}
+	for _, peer := range peers {
+		var status RaftStatus
+		if err := m.raftRequest(ctx, peer, http.MethodGet, "/cluster/raft", nil, &status); err != nil {
+			continue
+		}
+		reachable = append(reachable, peer)
+		if status.Leader == "" {
+			continue
+		}
+		err := m.raftRequest(ctx, status.Leader, http.MethodPost, "/cluster/raft/join", raftJoin{Address: m.raft.address}, nil)
+		if err != nil {
+			log.Printf("raft: joining through %s: %v", status.Leader, err)
+			continue
+		}
+		log.Printf("raft: joined the group of %s", status.Leader)
+		return
+	}
+
+	if slices.Min(reachable) != m.raft.address {
+		return
+	}
+	server := raft.Server{ID: raft.ServerID(m.raft.address), Address: raft.ServerAddress(m.raft.address)}
+	err := m.raft.raft.BootstrapCluster(raft.Configuration{Servers: []raft.Server{server}}).Error()
+	if err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+		log.Println("raft: starting the group: ", err)
+		return
+	}
+	log.Printf("raft: started the group, %d peers found", len(peers))
+}
+
+// runRaft joins the group and sends the clients of this instance to it when they
+// change and every third of the presence ttl, on shutdown it sends that it has none
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runRaft(ctx context.Context) {
+	defer func() {
+		state := raftNodeState{Node: m.cluster.self, Address: m.raft.address, At: m.now(), Members: []raftMember{}}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), raftTimeout)
+		if err := m.applyRaftState(shutdownCtx, state); err != nil {
+			log.Println("raft: leaving: ", err)
+		}
+		cancel()
+		if err := m.raft.raft.Shutdown().Error(); err != nil {
+			log.Println("raft: shutting down: ", err)
+		}
+		m.raft.transport.Close()
+	}()
+
+	discovered := time.Time{}
+	sent := time.Time{}
+	pending := true
+	for {
+		// The intervals are read every time so a config reload applies to the next run
+		interval := time.Duration(m.config().Cluster.Raft.DiscoveryInterval)
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		now := m.now()
+		if now.Sub(discovered) >= interval && !m.raft.inGroup() {
+			m.joinRaftGroup(ctx)
+			discovered = now
+		}
+		if pending || now.Sub(sent) >= m.raftPresenceTTL()/3 {
+			if err := m.applyRaftState(ctx, m.localRaftState()); err != nil {
+				pending = true
+			} else {
+				pending = false
+				sent = now
+			}
+		}
+
+		select {
+		case <-m.raft.changed:
+			pending = true
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// raftStatusHandler returns the group as seen by this instance, instances that
+// are not in the group yet ask it for the leader
+func (m *Manager) raftStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if m.raft == nil {
+		http.Error(w, "raft is off", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, m.raft.status(m.now(), m.raftPresenceTTL()))
+}
+
+// raftJoinHandler adds an instance to the group, only the leader can
+func (m *Manager) raftJoinHandler(w http.ResponseWriter, r *http.Request) {
+	if m.raft == nil {
+		http.Error(w, "raft is off", http.StatusNotFound)
+		return
+	}
+	var join raftJoin
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&join); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, _, err := net.SplitHostPort(join.Address); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := raft.ServerID(join.Address)
+	if err := m.raft.raft.AddVoter(id, raft.ServerAddress(join.Address), 0, raftTimeout).Error(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("raft: added %s to the group", join.Address)
+	w.WriteHeader(http.StatusOK)
+}
+
+// raftApplyHandler applies the clients of another instance, only the leader can
+func (m *Manager) raftApplyHandler(w http.ResponseWriter, r *http.Request) {
+	if m.raft == nil {
+		http.Error(w, "raft is off", http.StatusNotFound)
+		return
+	}
+	var state raftNodeState
+	r.Body = http.MaxBytesReader(w, r.Body, raftMaxStateSize)
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if m.raft.raft.State() != raft.Leader {
+		http.Error(w, "not the leader", http.StatusServiceUnavailable)
+		return
+	}
+	if err := m.applyRaftState(r.Context(), state); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// freeRaftAddress returns a loopback address with a port nothing listens on
+func freeRaftAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestRaftFSMSnapshot(t *testing.T) {
+	fsm := &raftFSM{nodes: make(map[string]raftNodeState)}
+	at := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, state := range []raftNodeState{
+		{Node: "ws-1", At: at, Members: []raftMember{{Client: "c1", Username: "alice", Room: defaultRoom}}},
+		{Node: "ws-2", At: at, Members: []raftMember{{Client: "c2", Username: "bob", Room: "ops"}}},
+		// A change replaces all the clients of the instance
+		{Node: "ws-1", At: at.Add(time.Second), Members: []raftMember{}},
+	} {
+		data, _ := json.Marshal(state)
+		if err := fsm.Apply(&raft.Log{Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err, ok := fsm.Apply(&raft.Log{Data: []byte("{")}).(error); !ok || err == nil {
+		t.Error("an invalid change was applied")
+	}
+
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &raftTestSink{}
+	if err := snapshot.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	restored := &raftFSM{}
+	if err := restored.Restore(sink); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.nodes) != 2 || len(restored.nodes["ws-1"].Members) != 0 || restored.nodes["ws-2"].Members[0].Username != "bob" {
+		t.Errorf("restored %+v", restored.nodes)
+	}
+}
+
+// raftTestSink keeps a snapshot in memory
+type raftTestSink struct {
+	bytes.Buffer
+}
+
+func (s *raftTestSink) ID() string    { return "test" }
+func (s *raftTestSink) Cancel() error { return nil }
+func (s *raftTestSink) Close() error  { return nil }
+
+func TestRaftSharesPresence(t *testing.T) {
+	config := DefaultConfig()
+	config.Cluster.NodeID = "ws-1"
+	config.Cluster.Secret = "backplane"
+	config.Cluster.Raft.Bind = freeRaftAddress(t)
+	config.Cluster.Raft.PresenceTTL = Duration(30 * time.Second)
+	clock := NewManualClock(time.Now())
+	server, m, err := NewTestServer(config, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Connect("alice")
+
+	// Alone, the instance starts the group and sends its clients to it
+	ttl := time.Duration(config.Cluster.Raft.PresenceTTL)
+	deadline := time.Now().Add(10 * time.Second)
+	for m.raft.status(clock.Now(), ttl).Clients["ws-1"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the client of alice didn't reach the group: %+v", m.raft.status(clock.Now(), ttl))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Another instance sends its clients to the leader
+	state, _ := json.Marshal(raftNodeState{
+		Node:    "ws-2",
+		Address: "127.0.0.2:7000",
+		At:      clock.Now(),
+		Members: []raftMember{{Client: "c2", Username: "bob", Room: defaultRoom}},
+	})
+	w := httptest.NewRecorder()
+	m.raftApplyHandler(w, httptest.NewRequest(http.MethodPost, "/cluster/raft/apply", bytes.NewReader(state)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("applying the clients of ws-2: %d %s", w.Code, w.Body)
+	}
+	if members := m.roomMembers(defaultRoom); members != 2 {
+		t.Errorf("%s has %d members, want alice and bob of ws-2", defaultRoom, members)
+	}
+	if !m.userConnected("bob") {
+		t.Error("bob of ws-2 is not connected")
+	}
+
+	// The clients of an instance that stopped sending them go away
+	clock.Advance(ttl + time.Second)
+	if members := m.roomMembers(defaultRoom); members != 1 {
+		t.Errorf("%s has %d members after the ttl, want alice only", defaultRoom, members)
+	}
+	if m.userConnected("bob") {
+		t.Error("bob is still connected after the ttl")
+	}
+}
+
+func TestRaftJoinNeedsAnAddress(t *testing.T) {
+	config := DefaultConfig()
+	config.Cluster.NodeID = "ws-1"
+	config.Cluster.Secret = "backplane"
+	config.Cluster.Raft.Bind = freeRaftAddress(t)
+	server, m, err := NewTestServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	w := httptest.NewRecorder()
+	m.raftJoinHandler(w, httptest.NewRequest(http.MethodPost, "/cluster/raft/join", strings.NewReader(`{"address":"ws-2"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("joining without a port: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
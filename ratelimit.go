@@ -0,0 +1,36 @@
+package main
+
+import "time"
+
+// tokenBucket is a rate limiter that allows bursts, it is not safe for concurrent use
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token at now if there is one, refilling at rate tokens per second up to burst
+// A rate of zero means no limit
+func (b *tokenBucket) allow(now time.Time, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	b.last = now
+
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Reactions are emoji added to a chat message by its id. The users that reacted
+// are stored with the message, the room is sent the counts every time they change
+// so clients don't have to keep track of who reacted.
+
+const (
+	// EventAddReaction is sent by a client to react to a message
+	EventAddReaction = "add_reaction"
+	// EventRemoveReaction is sent by a client to take its reaction back
+	EventRemoveReaction = "remove_reaction"
+	// EventReactionUpdated is sent to the room when the reactions of a message changed
+	EventReactionUpdated = "reaction_updated"
+)
+
+var (
+	ErrInvalidReaction  = errors.New("invalid reaction")
+	ErrTooManyReactions = errors.New("too many reactions on the message")
+	ErrMessageNotFound  = errors.New("message not found")
+)
+
+var (
+	// maxReactionsPerUser is how many different emoji a user can add to one message
+	maxReactionsPerUser = 10
+	// maxEmojiLength is the longest emoji in bytes, long enough for joined emoji like families
+	maxEmojiLength = 32
+)
+
+// ReactionEvent is the payload sent in the
+// add_reaction and remove_reaction events
+type ReactionEvent struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionUpdatedEvent is the payload sent in the
+// reaction_updated event
+type ReactionUpdatedEvent struct {
+	MessageID string `json:"message_id"`
+	Room      string `json:"room"`
+	// Emoji, By and Added describe the change
+	Emoji string `json:"emoji"`
+	By    string `json:"by"`
+	Added bool   `json:"added"`
+	// Reactions are the counts of all emoji on the message
+	Reactions map[string]int `json:"reactions"`
+}
+
+// validateEmoji returns an error unless the emoji is a short string without spaces
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) || strings.ContainsFunc(emoji, func(r rune) bool { return r <= ' ' }) {
+		return fmt.Errorf("%w: emoji must be 1 to %d bytes without spaces", ErrInvalidReaction, maxEmojiLength)
+	}
+	return nil
+}
+
+// reactionCounts returns how many users reacted with each emoji
+func reactionCounts(reactions map[string][]string) map[string]int {
+	counts := make(map[string]int, len(reactions))
+	for emoji, users := range reactions {
+		counts[emoji] = len(users)
+	}
+	return counts
+}
+
+// AddReactionHandler adds a reaction of the user to a message in its room
+func AddReactionHandler(event Event, c *Client) error {
+	return c.manager.updateReaction(event, c, true)
+}
+
+// RemoveReactionHandler removes a reaction of the user from a message in its room
+func RemoveReactionHandler(event Event, c *Client) error {
+	return c.manager.updateReaction(event, c, false)
+}
+
+// updateReaction adds or removes the reaction in the event and tells the room
+func (m *Manager) updateReaction(event Event, c *Client, add bool) error {
+	var reaction ReactionEvent
+	if err := json.Unmarshal(event.Payload, &reaction); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if err := validateEmoji(reaction.Emoji); err != nil {
+		return err
+	}
+
+	// The read, change and save of the reactions must not interleave with another update
+	m.reactionsLock.Lock()
+	defer m.reactionsLock.Unlock()
+
+	msg, err := m.store.GetMessage(reaction.MessageID)
+	// Messages of other rooms are hidden like missing ones
+	if errors.Is(err, ErrNotFound) || (err == nil && msg.Room != m.roomOf(c)) {
+		return fmt.Errorf("%w: %s", ErrMessageNotFound, reaction.MessageID)
+	}
+	if err != nil {
+		return err
+	}
+
+	reactions := msg.Reactions
+	if reactions == nil {
+		reactions = make(map[string][]string)
+	}
+	users := reactions[reaction.Emoji]
+	reacted := slices.Contains(users, c.username)
+
+	switch {
+	case add && reacted, !add && !reacted:
+		// Nothing changes, resending the same reaction is not an error
+		return nil
+	case add:
+		if userReactions(reactions, c.username) >= maxReactionsPerUser {
+			return fmt.Errorf("%w: at most %d per user", ErrTooManyReactions, maxReactionsPerUser)
+		}
+		reactions[reaction.Emoji] = append(users, c.username)
+	default:
+		users = slices.DeleteFunc(users, func(user string) bool { return user == c.username })
+		if len(users) == 0 {
+			delete(reactions, reaction.Emoji)
+		} else {
+			reactions[reaction.Emoji] = users
+		}
+	}
+
+	if err := m.store.SaveReactions(msg.ID, reactions); err != nil {
+		return err
+	}
+	m.uncacheRoom(msg.Room)
+
+	data, err := json.Marshal(ReactionUpdatedEvent{
+		MessageID: msg.ID,
+		Room:      msg.Room,
+		Emoji:     reaction.Emoji,
+		By:        c.username,
+		Added:     add,
+		Reactions: reactionCounts(reactions),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal reaction: %v", err)
+	}
+	m.sendToRoom(msg.Room, Event{Type: EventReactionUpdated, Payload: data})
+	return nil
+}
+
+// historyReactions returns the reaction counts of the latest messages of the room
+// that have reactions, keyed by message id
+func (m *Manager) historyReactions(room string, limit int) map[string]map[string]int {
+	if limit == 0 {
+		return nil
+	}
+	messages, err := m.latestMessages(room, limit)
+	if err != nil {
+		log.Printf("loading reactions of room %s: %v", room, err)
+		return nil
+	}
+
+	var reactions map[string]map[string]int
+	for _, msg := range messages {
+		if len(msg.Reactions) == 0 {
+			continue
+		}
+		if reactions == nil {
+			reactions = make(map[string]map[string]int)
+		}
+		reactions[msg.ID] = reactionCounts(msg.Reactions)
+	}
+	return reactions
+}
+
+// userReactions returns how many different emoji the user reacted with
+func userReactions(reactions map[string][]string, username string) int {
+	n := 0
+	for _, users := range reactions {
+		if slices.Contains(users, username) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"arti.soft/websockets-go/wstest"
+)
+
+// A single client session can be recorded to reproduce a handler bug that only
+// shows up with what one user did. An operator starts the recording with the
+// consent of the user, from then on every event the client sends and every event
+// written to it is appended to a JSON Lines file in recording.dir, until the
+// recording is stopped or the client disconnects:
+//
+//	POST /admin/clients/{client id}/recording {"consent":true}
+//	DELETE /admin/clients/{client id}/recording
+//
+// The client is told with a session_recording event, so the frontend can show it.
+// The playback harness connects a client to a test server and sends the recorded
+// events of the client again, with the time between them, and compares what the
+// client received with the recording:
+//
+//	websockets-go -config config.json -playback alice.jsonl -playback-user alice
+//
+// Recordings hold the messages of the user in the clear, they are for debugging
+// and should be deleted once the bug is found.
+
+const (
+	// EventSessionRecording tells a client that its session is recorded, or no longer is
+	EventSessionRecording = "session_recording"
+
+	AuditRecordingStarted = "recording_started"
+	AuditRecordingStopped = "recording_stopped"
+
+	// RecordInbound marks the events sent by the client, RecordOutbound the ones written to it
+	RecordInbound  = "in"
+	RecordOutbound = "out"
+)
+
+var (
+	ErrRecordingDisabled = errors.New("recordings are not enabled")
+	ErrRecordingConsent  = errors.New("the user has to consent to the recording")
+	ErrRecording         = errors.New("the client is already recorded")
+	ErrClientNotFound    = errors.New("client not found")
+)
+
+var (
+	// maxRecordingBytes stops a recording once its file is this large
+	maxRecordingBytes int64 = 64 << 20
+	// playbackSettle is how long playback waits for the last responses
+	playbackSettle = 500 * time.Millisecond
+)
+
+// SessionRecord is a line of a recording
+type SessionRecord struct {
+	Time time.Time `json:"time"`
+	// Direction is in for events the client sent, out for events written to it
+	Direction string `json:"direction"`
+	Event     Event  `json:"event"`
+}
+
+// StartRecordingRequest is the body of POST /admin/clients/{target}/recording
+type StartRecordingRequest struct {
+	// Consent confirms the user agreed to the recording, it is required
+	Consent bool `json:"consent"`
+}
+
+// RecordingResponse is the response of the recording endpoints
+type RecordingResponse struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	// Path is the file the session is recorded to
+	Path string `json:"path"`
+	// Records is how many events were recorded so far
+	Records int `json:"records"`
+}
+
+// SessionRecordingEvent is the payload sent in the
+// session_recording event
+type SessionRecordingEvent struct {
+	Recording bool `json:"recording"`
+}
+
+// sessionRecorder appends the events of one client to its file
+type sessionRecorder struct {
+	sync.Mutex
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	bytes   int64
+	records int
+	clock   Clock
+}
+
+// record appends the event, it does nothing once the recorder was closed
+func (r *sessionRecorder) record(direction string, event Event) {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return
+	}
+
+	data, err := json.Marshal(SessionRecord{Time: r.clock.Now(), Direction: direction, Event: event})
+	if err != nil {
+		log.Println("recording: ", err)
+		return
+	}
+	if r.bytes+int64(len(data))+1 > maxRecordingBytes {
+		log.Printf("recording %s is full", r.path)
+		r.closeLocked()
+		return
+	}
+	r.writer.Write(append(data, '\n'))
+	r.bytes += int64(len(data)) + 1
+	r.records++
+}
+
+// close flushes and closes the file, it is safe to call more than once
+func (r *sessionRecorder) close() {
+	r.Lock()
+	defer r.Unlock()
+	r.closeLocked()
+}
+
+func (r *sessionRecorder) closeLocked() {
+	if r.file == nil {
+		return
+	}
+	if err := r.writer.Flush(); err != nil {
+		log.Println("recording: ", err)
+	}
+	if err := r.file.Close(); err != nil {
+		log.Println("recording: ", err)
+	}
+	r.file = nil
+}
+
+// response describes the recording of the client
+func (r *sessionRecorder) response(c *Client) RecordingResponse {
+	r.Lock()
+	defer r.Unlock()
+	return RecordingResponse{ClientID: c.id, Username: c.username, Path: r.path, Records: r.records}
+}
+
+// record appends the event to the recording of the client, if it is recorded
+func (c *Client) record(direction string, event Event) {
+	if r := c.recorder.Load(); r != nil {
+		r.record(direction, event)
+	}
+}
+
+// stopRecording ends the recording of the client, it returns nil if there was none
+func (c *Client) stopRecording() *sessionRecorder {
+	r := c.recorder.Swap(nil)
+	if r != nil {
+		r.close()
+	}
+	return r
+}
+
+// clientByID returns the connected client with the ID
+func (m *Manager) clientByID(id string) (*Client, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	for client := range m.clients {
+		if client.id == id {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
+// startRecording records the session of the client to a new file in the recording dir
+func (m *Manager) startRecording(c *Client) (*sessionRecorder, error) {
+	dir := m.config().Recording.Dir
+	if dir == "" {
+		return nil, ErrRecordingDisabled
+	}
+	// The file of a recording started in the same second would have the same name
+	if c.recorder.Load() != nil {
+		return nil, ErrRecording
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s-%d.jsonl", c.username, c.id, m.now().Unix()))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &sessionRecorder{path: path, file: file, writer: bufio.NewWriter(file), clock: m.clock}
+	if !c.recorder.CompareAndSwap(nil, r) {
+		file.Close()
+		os.Remove(path)
+		return nil, ErrRecording
+	}
+	// The client may have disconnected meanwhile, nothing would close the file then
+	if _, ok := m.clientByID(c.id); !ok {
+		c.stopRecording()
+		return nil, ErrClientNotFound
+	}
+	return r, nil
+}
+
+// tellRecording lets the client know whether it is recorded
+func (m *Manager) tellRecording(c *Client, recording bool) {
+	data, _ := json.Marshal(SessionRecordingEvent{Recording: recording})
+	m.sendToClient(c, Event{Type: EventSessionRecording, Payload: data})
+}
+
+// startRecordingHandler starts recording the client, like {"consent":true}
+func (m *Manager) startRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	var req StartRecordingRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !req.Consent {
+		http.Error(w, ErrRecordingConsent.Error(), http.StatusBadRequest)
+		return
+	}
+	client, ok := m.clientByID(r.PathValue("target"))
+	if !ok {
+		http.Error(w, ErrClientNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	recorder, err := m.startRecording(client)
+	switch {
+	case errors.Is(err, ErrRecordingDisabled), errors.Is(err, ErrClientNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrRecording):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.tellRecording(client, true)
+	m.audit(AuditEntry{
+		Action:     AuditRecordingStarted,
+		Actor:      "admin",
+		Target:     client.username,
+		RemoteAddr: r.RemoteAddr,
+		Details:    map[string]string{"client_id": client.id, "path": recorder.path},
+	})
+	writeJSON(w, http.StatusCreated, recorder.response(client))
+}
+
+// stopRecordingHandler stops recording the client
+func (m *Manager) stopRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := m.clientByID(r.PathValue("target"))
+	if !ok {
+		http.Error(w, ErrClientNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	recorder := client.stopRecording()
+	if recorder == nil {
+		http.Error(w, "the client is not recorded", http.StatusNotFound)
+		return
+	}
+
+	m.tellRecording(client, false)
+	response := recorder.response(client)
+	m.audit(AuditEntry{
+		Action:     AuditRecordingStopped,
+		Actor:      "admin",
+		Target:     client.username,
+		RemoteAddr: r.RemoteAddr,
+		Details:    map[string]string{"client_id": client.id, "records": strconv.Itoa(response.Records)},
+	})
+	writeJSON(w, http.StatusOK, response)
+}
+
+// PlaybackResult compares what a client received during playback with the recording
+type PlaybackResult struct {
+	// Sent is how many recorded events were sent again
+	Sent int `json:"sent"`
+	// Recorded and Received count the events written to the client by type, in
+	// the recording and in the playback
+	Recorded map[string]int `json:"recorded"`
+	Received map[string]int `json:"received"`
+	// Events are the events received during playback
+	Events []wstest.Event `json:"events"`
+}
+
+// readRecording reads the records of a recording
+func readRecording(recording io.Reader) ([]SessionRecord, error) {
+	var records []SessionRecord
+	scanner := bufio.NewScanner(recording)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReplayLine)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record SessionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d of the recording: %v", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// Playback connects a client for the user and sends the events the recorded
+// client sent, with the time between them divided by speed, 0 sends them right
+// away. It waits a little for the last responses before it disconnects
+func Playback(server *wstest.Server, username string, recording io.Reader, speed float64) (PlaybackResult, error) {
+	records, err := readRecording(recording)
+	if err != nil {
+		return PlaybackResult{}, err
+	}
+	result := PlaybackResult{Recorded: make(map[string]int), Received: make(map[string]int), Events: []wstest.Event{}}
+	for _, record := range records {
+		if record.Direction == RecordOutbound {
+			result.Recorded[record.Event.Type]++
+		}
+	}
+
+	client := server.Connect(username)
+	var sent atomic.Bool
+	received := make(chan []wstest.Event)
+	go func() {
+		var events []wstest.Event
+		for {
+			event, err := client.Receive(playbackSettle)
+			if errors.Is(err, ErrTransportTimeout) && !sent.Load() {
+				continue
+			}
+			if err != nil {
+				received <- events
+				return
+			}
+			events = append(events, event)
+		}
+	}()
+
+	var previous time.Time
+	for _, record := range records {
+		if record.Direction != RecordInbound {
+			continue
+		}
+		if speed > 0 && !previous.IsZero() {
+			time.Sleep(time.Duration(float64(record.Time.Sub(previous)) / speed))
+		}
+		previous = record.Time
+		if err := client.SendEvent(wstest.Event{ID: record.Event.ID, Type: record.Event.Type, Payload: record.Event.Payload}); err != nil {
+			client.Close()
+			<-received
+			return result, err
+		}
+		result.Sent++
+	}
+
+	// The reader stops once nothing arrived for playbackSettle
+	sent.Store(true)
+	events := <-received
+	client.Close()
+	for _, event := range events {
+		result.Received[event.Type]++
+	}
+	result.Events = append(result.Events, events...)
+	return result, nil
+}
+
+// runPlayback plays the recording back against a test server made from the config
+// and prints the result, for the -playback flag
+func runPlayback(w io.Writer, config Config, path, username string, speed float64) error {
+	if username == "" {
+		return errors.New("-playback-user is required")
+	}
+	recording, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer recording.Close()
+
+	server, _, err := NewTestServer(config)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	result, err := Playback(server, username, recording, speed)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
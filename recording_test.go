@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// callRecording calls the recording handlers like the admin API does
+func callRecording(m *Manager, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/admin/clients/"+target+"/recording", strings.NewReader(body))
+	r.SetPathValue("target", target)
+	w := httptest.NewRecorder()
+	if method == http.MethodDelete {
+		m.stopRecordingHandler(w, r)
+	} else {
+		m.startRecordingHandler(w, r)
+	}
+	return w
+}
+
+func TestRecordAndPlayBack(t *testing.T) {
+	defer func(settle time.Duration) { playbackSettle = settle }(playbackSettle)
+	playbackSettle = 100 * time.Millisecond
+
+	config := DefaultConfig()
+	config.Recording.Dir = t.TempDir()
+	server, m := newRoomTestServer(t, config)
+	alice := server.Connect("alice")
+
+	w := callRecording(m, http.MethodPost, alice.ID, `{"consent":true}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("starting the recording: %d %s", w.Code, w.Body)
+	}
+	var recording SessionRecordingEvent
+	if err := alice.ExpectPayload(EventSessionRecording, &recording, time.Second); err != nil || !recording.Recording {
+		t.Fatalf("alice wasn't told about the recording: %+v, %v", recording, err)
+	}
+	if w := callRecording(m, http.MethodPost, alice.ID, `{"consent":true}`); w.Code != http.StatusConflict {
+		t.Errorf("recording twice: %d, want %d", w.Code, http.StatusConflict)
+	}
+
+	if err := alice.Send(EventSendMessage, SendMessageEvent{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Expect(EventNewMessage, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	w = callRecording(m, http.MethodDelete, alice.ID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("stopping the recording: %d %s", w.Code, w.Body)
+	}
+	if w := callRecording(m, http.MethodDelete, alice.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("stopping a stopped recording: %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// The recording holds the message alice sent and what was written to the client of alice
+	paths, err := os.ReadDir(config.Recording.Dir)
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("recordings are %v, %v, want one", paths, err)
+	}
+	file, err := os.Open(filepath.Join(config.Recording.Dir, paths[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := readRecording(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	directions := map[string]int{}
+	for _, record := range records {
+		directions[record.Direction+" "+record.Event.Type]++
+	}
+	if directions[RecordInbound+" "+EventSendMessage] != 1 || directions[RecordOutbound+" "+EventNewMessage] != 1 {
+		t.Fatalf("recorded %v, want the message sent and received", directions)
+	}
+
+	// Playing it back against a new server sends the message again
+	playbackServer, _, err := NewTestServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer playbackServer.Close()
+	file.Seek(0, 0)
+	result, err := Playback(playbackServer, "alice", file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != 1 || result.Received[EventNewMessage] != result.Recorded[EventNewMessage] {
+		t.Errorf("playback sent %d events and received %v, recorded %v", result.Sent, result.Received, result.Recorded)
+	}
+}
+
+func TestRecordingErrors(t *testing.T) {
+	server, m := newRoomTestServer(t, DefaultConfig())
+	alice := server.Connect("alice")
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		body   string
+		want   int
+	}{
+		{"without consent", alice.ID, `{"consent":false}`, http.StatusBadRequest},
+		{"unknown client", "nobody", `{"consent":true}`, http.StatusNotFound},
+		{"recordings disabled", alice.ID, `{"consent":true}`, http.StatusNotFound},
+	} {
+		if w := callRecording(m, http.MethodPost, tc.target, tc.body); w.Code != tc.want {
+			t.Errorf("%s: %d %s, want %d", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+}
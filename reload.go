@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The config file can be reloaded while running, by changing the file, sending
+// SIGHUP or calling the admin API. Most settings are read from the current config
+// whenever they are used, so they apply right away. The settings used to set
+// things up at start are listed in restartFields, changing them is reported
+// but only applied after a restart.
+
+// configWatchInterval is how often the config file is checked for changes
+var configWatchInterval = 2 * time.Second
+
+// AuditConfigReload is recorded whenever the config is reloaded
+const AuditConfigReload = "config_reload"
+
+// restartFields are the json names of Config fields that only apply after a restart
+var restartFields = []string{"addr", "listeners", "base_path", "store_path", "database_url", "audit_log_path", "workers", "grpc", "notifications", "console_socket", "disable_frontend", "enable_compression", "buffers", "netpoll", "oidc", "bots", "ids", "http2"}
+
+// ReloadResult reports what a config reload changed
+type ReloadResult struct {
+	// Changed are the settings that changed and were applied
+	Changed []string `json:"changed"`
+	// RequiresRestart are the settings that changed but only apply after a restart
+	RequiresRestart []string `json:"requires_restart"`
+	// Kicked is the number of clients disconnected because their user got banned
+	Kicked int `json:"kicked"`
+}
+
+// diffConfig returns the json names of the top level fields that differ
+func diffConfig(old, new *Config) []string {
+	var changed []string
+	oldValue, newValue := reflect.ValueOf(*old), reflect.ValueOf(*new)
+	for i := range oldValue.NumField() {
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			name, _, _ := strings.Cut(reflect.TypeOf(*old).Field(i).Tag.Get("json"), ",")
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// reloadConfig loads the config file and swaps it in
+func (m *Manager) reloadConfig(path string) (ReloadResult, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	old := m.currentConfig.Swap(&config)
+
+	result := ReloadResult{Changed: []string{}, RequiresRestart: []string{}}
+	for _, field := range diffConfig(old, &config) {
+		if slices.Contains(restartFields, field) {
+			result.RequiresRestart = append(result.RequiresRestart, field)
+		} else {
+			result.Changed = append(result.Changed, field)
+		}
+	}
+
+	result.Kicked = m.kickBanned()
+
+	if len(result.RequiresRestart) > 0 {
+		log.Printf("config reloaded, these settings need a restart to apply: %v", result.RequiresRestart)
+	}
+	details, _ := json.Marshal(result)
+	m.audit(AuditEntry{Action: AuditConfigReload, Details: map[string]string{"result": string(details)}})
+	return result, nil
+}
+
+// isBanned returns true if the user is on the ban list of the config or banned in the store
+// Users are not considered banned when the store can't be reached
+func (m *Manager) isBanned(username string) bool {
+	if slices.Contains(m.config().BannedUsers, username) {
+		return true
+	}
+	banned, err := m.store.IsBanned(username)
+	if err != nil {
+		log.Printf("checking ban of %s: %v", username, err)
+	}
+	return banned
+}
+
+// kickBanned disconnects all clients of banned users and returns how many it kicked
+func (m *Manager) kickBanned() int {
+	bans := make(map[string]bool)
+	for _, username := range m.config().BannedUsers {
+		bans[username] = true
+	}
+	stored, err := m.store.ListBans()
+	if err != nil {
+		log.Printf("listing bans: %v", err)
+	}
+	for _, ban := range stored {
+		bans[ban.Username] = true
+	}
+
+	var banned []*Client
+	m.RLock()
+	for client := range m.clients {
+		if bans[client.username] {
+			banned = append(banned, client)
+		}
+	}
+	m.RUnlock()
+
+	for _, client := range banned {
+		m.removeClient(client)
+		m.audit(AuditEntry{Action: AuditKick, Target: client.username, Details: map[string]string{"client_id": client.id, "reason": "banned"}})
+	}
+	return len(banned)
+}
+
+// watchConfig reloads the config file when it changes or when SIGHUP is received
+// Is Blocking, so run as a Goroutine
+func (m *Manager) watchConfig(ctx context.Context, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	reload := func() {
+		if _, err := m.reloadConfig(path); err != nil {
+			log.Println("failed to reload config: ", err)
+		}
+	}
+
+	for {
+		select {
+		case <-hup:
+			reload()
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || !info.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reloadConfigHandler returns an admin handler reloading the config file at path
+func (m *Manager) reloadConfigHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if path == "" {
+			http.Error(w, "server was started without a config file", http.StatusConflict)
+			return
+		}
+
+		result, err := m.reloadConfig(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"arti.soft/websockets-go/wstest"
+)
+
+// Archived traffic can be replayed into a Manager to debug an incident or to
+// load test the handlers with realistic traffic. The archive is the JSON Lines
+// room export, one stored event per line, as written by GET
+// /admin/rooms/{room}/export or the file the export was saved to. There is no
+// Kafka sink, a topic dumped to JSON Lines in that format replays the same way.
+//
+// Every chat message is sent again by its author, through a replay client that is
+// connected to the Manager like any other client but has no network connection,
+// so it passes the same handlers, permissions and room rules. The time between
+// messages is kept, divided by the speed: 1 is the original speed, 10 ten times
+// faster and 0 as fast as possible. Other events, like member events, are
+// skipped, the handlers make them again where they belong.
+//
+//	websockets-go -config config.json -replay general.jsonl -replay-speed 10
+//	POST /admin/replay?speed=10&room=incident-42   with the archive as body
+//
+// The flag replays into a Manager of its own made from the config, the endpoint
+// into the running server. room sends everything to one room instead of the
+// rooms it was archived from, so a replay doesn't show up in real rooms.
+
+const (
+	AuditReplay = "replay"
+)
+
+// maxReplayLine is the longest line of an archive in bytes
+var maxReplayLine = 1 << 20
+
+// ReplayOptions say how an archive is replayed
+type ReplayOptions struct {
+	// Speed divides the time between messages, 0 replays as fast as possible
+	Speed float64
+	// Room is where all messages are sent, the archived room if empty
+	Room string
+}
+
+// ReplayReport is the outcome of a replay, and the response of POST /admin/replay
+type ReplayReport struct {
+	// Events is how many events the archive held
+	Events int `json:"events"`
+	// Replayed is how many chat messages were sent again
+	Replayed int `json:"replayed"`
+	// Skipped is how many events were not chat messages
+	Skipped int `json:"skipped"`
+	// Errors is how many messages the handlers refused
+	Errors int `json:"errors"`
+	// Clients is how many replay clients were connected, one per author
+	Clients  int      `json:"clients"`
+	Duration Duration `json:"duration"`
+}
+
+// replayClient sends the messages of one author
+type replayClient struct {
+	client *Client
+	// room is the room the client is in
+	room string
+}
+
+// connectReplayClient connects a client for the user without a network, the
+// events sent to it are read and thrown away
+func (m *Manager) connectReplayClient(username string) *replayClient {
+	server, peer := wstest.Pipe("")
+	client := NewClient(server, m, username)
+	m.startClient(client)
+	go func() {
+		for {
+			if _, _, err := peer.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return &replayClient{client: client}
+}
+
+// replayEvent runs the handler of the event for the replay client
+func (m *Manager) replayEvent(c *replayClient, eventType string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return m.reouteEvent(Event{Type: eventType, Payload: data}, c.client)
+}
+
+// replay reads the archive and sends its chat messages again, it stops early if
+// the context is canceled
+func (m *Manager) replay(ctx context.Context, archive io.Reader, options ReplayOptions) (report ReplayReport, err error) {
+	clients := make(map[string]*replayClient)
+	defer func() {
+		for _, c := range clients {
+			m.removeClient(c.client)
+		}
+	}()
+
+	start := time.Now()
+	defer func() { report.Duration = Duration(time.Since(start)) }()
+
+	var first time.Time
+	scanner := bufio.NewScanner(archive)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReplayLine)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var msg StoredMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return report, fmt.Errorf("line %d of the archive: %v", report.Events+1, err)
+		}
+		report.Events++
+
+		var chat NewMessageEvent
+		if msg.Event.Type != EventNewMessage || json.Unmarshal(msg.Event.Payload, &chat) != nil || chat.From == "" {
+			report.Skipped++
+			continue
+		}
+
+		// Wait until the message is due, relative to the first one
+		if first.IsZero() {
+			first = msg.Sent
+		}
+		if options.Speed > 0 {
+			due := start.Add(time.Duration(float64(msg.Sent.Sub(first)) / options.Speed))
+			select {
+			case <-ctx.Done():
+				return report, ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		} else if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		c, ok := clients[chat.From]
+		if !ok {
+			c = m.connectReplayClient(chat.From)
+			clients[chat.From] = c
+			report.Clients++
+		}
+		room := msg.Room
+		if options.Room != "" {
+			room = options.Room
+		}
+		if c.room != room {
+			if err := m.replayEvent(c, EventJoinRoom, JoinRoomEvent{Room: room}); err != nil {
+				report.Errors++
+				continue
+			}
+			c.room = room
+		}
+
+		// Actions are sent as the /me command they were made with
+		message := chat.Message
+		if chat.Action {
+			message = "/me " + message
+		}
+		if err := m.replayEvent(c, EventSendMessage, SendMessageEvent{Message: message, Mentions: chat.Mentions}); err != nil {
+			report.Errors++
+			continue
+		}
+		report.Replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return report, fmt.Errorf("reading the archive: %v", err)
+	}
+	return report, nil
+}
+
+// replayHandler replays the archive in the body, like
+// POST /admin/replay?speed=10&room=incident-42
+func (m *Manager) replayHandler(w http.ResponseWriter, r *http.Request) {
+	options := ReplayOptions{Speed: 1, Room: r.URL.Query().Get("room")}
+	if value := r.URL.Query().Get("speed"); value != "" {
+		speed, err := strconv.ParseFloat(value, 64)
+		if err != nil || speed < 0 {
+			http.Error(w, "speed must be a number of at least 0", http.StatusBadRequest)
+			return
+		}
+		options.Speed = speed
+	}
+	if options.Room != "" {
+		if err := validateRoomName(options.Room); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := m.replay(r.Context(), r.Body, options)
+	m.audit(AuditEntry{
+		Action:     AuditReplay,
+		Actor:      "admin",
+		Target:     options.Room,
+		RemoteAddr: r.RemoteAddr,
+		Details:    map[string]string{"speed": strconv.FormatFloat(options.Speed, 'g', -1, 64), "replayed": strconv.Itoa(report.Replayed)},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// runReplay replays the archive file into a Manager made from the config and
+// prints the report, for the -replay flag
+func runReplay(w io.Writer, config Config, path string, options ReplayOptions) error {
+	archive, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, err := NewManager(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	report, err := m.replay(ctx, archive, options)
+	if err != nil {
+		return err
+	}
+	log.Printf("replayed %s", path)
+	return json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// archiveLine returns the line of a JSON Lines archive for the event
+func archiveLine(t *testing.T, room, eventType string, payload any, sent time.Time) string {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := json.Marshal(StoredMessage{Room: room, Event: Event{Type: eventType, Payload: data}, Sent: sent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(line)
+}
+
+func TestReplayIntoARoom(t *testing.T) {
+	server, m := newRoomTestServer(t, DefaultConfig())
+	start := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	archive := strings.Join([]string{
+		archiveLine(t, defaultRoom, EventNewMessage, NewMessageEvent{SendMessageEvent: SendMessageEvent{Message: "hello", From: "alice"}}, start),
+		archiveLine(t, defaultRoom, EventMemberJoined, map[string]string{"username": "bob"}, start.Add(time.Second)),
+		"",
+		archiveLine(t, defaultRoom, EventNewMessage, NewMessageEvent{SendMessageEvent: SendMessageEvent{Message: "hi", From: "bob"}}, start.Add(time.Minute)),
+		archiveLine(t, defaultRoom, EventNewMessage, NewMessageEvent{SendMessageEvent: SendMessageEvent{Message: "waves", From: "alice", Action: true}}, start.Add(time.Hour)),
+	}, "\n")
+
+	watcher := server.Connect("olivia")
+	if err := routeAs(t, m, watcher, EventJoinRoom, JoinRoomEvent{Room: "incident-42"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An hour of traffic replays right away at speed 0
+	report, err := m.replay(context.Background(), strings.NewReader(archive), ReplayOptions{Room: "incident-42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReplayReport{Events: 4, Replayed: 3, Skipped: 1, Clients: 2}
+	report.Duration = 0
+	if report != want {
+		t.Errorf("report is %+v, want %+v", report, want)
+	}
+	for _, want := range []NewMessageEvent{
+		{SendMessageEvent: SendMessageEvent{Message: "hello", From: "alice"}},
+		{SendMessageEvent: SendMessageEvent{Message: "hi", From: "bob"}},
+		{SendMessageEvent: SendMessageEvent{Message: "waves", From: "alice", Action: true}},
+	} {
+		var msg NewMessageEvent
+		if err := watcher.ExpectPayload(EventNewMessage, &msg, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if msg.From != want.From || msg.Message != want.Message || msg.Action != want.Action {
+			t.Errorf("replayed %+v, want %+v", msg.SendMessageEvent, want.SendMessageEvent)
+		}
+	}
+
+	// The replay clients are gone once it is done
+	m.RLock()
+	clients := len(m.clients)
+	m.RUnlock()
+	if clients != 1 {
+		t.Errorf("%d clients are connected after the replay, want the watcher only", clients)
+	}
+}
+
+func TestReplayPassesTheRoomRules(t *testing.T) {
+	_, m := newRoomTestServer(t, DefaultConfig())
+	start := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	archive := strings.Join([]string{
+		archiveLine(t, "secret", EventNewMessage, NewMessageEvent{SendMessageEvent: SendMessageEvent{Message: "let me in", From: "mallory"}}, start),
+		archiveLine(t, "secret", EventNewMessage, NewMessageEvent{SendMessageEvent: SendMessageEvent{Message: "welcome", From: "carol"}}, start),
+	}, "\n")
+
+	report, err := m.replay(context.Background(), strings.NewReader(archive), ReplayOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Replayed != 1 || report.Errors != 1 {
+		t.Errorf("report is %+v, want the message of carol replayed and the one of mallory refused", report)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	_, m := newRoomTestServer(t, DefaultConfig())
+	if _, err := m.replay(context.Background(), strings.NewReader("{\"room\":"), ReplayOptions{}); err == nil {
+		t.Error("an invalid archive was replayed")
+	}
+
+	// A canceled replay stops while it waits for the next message
+	start := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	archive := strings.Join([]string{
+		archiveLine(t, defaultRoom, EventNewMessage, NewMessageEvent{SendMessageEvent: SendMessageEvent{Message: "now", From: "alice"}}, start),
+		archiveLine(t, defaultRoom, EventNewMessage, NewMessageEvent{SendMessageEvent: SendMessageEvent{Message: "in an hour", From: "alice"}}, start.Add(time.Hour)),
+	}, "\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := m.replay(ctx, strings.NewReader(archive), ReplayOptions{Speed: 1})
+	if !errors.Is(err, context.DeadlineExceeded) || report.Replayed != 1 {
+		t.Errorf("canceled replay: %+v, %v, want one message replayed and %v", report, err, context.DeadlineExceeded)
+	}
+}
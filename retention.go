@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Messages are deleted from the store once they are older than the retention of
+// their room, or once the room has more than its max messages. Rooms without
+// their own settings use the retention of the config. A janitor goroutine
+// enforces it, operators can also purge a room with the admin API.
+
+// retentionPolicy returns the max age and count of messages kept in the room,
+// zero means no limit
+func (m *Manager) retentionPolicy(room Room) (time.Duration, int) {
+	global := m.config().Rooms.Retention
+
+	maxAge := time.Duration(room.Retention)
+	if maxAge == 0 {
+		maxAge = time.Duration(global.MaxAge)
+	}
+	maxCount := room.MaxMessages
+	if maxCount == 0 {
+		maxCount = global.MaxCount
+	}
+	return maxAge, maxCount
+}
+
+// runRetention enforces the retention of all rooms periodically
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runRetention(ctx context.Context) {
+	for {
+		// The interval is read every time so a config reload applies to the next run
+		interval := time.Duration(m.config().Rooms.RetentionInterval)
+		if interval <= 0 {
+			interval = time.Minute
+		}
+
+		select {
+		case <-time.After(interval):
+			m.enforceRetention(m.now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// enforceRetention deletes the messages that are past the retention of their room at now
+func (m *Manager) enforceRetention(now time.Time) {
+	rooms, err := m.store.ListRooms()
+	if err != nil {
+		log.Println("listing rooms for retention: ", err)
+		return
+	}
+
+	for _, room := range rooms {
+		maxAge, maxCount := m.retentionPolicy(room)
+		if maxAge == 0 && maxCount == 0 {
+			continue
+		}
+
+		var before time.Time
+		if maxAge > 0 {
+			before = now.Add(-maxAge)
+		}
+		keep := -1
+		if maxCount > 0 {
+			keep = maxCount
+		}
+
+		purged, err := m.purgeRoom(room.Name, before, keep)
+		if err != nil {
+			log.Printf("enforcing retention of room %s: %v", room.Name, err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("retention deleted %d messages of room %s", purged, room.Name)
+		}
+	}
+}
+
+// purgeRoom deletes the messages of the room sent before the time and all but the
+// latest keep ones, see MessageStore.PurgeMessages. The deleted events are also
+// dropped from the history replayed to clients
+func (m *Manager) purgeRoom(name string, before time.Time, keep int) (int, error) {
+	purged, lastSeq, err := m.store.PurgeMessages(name, before, keep)
+	if err != nil || purged == 0 {
+		return purged, err
+	}
+	m.quotas.forgetStorage(name)
+	m.uncacheRoom(name)
+
+	// Rooms that were not used since the start have no history in memory
+	m.roomsLock.Lock()
+	r, ok := m.rooms[name]
+	m.roomsLock.Unlock()
+	if !ok {
+		return purged, nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	// The history holds the events numbered seq-len(history)+1 up to seq
+	first := r.seq - uint64(len(r.history)) + 1
+	if lastSeq >= first {
+		drop := min(lastSeq-first+1, uint64(len(r.history)))
+		r.history = append([]Event{}, r.history[drop:]...)
+	}
+	return purged, nil
+}
+
+// purgeRequest is the body of POST /admin/rooms/{room}/purge, an empty body deletes all messages
+type purgeRequest struct {
+	// OlderThan deletes the messages older than it
+	OlderThan Duration `json:"older_than"`
+	// Keep only keeps the latest messages
+	Keep *int `json:"keep"`
+}
+
+// purgeHandler deletes messages of a room, like {"older_than":"720h"} or {"keep":100}
+func (m *Manager) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+
+	var req purgeRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.OlderThan < 0 || (req.Keep != nil && *req.Keep < 0) {
+		http.Error(w, "older_than and keep can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	var before time.Time
+	if req.OlderThan > 0 {
+		before = m.now().Add(-time.Duration(req.OlderThan))
+	}
+	keep := -1
+	switch {
+	case req.Keep != nil:
+		keep = *req.Keep
+	case req.OlderThan == 0:
+		// Nothing given, everything goes
+		keep = 0
+	}
+
+	purged, err := m.purgeRoom(room, before, keep)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.audit(AuditEntry{Action: AuditPurge, Actor: "admin", Target: room, Details: map[string]string{"purged": strconv.Itoa(purged)}})
+	writeJSON(w, http.StatusOK, struct {
+		Purged int `json:"purged"`
+	}{Purged: purged})
+}
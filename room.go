@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every event broadcast to a room gets the next sequence number of that room,
+// added to its payload as "seq". Clients that see a gap in the numbers can ask
+// for the events they missed with get_history, the latest events of each room
+// are kept for that.
+
+// roomHistorySize is how many events are kept per room for replay
+var roomHistorySize = 100
+
+// maxRoomNameLength is the longest room name in bytes, every room costs
+// memory for its history so names are kept short
+var maxRoomNameLength = 64
+
+// validateRoomName returns an error if the room name can't be used
+func validateRoomName(room string) error {
+	if room == "" {
+		return ErrInvalidRoom
+	}
+	if len(room) > maxRoomNameLength {
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidRoom, maxRoomNameLength)
+	}
+	return nil
+}
+
+const (
+	// EventGetHistory is sent by a client to replay the events of a room after a sequence number
+	EventGetHistory = "get_history"
+	// EventHistory is the response to get_history
+	EventHistory = "history"
+)
+
+// GetHistoryEvent is the payload sent in the
+// get_history event
+type GetHistoryEvent struct {
+	// Room defaults to the room of the client
+	Room string `json:"room,omitempty"`
+	// Since is the last sequence number the client received, events after it are returned
+	Since uint64 `json:"since"`
+}
+
+// HistoryEvent is returned when responding to get_history
+type HistoryEvent struct {
+	Room   string  `json:"room"`
+	Events []Event `json:"events"`
+	// Complete is false if events after Since are no longer kept, the client missed some for good
+	Complete bool `json:"complete"`
+	// Reactions are the reaction counts of the messages in Events, keyed by message id
+	Reactions map[string]map[string]int `json:"reactions,omitempty"`
+}
+
+// roomState holds the sequence counter and recent history of a room
+type roomState struct {
+	// The lock is held while an event is numbered and queued, so every client
+	// receives the events of a room in sequence order
+	sync.Mutex
+	seq     uint64
+	history []Event
+	// lastActive is when an event was last sent to the room or a client joined it
+	lastActive time.Time
+	// e2ee and owner are copied from the stored room, so messages don't need a store lookup
+	e2ee  bool
+	owner string
+	// epoch is the epoch of the cluster ring the room was last numbered in, see cluster.go
+	epoch uint64
+}
+
+// room returns the state of the room, creating it if needed
+func (m *Manager) room(name string) *roomState {
+	m.roomsLock.Lock()
+
+	r, ok := m.rooms[name]
+	if ok {
+		m.roomsLock.Unlock()
+		return r
+	}
+
+	// The room is locked until its history is loaded, so the store is not
+	// queried while holding the lock of all rooms
+	r = &roomState{lastActive: m.now()}
+	r.Lock()
+	defer r.Unlock()
+	m.rooms[name] = r
+	m.roomsLock.Unlock()
+
+	m.loadRoom(name, r)
+	return r
+}
+
+// loadRoom restores the sequence number and history of a room from the store, so
+// numbering continues where it stopped before a restart
+// It records the room in the store the first time it is used
+// Only call it while holding the room lock
+func (m *Manager) loadRoom(name string, r *roomState) {
+	room, err := m.store.GetRoom(name)
+	if errors.Is(err, ErrNotFound) {
+		if err := m.store.SaveRoom(Room{Name: name, Created: m.now()}); err != nil {
+			log.Printf("saving room %s: %v", name, err)
+		}
+		return
+	} else if err != nil {
+		log.Printf("loading room %s: %v", name, err)
+		return
+	}
+	r.e2ee = room.E2EE
+	r.owner = room.Owner
+	if room.ArchivedAt != nil {
+		m.unarchiveRoom(room)
+	}
+
+	messages, err := m.latestMessages(name, roomHistorySize)
+	if err != nil {
+		log.Printf("loading history of room %s: %v", name, err)
+		return
+	}
+	restoreHistory(r, messages)
+}
+
+// restoreHistory replaces the sequence number and history of the room with the
+// stored messages, oldest first
+// Only call it while holding the room lock
+func restoreHistory(r *roomState, messages []StoredMessage) {
+	if len(messages) == 0 {
+		return
+	}
+
+	// The history has to be contiguous, only the messages after the last gap are kept
+	r.seq = messages[len(messages)-1].Seq
+	r.history = nil
+	first := len(messages) - 1
+	for first > 0 && messages[first-1].Seq == messages[first].Seq-1 {
+		first--
+	}
+	for _, msg := range messages[first:] {
+		r.history = append(r.history, msg.Event)
+	}
+}
+
+// withSeq adds the sequence number to a JSON object payload, replacing a seq the
+// sender put in it, the other keys keep their order
+// Payloads that are not objects are returned as is
+func withSeq(payload json.RawMessage, seq uint64) json.RawMessage {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return payload
+	}
+
+	b := []byte(`{"seq":` + strconv.FormatUint(seq, 10))
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return payload
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return payload
+		}
+		// Clients could otherwise send a seq that readers take instead of ours
+		key, _ := tok.(string)
+		if key == "seq" {
+			continue
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return payload
+		}
+		b = append(append(append(append(b, ','), name...), ':'), value...)
+	}
+	return append(b, '}')
+}
+
+// broadcastToRoom numbers the event and sends it to all clients in the room,
+// it returns how many clients it was queued for
+// The event is stored with the id, which may be empty for events other than messages
+// In a cluster the event is numbered by the instance owning the room, see cluster.go
+func (m *Manager) broadcastToRoom(room, id string, event Event) int {
+	if m.cluster != nil {
+		if node := m.cluster.owner(room); node != m.cluster.self {
+			delivered, err := m.forwardRoomEvent(node, room, id, event)
+			if err == nil {
+				return delivered
+			}
+			// The room moves to another instance, which may be this one
+			log.Printf("cluster: forwarding to %s, the owner of room %s: %v", node, room, err)
+			m.cluster.markDown(node)
+			return m.broadcastToRoom(room, id, event)
+		}
+	}
+	return m.numberRoomEvent(room, id, event)
+}
+
+// numberRoomEvent numbers the event and sends it to all clients in the room, and
+// to the other instances of the cluster
+func (m *Manager) numberRoomEvent(room, id string, event Event) int {
+	r := m.room(room)
+	r.Lock()
+	if m.cluster != nil {
+		m.takeOverRoom(room, r)
+	}
+
+	r.seq++
+	seq := r.seq
+	event.Payload = withSeq(event.Payload, seq)
+	event.Room = room
+	r.lastActive = m.now()
+
+	r.history = append(r.history, event)
+	if len(r.history) > roomHistorySize {
+		r.history = r.history[len(r.history)-roomHistorySize:]
+	}
+
+	m.RLock()
+	prepared := prepare(event)
+	delivered := 0
+	for client := range m.members[room] {
+		if client.send(prepared) {
+			delivered++
+		}
+	}
+	m.RUnlock()
+	// The event is queued for the other instances while the room is locked, so they
+	// get the events of the room in order, their answers are waited for once it isn't
+	remote := func() int { return 0 }
+	if m.cluster != nil {
+		remote = m.cluster.fanOut(roomDeliverPath(room), clusterEvent{Seq: seq, Event: event})
+	}
+	r.Unlock()
+
+	// Persisting is done outside the room lock, a slow store doesn't hold up the room
+	msg := StoredMessage{ID: id, Room: room, Seq: seq, Event: event, Sent: m.now()}
+	if err := m.store.AppendMessage(msg); err != nil {
+		log.Printf("storing message %d of room %s: %v", seq, room, err)
+	} else {
+		m.quotas.stored(room, len(event.Payload))
+		m.cacheMessage(msg)
+	}
+	return delivered + remote()
+}
+
+// sendToRoom sends the event to all clients in the room without numbering it, for
+// events that are not kept in the history
+// In a cluster the clients in the room on other instances get it too, they are not counted
+func (m *Manager) sendToRoom(room string, event Event) int {
+	if m.cluster != nil {
+		m.cluster.fanOut(roomDeliverPath(room), clusterEvent{Event: event})
+	}
+	return m.deliverToRoom(room, event)
+}
+
+// deliverToRoom sends the event to the clients in the room on this instance
+func (m *Manager) deliverToRoom(room string, event Event) int {
+	if key, sender, ok := m.ephemeralKey(event); ok {
+		return m.deliverEphemeral(room, event, key, sender)
+	}
+	m.RLock()
+	defer m.RUnlock()
+
+	prepared := prepare(event)
+	delivered := 0
+	for client := range m.members[room] {
+		if client.send(prepared) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// indexClient adds the client to the members of its room
+// Only call it while holding the manager write lock
+func (m *Manager) indexClient(client *Client) {
+	members, ok := m.members[client.room]
+	if !ok {
+		members = make(ClientList)
+		m.members[client.room] = members
+	}
+	members[client] = true
+	if m.raft != nil {
+		m.raft.markChanged()
+	}
+}
+
+// unindexClient removes the client from the members of its room
+// Only call it while holding the manager write lock
+func (m *Manager) unindexClient(client *Client) {
+	members := m.members[client.room]
+	delete(members, client)
+	if len(members) == 0 {
+		delete(m.members, client.room)
+	}
+	if m.raft != nil {
+		m.raft.markChanged()
+	}
+}
+
+// moveClient changes the room of the client, keeping the members index up to date
+// Only call it while holding the manager write lock
+func (m *Manager) moveClient(client *Client, room string) {
+	_, connected := m.clients[client]
+	if connected {
+		m.unindexClient(client)
+	}
+	client.room = room
+	if connected {
+		m.indexClient(client)
+	}
+}
+
+// roomOf returns the room the client is in
+func (m *Manager) roomOf(client *Client) string {
+	m.RLock()
+	defer m.RUnlock()
+	return client.room
+}
+
+// historySince returns the events of the room numbered after since, and false if
+// some of them are no longer kept
+func (m *Manager) historySince(room string, since uint64) ([]Event, bool) {
+	r := m.room(room)
+	r.Lock()
+	defer r.Unlock()
+
+	// The history holds the events numbered seq-len(history)+1 up to seq
+	first := r.seq - uint64(len(r.history)) + 1
+	if since >= r.seq {
+		return []Event{}, true
+	}
+	if since+1 < first {
+		return append([]Event{}, r.history...), false
+	}
+	return append([]Event{}, r.history[since+1-first:]...), true
+}
+
+// GetHistoryHandler replays the events of a room the client missed
+func GetHistoryHandler(event Event, c *Client) error {
+	var req GetHistoryEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if req.Room == "" {
+		req.Room = c.manager.roomOf(c)
+	}
+	if err := validateRoomName(req.Room); err != nil {
+		return err
+	}
+	// Rooms that don't exist are not found, reading must not create them
+	if err := c.manager.checkRoomAccess(c, req.Room); err != nil {
+		return err
+	}
+
+	events, complete := c.manager.historySince(req.Room, req.Since)
+	return c.manager.replyJSON(c, EventHistory, HistoryEvent{
+		Room:      req.Room,
+		Events:    events,
+		Complete:  complete,
+		Reactions: c.manager.historyReactions(req.Room, len(events)),
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithSeq(t *testing.T) {
+	for _, tc := range []struct {
+		payload, want string
+	}{
+		{`{}`, `{"seq":7}`},
+		{` { } `, `{"seq":7}`},
+		{`{"message":"hi","from":"alice"}`, `{"seq":7,"message":"hi","from":"alice"}`},
+		// A seq of the sender is replaced, however it is spelled
+		{`{"seq":1,"message":"hi"}`, `{"seq":7,"message":"hi"}`},
+		{`{"message":"hi","seq":"1"}`, `{"seq":7,"message":"hi"}`},
+		{`{"seq":1}`, `{"seq":7}`},
+		{`{"seq":1,"seq":2}`, `{"seq":7}`},
+		// Only the top level is numbered
+		{`{"reply":{"seq":1}}`, `{"seq":7,"reply":{"seq":1}}`},
+		{`[1,2]`, `[1,2]`},
+		{`"text"`, `"text"`},
+		{``, ``},
+	} {
+		got := withSeq(json.RawMessage(tc.payload), 7)
+		if string(got) != tc.want {
+			t.Errorf("withSeq(%s) = %s, want %s", tc.payload, got, tc.want)
+		}
+	}
+}
+
+func TestWithSeqDecodesToOneSeq(t *testing.T) {
+	var event struct {
+		Seq uint64 `json:"seq"`
+	}
+	if err := json.Unmarshal(withSeq(json.RawMessage(`{"message":"hi","seq":99}`), 7), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Seq != 7 {
+		t.Errorf("seq is %d, want 7", event.Seq)
+	}
+}
+
+func TestGetHistoryDoesNotCreateRooms(t *testing.T) {
+	config := DefaultConfig()
+	config.Operators = []string{"olivia"}
+	server, m, err := NewTestServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Operators pass the visibility check, they still can't create rooms by reading
+	for _, username := range []string{"bob", "olivia"} {
+		client := server.Connect(username)
+		err := routeAs(t, m, client, EventGetHistory, GetHistoryEvent{Room: "nowhere-" + username})
+		if !errors.Is(err, ErrRoomNotFound) {
+			t.Errorf("history of an unknown room for %s: %v, want %v", username, err, ErrRoomNotFound)
+		}
+		if _, err := m.store.GetRoom("nowhere-" + username); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the room of %s was stored: %v", username, err)
+		}
+		m.roomsLock.Lock()
+		_, ok := m.rooms["nowhere-"+username]
+		m.roomsLock.Unlock()
+		if ok {
+			t.Errorf("the room of %s is kept in memory", username)
+		}
+	}
+
+	bob := server.Connect("bob")
+	long := strings.Repeat("r", maxRoomNameLength+1)
+	if err := routeAs(t, m, bob, EventGetHistory, GetHistoryEvent{Room: long}); !errors.Is(err, ErrInvalidRoom) {
+		t.Errorf("history of a too long room name: %v, want %v", err, ErrInvalidRoom)
+	}
+}
+
+// assertMembersIndex checks that the members of every room are the clients in it,
+// and that rooms without clients are dropped from the index
+func assertMembersIndex(t *testing.T, m *Manager, step string) {
+	t.Helper()
+	m.RLock()
+	defer m.RUnlock()
+
+	want := make(map[string]int)
+	for client := range m.clients {
+		want[client.room]++
+		if !m.members[client.room][client] {
+			t.Errorf("%s: client of %s is in %s but not in its members", step, client.username, client.room)
+		}
+	}
+	for room, members := range m.members {
+		if len(members) != want[room] {
+			t.Errorf("%s: %s has %d members, %d clients are in it", step, room, len(members), want[room])
+		}
+		for client := range members {
+			if _, ok := m.clients[client]; !ok || client.room != room {
+				t.Errorf("%s: %s has a member that isn't a client in it", step, room)
+			}
+		}
+	}
+}
+
+func TestMembersIndex(t *testing.T) {
+	server, m, err := NewTestServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	alice := server.Connect("alice")
+	bob := server.Connect("bob")
+	carol := server.Connect("carol")
+	assertMembersIndex(t, m, "connect")
+
+	if err := routeAs(t, m, alice, EventJoinRoom, JoinRoomEvent{Room: "design"}); err != nil {
+		t.Fatal(err)
+	}
+	assertMembersIndex(t, m, "join")
+	if err := routeAs(t, m, bob, EventSwitchRoom, SwitchRoomEvent{Room: "design"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := routeAs(t, m, carol, EventSwitchRoom, SwitchRoomEvent{Room: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	assertMembersIndex(t, m, "switch")
+
+	// Leaving is joining another room, the last one out drops the room from the index
+	if err := routeAs(t, m, alice, EventJoinRoom, JoinRoomEvent{Room: defaultRoom}); err != nil {
+		t.Fatal(err)
+	}
+	if err := routeAs(t, m, bob, EventJoinRoom, JoinRoomEvent{Room: defaultRoom}); err != nil {
+		t.Fatal(err)
+	}
+	assertMembersIndex(t, m, "leave")
+	m.RLock()
+	_, indexed := m.members["design"]
+	m.RUnlock()
+	if indexed {
+		t.Error("design has no clients left but is still indexed")
+	}
+
+	c, _ := m.clientByID(carol.ID)
+	carol.Close()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, connected := m.clientByID(carol.ID); !connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("carol is still connected")
+		}
+	}
+	assertMembersIndex(t, m, "disconnect")
+	m.RLock()
+	_, indexed = m.members["ops"]
+	m.RUnlock()
+	if indexed {
+		t.Error("ops has no clients left but is still indexed")
+	}
+
+	// A client that is gone is not indexed again by moving it
+	m.Lock()
+	m.moveClient(c, "design")
+	m.Unlock()
+	assertMembersIndex(t, m, "move after disconnect")
+}
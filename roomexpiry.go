@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// Ephemeral rooms are closed by the server, either after nothing happened in them
+// for their idle timeout or at the time set with a TTL. Closing a room moves its
+// members back to the default room with a room_closed event and deletes the room
+// with its history from the store. Like the OTP retention, a ticker goroutine
+// checks the rooms.
+
+const (
+	// EventRoomClosed is sent to the members of a room before they are moved out of it
+	EventRoomClosed = "room_closed"
+)
+
+const (
+	RoomClosedIdle    = "idle"
+	RoomClosedExpired = "expired"
+)
+
+// roomExpiryInterval is how often the ephemeral rooms are checked
+var roomExpiryInterval = 5 * time.Second
+
+// RoomClosedEvent is the payload sent in the
+// room_closed event
+type RoomClosedEvent struct {
+	Room string `json:"room"`
+	// Reason is either idle or expired
+	Reason string `json:"reason"`
+	// MovedTo is the room the members were moved to
+	MovedTo string `json:"moved_to"`
+}
+
+// touchRoom marks the room as active, so it isn't closed for being idle
+func (m *Manager) touchRoom(name string) {
+	r := m.room(name)
+	r.Lock()
+	r.lastActive = m.now()
+	r.Unlock()
+}
+
+// roomLastActive returns when the room was last active, rooms not used since the
+// server started count from the time they are first looked at
+func (m *Manager) roomLastActive(name string) time.Time {
+	r := m.room(name)
+	r.Lock()
+	defer r.Unlock()
+	return r.lastActive
+}
+
+// runRoomExpiry closes the ephemeral rooms that are idle or expired
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runRoomExpiry(ctx context.Context) {
+	ticker := time.NewTicker(roomExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.expireRooms(m.now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expireRooms closes the ephemeral rooms that are due at now
+func (m *Manager) expireRooms(now time.Time) {
+	rooms, err := m.store.ListRooms()
+	if err != nil {
+		log.Println("listing rooms to expire: ", err)
+		return
+	}
+
+	for _, room := range rooms {
+		if !room.Ephemeral || room.Name == defaultRoom {
+			continue
+		}
+
+		reason := ""
+		idleTimeout := time.Duration(room.IdleTimeout)
+		if idleTimeout == 0 {
+			idleTimeout = time.Duration(m.config().Rooms.EphemeralIdleTimeout)
+		}
+		switch {
+		case room.ExpiresAt != nil && !now.Before(*room.ExpiresAt):
+			reason = RoomClosedExpired
+		case idleTimeout > 0 && now.Sub(m.roomLastActive(room.Name)) >= idleTimeout:
+			reason = RoomClosedIdle
+		default:
+			continue
+		}
+
+		if err := m.closeRoom(room.Name, reason); err != nil {
+			log.Printf("closing room %s: %v", room.Name, err)
+		}
+	}
+}
+
+// closeRoom moves the members of the room to the default room and deletes the
+// room with its history
+func (m *Manager) closeRoom(name, reason string) error {
+	// An update of the settings can't race with the room going away
+	m.roomSettingsLock.Lock()
+	defer m.roomSettingsLock.Unlock()
+
+	data, err := json.Marshal(RoomClosedEvent{Room: name, Reason: reason, MovedTo: defaultRoom})
+	if err != nil {
+		return err
+	}
+	closed := Event{Type: EventRoomClosed, Payload: data}
+
+	// The room lock keeps events from being sent to the room while it is emptied
+	r := m.room(name)
+	r.Lock()
+	m.Lock()
+	var members []*Client
+	for client := range m.members[name] {
+		members = append(members, client)
+	}
+	for _, client := range members {
+		client.send(closed)
+		m.moveClient(client, defaultRoom)
+	}
+	m.Unlock()
+
+	m.roomsLock.Lock()
+	delete(m.rooms, name)
+	m.roomsLock.Unlock()
+
+	err = m.store.DeleteRoom(name)
+	r.Unlock()
+	m.quotas.forgetStorage(name)
+	m.uncacheRoom(name)
+	m.dropRoomStates(name)
+	m.dropRoomDocs(name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	log.Printf("closed room %s (%s), %d clients moved to %s", name, reason, len(members), defaultRoom)
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Clients find rooms with list_rooms instead of knowing their names up front.
+// Public and invite-only rooms are listed with their topic and member count,
+// private rooms are never listed. The list is ordered by name and paged with the
+// name of the last room of the previous page.
+
+const (
+	// EventListRooms is sent by a client to browse the rooms
+	EventListRooms = "list_rooms"
+	// EventRoomList is the response to list_rooms
+	EventRoomList = "room_list"
+)
+
+var (
+	// defaultRoomListLimit is the page size when the client doesn't ask for one
+	defaultRoomListLimit = 50
+	// maxRoomListLimit is the largest page a client can ask for
+	maxRoomListLimit = 200
+)
+
+// ListRoomsEvent is the payload sent in the
+// list_rooms event
+type ListRoomsEvent struct {
+	// Query only returns the rooms whose name or topic contains it, ignoring case
+	Query string `json:"query,omitempty"`
+	// After is the Next of the previous page, empty for the first page
+	After string `json:"after,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// RoomListEvent is the payload sent in the
+// room_list event
+type RoomListEvent struct {
+	Rooms []RoomInfo `json:"rooms"`
+	// Next is set if there are more rooms, it is sent as After to get them
+	Next string `json:"next,omitempty"`
+}
+
+// listRooms returns a page of the listed rooms matching the request, allowed
+// filters out the rooms the caller can't use
+func (m *Manager) listRooms(req ListRoomsEvent, allowed func(room string) bool) (RoomListEvent, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultRoomListLimit
+	}
+	limit = min(limit, maxRoomListLimit)
+	query := strings.ToLower(req.Query)
+
+	rooms, err := m.store.ListRooms()
+	if err != nil {
+		return RoomListEvent{}, err
+	}
+
+	list := RoomListEvent{Rooms: []RoomInfo{}}
+	for _, room := range rooms {
+		if room.Name <= req.After || room.visibility() == VisibilityPrivate || !allowed(room.Name) {
+			continue
+		}
+		if query != "" && !strings.Contains(strings.ToLower(room.Name), query) && !strings.Contains(strings.ToLower(room.Topic), query) {
+			continue
+		}
+		if len(list.Rooms) == limit {
+			list.Next = list.Rooms[len(list.Rooms)-1].Name
+			break
+		}
+		list.Rooms = append(list.Rooms, newRoomInfo(room))
+	}
+
+	// The counts are taken at once, so a page doesn't lock the manager per room
+	m.RLock()
+	for i := range list.Rooms {
+		list.Rooms[i].Members = m.countMembers(list.Rooms[i].Name)
+	}
+	m.RUnlock()
+	return list, nil
+}
+
+// ListRoomsHandler answers with a page of the rooms the client can see
+func ListRoomsHandler(event Event, c *Client) error {
+	var req ListRoomsEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	list, err := c.manager.listRooms(req, c.allowedRoom)
+	if err != nil {
+		return err
+	}
+	return c.manager.replyJSON(c, EventRoomList, list)
+}
+
+// listRoomsHandler is the REST version of list_rooms, like GET /api/rooms?query=go&after=general&limit=20
+func (m *Manager) listRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	req := ListRoomsEvent{
+		Query: r.URL.Query().Get("query"),
+		After: r.URL.Query().Get("after"),
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, "limit must be a number", http.StatusBadRequest)
+			return
+		}
+		req.Limit = n
+	}
+
+	// API keys only see the rooms they are limited to
+	allowed := func(string) bool { return true }
+	if key, ok := requestAPIKey(r); ok {
+		allowed = key.allowsRoom
+	}
+
+	list, err := m.listRooms(req, allowed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
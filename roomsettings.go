@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+	"unicode/utf8"
+)
+
+// Rooms are created by the first user joining them, that user owns the room and
+// can change its settings along with the operators. Public rooms can be joined by
+// everyone, private and invite-only rooms only by the users invited with
+// invite_to_room. Private rooms are also left out of room listings.
+
+const (
+	// EventGetRoom is sent by a client to read the settings of a room
+	EventGetRoom = "get_room"
+	// EventRoomInfo is the response to get_room
+	EventRoomInfo = "room_info"
+	// EventUpdateRoom is sent by the owner of a room or an operator to change its settings
+	EventUpdateRoom = "update_room"
+	// EventRoomUpdated is sent to the room when its settings changed
+	EventRoomUpdated = "room_updated"
+	// EventInviteToRoom is sent by the owner of a room or an operator to let a user join
+	EventInviteToRoom = "invite_to_room"
+	// EventRoomInvite is delivered to all clients of an invited user
+	EventRoomInvite = "room_invite"
+)
+
+const (
+	VisibilityPublic     = "public"
+	VisibilityPrivate    = "private"
+	VisibilityInviteOnly = "invite_only"
+)
+
+var (
+	ErrInvalidRoomSettings = errors.New("invalid room settings")
+	ErrRoomFull            = errors.New("room is full")
+	ErrNotInvited          = errors.New("room requires an invite")
+	ErrRoomNotFound        = errors.New("room not found")
+)
+
+var (
+	// maxTopicLength and maxDescriptionLength are in characters
+	maxTopicLength       = 256
+	maxDescriptionLength = 2048
+)
+
+// RoomInfo is a room as sent to clients, the invited users are left out
+type RoomInfo struct {
+	Name        string    `json:"name"`
+	Owner       string    `json:"owner,omitempty"`
+	Topic       string    `json:"topic,omitempty"`
+	Description string    `json:"description,omitempty"`
+	MaxMembers  int       `json:"max_members,omitempty"`
+	Retention   Duration  `json:"retention,omitempty"`
+	MaxMessages int       `json:"max_messages,omitempty"`
+	Visibility  string    `json:"visibility"`
+	Created     time.Time `json:"created"`
+	// Members is how many users are in the room right now
+	Members     int        `json:"members"`
+	Ephemeral   bool       `json:"ephemeral,omitempty"`
+	IdleTimeout Duration   `json:"idle_timeout,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	E2EE        bool       `json:"e2ee,omitempty"`
+	ArchivedAt  *time.Time `json:"archived_at,omitempty"`
+}
+
+// GetRoomEvent is the payload sent in the
+// get_room event
+type GetRoomEvent struct {
+	// Room defaults to the room of the client
+	Room string `json:"room,omitempty"`
+}
+
+// UpdateRoomEvent is the payload sent in the
+// update_room event, only the fields that are set are changed
+type UpdateRoomEvent struct {
+	Room        string    `json:"room"`
+	Topic       *string   `json:"topic,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	MaxMembers  *int      `json:"max_members,omitempty"`
+	Retention   *Duration `json:"retention,omitempty"`
+	MaxMessages *int      `json:"max_messages,omitempty"`
+	Visibility  *string   `json:"visibility,omitempty"`
+	Ephemeral   *bool     `json:"ephemeral,omitempty"`
+	IdleTimeout *Duration `json:"idle_timeout,omitempty"`
+	// TTL closes an ephemeral room this long after the update, 0 removes the deadline
+	TTL *Duration `json:"ttl,omitempty"`
+	// E2EE makes the room refuse plaintext messages, see e2ee.go
+	E2EE *bool `json:"e2ee,omitempty"`
+}
+
+// RoomUpdatedEvent is the payload sent in the
+// room_updated event
+type RoomUpdatedEvent struct {
+	Room RoomInfo `json:"room"`
+	By   string   `json:"by"`
+}
+
+// InviteToRoomEvent is the payload sent in the
+// invite_to_room event
+type InviteToRoomEvent struct {
+	Room     string `json:"room"`
+	Username string `json:"username"`
+}
+
+// RoomInviteEvent is the payload sent in the
+// room_invite event
+type RoomInviteEvent struct {
+	Room  string `json:"room"`
+	From  string `json:"from"`
+	Topic string `json:"topic,omitempty"`
+}
+
+// visibility returns the visibility of the room, rooms without one are public
+func (r Room) visibility() string {
+	if r.Visibility == "" {
+		return VisibilityPublic
+	}
+	return r.Visibility
+}
+
+// admits returns true if the user may join the room
+func (r Room) admits(username string) bool {
+	return r.visibility() == VisibilityPublic || r.Owner == username || slices.Contains(r.Invited, username)
+}
+
+// roomSettings returns the stored settings of a room, ErrRoomNotFound is returned
+// for rooms that were never used
+func (m *Manager) roomSettings(name string) (Room, error) {
+	room, err := m.store.GetRoom(name)
+	if errors.Is(err, ErrNotFound) {
+		return Room{}, fmt.Errorf("%w: %s", ErrRoomNotFound, name)
+	}
+	return room, err
+}
+
+// newRoomInfo returns the room as sent to clients, without the member count
+func newRoomInfo(room Room) RoomInfo {
+	return RoomInfo{
+		Name:        room.Name,
+		Owner:       room.Owner,
+		Topic:       room.Topic,
+		Description: room.Description,
+		MaxMembers:  room.MaxMembers,
+		Retention:   room.Retention,
+		MaxMessages: room.MaxMessages,
+		Visibility:  room.visibility(),
+		Created:     room.Created,
+		Ephemeral:   room.Ephemeral,
+		IdleTimeout: room.IdleTimeout,
+		ExpiresAt:   room.ExpiresAt,
+		E2EE:        room.E2EE,
+		ArchivedAt:  room.ArchivedAt,
+	}
+}
+
+// roomInfo returns the room as sent to clients
+func (m *Manager) roomInfo(room Room) RoomInfo {
+	info := newRoomInfo(room)
+	info.Members = m.roomMembers(room.Name)
+	return info
+}
+
+// roomMembers returns how many different users are in the room
+func (m *Manager) roomMembers(room string) int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.countMembers(room)
+}
+
+// countMembers returns how many different users are in the room, a user with
+// several clients counts once
+// Users on other instances count with cluster.raft, see raft.go
+// Only call it while holding the manager lock
+func (m *Manager) countMembers(room string) int {
+	users := make(map[string]bool)
+	for client := range m.members[room] {
+		users[client.username] = true
+	}
+	m.remoteRoomUsernames(room, users)
+	return len(users)
+}
+
+// canManageRoom returns true if the client may change the settings of the room
+func (m *Manager) canManageRoom(c *Client, room Room) bool {
+	if c.apiKey != nil {
+		return false
+	}
+	return (room.Owner != "" && room.Owner == c.username) || m.allowed(c, PermissionOperator)
+}
+
+// admitToRoom returns the room if its settings let the client in, the room is
+// created with the user as owner the first time it is joined
+func (m *Manager) admitToRoom(c *Client, name string) (Room, error) {
+	room, err := m.store.GetRoom(name)
+	if errors.Is(err, ErrNotFound) {
+		if err := m.checkRoomQuota(c.username); err != nil {
+			return Room{}, err
+		}
+		room = Room{Name: name, Owner: c.username, Created: m.now()}
+		if err := m.store.SaveRoom(room); err != nil {
+			return Room{}, err
+		}
+	} else if err != nil {
+		return Room{}, err
+	}
+
+	if !room.admits(c.username) && !m.allowed(c, PermissionOperator) {
+		return Room{}, fmt.Errorf("%w: %s", ErrNotInvited, name)
+	}
+	return room, nil
+}
+
+// checkRoomAccess returns an error unless the client may read or post to the room
+// without being in it, the settings are checked like admitToRoom does but rooms
+// are never created
+func (m *Manager) checkRoomAccess(c *Client, name string) error {
+	if !c.allowedRoom(name) {
+		return c.roomError(name)
+	}
+	// Clients were admitted to the room they are in when they joined it
+	if name == m.roomOf(c) {
+		return nil
+	}
+
+	room, err := m.roomSettings(name)
+	if err != nil {
+		return err
+	}
+	if !room.admits(c.username) && !m.allowed(c, PermissionOperator) {
+		return fmt.Errorf("%w: %s", ErrNotInvited, name)
+	}
+	return nil
+}
+
+// checkRoomFull returns ErrRoomFull if the client would take a place the room doesn't have
+// Only call it while holding the manager lock
+func (m *Manager) checkRoomFull(c *Client, room Room) error {
+	if room.MaxMembers == 0 || m.hasPlace(c, room.Name, room.MaxMembers) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s allows %d members", ErrRoomFull, room.Name, room.MaxMembers)
+}
+
+// hasPlace returns true if the client can be in the room without it having more
+// than max members
+// Only call it while holding the manager lock
+func (m *Manager) hasPlace(c *Client, room string, max int) bool {
+	if c.room == room || m.countMembers(room) < max {
+		return true
+	}
+	// Another client of the same user doesn't take another place
+	for client := range m.members[room] {
+		if client.username == c.username {
+			return true
+		}
+	}
+	return false
+}
+
+// joinRoom moves the client to the room if its settings allow it
+func (m *Manager) joinRoom(c *Client, name string) error {
+	room, err := m.admitToRoom(c, name)
+	if err != nil {
+		return err
+	}
+
+	limits := m.roomQuotaLimits(room.Owner)
+	m.Lock()
+	if err := m.checkRoomFull(c, room); err != nil {
+		m.Unlock()
+		return err
+	}
+	if err := m.checkMembersQuota(c, room, limits); err != nil {
+		m.Unlock()
+		return err
+	}
+	m.moveClient(c, name)
+	m.Unlock()
+
+	// The room lock is taken before the manager lock elsewhere, so it is touched after unlocking
+	m.touchRoom(name)
+	m.addMembership(c.username, name)
+	return nil
+}
+
+// validateRoomUpdate returns an error if the update has a value that can't be used
+func validateRoomUpdate(update UpdateRoomEvent) error {
+	if update.Topic != nil && utf8.RuneCountInString(*update.Topic) > maxTopicLength {
+		return fmt.Errorf("%w: topic is longer than %d characters", ErrInvalidRoomSettings, maxTopicLength)
+	}
+	if update.Description != nil && utf8.RuneCountInString(*update.Description) > maxDescriptionLength {
+		return fmt.Errorf("%w: description is longer than %d characters", ErrInvalidRoomSettings, maxDescriptionLength)
+	}
+	if update.MaxMembers != nil && *update.MaxMembers < 0 {
+		return fmt.Errorf("%w: max_members can't be negative", ErrInvalidRoomSettings)
+	}
+	if update.Retention != nil && *update.Retention < 0 {
+		return fmt.Errorf("%w: retention can't be negative", ErrInvalidRoomSettings)
+	}
+	if update.MaxMessages != nil && *update.MaxMessages < 0 {
+		return fmt.Errorf("%w: max_messages can't be negative", ErrInvalidRoomSettings)
+	}
+	if update.IdleTimeout != nil && *update.IdleTimeout < 0 {
+		return fmt.Errorf("%w: idle_timeout can't be negative", ErrInvalidRoomSettings)
+	}
+	if update.TTL != nil && *update.TTL < 0 {
+		return fmt.Errorf("%w: ttl can't be negative", ErrInvalidRoomSettings)
+	}
+	if update.Ephemeral != nil && *update.Ephemeral && update.Room == defaultRoom {
+		return fmt.Errorf("%w: the default room can't be ephemeral", ErrInvalidRoomSettings)
+	}
+	if update.Visibility != nil {
+		switch *update.Visibility {
+		case VisibilityPublic, VisibilityPrivate, VisibilityInviteOnly:
+		default:
+			return fmt.Errorf("%w: visibility must be %s, %s or %s", ErrInvalidRoomSettings, VisibilityPublic, VisibilityPrivate, VisibilityInviteOnly)
+		}
+	}
+	return nil
+}
+
+// GetRoomHandler answers with the settings of a room
+func GetRoomHandler(event Event, c *Client) error {
+	var req GetRoomEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if req.Room == "" {
+		req.Room = c.manager.roomOf(c)
+	}
+	if !c.allowedRoom(req.Room) {
+		return c.roomError(req.Room)
+	}
+
+	room, err := c.manager.roomSettings(req.Room)
+	if err != nil {
+		return err
+	}
+	// Private rooms are only described to the users that may join them
+	if room.visibility() == VisibilityPrivate && !room.admits(c.username) && !c.manager.allowed(c, PermissionOperator) {
+		return fmt.Errorf("%w: %s", ErrRoomNotFound, req.Room)
+	}
+	return c.manager.replyJSON(c, EventRoomInfo, c.manager.roomInfo(room))
+}
+
+// UpdateRoomHandler changes the settings of a room and tells its members
+func UpdateRoomHandler(event Event, c *Client) error {
+	var update UpdateRoomEvent
+	if err := json.Unmarshal(event.Payload, &update); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if update.Room == "" {
+		update.Room = c.manager.roomOf(c)
+	}
+	if err := validateRoomUpdate(update); err != nil {
+		return err
+	}
+
+	m := c.manager
+	// Settings are read, changed and written back, concurrent updates must not interleave
+	m.roomSettingsLock.Lock()
+	room, err := m.roomSettings(update.Room)
+	if err != nil {
+		m.roomSettingsLock.Unlock()
+		return err
+	}
+	if !m.canManageRoom(c, room) {
+		m.roomSettingsLock.Unlock()
+		return fmt.Errorf("%w: only the owner of %s can change it", ErrPermissionDenied, room.Name)
+	}
+
+	if update.Topic != nil {
+		room.Topic = *update.Topic
+	}
+	if update.Description != nil {
+		room.Description = *update.Description
+	}
+	if update.MaxMembers != nil {
+		room.MaxMembers = *update.MaxMembers
+	}
+	if update.Retention != nil {
+		room.Retention = *update.Retention
+	}
+	if update.MaxMessages != nil {
+		room.MaxMessages = *update.MaxMessages
+	}
+	if update.Visibility != nil {
+		room.Visibility = *update.Visibility
+	}
+	if update.Ephemeral != nil {
+		room.Ephemeral = *update.Ephemeral
+	}
+	if update.IdleTimeout != nil {
+		room.IdleTimeout = *update.IdleTimeout
+	}
+	if update.E2EE != nil {
+		room.E2EE = *update.E2EE
+		m.setRoomE2EE(room.Name, room.E2EE)
+	}
+	if update.TTL != nil {
+		room.ExpiresAt = nil
+		if *update.TTL > 0 {
+			expires := m.now().Add(time.Duration(*update.TTL))
+			room.ExpiresAt = &expires
+		}
+	}
+	err = m.store.SaveRoom(room)
+	m.roomSettingsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(RoomUpdatedEvent{Room: m.roomInfo(room), By: c.username})
+	if err != nil {
+		return fmt.Errorf("failed to marshal room update: %v", err)
+	}
+	m.broadcastToRoom(room.Name, "", Event{Type: EventRoomUpdated, Payload: data})
+	return nil
+}
+
+// InviteToRoomHandler lets a user join a private or invite-only room and tells them
+func InviteToRoomHandler(event Event, c *Client) error {
+	var invite InviteToRoomEvent
+	if err := json.Unmarshal(event.Payload, &invite); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if invite.Room == "" {
+		invite.Room = c.manager.roomOf(c)
+	}
+	if err := validateUsername(invite.Username); err != nil {
+		return err
+	}
+
+	m := c.manager
+	m.roomSettingsLock.Lock()
+	room, err := m.roomSettings(invite.Room)
+	if err != nil {
+		m.roomSettingsLock.Unlock()
+		return err
+	}
+	if !m.canManageRoom(c, room) {
+		m.roomSettingsLock.Unlock()
+		return fmt.Errorf("%w: only the owner of %s can invite", ErrPermissionDenied, room.Name)
+	}
+	if !slices.Contains(room.Invited, invite.Username) {
+		room.Invited = append(room.Invited, invite.Username)
+		err = m.store.SaveRoom(room)
+	}
+	m.roomSettingsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(RoomInviteEvent{Room: room.Name, From: c.username, Topic: room.Topic})
+	if err != nil {
+		return fmt.Errorf("failed to marshal room invite: %v", err)
+	}
+	if m.sendToUser(invite.Username, Event{Type: EventRoomInvite, Payload: data}) == 0 {
+		log.Printf("invite of %s to %s stored, the user is offline", invite.Username, room.Name)
+	}
+	return nil
+}
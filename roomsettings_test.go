@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"arti.soft/websockets-go/wstest"
+)
+
+// newRoomTestServer returns a test server with a private room of alice
+func newRoomTestServer(t *testing.T, config Config) (*wstest.Server, *Manager) {
+	t.Helper()
+	server, m, err := NewTestServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	room := Room{Name: "secret", Owner: "alice", Visibility: VisibilityPrivate, Invited: []string{"carol"}, Created: m.now()}
+	if err := m.store.SaveRoom(room); err != nil {
+		t.Fatal(err)
+	}
+	return server, m
+}
+
+// routeAs routes the event from the client of the test server like its read pump would
+func routeAs(t *testing.T, m *Manager, client *wstest.Client, eventType string, payload any) error {
+	t.Helper()
+	c, ok := m.clientByID(client.ID)
+	if !ok {
+		t.Fatalf("client %s is not connected", client.ID)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.reouteEvent(Event{Type: eventType, Payload: data}, c)
+}
+
+func TestGetHistoryOfPrivateRoom(t *testing.T) {
+	config := DefaultConfig()
+	config.Operators = []string{"olivia"}
+	server, m := newRoomTestServer(t, config)
+
+	bob := server.Connect("bob")
+	err := routeAs(t, m, bob, EventGetHistory, GetHistoryEvent{Room: "secret"})
+	if !errors.Is(err, ErrNotInvited) {
+		t.Fatalf("history of a private room for a non-member: %v, want %v", err, ErrNotInvited)
+	}
+	if err := bob.ExpectNone(EventHistory, 50*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+
+	// The owner, invited users and operators may read it
+	for _, username := range []string{"alice", "carol", "olivia"} {
+		client := server.Connect(username)
+		if err := routeAs(t, m, client, EventGetHistory, GetHistoryEvent{Room: "secret"}); err != nil {
+			t.Fatalf("history for %s: %v", username, err)
+		}
+		if _, err := client.Expect(EventHistory, time.Second); err != nil {
+			t.Errorf("history for %s: %v", username, err)
+		}
+	}
+}
+
+func TestScheduleMessageToPrivateRoom(t *testing.T) {
+	server, m := newRoomTestServer(t, DefaultConfig())
+	deliverAt := m.now().Add(time.Hour)
+
+	bob := server.Connect("bob")
+	err := routeAs(t, m, bob, EventScheduleMessage, ScheduleMessageEvent{Room: "secret", Message: "hi", DeliverAt: deliverAt})
+	if !errors.Is(err, ErrNotInvited) {
+		t.Fatalf("scheduling into a private room for a non-member: %v, want %v", err, ErrNotInvited)
+	}
+	if scheduled, _ := m.store.ListScheduled(); len(scheduled) != 0 {
+		t.Errorf("%d messages scheduled, want none", len(scheduled))
+	}
+
+	carol := server.Connect("carol")
+	if err := routeAs(t, m, carol, EventScheduleMessage, ScheduleMessageEvent{Room: "secret", Message: "hi", DeliverAt: deliverAt}); err != nil {
+		t.Fatalf("scheduling for an invited user: %v", err)
+	}
+}
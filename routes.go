@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// All routes can be mounted under a base path, like /realtime, so the server can
+// sit behind a reverse proxy next to other applications or be embedded in one.
+// setupAPI registers them on any Router, the server's own *http.ServeMux or one
+// of the application. chi routers take them on a ServeMux of their own, mounted
+// at the base path with r.Mount("/realtime", mux), chi leaves the path alone
+// so the ServeMux still sees the base path.
+
+// Router is what the routes are registered on, *http.ServeMux is one
+type Router interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// routes registers handlers on the router under the base path
+type routes struct {
+	router Router
+	base   string
+	// wrap is the middleware put around every handler, if any
+	wrap func(http.HandlerFunc) http.HandlerFunc
+	// options are the paths given an OPTIONS route for the middleware
+	options map[string]bool
+}
+
+// newRoutes returns routes registering on the router under the base path
+func newRoutes(router Router, base string) routes {
+	return routes{router: router, base: cleanBasePath(base)}
+}
+
+// with returns routes registering their handlers behind the middleware. Patterns
+// with a method also get an OPTIONS route behind it, finding nothing past it, so
+// middleware like cors sees the preflight requests for them
+func (r routes) with(middleware func(http.HandlerFunc) http.HandlerFunc) routes {
+	r.wrap = middleware
+	r.options = make(map[string]bool)
+	return r
+}
+
+// Handle registers the handler for the pattern under the base path
+func (r routes) Handle(pattern string, handler http.Handler) {
+	if r.wrap != nil {
+		method, path, found := strings.Cut(pattern, " ")
+		if found && method != http.MethodOptions && !r.options[path] {
+			r.options[path] = true
+			r.router.Handle(withBasePath(r.base, http.MethodOptions+" "+path), r.wrap(http.NotFound))
+		}
+		handler = r.wrap(handler.ServeHTTP)
+	}
+	r.router.Handle(withBasePath(r.base, pattern), handler)
+}
+
+// HandleFunc registers the handler func for the pattern under the base path
+func (r routes) HandleFunc(pattern string, handler http.HandlerFunc) {
+	r.Handle(pattern, handler)
+}
+
+// cleanBasePath returns the base path with a leading and without a trailing slash,
+// empty for the root
+func cleanBasePath(base string) string {
+	base = strings.Trim(base, "/")
+	if base == "" {
+		return ""
+	}
+	return "/" + base
+}
+
+// withBasePath puts the base path in front of the path of the pattern, after
+// the method if the pattern has one, like "POST /login"
+func withBasePath(base, pattern string) string {
+	if base == "" {
+		return pattern
+	}
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		return base + pattern
+	}
+	return method + " " + base + strings.TrimLeft(path, " ")
+}
+
+// basePath returns the configured base path, empty for the root
+func (m *Manager) basePath() string {
+	return cleanBasePath(m.config().BasePath)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The round trip time of a client is measured from when a ping was written to
+// when its pong arrived. Every sample goes into the rtt histogram of the Manager,
+// and into a rolling estimate on the client computed like TCP does, an average
+// leaning on the latest samples along with how much they vary. Handlers read the
+// estimate with roundTripTime, to batch more for slow clients or to match players
+// with similar latency. Clients in netpoll mode get no pings from the server, their
+// RTT stays zero.
+
+// rttEstimator holds the round trip times of a client, all in nanoseconds
+type rttEstimator struct {
+	// pingSent is when the last ping was written in unix nanoseconds, zero once its pong arrived
+	pingSent atomic.Int64
+	// latest is the round trip time of the last pong
+	latest atomic.Int64
+	// smoothed is the rolling average, variance the rolling mean deviation from it
+	smoothed atomic.Int64
+	variance atomic.Int64
+	// samples counts the pongs measured
+	samples atomic.Uint64
+
+	// interval is the adaptive ping interval, zero until it adapted, see adaptiveping.go
+	interval atomic.Int64
+	// scheduled is the interval the writer currently waits for the next ping
+	scheduled atomic.Int64
+}
+
+// pingWritten starts the round trip of a ping
+func (c *Client) pingWritten() {
+	c.ping.pingSent.Store(time.Now().UnixNano())
+}
+
+// pongReceived ends the round trip of the last ping, pongs the server didn't ask for are ignored
+func (c *Client) pongReceived() {
+	sent := c.ping.pingSent.Swap(0)
+	if sent == 0 {
+		return
+	}
+	rtt := time.Since(time.Unix(0, sent))
+	c.ping.latest.Store(int64(rtt))
+	c.manager.rttLatency.ObserveDuration(rtt)
+
+	// Pongs are only handled by the read goroutine, so the estimate can't race.
+	// Same weights as TCP, 1/8 for the average and 1/4 for the variance
+	smoothed, variance := time.Duration(c.ping.smoothed.Load()), time.Duration(c.ping.variance.Load())
+	if c.ping.samples.Add(1) == 1 {
+		smoothed, variance = rtt, rtt/2
+	} else {
+		variance += (abs(smoothed-rtt) - variance) / 4
+		smoothed += (rtt - smoothed) / 8
+	}
+	c.ping.smoothed.Store(int64(smoothed))
+	c.ping.variance.Store(int64(variance))
+
+	c.adaptPingInterval(rtt)
+}
+
+// roundTripTime returns the rolling estimate of the round trip time, zero before the first pong
+func (c *Client) roundTripTime() time.Duration {
+	return time.Duration(c.ping.smoothed.Load())
+}
+
+// roundTripVariance returns how much the round trip times vary around the estimate
+func (c *Client) roundTripVariance() time.Duration {
+	return time.Duration(c.ping.variance.Load())
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
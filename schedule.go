@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	ErrInvalidSchedule  = errors.New("scheduled message needs a message, a room or a recipient, and a delivery time in the future")
+	ErrNotAuthor        = errors.New("only the author can cancel a scheduled message")
+	ErrTooManyScheduled = errors.New("too many scheduled messages, cancel some first")
+)
+
+// The scheduler delivers ScheduledMessages once their time has come. Messages are
+// kept in the MessageStore so they survive restarts, the store is polled on an
+// interval like the RetentionMap does for OTPs. Every poll only asks the store for
+// the messages that are due, and the handlers only for the ones of their user.
+
+// schedulerInterval is how often the scheduler checks for messages to deliver
+var schedulerInterval = time.Second
+
+// maxScheduledPerUser is how many scheduled messages a user may have pending
+var maxScheduledPerUser = 100
+
+// ScheduleMessageEvent is the payload sent in the
+// schedule_message event
+type ScheduleMessageEvent struct {
+	Room      string    `json:"room,omitempty"`
+	To        string    `json:"to,omitempty"`
+	Message   string    `json:"message"`
+	DeliverAt time.Time `json:"deliver_at"`
+}
+
+// CancelScheduledMessageEvent is the payload sent in the
+// cancel_scheduled_message event
+type CancelScheduledMessageEvent struct {
+	ID string `json:"id"`
+}
+
+// ScheduledMessagesEvent is the payload of the scheduled_messages response
+type ScheduledMessagesEvent struct {
+	Messages []ScheduledMessage `json:"messages"`
+}
+
+const (
+	// EventScheduleMessage is sent by a client to deliver a message later
+	EventScheduleMessage = "schedule_message"
+	// EventMessageScheduled is returned to the author with the created ScheduledMessage
+	EventMessageScheduled = "message_scheduled"
+	// EventListScheduledMessages is sent by a client to get its scheduled messages
+	EventListScheduledMessages = "list_scheduled_messages"
+	// EventScheduledMessages is the response to list_scheduled_messages
+	EventScheduledMessages = "scheduled_messages"
+	// EventCancelScheduledMessage is sent by a client to cancel one of its scheduled messages
+	EventCancelScheduledMessage = "cancel_scheduled_message"
+	// EventScheduledMessageCancelled is returned to the author once a message is cancelled
+	EventScheduledMessageCancelled = "scheduled_message_cancelled"
+)
+
+// ScheduleMessageHandler stores the message to be delivered by the scheduler
+func ScheduleMessageHandler(event Event, c *Client) error {
+	var req ScheduleMessageEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if req.Message == "" || (req.Room == "") == (req.To == "") || !req.DeliverAt.After(c.manager.now()) {
+		return ErrInvalidSchedule
+	}
+	if req.Room != "" {
+		if err := validateRoomName(req.Room); err != nil {
+			return err
+		}
+		if err := c.manager.checkRoomAccess(c, req.Room); err != nil {
+			return err
+		}
+	}
+
+	// Every scheduled message is kept until delivery, so users get a limited number
+	pending, err := c.manager.store.ListScheduledByAuthor(c.username)
+	if err != nil {
+		return err
+	}
+	if len(pending) >= maxScheduledPerUser {
+		return ErrTooManyScheduled
+	}
+
+	msg := ScheduledMessage{
+		ID:        c.manager.newID(),
+		Author:    c.username,
+		Room:      req.Room,
+		To:        req.To,
+		Message:   req.Message,
+		DeliverAt: req.DeliverAt,
+	}
+	if err := c.manager.store.SaveScheduled(msg); err != nil {
+		return err
+	}
+
+	return c.manager.replyJSON(c, EventMessageScheduled, msg)
+}
+
+// ListScheduledMessagesHandler returns the pending scheduled messages of the user
+func ListScheduledMessagesHandler(event Event, c *Client) error {
+	scheduled, err := c.manager.store.ListScheduledByAuthor(c.username)
+	if err != nil {
+		return err
+	}
+	return c.manager.replyJSON(c, EventScheduledMessages, ScheduledMessagesEvent{Messages: scheduled})
+}
+
+// CancelScheduledMessageHandler removes a scheduled message of the user
+func CancelScheduledMessageHandler(event Event, c *Client) error {
+	var req CancelScheduledMessageEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	msg, err := c.manager.store.GetScheduled(req.ID)
+	if err != nil {
+		return err
+	}
+	if msg.Author != c.username {
+		return ErrNotAuthor
+	}
+	if err := c.manager.store.DeleteScheduled(msg.ID); err != nil {
+		return err
+	}
+	return c.manager.replyJSON(c, EventScheduledMessageCancelled, req)
+}
+
+// runScheduler delivers scheduled messages when they are due
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.deliverScheduled(m.now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deliverScheduled sends all messages due at now and removes them from the store
+func (m *Manager) deliverScheduled(now time.Time) {
+	due, err := m.store.ListScheduledDue(now)
+	if err != nil {
+		log.Println("failed to list scheduled messages: ", err)
+		return
+	}
+
+	for _, msg := range due {
+		// Remove it first, a message is better lost than delivered over and over
+		if err := m.store.DeleteScheduled(msg.ID); err != nil {
+			log.Println("failed to remove scheduled message: ", err)
+			continue
+		}
+
+		if msg.Room != "" {
+			_, err = m.postMessage(msg.Room, SendMessageEvent{Message: msg.Message, From: msg.Author})
+		} else {
+			err = m.sendDirectMessage(msg.Author, msg.To, msg.Message)
+		}
+		if err != nil {
+			log.Println("failed to deliver scheduled message: ", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduledQueries(t *testing.T) {
+	store := newMemoryStore()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, msg := range []ScheduledMessage{
+		{ID: "later", Author: "alice", Room: defaultRoom, Message: "later", DeliverAt: now.Add(2 * time.Hour)},
+		{ID: "direct", Author: "bob", To: "alice", Message: "direct", DeliverAt: now.Add(time.Hour)},
+		{ID: "soon", Author: "alice", Room: defaultRoom, Message: "soon", DeliverAt: now.Add(30 * time.Minute)},
+	} {
+		if err := store.SaveScheduled(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(list []ScheduledMessage) []string {
+		var ids []string
+		for _, msg := range list {
+			ids = append(ids, msg.ID)
+		}
+		return ids
+	}
+	if list, _ := store.ListScheduledByAuthor("alice"); len(list) != 2 || list[0].ID != "soon" || list[1].ID != "later" {
+		t.Errorf("messages of alice are %v, want [soon later]", ids(list))
+	}
+	if list, _ := store.ListScheduledDue(now.Add(time.Hour)); len(list) != 2 || list[0].ID != "soon" || list[1].ID != "direct" {
+		t.Errorf("messages due in an hour are %v, want [soon direct]", ids(list))
+	}
+	if list, _ := store.ListScheduledDue(now); len(list) != 0 {
+		t.Errorf("messages due now are %v, want none", ids(list))
+	}
+	if msg, err := store.GetScheduled("direct"); err != nil || msg.To != "alice" {
+		t.Errorf("GetScheduled(direct) = %+v, %v", msg, err)
+	}
+	if _, err := store.GetScheduled("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetScheduled(missing): %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestScheduledMessageDelivery(t *testing.T) {
+	clock := NewManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	server, m, err := NewTestServer(DefaultConfig(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	alice := server.Connect("alice")
+	bob := server.Connect("bob")
+	if err := routeAs(t, m, alice, EventScheduleMessage, ScheduleMessageEvent{Room: defaultRoom, Message: "good morning", DeliverAt: clock.Now().Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	var scheduled ScheduledMessage
+	if err := alice.ExpectPayload(EventMessageScheduled, &scheduled, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := routeAs(t, m, bob, EventCancelScheduledMessage, CancelScheduledMessageEvent{ID: scheduled.ID}); !errors.Is(err, ErrNotAuthor) {
+		t.Errorf("cancelling the message of another user: %v, want %v", err, ErrNotAuthor)
+	}
+	if err := routeAs(t, m, bob, EventCancelScheduledMessage, CancelScheduledMessageEvent{ID: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("cancelling an unknown message: %v, want %v", err, ErrNotFound)
+	}
+	if err := routeAs(t, m, bob, EventListScheduledMessages, struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	var list ScheduledMessagesEvent
+	if err := bob.ExpectPayload(EventScheduledMessages, &list, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Messages) != 0 {
+		t.Errorf("bob lists the messages of alice: %+v", list.Messages)
+	}
+
+	m.deliverScheduled(clock.Now())
+	if err := bob.ExpectNone(EventNewMessage, 50*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+	clock.Advance(time.Minute)
+	m.deliverScheduled(clock.Now())
+	var msg NewMessageEvent
+	if err := bob.ExpectPayload(EventNewMessage, &msg, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if msg.From != "alice" || msg.Message != "good morning" {
+		t.Errorf("delivered %+v, want the message of alice", msg)
+	}
+	if pending, _ := m.store.ListScheduledByAuthor("alice"); len(pending) != 0 {
+		t.Errorf("delivered message is still scheduled: %+v", pending)
+	}
+}
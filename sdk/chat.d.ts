@@ -0,0 +1,785 @@
+// Code generated by go run . -generate-sdk; DO NOT EDIT.
+
+export interface AccountErasedEvent {
+    message: string;
+    code: string;
+}
+
+export interface AckEvent {
+    id: string;
+}
+
+export interface BulkAddMembersEvent {
+    room: string;
+    usernames: string[];
+}
+
+export interface BulkAnnounceEvent {
+    rooms: string[];
+    message: string;
+    priority?: string;
+}
+
+export interface BulkKickEvent {
+    room: string;
+}
+
+export interface BulkResultEvent {
+    operation: string;
+    invited?: number;
+    moved?: number;
+    delivered?: number;
+    kicked?: number;
+}
+
+export interface CancelScheduledMessageEvent {
+    id: string;
+}
+
+export interface ChunkEvent {
+    stream: string;
+    type?: string;
+    id?: string;
+    meta?: unknown;
+    seq: number;
+    data?: string;
+    binary?: boolean;
+    final?: boolean;
+}
+
+export interface ClientCapabilities {
+    batch: boolean;
+    compression: boolean;
+    binary: boolean;
+    max_message_size?: number;
+    chunks?: boolean;
+}
+
+export interface CompactDocEvent {
+    room: string;
+    doc: string;
+    seq: number;
+}
+
+export interface ConnectionStatsEvent {
+    client_id: string;
+    connected_at: string;
+    uptime: string;
+    messages_in: number;
+    messages_out: number;
+    bytes_in: number;
+    bytes_out: number;
+    queue_depth: number;
+    queued_bytes: number;
+    dropped: number;
+    unacked?: number;
+    rtt: string;
+    smoothed_rtt: string;
+    rtt_variance: string;
+}
+
+export interface CountdownEvent {
+    id: string;
+    room: string;
+    type: string;
+    ends_at: string;
+}
+
+export interface CreateLobbyEvent {
+    game?: string;
+    capacity: number;
+}
+
+export interface DeviceInfo {
+    id: string;
+    name?: string;
+    created: string;
+    last_seen: string;
+    connected: number;
+    current?: boolean;
+}
+
+export interface DeviceKeys {
+    device_id: string;
+    identity_key: string;
+    signed_prekey: string;
+    prekey_signature: string;
+    one_time_prekey?: string;
+}
+
+export interface DeviceListEvent {
+    devices: DeviceInfo[];
+}
+
+export interface DeviceRevokedEvent {
+    device_id: string;
+}
+
+export interface DirectMessageEvent {
+    from: string;
+    to: string;
+    nickname?: string;
+    message: string;
+    sent: string;
+}
+
+export interface DocAwarenessEvent {
+    room?: string;
+    doc: string;
+    client?: string;
+    from?: string;
+    state: unknown;
+}
+
+export interface DocOpenedEvent {
+    room: string;
+    doc: string;
+    snapshot?: string;
+    snapshot_seq: number;
+    updates: DocUpdatedEvent[];
+    seq: number;
+    awareness: DocAwarenessEvent[];
+}
+
+export interface DocSnapshotEvent {
+    doc: string;
+    seq: number;
+    state: string;
+}
+
+export interface DocUpdateEvent {
+    doc: string;
+    update: string;
+}
+
+export interface DocUpdatedEvent {
+    room?: string;
+    doc?: string;
+    seq: number;
+    update: string;
+    from: string;
+    sent: string;
+}
+
+export interface E2EEMessageEvent {
+    id?: string;
+    from: string;
+    room?: string;
+    to?: string;
+    ciphertext: unknown;
+    sent: string;
+}
+
+export interface E2EESendEvent {
+    room?: string;
+    to?: string;
+    ciphertext: unknown;
+}
+
+export interface EphemeralEvent {
+    command: string;
+    message: string;
+    error?: boolean;
+    code?: string;
+    params?: Record<string, string>;
+}
+
+export interface ErrorEvent {
+    code: string;
+    message: string;
+    params?: Record<string, string>;
+}
+
+export interface Event {
+    id?: string;
+    type: string;
+    payload: unknown;
+}
+
+export interface FetchKeysEvent {
+    username: string;
+}
+
+export interface GetHistoryEvent {
+    room?: string;
+    since: number;
+}
+
+export interface GetProfileEvent {
+    username: string;
+}
+
+export interface GetRoomEvent {
+    room?: string;
+}
+
+export interface HelloEvent {
+    capabilities: ClientCapabilities;
+    locale?: string;
+}
+
+export interface Highlight {
+    start: number;
+    end: number;
+}
+
+export interface HistoryEvent {
+    room: string;
+    events: Event[];
+    complete: boolean;
+    reactions?: Record<string, Record<string, number>>;
+}
+
+export interface ICEServer {
+    urls: string[];
+    username?: string;
+    credential?: string;
+}
+
+export interface ICEServersEvent {
+    ice_servers: ICEServer[];
+    expires: string;
+}
+
+export interface InviteToRoomEvent {
+    room: string;
+    username: string;
+}
+
+export interface JoinLobbyEvent {
+    lobby: string;
+}
+
+export interface JoinRoomEvent {
+    room: string;
+}
+
+export interface KeyBundlesEvent {
+    username: string;
+    devices: DeviceKeys[];
+}
+
+export interface KeysPublishedEvent {
+    device_id: string;
+    one_time_prekeys: number;
+}
+
+export interface ListLobbiesEvent {
+    game?: string;
+}
+
+export interface ListRoomsEvent {
+    query?: string;
+    after?: string;
+    limit?: number;
+}
+
+export interface LobbiesEvent {
+    lobbies: Lobby[];
+}
+
+export interface Lobby {
+    id: string;
+    game?: string;
+    owner: string;
+    capacity: number;
+    state: string;
+    members: LobbyMember[];
+    deadline: string;
+    created: string;
+}
+
+export interface LobbyLeftEvent {
+    lobby: string;
+    reason: string;
+}
+
+export interface LobbyMember {
+    username: string;
+    ready: boolean;
+}
+
+export interface LobbyReadyEvent {
+    ready: boolean;
+}
+
+export interface LobbyStartedEvent {
+    lobby: Lobby;
+    room: string;
+}
+
+export interface MemberEvent {
+    room: string;
+    username: string;
+    nickname?: string;
+}
+
+export interface MentionEvent {
+    from: string;
+    room: string;
+    message: string;
+    sent: string;
+}
+
+export interface NewMessageEvent {
+    id: string;
+    message: string;
+    from: string;
+    nickname?: string;
+    action?: boolean;
+    mentions?: string[];
+    sent: string;
+}
+
+export interface NicknameChangedEvent {
+    username: string;
+    nickname: string;
+    previous?: string;
+}
+
+export interface OpenDocEvent {
+    doc: string;
+}
+
+export interface PresenceEvent {
+    username: string;
+    nickname?: string;
+    status: string;
+    text?: string;
+    last_active: string;
+}
+
+export interface ProfileEvent {
+    username: string;
+    display_name?: string;
+    avatar_url?: string;
+    status_text?: string;
+}
+
+export interface PublishKeysEvent {
+    device_id: string;
+    identity_key: string;
+    signed_prekey: string;
+    prekey_signature: string;
+    one_time_prekeys?: string[];
+}
+
+export interface PushToken {
+    platform: string;
+    token: string;
+}
+
+export interface RTCSignalEvent {
+    to?: string;
+    to_client?: string;
+    room?: string;
+    from?: string;
+    from_client?: string;
+    kind: string;
+    data?: unknown;
+}
+
+export interface ReactionEvent {
+    message_id: string;
+    emoji: string;
+}
+
+export interface ReactionUpdatedEvent {
+    message_id: string;
+    room: string;
+    emoji: string;
+    by: string;
+    added: boolean;
+    reactions: Record<string, number>;
+}
+
+export interface RevokeDeviceEvent {
+    device_id: string;
+}
+
+export interface RoomClosedEvent {
+    room: string;
+    reason: string;
+    moved_to: string;
+}
+
+export interface RoomInfo {
+    name: string;
+    owner?: string;
+    topic?: string;
+    description?: string;
+    max_members?: number;
+    retention?: string;
+    max_messages?: number;
+    visibility: string;
+    created: string;
+    members: number;
+    ephemeral?: boolean;
+    idle_timeout?: string;
+    expires_at?: string;
+    e2ee?: boolean;
+    archived_at?: string;
+}
+
+export interface RoomInviteEvent {
+    room: string;
+    from: string;
+    topic?: string;
+}
+
+export interface RoomListEvent {
+    rooms: RoomInfo[];
+    next?: string;
+}
+
+export interface RoomSwitchedEvent {
+    from: string;
+    room: RoomInfo;
+    seq: number;
+    history: Event[];
+    reactions?: Record<string, Record<string, number>>;
+    members: string[];
+    nicknames?: Record<string, string>;
+}
+
+export interface RoomUpdatedEvent {
+    room: RoomInfo;
+    by: string;
+}
+
+export interface ScheduleMessageEvent {
+    room?: string;
+    to?: string;
+    message: string;
+    deliver_at: string;
+}
+
+export interface ScheduledMessage {
+    id: string;
+    author: string;
+    room?: string;
+    to?: string;
+    message: string;
+    deliver_at: string;
+}
+
+export interface ScheduledMessagesEvent {
+    messages: ScheduledMessage[];
+}
+
+export interface SearchMessagesEvent {
+    query: string;
+    room?: string;
+    offset?: number;
+    limit?: number;
+}
+
+export interface SearchResult {
+    room: string;
+    seq: number;
+    message: NewMessageEvent;
+    highlights: Highlight[];
+}
+
+export interface SearchResultsEvent {
+    query: string;
+    results: SearchResult[];
+    next?: number;
+}
+
+export interface SendDirectMessageEvent {
+    to: string;
+    message: string;
+}
+
+export interface SendMessageEvent {
+    message: string;
+    from: string;
+    nickname?: string;
+    action?: boolean;
+    mentions?: string[];
+}
+
+export interface ServerDrainingEvent {
+    retry_after: number;
+    message: string;
+    code: string;
+}
+
+export interface SessionRecordingEvent {
+    recording: boolean;
+}
+
+export interface SetNicknameEvent {
+    nickname: string;
+}
+
+export interface SetStatusEvent {
+    status: string;
+    text?: string;
+}
+
+export interface SlowConsumerEvent {
+    reason: string;
+    queue_depth: number;
+    queue_size: number;
+    write_latency: string;
+}
+
+export interface StateDeltaEvent {
+    room: string;
+    name: string;
+    version: number;
+    delta: unknown;
+    from?: string;
+}
+
+export interface StateSnapshotEvent {
+    room: string;
+    name: string;
+    version: number;
+    state: unknown;
+}
+
+export interface SubscribeStateEvent {
+    name: string;
+    version?: number;
+}
+
+export interface SwitchRoomEvent {
+    room: string;
+    history?: number;
+}
+
+export interface SystemEvent {
+    message: string;
+    code?: string;
+    params?: Record<string, string>;
+    priority: string;
+    sent: string;
+}
+
+export interface TimeSyncEvent {
+    client_time?: unknown;
+    received: string;
+    sent: string;
+}
+
+export interface TypingEvent {
+    typing: boolean;
+}
+
+export interface UnsubscribeStateEvent {
+    name: string;
+}
+
+export interface UpdateProfileEvent {
+    display_name?: string;
+    avatar_url?: string;
+    status_text?: string;
+}
+
+export interface UpdateRoomEvent {
+    room: string;
+    topic?: string;
+    description?: string;
+    max_members?: number;
+    retention?: string;
+    max_messages?: number;
+    visibility?: string;
+    ephemeral?: boolean;
+    idle_timeout?: string;
+    ttl?: string;
+    e2ee?: boolean;
+}
+
+export interface UpdateStateEvent {
+    name: string;
+    change: unknown;
+    base_version?: number;
+}
+
+export interface UserTypingEvent {
+    from: string;
+    room: string;
+    typing: boolean;
+}
+
+export interface WelcomeEvent {
+    client_id: string;
+    username: string;
+    device_id?: string;
+    api_key_id?: string;
+    operator?: boolean;
+    room: string;
+    server_time: string;
+    region?: string;
+    flags?: string[];
+    locale?: string;
+    protocol: WelcomeProtocol;
+    heartbeat: WelcomeHeartbeat;
+}
+
+export interface WelcomeHeartbeat {
+    ping_interval: string;
+    pong_wait: string;
+    adaptive?: boolean;
+    keepalive?: boolean;
+}
+
+export interface WelcomeProtocol {
+    subprotocol: string;
+    version: number;
+    batch?: boolean;
+    qos?: boolean;
+    max_message_size: number;
+    max_doc_message_size?: number;
+    max_signal_size?: number;
+    max_chunk_size?: number;
+    capabilities?: ClientCapabilities;
+}
+
+/** ClientEvents are the events clients send, by type */
+export interface ClientEvents {
+    hello: HelloEvent;
+    send_message: SendMessageEvent;
+    join_room: JoinRoomEvent;
+    switch_room: SwitchRoomEvent;
+    send_direct_message: SendDirectMessageEvent;
+    register_push_token: PushToken;
+    schedule_message: ScheduleMessageEvent;
+    list_scheduled_messages: Record<string, never>;
+    cancel_scheduled_message: CancelScheduledMessageEvent;
+    get_history: GetHistoryEvent;
+    ack: AckEvent;
+    typing: TypingEvent;
+    add_reaction: ReactionEvent;
+    remove_reaction: ReactionEvent;
+    get_room: GetRoomEvent;
+    update_room: UpdateRoomEvent;
+    invite_to_room: InviteToRoomEvent;
+    list_rooms: ListRoomsEvent;
+    "e2ee.publish_keys": PublishKeysEvent;
+    "e2ee.fetch_keys": FetchKeysEvent;
+    "e2ee.send": E2EESendEvent;
+    list_devices: Record<string, never>;
+    revoke_device: RevokeDeviceEvent;
+    time_sync: TimeSyncEvent;
+    bulk_add_members: BulkAddMembersEvent;
+    bulk_announce: BulkAnnounceEvent;
+    bulk_kick: BulkKickEvent;
+    stats: Record<string, never>;
+    set_nickname: SetNicknameEvent;
+    get_profile: GetProfileEvent;
+    update_profile: UpdateProfileEvent;
+    set_status: SetStatusEvent;
+    search_messages: SearchMessagesEvent;
+    subscribe_state: SubscribeStateEvent;
+    unsubscribe_state: UnsubscribeStateEvent;
+    update_state: UpdateStateEvent;
+    rtc_signal: RTCSignalEvent;
+    get_ice_servers: Record<string, never>;
+    open_doc: OpenDocEvent;
+    close_doc: OpenDocEvent;
+    doc_update: DocUpdateEvent;
+    doc_awareness: DocAwarenessEvent;
+    doc_snapshot: DocSnapshotEvent;
+    chunk: ChunkEvent;
+    create_lobby: CreateLobbyEvent;
+    join_lobby: JoinLobbyEvent;
+    find_lobby: CreateLobbyEvent;
+    leave_lobby: Record<string, never>;
+    lobby_ready: LobbyReadyEvent;
+    list_lobbies: ListLobbiesEvent;
+}
+
+/** ServerEvents are the events the server sends, by type */
+export interface ServerEvents {
+    welcome: WelcomeEvent;
+    error: ErrorEvent;
+    system: SystemEvent;
+    ephemeral: EphemeralEvent;
+    server_draining: ServerDrainingEvent;
+    slow_consumer: SlowConsumerEvent;
+    session_recording: SessionRecordingEvent;
+    account_erased: AccountErasedEvent;
+    new_message: NewMessageEvent;
+    direct_message: DirectMessageEvent;
+    mention: MentionEvent;
+    user_typing: UserTypingEvent;
+    reaction_updated: ReactionUpdatedEvent;
+    history: HistoryEvent;
+    message_scheduled: ScheduledMessage;
+    scheduled_messages: ScheduledMessagesEvent;
+    scheduled_message_cancelled: CancelScheduledMessageEvent;
+    room_switched: RoomSwitchedEvent;
+    member_joined: MemberEvent;
+    member_left: MemberEvent;
+    room_info: RoomInfo;
+    room_updated: RoomUpdatedEvent;
+    room_invite: RoomInviteEvent;
+    room_list: RoomListEvent;
+    room_closed: RoomClosedEvent;
+    presence: PresenceEvent;
+    "e2ee.keys_published": KeysPublishedEvent;
+    "e2ee.key_bundles": KeyBundlesEvent;
+    "e2ee.message": E2EEMessageEvent;
+    device_list: DeviceListEvent;
+    device_revoked: DeviceRevokedEvent;
+    time_sync: TimeSyncEvent;
+    bulk_result: BulkResultEvent;
+    stats: ConnectionStatsEvent;
+    nickname_changed: NicknameChangedEvent;
+    profile: ProfileEvent;
+    profile_updated: ProfileEvent;
+    search_results: SearchResultsEvent;
+    state_snapshot: StateSnapshotEvent;
+    state_delta: StateDeltaEvent;
+    rtc_signal: RTCSignalEvent;
+    ice_servers: ICEServersEvent;
+    doc_opened: DocOpenedEvent;
+    doc_updated: DocUpdatedEvent;
+    doc_awareness: DocAwarenessEvent;
+    compact_doc: CompactDocEvent;
+    countdown_started: CountdownEvent;
+    countdown_cancelled: CountdownEvent;
+    lobbies: LobbiesEvent;
+    lobby_updated: Lobby;
+    lobby_left: LobbyLeftEvent;
+    lobby_started: LobbyStartedEvent;
+    chunk: ChunkEvent;
+}
+
+/** Envelope is an event on the wire, id and ts are set with the strict envelope */
+export interface Envelope<T extends string = string, P = unknown> {
+    id?: string;
+    ts?: string | number;
+    type: T;
+    room?: string;
+    payload: P;
+}
+
+export interface ChatClientOptions {
+    /** strict speaks chat.v2.json, sending every event with an id and a timestamp */
+    strict?: boolean;
+    /** timestamps is how the server reads ts, rfc3339 unless the server is configured with unix_ms */
+    timestamps?: "rfc3339" | "unix_ms";
+    /** protocols are offered instead of the one picked by strict */
+    protocols?: string[];
+}
+
+export declare const clientEvents: readonly (keyof ClientEvents)[];
+export declare const serverEvents: readonly (keyof ServerEvents)[];
+
+/** ChatClient sends and receives the events of the chat server over a WebSocket */
+export declare class ChatClient {
+    constructor(url: string, options?: ChatClientOptions);
+    /** connect opens the WebSocket, it resolves once it is open */
+    connect(): Promise<void>;
+    /** send sends an event, it throws if the client isn't connected */
+    send<K extends keyof ClientEvents>(type: K, payload: ClientEvents[K]): void;
+    /** on calls the handler for every event of the type, it returns a function removing it */
+    on<K extends keyof ServerEvents>(type: K, handler: (payload: ServerEvents[K], event: Envelope<K, ServerEvents[K]>) => void): () => void;
+    /** close closes the WebSocket */
+    close(code?: number, reason?: string): void;
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The TypeScript definitions and the JavaScript client in sdk/ are generated from
+// the event catalog, see catalog.go, with
+//
+//	go generate
+//
+// which runs the server with -generate-sdk. Every payload struct becomes an
+// interface with the JSON names of its fields, fields with omitempty or pointers
+// are optional. ClientEvents and ServerEvents map the event types to their
+// payloads, so ChatClient.send and ChatClient.on are checked by the compiler:
+//
+//	import { ChatClient } from "./sdk/chat.js";
+//
+//	const client = new ChatClient("wss://chat.example.com/ws?otp=" + otp);
+//	await client.connect();
+//	client.on("new_message", (message) => console.log(message.from, message.message));
+//	client.send("send_message", { message: "hi" });
+//
+// After changing a payload or adding an event to the catalog, run go generate and
+// commit the regenerated files along with the change.
+
+//go:generate go run . -generate-sdk sdk
+
+// sdkHeader is the first line of the generated files
+const sdkHeader = "// Code generated by go run . -generate-sdk; DO NOT EDIT.\n"
+
+var (
+	timeType      = reflect.TypeFor[time.Time]()
+	durationType  = reflect.TypeFor[Duration]()
+	rawJSONType   = reflect.TypeFor[json.RawMessage]()
+	marshalerType = reflect.TypeFor[json.Marshaler]()
+)
+
+// generateSDK writes chat.d.ts and chat.js for the events of the catalog into the directory
+func generateSDK(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	specs := EventSpecs()
+	if err := os.WriteFile(filepath.Join(dir, "chat.d.ts"), []byte(typescriptDefinitions(specs)), 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "chat.js"), []byte(javascriptClient(specs)), 0o644)
+}
+
+// tsTypes collects the interfaces of the named structs used by the payloads
+type tsTypes struct {
+	interfaces map[string]string
+}
+
+// typeOf returns the TypeScript type of the Go type, adding the interfaces it needs
+func (g *tsTypes) typeOf(t reflect.Type) string {
+	switch t {
+	case timeType, durationType:
+		return "string"
+	case rawJSONType:
+		return "unknown"
+	}
+	if t.Kind() != reflect.Pointer && reflect.PointerTo(t).Implements(marshalerType) {
+		return "unknown"
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.typeOf(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json writes bytes as base64
+			return "string"
+		}
+		element := g.typeOf(t.Elem())
+		if strings.ContainsAny(element, " |") {
+			element = "(" + element + ")"
+		}
+		return element + "[]"
+	case reflect.Map:
+		return "Record<string, " + g.typeOf(t.Elem()) + ">"
+	case reflect.Struct:
+		if t.Name() == "" {
+			return "{ " + strings.Join(g.fields(t), " ") + " }"
+		}
+		if _, ok := g.interfaces[t.Name()]; !ok {
+			// Marks it before the fields, so types referring to themselves end
+			g.interfaces[t.Name()] = ""
+			g.interfaces[t.Name()] = "export interface " + t.Name() + " {\n    " + strings.Join(g.fields(t), "\n    ") + "\n}\n"
+		}
+		return t.Name()
+	}
+	return "unknown"
+}
+
+// fields returns the fields of the struct as encoding/json writes them, the fields
+// of embedded structs are part of the struct
+func (g *tsTypes) fields(t reflect.Type) []string {
+	var fields []string
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		fieldType := field.Type
+		if field.Anonymous && name == "" {
+			embedded := fieldType
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				fields = append(fields, g.fields(embedded)...)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		optional := ""
+		if slices.Contains(strings.Split(options, ","), "omitempty") || fieldType.Kind() == reflect.Pointer {
+			optional = "?"
+		}
+		fields = append(fields, tsKey(name)+optional+": "+g.typeOf(fieldType)+";")
+	}
+	return fields
+}
+
+// tsKey returns the name as a key of an interface, quoted unless it is an identifier
+func tsKey(name string) string {
+	for i, r := range name {
+		if r != '_' && r != '$' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return strconv.Quote(name)
+		}
+	}
+	return name
+}
+
+// payloadType returns the TypeScript type of the payload of the event
+func (g *tsTypes) payloadType(spec EventSpec) string {
+	if spec.Payload == nil {
+		return "Record<string, never>"
+	}
+	return g.typeOf(reflect.TypeOf(spec.Payload))
+}
+
+// typescriptDefinitions returns chat.d.ts
+func typescriptDefinitions(specs []EventSpec) string {
+	g := &tsTypes{interfaces: make(map[string]string)}
+	events := map[string]*strings.Builder{DirectionClient: {}, DirectionServer: {}}
+	for _, spec := range specs {
+		fmt.Fprintf(events[spec.Direction], "    %s: %s;\n", tsKey(spec.Type), g.payloadType(spec))
+	}
+
+	var b strings.Builder
+	b.WriteString(sdkHeader + "\n")
+	for _, name := range slices.Sorted(maps.Keys(g.interfaces)) {
+		b.WriteString(g.interfaces[name] + "\n")
+	}
+	b.WriteString("/** ClientEvents are the events clients send, by type */\nexport interface ClientEvents {\n" + events[DirectionClient].String() + "}\n\n")
+	b.WriteString("/** ServerEvents are the events the server sends, by type */\nexport interface ServerEvents {\n" + events[DirectionServer].String() + "}\n\n")
+	b.WriteString(typescriptClient)
+	return b.String()
+}
+
+// javascriptClient returns chat.js
+func javascriptClient(specs []EventSpec) string {
+	types := map[string][]string{}
+	for _, spec := range specs {
+		types[spec.Direction] = append(types[spec.Direction], strconv.Quote(spec.Type))
+	}
+
+	var b strings.Builder
+	b.WriteString(sdkHeader + "\n")
+	fmt.Fprintf(&b, "/** clientEvents are the types of the events clients send */\nexport const clientEvents = Object.freeze([\n    %s,\n]);\n\n", strings.Join(types[DirectionClient], ",\n    "))
+	fmt.Fprintf(&b, "/** serverEvents are the types of the events the server sends */\nexport const serverEvents = Object.freeze([\n    %s,\n]);\n\n", strings.Join(types[DirectionServer], ",\n    "))
+	b.WriteString(javascriptChatClient)
+	return b.String()
+}
+
+// typescriptClient declares the client of chat.js
+const typescriptClient = `/** Envelope is an event on the wire, id and ts are set with the strict envelope */
+export interface Envelope<T extends string = string, P = unknown> {
+    id?: string;
+    ts?: string | number;
+    type: T;
+    room?: string;
+    payload: P;
+}
+
+export interface ChatClientOptions {
+    /** strict speaks chat.v2.json, sending every event with an id and a timestamp */
+    strict?: boolean;
+    /** timestamps is how the server reads ts, rfc3339 unless the server is configured with unix_ms */
+    timestamps?: "rfc3339" | "unix_ms";
+    /** protocols are offered instead of the one picked by strict */
+    protocols?: string[];
+}
+
+export declare const clientEvents: readonly (keyof ClientEvents)[];
+export declare const serverEvents: readonly (keyof ServerEvents)[];
+
+/** ChatClient sends and receives the events of the chat server over a WebSocket */
+export declare class ChatClient {
+    constructor(url: string, options?: ChatClientOptions);
+    /** connect opens the WebSocket, it resolves once it is open */
+    connect(): Promise<void>;
+    /** send sends an event, it throws if the client isn't connected */
+    send<K extends keyof ClientEvents>(type: K, payload: ClientEvents[K]): void;
+    /** on calls the handler for every event of the type, it returns a function removing it */
+    on<K extends keyof ServerEvents>(type: K, handler: (payload: ServerEvents[K], event: Envelope<K, ServerEvents[K]>) => void): () => void;
+    /** close closes the WebSocket */
+    close(code?: number, reason?: string): void;
+}
+`
+
+// javascriptChatClient is the client of chat.js
+const javascriptChatClient = `/** ChatClient sends and receives the events of the chat server over a WebSocket */
+export class ChatClient {
+    constructor(url, options = {}) {
+        this.url = url;
+        this.strict = options.strict === true;
+        this.timestamps = options.timestamps ?? "rfc3339";
+        this.protocols = options.protocols ?? [this.strict ? "chat.v2.json" : "chat.v1.json"];
+        this.handlers = new Map();
+        this.socket = null;
+    }
+
+    /** connect opens the WebSocket, it resolves once it is open */
+    connect() {
+        return new Promise((resolve, reject) => {
+            const socket = new WebSocket(this.url, this.protocols);
+            socket.onopen = () => resolve();
+            socket.onerror = (error) => reject(error);
+            socket.onmessage = (message) => this.receive(message.data);
+            this.socket = socket;
+        });
+    }
+
+    /** send sends an event, it throws if the client isn't connected */
+    send(type, payload) {
+        if (this.socket === null || this.socket.readyState !== WebSocket.OPEN) {
+            throw new Error("not connected");
+        }
+        const event = { type, payload: payload ?? {} };
+        if (this.strict) {
+            event.id = crypto.randomUUID();
+            event.ts = this.timestamps === "unix_ms" ? Date.now() : new Date().toISOString();
+        }
+        this.socket.send(JSON.stringify(event));
+    }
+
+    /** on calls the handler for every event of the type, it returns a function removing it */
+    on(type, handler) {
+        if (!this.handlers.has(type)) {
+            this.handlers.set(type, new Set());
+        }
+        this.handlers.get(type).add(handler);
+        return () => this.handlers.get(type).delete(handler);
+    }
+
+    /** close closes the WebSocket */
+    close(code, reason) {
+        if (this.socket !== null) {
+            this.socket.close(code, reason);
+            this.socket = null;
+        }
+    }
+
+    // receive hands the events of a frame to their handlers, batches hold several
+    receive(data) {
+        const parsed = JSON.parse(data);
+        for (const event of Array.isArray(parsed) ? parsed : [parsed]) {
+            for (const handler of this.handlers.get(event.type) ?? []) {
+                handler(event.payload, event);
+            }
+        }
+    }
+}
+`
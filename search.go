@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Clients search the chat messages with search_messages, backends with GET
+// /api/search. A search finds the messages containing all words of the query,
+// ignoring case, newest first. Without a room it goes through the rooms the user
+// is a member of, the ones the user was in or was added to and may still join,
+// leaving out end-to-end encrypted rooms the server can't read. Other rooms the
+// user may join are searched by naming them. Each result carries the positions
+// of the matched words so they can be highlighted. Results are paged with the
+// Next of the previous page.
+//
+// The Postgres store searches a full text index, the memory and file stores go
+// through the messages they hold.
+
+const (
+	// EventSearchMessages is sent by a client to search the messages of its rooms
+	EventSearchMessages = "search_messages"
+	// EventSearchResults is the response to search_messages
+	EventSearchResults = "search_results"
+)
+
+var (
+	ErrEmptySearch = errors.New("search query has no words")
+)
+
+var (
+	// defaultSearchLimit is the page size when the client doesn't ask for one
+	defaultSearchLimit = 20
+	// maxSearchLimit is the largest page a client can ask for
+	maxSearchLimit = 100
+	// maxSearchTerms is how many words of a query are searched for, the rest are ignored
+	maxSearchTerms = 10
+)
+
+// MessageSearch is a search as passed to the store
+type MessageSearch struct {
+	// Terms are lower case words, a message has to contain all of them
+	Terms []string
+	// Rooms are the rooms to search
+	Rooms  []string
+	Offset int
+	Limit  int
+}
+
+// SearchMessagesEvent is the payload sent in the
+// search_messages event
+type SearchMessagesEvent struct {
+	Query string `json:"query"`
+	// Room limits the search to one room, all rooms of the user are searched if empty
+	Room string `json:"room,omitempty"`
+	// Offset is the Next of the previous page, 0 for the first page
+	Offset int `json:"offset,omitempty"`
+	Limit  int `json:"limit,omitempty"`
+}
+
+// Highlight is where a matched word is in the message, in characters
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// SearchResult is a message found by a search
+type SearchResult struct {
+	Room    string          `json:"room"`
+	Seq     uint64          `json:"seq"`
+	Message NewMessageEvent `json:"message"`
+	// Highlights are the matched words in Message.Message
+	Highlights []Highlight `json:"highlights"`
+}
+
+// SearchResultsEvent is the payload sent in the
+// search_results event, and the response of GET /api/search
+type SearchResultsEvent struct {
+	Query   string         `json:"query"`
+	Results []SearchResult `json:"results"`
+	// Next is set if there are more results, it is sent as Offset to get them
+	Next int `json:"next,omitempty"`
+}
+
+// isWordRune returns true for the characters words are made of
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// searchTerms returns the unique lower case words of the query
+func searchTerms(query string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool { return !isWordRune(r) }) {
+		if len(terms) == maxSearchTerms {
+			break
+		}
+		if !slices.Contains(terms, word) {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// matchesTerms returns true if the text contains all terms as words
+func matchesTerms(text string, terms []string) bool {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !isWordRune(r) })
+	for _, term := range terms {
+		if !slices.Contains(words, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// highlights returns where the words of the text matching a term are, in characters
+func highlights(text string, terms []string) []Highlight {
+	list := []Highlight{}
+	start := -1
+	var word strings.Builder
+	end := func(pos int) {
+		if start >= 0 && slices.Contains(terms, word.String()) {
+			list = append(list, Highlight{Start: start, End: pos})
+		}
+		start = -1
+		word.Reset()
+	}
+
+	pos := 0
+	for _, r := range text {
+		if isWordRune(r) {
+			if start < 0 {
+				start = pos
+			}
+			word.WriteRune(unicode.ToLower(r))
+		} else {
+			end(pos)
+		}
+		pos++
+	}
+	end(pos)
+	return list
+}
+
+// addMembership records the user as a member of the room, failures are only
+// logged as the user is in the room either way
+func (m *Manager) addMembership(username, room string) {
+	if err := m.store.AddMembership(username, room); err != nil {
+		log.Printf("recording %s as member of %s: %v", username, room, err)
+	}
+}
+
+// searchableRooms returns the rooms the user is a member of and may still read,
+// allowed filters out the rooms the caller can't use
+func (m *Manager) searchableRooms(username string, allowed func(room string) bool) ([]string, error) {
+	rooms, err := m.store.ListMemberships(username)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, room := range rooms {
+		if room.admits(username) && !room.E2EE && allowed(room.Name) {
+			names = append(names, room.Name)
+		}
+	}
+	return names, nil
+}
+
+// searchMessages runs the search for the user, allowed filters out the rooms the caller can't use
+func (m *Manager) searchMessages(username string, req SearchMessagesEvent, allowed func(room string) bool) (SearchResultsEvent, error) {
+	terms := searchTerms(req.Query)
+	if len(terms) == 0 {
+		return SearchResultsEvent{}, ErrEmptySearch
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	limit = min(limit, maxSearchLimit)
+
+	var rooms []string
+	if req.Room != "" {
+		room, err := m.roomSettings(req.Room)
+		if err != nil {
+			return SearchResultsEvent{}, err
+		}
+		if !allowed(room.Name) || !room.admits(username) {
+			return SearchResultsEvent{}, fmt.Errorf("%w: %s", ErrNotInvited, room.Name)
+		}
+		if room.E2EE {
+			return SearchResultsEvent{}, fmt.Errorf("%w: %s", ErrE2EERoom, room.Name)
+		}
+		rooms = []string{room.Name}
+	} else {
+		var err error
+		if rooms, err = m.searchableRooms(username, allowed); err != nil {
+			return SearchResultsEvent{}, err
+		}
+	}
+
+	results := SearchResultsEvent{Query: req.Query, Results: []SearchResult{}}
+	if len(rooms) == 0 {
+		return results, nil
+	}
+	// One more than asked for tells whether there is another page
+	found, err := m.store.SearchMessages(MessageSearch{Terms: terms, Rooms: rooms, Offset: max(req.Offset, 0), Limit: limit + 1})
+	if err != nil {
+		return SearchResultsEvent{}, err
+	}
+	if len(found) > limit {
+		found = found[:limit]
+		results.Next = max(req.Offset, 0) + limit
+	}
+
+	for _, msg := range found {
+		var message NewMessageEvent
+		if err := json.Unmarshal(msg.Event.Payload, &message); err != nil {
+			continue
+		}
+		results.Results = append(results.Results, SearchResult{
+			Room:       msg.Room,
+			Seq:        msg.Seq,
+			Message:    message,
+			Highlights: highlights(message.Message, terms),
+		})
+	}
+	return results, nil
+}
+
+// SearchMessagesHandler answers with the messages matching the search
+func SearchMessagesHandler(event Event, c *Client) error {
+	var req SearchMessagesEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	results, err := c.manager.searchMessages(c.username, req, c.allowedRoom)
+	if err != nil {
+		return err
+	}
+	return c.manager.replyJSON(c, EventSearchResults, results)
+}
+
+// searchHandler is the REST version of search_messages, like
+// GET /api/search?query=release+notes&room=general&offset=20&limit=20
+// An API key searches as its user, the API token has to name the user with ?user=
+func (m *Manager) searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := SearchMessagesEvent{Query: query.Get("query"), Room: query.Get("room")}
+	for name, dest := range map[string]*int{"offset": &req.Offset, "limit": &req.Limit} {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, name+" must be a number", http.StatusBadRequest)
+				return
+			}
+			*dest = n
+		}
+	}
+
+	username := query.Get("user")
+	allowed := func(string) bool { return true }
+	if key, ok := requestAPIKey(r); ok {
+		username = key.Username
+		allowed = key.allowsRoom
+	}
+	if username == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+
+	results, err := m.searchMessages(username, req, allowed)
+	switch {
+	case errors.Is(err, ErrEmptySearch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrRoomNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotInvited), errors.Is(err, ErrE2EERoom):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, results)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSearchOnlyGoesThroughMemberships(t *testing.T) {
+	server, m, err := NewTestServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	alice := server.Connect("alice")
+	bob := server.Connect("bob")
+	if err := routeAs(t, m, alice, EventJoinRoom, JoinRoomEvent{Room: "release"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := routeAs(t, m, alice, EventSendMessage, SendMessageEvent{Message: "release notes are out"}); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(username, room string) int {
+		t.Helper()
+		results, err := m.searchMessages(username, SearchMessagesEvent{Query: "release notes", Room: room}, func(string) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(results.Results)
+	}
+	if n := search("alice", ""); n != 1 {
+		t.Errorf("alice found %d messages in the rooms of alice, want 1", n)
+	}
+	// The room is public, bob may search it by name but bob isn't a member
+	if n := search("bob", ""); n != 0 {
+		t.Errorf("bob found %d messages in rooms bob never joined", n)
+	}
+	if n := search("bob", "release"); n != 1 {
+		t.Errorf("bob found %d messages searching the room by name, want 1", n)
+	}
+
+	if err := routeAs(t, m, bob, EventJoinRoom, JoinRoomEvent{Room: "release"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := search("bob", ""); n != 1 {
+		t.Errorf("bob found %d messages after joining, want 1", n)
+	}
+	rooms, err := m.store.ListMemberships("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 2 || rooms[0].Name != defaultRoom || rooms[1].Name != "release" {
+		t.Errorf("bob is a member of %v, want %s and release", rooms, defaultRoom)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Secrets in the config, like the admin token or the database URL, don't have to
+// be written into the file. A value can point to where the secret is kept instead:
+//
+//	"admin_token": "env:ADMIN_TOKEN"           the environment variable
+//	"api_token": "file:/run/secrets/api_token" the file, without the trailing newline
+//	"database_url": "vault:chat/db#url"        the field of the Vault KV v2 secret
+//
+// They are resolved when the config is loaded, and again on every reload, so
+// rotated secrets are picked up with a reload. Values starting with anything
+// else are taken as they are.
+
+var (
+	ErrSecretNotFound = errors.New("secret not found")
+	ErrVaultDisabled  = errors.New("vault is not configured")
+)
+
+// secretsTimeout bounds looking up all secrets of the config
+var secretsTimeout = 10 * time.Second
+
+// SecretSource looks up secrets by the reference after the scheme, like ADMIN_TOKEN of env:ADMIN_TOKEN
+type SecretSource interface {
+	Secret(ctx context.Context, ref string) (string, error)
+}
+
+// EnvSecrets reads secrets from environment variables
+type EnvSecrets struct{}
+
+func (EnvSecrets) Secret(ctx context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("%w: environment variable %s", ErrSecretNotFound, name)
+	}
+	return value, nil
+}
+
+// FileSecrets reads secrets from files, like the ones mounted by Docker or Kubernetes
+type FileSecrets struct{}
+
+func (FileSecrets) Secret(ctx context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// VaultSecrets reads fields of secrets from the KV version 2 engine of HashiCorp Vault,
+// the reference is the path of the secret and the field, like chat/db#url
+type VaultSecrets struct {
+	Addr  string
+	Token string
+	// Mount is where the KV engine is mounted, secret if empty
+	Mount  string
+	Client *http.Client
+}
+
+func (v VaultSecrets) Secret(ctx context.Context, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok {
+		return "", fmt.Errorf("vault reference %q needs a #field", ref)
+	}
+	mount := v.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	endpoint, err := url.JoinPath(v.Addr, "v1", mount, "data", path)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("%w: vault %s", ErrSecretNotFound, path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault answered %s for %s", resp.Status, path)
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+	value, ok := secret.Data.Data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("%w: vault %s#%s", ErrSecretNotFound, path, field)
+	}
+	return value, nil
+}
+
+// disabledSecrets fails every lookup, it stands in for Vault when it isn't configured
+type disabledSecrets struct {
+	err error
+}
+
+func (d disabledSecrets) Secret(ctx context.Context, ref string) (string, error) {
+	return "", d.err
+}
+
+// secretSources returns the sources by scheme for the config. The Vault token
+// may itself come from the environment or a file, VAULT_TOKEN is used if it isn't set
+func secretSources(ctx context.Context, config Config) (map[string]SecretSource, error) {
+	sources := map[string]SecretSource{
+		"env":   EnvSecrets{},
+		"file":  FileSecrets{},
+		"vault": disabledSecrets{err: ErrVaultDisabled},
+	}
+	if config.Vault.Addr != "" {
+		token := config.Vault.Token
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		token, err := resolveSecret(ctx, sources, token)
+		if err != nil {
+			return nil, fmt.Errorf("vault token: %w", err)
+		}
+		sources["vault"] = VaultSecrets{Addr: config.Vault.Addr, Token: token, Mount: config.Vault.Mount}
+	}
+	return sources, nil
+}
+
+// resolveSecret returns the secret the value points to, or the value if it doesn't point anywhere
+func resolveSecret(ctx context.Context, sources map[string]SecretSource, value string) (string, error) {
+	scheme, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return value, nil
+	}
+	source, ok := sources[scheme]
+	if !ok {
+		return value, nil
+	}
+	return source.Secret(ctx, ref)
+}
+
+// secretFields are the settings that may point to secrets
+func secretFields(config *Config) map[string]*string {
+	fields := map[string]*string{
+		"admin_token":                           &config.AdminToken,
+		"api_token":                             &config.APIToken,
+		"database_url":                          &config.DatabaseURL,
+		"oidc.client_secret":                    &config.OIDC.ClientSecret,
+		"notifications.fcm.service_account_key": &config.Notifications.FCM.ServiceAccountKey,
+		"notifications.apns.private_key":        &config.Notifications.APNs.PrivateKey,
+		"notifications.webhook":                 &config.Notifications.Webhook,
+		"registration.verification_webhook":     &config.Registration.VerificationWebhook,
+		"webrtc.turn.secret":                    &config.WebRTC.TURN.Secret,
+	}
+	for i := range config.SigningKeys {
+		fields[fmt.Sprintf("signing_keys[%d]", i)] = &config.SigningKeys[i].Secret
+	}
+	return fields
+}
+
+// resolveSecrets replaces the settings pointing to secrets with the secrets,
+// the passwords of the users of the config included
+func resolveSecrets(config *Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), secretsTimeout)
+	defer cancel()
+
+	sources, err := secretSources(ctx, *config)
+	if err != nil {
+		return err
+	}
+	for name, field := range secretFields(config) {
+		if *field, err = resolveSecret(ctx, sources, *field); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for username, password := range config.Users {
+		if config.Users[username], err = resolveSecret(ctx, sources, password); err != nil {
+			return fmt.Errorf("users.%s: %w", username, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Tokens the server signs itself, like the csrf tokens, carry the ID of the key
+// they were signed with. The first of the signing_keys signs new tokens, all of
+// them are accepted, so keys are rotated by putting a new one first and removing
+// the old one once its tokens have expired, with a config reload each time. Without
+// signing keys a random key is made at the start, tokens then only work on this
+// instance and until it restarts.
+
+// localKeyID is the ID of the key made at the start
+const localKeyID = "local"
+
+// newLocalSigningKey returns the key made at the start
+func newLocalSigningKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// signingKeys returns the configured keys, or the one made at the start
+func (m *Manager) signingKeys() []SigningKey {
+	if keys := m.config().SigningKeys; len(keys) > 0 {
+		return keys
+	}
+	return []SigningKey{{ID: localKeyID, Secret: string(m.localSigningKey)}}
+}
+
+// sign returns the ID of the current key and the signature of the data with it
+func (m *Manager) sign(data string) (string, string) {
+	key := m.signingKeys()[0]
+	return key.ID, signWith(key.Secret, data)
+}
+
+// verifySignature returns true if the signature of the data was made with the key of the ID
+func (m *Manager) verifySignature(data, keyID, signature string) bool {
+	for _, key := range m.signingKeys() {
+		if key.ID == keyID {
+			return hmac.Equal([]byte(signature), []byte(signWith(key.Secret, data)))
+		}
+	}
+	return false
+}
+
+// signWith returns the hex HMAC-SHA256 of the data
+func signWith(secret, data string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
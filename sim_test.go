@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"arti.soft/websockets-go/wstest"
+)
+
+// The simulation drives thousands of scripted clients through a Manager to find
+// ordering and race bugs that tests with a handful of clients don't hit. It runs
+// a wstest.Server on a ManualClock with clients connected over wstest.Conn, and a
+// script made from a seed picks what happens next: a client sends a message,
+// switches room, disconnects or comes back, or the clock moves on. Every step
+// waits until the server confirmed it, so the same seed runs the same script,
+// and what the server does meanwhile on its own goroutines is what is tested.
+//
+// TestSimulation runs a short script, bigger ones are run with its flags:
+//
+//	go test -run TestSimulation -sim-clients 2000 -sim-steps 20000 -sim-seed 42
+//
+// Once the script ran the invariants are checked:
+//   - every message the sender got back is stored exactly once in its room,
+//     unless the store dropped it as one of the oldest of the room
+//   - every client that was in the room when a message was acked received it,
+//     unless it disconnected since
+//   - every client received the messages of a room in the order of their seq
+//   - the clients the Manager has in each room are the ones the script put there
+//
+// A broken invariant is reported with the seed, running it again with that seed
+// replays the same script.
+
+var (
+	simClients = flag.Int("sim-clients", 50, "clients of TestSimulation")
+	simSteps   = flag.Int("sim-steps", 500, "steps of TestSimulation")
+	simSeed    = flag.Uint64("sim-seed", 1, "seed of the script of TestSimulation")
+)
+
+var (
+	// simStepTimeout is how long a step waits for the server to confirm it
+	simStepTimeout = 5 * time.Second
+	// simRooms is how many rooms the clients move between
+	simRooms = 5
+)
+
+// SimulationConfig says how big the simulation is
+type SimulationConfig struct {
+	Seed    uint64
+	Clients int
+	Steps   int
+}
+
+// SimulationReport is the outcome of a simulation
+type SimulationReport struct {
+	Seed    uint64 `json:"seed"`
+	Clients int    `json:"clients"`
+	Steps   int    `json:"steps"`
+	// Acked is how many messages the senders got back, Rejected how many the
+	// server refused, like over the rate limit
+	Acked       int `json:"acked"`
+	Rejected    int `json:"rejected"`
+	Switches    int `json:"switches"`
+	Disconnects int `json:"disconnects"`
+	Reconnects  int `json:"reconnects"`
+	// Violations are the broken invariants, the simulation passed if it is empty
+	Violations []string `json:"violations"`
+	Duration   Duration `json:"duration"`
+}
+
+// simMessage is a message the sender got back
+type simMessage struct {
+	id   string
+	room string
+	// recipients are the clients in the room when the message was acked
+	recipients []simRecipient
+}
+
+// simRecipient is a client in the room of a message, it is only expected to
+// receive it if it wasn't disconnected since, it may have been on its way then
+type simRecipient struct {
+	index      int
+	connection int
+}
+
+// simClient is a scripted client, it keeps everything it received across reconnects
+type simClient struct {
+	index     int
+	username  string
+	client    *wstest.Client
+	connected bool
+	room      string
+	// connection counts the connections of the client
+	connection int
+
+	lock   sync.Mutex
+	events []wstest.Event
+	// messages are the new_message events received, in order
+	messages []simReceived
+	// ids holds the IDs of the messages received
+	ids map[string]bool
+	// notify is signaled when an event was received
+	notify chan struct{}
+}
+
+// simReceived is a message a client received
+type simReceived struct {
+	id  string
+	seq uint64
+}
+
+// receive reads the events of the connection until it is closed
+func (c *simClient) receive(conn *wstest.Client) {
+	for {
+		event, err := conn.Receive(time.Hour)
+		if errors.Is(err, ErrTransportTimeout) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		c.lock.Lock()
+		c.events = append(c.events, event)
+		if event.Type == EventNewMessage {
+			var message struct {
+				ID  string `json:"id"`
+				Seq uint64 `json:"seq"`
+			}
+			json.Unmarshal(event.Payload, &message)
+			c.messages = append(c.messages, simReceived{id: message.ID, seq: message.Seq})
+			c.ids[message.ID] = true
+		}
+		c.lock.Unlock()
+		select {
+		case c.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// received returns how many events were received so far
+func (c *simClient) received() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.events)
+}
+
+// await waits for an event received after the first from events that matches
+func (c *simClient) await(from int, match func(wstest.Event) bool) (wstest.Event, error) {
+	deadline := time.After(simStepTimeout)
+	for {
+		c.lock.Lock()
+		for _, event := range c.events[from:] {
+			if match(event) {
+				c.lock.Unlock()
+				return event, nil
+			}
+		}
+		from = len(c.events)
+		c.lock.Unlock()
+
+		select {
+		case <-c.notify:
+		case <-deadline:
+			return wstest.Event{}, fmt.Errorf("client %d: no matching event within %s", c.index, simStepTimeout)
+		}
+	}
+}
+
+// simulation is a running simulation
+type simulation struct {
+	server   *wstest.Server
+	manager  *Manager
+	clock    *ManualClock
+	random   *rand.Rand
+	clients  []*simClient
+	messages []simMessage
+	report   SimulationReport
+}
+
+// connect connects the client and waits for its welcome
+func (s *simulation) connect(c *simClient) error {
+	from := c.received()
+	c.client = s.server.Connect(c.username)
+	c.connected = true
+	c.connection++
+	c.room = defaultRoom
+	go c.receive(c.client)
+	_, err := c.await(from, func(e wstest.Event) bool { return e.Type == EventWelcome })
+	return err
+}
+
+// disconnect closes the client and waits until the Manager removed it
+func (s *simulation) disconnect(c *simClient) error {
+	c.client.Close()
+	c.connected = false
+	deadline := time.Now().Add(simStepTimeout)
+	for {
+		if _, ok := s.manager.clientByID(c.client.ID); !ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("client %d was not removed within %s", c.index, simStepTimeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// switchRoom moves the client and waits for room_switched
+func (s *simulation) switchRoom(c *simClient, room string) error {
+	from := c.received()
+	if err := c.client.Send(EventSwitchRoom, SwitchRoomEvent{Room: room, History: -1}); err != nil {
+		return err
+	}
+	event, err := c.await(from, func(e wstest.Event) bool { return e.Type == EventRoomSwitched || e.Type == EventError })
+	if err != nil {
+		return err
+	}
+	if event.Type == EventError {
+		return fmt.Errorf("client %d could not switch to %s: %s", c.index, room, event.Payload)
+	}
+	c.room = room
+	return nil
+}
+
+// send sends a message and waits until the sender got it back, the message is
+// acked then and all clients in the room are expected to receive it
+func (s *simulation) send(c *simClient, step int) error {
+	text := fmt.Sprintf("step %d from %d", step, c.index)
+	from := c.received()
+	if err := c.client.Send(EventSendMessage, SendMessageEvent{Message: text}); err != nil {
+		return err
+	}
+	event, err := c.await(from, func(e wstest.Event) bool {
+		return e.Type == EventError || (e.Type == EventNewMessage && simMessageText(e) == text)
+	})
+	if err != nil {
+		return err
+	}
+	if event.Type == EventError {
+		s.report.Rejected++
+		return nil
+	}
+
+	var message NewMessageEvent
+	json.Unmarshal(event.Payload, &message)
+	acked := simMessage{id: message.ID, room: c.room}
+	for _, other := range s.clients {
+		if other.connected && other.room == c.room {
+			acked.recipients = append(acked.recipients, simRecipient{index: other.index, connection: other.connection})
+		}
+	}
+	s.messages = append(s.messages, acked)
+	s.report.Acked++
+	return nil
+}
+
+// step runs the next step of the script
+func (s *simulation) step(step int) error {
+	c := s.clients[s.random.IntN(len(s.clients))]
+	if !c.connected {
+		s.report.Reconnects++
+		return s.connect(c)
+	}
+
+	switch roll := s.random.IntN(100); {
+	case roll < 60:
+		return s.send(c, step)
+	case roll < 80:
+		s.report.Switches++
+		return s.switchRoom(c, fmt.Sprintf("sim-%d", s.random.IntN(simRooms)))
+	case roll < 90:
+		s.report.Disconnects++
+		return s.disconnect(c)
+	default:
+		s.clock.Set(s.clock.Now().Add(time.Duration(s.random.IntN(1000)) * time.Millisecond))
+		return nil
+	}
+}
+
+// violation records a broken invariant
+func (s *simulation) violation(format string, args ...any) {
+	s.report.Violations = append(s.report.Violations, fmt.Sprintf(format, args...))
+}
+
+// checkStored checks the acked messages are stored once. The store only keeps the
+// latest messages of a room, so an acked message may only be missing if no later
+// one of its room is stored
+func (s *simulation) checkStored() {
+	stored := make(map[string]int)
+	for room := range simRoomNames(s.messages) {
+		err := s.manager.store.ExportMessages(room, time.Time{}, time.Time{}, func(msg StoredMessage) error {
+			stored[msg.ID]++
+			return nil
+		})
+		if err != nil {
+			s.violation("reading %s: %v", room, err)
+		}
+	}
+
+	// Going from the newest, once a message is missing all older ones of the room may be
+	dropped := make(map[string]bool)
+	for _, msg := range slices.Backward(s.messages) {
+		switch n := stored[msg.id]; {
+		case n > 1:
+			s.violation("acked message %s in %s is stored %d times", msg.id, msg.room, n)
+		case n == 1 && dropped[msg.room]:
+			s.violation("acked message %s in %s is missing from the store while an older one is kept", msg.id, msg.room)
+		case n == 0:
+			dropped[msg.room] = true
+		}
+	}
+}
+
+// checkDelivered checks the clients in the room when a message was acked received
+// it, and that every client got the messages of a room in order
+func (s *simulation) checkDelivered() {
+	expected := make([][]string, len(s.clients))
+	rooms := make(map[string]string, len(s.messages))
+	for _, msg := range s.messages {
+		rooms[msg.id] = msg.room
+		for _, recipient := range msg.recipients {
+			c := s.clients[recipient.index]
+			if c.connected && c.connection == recipient.connection {
+				expected[recipient.index] = append(expected[recipient.index], msg.id)
+			}
+		}
+	}
+
+	// The last broadcasts may still be on their way
+	deadline := time.Now().Add(simStepTimeout)
+	for _, c := range s.clients {
+		missing := expected[c.index]
+		for {
+			missing = slices.DeleteFunc(missing, c.hasMessage)
+			if len(missing) == 0 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, id := range missing {
+			s.violation("client %d did not receive acked message %s", c.index, id)
+		}
+
+		c.lock.Lock()
+		last := make(map[string]uint64)
+		for _, msg := range c.messages {
+			room, ok := rooms[msg.id]
+			if !ok {
+				continue
+			}
+			if msg.seq <= last[room] {
+				s.violation("client %d received seq %d of %s after seq %d", c.index, msg.seq, room, last[room])
+			}
+			last[room] = msg.seq
+		}
+		c.lock.Unlock()
+	}
+}
+
+// hasMessage returns true if the client received the message
+func (c *simClient) hasMessage(id string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ids[id]
+}
+
+// checkMembers checks the Manager has the clients in the rooms the script put them in
+func (s *simulation) checkMembers() {
+	want := make(map[string]map[string]bool)
+	for _, c := range s.clients {
+		if !c.connected {
+			continue
+		}
+		if want[c.room] == nil {
+			want[c.room] = make(map[string]bool)
+		}
+		want[c.room][c.client.ID] = true
+	}
+
+	m := s.manager
+	m.RLock()
+	defer m.RUnlock()
+	for room, members := range m.members {
+		for client := range members {
+			if !want[room][client.id] {
+				s.violation("client %s of %s is in %s, the script didn't put it there", client.id, client.username, room)
+			}
+		}
+	}
+	for room, ids := range want {
+		for id := range ids {
+			found := false
+			for client := range m.members[room] {
+				if client.id == id {
+					found = true
+					break
+				}
+			}
+			if !found {
+				s.violation("client %s is missing from %s", id, room)
+			}
+		}
+	}
+}
+
+// simMessageText returns the text of a new_message event
+func simMessageText(event wstest.Event) string {
+	var message SendMessageEvent
+	json.Unmarshal(event.Payload, &message)
+	return message.Message
+}
+
+// simRoomNames returns the rooms messages were sent to
+func simRoomNames(messages []simMessage) map[string]bool {
+	rooms := make(map[string]bool)
+	for _, msg := range messages {
+		rooms[msg.room] = true
+	}
+	return rooms
+}
+
+// runSimulation runs the script of the seed against a test server made from the config
+func runSimulation(config Config, sim SimulationConfig) (report SimulationReport, err error) {
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	server, manager, err := NewTestServer(config, WithClock(clock))
+	if err != nil {
+		return SimulationReport{}, err
+	}
+	defer server.Close()
+
+	s := &simulation{
+		server:  server,
+		manager: manager,
+		clock:   clock,
+		random:  rand.New(rand.NewPCG(sim.Seed, sim.Seed)),
+		report:  SimulationReport{Seed: sim.Seed, Clients: sim.Clients, Steps: sim.Steps, Violations: []string{}},
+	}
+	start := time.Now()
+	defer func() { report.Duration = Duration(time.Since(start)) }()
+
+	for i := range sim.Clients {
+		c := &simClient{index: i, username: fmt.Sprintf("sim-user-%d", i), ids: make(map[string]bool), notify: make(chan struct{}, 1)}
+		s.clients = append(s.clients, c)
+		if err := s.connect(c); err != nil {
+			return s.report, err
+		}
+	}
+	for step := range sim.Steps {
+		if err := s.step(step); err != nil {
+			s.violation("step %d: %v", step, err)
+			break
+		}
+	}
+
+	s.checkStored()
+	s.checkDelivered()
+	s.checkMembers()
+	return s.report, nil
+}
+
+func TestSimulation(t *testing.T) {
+	sim := SimulationConfig{Seed: *simSeed, Clients: *simClients, Steps: *simSteps}
+	report, err := runSimulation(DefaultConfig(), sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Acked == 0 {
+		t.Errorf("no message was acked in %d steps", sim.Steps)
+	}
+	for _, violation := range report.Violations {
+		t.Error(violation)
+	}
+	if t.Failed() {
+		t.Logf("rerun with -sim-seed %d", sim.Seed)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handlers run on the read goroutine of their client unless worker pools are
+// configured, a slow one stalls everything the client sends after it. Every
+// handler run is timed into the handler latency histogram of its event type, and
+// a run over the slow threshold of its type logs a warning naming the event, the
+// client and the size of the payload, so the handler can be found:
+//
+//	slow handler: event=search_messages client=6f1c... user=alice payload_bytes=38 took=412ms threshold=250ms
+//
+// The objective is the share of the events of each type that have to be handled
+// within the threshold, like 0.99. The counts and whether each type meets it are
+// in /admin/debug/runtime, and with the histograms in Prometheus format at
+// GET /admin/metrics.
+
+// handlerSLOStats is how a type of event does against the objective
+type handlerSLOStats struct {
+	Threshold Duration `json:"threshold"`
+	Handled   uint64   `json:"handled"`
+	Slow      uint64   `json:"slow"`
+	// WithinThreshold is the share of the events handled within the threshold
+	WithinThreshold float64 `json:"within_threshold"`
+	// Met is set while WithinThreshold is at least the objective
+	Met bool `json:"met"`
+}
+
+// handlerCounts counts the runs of the handler of one event type
+type handlerCounts struct {
+	handled atomic.Uint64
+	slow    atomic.Uint64
+}
+
+// handlerSLO counts the handler runs and the slow ones by event type
+type handlerSLO struct {
+	sync.RWMutex
+	counts map[string]*handlerCounts
+}
+
+func newHandlerSLO() *handlerSLO {
+	return &handlerSLO{counts: make(map[string]*handlerCounts)}
+}
+
+// with returns the counts of the event type, creating them if needed
+func (s *handlerSLO) with(eventType string) *handlerCounts {
+	s.RLock()
+	counts, ok := s.counts[eventType]
+	s.RUnlock()
+	if ok {
+		return counts
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if counts, ok = s.counts[eventType]; !ok {
+		counts = &handlerCounts{}
+		s.counts[eventType] = counts
+	}
+	return counts
+}
+
+// slowHandlerThreshold returns how long the handler of the event type may take, 0 if
+// it may take any time
+func (m *Manager) slowHandlerThreshold(eventType string) time.Duration {
+	config := m.config().HandlerSLO
+	if threshold, ok := config.Thresholds[eventType]; ok {
+		return time.Duration(threshold)
+	}
+	return time.Duration(config.SlowThreshold)
+}
+
+// observeHandler records how long the handler of the event took for the client and
+// warns if it was slow
+func (m *Manager) observeHandler(event Event, c *Client, took time.Duration) {
+	m.handlerLatency.With(event.Type).ObserveDuration(took)
+
+	counts := m.handlerSLO.with(event.Type)
+	counts.handled.Add(1)
+	threshold := m.slowHandlerThreshold(event.Type)
+	if threshold <= 0 || took <= threshold {
+		return
+	}
+	counts.slow.Add(1)
+	log.Printf("slow handler: event=%s client=%s user=%s payload_bytes=%d took=%s threshold=%s",
+		event.Type, c.id, c.username, len(event.Payload), took.Round(time.Microsecond), threshold)
+}
+
+// handlerSLOStats returns how each event type does against the objective
+func (m *Manager) handlerSLOStats() map[string]handlerSLOStats {
+	objective := m.config().HandlerSLO.Objective
+	m.handlerSLO.RLock()
+	defer m.handlerSLO.RUnlock()
+
+	stats := make(map[string]handlerSLOStats, len(m.handlerSLO.counts))
+	for eventType, counts := range m.handlerSLO.counts {
+		s := handlerSLOStats{
+			Threshold:       Duration(m.slowHandlerThreshold(eventType)),
+			Handled:         counts.handled.Load(),
+			Slow:            counts.slow.Load(),
+			WithinThreshold: 1,
+		}
+		if s.Handled > 0 {
+			s.WithinThreshold = float64(s.Handled-s.Slow) / float64(s.Handled)
+		}
+		s.Met = s.WithinThreshold >= objective
+		stats[eventType] = s
+	}
+	return stats
+}
+
+// writePrometheusHistogram writes the histograms in the Prometheus text format, with
+// the key of each in the label
+func writePrometheusHistogram(w io.Writer, name, help, label string, histograms map[string]HistogramSnapshot) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, key := range slices.Sorted(maps.Keys(histograms)) {
+		h := histograms[key]
+		for _, bucket := range h.Buckets {
+			le := "+Inf"
+			if bucket.Le != math.MaxFloat64 {
+				le = strconv.FormatFloat(bucket.Le, 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, label, key, le, bucket.Count)
+		}
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", name, label, key, h.Sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, label, key, h.Count)
+	}
+}
+
+// metricsHandler serves the handler latencies and the objective in the Prometheus text format
+func (m *Manager) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writePrometheusHistogram(w, "handler_latency_seconds", "How long handlers took by event type.", "event_type", m.handlerLatency.Snapshot())
+
+	stats := m.handlerSLOStats()
+	types := slices.Sorted(maps.Keys(stats))
+	fmt.Fprintf(w, "# HELP handler_slow_total Handler runs over the slow threshold by event type.\n# TYPE handler_slow_total counter\n")
+	for _, eventType := range types {
+		fmt.Fprintf(w, "handler_slow_total{event_type=%q} %d\n", eventType, stats[eventType].Slow)
+	}
+	fmt.Fprintf(w, "# HELP handler_slo_within_threshold Share of handler runs within the slow threshold by event type.\n# TYPE handler_slo_within_threshold gauge\n")
+	for _, eventType := range types {
+		fmt.Fprintf(w, "handler_slo_within_threshold{event_type=%q} %g\n", eventType, stats[eventType].WithinThreshold)
+	}
+	fmt.Fprintf(w, "# HELP handler_slo_objective Share of handler runs that have to be within the slow threshold.\n# TYPE handler_slo_objective gauge\n")
+	fmt.Fprintf(w, "handler_slo_objective %g\n", m.config().HandlerSLO.Objective)
+	m.writeIngressMetrics(w)
+	m.writeDisconnectMetrics(w)
+}
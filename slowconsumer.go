@@ -0,0 +1,191 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// A client that reads slower than events are sent to it piles them up on its
+// egress, which is where the memory of a busy server goes. Every client tracks how
+// deep its queue is, how many events were dropped and how long writes take. Once
+// the queue or a write crosses the thresholds of the config the client is flagged
+// as slow, gets a slow_consumer event and is counted in the metrics. The flag is
+// cleared once it caught up, so the warning is sent again the next time.
+
+const (
+	// EventSlowConsumer warns a client that it doesn't keep up with its events
+	EventSlowConsumer = "slow_consumer"
+)
+
+const (
+	SlowConsumerQueueDepth   = "queue_depth"
+	SlowConsumerWriteLatency = "write_latency"
+)
+
+// SlowConsumerEvent is the payload sent in the
+// slow_consumer event
+type SlowConsumerEvent struct {
+	// Reason is the threshold crossed, either queue_depth or write_latency
+	Reason string `json:"reason"`
+	// QueueDepth is how many events wait to be written, QueueSize how many fit
+	QueueDepth int `json:"queue_depth"`
+	QueueSize  int `json:"queue_size"`
+	// WriteLatency is how long the last write took
+	WriteLatency Duration `json:"write_latency"`
+}
+
+// egressStats tracks how fast a client takes its events, it is updated by the
+// writer and by senders without a lock
+type egressStats struct {
+	// writes and writeNanos are the frames written and how long they took in total
+	writes     atomic.Uint64
+	writeNanos atomic.Int64
+	// lastWrite is how long the last frame took in nanoseconds
+	lastWrite atomic.Int64
+	// queuedBytes is the size of the events on the queues, see backpressure.go
+	queuedBytes atomic.Int64
+	// dropped counts the events dropped because a queue was full
+	dropped atomic.Uint64
+	// coalesced counts the ephemeral events replaced by a newer one while queued
+	coalesced atomic.Uint64
+	// oversized counts the events dropped for being larger than the client takes
+	oversized atomic.Uint64
+	// slow is set while the client is over a threshold
+	slow atomic.Bool
+	// warnings counts the slow_consumer events of the client
+	warnings atomic.Uint64
+}
+
+// checkQueueDepth flags the client as slow once its egress is over the threshold
+// Only call it while holding the manager lock, like enqueue
+func (c *Client) checkQueueDepth() {
+	threshold := c.manager.config().SlowConsumer.QueueDepth
+	if threshold <= 0 || len(c.egress) < threshold {
+		return
+	}
+	if c.stats.slow.CompareAndSwap(false, true) {
+		c.warnSlowConsumer(SlowConsumerQueueDepth)
+	}
+}
+
+// observeWrite records a write started at start, call it deferred by the writer
+func (c *Client) observeWrite(start time.Time) {
+	took := time.Since(start)
+	c.stats.writes.Add(1)
+	c.stats.writeNanos.Add(int64(took))
+	c.stats.lastWrite.Store(int64(took))
+
+	m := c.manager
+	m.writeLatency.ObserveDuration(took)
+
+	config := m.config().SlowConsumer
+	if config.WriteLatency > 0 && took >= time.Duration(config.WriteLatency) {
+		if !c.stats.slow.CompareAndSwap(false, true) {
+			return
+		}
+		// The writer holds no lock, take it so the queues can't be closed meanwhile
+		m.RLock()
+		if _, ok := m.clients[c]; ok {
+			c.warnSlowConsumer(SlowConsumerWriteLatency)
+		}
+		m.RUnlock()
+		return
+	}
+
+	// Caught up once the queue is down to half the threshold, so a client hovering
+	// around it isn't warned for every event
+	if c.stats.slow.Load() && len(c.egress) <= config.QueueDepth/2 {
+		c.stats.slow.Store(false)
+		log.Printf("client %s of %s caught up", c.id, c.username)
+	}
+}
+
+// warnSlowConsumer sends the slow_consumer event to the client and counts it
+// Only call it while holding the manager lock, so the queue can't be closed meanwhile
+func (c *Client) warnSlowConsumer(reason string) {
+	c.stats.warnings.Add(1)
+	c.manager.slowConsumers.Add(1)
+	log.Printf("slow consumer %s of %s: %s, %d events queued", c.id, c.username, reason, len(c.egress))
+
+	data, err := json.Marshal(SlowConsumerEvent{
+		Reason:       reason,
+		QueueDepth:   len(c.egress),
+		QueueSize:    cap(c.egress),
+		WriteLatency: Duration(c.stats.lastWrite.Load()),
+	})
+	if err != nil {
+		log.Println("failed to marshal slow_consumer: ", err)
+		return
+	}
+	// Skipping ahead of the full egress is the point, a warning about a connection
+	// is not worth sending again on the next one
+	c.enqueuePriority(Event{Type: EventSlowConsumer, Payload: data})
+}
+
+// debugInfo describes the state of the client for the admin API
+// Only call it while holding the manager lock, as the room can change otherwise
+func (c *Client) debugInfo() clientDebugInfo {
+	info := clientDebugInfo{
+		ID:            c.id,
+		Username:      c.username,
+		Room:          c.room,
+		EgressDepth:   len(c.egress),
+		PriorityDepth: len(c.priority),
+		QueuedBytes:   c.stats.queuedBytes.Load(),
+		Dropped:       c.stats.dropped.Load(),
+		Coalesced:     c.stats.coalesced.Load(),
+		Oversized:     c.stats.oversized.Load(),
+		Slow:          c.stats.slow.Load(),
+		Warnings:      c.stats.warnings.Load(),
+		LastWrite:     Duration(c.stats.lastWrite.Load()),
+		IdleFor:       Duration(time.Since(time.Unix(0, c.lastActivity.Load())).Round(time.Second)),
+		RTT:           Duration(c.roundTripTime()),
+		RTTVariance:   Duration(c.roundTripVariance()),
+	}
+	if writes := c.stats.writes.Load(); writes > 0 {
+		info.AvgWrite = Duration(c.stats.writeNanos.Load() / int64(writes))
+	}
+	return info
+}
+
+// listClientsHandler lists the clients with the deepest queues first, like
+// GET /admin/clients?slow=true&limit=20 to only get the clients flagged as slow
+func (m *Manager) listClientsHandler(w http.ResponseWriter, r *http.Request) {
+	onlySlow := r.URL.Query().Get("slow") == "true"
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	clients := []clientDebugInfo{}
+	m.RLock()
+	for client := range m.clients {
+		if onlySlow && !client.stats.slow.Load() {
+			continue
+		}
+		clients = append(clients, client.debugInfo())
+	}
+	m.RUnlock()
+
+	slices.SortFunc(clients, func(a, b clientDebugInfo) int {
+		if a.EgressDepth != b.EgressDepth {
+			return cmp.Compare(b.EgressDepth, a.EgressDepth)
+		}
+		return cmp.Compare(b.LastWrite, a.LastWrite)
+	})
+	if limit > 0 && len(clients) > limit {
+		clients = clients[:limit]
+	}
+	writeJSON(w, http.StatusOK, clients)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// This file is a small compatibility layer speaking the Engine.IO v4 / Socket.IO v5
+// framing over the websocket transport, so existing socket.io frontends can connect.
+// Only the default namespace is supported, and no binary attachments.
+//
+// A socket.io event packet looks like 42["send_message",{"message":"hi"}]
+// where 4 is the Engine.IO message type and 2 is the Socket.IO event type.
+
+// Engine.IO packet types
+const (
+	engineOpen    = '0'
+	engineClose   = '1'
+	enginePing    = '2'
+	enginePong    = '3'
+	engineMessage = '4'
+)
+
+// Socket.IO packet types, carried inside Engine.IO messages
+const (
+	socketConnect      = '0'
+	socketDisconnect   = '1'
+	socketEvent        = '2'
+	socketConnectError = '4'
+)
+
+// socketIOHandshakeTimeout bounds the handshake of clients that send their OTP in
+// the connect packet, they are upgraded before they are authenticated
+var socketIOHandshakeTimeout = 10 * time.Second
+
+var (
+	ErrSocketIOUnsupported = errors.New("unsupported socket.io packet")
+	ErrSocketIOClosed      = errors.New("socket.io client disconnected")
+	ErrUnauthorized        = errors.New("unauthorized")
+)
+
+// socketIOCodec translates Events to and from Socket.IO event packets
+type socketIOCodec struct{}
+
+func (socketIOCodec) Encode(event Event) (int, []byte, error) {
+	payload := event.Payload
+	if len(payload) == 0 {
+		payload = json.RawMessage("null")
+	}
+
+	data, err := json.Marshal([]any{event.Type, payload})
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, append([]byte{engineMessage, socketEvent}, data...), nil
+}
+
+func (socketIOCodec) Decode(messageType int, data []byte) (Event, error) {
+	if messageType != websocket.TextMessage || len(data) == 0 {
+		return Event{}, ErrUnexpectedFrame
+	}
+
+	switch data[0] {
+	case enginePong:
+		return Event{}, errPong
+	case enginePing:
+		// Older clients ping the server themselves, nothing to do
+		return Event{}, errSkip
+	case engineClose:
+		return Event{}, ErrSocketIOClosed
+	case engineMessage:
+	default:
+		return Event{}, fmt.Errorf("%w: engine.io type %q", ErrSocketIOUnsupported, data[0])
+	}
+
+	if len(data) < 2 {
+		return Event{}, ErrSocketIOUnsupported
+	}
+
+	switch data[1] {
+	case socketEvent:
+	case socketDisconnect:
+		return Event{}, ErrSocketIOClosed
+	default:
+		return Event{}, fmt.Errorf("%w: socket.io type %q", ErrSocketIOUnsupported, data[1])
+	}
+
+	// Skip an optional ack id, acknowledgements are not supported so it is ignored
+	body := bytes.TrimLeft(data[2:], "0123456789")
+
+	var args []json.RawMessage
+	if err := json.Unmarshal(body, &args); err != nil {
+		return Event{}, err
+	}
+	if len(args) == 0 {
+		return Event{}, fmt.Errorf("%w: event without name", ErrSocketIOUnsupported)
+	}
+
+	var event Event
+	if err := json.Unmarshal(args[0], &event.Type); err != nil {
+		return Event{}, err
+	}
+	if len(args) > 1 {
+		event.Payload = args[1]
+	}
+	return event, nil
+}
+
+// Ping returns the Engine.IO ping packet, socket.io clients expect heartbeats as
+// regular messages and will close the connection if only websocket pings are sent
+func (socketIOCodec) Ping() (int, []byte) {
+	return websocket.TextMessage, []byte{enginePing}
+}
+
+// serveSocketIO is a HTTP Handler accepting socket.io clients on the websocket transport
+// The OTP is accepted either as the otp query param or in the auth payload of the connect packet,
+// API keys and the otp param are checked like in serveWS before the upgrade
+func (m *Manager) serveSocketIO(w http.ResponseWriter, r *http.Request) {
+	if m.rejectDraining(w) {
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("EIO") != "4" || query.Get("transport") != "websocket" {
+		// Polling is not supported, clients have to be configured with transports: ["websocket"]
+		http.Error(w, "only EIO=4 with the websocket transport is supported", http.StatusBadRequest)
+		return
+	}
+	// Socket.IO packets have no room for the strict envelope
+	if m.rejectLoose(Protocol{Name: "socket.io"}) {
+		http.Error(w, ErrLooseEnvelope.Error(), http.StatusBadRequest)
+		return
+	}
+	if !m.checkUpgradeCSRF(r) {
+		http.Error(w, ErrCSRFToken.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Browsers can't set headers on websockets, so the auth payload of the connect
+	// packet is the only way they have. Everyone else is authenticated before the upgrade
+	var verified OTP
+	var apiKey *APIKey
+	if _, found := bearerAPIKey(r); found || query.Get("otp") != "" {
+		var ok bool
+		if verified, apiKey, ok = m.authenticateUpgrade(w, r); !ok {
+			return
+		}
+	}
+
+	conn, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	sid, username, err := m.socketIOHandshake(conn, verified.Username)
+	if errors.Is(err, ErrUnauthorized) {
+		m.audit(AuditEntry{Action: AuditOTPRejected, RemoteAddr: r.RemoteAddr})
+	}
+	if err != nil {
+		log.Println("socket.io handshake: ", err)
+		conn.Close()
+		return
+	}
+
+	if verified.Username == "" {
+		m.audit(AuditEntry{Action: AuditOTPVerified, Actor: username, RemoteAddr: r.RemoteAddr})
+		if m.isBanned(username) {
+			conn.Close()
+			return
+		}
+	}
+
+	client := NewClient(conn, m, username)
+	client.codec = socketIOCodec{}
+	client.compress.Store(m.featureGranted(FlagCompression, username))
+	client.setLocale(requestLocale(r))
+	if apiKey != nil {
+		client.apiKey = apiKey
+		// Keys limited to other rooms start in their first room
+		if !client.allowedRoom(client.room) {
+			client.room = apiKey.Rooms[0]
+		}
+	}
+	log.Println("New socket.io connection", sid)
+
+	m.startClient(client)
+}
+
+// socketIOHandshake sends the Engine.IO open packet and waits for the
+// Socket.IO connect packet of the default namespace. Without the username of a
+// connection authenticated before the upgrade the OTP of the connect packet is verified
+// The sid and the username are returned
+func (m *Manager) socketIOHandshake(conn *websocket.Conn, username string) (string, string, error) {
+	sid := uuid.NewString()
+
+	// The whole handshake has to finish in time, the client pumps set their own
+	// read deadline and writes have none
+	deadline := time.Now().Add(socketIOHandshakeTimeout)
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return "", "", err
+	}
+	defer conn.SetWriteDeadline(time.Time{})
+
+	open, err := json.Marshal(struct {
+		SID          string   `json:"sid"`
+		Upgrades     []string `json:"upgrades"`
+		PingInterval int64    `json:"pingInterval"`
+		PingTimeout  int64    `json:"pingTimeout"`
+		MaxPayload   int      `json:"maxPayload"`
+	}{
+		SID:          sid,
+		Upgrades:     []string{},
+		PingInterval: m.config().pingInterval().Milliseconds(),
+		PingTimeout:  (m.config().pongWait() - m.config().pingInterval()).Milliseconds(),
+		MaxPayload:   maxMessageSize,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, append([]byte{engineOpen}, open...)); err != nil {
+		return "", "", err
+	}
+
+	conn.SetReadLimit(int64(maxMessageSize))
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return "", "", err
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return "", "", err
+	}
+	if len(data) < 2 || data[0] != engineMessage || data[1] != socketConnect {
+		return "", "", fmt.Errorf("%w: expected connect packet", ErrSocketIOUnsupported)
+	}
+
+	if username == "" {
+		var auth struct {
+			OTP string `json:"otp"`
+		}
+		if len(data) > 2 {
+			if err := json.Unmarshal(data[2:], &auth); err != nil {
+				return "", "", err
+			}
+		}
+
+		verified, ok := m.verifyOTP(auth.OTP)
+		if auth.OTP == "" || !ok {
+			reject := append([]byte{engineMessage, socketConnectError}, `{"message":"unauthorized"}`...)
+			conn.WriteMessage(websocket.TextMessage, reject)
+			return "", "", ErrUnauthorized
+		}
+		username = verified.Username
+	}
+
+	connected, err := json.Marshal(struct {
+		SID string `json:"sid"`
+	}{SID: sid})
+	if err != nil {
+		return "", "", err
+	}
+	return sid, username, conn.WriteMessage(websocket.TextMessage, append([]byte{engineMessage, socketConnect}, connected...))
+}
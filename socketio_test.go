@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"arti.soft/websockets-go/client"
+	"github.com/gorilla/websocket"
+)
+
+// socketIOURL is the URL of the socket.io endpoint with the query params
+func (s *e2eServer) socketIOURL(params url.Values) string {
+	params.Set("EIO", "4")
+	params.Set("transport", "websocket")
+	return "ws" + strings.TrimPrefix(s.URL, "http") + "/socket.io/?" + params.Encode()
+}
+
+// socketIOConnect reads the open packet and sends the connect packet
+func socketIOConnect(t *testing.T, ws *websocket.Conn, auth string) []byte {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, data, err := ws.ReadMessage(); err != nil || len(data) == 0 || data[0] != engineOpen {
+		t.Fatalf("open packet: %q, %v", data, err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, append([]byte{engineMessage, socketConnect}, auth...)); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("connect reply: %v", err)
+	}
+	return data
+}
+
+func TestSocketIOAuthenticatesBeforeUpgrade(t *testing.T) {
+	s := startE2EServer(t, 1)
+
+	_, resp, err := websocket.DefaultDialer.Dial(s.socketIOURL(url.Values{"otp": {"bogus"}}), nil)
+	if !errors.Is(err, websocket.ErrBadHandshake) || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("upgrade with a bad otp: %v, want %d", err, http.StatusUnauthorized)
+	}
+
+	header := http.Header{"Authorization": {"Bearer " + apiKeyPrefix + "bogus"}}
+	_, resp, err = websocket.DefaultDialer.Dial(s.socketIOURL(url.Values{}), header)
+	if !errors.Is(err, websocket.ErrBadHandshake) || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("upgrade with a bad api key: %v, want %d", err, http.StatusUnauthorized)
+	}
+}
+
+func TestSocketIOQueryOTP(t *testing.T) {
+	s := startE2EServer(t, 1)
+	otp, err := client.Login(t.Context(), s.URL, e2eUser(0), e2ePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(s.socketIOURL(url.Values{"otp": {otp}}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if data := socketIOConnect(t, ws, ""); !strings.HasPrefix(string(data), `40{"sid":`) {
+		t.Errorf("connect reply is %q", data)
+	}
+}
+
+func TestSocketIOConnectPacketOTP(t *testing.T) {
+	s := startE2EServer(t, 1)
+	otp, err := client.Login(t.Context(), s.URL, e2eUser(0), e2ePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(s.socketIOURL(url.Values{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if data := socketIOConnect(t, ws, `{"otp":"`+otp+`"}`); !strings.HasPrefix(string(data), `40{"sid":`) {
+		t.Errorf("connect reply is %q", data)
+	}
+
+	// The OTP is used up, connecting with it again fails
+	ws, _, err = websocket.DefaultDialer.Dial(s.socketIOURL(url.Values{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if data := socketIOConnect(t, ws, `{"otp":"`+otp+`"}`); !strings.HasPrefix(string(data), "44") {
+		t.Errorf("connect reply with a used otp is %q", data)
+	}
+}
+
+func TestSocketIOHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { socketIOHandshakeTimeout = timeout }(socketIOHandshakeTimeout)
+	socketIOHandshakeTimeout = 50 * time.Millisecond
+	s := startE2EServer(t, 1)
+
+	ws, _, err := websocket.DefaultDialer.Dial(s.socketIOURL(url.Values{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	// Never send the connect packet, the server has to give up on its own
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatalf("open packet: %v", err)
+	}
+	_, _, err = ws.ReadMessage()
+	var netErr interface{ Timeout() bool }
+	if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Fatalf("read after the handshake timeout: %v, want the server to close", err)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Collaborative apps built on the server need more than chat, like a shared
+// whiteboard, a playlist or the board of a game. State sync keeps named state
+// objects per room and sends every change to the clients that subscribed to them.
+// The server registers the objects, like slash commands:
+//
+//	m.RegisterState("board", StateObject{Initial: json.RawMessage(`{"cells":{}}`)})
+//
+// A client in a room sends subscribe_state with the name and gets a state_snapshot
+// holding the whole state and its version. Every update_state by anyone in the
+// room goes up one version and is sent to the subscribers as state_delta. By
+// default a change is a JSON merge patch, RFC 7386, applied to the state and sent
+// on as the delta, StateObject.Apply replaces that for other kinds of changes.
+//
+// A client that sees a delta whose version isn't one above the last it has missed
+// a change, like when its queue overflowed. It sends subscribe_state again with the
+// version it has, and gets the deltas after it, or a snapshot if they are not kept
+// anymore, stateDeltaHistory are kept. A client that is up to date gets nothing.
+// An update_state with base_version is rejected with a state_conflict error if the
+// state moved on since, for changes that only make sense on the state they were
+// made on.
+//
+// Subscriptions end when the client leaves the room. The state is kept in memory
+// until the room is closed. In a cluster each instance has its own state, like
+// typing indicators.
+
+const (
+	// EventSubscribeState is sent by a client to get the state and its changes
+	EventSubscribeState = "subscribe_state"
+	// EventUnsubscribeState stops the changes of a state
+	EventUnsubscribeState = "unsubscribe_state"
+	// EventUpdateState is sent by a client to change a state
+	EventUpdateState = "update_state"
+	// EventStateSnapshot holds the whole state
+	EventStateSnapshot = "state_snapshot"
+	// EventStateDelta holds a change of the state
+	EventStateDelta = "state_delta"
+)
+
+var (
+	ErrUnknownState  = errors.New("unknown state")
+	ErrInvalidState  = errors.New("invalid state change")
+	ErrStateConflict = errors.New("state changed since the base version")
+	ErrStateTooLarge = errors.New("state is too large")
+)
+
+var (
+	// stateDeltaHistory is how many deltas are kept per state for clients catching up
+	stateDeltaHistory = 64
+	// maxStateSize is the largest state in bytes
+	maxStateSize = 256 * 1024
+)
+
+// StateObject is a registered kind of state
+type StateObject struct {
+	// Initial is the state of a room before its first change, null if empty
+	Initial json.RawMessage
+	// Apply returns the state with the change applied and the delta sent to the
+	// subscribers, errors are sent back to the client. Without it the change is a
+	// JSON merge patch
+	Apply func(change StateChange, state json.RawMessage) (json.RawMessage, json.RawMessage, error)
+	// Permission is who may change the state, everyone may subscribe
+	Permission Permission
+}
+
+// StateChange is a change being applied to a state
+type StateChange struct {
+	Room string
+	Name string
+	// Change is the change as sent
+	Change json.RawMessage
+	// Client sent the change, nil for changes made by the server
+	Client *Client
+}
+
+// stateKey is a state of a room
+type stateKey struct {
+	room string
+	name string
+}
+
+// stateDelta is a change kept for clients catching up
+type stateDelta struct {
+	version uint64
+	event   Event
+}
+
+// syncedState is the state of a room and its subscribers
+type syncedState struct {
+	state   json.RawMessage
+	version uint64
+	// deltas are the latest changes, oldest first
+	deltas      []stateDelta
+	subscribers map[*Client]bool
+}
+
+// SubscribeStateEvent is the payload of the subscribe_state event
+type SubscribeStateEvent struct {
+	Name string `json:"name"`
+	// Version is the version the client has, to get the deltas after it instead of a snapshot
+	Version uint64 `json:"version,omitempty"`
+}
+
+// UnsubscribeStateEvent is the payload of the unsubscribe_state event
+type UnsubscribeStateEvent struct {
+	Name string `json:"name"`
+}
+
+// UpdateStateEvent is the payload of the update_state event
+type UpdateStateEvent struct {
+	Name   string          `json:"name"`
+	Change json.RawMessage `json:"change"`
+	// BaseVersion rejects the change if the state is at another version, if set
+	BaseVersion uint64 `json:"base_version,omitempty"`
+}
+
+// StateSnapshotEvent is the payload of the state_snapshot event
+type StateSnapshotEvent struct {
+	Room    string          `json:"room"`
+	Name    string          `json:"name"`
+	Version uint64          `json:"version"`
+	State   json.RawMessage `json:"state"`
+}
+
+// StateDeltaEvent is the payload of the state_delta event
+type StateDeltaEvent struct {
+	Room    string          `json:"room"`
+	Name    string          `json:"name"`
+	Version uint64          `json:"version"`
+	Delta   json.RawMessage `json:"delta"`
+	// From is the user who made the change, empty for the server
+	From string `json:"from,omitempty"`
+}
+
+// RegisterState adds a kind of state, replacing the state of the same name
+func (m *Manager) RegisterState(name string, object StateObject) {
+	m.statesLock.Lock()
+	defer m.statesLock.Unlock()
+	m.stateObjects[name] = object
+}
+
+// syncedState returns the state of the room, created at the initial state
+// Only call it while holding the states lock
+func (m *Manager) syncedState(room, name string) (*syncedState, StateObject, error) {
+	object, ok := m.stateObjects[name]
+	if !ok {
+		return nil, object, fmt.Errorf("%w: %s", ErrUnknownState, name)
+	}
+	key := stateKey{room: room, name: name}
+	s, ok := m.states[key]
+	if !ok {
+		initial := object.Initial
+		if len(initial) == 0 {
+			initial = json.RawMessage("null")
+		}
+		s = &syncedState{state: initial, subscribers: make(map[*Client]bool)}
+		m.states[key] = s
+	}
+	return s, object, nil
+}
+
+// State returns the state of the room and its version
+func (m *Manager) State(room, name string) (json.RawMessage, uint64, error) {
+	m.statesLock.Lock()
+	defer m.statesLock.Unlock()
+	s, _, err := m.syncedState(room, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.state, s.version, nil
+}
+
+// UpdateState changes the state of the room as the server, it returns the new version
+func (m *Manager) UpdateState(room, name string, change json.RawMessage) (uint64, error) {
+	return m.updateState(StateChange{Room: room, Name: name, Change: change}, 0)
+}
+
+// updateState applies the change and sends the delta to the subscribers, a base
+// version other than 0 has to be the current version
+func (m *Manager) updateState(change StateChange, baseVersion uint64) (uint64, error) {
+	m.statesLock.Lock()
+	defer m.statesLock.Unlock()
+
+	s, object, err := m.syncedState(change.Room, change.Name)
+	if err != nil {
+		return 0, err
+	}
+	if change.Client != nil && !m.allowed(change.Client, object.Permission) {
+		return 0, ErrPermissionDenied
+	}
+	if baseVersion != 0 && baseVersion != s.version {
+		return 0, fmt.Errorf("%w: %s is at version %d", ErrStateConflict, change.Name, s.version)
+	}
+
+	apply := object.Apply
+	if apply == nil {
+		apply = mergePatchState
+	}
+	state, delta, err := apply(change, s.state)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	if len(state) > maxStateSize {
+		return 0, fmt.Errorf("%w: %d bytes", ErrStateTooLarge, len(state))
+	}
+
+	deltaEvent := StateDeltaEvent{Room: change.Room, Name: change.Name, Version: s.version + 1, Delta: delta}
+	if change.Client != nil {
+		deltaEvent.From = change.Client.username
+	}
+	data, err := json.Marshal(deltaEvent)
+	if err != nil {
+		return 0, err
+	}
+	event := Event{Type: EventStateDelta, Payload: data}
+
+	s.state = state
+	s.version++
+	s.deltas = append(s.deltas, stateDelta{version: s.version, event: event})
+	if len(s.deltas) > stateDeltaHistory {
+		s.deltas = s.deltas[len(s.deltas)-stateDeltaHistory:]
+	}
+
+	m.RLock()
+	for client := range s.subscribers {
+		// Clients that left the room or disconnected are unsubscribed
+		if _, ok := m.clients[client]; !ok || client.room != change.Room {
+			delete(s.subscribers, client)
+			continue
+		}
+		client.send(event)
+	}
+	m.RUnlock()
+	return s.version, nil
+}
+
+// mergePatchState applies the change as JSON merge patch, the delta is the change
+func mergePatchState(change StateChange, state json.RawMessage) (json.RawMessage, json.RawMessage, error) {
+	var target, patch any
+	if err := json.Unmarshal(state, &target); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(change.Change, &patch); err != nil {
+		return nil, nil, err
+	}
+	merged, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return nil, nil, err
+	}
+	return merged, change.Change, nil
+}
+
+// mergePatch applies the patch to the target, see RFC 7386
+func mergePatch(target, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	result, ok := target.(map[string]any)
+	if !ok {
+		result = make(map[string]any)
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(result, name)
+		} else {
+			result[name] = mergePatch(result[name], value)
+		}
+	}
+	return result
+}
+
+// subscribeState subscribes the client to the state of its room and sends what it
+// misses of it
+func (m *Manager) subscribeState(c *Client, room, name string, version uint64) error {
+	m.statesLock.Lock()
+	defer m.statesLock.Unlock()
+
+	s, _, err := m.syncedState(room, name)
+	if err != nil {
+		return err
+	}
+	s.subscribers[c] = true
+
+	// The deltas after the version of the client are enough if they are all kept
+	if version != 0 && version <= s.version && (version == s.version || s.deltas[0].version <= version+1) {
+		for _, delta := range s.deltas {
+			if delta.version > version {
+				m.sendToClient(c, delta.event)
+			}
+		}
+		return nil
+	}
+	return m.replyJSON(c, EventStateSnapshot, StateSnapshotEvent{Room: room, Name: name, Version: s.version, State: s.state})
+}
+
+// unsubscribeState stops sending the changes of the state to the client
+func (m *Manager) unsubscribeState(c *Client, room, name string) {
+	m.statesLock.Lock()
+	defer m.statesLock.Unlock()
+	if s, ok := m.states[stateKey{room: room, name: name}]; ok {
+		delete(s.subscribers, c)
+	}
+}
+
+// dropRoomStates forgets the states of a room that was closed
+func (m *Manager) dropRoomStates(room string) {
+	m.statesLock.Lock()
+	defer m.statesLock.Unlock()
+	for key := range m.states {
+		if key.room == room {
+			delete(m.states, key)
+		}
+	}
+}
+
+// SubscribeStateHandler sends the state of the room to the client and subscribes it to the changes
+func SubscribeStateHandler(event Event, c *Client) error {
+	var subscribe SubscribeStateEvent
+	if err := json.Unmarshal(event.Payload, &subscribe); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	return c.manager.subscribeState(c, c.manager.roomOf(c), subscribe.Name, subscribe.Version)
+}
+
+// UnsubscribeStateHandler stops sending the changes of the state to the client
+func UnsubscribeStateHandler(event Event, c *Client) error {
+	var unsubscribe UnsubscribeStateEvent
+	if err := json.Unmarshal(event.Payload, &unsubscribe); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	c.manager.unsubscribeState(c, c.manager.roomOf(c), unsubscribe.Name)
+	return nil
+}
+
+// UpdateStateHandler changes the state of the room of the client, a conflict is
+// sent back as error event so the client can catch up and try again
+func UpdateStateHandler(event Event, c *Client) error {
+	var update UpdateStateEvent
+	if err := json.Unmarshal(event.Payload, &update); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	m := c.manager
+	change := StateChange{Room: m.roomOf(c), Name: update.Name, Change: update.Change, Client: c}
+	_, err := m.updateState(change, update.BaseVersion)
+	if errors.Is(err, ErrStateConflict) {
+		m.sendError(c, "state_conflict", map[string]string{"reason": err.Error()})
+	}
+	return err
+}
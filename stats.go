@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Every client counts what went over its connection. Clients ask for the numbers
+// of their own connection with the stats event, for diagnostics screens or to
+// paste into a support ticket, along with the round trip time, see rtt.go.
+
+const (
+	// EventStats is sent by a client to get the stats of its connection, the server
+	// answers with a stats event of its own
+	EventStats = "stats"
+)
+
+// trafficStats counts what went over the connection of a client
+type trafficStats struct {
+	// messagesIn and bytesIn are the frames read and their size
+	messagesIn atomic.Uint64
+	bytesIn    atomic.Uint64
+	// messagesOut are the events written, bytesOut the size of the frames they were written in
+	messagesOut atomic.Uint64
+	bytesOut    atomic.Uint64
+}
+
+// ConnectionStatsEvent is the payload sent in the
+// stats event
+type ConnectionStatsEvent struct {
+	ClientID    string    `json:"client_id"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Uptime      Duration  `json:"uptime"`
+
+	MessagesIn  uint64 `json:"messages_in"`
+	MessagesOut uint64 `json:"messages_out"`
+	BytesIn     uint64 `json:"bytes_in"`
+	BytesOut    uint64 `json:"bytes_out"`
+
+	// QueueDepth is how many events wait to be written to the client, QueuedBytes their size
+	QueueDepth  int   `json:"queue_depth"`
+	QueuedBytes int64 `json:"queued_bytes"`
+	// Dropped counts the events dropped because a queue of the client was full
+	Dropped uint64 `json:"dropped"`
+	// Unacked is how many events wait for an ack, only with qos
+	Unacked int `json:"unacked,omitempty"`
+
+	// RTT is the latest round trip time of a ping, SmoothedRTT the rolling average
+	// and RTTVariance how much the round trip times vary around it
+	RTT         Duration `json:"rtt"`
+	SmoothedRTT Duration `json:"smoothed_rtt"`
+	RTTVariance Duration `json:"rtt_variance"`
+}
+
+// countIn counts a frame of size bytes read from the client
+func (c *Client) countIn(size int) {
+	c.traffic.messagesIn.Add(1)
+	c.traffic.bytesIn.Add(uint64(size))
+}
+
+// countOut counts events written to the client in frames of size bytes
+func (c *Client) countOut(events, size int) {
+	c.traffic.messagesOut.Add(uint64(events))
+	c.traffic.bytesOut.Add(uint64(size))
+}
+
+// connectionStats returns the stats of the connection of the client
+func (c *Client) connectionStats() ConnectionStatsEvent {
+	stats := ConnectionStatsEvent{
+		ClientID:    c.id,
+		ConnectedAt: c.connectedAt,
+		Uptime:      Duration(c.manager.now().Sub(c.connectedAt).Round(time.Second)),
+		MessagesIn:  c.traffic.messagesIn.Load(),
+		MessagesOut: c.traffic.messagesOut.Load(),
+		BytesIn:     c.traffic.bytesIn.Load(),
+		BytesOut:    c.traffic.bytesOut.Load(),
+		QueueDepth:  len(c.egress) + len(c.priority),
+		QueuedBytes: c.stats.queuedBytes.Load(),
+		Dropped:     c.stats.dropped.Load(),
+		RTT:         Duration(c.ping.latest.Load()),
+		SmoothedRTT: Duration(c.roundTripTime()),
+		RTTVariance: Duration(c.roundTripVariance()),
+	}
+	if c.qos != nil {
+		stats.Unacked = c.qos.unacked()
+	}
+	return stats
+}
+
+// StatsHandler answers with the stats of the client's connection
+func StatsHandler(event Event, c *Client) error {
+	return c.manager.replyJSON(c, EventStats, c.connectionStats())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Besides being shown as away when idle, see idle.go, users can pick their status
+// with set_status: away until they change it, dnd (do not disturb) or back to
+// online, which is the automatic status again. A short text like "in a meeting"
+// can go with any status. The status is part of the presence events and lasts
+// until it is changed or the server restarts, also while the user is offline.
+// Users in dnd still get all messages, but no mention events or push
+// notifications, see notificationsMuted in notify.go.
+
+const (
+	// EventSetStatus is sent by a client to pick the status of its user
+	EventSetStatus = "set_status"
+)
+
+const (
+	// PresenceDND is do not disturb, chosen with set_status
+	PresenceDND = "dnd"
+)
+
+var (
+	ErrInvalidStatus = errors.New("status must be online, away or dnd")
+)
+
+// SetStatusEvent is the payload sent in the
+// set_status event
+type SetStatusEvent struct {
+	// Status is online, away or dnd
+	Status string `json:"status"`
+	// Text is shown with the status, empty clears it
+	Text string `json:"text,omitempty"`
+}
+
+// UserStatus is the status a user picked
+type UserStatus struct {
+	Status string
+	Text   string
+}
+
+// validateStatus returns the status with the text trimmed, or an error if it can't be used
+func validateStatus(status SetStatusEvent) (UserStatus, error) {
+	switch status.Status {
+	case PresenceOnline, PresenceAway, PresenceDND:
+	default:
+		return UserStatus{}, ErrInvalidStatus
+	}
+	text := strings.TrimSpace(status.Text)
+	if utf8.RuneCountInString(text) > maxStatusTextLength {
+		return UserStatus{}, fmt.Errorf("status text is longer than %d characters", maxStatusTextLength)
+	}
+	if strings.ContainsFunc(text, unicode.IsControl) {
+		return UserStatus{}, errors.New("status text can't contain control characters")
+	}
+	return UserStatus{Status: status.Status, Text: text}, nil
+}
+
+// presence returns the status shown for the user and the text that goes with it
+func (m *Manager) presence(username string) (string, string) {
+	m.presenceLock.Lock()
+	defer m.presenceLock.Unlock()
+	status := m.statuses[username]
+	switch {
+	case status.Status == PresenceAway || status.Status == PresenceDND:
+		return status.Status, status.Text
+	case m.away[username]:
+		return PresenceAway, status.Text
+	default:
+		return PresenceOnline, status.Text
+	}
+}
+
+// statusPicked returns true if the user picked a status the idle tracking must not change
+// Only call it while holding the presence lock
+func (m *Manager) statusPicked(username string) bool {
+	status := m.statuses[username].Status
+	return status == PresenceAway || status == PresenceDND
+}
+
+// setStatus sets the status of the user and tells the rooms of the user
+func (m *Manager) setStatus(username string, status UserStatus, lastActive time.Time) {
+	m.presenceLock.Lock()
+	if status.Status == PresenceOnline && status.Text == "" {
+		delete(m.statuses, username)
+	} else {
+		m.statuses[username] = status
+	}
+	m.presenceLock.Unlock()
+
+	m.broadcastPresence(username, lastActive)
+}
+
+// SetStatusHandler sets the status of the client's user
+func SetStatusHandler(event Event, c *Client) error {
+	var req SetStatusEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	status, err := validateStatus(req)
+	if err != nil {
+		return err
+	}
+	c.manager.setStatus(c.username, status, time.Unix(0, c.lastActivity.Load()))
+	return nil
+}
@@ -0,0 +1,1835 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+)
+
+// storedMessagesPerRoom is how many messages the in memory store keeps per room
+var storedMessagesPerRoom = 1000
+
+// ScheduledMessage is a message to be delivered to a room or user at a later time
+type ScheduledMessage struct {
+	ID string `json:"id"`
+	// Author is the user that scheduled the message, it is sent in their name
+	Author string `json:"author"`
+	// Room is the room to deliver to, either Room or To is set
+	Room string `json:"room,omitempty"`
+	// To is the user to deliver to as a direct message
+	To        string    `json:"to,omitempty"`
+	Message   string    `json:"message"`
+	DeliverAt time.Time `json:"deliver_at"`
+}
+
+// User is an account stored by the server, the users of the config are not stored
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	Email        string `json:"email,omitempty"`
+	// VerificationToken is set until the user verified their email
+	VerificationToken string    `json:"verification_token,omitempty"`
+	Created           time.Time `json:"created"`
+	// Nickname is shown instead of the username, see nickname.go
+	Nickname string `json:"nickname,omitempty"`
+}
+
+// Room is a chat room that was used at least once
+type Room struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Owner is the user that created the room, empty for rooms the server created
+	Owner       string `json:"owner,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+	Description string `json:"description,omitempty"`
+	// MaxMembers limits how many users can be in the room, 0 is unlimited
+	MaxMembers int `json:"max_members,omitempty"`
+	// Retention is how long messages of the room are kept, 0 uses the server default
+	Retention Duration `json:"retention,omitempty"`
+	// MaxMessages is how many messages of the room are kept, 0 uses the server default
+	MaxMessages int `json:"max_messages,omitempty"`
+	// Visibility is one of the Visibility constants, empty is public
+	Visibility string `json:"visibility,omitempty"`
+	// Invited are the users that may join a private or invite-only room
+	Invited []string `json:"invited,omitempty"`
+	// Ephemeral rooms are closed once idle for IdleTimeout or at ExpiresAt
+	Ephemeral   bool       `json:"ephemeral,omitempty"`
+	IdleTimeout Duration   `json:"idle_timeout,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	// E2EE rooms only accept end-to-end encrypted messages, see e2ee.go
+	E2EE bool `json:"e2ee,omitempty"`
+	// ArchivedAt is when the room was archived for being inactive, nil while it is active, see archive.go
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+// StoredMessage is an event sent to a room, with the sequence number it got in the room
+type StoredMessage struct {
+	// ID is the id of chat messages, empty for other events
+	ID    string    `json:"id,omitempty"`
+	Room  string    `json:"room"`
+	Seq   uint64    `json:"seq"`
+	Event Event     `json:"event"`
+	Sent  time.Time `json:"sent"`
+	// Reactions are the users that reacted to the message, keyed by emoji
+	Reactions map[string][]string `json:"reactions,omitempty"`
+}
+
+// Ban keeps a user from logging in and connecting
+type Ban struct {
+	Username string `json:"username"`
+	Reason   string `json:"reason,omitempty"`
+	// Actor is who banned the user
+	Actor   string    `json:"actor,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// APIKey lets a machine client connect or publish without the login, see apikey.go
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Username is the user the connections made with the key act as
+	Username string `json:"username"`
+	// SecretHash is the SHA-256 of the secret, the secret itself is only shown when issued
+	SecretHash string   `json:"secret_hash"`
+	Scopes     []string `json:"scopes"`
+	// Rooms limits the key to these rooms, all rooms are allowed if empty
+	Rooms   []string   `json:"rooms,omitempty"`
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+}
+
+// KeyBundle holds the public keys a device of an E2EE client published, see e2ee.go
+// The keys are opaque to the server, it only hands them out
+type KeyBundle struct {
+	Username        string `json:"username"`
+	DeviceID        string `json:"device_id"`
+	IdentityKey     string `json:"identity_key"`
+	SignedPrekey    string `json:"signed_prekey"`
+	PrekeySignature string `json:"prekey_signature"`
+	// OneTimePrekeys are handed out once each, the client publishes more when they run low
+	OneTimePrekeys []string  `json:"one_time_prekeys,omitempty"`
+	Updated        time.Time `json:"updated"`
+}
+
+// Device is a browser or app a user connected from, see device.go
+type Device struct {
+	Username string `json:"username"`
+	// ID is assigned by the server on the first connect and kept by the client
+	ID string `json:"id"`
+	// Name is chosen by the client, like "Firefox on Linux" or "Pixel 8"
+	Name     string    `json:"name,omitempty"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// StoredPushToken is a push token registered from a device of a user, see notify.go
+type StoredPushToken struct {
+	Username string `json:"username"`
+	// DeviceID is the device the token was registered from, empty for clients without one
+	DeviceID   string    `json:"device_id,omitempty"`
+	Platform   string    `json:"platform"`
+	Token      string    `json:"token"`
+	Registered time.Time `json:"registered"`
+}
+
+// Profile is what a user shows others about themselves, see profile.go
+// The display name is the nickname of the user, it is kept with the nickname
+type Profile struct {
+	Username   string    `json:"username"`
+	AvatarURL  string    `json:"avatar_url,omitempty"`
+	StatusText string    `json:"status_text,omitempty"`
+	Updated    time.Time `json:"updated"`
+}
+
+// Usage is what a tenant used since Since that was not reported yet, see metering.go
+type Usage struct {
+	Tenant            string    `json:"tenant"`
+	Since             time.Time `json:"since"`
+	ConnectionSeconds float64   `json:"connection_seconds"`
+	Messages          int64     `json:"messages"`
+	BytesIn           int64     `json:"bytes_in"`
+	BytesOut          int64     `json:"bytes_out"`
+}
+
+// DocUpdate is a CRDT update of a collaborative document, see docs.go
+// The update is opaque to the server, like a Yjs or Automerge binary update
+type DocUpdate struct {
+	Room   string    `json:"room"`
+	Doc    string    `json:"doc"`
+	Seq    uint64    `json:"seq"`
+	Update []byte    `json:"update"`
+	From   string    `json:"from"`
+	Sent   time.Time `json:"sent"`
+}
+
+// DocSnapshot is the state of a document merging all its updates up to Seq
+type DocSnapshot struct {
+	Room  string    `json:"room"`
+	Doc   string    `json:"doc"`
+	Seq   uint64    `json:"seq"`
+	State []byte    `json:"state"`
+	From  string    `json:"from"`
+	Saved time.Time `json:"saved"`
+}
+
+// RoomTimer is an event broadcast to a room once its time has come, see timers.go
+type RoomTimer struct {
+	ID      string    `json:"id"`
+	Room    string    `json:"room"`
+	FiresAt time.Time `json:"fires_at"`
+	Event   Event     `json:"event"`
+	// Countdown timers were announced to the room, so their cancellation is announced too
+	Countdown bool `json:"countdown,omitempty"`
+}
+
+// add adds the other usage of the same tenant, Since becomes the earlier of both
+func (u *Usage) add(other Usage) {
+	if u.Since.IsZero() || (!other.Since.IsZero() && other.Since.Before(u.Since)) {
+		u.Since = other.Since
+	}
+	u.ConnectionSeconds += other.ConnectionSeconds
+	u.Messages += other.Messages
+	u.BytesIn += other.BytesIn
+	u.BytesOut += other.BytesOut
+}
+
+// UserStore is used to persist user accounts
+type UserStore interface {
+	// SaveUser adds or replaces a user
+	SaveUser(user User) error
+	// GetUser returns a user, ErrNotFound is returned if it doesn't exist
+	GetUser(username string) (User, error)
+	// DeleteUser removes a user, ErrNotFound is returned if it doesn't exist
+	DeleteUser(username string) error
+}
+
+// RoomStore is used to persist rooms
+type RoomStore interface {
+	// SaveRoom adds or replaces a room
+	SaveRoom(room Room) error
+	// GetRoom returns a room, ErrNotFound is returned if it doesn't exist
+	GetRoom(name string) (Room, error)
+	// ListRooms returns all rooms ordered by name
+	ListRooms() ([]Room, error)
+	// DeleteRoom removes a room with all its messages
+	DeleteRoom(name string) error
+}
+
+// MessageStore is used to persist messages
+type MessageStore interface {
+	// SaveScheduled adds or replaces a scheduled message
+	SaveScheduled(msg ScheduledMessage) error
+	// DeleteScheduled removes a scheduled message, ErrNotFound is returned if it doesn't exist
+	DeleteScheduled(id string) error
+	// GetScheduled returns a scheduled message, ErrNotFound is returned if it doesn't exist
+	GetScheduled(id string) (ScheduledMessage, error)
+	// ListScheduled returns all scheduled messages ordered by delivery time
+	ListScheduled() ([]ScheduledMessage, error)
+	// ListScheduledByAuthor returns the scheduled messages of the author ordered by delivery time
+	ListScheduledByAuthor(author string) ([]ScheduledMessage, error)
+	// ListScheduledDue returns the scheduled messages to deliver at or before now ordered by delivery time
+	ListScheduledDue(now time.Time) ([]ScheduledMessage, error)
+	// AppendMessage adds a message to the history of its room
+	AppendMessage(msg StoredMessage) error
+	// ListMessages returns up to limit of the latest messages of a room, oldest first
+	ListMessages(room string, limit int) ([]StoredMessage, error)
+	// GetMessage returns a chat message by id, ErrNotFound is returned if it doesn't exist
+	GetMessage(id string) (StoredMessage, error)
+	// SaveReactions replaces the reactions of a message
+	SaveReactions(id string, reactions map[string][]string) error
+	// PurgeMessages deletes the messages of a room sent before the time, and all but
+	// the latest keep messages. A zero time or keep of -1 disables that part.
+	// It returns how many were deleted and the highest sequence number deleted
+	PurgeMessages(room string, before time.Time, keep int) (int, uint64, error)
+	// SearchMessages returns the chat messages of the rooms containing all terms of
+	// the search as words, newest first, see search.go
+	SearchMessages(search MessageSearch) ([]StoredMessage, error)
+	// ExportMessages calls each for the events of a room sent from up to before to,
+	// ordered by sequence number, a zero time leaves that end open. It stops at the
+	// first error returned by each and returns it
+	ExportMessages(room string, from, to time.Time, each func(StoredMessage) error) error
+	// EraseMessagesFrom deletes the chat messages the user sent, or attributes them to
+	// replacement if it is set, and removes the reactions of the user or gives them to
+	// replacement, see gdpr.go. With dryRun it only counts what it would change
+	EraseMessagesFrom(username, replacement string, dryRun bool) (MessageErasure, error)
+}
+
+// BanStore is used to persist bans
+type BanStore interface {
+	// SaveBan adds or replaces the ban of a user
+	SaveBan(ban Ban) error
+	// DeleteBan lifts the ban of a user, ErrNotFound is returned if the user isn't banned
+	DeleteBan(username string) error
+	// IsBanned returns true if the user is banned
+	IsBanned(username string) (bool, error)
+	// ListBans returns all bans ordered by username
+	ListBans() ([]Ban, error)
+}
+
+// APIKeyStore is used to persist API keys, revoked keys are kept
+type APIKeyStore interface {
+	// SaveAPIKey adds or replaces a key
+	SaveAPIKey(key APIKey) error
+	// GetAPIKey returns a key, ErrNotFound is returned if it doesn't exist
+	GetAPIKey(id string) (APIKey, error)
+	// ListAPIKeys returns all keys ordered by creation
+	ListAPIKeys() ([]APIKey, error)
+}
+
+// KeyStore is used to persist the key bundles of E2EE devices
+type KeyStore interface {
+	// SaveKeyBundle adds or replaces the bundle of a device
+	SaveKeyBundle(bundle KeyBundle) error
+	// ListKeyBundles returns the bundles of all devices of a user ordered by device id
+	ListKeyBundles(username string) ([]KeyBundle, error)
+	// DeleteKeyBundles removes the bundles of all devices of a user
+	DeleteKeyBundles(username string) error
+}
+
+// DeviceStore is used to persist the devices of users
+type DeviceStore interface {
+	// SaveDevice adds or replaces a device
+	SaveDevice(device Device) error
+	// ListDevices returns the devices of a user ordered by creation
+	ListDevices(username string) ([]Device, error)
+	// DeleteDevice removes a device, ErrNotFound is returned if it doesn't exist
+	DeleteDevice(username, id string) error
+}
+
+// MembershipStore is used to persist the rooms users are members of, a user becomes
+// a member by being in the room, see search.go
+type MembershipStore interface {
+	// AddMembership records that the user is a member of the room, nothing is
+	// recorded if the room doesn't exist
+	AddMembership(username, room string) error
+	// ListMemberships returns the rooms the user is a member of ordered by name
+	ListMemberships(username string) ([]Room, error)
+	// DeleteMemberships removes all memberships of the user
+	DeleteMemberships(username string) error
+}
+
+// PushTokenStore is used to persist the push tokens of devices, see notify.go
+type PushTokenStore interface {
+	// SavePushToken adds a token, a token the user registered before is replaced
+	SavePushToken(token StoredPushToken) error
+	// ListPushTokens returns the tokens of a user ordered by platform and token
+	ListPushTokens(username string) ([]StoredPushToken, error)
+	// DeletePushTokens removes the tokens registered from the device of the user, or
+	// all tokens of the user if deviceID is empty
+	DeletePushTokens(username, deviceID string) error
+}
+
+// ProfileStore is used to persist the profiles of users
+type ProfileStore interface {
+	// SaveProfile adds or replaces the profile of a user
+	SaveProfile(profile Profile) error
+	// GetProfile returns the profile of a user, ErrNotFound is returned if it doesn't exist
+	GetProfile(username string) (Profile, error)
+	// DeleteProfile removes the profile of a user, ErrNotFound is returned if it doesn't exist
+	DeleteProfile(username string) error
+}
+
+// UsageStore is used to persist the usage of tenants until it is reported, so it
+// survives restarts and is shared by instances
+type UsageStore interface {
+	// AddUsage adds to the unreported usage of the tenant
+	AddUsage(usage Usage) error
+	// TakeUsage returns the unreported usage of all tenants ordered by tenant and removes it
+	TakeUsage() ([]Usage, error)
+}
+
+// DocumentStore is used to persist the collaborative documents of rooms, see docs.go
+type DocumentStore interface {
+	// AppendDocUpdate adds an update to its document
+	AppendDocUpdate(update DocUpdate) error
+	// LoadDoc returns the snapshot of a document, zero if it has none, and the updates
+	// after it ordered by sequence number
+	LoadDoc(room, doc string) (DocSnapshot, []DocUpdate, error)
+	// CompactDoc replaces the snapshot of its document and deletes the updates it
+	// merged, a snapshot older than the stored one is ignored
+	CompactDoc(snapshot DocSnapshot) error
+}
+
+// TimerStore is used to persist the timers of rooms, see timers.go
+type TimerStore interface {
+	// SaveTimer adds or replaces a timer
+	SaveTimer(timer RoomTimer) error
+	// DeleteTimer removes a timer and returns it, ErrNotFound is returned if it doesn't exist
+	DeleteTimer(id string) (RoomTimer, error)
+	// ListTimers returns the timers firing at or before the time, ordered by firing time
+	ListTimers(until time.Time) ([]RoomTimer, error)
+}
+
+// Store persists the state of the server
+// The memory store is used for development, the file store for single instances
+// and the Postgres store when the state has to outlive the instance
+type Store interface {
+	UserStore
+	RoomStore
+	MembershipStore
+	MessageStore
+	BanStore
+	APIKeyStore
+	KeyStore
+	DeviceStore
+	PushTokenStore
+	ProfileStore
+	UsageStore
+	DocumentStore
+	TimerStore
+	// Ping checks that the store is reachable
+	Ping(ctx context.Context) error
+	// Close releases the resources of the store
+	Close() error
+}
+
+// newStore returns the store configured by the config, Postgres if a database URL is
+// set, otherwise a store persisted at the store path, or an in memory store if both are empty
+func newStore(ctx context.Context, config Config) (Store, error) {
+	if config.DatabaseURL != "" {
+		return newPostgresStore(ctx, config.DatabaseURL)
+	}
+	if config.StorePath == "" {
+		return newMemoryStore(), nil
+	}
+	return newFileStore(config.StorePath)
+}
+
+// memoryStore keeps everything in memory, used for development
+type memoryStore struct {
+	sync.RWMutex
+	scheduled map[string]ScheduledMessage
+	users     map[string]User
+	rooms     map[string]Room
+	// memberships are the rooms of each user, keyed by username
+	memberships map[string]map[string]struct{}
+	messages    map[string][]StoredMessage
+	// messageRooms is the room of each stored message with an id
+	messageRooms map[string]string
+	bans         map[string]Ban
+	apiKeys      map[string]APIKey
+	// keyBundles are keyed by username, then device id
+	keyBundles map[string]map[string]KeyBundle
+	// devices are keyed by username, then device id
+	devices map[string]map[string]Device
+	// pushTokens are keyed by username, then platform and token
+	pushTokens map[string]map[pushTokenKey]StoredPushToken
+	profiles   map[string]Profile
+	// usage is the unreported usage, keyed by tenant
+	usage map[string]Usage
+	// docs are keyed by room, then document name
+	docs map[string]map[string]*memoryDoc
+	// timers are keyed by id
+	timers map[string]RoomTimer
+}
+
+// pushTokenKey is a token of the memory store, a token is unique per platform
+type pushTokenKey struct {
+	platform, token string
+}
+
+// memoryDoc is a document of the memory store
+type memoryDoc struct {
+	snapshot DocSnapshot
+	updates  []DocUpdate
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		scheduled:    make(map[string]ScheduledMessage),
+		users:        make(map[string]User),
+		rooms:        make(map[string]Room),
+		memberships:  make(map[string]map[string]struct{}),
+		messages:     make(map[string][]StoredMessage),
+		messageRooms: make(map[string]string),
+		bans:         make(map[string]Ban),
+		apiKeys:      make(map[string]APIKey),
+		keyBundles:   make(map[string]map[string]KeyBundle),
+		devices:      make(map[string]map[string]Device),
+		pushTokens:   make(map[string]map[pushTokenKey]StoredPushToken),
+		profiles:     make(map[string]Profile),
+		usage:        make(map[string]Usage),
+		docs:         make(map[string]map[string]*memoryDoc),
+		timers:       make(map[string]RoomTimer),
+	}
+}
+
+func (s *memoryStore) SaveScheduled(msg ScheduledMessage) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.scheduled[msg.ID] = msg
+	return nil
+}
+
+func (s *memoryStore) DeleteScheduled(id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.scheduled[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.scheduled, id)
+	return nil
+}
+
+func (s *memoryStore) GetScheduled(id string) (ScheduledMessage, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	msg, ok := s.scheduled[id]
+	if !ok {
+		return ScheduledMessage{}, ErrNotFound
+	}
+	return msg, nil
+}
+
+func (s *memoryStore) ListScheduled() ([]ScheduledMessage, error) {
+	return s.listScheduled(func(ScheduledMessage) bool { return true }), nil
+}
+
+func (s *memoryStore) ListScheduledByAuthor(author string) ([]ScheduledMessage, error) {
+	return s.listScheduled(func(msg ScheduledMessage) bool { return msg.Author == author }), nil
+}
+
+func (s *memoryStore) ListScheduledDue(now time.Time) ([]ScheduledMessage, error) {
+	return s.listScheduled(func(msg ScheduledMessage) bool { return !msg.DeliverAt.After(now) }), nil
+}
+
+// listScheduled returns the scheduled messages matching keep ordered by delivery time
+func (s *memoryStore) listScheduled(keep func(ScheduledMessage) bool) []ScheduledMessage {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := []ScheduledMessage{}
+	for _, msg := range s.scheduled {
+		if keep(msg) {
+			list = append(list, msg)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeliverAt.Before(list[j].DeliverAt) })
+	return list
+}
+
+func (s *memoryStore) AppendMessage(msg StoredMessage) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// The file store appends a message again when its reactions change, it replaces the old one
+	if i := s.messageIndex(msg.ID); i >= 0 {
+		s.messages[msg.Room][i] = msg
+		return nil
+	}
+
+	messages := append(s.messages[msg.Room], msg)
+	if len(messages) > storedMessagesPerRoom {
+		for _, dropped := range messages[:len(messages)-storedMessagesPerRoom] {
+			delete(s.messageRooms, dropped.ID)
+		}
+		messages = messages[len(messages)-storedMessagesPerRoom:]
+	}
+	s.messages[msg.Room] = messages
+	if msg.ID != "" {
+		s.messageRooms[msg.ID] = msg.Room
+	}
+	return nil
+}
+
+// messageIndex returns the index of the message in the messages of its room, -1 if it isn't stored
+// The caller must hold the lock
+func (s *memoryStore) messageIndex(id string) int {
+	room, ok := s.messageRooms[id]
+	if id == "" || !ok {
+		return -1
+	}
+	return slices.IndexFunc(s.messages[room], func(msg StoredMessage) bool { return msg.ID == id })
+}
+
+func (s *memoryStore) GetMessage(id string) (StoredMessage, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	i := s.messageIndex(id)
+	if i < 0 {
+		return StoredMessage{}, ErrNotFound
+	}
+	msg := s.messages[s.messageRooms[id]][i]
+	msg.Reactions = maps.Clone(msg.Reactions)
+	return msg, nil
+}
+
+func (s *memoryStore) SaveReactions(id string, reactions map[string][]string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	i := s.messageIndex(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.messages[s.messageRooms[id]][i].Reactions = maps.Clone(reactions)
+	return nil
+}
+
+func (s *memoryStore) ListMessages(room string, limit int) ([]StoredMessage, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	messages := s.messages[room]
+	if len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	// Messages are appended outside the room lock, so they may arrive out of order
+	list := append([]StoredMessage{}, messages...)
+	sort.Slice(list, func(i, j int) bool { return list[i].Seq < list[j].Seq })
+	return list, nil
+}
+
+// SearchMessages goes through all messages of the rooms, the in memory store only
+// holds the latest of each room anyway
+func (s *memoryStore) SearchMessages(search MessageSearch) ([]StoredMessage, error) {
+	s.RLock()
+	var found []StoredMessage
+	for _, room := range search.Rooms {
+		for _, msg := range s.messages[room] {
+			if msg.Event.Type != EventNewMessage {
+				continue
+			}
+			var chat SendMessageEvent
+			if err := json.Unmarshal(msg.Event.Payload, &chat); err != nil {
+				continue
+			}
+			if matchesTerms(chat.Message, search.Terms) {
+				msg.Reactions = maps.Clone(msg.Reactions)
+				found = append(found, msg)
+			}
+		}
+	}
+	s.RUnlock()
+
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].Sent.Equal(found[j].Sent) {
+			return found[i].Sent.After(found[j].Sent)
+		}
+		return found[i].Seq > found[j].Seq
+	})
+	if search.Offset >= len(found) {
+		return []StoredMessage{}, nil
+	}
+	found = found[search.Offset:]
+	return found[:min(len(found), search.Limit)], nil
+}
+
+func (s *memoryStore) ExportMessages(room string, from, to time.Time, each func(StoredMessage) error) error {
+	s.RLock()
+	list := append([]StoredMessage{}, s.messages[room]...)
+	s.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Seq < list[j].Seq })
+	for _, msg := range list {
+		if (!from.IsZero() && msg.Sent.Before(from)) || (!to.IsZero() && !msg.Sent.Before(to)) {
+			continue
+		}
+		msg.Reactions = maps.Clone(msg.Reactions)
+		if err := each(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) EraseMessagesFrom(username, replacement string, dryRun bool) (MessageErasure, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var erasure MessageErasure
+	for room, messages := range s.messages {
+		kept := messages
+		if !dryRun {
+			kept = messages[:0]
+		}
+		for _, msg := range messages {
+			if msg.Event.Type == EventNewMessage && messageAuthor(msg.Event.Payload) == username {
+				erasure.Messages++
+				if !dryRun && replacement == "" {
+					delete(s.messageRooms, msg.ID)
+					continue
+				}
+				if !dryRun {
+					msg.Event.Payload = anonymizeMessage(msg.Event.Payload, replacement)
+				}
+			}
+			if reactions, ok := eraseReactions(msg.Reactions, username, replacement); ok {
+				erasure.Reactions++
+				if !dryRun {
+					msg.Reactions = reactions
+				}
+			}
+			if !dryRun {
+				kept = append(kept, msg)
+			}
+		}
+		if dryRun {
+			continue
+		}
+		if len(kept) == 0 {
+			delete(s.messages, room)
+		} else {
+			s.messages[room] = kept
+		}
+	}
+	return erasure, nil
+}
+
+func (s *memoryStore) PurgeMessages(room string, before time.Time, keep int) (int, uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Messages are appended outside the room lock, so they are sorted before counting from the end
+	messages := s.messages[room]
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Seq < messages[j].Seq })
+
+	kept := messages[:0]
+	var lastSeq uint64
+	deleted := 0
+	for i, msg := range messages {
+		tooOld := !before.IsZero() && msg.Sent.Before(before)
+		tooMany := keep >= 0 && i < len(messages)-keep
+		if !tooOld && !tooMany {
+			kept = append(kept, msg)
+			continue
+		}
+		delete(s.messageRooms, msg.ID)
+		lastSeq = max(lastSeq, msg.Seq)
+		deleted++
+	}
+	if len(kept) == 0 {
+		delete(s.messages, room)
+	} else {
+		s.messages[room] = kept
+	}
+	return deleted, lastSeq, nil
+}
+
+func (s *memoryStore) SaveUser(user User) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.users[user.Username] = user
+	return nil
+}
+
+func (s *memoryStore) GetUser(username string) (User, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryStore) DeleteUser(username string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.users[username]; !ok {
+		return ErrNotFound
+	}
+	delete(s.users, username)
+	return nil
+}
+
+func (s *memoryStore) SaveRoom(room Room) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.rooms[room.Name] = room
+	return nil
+}
+
+func (s *memoryStore) GetRoom(name string) (Room, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	room, ok := s.rooms[name]
+	if !ok {
+		return Room{}, ErrNotFound
+	}
+	room.Invited = slices.Clone(room.Invited)
+	return room, nil
+}
+
+func (s *memoryStore) DeleteRoom(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.rooms[name]
+	if !ok && len(s.messages[name]) == 0 {
+		return ErrNotFound
+	}
+	for _, msg := range s.messages[name] {
+		delete(s.messageRooms, msg.ID)
+	}
+	delete(s.messages, name)
+	delete(s.rooms, name)
+	for username, rooms := range s.memberships {
+		delete(rooms, name)
+		if len(rooms) == 0 {
+			delete(s.memberships, username)
+		}
+	}
+	delete(s.docs, name)
+	maps.DeleteFunc(s.timers, func(_ string, timer RoomTimer) bool { return timer.Room == name })
+	return nil
+}
+
+func (s *memoryStore) ListRooms() ([]Room, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		list = append(list, room)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (s *memoryStore) SaveBan(ban Ban) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.bans[ban.Username] = ban
+	return nil
+}
+
+func (s *memoryStore) DeleteBan(username string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.bans[username]; !ok {
+		return ErrNotFound
+	}
+	delete(s.bans, username)
+	return nil
+}
+
+func (s *memoryStore) IsBanned(username string) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	_, ok := s.bans[username]
+	return ok, nil
+}
+
+func (s *memoryStore) ListBans() ([]Ban, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]Ban, 0, len(s.bans))
+	for _, ban := range s.bans {
+		list = append(list, ban)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list, nil
+}
+
+func (s *memoryStore) SaveAPIKey(key APIKey) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.apiKeys[key.ID] = key
+	return nil
+}
+
+func (s *memoryStore) GetAPIKey(id string) (APIKey, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok {
+		return APIKey{}, ErrNotFound
+	}
+	return key, nil
+}
+
+func (s *memoryStore) ListAPIKeys() ([]APIKey, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]APIKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		list = append(list, key)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list, nil
+}
+
+func (s *memoryStore) AddMembership(username, room string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.rooms[room]; !ok {
+		return nil
+	}
+	rooms, ok := s.memberships[username]
+	if !ok {
+		rooms = make(map[string]struct{})
+		s.memberships[username] = rooms
+	}
+	rooms[room] = struct{}{}
+	return nil
+}
+
+// isMember returns true if the membership of the user in the room is recorded
+func (s *memoryStore) isMember(username, room string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	_, ok := s.memberships[username][room]
+	return ok
+}
+
+func (s *memoryStore) ListMemberships(username string) ([]Room, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]Room, 0, len(s.memberships[username]))
+	for name := range s.memberships[username] {
+		room := s.rooms[name]
+		room.Invited = slices.Clone(room.Invited)
+		list = append(list, room)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (s *memoryStore) DeleteMemberships(username string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.memberships, username)
+	return nil
+}
+
+func (s *memoryStore) SaveKeyBundle(bundle KeyBundle) error {
+	s.Lock()
+	defer s.Unlock()
+
+	devices, ok := s.keyBundles[bundle.Username]
+	if !ok {
+		devices = make(map[string]KeyBundle)
+		s.keyBundles[bundle.Username] = devices
+	}
+	bundle.OneTimePrekeys = slices.Clone(bundle.OneTimePrekeys)
+	devices[bundle.DeviceID] = bundle
+	return nil
+}
+
+func (s *memoryStore) DeleteKeyBundles(username string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.keyBundles, username)
+	return nil
+}
+
+func (s *memoryStore) ListKeyBundles(username string) ([]KeyBundle, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]KeyBundle, 0, len(s.keyBundles[username]))
+	for _, bundle := range s.keyBundles[username] {
+		bundle.OneTimePrekeys = slices.Clone(bundle.OneTimePrekeys)
+		list = append(list, bundle)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeviceID < list[j].DeviceID })
+	return list, nil
+}
+
+func (s *memoryStore) SaveDevice(device Device) error {
+	s.Lock()
+	defer s.Unlock()
+
+	devices, ok := s.devices[device.Username]
+	if !ok {
+		devices = make(map[string]Device)
+		s.devices[device.Username] = devices
+	}
+	devices[device.ID] = device
+	return nil
+}
+
+func (s *memoryStore) ListDevices(username string) ([]Device, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]Device, 0, len(s.devices[username]))
+	for _, device := range s.devices[username] {
+		list = append(list, device)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list, nil
+}
+
+func (s *memoryStore) DeleteDevice(username, id string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.devices[username][id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.devices[username], id)
+	if len(s.devices[username]) == 0 {
+		delete(s.devices, username)
+	}
+	return nil
+}
+
+func (s *memoryStore) SavePushToken(token StoredPushToken) error {
+	s.Lock()
+	defer s.Unlock()
+
+	tokens, ok := s.pushTokens[token.Username]
+	if !ok {
+		tokens = make(map[pushTokenKey]StoredPushToken)
+		s.pushTokens[token.Username] = tokens
+	}
+	tokens[pushTokenKey{platform: token.Platform, token: token.Token}] = token
+	return nil
+}
+
+func (s *memoryStore) ListPushTokens(username string) ([]StoredPushToken, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := slices.Collect(maps.Values(s.pushTokens[username]))
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		return a.Platform < b.Platform || (a.Platform == b.Platform && a.Token < b.Token)
+	})
+	return list, nil
+}
+
+func (s *memoryStore) DeletePushTokens(username, deviceID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for key, token := range s.pushTokens[username] {
+		if deviceID == "" || token.DeviceID == deviceID {
+			delete(s.pushTokens[username], key)
+		}
+	}
+	if len(s.pushTokens[username]) == 0 {
+		delete(s.pushTokens, username)
+	}
+	return nil
+}
+
+func (s *memoryStore) SaveProfile(profile Profile) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.profiles[profile.Username] = profile
+	return nil
+}
+
+func (s *memoryStore) GetProfile(username string) (Profile, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	profile, ok := s.profiles[username]
+	if !ok {
+		return Profile{}, ErrNotFound
+	}
+	return profile, nil
+}
+
+func (s *memoryStore) DeleteProfile(username string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.profiles[username]; !ok {
+		return ErrNotFound
+	}
+	delete(s.profiles, username)
+	return nil
+}
+
+func (s *memoryStore) AddUsage(usage Usage) error {
+	s.Lock()
+	defer s.Unlock()
+
+	total := s.usage[usage.Tenant]
+	total.Tenant = usage.Tenant
+	total.add(usage)
+	s.usage[usage.Tenant] = total
+	return nil
+}
+
+func (s *memoryStore) TakeUsage() ([]Usage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	list := slices.Collect(maps.Values(s.usage))
+	sort.Slice(list, func(i, j int) bool { return list[i].Tenant < list[j].Tenant })
+	clear(s.usage)
+	return list, nil
+}
+
+// doc returns the document, created if it doesn't exist
+// Only call it while holding the write lock
+func (s *memoryStore) doc(room, name string) *memoryDoc {
+	docs, ok := s.docs[room]
+	if !ok {
+		docs = make(map[string]*memoryDoc)
+		s.docs[room] = docs
+	}
+	doc, ok := docs[name]
+	if !ok {
+		doc = &memoryDoc{snapshot: DocSnapshot{Room: room, Doc: name}}
+		docs[name] = doc
+	}
+	return doc
+}
+
+func (s *memoryStore) AppendDocUpdate(update DocUpdate) error {
+	s.Lock()
+	defer s.Unlock()
+
+	doc := s.doc(update.Room, update.Doc)
+	if update.Seq <= doc.snapshot.Seq {
+		return nil
+	}
+	doc.updates = append(doc.updates, update)
+	return nil
+}
+
+func (s *memoryStore) LoadDoc(room, name string) (DocSnapshot, []DocUpdate, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	doc, ok := s.docs[room][name]
+	if !ok {
+		return DocSnapshot{Room: room, Doc: name}, []DocUpdate{}, nil
+	}
+	return doc.snapshot, slices.Clone(doc.updates), nil
+}
+
+func (s *memoryStore) CompactDoc(snapshot DocSnapshot) error {
+	s.Lock()
+	defer s.Unlock()
+
+	doc := s.doc(snapshot.Room, snapshot.Doc)
+	if snapshot.Seq < doc.snapshot.Seq {
+		return nil
+	}
+	doc.snapshot = snapshot
+	doc.updates = slices.DeleteFunc(doc.updates, func(update DocUpdate) bool { return update.Seq <= snapshot.Seq })
+	return nil
+}
+
+func (s *memoryStore) SaveTimer(timer RoomTimer) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.timers[timer.ID] = timer
+	return nil
+}
+
+func (s *memoryStore) DeleteTimer(id string) (RoomTimer, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	timer, ok := s.timers[id]
+	if !ok {
+		return timer, ErrNotFound
+	}
+	delete(s.timers, id)
+	return timer, nil
+}
+
+func (s *memoryStore) ListTimers(until time.Time) ([]RoomTimer, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := []RoomTimer{}
+	for _, timer := range s.timers {
+		if !timer.FiresAt.After(until) {
+			list = append(list, timer)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].FiresAt.Before(list[j].FiresAt) })
+	return list, nil
+}
+
+func (s *memoryStore) Ping(_ context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// fileStore is a memoryStore that writes its content to a JSON file on every change,
+// so it survives restarts
+// Messages are appended to a second file with one JSON message per line, so sending
+// a message doesn't rewrite the whole store
+type fileStore struct {
+	*memoryStore
+	path string
+
+	// flushLock keeps concurrent flushes from writing the temporary file at the same time
+	flushLock sync.Mutex
+
+	// messages is the file messages are appended to
+	messages     *os.File
+	messagesLock sync.Mutex
+
+	// docs is the file the updates and snapshots of documents are appended to
+	docs     *os.File
+	docsLock sync.Mutex
+}
+
+// maxDocRecordSize is the longest line of the documents file
+var maxDocRecordSize = 64 * 1024 * 1024
+
+// docRecord is a line of the documents file, an update or a snapshot
+type docRecord struct {
+	Update   *DocUpdate   `json:"update,omitempty"`
+	Snapshot *DocSnapshot `json:"snapshot,omitempty"`
+}
+
+// fileStoreData is the content of the store file
+type fileStoreData struct {
+	Scheduled  []ScheduledMessage `json:"scheduled"`
+	Users      []User             `json:"users,omitempty"`
+	Rooms      []Room             `json:"rooms,omitempty"`
+	Bans       []Ban              `json:"bans,omitempty"`
+	APIKeys    []APIKey           `json:"api_keys,omitempty"`
+	KeyBundles []KeyBundle        `json:"key_bundles,omitempty"`
+	Devices    []Device           `json:"devices,omitempty"`
+	PushTokens []StoredPushToken  `json:"push_tokens,omitempty"`
+	Profiles   []Profile          `json:"profiles,omitempty"`
+	Usage      []Usage            `json:"usage,omitempty"`
+	Timers     []RoomTimer        `json:"timers,omitempty"`
+	// Memberships are the rooms of each user, keyed by username
+	Memberships map[string][]string `json:"memberships,omitempty"`
+}
+
+func newFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: newMemoryStore(), path: path}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.loadMessages(); err != nil {
+		return nil, err
+	}
+	if err := s.loadDocs(); err != nil {
+		return nil, err
+	}
+
+	messages, err := os.OpenFile(s.messagesPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s.messages = messages
+	docs, err := os.OpenFile(s.docsPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		messages.Close()
+		return nil, err
+	}
+	s.docs = docs
+	return s, nil
+}
+
+// messagesPath is the file the messages are appended to, next to the store file
+func (s *fileStore) messagesPath() string {
+	return s.path + ".messages"
+}
+
+// docsPath is the file the documents are appended to, next to the store file
+func (s *fileStore) docsPath() string {
+	return s.path + ".docs"
+}
+
+// load reads the store file, a missing file is an empty store
+func (s *fileStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var content fileStoreData
+	if err := json.Unmarshal(data, &content); err != nil {
+		return err
+	}
+	for _, msg := range content.Scheduled {
+		s.scheduled[msg.ID] = msg
+	}
+	for _, user := range content.Users {
+		s.users[user.Username] = user
+	}
+	for _, room := range content.Rooms {
+		s.rooms[room.Name] = room
+	}
+	for username, rooms := range content.Memberships {
+		for _, room := range rooms {
+			s.memoryStore.AddMembership(username, room)
+		}
+	}
+	for _, ban := range content.Bans {
+		s.bans[ban.Username] = ban
+	}
+	for _, key := range content.APIKeys {
+		s.apiKeys[key.ID] = key
+	}
+	for _, bundle := range content.KeyBundles {
+		s.memoryStore.SaveKeyBundle(bundle)
+	}
+	for _, device := range content.Devices {
+		s.memoryStore.SaveDevice(device)
+	}
+	for _, token := range content.PushTokens {
+		s.memoryStore.SavePushToken(token)
+	}
+	for _, profile := range content.Profiles {
+		s.profiles[profile.Username] = profile
+	}
+	for _, usage := range content.Usage {
+		s.usage[usage.Tenant] = usage
+	}
+	for _, timer := range content.Timers {
+		s.timers[timer.ID] = timer
+	}
+	return nil
+}
+
+// loadMessages reads the messages file, only the latest messages of each room are kept
+func (s *fileStore) loadMessages() error {
+	f, err := os.Open(s.messagesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), int(maxRequestBodySize))
+	for scanner.Scan() {
+		var msg StoredMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			// A crash can leave the last line half written, it is skipped
+			continue
+		}
+		s.memoryStore.AppendMessage(msg)
+	}
+	return scanner.Err()
+}
+
+// loadDocs reads the documents file, a snapshot drops the updates it merged
+func (s *fileStore) loadDocs() error {
+	f, err := os.Open(s.docsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxDocRecordSize)
+	for scanner.Scan() {
+		var record docRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash can leave the last line half written, it is skipped
+			continue
+		}
+		if record.Update != nil {
+			s.memoryStore.AppendDocUpdate(*record.Update)
+		}
+		if record.Snapshot != nil {
+			s.memoryStore.CompactDoc(*record.Snapshot)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *fileStore) SaveScheduled(msg ScheduledMessage) error {
+	if err := s.memoryStore.SaveScheduled(msg); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) DeleteScheduled(id string) error {
+	if err := s.memoryStore.DeleteScheduled(id); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) AppendMessage(msg StoredMessage) error {
+	if err := s.memoryStore.AppendMessage(msg); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	s.messagesLock.Lock()
+	defer s.messagesLock.Unlock()
+	_, err = s.messages.Write(append(data, '\n'))
+	return err
+}
+
+// SaveReactions appends the message again with its reactions, it replaces the old
+// line when the file is loaded
+func (s *fileStore) SaveReactions(id string, reactions map[string][]string) error {
+	if err := s.memoryStore.SaveReactions(id, reactions); err != nil {
+		return err
+	}
+	msg, err := s.memoryStore.GetMessage(id)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	s.messagesLock.Lock()
+	defer s.messagesLock.Unlock()
+	_, err = s.messages.Write(append(data, '\n'))
+	return err
+}
+
+func (s *fileStore) PurgeMessages(room string, before time.Time, keep int) (int, uint64, error) {
+	deleted, lastSeq, err := s.memoryStore.PurgeMessages(room, before, keep)
+	if err != nil || deleted == 0 {
+		return deleted, lastSeq, err
+	}
+	return deleted, lastSeq, s.compactMessages()
+}
+
+func (s *fileStore) EraseMessagesFrom(username, replacement string, dryRun bool) (MessageErasure, error) {
+	erasure, err := s.memoryStore.EraseMessagesFrom(username, replacement, dryRun)
+	if err != nil || dryRun || erasure == (MessageErasure{}) {
+		return erasure, err
+	}
+	// The old lines are still in the messages file, it is rewritten without them
+	return erasure, s.compactMessages()
+}
+
+func (s *fileStore) SaveUser(user User) error {
+	if err := s.memoryStore.SaveUser(user); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) DeleteUser(username string) error {
+	if err := s.memoryStore.DeleteUser(username); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) SaveRoom(room Room) error {
+	if err := s.memoryStore.SaveRoom(room); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) SaveTimer(timer RoomTimer) error {
+	if err := s.memoryStore.SaveTimer(timer); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) DeleteTimer(id string) (RoomTimer, error) {
+	timer, err := s.memoryStore.DeleteTimer(id)
+	if err != nil {
+		return timer, err
+	}
+	return timer, s.flush()
+}
+
+func (s *fileStore) DeleteRoom(name string) error {
+	if err := s.memoryStore.DeleteRoom(name); err != nil {
+		return err
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.compactMessages(); err != nil {
+		return err
+	}
+	return s.compactDocs()
+}
+
+func (s *fileStore) AppendDocUpdate(update DocUpdate) error {
+	if err := s.memoryStore.AppendDocUpdate(update); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(docRecord{Update: &update})
+	if err != nil {
+		return err
+	}
+
+	s.docsLock.Lock()
+	defer s.docsLock.Unlock()
+	_, err = s.docs.Write(append(data, '\n'))
+	return err
+}
+
+// CompactDoc rewrites the documents file, so the merged updates are gone from the disk
+func (s *fileStore) CompactDoc(snapshot DocSnapshot) error {
+	if err := s.memoryStore.CompactDoc(snapshot); err != nil {
+		return err
+	}
+	return s.compactDocs()
+}
+
+// compactDocs rewrites the documents file with the snapshot and updates of every
+// document still kept
+func (s *fileStore) compactDocs() error {
+	s.docsLock.Lock()
+	defer s.docsLock.Unlock()
+
+	tmp := s.docsPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	var records []docRecord
+	s.RLock()
+	for _, docs := range s.memoryStore.docs {
+		for _, doc := range docs {
+			if doc.snapshot.Seq > 0 {
+				records = append(records, docRecord{Snapshot: &doc.snapshot})
+			}
+			for i := range doc.updates {
+				records = append(records, docRecord{Update: &doc.updates[i]})
+			}
+		}
+	}
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			s.RUnlock()
+			f.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	s.RUnlock()
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.docsPath()); err != nil {
+		return err
+	}
+
+	// The old file was replaced, appending continues in the new one
+	docs, err := os.OpenFile(s.docsPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	s.docs.Close()
+	s.docs = docs
+	return nil
+}
+
+// compactMessages rewrites the messages file with the messages still kept, so
+// deleted messages are gone from the disk and don't come back on a restart
+func (s *fileStore) compactMessages() error {
+	s.messagesLock.Lock()
+	defer s.messagesLock.Unlock()
+
+	tmp := s.messagesPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	s.RLock()
+	for _, messages := range s.memoryStore.messages {
+		for _, msg := range messages {
+			data, err := json.Marshal(msg)
+			if err != nil {
+				s.RUnlock()
+				f.Close()
+				return err
+			}
+			w.Write(append(data, '\n'))
+		}
+	}
+	s.RUnlock()
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.messagesPath()); err != nil {
+		return err
+	}
+
+	// The old file was replaced, appending continues in the new one
+	messages, err := os.OpenFile(s.messagesPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	s.messages.Close()
+	s.messages = messages
+	return nil
+}
+
+func (s *fileStore) SaveBan(ban Ban) error {
+	if err := s.memoryStore.SaveBan(ban); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) DeleteBan(username string) error {
+	if err := s.memoryStore.DeleteBan(username); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) SaveAPIKey(key APIKey) error {
+	if err := s.memoryStore.SaveAPIKey(key); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) SaveKeyBundle(bundle KeyBundle) error {
+	if err := s.memoryStore.SaveKeyBundle(bundle); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) DeleteKeyBundles(username string) error {
+	if err := s.memoryStore.DeleteKeyBundles(username); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+// AddMembership only writes the file for new members, it is called for every connection
+func (s *fileStore) AddMembership(username, room string) error {
+	if s.memoryStore.isMember(username, room) {
+		return nil
+	}
+	if err := s.memoryStore.AddMembership(username, room); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) DeleteMemberships(username string) error {
+	if err := s.memoryStore.DeleteMemberships(username); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) SaveDevice(device Device) error {
+	if err := s.memoryStore.SaveDevice(device); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) DeleteDevice(username, id string) error {
+	if err := s.memoryStore.DeleteDevice(username, id); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) SavePushToken(token StoredPushToken) error {
+	if err := s.memoryStore.SavePushToken(token); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) DeletePushTokens(username, deviceID string) error {
+	if err := s.memoryStore.DeletePushTokens(username, deviceID); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) SaveProfile(profile Profile) error {
+	if err := s.memoryStore.SaveProfile(profile); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) DeleteProfile(username string) error {
+	if err := s.memoryStore.DeleteProfile(username); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) AddUsage(usage Usage) error {
+	if err := s.memoryStore.AddUsage(usage); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileStore) TakeUsage() ([]Usage, error) {
+	list, err := s.memoryStore.TakeUsage()
+	if err != nil || len(list) == 0 {
+		return list, err
+	}
+	return list, s.flush()
+}
+
+// Ping checks that the directory of the store file is still there
+func (s *fileStore) Ping(_ context.Context) error {
+	_, err := os.Stat(filepath.Dir(s.path))
+	return err
+}
+
+func (s *fileStore) Close() error {
+	s.docsLock.Lock()
+	s.docs.Close()
+	s.docsLock.Unlock()
+
+	s.messagesLock.Lock()
+	defer s.messagesLock.Unlock()
+	return s.messages.Close()
+}
+
+// flush writes the store to a temporary file and renames it so the file is never half written
+func (s *fileStore) flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	var content fileStoreData
+	var err error
+	if content.Scheduled, err = s.ListScheduled(); err != nil {
+		return err
+	}
+	if content.Rooms, err = s.ListRooms(); err != nil {
+		return err
+	}
+	if content.Bans, err = s.ListBans(); err != nil {
+		return err
+	}
+	if content.APIKeys, err = s.ListAPIKeys(); err != nil {
+		return err
+	}
+	s.RLock()
+	for _, user := range s.users {
+		content.Users = append(content.Users, user)
+	}
+	for username, rooms := range s.memberships {
+		if content.Memberships == nil {
+			content.Memberships = make(map[string][]string)
+		}
+		content.Memberships[username] = slices.Sorted(maps.Keys(rooms))
+	}
+	for _, devices := range s.keyBundles {
+		for _, bundle := range devices {
+			content.KeyBundles = append(content.KeyBundles, bundle)
+		}
+	}
+	for _, devices := range s.devices {
+		for _, device := range devices {
+			content.Devices = append(content.Devices, device)
+		}
+	}
+	for _, tokens := range s.pushTokens {
+		for _, token := range tokens {
+			content.PushTokens = append(content.PushTokens, token)
+		}
+	}
+	for _, profile := range s.profiles {
+		content.Profiles = append(content.Profiles, profile)
+	}
+	for _, usage := range s.usage {
+		content.Usage = append(content.Usage, usage)
+	}
+	for _, timer := range s.timers {
+		content.Timers = append(content.Timers, timer)
+	}
+	s.RUnlock()
+	sort.Slice(content.Users, func(i, j int) bool { return content.Users[i].Username < content.Users[j].Username })
+	sort.Slice(content.KeyBundles, func(i, j int) bool {
+		a, b := content.KeyBundles[i], content.KeyBundles[j]
+		return a.Username < b.Username || (a.Username == b.Username && a.DeviceID < b.DeviceID)
+	})
+	sort.Slice(content.Devices, func(i, j int) bool {
+		a, b := content.Devices[i], content.Devices[j]
+		return a.Username < b.Username || (a.Username == b.Username && a.ID < b.ID)
+	})
+	sort.Slice(content.PushTokens, func(i, j int) bool {
+		a, b := content.PushTokens[i], content.PushTokens[j]
+		if a.Username != b.Username {
+			return a.Username < b.Username
+		}
+		return a.Platform < b.Platform || (a.Platform == b.Platform && a.Token < b.Token)
+	})
+	sort.Slice(content.Profiles, func(i, j int) bool { return content.Profiles[i].Username < content.Profiles[j].Username })
+	sort.Slice(content.Usage, func(i, j int) bool { return content.Usage[i].Tenant < content.Usage[j].Tenant })
+	sort.Slice(content.Timers, func(i, j int) bool { return content.Timers[i].ID < content.Timers[j].ID })
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
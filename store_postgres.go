@@ -0,0 +1,833 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// pq registers the postgres driver for database/sql, its arrays are used for lists
+	"github.com/lib/pq"
+)
+
+// migrationFiles are the SQL migrations of the Postgres schema, they are applied in
+// the order of their file names and each one only once
+//
+//go:embed migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock taken while migrating, so instances starting
+// at the same time don't apply the same migration twice
+const migrationLockID = 0x77735f6d6967
+
+// postgresTimeout bounds every query, the store interfaces have no context
+var postgresTimeout = 5 * time.Second
+
+// postgresStore persists everything in Postgres, so it is shared by instances and
+// outlives them
+type postgresStore struct {
+	db *sql.DB
+}
+
+// newPostgresStore connects to the database at url and migrates its schema
+func newPostgresStore(ctx context.Context, url string) (*postgresStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &postgresStore{db: db}
+	if err := s.migrate(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating the database: %w", err)
+	}
+	return s, nil
+}
+
+// migrate applies the migrations that were not applied yet, all in one transaction
+func (s *postgresStore) migrate(ctx context.Context) error {
+	files, err := fs.Glob(migrationFiles, "migrations/postgres/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		// Files are named like 0001_init.sql, the number is the version
+		name := path.Base(file)
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("migration %s has no version: %w", name, err)
+		}
+
+		var applied bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied); err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		migration, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, string(migration)); err != nil {
+			return fmt.Errorf("migration %s: %w", name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return err
+		}
+		log.Println("applied migration", name)
+	}
+	return tx.Commit()
+}
+
+// exec runs a statement that changes a single row, ErrNotFound is returned if no row matched
+func (s *postgresStore) exec(query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// query runs a query and calls scan for every row
+func (s *postgresStore) query(scan func(*sql.Rows) error, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// queryRow runs a query returning a single row, ErrNotFound is returned if there is none
+func (s *postgresStore) queryRow(query string, args []any, dest ...any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *postgresStore) SaveScheduled(msg ScheduledMessage) error {
+	return s.exec(`INSERT INTO scheduled_messages (id, author, room, recipient, message, deliver_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET author = $2, room = $3, recipient = $4, message = $5, deliver_at = $6`,
+		msg.ID, msg.Author, msg.Room, msg.To, msg.Message, msg.DeliverAt)
+}
+
+func (s *postgresStore) DeleteScheduled(id string) error {
+	return s.exec(`DELETE FROM scheduled_messages WHERE id = $1`, id)
+}
+
+// scheduledColumns are the columns of a ScheduledMessage in the order Scan takes them
+const scheduledColumns = `id, author, room, recipient, message, deliver_at`
+
+func (s *postgresStore) GetScheduled(id string) (ScheduledMessage, error) {
+	var msg ScheduledMessage
+	err := s.queryRow(`SELECT `+scheduledColumns+` FROM scheduled_messages WHERE id = $1`, []any{id},
+		&msg.ID, &msg.Author, &msg.Room, &msg.To, &msg.Message, &msg.DeliverAt)
+	return msg, err
+}
+
+func (s *postgresStore) ListScheduled() ([]ScheduledMessage, error) {
+	return s.listScheduled(`SELECT ` + scheduledColumns + ` FROM scheduled_messages ORDER BY deliver_at`)
+}
+
+func (s *postgresStore) ListScheduledByAuthor(author string) ([]ScheduledMessage, error) {
+	return s.listScheduled(`SELECT `+scheduledColumns+` FROM scheduled_messages WHERE author = $1 ORDER BY deliver_at`, author)
+}
+
+func (s *postgresStore) ListScheduledDue(now time.Time) ([]ScheduledMessage, error) {
+	return s.listScheduled(`SELECT `+scheduledColumns+` FROM scheduled_messages WHERE deliver_at <= $1 ORDER BY deliver_at`, now)
+}
+
+// listScheduled runs a query selecting the scheduledColumns
+func (s *postgresStore) listScheduled(query string, args ...any) ([]ScheduledMessage, error) {
+	list := []ScheduledMessage{}
+	err := s.query(func(rows *sql.Rows) error {
+		var msg ScheduledMessage
+		if err := rows.Scan(&msg.ID, &msg.Author, &msg.Room, &msg.To, &msg.Message, &msg.DeliverAt); err != nil {
+			return err
+		}
+		list = append(list, msg)
+		return nil
+	}, query, args...)
+	return list, err
+}
+
+func (s *postgresStore) AppendMessage(msg StoredMessage) error {
+	// NULL is stored for events without payload, JSONB doesn't accept empty values
+	var payload any
+	if len(msg.Event.Payload) > 0 {
+		payload = []byte(msg.Event.Payload)
+	}
+	// Events other than chat messages have no id, NULL keeps them out of the unique index
+	var id any
+	if msg.ID != "" {
+		id = msg.ID
+	}
+	return s.exec(`INSERT INTO messages (room, seq, id, type, payload, sent) VALUES ($1, $2, $3, $4, $5, $6)`,
+		msg.Room, msg.Seq, id, msg.Event.Type, payload, msg.Sent)
+}
+
+func (s *postgresStore) ListMessages(room string, limit int) ([]StoredMessage, error) {
+	list := []StoredMessage{}
+	err := s.query(func(rows *sql.Rows) error {
+		msg, err := scanStoredMessage(rows)
+		if err != nil {
+			return err
+		}
+		list = append(list, msg)
+		return nil
+	}, `SELECT room, seq, id, type, payload, sent, reactions FROM (
+			SELECT * FROM messages WHERE room = $1 ORDER BY seq DESC LIMIT $2
+		) AS latest ORDER BY seq`, room, limit)
+	return list, err
+}
+
+func (s *postgresStore) PurgeMessages(room string, before time.Time, keep int) (int, uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	var beforeArg any
+	if !before.IsZero() {
+		beforeArg = before
+	}
+	// The messages past the latest keep ones are found with OFFSET, a keep of -1 matches none
+	// and a NULL before matches no message by age
+	var deleted int
+	var lastSeq sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `WITH purged AS (
+			DELETE FROM messages WHERE room = $1 AND (
+				sent < $2 OR
+				($3 >= 0 AND seq <= (SELECT seq FROM messages WHERE room = $1 ORDER BY seq DESC OFFSET GREATEST($3, 0) LIMIT 1))
+			) RETURNING seq
+		) SELECT count(*), max(seq) FROM purged`, room, beforeArg, keep).Scan(&deleted, &lastSeq)
+	return deleted, uint64(lastSeq.Int64), err
+}
+
+// scanStoredMessage scans the room, seq, id, type, payload, sent and reactions columns
+func scanStoredMessage(row interface{ Scan(dest ...any) error }) (StoredMessage, error) {
+	var msg StoredMessage
+	var id sql.NullString
+	var payload, reactions []byte
+	if err := row.Scan(&msg.Room, &msg.Seq, &id, &msg.Event.Type, &payload, &msg.Sent, &reactions); err != nil {
+		return StoredMessage{}, err
+	}
+	msg.ID = id.String
+	msg.Event.Payload = json.RawMessage(payload)
+	if len(reactions) > 0 {
+		if err := json.Unmarshal(reactions, &msg.Reactions); err != nil {
+			return StoredMessage{}, err
+		}
+	}
+	return msg, nil
+}
+
+// SearchMessages uses the full text index of the chat messages, the simple
+// configuration only splits words and ignores case, like the other stores
+func (s *postgresStore) SearchMessages(search MessageSearch) ([]StoredMessage, error) {
+	list := []StoredMessage{}
+	err := s.query(func(rows *sql.Rows) error {
+		msg, err := scanStoredMessage(rows)
+		if err != nil {
+			return err
+		}
+		list = append(list, msg)
+		return nil
+	}, `SELECT room, seq, id, type, payload, sent, reactions FROM messages
+		WHERE type = $1 AND room = ANY($2) AND search @@ plainto_tsquery('simple', $3)
+		ORDER BY sent DESC, seq DESC LIMIT $4 OFFSET $5`,
+		EventNewMessage, pq.Array(nonNil(search.Rooms)), strings.Join(search.Terms, " "), search.Limit, search.Offset)
+	return list, err
+}
+
+// ExportMessages reads the messages in batches, so a long export doesn't hold a
+// query open past the timeout while the messages are written out
+func (s *postgresStore) ExportMessages(room string, from, to time.Time, each func(StoredMessage) error) error {
+	var fromArg, toArg any
+	if !from.IsZero() {
+		fromArg = from
+	}
+	if !to.IsZero() {
+		toArg = to
+	}
+
+	var after int64 = -1
+	for {
+		batch := make([]StoredMessage, 0, exportBatchSize)
+		err := s.query(func(rows *sql.Rows) error {
+			msg, err := scanStoredMessage(rows)
+			if err != nil {
+				return err
+			}
+			batch = append(batch, msg)
+			return nil
+		}, `SELECT room, seq, id, type, payload, sent, reactions FROM messages
+			WHERE room = $1 AND seq > $2 AND ($3::timestamptz IS NULL OR sent >= $3) AND ($4::timestamptz IS NULL OR sent < $4)
+			ORDER BY seq LIMIT $5`, room, after, fromArg, toArg, exportBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, msg := range batch {
+			if err := each(msg); err != nil {
+				return err
+			}
+		}
+		if len(batch) < exportBatchSize {
+			return nil
+		}
+		after = int64(batch[len(batch)-1].Seq)
+	}
+}
+
+// EraseMessagesFrom changes the messages and reactions in one transaction, the
+// reactions are rewritten per emoji in SQL so the messages aren't read out
+func (s *postgresStore) EraseMessagesFrom(username, replacement string, dryRun bool) (MessageErasure, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	var erasure MessageErasure
+	if dryRun {
+		err := s.db.QueryRowContext(ctx, `SELECT
+				count(*) FILTER (WHERE type = $1 AND payload->>'from' = $2),
+				count(*) FILTER (WHERE reactions IS NOT NULL AND EXISTS (SELECT 1 FROM jsonb_each(reactions) r WHERE r.value ? $2))
+			FROM messages`, EventNewMessage, username).Scan(&erasure.Messages, &erasure.Reactions)
+		return erasure, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return erasure, err
+	}
+	defer tx.Rollback()
+
+	var result sql.Result
+	if replacement == "" {
+		result, err = tx.ExecContext(ctx, `DELETE FROM messages WHERE type = $1 AND payload->>'from' = $2`, EventNewMessage, username)
+	} else {
+		result, err = tx.ExecContext(ctx, `UPDATE messages SET payload = jsonb_set(payload - 'nickname', '{from}', to_jsonb($3::text))
+			WHERE type = $1 AND payload->>'from' = $2`, EventNewMessage, username, replacement)
+	}
+	if err != nil {
+		return erasure, err
+	}
+	n, _ := result.RowsAffected()
+	erasure.Messages = int(n)
+
+	// Without a replacement emojis only the user reacted with are dropped
+	result, err = tx.ExecContext(ctx, `UPDATE messages SET reactions = (
+			SELECT jsonb_object_agg(r.key, CASE WHEN r.value ? $1
+				THEN (r.value - $1) || CASE WHEN $2 = '' THEN '[]'::jsonb ELSE jsonb_build_array($2::text) END
+				ELSE r.value END)
+			FROM jsonb_each(reactions) r
+			WHERE NOT ($2 = '' AND r.value = jsonb_build_array($1::text)))
+		WHERE reactions IS NOT NULL AND EXISTS (SELECT 1 FROM jsonb_each(reactions) r WHERE r.value ? $1)`, username, replacement)
+	if err != nil {
+		return erasure, err
+	}
+	n, _ = result.RowsAffected()
+	erasure.Reactions = int(n)
+	return erasure, tx.Commit()
+}
+
+func (s *postgresStore) GetMessage(id string) (StoredMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	msg, err := scanStoredMessage(s.db.QueryRowContext(ctx,
+		`SELECT room, seq, id, type, payload, sent, reactions FROM messages WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredMessage{}, ErrNotFound
+	}
+	return msg, err
+}
+
+func (s *postgresStore) SaveReactions(id string, reactions map[string][]string) error {
+	data, err := json.Marshal(reactions)
+	if err != nil {
+		return err
+	}
+	return s.exec(`UPDATE messages SET reactions = $2 WHERE id = $1`, id, data)
+}
+
+func (s *postgresStore) SaveUser(user User) error {
+	return s.exec(`INSERT INTO users (username, password_hash, email, verification_token, created, nickname) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (username) DO UPDATE SET password_hash = $2, email = $3, verification_token = $4, nickname = $6`,
+		user.Username, user.PasswordHash, user.Email, user.VerificationToken, user.Created, user.Nickname)
+}
+
+func (s *postgresStore) GetUser(username string) (User, error) {
+	var user User
+	err := s.queryRow(`SELECT username, password_hash, email, verification_token, created, nickname FROM users WHERE username = $1`,
+		[]any{username}, &user.Username, &user.PasswordHash, &user.Email, &user.VerificationToken, &user.Created, &user.Nickname)
+	return user, err
+}
+
+func (s *postgresStore) DeleteUser(username string) error {
+	return s.exec(`DELETE FROM users WHERE username = $1`, username)
+}
+
+func (s *postgresStore) SaveRoom(room Room) error {
+	return s.exec(`INSERT INTO rooms (`+roomColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (name) DO UPDATE SET created = $2, owner = $3, topic = $4, description = $5,
+			max_members = $6, retention_seconds = $7, visibility = $8, invited = $9,
+			ephemeral = $10, idle_timeout_seconds = $11, expires_at = $12, max_messages = $13, e2ee = $14,
+			archived_at = $15`,
+		room.Name, room.Created, room.Owner, room.Topic, room.Description, room.MaxMembers,
+		int64(time.Duration(room.Retention)/time.Second), room.Visibility, pq.Array(nonNil(room.Invited)),
+		room.Ephemeral, int64(time.Duration(room.IdleTimeout)/time.Second), room.ExpiresAt, room.MaxMessages, room.E2EE,
+		room.ArchivedAt)
+}
+
+// DeleteRoom removes the room and its messages in one transaction
+func (s *postgresStore) DeleteRoom(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE room = $1`, name); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM doc_updates WHERE room = $1`, name); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM doc_snapshots WHERE room = $1`, name); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM room_timers WHERE room = $1`, name); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM memberships WHERE room = $1`, name); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM rooms WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// roomColumns are the columns scanned by scanRoom
+const roomColumns = `name, created, owner, topic, description, max_members, retention_seconds, visibility, invited,
+	ephemeral, idle_timeout_seconds, expires_at, max_messages, e2ee, archived_at`
+
+// scanRoom scans the roomColumns of a row
+func scanRoom(row interface{ Scan(dest ...any) error }) (Room, error) {
+	var room Room
+	var retention, idleTimeout int64
+	err := row.Scan(&room.Name, &room.Created, &room.Owner, &room.Topic, &room.Description, &room.MaxMembers,
+		&retention, &room.Visibility, pq.Array(&room.Invited), &room.Ephemeral, &idleTimeout, &room.ExpiresAt,
+		&room.MaxMessages, &room.E2EE, &room.ArchivedAt)
+	room.Retention = Duration(time.Duration(retention) * time.Second)
+	room.IdleTimeout = Duration(time.Duration(idleTimeout) * time.Second)
+	return room, err
+}
+
+func (s *postgresStore) GetRoom(name string) (Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	room, err := scanRoom(s.db.QueryRowContext(ctx, `SELECT `+roomColumns+` FROM rooms WHERE name = $1`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Room{}, ErrNotFound
+	}
+	return room, err
+}
+
+func (s *postgresStore) ListRooms() ([]Room, error) {
+	list := []Room{}
+	err := s.query(func(rows *sql.Rows) error {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return err
+		}
+		list = append(list, room)
+		return nil
+	}, `SELECT `+roomColumns+` FROM rooms ORDER BY name`)
+	return list, err
+}
+
+func (s *postgresStore) AddMembership(username, room string) error {
+	err := s.exec(`INSERT INTO memberships (username, room) SELECT $1, name FROM rooms WHERE name = $2
+		ON CONFLICT (username, room) DO NOTHING`, username, room)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *postgresStore) ListMemberships(username string) ([]Room, error) {
+	list := []Room{}
+	err := s.query(func(rows *sql.Rows) error {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return err
+		}
+		list = append(list, room)
+		return nil
+	}, `SELECT `+roomColumns+` FROM rooms JOIN memberships ON memberships.room = rooms.name
+		WHERE memberships.username = $1 ORDER BY name`, username)
+	return list, err
+}
+
+func (s *postgresStore) DeleteMemberships(username string) error {
+	err := s.exec(`DELETE FROM memberships WHERE username = $1`, username)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *postgresStore) SaveKeyBundle(bundle KeyBundle) error {
+	return s.exec(`INSERT INTO key_bundles (username, device_id, identity_key, signed_prekey, prekey_signature, one_time_prekeys, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (username, device_id) DO UPDATE SET identity_key = $3, signed_prekey = $4, prekey_signature = $5,
+			one_time_prekeys = $6, updated = $7`,
+		bundle.Username, bundle.DeviceID, bundle.IdentityKey, bundle.SignedPrekey, bundle.PrekeySignature,
+		pq.Array(nonNil(bundle.OneTimePrekeys)), bundle.Updated)
+}
+
+func (s *postgresStore) ListKeyBundles(username string) ([]KeyBundle, error) {
+	list := []KeyBundle{}
+	err := s.query(func(rows *sql.Rows) error {
+		var bundle KeyBundle
+		if err := rows.Scan(&bundle.Username, &bundle.DeviceID, &bundle.IdentityKey, &bundle.SignedPrekey,
+			&bundle.PrekeySignature, pq.Array(&bundle.OneTimePrekeys), &bundle.Updated); err != nil {
+			return err
+		}
+		list = append(list, bundle)
+		return nil
+	}, `SELECT username, device_id, identity_key, signed_prekey, prekey_signature, one_time_prekeys, updated
+		FROM key_bundles WHERE username = $1 ORDER BY device_id`, username)
+	return list, err
+}
+
+func (s *postgresStore) DeleteKeyBundles(username string) error {
+	err := s.exec(`DELETE FROM key_bundles WHERE username = $1`, username)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *postgresStore) SaveDevice(device Device) error {
+	return s.exec(`INSERT INTO devices (username, id, name, created, last_seen) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (username, id) DO UPDATE SET name = $3, created = $4, last_seen = $5`,
+		device.Username, device.ID, device.Name, device.Created, device.LastSeen)
+}
+
+func (s *postgresStore) ListDevices(username string) ([]Device, error) {
+	list := []Device{}
+	err := s.query(func(rows *sql.Rows) error {
+		var device Device
+		if err := rows.Scan(&device.Username, &device.ID, &device.Name, &device.Created, &device.LastSeen); err != nil {
+			return err
+		}
+		list = append(list, device)
+		return nil
+	}, `SELECT username, id, name, created, last_seen FROM devices WHERE username = $1 ORDER BY created`, username)
+	return list, err
+}
+
+func (s *postgresStore) DeleteDevice(username, id string) error {
+	return s.exec(`DELETE FROM devices WHERE username = $1 AND id = $2`, username, id)
+}
+
+func (s *postgresStore) SavePushToken(token StoredPushToken) error {
+	return s.exec(`INSERT INTO push_tokens (username, platform, token, device_id, registered) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (username, platform, token) DO UPDATE SET device_id = $4, registered = $5`,
+		token.Username, token.Platform, token.Token, token.DeviceID, token.Registered)
+}
+
+func (s *postgresStore) ListPushTokens(username string) ([]StoredPushToken, error) {
+	list := []StoredPushToken{}
+	err := s.query(func(rows *sql.Rows) error {
+		var token StoredPushToken
+		if err := rows.Scan(&token.Username, &token.Platform, &token.Token, &token.DeviceID, &token.Registered); err != nil {
+			return err
+		}
+		list = append(list, token)
+		return nil
+	}, `SELECT username, platform, token, device_id, registered FROM push_tokens WHERE username = $1 ORDER BY platform, token`, username)
+	return list, err
+}
+
+func (s *postgresStore) DeletePushTokens(username, deviceID string) error {
+	err := s.exec(`DELETE FROM push_tokens WHERE username = $1 AND ($2 = '' OR device_id = $2)`, username, deviceID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *postgresStore) SaveProfile(profile Profile) error {
+	return s.exec(`INSERT INTO profiles (username, avatar_url, status_text, updated) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username) DO UPDATE SET avatar_url = $2, status_text = $3, updated = $4`,
+		profile.Username, profile.AvatarURL, profile.StatusText, profile.Updated)
+}
+
+func (s *postgresStore) GetProfile(username string) (Profile, error) {
+	var profile Profile
+	err := s.queryRow(`SELECT username, avatar_url, status_text, updated FROM profiles WHERE username = $1`,
+		[]any{username}, &profile.Username, &profile.AvatarURL, &profile.StatusText, &profile.Updated)
+	return profile, err
+}
+
+func (s *postgresStore) DeleteProfile(username string) error {
+	return s.exec(`DELETE FROM profiles WHERE username = $1`, username)
+}
+
+func (s *postgresStore) AddUsage(usage Usage) error {
+	return s.exec(`INSERT INTO tenant_usage (tenant, since, connection_seconds, messages, bytes_in, bytes_out)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (tenant) DO UPDATE SET since = LEAST(tenant_usage.since, $2),
+			connection_seconds = tenant_usage.connection_seconds + $3, messages = tenant_usage.messages + $4,
+			bytes_in = tenant_usage.bytes_in + $5, bytes_out = tenant_usage.bytes_out + $6`,
+		usage.Tenant, usage.Since, usage.ConnectionSeconds, usage.Messages, usage.BytesIn, usage.BytesOut)
+}
+
+func (s *postgresStore) TakeUsage() ([]Usage, error) {
+	list := []Usage{}
+	err := s.query(func(rows *sql.Rows) error {
+		var usage Usage
+		if err := rows.Scan(&usage.Tenant, &usage.Since, &usage.ConnectionSeconds, &usage.Messages, &usage.BytesIn, &usage.BytesOut); err != nil {
+			return err
+		}
+		list = append(list, usage)
+		return nil
+	}, `DELETE FROM tenant_usage RETURNING tenant, since, connection_seconds, messages, bytes_in, bytes_out`)
+	sort.Slice(list, func(i, j int) bool { return list[i].Tenant < list[j].Tenant })
+	return list, err
+}
+
+func (s *postgresStore) AppendDocUpdate(update DocUpdate) error {
+	return s.exec(`INSERT INTO doc_updates (room, doc, seq, data, sender, sent) VALUES ($1, $2, $3, $4, $5, $6)`,
+		update.Room, update.Doc, update.Seq, update.Update, update.From, update.Sent)
+}
+
+func (s *postgresStore) LoadDoc(room, doc string) (DocSnapshot, []DocUpdate, error) {
+	snapshot := DocSnapshot{Room: room, Doc: doc}
+	err := s.queryRow(`SELECT seq, state, sender, saved FROM doc_snapshots WHERE room = $1 AND doc = $2`,
+		[]any{room, doc}, &snapshot.Seq, &snapshot.State, &snapshot.From, &snapshot.Saved)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return snapshot, nil, err
+	}
+
+	updates := []DocUpdate{}
+	err = s.query(func(rows *sql.Rows) error {
+		update := DocUpdate{Room: room, Doc: doc}
+		if err := rows.Scan(&update.Seq, &update.Update, &update.From, &update.Sent); err != nil {
+			return err
+		}
+		updates = append(updates, update)
+		return nil
+	}, `SELECT seq, data, sender, sent FROM doc_updates WHERE room = $1 AND doc = $2 AND seq > $3 ORDER BY seq`,
+		room, doc, snapshot.Seq)
+	return snapshot, updates, err
+}
+
+// CompactDoc saves the snapshot and deletes the updates it merged in one transaction
+func (s *postgresStore) CompactDoc(snapshot DocSnapshot) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO doc_snapshots (room, doc, seq, state, sender, saved)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (room, doc) DO UPDATE SET seq = $3, state = $4, sender = $5, saved = $6
+		WHERE doc_snapshots.seq <= $3`,
+		snapshot.Room, snapshot.Doc, snapshot.Seq, snapshot.State, snapshot.From, snapshot.Saved)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// A newer snapshot is stored
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM doc_updates WHERE room = $1 AND doc = $2 AND seq <= $3`,
+		snapshot.Room, snapshot.Doc, snapshot.Seq); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) SaveTimer(timer RoomTimer) error {
+	event, err := json.Marshal(timer.Event)
+	if err != nil {
+		return err
+	}
+	return s.exec(`INSERT INTO room_timers (id, room, fires_at, event, countdown) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET room = $2, fires_at = $3, event = $4, countdown = $5`,
+		timer.ID, timer.Room, timer.FiresAt, event, timer.Countdown)
+}
+
+// DeleteTimer deletes the timer and returns it in one statement, so of the instances
+// deleting the same timer only one gets it
+func (s *postgresStore) DeleteTimer(id string) (RoomTimer, error) {
+	timer := RoomTimer{ID: id}
+	var event []byte
+	err := s.queryRow(`DELETE FROM room_timers WHERE id = $1 RETURNING room, fires_at, event, countdown`,
+		[]any{id}, &timer.Room, &timer.FiresAt, &event, &timer.Countdown)
+	if err != nil {
+		return timer, err
+	}
+	return timer, json.Unmarshal(event, &timer.Event)
+}
+
+func (s *postgresStore) ListTimers(until time.Time) ([]RoomTimer, error) {
+	list := []RoomTimer{}
+	err := s.query(func(rows *sql.Rows) error {
+		var timer RoomTimer
+		var event []byte
+		if err := rows.Scan(&timer.ID, &timer.Room, &timer.FiresAt, &event, &timer.Countdown); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(event, &timer.Event); err != nil {
+			return err
+		}
+		list = append(list, timer)
+		return nil
+	}, `SELECT id, room, fires_at, event, countdown FROM room_timers WHERE fires_at <= $1 ORDER BY fires_at`, until)
+	return list, err
+}
+
+func (s *postgresStore) SaveBan(ban Ban) error {
+	return s.exec(`INSERT INTO bans (username, reason, actor, created) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username) DO UPDATE SET reason = $2, actor = $3, created = $4`,
+		ban.Username, ban.Reason, ban.Actor, ban.Created)
+}
+
+func (s *postgresStore) DeleteBan(username string) error {
+	return s.exec(`DELETE FROM bans WHERE username = $1`, username)
+}
+
+func (s *postgresStore) IsBanned(username string) (bool, error) {
+	var banned bool
+	err := s.queryRow(`SELECT EXISTS (SELECT 1 FROM bans WHERE username = $1)`, []any{username}, &banned)
+	return banned, err
+}
+
+func (s *postgresStore) ListBans() ([]Ban, error) {
+	list := []Ban{}
+	err := s.query(func(rows *sql.Rows) error {
+		var ban Ban
+		if err := rows.Scan(&ban.Username, &ban.Reason, &ban.Actor, &ban.Created); err != nil {
+			return err
+		}
+		list = append(list, ban)
+		return nil
+	}, `SELECT username, reason, actor, created FROM bans ORDER BY username`)
+	return list, err
+}
+
+func (s *postgresStore) SaveAPIKey(key APIKey) error {
+	return s.exec(`INSERT INTO api_keys (id, name, username, secret_hash, scopes, rooms, created, revoked)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET name = $2, scopes = $5, rooms = $6, revoked = $8`,
+		key.ID, key.Name, key.Username, key.SecretHash, pq.Array(key.Scopes), pq.Array(nonNil(key.Rooms)), key.Created, key.Revoked)
+}
+
+func (s *postgresStore) GetAPIKey(id string) (APIKey, error) {
+	var key APIKey
+	var revoked sql.NullTime
+	err := s.queryRow(`SELECT id, name, username, secret_hash, scopes, rooms, created, revoked FROM api_keys WHERE id = $1`,
+		[]any{id}, &key.ID, &key.Name, &key.Username, &key.SecretHash, pq.Array(&key.Scopes), pq.Array(&key.Rooms), &key.Created, &revoked)
+	if revoked.Valid {
+		key.Revoked = &revoked.Time
+	}
+	return key, err
+}
+
+func (s *postgresStore) ListAPIKeys() ([]APIKey, error) {
+	list := []APIKey{}
+	err := s.query(func(rows *sql.Rows) error {
+		var key APIKey
+		var revoked sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Name, &key.Username, &key.SecretHash, pq.Array(&key.Scopes), pq.Array(&key.Rooms), &key.Created, &revoked); err != nil {
+			return err
+		}
+		if revoked.Valid {
+			key.Revoked = &revoked.Time
+		}
+		list = append(list, key)
+		return nil
+	}, `SELECT id, name, username, secret_hash, scopes, rooms, created, revoked FROM api_keys ORDER BY created`)
+	return list, err
+}
+
+// nonNil returns an empty list for nil, pq stores nil slices as NULL
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+func (s *postgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Events are read whole into a buffer and are at most a few KB, see eventLimit. File
+// uploads, exports and large documents don't fit that, so with streams.enabled in
+// the config a payload can be sent as a stream of chunk events instead, each one
+// small enough for the read limit:
+//
+//	{"type":"chunk","payload":{"stream":"up-1","type":"upload","meta":{"name":"cat.png"},"seq":0,"data":"iVBORw0K..."}}
+//	{"type":"chunk","payload":{"stream":"up-1","seq":1,"data":"AAAADUlI...","final":true}}
+//
+// The stream is named by the sender and unique on the connection, the first chunk
+// names the event type the payload is for and the chunks are numbered from 0. Data
+// is base64 in JSON, which costs a third more, so a chunk can instead set binary
+// and send its data as the next message, a binary one of up to streams.max_chunk_size
+// bytes that is streamed from the connection as it arrives:
+//
+//	{"type":"chunk","payload":{"stream":"up-1","type":"upload","seq":0,"binary":true}}
+//	<binary message>
+//
+// Handlers registered with RegisterStreamHandler read the payload as an io.Reader
+// while the chunks arrive, the meta of the first chunk is the payload of their
+// event. Reading slowly holds up the reading of the connection, which is the flow
+// control. Sent as a single event the payload is their reader as well. For any
+// other event type the chunks are put together, up to streams.max_size bytes, and
+// handled as one event with the data as its payload.
+//
+// The other way, clients that declared chunks in the capabilities of hello get the
+// events larger than their max_message_size as chunk events, instead of losing them.
+// Events of clients without a limit are written straight into the connection
+// when they are large, without encoding them into a buffer first.
+
+const (
+	// EventChunk carries a part of a stream both ways
+	EventChunk = "chunk"
+)
+
+// chunkOverhead is the room left in a chunk for everything but the data
+const chunkOverhead = 512
+
+var (
+	ErrStreamFailed  = errors.New("stream failed")
+	ErrStreamAborted = errors.New("stream aborted, the client disconnected")
+
+	// errStreamClosed is returned writing to a stream whose handler returned
+	errStreamClosed = errors.New("stream handler returned")
+)
+
+// StreamsConfig configures payloads sent in chunks
+type StreamsConfig struct {
+	Enabled bool `json:"enabled"`
+	// MaxSize is the largest payload in bytes of a stream
+	MaxSize int64 `json:"max_size"`
+	// MaxChunkSize is the largest data in bytes of a single chunk
+	MaxChunkSize int `json:"max_chunk_size"`
+	// MaxStreams is how many streams a client may have open at once
+	MaxStreams int `json:"max_streams"`
+}
+
+// ChunkEvent is the payload sent in the
+// chunk event
+type ChunkEvent struct {
+	// Stream identifies the stream on the connection
+	Stream string `json:"stream"`
+	// Type is the type of the event the payload is for, set on the first chunk
+	Type string `json:"type,omitempty"`
+	// ID is the id of the event the chunks make up, set on the first chunk sent by the server
+	ID string `json:"id,omitempty"`
+	// Meta is the payload of the event stream handlers get, set on the first chunk
+	Meta json.RawMessage `json:"meta,omitempty"`
+	// Seq numbers the chunks of the stream from 0
+	Seq int `json:"seq"`
+	// Data is the next part of the payload
+	Data []byte `json:"data,omitempty"`
+	// Binary is set when the data is sent as the next message, a binary one
+	Binary bool `json:"binary,omitempty"`
+	// Final is set on the last chunk of the stream
+	Final bool `json:"final,omitempty"`
+}
+
+// StreamHandler handles an event whose payload is read as a stream, event holds
+// the meta of the stream as its payload
+type StreamHandler func(event Event, payload io.Reader, c *Client) error
+
+// streamWriter is implemented by transports that can write a message as a
+// stream, *websocket.Conn does
+type streamWriter interface {
+	NextWriter(messageType int) (io.WriteCloser, error)
+}
+
+// streamEncoder is implemented by codecs that can encode straight into the connection
+type streamEncoder interface {
+	// EncodeStream writes the encoded event to w and returns the message type it needs
+	EncodeStream(w io.Writer, event Event) error
+	// MessageType is the type of the messages written by EncodeStream
+	MessageType() int
+}
+
+// inboundStream is a stream the client is sending
+type inboundStream struct {
+	name  string
+	event Event
+	// seq is the number of the next chunk
+	seq  int
+	size int64
+	// final is set once the last chunk arrived, a binary one may still wait for its data
+	final bool
+	// pipe feeds the stream handler, nil when the payload is put together in buffer
+	pipe   *io.PipeWriter
+	buffer bytes.Buffer
+	// discard is set when the stream handler returned before reading everything
+	discard bool
+}
+
+// clientStreams are the open streams of a client
+type clientStreams struct {
+	sync.Mutex
+	open map[string]*inboundStream
+	// binary is the stream the next message is the data of, nil if none
+	binary *inboundStream
+}
+
+// RegisterStreamHandler sets the handler of the event type, replacing the handler of
+// the same type, its payload is read as a stream
+func (m *Manager) RegisterStreamHandler(eventType string, handler StreamHandler) {
+	m.streamHandlersLock.Lock()
+	defer m.streamHandlersLock.Unlock()
+	m.streamHandlers[eventType] = handler
+}
+
+// streamHandler returns the stream handler of the event type
+func (m *Manager) streamHandler(eventType string) (StreamHandler, bool) {
+	m.streamHandlersLock.RLock()
+	defer m.streamHandlersLock.RUnlock()
+	handler, ok := m.streamHandlers[eventType]
+	return handler, ok
+}
+
+// asEventHandler runs the stream handler for an event sent whole
+func (h StreamHandler) asEventHandler() EventHandler {
+	return func(event Event, c *Client) error {
+		return h(event, bytes.NewReader(event.Payload), c)
+	}
+}
+
+// maxStreamSize is the largest payload of a stream in bytes
+func (config StreamsConfig) maxStreamSize() int64 {
+	if config.MaxSize <= 0 {
+		return 16 << 20
+	}
+	return config.MaxSize
+}
+
+// maxChunkSize is the largest data of a chunk in bytes
+func (config StreamsConfig) maxChunkSize() int {
+	if config.MaxChunkSize <= 0 {
+		return 64 << 10
+	}
+	return config.MaxChunkSize
+}
+
+// chunkEventLimit is the largest chunk event in bytes, with its data in base64
+func (config StreamsConfig) chunkEventLimit() int {
+	return config.maxChunkSize()*4/3 + chunkOverhead
+}
+
+// receiveChunk adds the chunk to its stream, it is called by the read goroutine so
+// the chunks of a stream are taken in order
+func (c *Client) receiveChunk(event Event) {
+	var chunk ChunkEvent
+	if err := json.Unmarshal(event.Payload, &chunk); err != nil {
+		c.failStream("", fmt.Errorf("bad payload in request: %v", err))
+		return
+	}
+	stream, err := c.streamOf(event, chunk)
+	if err != nil {
+		c.failStream(chunk.Stream, err)
+		return
+	}
+	stream.seq++
+	stream.final = chunk.Final
+	if chunk.Binary {
+		// The data is read with the next message, see readChunkData
+		c.streams.Lock()
+		c.streams.binary = stream
+		c.streams.Unlock()
+		return
+	}
+	c.addData(stream, bytes.NewReader(chunk.Data))
+}
+
+// streamOf returns the stream of the chunk, it is opened by the first chunk
+func (c *Client) streamOf(event Event, chunk ChunkEvent) (*inboundStream, error) {
+	m := c.manager
+	config := m.config().Streams
+	if chunk.Stream == "" {
+		return nil, errors.New("stream is required")
+	}
+	if len(chunk.Data) > config.maxChunkSize() {
+		return nil, fmt.Errorf("chunk is larger than %d bytes", config.maxChunkSize())
+	}
+
+	c.streams.Lock()
+	defer c.streams.Unlock()
+	stream, ok := c.streams.open[chunk.Stream]
+	if ok {
+		if chunk.Seq != stream.seq {
+			delete(c.streams.open, chunk.Stream)
+			err := fmt.Errorf("chunk %d arrived instead of %d", chunk.Seq, stream.seq)
+			stream.abort(fmt.Errorf("%w: %v", ErrStreamFailed, err))
+			return nil, err
+		}
+		return stream, nil
+	}
+
+	if chunk.Seq != 0 {
+		return nil, fmt.Errorf("unknown stream, chunk %d arrived first", chunk.Seq)
+	}
+	if chunk.Type == "" || chunk.Type == EventChunk {
+		return nil, errors.New("the first chunk needs the type of the event")
+	}
+	if limit := max(config.MaxStreams, 1); len(c.streams.open) >= limit {
+		return nil, fmt.Errorf("more than %d streams open", limit)
+	}
+
+	stream = &inboundStream{
+		name:  chunk.Stream,
+		event: Event{Type: chunk.Type, ID: event.ID, Timestamp: event.Timestamp, Room: event.Room, Payload: chunk.Meta},
+	}
+	if len(stream.event.Payload) == 0 {
+		stream.event.Payload = json.RawMessage("{}")
+	}
+	if c.streams.open == nil {
+		c.streams.open = make(map[string]*inboundStream)
+	}
+	c.streams.open[chunk.Stream] = stream
+
+	// Stream handlers read while the chunks arrive, in their own goroutine
+	if handler, ok := m.streamHandler(chunk.Type); ok {
+		reader, writer := io.Pipe()
+		stream.pipe = writer
+		go c.runStreamHandler(handler, stream, reader)
+	}
+	return stream, nil
+}
+
+// runStreamHandler runs the handler on the stream, like a handler of an event
+// Is Blocking, so run as a Goroutine
+func (c *Client) runStreamHandler(handler StreamHandler, stream *inboundStream, reader *io.PipeReader) {
+	m := c.manager
+	err := m.checkEventFlag(stream.event, c)
+	if err == nil {
+		err = m.runHandler(func(event Event, c *Client) error { return handler(event, reader, c) }, stream.event, c)
+	}
+	// The data still arriving is dropped, see addData
+	reader.CloseWithError(errStreamClosed)
+	if err != nil && !errors.Is(err, ErrStreamAborted) && !errors.Is(err, ErrFeatureDisabled) {
+		log.Printf("stream %s of client %s failed: %v", stream.name, c.id, err)
+		c.failStream(stream.name, err)
+	}
+}
+
+// addData adds the data to the stream and finishes the stream after its last chunk
+func (c *Client) addData(stream *inboundStream, data io.Reader) {
+	limit := c.manager.config().Streams.maxStreamSize()
+	// One byte over the limit tells it was exceeded
+	written, err := io.Copy(stream.sink(), io.LimitReader(data, limit-stream.size+1))
+	stream.size += written
+	if errors.Is(err, errStreamClosed) {
+		stream.discard, err = true, nil
+	}
+	if err == nil && stream.size > limit {
+		err = fmt.Errorf("larger than %d bytes", limit)
+	}
+	if err != nil {
+		c.dropStream(stream, fmt.Errorf("%w: %v", ErrStreamFailed, err))
+		c.failStream(stream.name, err)
+		return
+	}
+	if stream.final {
+		c.finishStream(stream)
+	}
+}
+
+// sink is where the data of the stream goes
+func (s *inboundStream) sink() io.Writer {
+	switch {
+	case s.discard:
+		return io.Discard
+	case s.pipe != nil:
+		return s.pipe
+	}
+	return &s.buffer
+}
+
+// abort ends the stream handler, its reader returns err
+func (s *inboundStream) abort(err error) {
+	if s.pipe != nil {
+		s.pipe.CloseWithError(err)
+	}
+}
+
+// finishStream closes the stream after its last chunk, the payload put together is
+// handled as an event unless a stream handler read it
+func (c *Client) finishStream(stream *inboundStream) {
+	c.dropStream(stream, nil)
+	if stream.pipe != nil {
+		stream.pipe.Close()
+		return
+	}
+	event := stream.event
+	event.Payload = stream.buffer.Bytes()
+	c.manager.dispatchEvent(event, c)
+}
+
+// dropStream forgets the stream, ending its handler with err if not nil
+func (c *Client) dropStream(stream *inboundStream, err error) {
+	c.streams.Lock()
+	if c.streams.open[stream.name] == stream {
+		delete(c.streams.open, stream.name)
+	}
+	c.streams.Unlock()
+	if err != nil {
+		stream.abort(err)
+	}
+}
+
+// failStream tells the client the stream failed
+func (c *Client) failStream(name string, err error) {
+	c.manager.sendError(c, "stream_failed", map[string]string{"stream": name, "reason": err.Error()})
+}
+
+// abortStreams ends the handlers of all open streams, called when the client disconnects
+func (c *Client) abortStreams() {
+	c.streams.Lock()
+	open := c.streams.open
+	c.streams.open, c.streams.binary = nil, nil
+	c.streams.Unlock()
+	for _, stream := range open {
+		stream.abort(ErrStreamAborted)
+	}
+}
+
+// awaitsChunkData returns true if the next message is the data of a binary chunk
+func (c *Client) awaitsChunkData() bool {
+	c.streams.Lock()
+	defer c.streams.Unlock()
+	return c.streams.binary != nil
+}
+
+// readChunkData reads the binary message carrying the data of a chunk into its
+// stream, straight from the connection without buffering the message. It returns
+// false when the connection has to be closed
+func (c *Client) readChunkData() bool {
+	c.streams.Lock()
+	stream := c.streams.binary
+	c.streams.binary = nil
+	c.streams.Unlock()
+
+	// A message larger than a chunk fails the connection with 1009
+	c.connection.SetReadLimit(int64(c.manager.config().Streams.maxChunkSize()))
+	defer c.connection.SetReadLimit(int64(c.manager.readLimit()))
+
+	var messageType int
+	var data io.Reader
+	if r, ok := c.connection.(streamReader); ok {
+		var err error
+		if messageType, data, err = r.NextReader(); err != nil {
+			c.readFailed(err)
+			return false
+		}
+	} else {
+		frame, payload, err := c.connection.ReadMessage()
+		if err != nil {
+			c.readFailed(err)
+			return false
+		}
+		messageType, data = frame, bytes.NewReader(payload)
+	}
+
+	counting := &countingReader{r: data}
+	if messageType != websocket.BinaryMessage {
+		err := errors.New("the data of a binary chunk has to be a binary message")
+		c.dropStream(stream, fmt.Errorf("%w: %v", ErrStreamFailed, err))
+		c.failStream(stream.name, err)
+	} else {
+		c.addData(stream, counting)
+	}
+	// What wasn't taken is read, so the next message can be
+	io.Copy(io.Discard, counting)
+	c.countIn(int(counting.n))
+	if counting.err != nil {
+		c.readFailed(counting.err)
+		return false
+	}
+	return true
+}
+
+// countingReader counts the bytes read and keeps the error reading them
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// streamsEvent returns true if the event is large enough to be written straight
+// into the connection instead of a buffer
+func (c *Client) streamsEvent(message Event) bool {
+	if len(message.Payload) <= maxPooledBufferSize || c.maxFrameSize.Load() != 0 {
+		return false
+	}
+	_, canWrite := c.connection.(streamWriter)
+	_, canEncode := c.codec.(streamEncoder)
+	return canWrite && canEncode
+}
+
+// writeStreamed encodes the event straight into the connection
+func (c *Client) writeStreamed(message Event) {
+	encoder := c.codec.(streamEncoder)
+	w, err := c.connection.(streamWriter).NextWriter(encoder.MessageType())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	counting := &countingWriter{w: w}
+	if err := encoder.EncodeStream(counting, message); err != nil {
+		log.Println(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Println(err)
+	}
+	c.countOut(1, int(counting.n))
+}
+
+// writeChunks writes the event as chunk events that fit the limit of the client
+func (c *Client) writeChunks(message Event, limit int) {
+	size := max((limit-chunkOverhead)*3/4, 1)
+	name := c.manager.newID()
+	payload := message.Payload
+	for seq := 0; seq == 0 || len(payload) > 0; seq++ {
+		chunk := ChunkEvent{Stream: name, Seq: seq, Data: payload[:min(size, len(payload))]}
+		payload = payload[len(chunk.Data):]
+		if seq == 0 {
+			chunk.Type, chunk.ID = message.Type, message.ID
+		}
+		chunk.Final = len(payload) == 0
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		c.writeFrame(Event{Type: EventChunk, Payload: data, Room: message.Room})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+)
+
+// Changing rooms with join_room followed by get_history leaves a window in which
+// events of the new room can arrive before the history, or be missed between the
+// two. switch_room does the whole move at once: while the new room can't number
+// events, the client is moved, and gets the recent history, the sequence number
+// the live events continue from and the members of the room in one event. The
+// rooms are told about the user leaving and joining.
+
+const (
+	// EventSwitchRoom is sent by a client to move to another room
+	EventSwitchRoom = "switch_room"
+	// EventRoomSwitched is the response to switch_room
+	EventRoomSwitched = "room_switched"
+	// EventMemberJoined is sent to a room when a user switched into it
+	EventMemberJoined = "member_joined"
+	// EventMemberLeft is sent to a room when the last client of a user switched out of it
+	EventMemberLeft = "member_left"
+)
+
+// defaultSwitchHistory is how many events of the new room are sent by default
+var defaultSwitchHistory = 50
+
+// SwitchRoomEvent is the payload sent in the
+// switch_room event
+type SwitchRoomEvent struct {
+	Room string `json:"room"`
+	// History is how many of the latest events to send, 50 if zero and none if negative
+	History int `json:"history,omitempty"`
+}
+
+// RoomSwitchedEvent is the payload sent in the
+// room_switched event
+type RoomSwitchedEvent struct {
+	From string   `json:"from"`
+	Room RoomInfo `json:"room"`
+	// Seq is the number of the latest event of the room, live events continue at Seq+1
+	Seq     uint64  `json:"seq"`
+	History []Event `json:"history"`
+	// Reactions are the reaction counts of the messages in History, keyed by message id
+	Reactions map[string]map[string]int `json:"reactions,omitempty"`
+	// Members are the users in the room, including the own one
+	Members []string `json:"members"`
+	// Nicknames are the nicknames of the members that have one, keyed by username
+	Nicknames map[string]string `json:"nicknames,omitempty"`
+}
+
+// MemberEvent is the payload sent in the
+// member_joined and member_left events
+type MemberEvent struct {
+	Room     string `json:"room"`
+	Username string `json:"username"`
+	Nickname string `json:"nickname,omitempty"`
+}
+
+// SwitchRoomHandler moves the client to another room in one step
+func SwitchRoomHandler(event Event, c *Client) error {
+	var req SwitchRoomEvent
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if err := validateRoomName(req.Room); err != nil {
+		return err
+	}
+	if !c.allowedRoom(req.Room) {
+		return c.roomError(req.Room)
+	}
+
+	history := req.History
+	switch {
+	case history == 0:
+		history = defaultSwitchHistory
+	case history < 0:
+		history = 0
+	}
+	if err := c.manager.switchRoom(c, req.Room, min(history, roomHistorySize)); err != nil {
+		return err
+	}
+	c.manager.addMembership(c.username, req.Room)
+	return nil
+}
+
+// switchRoom moves the client to the room and sends it the latest history events
+// of the room, no event of the room can be numbered in between
+func (m *Manager) switchRoom(c *Client, name string, history int) error {
+	room, err := m.admitToRoom(c, name)
+	if err != nil {
+		return err
+	}
+	// Reactions come from the store, which is too slow to ask while holding the locks
+	reactions := m.historyReactions(name, history)
+
+	// Same order as broadcastToRoom, the room lock first
+	r := m.room(name)
+	// Loading the room reactivated it if it was archived
+	room.ArchivedAt = nil
+	r.Lock()
+	defer r.Unlock()
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.clients[c]; !ok {
+		return nil
+	}
+	if err := m.checkRoomFull(c, room); err != nil {
+		return err
+	}
+
+	from := c.room
+	moved := from != name
+	leaving := moved && !m.userInRoom(from, c.username, c)
+	joining := moved && !m.userInRoom(name, c.username, c)
+	m.moveClient(c, name)
+	r.lastActive = m.now()
+
+	switched, err := m.roomSwitched(from, room, r, history, reactions)
+	if err != nil {
+		return err
+	}
+	c.send(switched)
+
+	if leaving {
+		m.sendMemberEvent(EventMemberLeft, from, c.username, nil)
+	}
+	if joining {
+		m.sendMemberEvent(EventMemberJoined, name, c.username, c)
+	}
+	return nil
+}
+
+// roomSwitched returns the room_switched event for a client moved from a room
+// Only call it while holding the lock of the room and the manager lock
+func (m *Manager) roomSwitched(from string, room Room, r *roomState, history int, reactions map[string]map[string]int) (Event, error) {
+	switched := RoomSwitchedEvent{
+		From:      from,
+		Room:      newRoomInfo(room),
+		Seq:       r.seq,
+		History:   append([]Event{}, r.history[max(len(r.history)-history, 0):]...),
+		Reactions: reactions,
+		Members:   m.roomUsernames(room.Name),
+	}
+	switched.Room.Members = len(switched.Members)
+	switched.Nicknames = m.nicknamesOf(switched.Members)
+	data, err := json.Marshal(switched)
+	if err != nil {
+		return Event{}, fmt.Errorf("failed to marshal room_switched: %v", err)
+	}
+	return Event{Type: EventRoomSwitched, Payload: data}, nil
+}
+
+// userInRoom returns true if the user has a client other than except in the room
+// Only call it while holding the manager lock
+func (m *Manager) userInRoom(room, username string, except *Client) bool {
+	for client := range m.members[room] {
+		if client != except && client.username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// roomUsernames returns the users in the room ordered by name
+// Only call it while holding the manager lock
+func (m *Manager) roomUsernames(room string) []string {
+	seen := make(map[string]bool)
+	for client := range m.members[room] {
+		seen[client.username] = true
+	}
+	m.remoteRoomUsernames(room, seen)
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// sendMemberEvent tells the clients of the room, other than except, about a member
+// Only call it while holding the manager lock
+func (m *Manager) sendMemberEvent(eventType, room, username string, except *Client) {
+	data, err := json.Marshal(MemberEvent{Room: room, Username: username, Nickname: m.nickname(username)})
+	if err != nil {
+		log.Printf("failed to marshal %s: %v", eventType, err)
+		return
+	}
+	event := prepare(Event{Type: eventType, Payload: data})
+	for client := range m.members[room] {
+		if client != except {
+			client.send(event)
+		}
+	}
+}
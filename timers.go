@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Games and other apps built on the server need things to happen in a room after
+// a while, like the end of a round or a vote. Instead of every handler starting a
+// goroutine with a ticker that nobody stops, handlers ask the Manager for a timer:
+//
+//	id, err := c.manager.After(room, 30*time.Second, Event{Type: "round_over"})
+//
+// When it fires the event is broadcast to the room like any other, numbered and
+// kept in the history. Countdown does the same and also broadcasts countdown_started
+// right away, with the time it ends at, so clients can show it counting down.
+// CancelTimer stops a timer that didn't fire yet, a cancelled countdown is
+// announced with countdown_cancelled.
+//
+// Timers are kept in the store, so they survive restarts, and are fired by the
+// instance owning the room when they are due. If that instance goes down the room
+// moves to another instance, which fires them instead. Firing a timer deletes it
+// from the store first, so it fires once even while two instances both think they
+// own the room. Timers of a room are deleted with the room.
+
+const (
+	// EventCountdownStarted is broadcast to a room when a countdown starts
+	EventCountdownStarted = "countdown_started"
+	// EventCountdownCancelled is broadcast to a room when a countdown is cancelled
+	EventCountdownCancelled = "countdown_cancelled"
+)
+
+var (
+	ErrInvalidTimer = errors.New("invalid timer")
+)
+
+// timerInterval is how often the timers are checked, timers fire up to this late
+var timerInterval = 250 * time.Millisecond
+
+// CountdownEvent is the payload of the countdown_started and countdown_cancelled events
+type CountdownEvent struct {
+	ID   string `json:"id"`
+	Room string `json:"room"`
+	// Type is the type of the event broadcast when the countdown ends
+	Type   string    `json:"type"`
+	EndsAt time.Time `json:"ends_at"`
+}
+
+// After broadcasts the event to the room once the duration passed, it returns the
+// id of the timer to cancel it with
+func (m *Manager) After(room string, d time.Duration, event Event) (string, error) {
+	timer, err := m.addTimer(room, d, event, false)
+	return timer.ID, err
+}
+
+// Countdown is After that also tells the room when the event comes
+func (m *Manager) Countdown(room string, d time.Duration, event Event) (string, error) {
+	timer, err := m.addTimer(room, d, event, true)
+	if err != nil {
+		return "", err
+	}
+	m.broadcastCountdown(EventCountdownStarted, timer)
+	return timer.ID, nil
+}
+
+// CancelTimer stops the timer, ErrNotFound is returned if it fired or was cancelled already
+func (m *Manager) CancelTimer(id string) error {
+	timer, err := m.store.DeleteTimer(id)
+	if err != nil {
+		return err
+	}
+	if timer.Countdown {
+		m.broadcastCountdown(EventCountdownCancelled, timer)
+	}
+	return nil
+}
+
+// addTimer stores a timer for the event
+func (m *Manager) addTimer(room string, d time.Duration, event Event, countdown bool) (RoomTimer, error) {
+	if err := validateRoomName(room); err != nil {
+		return RoomTimer{}, err
+	}
+	if event.Type == "" || d < 0 {
+		return RoomTimer{}, fmt.Errorf("%w: needs an event type and a duration that isn't negative", ErrInvalidTimer)
+	}
+	if len(event.Payload) > 0 && !json.Valid(event.Payload) {
+		return RoomTimer{}, fmt.Errorf("%w: payload is not JSON", ErrInvalidTimer)
+	}
+
+	timer := RoomTimer{
+		ID:        m.newID(),
+		Room:      room,
+		FiresAt:   m.now().Add(d),
+		Event:     Event{Type: event.Type, Payload: event.Payload},
+		Countdown: countdown,
+	}
+	return timer, m.store.SaveTimer(timer)
+}
+
+// broadcastCountdown tells the room of the countdown of the timer
+func (m *Manager) broadcastCountdown(eventType string, timer RoomTimer) {
+	data, err := json.Marshal(CountdownEvent{ID: timer.ID, Room: timer.Room, Type: timer.Event.Type, EndsAt: timer.FiresAt})
+	if err != nil {
+		log.Printf("marshalling %s: %v", eventType, err)
+		return
+	}
+	m.broadcastToRoom(timer.Room, "", Event{Type: eventType, Payload: data})
+}
+
+// runTimers fires the timers when they are due
+// Is Blocking, so run as a Goroutine
+func (m *Manager) runTimers(ctx context.Context) {
+	ticker := time.NewTicker(timerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.fireTimers(m.now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fireTimers broadcasts the events of the timers due at now, of the rooms this
+// instance owns
+func (m *Manager) fireTimers(now time.Time) {
+	timers, err := m.store.ListTimers(now)
+	if err != nil {
+		log.Println("failed to list timers: ", err)
+		return
+	}
+
+	for _, timer := range timers {
+		if m.cluster != nil && m.cluster.owner(timer.Room) != m.cluster.self {
+			continue
+		}
+		// Deleting it claims it, an instance that deleted it already fired it
+		if _, err := m.store.DeleteTimer(timer.ID); err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				log.Println("failed to remove timer: ", err)
+			}
+			continue
+		}
+		m.broadcastToRoom(timer.Room, "", timer.Event)
+	}
+}
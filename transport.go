@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+
+	"arti.soft/websockets-go/wstest"
+)
+
+// Transport is the connection a Client reads from and writes to
+// *websocket.Conn implements it, wstest.Conn connects clients without a network
+type Transport interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Subprotocol() string
+	Close() error
+}
+
+// controlWriter writes control frames while another goroutine writes messages,
+// *websocket.Conn implements it
+type controlWriter interface {
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+}
+
+// The errors of wstest.Conn, which bots and replays connect with
+var (
+	ErrTransportClosed  = wstest.ErrClosed
+	ErrTransportTimeout = wstest.ErrTimeout
+)
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TTLCache is a map whose entries expire, used for everything short lived the
+// server keeps track of: OTPs, the resumable qos sessions, the dedupe and rate
+// state of notifications and who is typing. A single goroutine per cache sweeps
+// out the expired entries, lookups never return an expired entry even before the
+// sweep got to it. OnExpire is told about every entry that expired or was pushed
+// out by MaxEntries, but not about the ones removed with Delete or Take.
+
+// TTLCacheOptions configures a TTLCache
+type TTLCacheOptions[K comparable, V any] struct {
+	// TTL is how long entries are kept by Set, entries with a TTL of zero or less never expire
+	TTL time.Duration
+	// SweepInterval is how often expired entries are removed, a second if zero
+	SweepInterval time.Duration
+	// MaxEntries caps the entries, the one closest to expiring is pushed out for a new
+	// one beyond it. Zero is unlimited
+	MaxEntries int
+	// OnExpire is called for every expired entry, without holding the lock of the cache
+	OnExpire func(key K, value V)
+	// Clock tells the time, the wall clock if nil
+	Clock Clock
+}
+
+type ttlEntry[V any] struct {
+	value V
+	// expires is zero for entries that never expire
+	expires time.Time
+}
+
+// TTLCache is a map with expiring entries, safe for concurrent use
+type TTLCache[K comparable, V any] struct {
+	sync.Mutex
+	entries map[K]ttlEntry[V]
+	options TTLCacheOptions[K, V]
+}
+
+// NewTTLCache creates the cache and sweeps it until the ctx is done
+func NewTTLCache[K comparable, V any](ctx context.Context, options TTLCacheOptions[K, V]) *TTLCache[K, V] {
+	if options.SweepInterval <= 0 {
+		options.SweepInterval = time.Second
+	}
+	if options.Clock == nil {
+		options.Clock = systemClock{}
+	}
+	c := &TTLCache[K, V]{entries: make(map[K]ttlEntry[V]), options: options}
+
+	go c.run(ctx)
+
+	return c
+}
+
+// Set stores the value for the TTL of the cache
+func (c *TTLCache[K, V]) Set(key K, value V) {
+	c.SetTTL(key, value, c.options.TTL)
+}
+
+// SetTTL stores the value for the ttl, it never expires if ttl is zero or less
+func (c *TTLCache[K, V]) SetTTL(key K, value V, ttl time.Duration) {
+	c.Lock()
+	evicted := c.store(key, value, ttl)
+	c.Unlock()
+	c.expired(evicted)
+}
+
+// Update stores what fn returns for the current value, ok is false if there is none.
+// fn runs while holding the lock, so it can't race with other updates of the key
+func (c *TTLCache[K, V]) Update(key K, ttl time.Duration, fn func(value V, ok bool) V) V {
+	c.Lock()
+	value, ok := c.lookup(key)
+	value = fn(value, ok)
+	evicted := c.store(key, value, ttl)
+	c.Unlock()
+	c.expired(evicted)
+	return value
+}
+
+// Get returns the value of the key, ok is false if there is none or it expired
+func (c *TTLCache[K, V]) Get(key K) (V, bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.lookup(key)
+}
+
+// Take returns the value of the key and removes it, so it can only be taken once
+func (c *TTLCache[K, V]) Take(key K) (V, bool) {
+	c.Lock()
+	defer c.Unlock()
+	value, ok := c.lookup(key)
+	delete(c.entries, key)
+	return value, ok
+}
+
+// Touch restarts the ttl of the key, it returns false if there is no such key
+func (c *TTLCache[K, V]) Touch(key K, ttl time.Duration) bool {
+	c.Lock()
+	defer c.Unlock()
+	value, ok := c.lookup(key)
+	if ok {
+		c.entries[key] = ttlEntry[V]{value: value, expires: c.expiry(ttl)}
+	}
+	return ok
+}
+
+// Delete removes the key, it returns false if there was no such key
+func (c *TTLCache[K, V]) Delete(key K) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.lookup(key)
+	delete(c.entries, key)
+	return ok
+}
+
+// Len returns the number of entries, including expired ones not swept yet
+func (c *TTLCache[K, V]) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.entries)
+}
+
+// lookup returns the value of the key unless it expired
+// Only call it while holding the lock
+func (c *TTLCache[K, V]) lookup(key K) (V, bool) {
+	entry, ok := c.entries[key]
+	if !ok || c.isExpired(entry, c.options.Clock.Now()) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// store sets the entry and returns the one pushed out to make room for it, if any
+// Only call it while holding the lock
+func (c *TTLCache[K, V]) store(key K, value V, ttl time.Duration) map[K]V {
+	var evicted map[K]V
+	if _, ok := c.entries[key]; !ok && c.options.MaxEntries > 0 && len(c.entries) >= c.options.MaxEntries {
+		// The soonest to expire goes first, entries that never expire last
+		var oldest K
+		var oldestExpires time.Time
+		found := false
+		for k, entry := range c.entries {
+			if !found || (!entry.expires.IsZero() && (oldestExpires.IsZero() || entry.expires.Before(oldestExpires))) {
+				oldest, oldestExpires, found = k, entry.expires, true
+			}
+		}
+		evicted = map[K]V{oldest: c.entries[oldest].value}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = ttlEntry[V]{value: value, expires: c.expiry(ttl)}
+	return evicted
+}
+
+// expiry returns when an entry stored now with the ttl expires
+func (c *TTLCache[K, V]) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return c.options.Clock.Now().Add(ttl)
+}
+
+func (c *TTLCache[K, V]) isExpired(entry ttlEntry[V], now time.Time) bool {
+	return !entry.expires.IsZero() && !now.Before(entry.expires)
+}
+
+// sweep removes the entries expired at now
+func (c *TTLCache[K, V]) sweep(now time.Time) {
+	expired := make(map[K]V)
+	c.Lock()
+	for key, entry := range c.entries {
+		if c.isExpired(entry, now) {
+			expired[key] = entry.value
+			delete(c.entries, key)
+		}
+	}
+	c.Unlock()
+	c.expired(expired)
+}
+
+// expired tells OnExpire about the removed entries
+func (c *TTLCache[K, V]) expired(entries map[K]V) {
+	if c.options.OnExpire == nil {
+		return
+	}
+	for key, value := range entries {
+		c.options.OnExpire(key, value)
+	}
+}
+
+// run sweeps the cache
+// Is Blocking, so run as a Goroutine
+func (c *TTLCache[K, V]) run(ctx context.Context) {
+	ticker := time.NewTicker(c.options.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep(c.options.Clock.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
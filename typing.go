@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Typing indicators are short lived, they are not numbered, not kept in the
+// room history and not redelivered, a late typing event is worse than none.
+// Clients that vanish or forget to send typing false would leave the user shown
+// as typing forever, so the server stops the indicator once typingTimeout passed
+// without the client sending typing again.
+
+const (
+	// EventTyping is sent by a client when the user starts or stops typing
+	EventTyping = "typing"
+	// EventUserTyping is sent to the other clients in the room
+	EventUserTyping = "user_typing"
+)
+
+// typingTimeout is how long a typing indicator lasts without being renewed
+var typingTimeout = 6 * time.Second
+
+// typingKey is a user typing in a room
+type typingKey struct {
+	room     string
+	username string
+}
+
+// TypingEvent is the payload of the typing event
+type TypingEvent struct {
+	Typing bool `json:"typing"`
+}
+
+// UserTypingEvent tells the room that a user started or stopped typing
+type UserTypingEvent struct {
+	From   string `json:"from"`
+	Room   string `json:"room"`
+	Typing bool   `json:"typing"`
+}
+
+// TypingHandler forwards the typing state to the other clients in the room
+func TypingHandler(event Event, c *Client) error {
+	var typingevent TypingEvent
+	if err := json.Unmarshal(event.Payload, &typingevent); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	m := c.manager
+	key := typingKey{room: m.roomOf(c), username: c.username}
+	if typingevent.Typing {
+		m.typing.Set(key, struct{}{})
+	} else {
+		m.typing.Delete(key)
+	}
+	m.sendTyping(key, typingevent.Typing)
+	return nil
+}
+
+// typingExpired stops the typing indicator of a user that didn't renew it
+func (m *Manager) typingExpired(key typingKey, _ struct{}) {
+	m.sendTyping(key, false)
+}
+
+// sendTyping tells the other users in the room whether the user is typing
+func (m *Manager) sendTyping(key typingKey, typing bool) {
+	data, err := json.Marshal(UserTypingEvent{From: key.username, Room: key.room, Typing: typing})
+	if err != nil {
+		log.Println("failed to marshal user_typing: ", err)
+		return
+	}
+	outgoing := Event{Type: EventUserTyping, Payload: data}
+
+	m.RLock()
+	defer m.RUnlock()
+	for client := range m.members[key.room] {
+		if client.username != key.username {
+			client.enqueue(outgoing)
+		}
+	}
+}
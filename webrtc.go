@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Video and voice apps connect their browsers with WebRTC, which needs a signaling
+// channel to exchange the SDP offers and answers and the ICE candidates before
+// the peers can reach each other. With webrtc.enabled the server is that channel:
+// a client sends rtc_signal to another client in its room, which gets it with the
+// sender added:
+//
+//	{"type":"rtc_signal","payload":{"to":"bob","kind":"offer","data":{"type":"offer","sdp":"..."}}}
+//	{"type":"rtc_signal","payload":{"room":"general","from":"alice","from_client":"...","kind":"offer","data":{...}}}
+//
+// A signal goes to the client to_client if it is set, or to all clients of the
+// user to in the room otherwise, like ringing every device of the user. The answer
+// goes back to from_client, so the call continues with a single client. Only
+// clients in the same room can signal each other. Signals are not stored or acked,
+// SDP is larger than other events, so they may be up to webrtc.max_signal_size.
+//
+// Peers behind NATs that don't let them reach each other relay through a TURN
+// server. With webrtc.turn.secret set, get_ice_servers returns the STUN servers
+// and short lived TURN credentials, minted like the TURN REST API that coturn
+// implements with use-auth-secret: the username is the expiry time and the user,
+// the credential the HMAC-SHA1 of the username with the shared secret.
+
+const (
+	// EventRTCSignal carries an offer, answer, ICE candidate or hangup between two clients
+	EventRTCSignal = "rtc_signal"
+	// EventGetICEServers is sent by a client for the ICE servers to use
+	EventGetICEServers = "get_ice_servers"
+	// EventICEServers is the response to get_ice_servers
+	EventICEServers = "ice_servers"
+)
+
+var (
+	ErrWebRTCDisabled = errors.New("webrtc signaling is not enabled")
+	ErrInvalidSignal  = errors.New("invalid rtc signal")
+	ErrPeerNotFound   = errors.New("peer not found in the room")
+)
+
+// rtcSignalKinds are the kinds of signals
+var rtcSignalKinds = map[string]bool{
+	"offer":     true,
+	"answer":    true,
+	"candidate": true,
+	// bye ends the call
+	"bye": true,
+}
+
+// RTCSignalEvent is the payload of the rtc_signal event both ways
+type RTCSignalEvent struct {
+	// To is the user to signal and ToClient the client, one of them is needed
+	To       string `json:"to,omitempty"`
+	ToClient string `json:"to_client,omitempty"`
+	// Room, From and FromClient are set by the server
+	Room       string `json:"room,omitempty"`
+	From       string `json:"from,omitempty"`
+	FromClient string `json:"from_client,omitempty"`
+	// Kind is offer, answer, candidate or bye
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// ICEServer is a STUN or TURN server as RTCPeerConnection takes it
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEServersEvent is the payload of the ice_servers event
+type ICEServersEvent struct {
+	ICEServers []ICEServer `json:"ice_servers"`
+	// Expires is when the TURN credentials stop working, zero without TURN
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// RTCSignalHandler relays a signal to the client or user it is for, in the room of the sender
+func RTCSignalHandler(event Event, c *Client) error {
+	m := c.manager
+	if !m.config().WebRTC.Enabled {
+		return ErrWebRTCDisabled
+	}
+	var signal RTCSignalEvent
+	if err := json.Unmarshal(event.Payload, &signal); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if !rtcSignalKinds[signal.Kind] {
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidSignal, signal.Kind)
+	}
+	if signal.To == "" && signal.ToClient == "" {
+		return fmt.Errorf("%w: to or to_client is needed", ErrInvalidSignal)
+	}
+
+	to, toClient := signal.To, signal.ToClient
+	room := m.roomOf(c)
+	signal.To, signal.ToClient = "", ""
+	signal.Room, signal.From, signal.FromClient = room, c.username, c.id
+	data, err := json.Marshal(signal)
+	if err != nil {
+		return err
+	}
+	outgoing := Event{Type: EventRTCSignal, Payload: data}
+
+	m.RLock()
+	defer m.RUnlock()
+	delivered := 0
+	for client := range m.members[room] {
+		if client == c || (toClient != "" && client.id != toClient) || (to != "" && client.username != to) {
+			continue
+		}
+		// Signals are only useful right away, they are never sent again
+		if client.enqueue(outgoing) {
+			delivered++
+		}
+	}
+	if delivered == 0 {
+		return fmt.Errorf("%w: %s%s", ErrPeerNotFound, to, toClient)
+	}
+	return nil
+}
+
+// turnCredentials returns a TURN username and credential for the user that work
+// until the expiry, see the TURN REST API
+func turnCredentials(secret, username string, expires time.Time) (string, string) {
+	user := strconv.FormatInt(expires.Unix(), 10) + ":" + username
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(user))
+	return user, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// GetICEServersHandler answers with the STUN servers and TURN credentials for the client
+func GetICEServersHandler(event Event, c *Client) error {
+	m := c.manager
+	config := m.config().WebRTC
+	if !config.Enabled {
+		return ErrWebRTCDisabled
+	}
+
+	response := ICEServersEvent{ICEServers: []ICEServer{}}
+	if len(config.STUNURLs) > 0 {
+		response.ICEServers = append(response.ICEServers, ICEServer{URLs: config.STUNURLs})
+	}
+	if turn := config.TURN; turn.Secret != "" && len(turn.URLs) > 0 {
+		response.Expires = m.now().Add(time.Duration(turn.TTL)).Truncate(time.Second)
+		username, credential := turnCredentials(turn.Secret, c.username, response.Expires)
+		response.ICEServers = append(response.ICEServers, ICEServer{URLs: turn.URLs, Username: username, Credential: credential})
+	}
+	return m.replyJSON(c, EventICEServers, response)
+}
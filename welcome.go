@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// The first event every client gets is welcome, it tells the client who the server
+// resolved it to, what was negotiated for the connection and how the heartbeat
+// works, so a client doesn't have to guess any of it. The clocks of clients are
+// often off by seconds, which messes up the order of timestamps shown next to each
+// other, so clients can measure their offset with time_sync like NTP does.
+
+const (
+	// EventWelcome is the first event sent to every client
+	EventWelcome = "welcome"
+	// EventTimeSync is sent by a client to measure its clock offset, the server
+	// answers with a time_sync event of its own
+	EventTimeSync = "time_sync"
+)
+
+// WelcomeEvent is the payload sent in the
+// welcome event
+type WelcomeEvent struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	// DeviceID is kept by the client and sent as ?device= on the next connect, it
+	// is empty for clients connected with an API key
+	DeviceID string `json:"device_id,omitempty"`
+	// APIKeyID is set for clients connected with an API key
+	APIKeyID string `json:"api_key_id,omitempty"`
+	Operator bool   `json:"operator,omitempty"`
+	// Room is the room the client starts in
+	Room string `json:"room"`
+
+	// ServerTime is when the welcome was sent, good enough for a first guess of the offset
+	ServerTime time.Time `json:"server_time"`
+	// Region is the configured region of the instance, empty if not set
+	Region string `json:"region,omitempty"`
+	// Flags are the feature flags granted to the client, see flags.go
+	Flags []string `json:"flags,omitempty"`
+	// Locale is the locale the messages of the server are in, see localize.go
+	Locale string `json:"locale,omitempty"`
+
+	Protocol  WelcomeProtocol  `json:"protocol"`
+	Heartbeat WelcomeHeartbeat `json:"heartbeat"`
+}
+
+// WelcomeProtocol is what was negotiated for the connection
+type WelcomeProtocol struct {
+	// Subprotocol selects the codec and the version of the protocol
+	Subprotocol string `json:"subprotocol"`
+	Version     int    `json:"version"`
+	// Batch is set when events can arrive as a JSON array of events
+	Batch bool `json:"batch,omitempty"`
+	// QoS is set when events have to be acked
+	QoS bool `json:"qos,omitempty"`
+	// MaxMessageSize is the largest message in bytes the client may send
+	MaxMessageSize int `json:"max_message_size"`
+	// MaxDocMessageSize is the largest document event, set if documents are enabled, see docs.go
+	MaxDocMessageSize int `json:"max_doc_message_size,omitempty"`
+	// MaxSignalSize is the largest rtc_signal event, set if WebRTC signaling is enabled, see webrtc.go
+	MaxSignalSize int `json:"max_signal_size,omitempty"`
+	// MaxChunkSize is the largest data of a chunk, set if streams are enabled, see stream.go
+	MaxChunkSize int `json:"max_chunk_size,omitempty"`
+	// Capabilities are the ones in effect once the client sent hello, see capabilities.go
+	Capabilities *ClientCapabilities `json:"capabilities,omitempty"`
+}
+
+// WelcomeHeartbeat tells the client how the server checks that it is alive
+type WelcomeHeartbeat struct {
+	// PingInterval is how often the server pings, the client has to answer within PongWait
+	PingInterval Duration `json:"ping_interval"`
+	PongWait     Duration `json:"pong_wait"`
+	// Adaptive is set when the ping interval changes with how well the connection does,
+	// PingInterval is then only the first one
+	Adaptive bool `json:"adaptive,omitempty"`
+	// Keepalive is set when liveness is checked with TCP keepalives instead of pings
+	Keepalive bool `json:"keepalive,omitempty"`
+}
+
+// TimeSyncEvent is the payload sent in the
+// time_sync event, the client sends ClientTime and gets it back with the times of
+// the server. With t0 the ClientTime and t3 when the answer arrived, the offset of
+// the server clock is ((Received - t0) + (Sent - t3)) / 2 and the round trip time is
+// (t3 - t0) - (Sent - Received)
+type TimeSyncEvent struct {
+	// ClientTime is echoed as it was sent, in whatever format the client likes
+	ClientTime json.RawMessage `json:"client_time,omitempty"`
+	// Received is when the server got the time_sync, Sent when it answered
+	Received time.Time `json:"received"`
+	Sent     time.Time `json:"sent"`
+}
+
+// sendWelcome tells a new client who it is and how the connection works
+// Only call it while holding the manager lock, like client.send
+func (m *Manager) sendWelcome(client *Client) {
+	config := m.config()
+	welcome := WelcomeEvent{
+		ClientID:   client.id,
+		Username:   client.username,
+		DeviceID:   client.deviceID,
+		Operator:   m.allowed(client, PermissionOperator),
+		Room:       client.room,
+		ServerTime: m.now(),
+		Region:     config.Region,
+		Flags:      client.flags,
+		Locale:     m.effectiveLocale(client),
+		Protocol: WelcomeProtocol{
+			Subprotocol:    client.protocol.Name,
+			Version:        client.protocol.Version,
+			Batch:          client.batch.Load(),
+			QoS:            client.qos != nil,
+			MaxMessageSize: maxMessageSize,
+			Capabilities:   client.effectiveCapabilities(),
+		},
+		Heartbeat: WelcomeHeartbeat{
+			PingInterval: Duration(client.currentPingInterval()),
+			PongWait:     Duration(config.pongWait()),
+			Adaptive:     config.AdaptivePing.Enabled && !client.netpoll,
+			Keepalive:    client.netpoll,
+		},
+	}
+	if client.apiKey != nil {
+		welcome.APIKeyID = client.apiKey.ID
+	}
+	if config.Docs.Enabled {
+		welcome.Protocol.MaxDocMessageSize = m.eventLimit(EventDocUpdate)
+	}
+	if config.WebRTC.Enabled {
+		welcome.Protocol.MaxSignalSize = m.eventLimit(EventRTCSignal)
+	}
+	if config.Streams.Enabled {
+		welcome.Protocol.MaxChunkSize = config.Streams.maxChunkSize()
+	}
+
+	data, err := json.Marshal(welcome)
+	if err != nil {
+		log.Println("failed to marshal welcome: ", err)
+		return
+	}
+	// The welcome belongs to this connection, qos must not send it again on the next one
+	client.enqueue(Event{Type: EventWelcome, Payload: data})
+}
+
+// TimeSyncHandler answers a time_sync with the time of the server
+func TimeSyncHandler(event Event, c *Client) error {
+	received := c.manager.now()
+
+	var sync TimeSyncEvent
+	if err := json.Unmarshal(event.Payload, &sync); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	data, err := json.Marshal(TimeSyncEvent{ClientTime: sync.ClientTime, Received: received, Sent: c.manager.now()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal time_sync: %v", err)
+	}
+	// The answer skips the queue, waiting behind other events would skew the round trip
+	c.manager.RLock()
+	defer c.manager.RUnlock()
+	if _, ok := c.manager.clients[c]; ok {
+		c.enqueuePriority(Event{Type: EventTimeSync, Payload: data})
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// Handlers normally run on the read goroutine of the client, so a slow handler
+// stops that client from reading anything else, including pongs. With a worker
+// pool configured, handlers run on bounded pools of workers instead, one pool
+// per event type so a slow event type can't starve the others.
+
+// Overflow policies of the worker pools, used when a queue is full
+const (
+	// OverflowBlock makes the read goroutine wait for room in the queue
+	OverflowBlock = "block"
+	// OverflowDrop drops the event and tells the client with an error event
+	OverflowDrop = "drop"
+)
+
+// workerPool runs jobs on a fixed number of workers
+type workerPool struct {
+	// ctx stops the workers, and with them submitting jobs that wait for room
+	ctx context.Context
+	// queues holds a single queue shared by all workers, or one queue per worker when ordered
+	queues   []chan func()
+	overflow string
+
+	processed atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+// workerPoolStats is a snapshot of the metrics of a worker pool
+type workerPoolStats struct {
+	Workers    int    `json:"workers"`
+	QueueDepth int    `json:"queue_depth"`
+	Processed  uint64 `json:"processed"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+// newWorkerPool starts size workers that run until the ctx is done
+// When ordered is set, jobs submitted with the same key always run on the same
+// worker, in the order they were submitted
+func newWorkerPool(ctx context.Context, size, queueSize int, ordered bool, overflow string) *workerPool {
+	p := &workerPool{ctx: ctx, overflow: overflow}
+
+	if ordered {
+		for range size {
+			queue := make(chan func(), queueSize)
+			p.queues = append(p.queues, queue)
+			go p.work(ctx, queue)
+		}
+		return p
+	}
+
+	queue := make(chan func(), queueSize)
+	p.queues = append(p.queues, queue)
+	for range size {
+		go p.work(ctx, queue)
+	}
+	return p
+}
+
+// work runs jobs from the queue, it is blocking so run it as a goroutine
+func (p *workerPool) work(ctx context.Context, queue chan func()) {
+	for {
+		select {
+		case job := <-queue:
+			job()
+			p.processed.Add(1)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// submit queues the job, false is returned if it was dropped because the queue is full,
+// or with OverflowBlock because the workers stopped while it waited for room
+func (p *workerPool) submit(key string, job func()) bool {
+	queue := p.queues[0]
+	if len(p.queues) > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		queue = p.queues[h.Sum32()%uint32(len(p.queues))]
+	}
+
+	if p.overflow == OverflowBlock {
+		select {
+		case queue <- job:
+			return true
+		case <-p.ctx.Done():
+			p.dropped.Add(1)
+			return false
+		}
+	}
+
+	select {
+	case queue <- job:
+		return true
+	default:
+		p.dropped.Add(1)
+		return false
+	}
+}
+
+// stats returns the current metrics of the pool
+func (p *workerPool) stats(workers int) workerPoolStats {
+	depth := 0
+	for _, queue := range p.queues {
+		depth += len(queue)
+	}
+	return workerPoolStats{
+		Workers:    workers,
+		QueueDepth: depth,
+		Processed:  p.processed.Load(),
+		Dropped:    p.dropped.Load(),
+	}
+}
+
+// handlerPools holds the worker pools handlers run on, created lazily per event type
+type handlerPools struct {
+	ctx    context.Context
+	config WorkerPoolConfig
+
+	sync.Mutex
+	pools map[string]*workerPool
+}
+
+func newHandlerPools(ctx context.Context, config WorkerPoolConfig) *handlerPools {
+	return &handlerPools{ctx: ctx, config: config, pools: make(map[string]*workerPool)}
+}
+
+// poolKey returns the pool an event type runs on, with per client ordering all
+// event types share one pool, otherwise events from one client could overtake each other
+func (h *handlerPools) poolKey(eventType string) string {
+	if h.config.PerClientOrdering {
+		return ""
+	}
+	return eventType
+}
+
+// size returns the number of workers of the pool for the event type
+func (h *handlerPools) size(key string) int {
+	if size, ok := h.config.PerType[key]; ok && size > 0 {
+		return size
+	}
+	return h.config.Size
+}
+
+// pool returns the worker pool for the event type, creating it if needed
+func (h *handlerPools) pool(eventType string) *workerPool {
+	key := h.poolKey(eventType)
+
+	h.Lock()
+	defer h.Unlock()
+
+	p, ok := h.pools[key]
+	if !ok {
+		p = newWorkerPool(h.ctx, h.size(key), h.config.QueueSize, h.config.PerClientOrdering, h.config.Overflow)
+		h.pools[key] = p
+	}
+	return p
+}
+
+// stats returns the metrics of all pools keyed by event type
+func (h *handlerPools) stats() map[string]workerPoolStats {
+	h.Lock()
+	defer h.Unlock()
+
+	stats := make(map[string]workerPoolStats, len(h.pools))
+	for key, p := range h.pools {
+		stats[key] = p.stats(h.size(key))
+	}
+	return stats
+}
+
+// dispatchEvent routes the event, on a worker pool if one is configured or on the
+// calling goroutine otherwise
+func (m *Manager) dispatchEvent(event Event, c *Client) {
+	event, ok := m.transformIngress(event, c)
+	if !ok {
+		return
+	}
+	if m.handlerPools == nil {
+		if err := m.reouteEvent(event, c); err != nil {
+			log.Println("Error handling Message: ", err)
+		}
+		return
+	}
+
+	ok = m.handlerPools.pool(event.Type).submit(c.id, func() {
+		if err := m.reouteEvent(event, c); err != nil {
+			log.Println("Error handling Message: ", err)
+		}
+	})
+	if !ok {
+		log.Printf("handler queue full, dropping %s event from client %s", event.Type, c.id)
+		m.sendError(c, "overloaded", map[string]string{"type": event.Type})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBlockingSubmitStopsWithTheWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := newWorkerPool(ctx, 1, 1, false, OverflowBlock)
+
+	// The worker is busy and the queue is full, so the next job waits for room
+	release := make(chan struct{})
+	defer close(release)
+	pool.submit("a", func() { <-release })
+	for len(pool.queues[0]) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	pool.submit("a", func() {})
+
+	submitted := make(chan bool)
+	go func() { submitted <- pool.submit("a", func() {}) }()
+	select {
+	case <-submitted:
+		t.Fatal("the job didn't wait for room in the queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case ok := <-submitted:
+		if ok {
+			t.Error("the job was queued for workers that stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("submitting still waits after the workers stopped")
+	}
+	if stats := pool.stats(1); stats.Dropped != 1 {
+		t.Errorf("%d jobs dropped, want 1", stats.Dropped)
+	}
+}
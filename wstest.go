@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+
+	"arti.soft/websockets-go/wstest"
+)
+
+// The test harness of package wstest runs against a Manager with NewTestServer,
+// clients connect to it over wstest.Conn, so handlers can be exercised end to end
+// without a network or the HTTP login:
+//
+//	server, _, _ := NewTestServer(DefaultConfig())
+//	defer server.Close()
+//	alice := server.Connect("alice")
+//	alice.Send(EventSendMessage, SendMessageEvent{Message: "hi"})
+//	event, err := alice.Expect(EventNewMessage, time.Second)
+
+// testAcceptor connects the clients of a wstest.Server to the Manager
+type testAcceptor struct {
+	m      *Manager
+	cancel context.CancelFunc
+}
+
+// NewTestServer creates a Manager with the config and a wstest.Server connected to
+// it, the store and audit log are kept in memory unless the config sets paths. Pass
+// WithClock(NewManualClock(...)) to control the time the Manager sees
+func NewTestServer(config Config, options ...ManagerOption) (*wstest.Server, *Manager, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m, err := NewManager(ctx, config, options...)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return wstest.NewServer(&testAcceptor{m: m, cancel: cancel}), m, nil
+}
+
+func (a *testAcceptor) Accept(conn *wstest.Conn, username string) (string, wstest.Codec) {
+	client := NewClient(conn, a.m, username)
+	a.m.startClient(client)
+	return client.id, frontendCodec{client.codec}
+}
+
+func (a *testAcceptor) OTP(username string) string {
+	return a.m.newOTP(username).Key
+}
+
+// Close disconnects all clients and stops the background work of the Manager
+func (a *testAcceptor) Close() {
+	a.m.RLock()
+	clients := make([]*Client, 0, len(a.m.clients))
+	for client := range a.m.clients {
+		clients = append(clients, client)
+	}
+	a.m.RUnlock()
+
+	for _, client := range clients {
+		a.m.removeClient(client)
+	}
+	a.cancel()
+}
+
+// frontendCodec is a Codec of the server as a wstest.Codec, the events of the
+// frontend have no room or timestamp
+type frontendCodec struct {
+	codec Codec
+}
+
+func (c frontendCodec) Encode(event wstest.Event) (int, []byte, error) {
+	return c.codec.Encode(Event{ID: event.ID, Type: event.Type, Payload: event.Payload})
+}
+
+func (c frontendCodec) Decode(messageType int, data []byte) (wstest.Event, error) {
+	event, err := c.codec.Decode(messageType, data)
+	return wstest.Event{ID: event.ID, Type: event.Type, Payload: event.Payload}, err
+}
@@ -0,0 +1,158 @@
+package wstest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"arti.soft/websockets-go/client"
+	"github.com/gorilla/websocket"
+)
+
+// Timeout is how long the Expect helpers wait when no timeout is given
+var Timeout = 2 * time.Second
+
+// Event is an event as the frontend sees it
+type Event = client.Event
+
+// Codec translates the events of a Client to and from websocket messages, the
+// server under test picks it by the subprotocol
+type Codec interface {
+	Encode(event Event) (int, []byte, error)
+	Decode(messageType int, data []byte) (Event, error)
+}
+
+// JSONCodec sends events as JSON text messages, the default protocol
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(event Event) (int, []byte, error) {
+	data, err := json.Marshal(event)
+	return websocket.TextMessage, data, err
+}
+
+func (JSONCodec) Decode(_ int, data []byte) (Event, error) {
+	var event Event
+	err := json.Unmarshal(data, &event)
+	return event, err
+}
+
+// MessageConn is the connection a Client reads and writes, *Conn and
+// *websocket.Conn implement it
+type MessageConn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// Client is the frontend side of a connection to the server under test
+type Client struct {
+	ID       string
+	Username string
+
+	conn  MessageConn
+	codec Codec
+	// seen holds the events read while waiting for another type
+	seen []Event
+}
+
+// NewClient returns a client for the user reading and writing conn, a nil codec is JSONCodec
+func NewClient(conn MessageConn, username string, codec Codec) *Client {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &Client{Username: username, conn: conn, codec: codec}
+}
+
+// Send sends an event, the payload is marshalled to JSON
+func (c *Client) Send(eventType string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.SendEvent(Event{Type: eventType, Payload: data})
+}
+
+// SendEvent sends the event as is
+func (c *Client) SendEvent(event Event) error {
+	messageType, data, err := c.codec.Encode(event)
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// Receive returns the next event sent to the client, including the ones skipped by Expect
+func (c *Client) Receive(timeout time.Duration) (Event, error) {
+	if len(c.seen) > 0 {
+		event := c.seen[0]
+		c.seen = c.seen[1:]
+		return event, nil
+	}
+	return c.read(timeout)
+}
+
+// read reads the next event from the connection
+func (c *Client) read(timeout time.Duration) (Event, error) {
+	if timeout <= 0 {
+		timeout = Timeout
+	}
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	messageType, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return Event{}, err
+	}
+	return c.codec.Decode(messageType, data)
+}
+
+// Expect waits for an event of the type, events of other types are kept for Receive
+func (c *Client) Expect(eventType string, timeout time.Duration) (Event, error) {
+	for i, event := range c.seen {
+		if event.Type == eventType {
+			c.seen = append(c.seen[:i], c.seen[i+1:]...)
+			return event, nil
+		}
+	}
+
+	for {
+		event, err := c.read(timeout)
+		if err != nil {
+			return Event{}, fmt.Errorf("waiting for %s, got %d other events: %w", eventType, len(c.seen), err)
+		}
+		if event.Type == eventType {
+			return event, nil
+		}
+		c.seen = append(c.seen, event)
+	}
+}
+
+// ExpectPayload waits for an event of the type and unmarshals its payload into v
+func (c *Client) ExpectPayload(eventType string, v any, timeout time.Duration) error {
+	event, err := c.Expect(eventType, timeout)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(event.Payload, v)
+}
+
+// ExpectNone returns an error if an event of the type arrives within d
+func (c *Client) ExpectNone(eventType string, d time.Duration) error {
+	event, err := c.Expect(eventType, d)
+	if err != nil {
+		// Only a timeout is expected, a closed connection fails the check too
+		if errors.Is(err, ErrTimeout) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("unexpected %s event: %s", eventType, event.Payload)
+}
+
+// Close disconnects the client
+func (c *Client) Close() {
+	c.conn.Close()
+}
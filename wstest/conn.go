@@ -0,0 +1,181 @@
+package wstest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrClosed          = errors.New("transport closed")
+	ErrTimeout         = errors.New("transport read deadline exceeded")
+	ErrMessageTooLarge = errors.New("message exceeds the read limit")
+)
+
+// pipeBufferSize is how many messages a direction of a Pipe holds before writes block
+var pipeBufferSize = 256
+
+// message is a single websocket message on a Conn
+type message struct {
+	messageType int
+	data        []byte
+}
+
+// pipe is one direction of a Conn pair
+type pipe struct {
+	messages chan message
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newPipe() *pipe {
+	return &pipe{messages: make(chan message, pipeBufferSize), closed: make(chan struct{})}
+}
+
+func (p *pipe) close() {
+	p.once.Do(func() { close(p.closed) })
+}
+
+// Conn is an in-memory websocket connection, created in pairs by Pipe. It has the
+// methods of *websocket.Conn the server reads and writes with
+// Pings are answered by the reading side like a browser would do
+type Conn struct {
+	in  *pipe
+	out *pipe
+
+	subprotocol string
+
+	lock        sync.Mutex
+	readLimit   int64
+	deadline    time.Time
+	pongHandler func(string) error
+}
+
+// Pipe returns two connections connected to each other, speaking the subprotocol
+func Pipe(subprotocol string) (*Conn, *Conn) {
+	a, b := newPipe(), newPipe()
+	return &Conn{in: a, out: b, subprotocol: subprotocol}, &Conn{in: b, out: a, subprotocol: subprotocol}
+}
+
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	for {
+		c.lock.Lock()
+		deadline, limit := c.deadline, c.readLimit
+		c.lock.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		stop := func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+
+		select {
+		case msg := <-c.in.messages:
+			stop()
+			if limit > 0 && int64(len(msg.data)) > limit {
+				c.Close()
+				return 0, nil, ErrMessageTooLarge
+			}
+
+			switch msg.messageType {
+			case websocket.PingMessage:
+				c.WriteMessage(websocket.PongMessage, msg.data)
+				continue
+			case websocket.PongMessage:
+				c.lock.Lock()
+				handler := c.pongHandler
+				c.lock.Unlock()
+				if handler != nil {
+					if err := handler(string(msg.data)); err != nil {
+						return 0, nil, err
+					}
+				}
+				continue
+			case websocket.CloseMessage:
+				c.Close()
+				return 0, nil, closeError(msg.data)
+			}
+			return msg.messageType, msg.data, nil
+		case <-c.in.closed:
+			stop()
+			return 0, nil, ErrClosed
+		case <-timeout:
+			// Unlike a websocket the connection stays usable, the reader decides what to do
+			return 0, nil, ErrTimeout
+		}
+	}
+}
+
+// closeError returns the error ReadMessage of *websocket.Conn returns for the
+// body of a close frame
+func closeError(frame []byte) *websocket.CloseError {
+	if len(frame) < 2 {
+		return &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+	}
+	return &websocket.CloseError{Code: int(frame[0])<<8 | int(frame[1]), Text: string(frame[2:])}
+}
+
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-c.out.closed:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case c.out.messages <- message{messageType: messageType, data: append([]byte(nil), data...)}:
+		return nil
+	case <-c.out.closed:
+		return ErrClosed
+	}
+}
+
+func (c *Conn) SetReadLimit(limit int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readLimit = limit
+}
+
+func (c *Conn) SetReadDeadline(deadline time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = deadline
+	return nil
+}
+
+func (c *Conn) SetPongHandler(h func(string) error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pongHandler = h
+}
+
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Close closes both directions, so the other side sees the connection as closed too
+func (c *Conn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+// Closed returns true once either side closed the connection
+func (c *Conn) Closed() bool {
+	select {
+	case <-c.in.closed:
+		return true
+	case <-c.out.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,59 @@
+// Package wstest runs test clients against the chat server without a network or
+// the HTTP login. Clients are connected over Conn, an in-memory websocket
+// connection, so handlers can be exercised end to end from tests and tools:
+//
+//	server, manager, _ := NewTestServer(DefaultConfig()) // in package main
+//	defer server.Close()
+//	alice := server.Connect("alice")
+//	alice.Send("send_message", map[string]string{"message": "hi"})
+//	event, err := alice.Expect("new_message", time.Second)
+//
+// A Client also reads and writes a *websocket.Conn, for tests against a real
+// server.
+package wstest
+
+// Acceptor takes the server side of the connections of a Server, the server
+// under test implements it
+type Acceptor interface {
+	// Accept starts a client of the user reading and writing conn, it returns the
+	// id of the client and the codec of the subprotocol of conn
+	Accept(conn *Conn, username string) (id string, codec Codec)
+	// OTP returns a valid OTP for the user, as if the user had logged in
+	OTP(username string) string
+	// Close disconnects all clients and stops the server
+	Close()
+}
+
+// Server connects clients to an Acceptor
+type Server struct {
+	acceptor Acceptor
+}
+
+// NewServer returns a Server connecting clients to the acceptor
+func NewServer(acceptor Acceptor) *Server {
+	return &Server{acceptor: acceptor}
+}
+
+// OTP returns a valid OTP for the user, as if the user had logged in
+func (s *Server) OTP(username string) string {
+	return s.acceptor.OTP(username)
+}
+
+// Connect connects a client for the user, skipping the login and OTP
+func (s *Server) Connect(username string) *Client {
+	return s.ConnectWith(username, "")
+}
+
+// ConnectWith connects a client for the user speaking the subprotocol, like "proto"
+func (s *Server) ConnectWith(username, subprotocol string) *Client {
+	server, peer := Pipe(subprotocol)
+	id, codec := s.acceptor.Accept(server, username)
+	client := NewClient(peer, username, codec)
+	client.ID = id
+	return client
+}
+
+// Close disconnects all clients and stops the server
+func (s *Server) Close() {
+	s.acceptor.Close()
+}
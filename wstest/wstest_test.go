@@ -0,0 +1,170 @@
+package wstest
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoAcceptor answers every event with an echo event of the same payload
+type echoAcceptor struct {
+	accepted []*Conn
+	closed   bool
+}
+
+func (a *echoAcceptor) Accept(conn *Conn, username string) (string, Codec) {
+	a.accepted = append(a.accepted, conn)
+	go func() {
+		codec := JSONCodec{}
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			event, err := codec.Decode(messageType, data)
+			if err != nil {
+				return
+			}
+			_, reply, _ := codec.Encode(Event{Type: "echo", Payload: event.Payload})
+			conn.WriteMessage(websocket.TextMessage, reply)
+		}
+	}()
+	return username + "-1", JSONCodec{}
+}
+
+func (a *echoAcceptor) OTP(username string) string {
+	return "otp-" + username
+}
+
+func (a *echoAcceptor) Close() {
+	a.closed = true
+	for _, conn := range a.accepted {
+		conn.Close()
+	}
+}
+
+func TestServerConnect(t *testing.T) {
+	acceptor := &echoAcceptor{}
+	server := NewServer(acceptor)
+	alice := server.Connect("alice")
+	if alice.ID != "alice-1" || alice.Username != "alice" {
+		t.Errorf("client is %q of %q, want alice-1 of alice", alice.ID, alice.Username)
+	}
+	if otp := server.OTP("alice"); otp != "otp-alice" {
+		t.Errorf("OTP is %q", otp)
+	}
+
+	if err := alice.Send("hello", map[string]string{"text": "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]string
+	if err := alice.ExpectPayload("echo", &payload, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if payload["text"] != "hi" {
+		t.Errorf("echo payload is %v", payload)
+	}
+
+	server.Close()
+	if !acceptor.closed {
+		t.Error("Close didn't close the acceptor")
+	}
+	if _, err := alice.Receive(time.Second); !errors.Is(err, ErrClosed) {
+		t.Errorf("receive after Close: %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestClientExpectKeepsOtherEvents(t *testing.T) {
+	server, peer := Pipe("")
+	client := NewClient(peer, "alice", nil)
+	for _, eventType := range []string{"first", "second", "third"} {
+		_, data, _ := JSONCodec{}.Encode(Event{Type: eventType, Payload: json.RawMessage(`{}`)})
+		server.WriteMessage(websocket.TextMessage, data)
+	}
+
+	if _, err := client.Expect("third", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "second"} {
+		event, err := client.Receive(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != want {
+			t.Errorf("received %s, want %s", event.Type, want)
+		}
+	}
+	if err := client.ExpectNone("first", 10*time.Millisecond); err != nil {
+		t.Errorf("ExpectNone without events: %v", err)
+	}
+
+	server.Close()
+	if err := client.ExpectNone("first", 10*time.Millisecond); !errors.Is(err, ErrClosed) {
+		t.Errorf("ExpectNone on a closed connection: %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestConnDeadline(t *testing.T) {
+	a, _ := Pipe("")
+	a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := a.ReadMessage(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("read past the deadline: %v, want %v", err, ErrTimeout)
+	}
+	// The connection stays usable after a timeout
+	if a.Closed() {
+		t.Error("timeout closed the connection")
+	}
+}
+
+func TestConnReadLimit(t *testing.T) {
+	a, b := Pipe("")
+	a.SetReadLimit(4)
+	b.WriteMessage(websocket.TextMessage, []byte("too long"))
+	if _, _, err := a.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("read of a large message: %v, want %v", err, ErrMessageTooLarge)
+	}
+	if !b.Closed() {
+		t.Error("the other side didn't see the close")
+	}
+}
+
+func TestConnPingPong(t *testing.T) {
+	a, b := Pipe("")
+	pongs := make(chan string, 1)
+	a.SetPongHandler(func(data string) error {
+		pongs <- data
+		return nil
+	})
+	a.WriteMessage(websocket.PingMessage, []byte("ping"))
+	// b answers the ping while it reads
+	go b.ReadMessage()
+	go a.ReadMessage()
+	select {
+	case data := <-pongs:
+		if data != "ping" {
+			t.Errorf("pong carries %q, want ping", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no pong")
+	}
+	a.Close()
+}
+
+func TestConnCloseFrame(t *testing.T) {
+	a, b := Pipe("chat.v1.json")
+	if a.Subprotocol() != "chat.v1.json" {
+		t.Errorf("subprotocol is %q", a.Subprotocol())
+	}
+	b.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "token expired"))
+	_, _, err := a.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != 4001 || closeErr.Text != "token expired" {
+		t.Fatalf("read of a close frame: %v", err)
+	}
+	if err := b.WriteMessage(websocket.TextMessage, nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("write after close: %v, want %v", err, ErrClosed)
+	}
+}
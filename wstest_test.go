@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTestServerBroadcast(t *testing.T) {
+	server, m, err := NewTestServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	alice := server.Connect("alice")
+	bob := server.ConnectWith("bob", "proto")
+	for _, c := range []string{alice.ID, bob.ID} {
+		if _, ok := m.clientByID(c); !ok {
+			t.Fatalf("client %s is not connected", c)
+		}
+	}
+	if _, err := bob.Expect(EventWelcome, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := alice.Send(EventSendMessage, SendMessageEvent{Message: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	// bob speaks protobuf, the codec of the server translates for the client
+	var message NewMessageEvent
+	if err := bob.ExpectPayload(EventNewMessage, &message, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if message.Message != "hi" || message.From != "alice" {
+		t.Errorf("bob got %q from %q", message.Message, message.From)
+	}
+	if err := alice.ExpectNone(EventError, 50*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTestServerOTP(t *testing.T) {
+	server, m, err := NewTestServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	otp, ok := m.verifyOTP(server.OTP("alice"))
+	if !ok || otp.Username != "alice" {
+		t.Errorf("OTP of the test server is %+v, %v", otp, ok)
+	}
+}